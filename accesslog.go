@@ -0,0 +1,222 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogConfig configures the access log of requests to Thing's public
+// and private web servers.  A WebSocket, or Server-Sent Events stream, is
+// logged when it closes, with how long it was open.
+type AccessLogConfig struct {
+
+	// File access log entries are appended to, or "-" for standard
+	// output.  Access logging is disabled if File is empty, unless an
+	// AccessLogger is set (see Thing.SetAccessLogger).  The default is "".
+	File string
+
+	// Format of the entries: "common", the Common Log Format with the
+	// request's duration, in milliseconds, appended; or "json", an
+	// AccessEntry per line.  The default is "common".
+	Format string
+}
+
+// Access log formats
+const (
+	AccessLogCommon = "common"
+	AccessLogJSON   = "json"
+)
+
+// AccessEntry is a request to one of Thing's web servers
+type AccessEntry struct {
+	Time time.Time
+	// "public" or "private"
+	Server string
+	// Client's address; behind a trusted proxy, from X-Forwarded-For
+	Remote string
+	// Basic auth user, if any
+	User   string `json:",omitempty"`
+	Method string
+	URI    string
+	Proto  string
+	// Response status; 101 for a WebSocket
+	Status int
+	// Response body bytes
+	Bytes int64
+	// From request to response, or how long a WebSocket was open
+	Duration  time.Duration
+	Referer   string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+}
+
+// AccessLogger logs requests to Thing's web servers.  The default
+// AccessLogger writes Cfg.AccessLog.File; use Thing.SetAccessLogger for
+// another format or destination.  LogAccess is called from the request's
+// goroutine.
+type AccessLogger interface {
+	LogAccess(e AccessEntry)
+}
+
+type accessLogger struct {
+	sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewAccessLogger returns an AccessLogger writing entries to w in format
+// AccessLogCommon or AccessLogJSON.
+func NewAccessLogger(w io.Writer, format string) (AccessLogger, error) {
+	switch format {
+	case "":
+		format = AccessLogCommon
+	case AccessLogCommon, AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("Access log format must be \"%s\" or \"%s\"",
+			AccessLogCommon, AccessLogJSON)
+	}
+	return &accessLogger{w: w, format: format}, nil
+}
+
+// Default AccessLogger, for cfg
+func newFileAccessLogger(cfg AccessLogConfig) (AccessLogger, error) {
+	var w io.Writer = os.Stdout
+	if cfg.File != "-" {
+		f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return NewAccessLogger(w, cfg.Format)
+}
+
+// "-" for an empty field, in the Common Log Format
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (l *accessLogger) LogAccess(e AccessEntry) {
+	var line []byte
+
+	switch l.format {
+	case AccessLogJSON:
+		line, _ = json.Marshal(&e)
+	default:
+		host := e.Remote
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		line = []byte(fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d %d`,
+			clfField(host), clfField(e.User),
+			e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method, e.URI, e.Proto, e.Status, e.Bytes,
+			e.Duration.Milliseconds()))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.w.Write(append(line, '\n'))
+}
+
+// SetAccessLogger sets the AccessLogger for Thing's web servers.
+// SetAccessLogger overrides Cfg.AccessLog.  Call SetAccessLogger before
+// thing.Run().
+func (t *Thing) SetAccessLogger(l AccessLogger) {
+	t.accessLog = l
+}
+
+// Response writer noting the status and size of the response
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Server-Sent Events, gRPC, and GraphQL subscriptions flush
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// WebSocket upgrades hijack the connection
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijack not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Log requests to next, on server, to Thing's AccessLogger, if any
+func (t *Thing) logAccess(server string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := t.accessLog
+		if logger == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+
+		user, _, _ := r.BasicAuth()
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		logger.LogAccess(AccessEntry{
+			Time:      start,
+			Server:    server,
+			Remote:    t.clientAddr(r),
+			User:      user,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    status,
+			Bytes:     aw.bytes,
+			Duration:  time.Since(start),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
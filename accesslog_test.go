@@ -0,0 +1,142 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type accessRecorder struct {
+	sync.Mutex
+	entries []AccessEntry
+}
+
+func (a *accessRecorder) LogAccess(e AccessEntry) {
+	a.Lock()
+	defer a.Unlock()
+	a.entries = append(a.entries, e)
+}
+
+// Wait for n entries
+func (a *accessRecorder) wait(n int) []AccessEntry {
+	for i := 0; i < 100; i++ {
+		a.Lock()
+		if len(a.entries) >= n {
+			entries := append([]AccessEntry{}, a.entries...)
+			a.Unlock()
+			return entries
+		}
+		a.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	thing := NewThing(&dashboard{html: "home"})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	rec := &accessRecorder{}
+	thing.SetAccessLogger(rec)
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(thing.web.public.handler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/"+testId+"?x=1", nil)
+	req.SetBasicAuth("alice", "pw")
+	req.Header.Set("User-Agent", "test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/" + testId
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	entries := rec.wait(2)
+	if len(entries) != 2 {
+		t.Fatalf("Entries %+v", rec.entries)
+	}
+
+	home := entries[0]
+	if home.Server != "public" || home.Method != "GET" ||
+		home.URI != "/"+testId+"?x=1" || home.Status != http.StatusOK ||
+		home.Bytes != 4 || home.User != "alice" || home.UserAgent != "test" {
+		t.Errorf("Home %+v", home)
+	}
+
+	ws := entries[1]
+	if ws.URI != "/ws/"+testId || ws.Status != http.StatusSwitchingProtocols ||
+		ws.Duration < 50*time.Millisecond {
+		t.Errorf("WebSocket %+v", ws)
+	}
+
+	// Private server too
+	w := httptest.NewRecorder()
+	thing.web.private.server.Handler.ServeHTTP(w,
+		httptest.NewRequest("GET", "/errors", nil))
+	if entries := rec.wait(3); len(entries) != 3 ||
+		entries[2].Server != "private" {
+		t.Errorf("Entries %+v", entries)
+	}
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	e := AccessEntry{
+		Time:     time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC),
+		Server:   "public",
+		Remote:   "10.0.0.1:4321",
+		Method:   "GET",
+		URI:      "/garage",
+		Proto:    "HTTP/1.1",
+		Status:   200,
+		Bytes:    42,
+		Duration: 15 * time.Millisecond,
+	}
+
+	var buf bytes.Buffer
+	l, err := NewAccessLogger(&buf, AccessLogCommon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.LogAccess(e)
+	want := `10.0.0.1 - - [04/Mar/2022:05:06:07 +0000] "GET /garage HTTP/1.1" 200 42 15` + "\n"
+	if buf.String() != want {
+		t.Errorf("Got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	l, _ = NewAccessLogger(&buf, AccessLogJSON)
+	l.LogAccess(e)
+	var got AccessEntry
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got != e {
+		t.Errorf("Got %s", buf.String())
+	}
+
+	if _, err := NewAccessLogger(&buf, "xml"); err == nil {
+		t.Error("Bad format accepted")
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Parameters passed to the admin page template
+type adminPage struct {
+	Me       *AuthUser
+	Data     AuthData
+	Things   []string
+	Roles    []string
+	NewToken string
+	Err      string
+	// Path the admin page is under (see Cfg.BasePath)
+	BasePath string
+	// Claimed Things, if provisioning (see ProvisionConfig)
+	Provisioning bool
+	Claims       []Claim
+	NewBootToken string
+}
+
+// Split comma-separated form value into a list
+func formList(r *http.Request, key string) []string {
+	var list []string
+	for _, s := range strings.Split(r.FormValue(key), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Ids of the Things on this Prime or bridge, for the admin page
+func (t *Thing) thingIds() []string {
+	ids := []string{t.id}
+	if t.isBridge {
+		for _, child := range t.bridge.childThings() {
+			ids = append(ids, child.id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Admin pages are only for admins, and form posts must come from the admin
+// page itself
+func (t *Thing) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := authUser(r)
+		if u == nil || u.Role != RoleAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method == "POST" && !t.sameOrigin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (t *Thing) renderAdmin(w http.ResponseWriter, r *http.Request,
+	newToken string, err error) {
+	t.renderAdminPage(w, r, adminPage{NewToken: newToken}, err)
+}
+
+func (t *Thing) renderAdminPage(w http.ResponseWriter, r *http.Request,
+	page adminPage, err error) {
+
+	page.Me = authUser(r)
+	page.Data = t.auth.snapshot()
+	page.Things = t.thingIds()
+	page.Roles = []string{RoleAdmin, RoleOperator, RoleViewer}
+	page.BasePath = t.basePath(r)
+	if t.provision != nil {
+		page.Provisioning = true
+		page.Claims = t.provision.list()
+	}
+	if err != nil {
+		page.Err = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	if err := adminTmpl.Execute(w, &page); err != nil {
+		t.log.println("Admin page:", err)
+	}
+}
+
+// Show the admin page on GET /admin
+func (t *Thing) adminHome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t.renderAdmin(w, r, "", nil)
+}
+
+// Finish an admin form post.  On success, go back to the admin page.
+func (t *Thing) adminDone(w http.ResponseWriter, r *http.Request, err error) {
+	if err != nil {
+		t.renderAdmin(w, r, "", err)
+		return
+	}
+	http.Redirect(w, r, t.basePath(r)+"/admin", http.StatusSeeOther)
+}
+
+// Add, change, or delete a user on POST /admin/user
+func (t *Thing) adminUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		t.adminDone(w, r, fmt.Errorf("Missing user name"))
+		return
+	}
+
+	if r.FormValue("action") == "delete" {
+		err := t.auth.update(func(data *AuthData) error {
+			var users []AuthUser
+			for _, u := range data.Users {
+				if u.Name != name {
+					users = append(users, u)
+				}
+			}
+			if err := checkAdmins(users); err != nil {
+				return err
+			}
+			data.Users = users
+			// User's tokens go with the user
+			var tokens []AuthToken
+			for _, tok := range data.Tokens {
+				if tok.User != name {
+					tokens = append(tokens, tok)
+				}
+			}
+			data.Tokens = tokens
+			return nil
+		})
+		if err == nil {
+			t.log.printf("Admin %s deleted user %s",
+				authUser(r).Name, name)
+		}
+		t.adminDone(w, r, err)
+		return
+	}
+
+	user := AuthUser{
+		Name:   name,
+		Role:   r.FormValue("role"),
+		Tenant: strings.TrimSpace(r.FormValue("tenant")),
+		Grants: formList(r, "grants"),
+	}
+
+	if !validRole(user.Role) {
+		t.adminDone(w, r, fmt.Errorf("Unknown role %q", user.Role))
+		return
+	}
+
+	if passwd := r.FormValue("passwd"); passwd != "" {
+		hash, err := hashPasswd(passwd)
+		if err != nil {
+			t.adminDone(w, r, err)
+			return
+		}
+		user.PasswdHash = hash
+	}
+
+	err := t.auth.update(func(data *AuthData) error {
+		if user.Tenant != "" && findTenant(data.Tenants, user.Tenant) < 0 {
+			return fmt.Errorf("Unknown tenant %q", user.Tenant)
+		}
+		for i := range data.Users {
+			if data.Users[i].Name == name {
+				// Keep password unless a new one is given
+				if user.PasswdHash == "" {
+					user.PasswdHash = data.Users[i].PasswdHash
+				}
+				data.Users[i] = user
+				return checkAdmins(data.Users)
+			}
+		}
+		data.Users = append(data.Users, user)
+		return checkAdmins(data.Users)
+	})
+	if err == nil {
+		t.log.printf("Admin %s saved user %s", authUser(r).Name, name)
+	}
+	t.adminDone(w, r, err)
+}
+
+// Create or delete an API token on POST /admin/token.  A new token is shown
+// once, on the page returned.
+func (t *Thing) adminToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.FormValue("action") == "delete" {
+		id := r.FormValue("id")
+		err := t.auth.update(func(data *AuthData) error {
+			var tokens []AuthToken
+			for _, tok := range data.Tokens {
+				if tok.Id != id {
+					tokens = append(tokens, tok)
+				}
+			}
+			data.Tokens = tokens
+			return nil
+		})
+		if err == nil {
+			t.log.printf("Admin %s deleted token %s",
+				authUser(r).Name, id)
+		}
+		t.adminDone(w, r, err)
+		return
+	}
+
+	user := r.FormValue("user")
+	token, rec, err := newToken(user, strings.TrimSpace(r.FormValue("name")))
+	if err != nil {
+		t.adminDone(w, r, err)
+		return
+	}
+
+	err = t.auth.update(func(data *AuthData) error {
+		for _, u := range data.Users {
+			if u.Name == user {
+				data.Tokens = append(data.Tokens, rec)
+				return nil
+			}
+		}
+		return fmt.Errorf("Unknown user %q", user)
+	})
+	if err != nil {
+		t.adminDone(w, r, err)
+		return
+	}
+
+	t.log.printf("Admin %s created token %s for user %s",
+		authUser(r).Name, rec.Id, user)
+	t.renderAdmin(w, r, token, nil)
+}
+
+func findTenant(tenants []AuthTenant, name string) int {
+	for i := range tenants {
+		if tenants[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add, change, or delete a tenant on POST /admin/tenant
+func (t *Thing) adminTenant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		t.adminDone(w, r, fmt.Errorf("Missing tenant name"))
+		return
+	}
+
+	if r.FormValue("action") == "delete" {
+		err := t.auth.update(func(data *AuthData) error {
+			for _, u := range data.Users {
+				if u.Tenant == name {
+					return fmt.Errorf("Tenant %q has user %q",
+						name, u.Name)
+				}
+			}
+			if i := findTenant(data.Tenants, name); i >= 0 {
+				data.Tenants = append(data.Tenants[:i],
+					data.Tenants[i+1:]...)
+			}
+			return nil
+		})
+		t.adminDone(w, r, err)
+		return
+	}
+
+	tenant := AuthTenant{Name: name, Things: formList(r, "things")}
+
+	err := t.auth.update(func(data *AuthData) error {
+		if i := findTenant(data.Tenants, name); i >= 0 {
+			data.Tenants[i] = tenant
+		} else {
+			data.Tenants = append(data.Tenants, tenant)
+		}
+		return nil
+	})
+	if err == nil {
+		t.log.printf("Admin %s saved tenant %s", authUser(r).Name, name)
+	}
+	t.adminDone(w, r, err)
+}
+
+var adminTmpl = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<title>Admin</title>
+		<style>
+			body { font-family: sans-serif; }
+			table { border-collapse: collapse; margin-bottom: 1em; }
+			td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+			.err { color: red; }
+			.token { font-family: monospace; background: #ffd; padding: 4px; }
+		</style>
+	</head>
+	<body>
+		<p>Logged in as {{.Me.Name}}</p>
+
+		{{if .Err}}<p class="err">{{.Err}}</p>{{end}}
+
+		{{if .NewToken}}
+		<p>New API token (copy it now; it won't be shown again):</p>
+		<p class="token">{{.NewToken}}</p>
+		{{end}}
+
+		<h2>Users</h2>
+		<table>
+			<tr><th>Name</th><th>Role</th><th>Tenant</th><th>Grants</th><th>Password</th><th></th></tr>
+			{{range .Data.Users}}
+			<tr>
+				<td>{{.Name}}</td><td>{{.Role}}</td><td>{{.Tenant}}</td>
+				<td>{{join .Grants ", "}}</td>
+				<td>{{if .PasswdHash}}set{{else}}system{{end}}</td>
+				<td>
+					<form method="post" action="{{$.BasePath}}/admin/user">
+						<input type="hidden" name="name" value="{{.Name}}">
+						<button name="action" value="delete">Delete</button>
+					</form>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		<form method="post" action="{{$.BasePath}}/admin/user">
+			<input name="name" placeholder="name" required>
+			<select name="role">
+				{{range .Roles}}<option>{{.}}</option>{{end}}
+			</select>
+			<input name="tenant" placeholder="tenant">
+			<input name="grants" placeholder="grants, e.g. * or id1, id2">
+			<input name="passwd" type="password" placeholder="password (blank: system)">
+			<button name="action" value="save">Add / Update</button>
+		</form>
+
+		<h2>API Tokens</h2>
+		<table>
+			<tr><th>Id</th><th>User</th><th>Name</th><th>Created</th><th></th></tr>
+			{{range .Data.Tokens}}
+			<tr>
+				<td>{{.Id}}</td><td>{{.User}}</td><td>{{.Name}}</td>
+				<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+				<td>
+					<form method="post" action="{{$.BasePath}}/admin/token">
+						<input type="hidden" name="id" value="{{.Id}}">
+						<button name="action" value="delete">Revoke</button>
+					</form>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		<form method="post" action="{{$.BasePath}}/admin/token">
+			<input name="user" placeholder="user" required>
+			<input name="name" placeholder="description">
+			<button name="action" value="create">Create</button>
+		</form>
+
+		<h2>Tenants</h2>
+		<table>
+			<tr><th>Name</th><th>Things</th><th></th></tr>
+			{{range .Data.Tenants}}
+			<tr>
+				<td>{{.Name}}</td><td>{{join .Things ", "}}</td>
+				<td>
+					<form method="post" action="{{$.BasePath}}/admin/tenant">
+						<input type="hidden" name="name" value="{{.Name}}">
+						<button name="action" value="delete">Delete</button>
+					</form>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		<form method="post" action="{{$.BasePath}}/admin/tenant">
+			<input name="name" placeholder="name" required>
+			<input name="things" placeholder="Thing ids, e.g. id1, id2">
+			<button name="action" value="save">Add / Update</button>
+		</form>
+
+		<h2>Things</h2>
+		<p>{{join .Things ", "}}</p>
+
+		{{if .Provisioning}}
+		<h2>Claims</h2>
+		{{if .NewBootToken}}
+		<p>Boot token of the claimed Thing, for its first admin (copy it now; it won't be shown again):</p>
+		<p class="token">{{.NewBootToken}}</p>
+		{{end}}
+		<table>
+			<tr><th>Id</th><th>Name</th><th>Tags</th><th>By</th><th>Created</th><th>Provisioned</th><th></th></tr>
+			{{range .Claims}}
+			<tr>
+				<td>{{.Id}}</td><td>{{.Name}}</td><td>{{join .Tags ", "}}</td><td>{{.By}}</td>
+				<td>{{.Created.Format "2006-01-02 15:04"}}</td>
+				<td>{{if .Delivered.IsZero}}waiting{{else}}{{.Delivered.Format "2006-01-02 15:04"}}{{end}}</td>
+				<td>
+					<form method="post" action="{{$.BasePath}}/admin/claim">
+						<input type="hidden" name="id" value="{{.Id}}">
+						<button name="action" value="delete">Delete</button>
+					</form>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		<form method="post" action="{{$.BasePath}}/admin/claim">
+			<input name="code" placeholder="claim code" required>
+			<input name="id" placeholder="Id" required>
+			<input name="name" placeholder="name">
+			<input name="tags" placeholder="tags, e.g. garage, north">
+			<button name="action" value="claim">Claim</button>
+		</form>
+		{{end}}
+	</body>
+</html>
+`))
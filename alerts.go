@@ -0,0 +1,249 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertConfig is a threshold alert on a numeric field of a message Thing
+// broadcasts, such as a sensor reading.  Alerts save each Thinger from
+// hand-rolling threshold, hysteresis, and debounce logic.
+//
+// The alert is raised when Field crosses Threshold, in the direction of Op,
+// and is cleared when Field comes back past Threshold by Hysteresis.  With
+// Op ">" and Threshold 30, Hysteresis 2, the alert is raised above 30, and
+// cleared at or below 28.  Either change must hold for Debounce
+// milliseconds before it's taken.  Each raise and clear sends EventAlert to
+// Thing's Subscribers().  Get alerts with the GetAlerts message.
+//
+//	thing.Cfg.Alerts = []merle.AlertConfig{
+//		{Name: "Hot", Msg: "Update", Field: "Temperature", Op: ">",
+//			Threshold: 30, Hysteresis: 2, Debounce: 5000},
+//		{Name: "LowBattery", Msg: "Update", Field: "Power.Volts",
+//			Op: "<", Threshold: 3.3, Severity: merle.SeverityCritical},
+//	}
+type AlertConfig struct {
+	Name string
+	// Msg of the broadcast message watched
+	Msg string
+	// Numeric member of the message, with dots for nested members (e.g.
+	// "Power.Volts")
+	Field string
+	// One of >, >=, <, <=
+	Op        string
+	Threshold float64
+	// [Optional] How far back past Threshold Field must come to clear the
+	// alert.  The default is 0.
+	Hysteresis float64
+	// [Optional] Debounce time, in milliseconds.  The default is 0 (no
+	// debouncing).
+	Debounce uint
+	// [Optional] One of the Severity* values.  The default is
+	// SeverityWarning.
+	Severity string
+}
+
+type alertState struct {
+	AlertConfig
+	path    []string
+	active  bool
+	pending bool
+	timer   *time.Timer
+	value   float64
+	changed time.Time
+}
+
+type alerts struct {
+	sync.Mutex
+	thing  *Thing
+	alerts []*alertState
+	sends  chan *MsgAlert
+	done   chan bool
+}
+
+func newAlerts(thing *Thing, cfgs []AlertConfig) (*alerts, error) {
+	as := &alerts{thing: thing, sends: make(chan *MsgAlert, notifyQueueLen)}
+
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("Alert missing Name")
+		}
+		if cfg.Msg == "" || cfg.Field == "" {
+			return nil, fmt.Errorf("Alert \"%s\" missing Msg or Field", cfg.Name)
+		}
+		switch cfg.Op {
+		case ">", ">=", "<", "<=":
+		default:
+			return nil, fmt.Errorf("Alert \"%s\": Op must be one of >, >=, <, <=",
+				cfg.Name)
+		}
+		if cfg.Hysteresis < 0 {
+			return nil, fmt.Errorf("Alert \"%s\": Hysteresis is negative", cfg.Name)
+		}
+		switch cfg.Severity {
+		case "":
+			cfg.Severity = SeverityWarning
+		case SeverityInfo, SeverityWarning, SeverityCritical:
+		default:
+			return nil, fmt.Errorf("Alert \"%s\": unknown Severity \"%s\"",
+				cfg.Name, cfg.Severity)
+		}
+		as.alerts = append(as.alerts, &alertState{AlertConfig: cfg,
+			path: strings.Split(cfg.Field, ".")})
+	}
+
+	return as, nil
+}
+
+// Should the alert be active, at value v?  An active alert holds until v is
+// back past the threshold by the hysteresis.
+func (a *alertState) beyond(v float64) bool {
+	threshold := a.Threshold
+	if a.active {
+		if a.Op[0] == '>' {
+			threshold -= a.Hysteresis
+		} else {
+			threshold += a.Hysteresis
+		}
+	}
+
+	cmp := 0
+	switch {
+	case v < threshold:
+		cmp = -1
+	case v > threshold:
+		cmp = 1
+	}
+	return compare(a.Op, cmp)
+}
+
+// Call with lock held
+func (a *alertState) status() AlertStatus {
+	return AlertStatus{Name: a.Name, Severity: a.Severity, Active: a.active,
+		Value: a.value, Threshold: a.Threshold, Time: a.changed}
+}
+
+// Call with lock held
+func (as *alerts) take(a *alertState, active bool) {
+	a.active = active
+	a.changed = time.Now()
+	msg := &MsgAlert{Msg: EventAlert, AlertStatus: a.status()}
+	select {
+	case as.sends <- msg:
+	default:
+		as.thing.log.printf("Alerts backed up; dropped alert \"%s\"", a.Name)
+	}
+}
+
+// Alert's level changed to active.  The level is taken once it's held for
+// the debounce time.  Call with lock held.
+func (as *alerts) level(a *alertState, active bool) {
+	if a.Debounce == 0 {
+		if active != a.active {
+			as.take(a, active)
+		}
+		return
+	}
+
+	if a.timer != nil && active == a.pending {
+		return
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	if active == a.active {
+		return
+	}
+
+	a.pending = active
+	debounce := time.Duration(a.Debounce) * time.Millisecond
+	a.timer = time.AfterFunc(debounce, func() {
+		as.Lock()
+		defer as.Unlock()
+		if a.timer == nil || a.pending != active {
+			return
+		}
+		a.timer = nil
+		as.take(a, active)
+	})
+}
+
+// Bus tap to check the alerts on broadcast messages.  Alerts are sent on
+// the alerts' goroutine, as the bus is busy broadcasting.
+func (as *alerts) tap(p *Packet) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(p.msg, &msg); err != nil {
+		return
+	}
+	name, _ := msg["Msg"].(string)
+
+	as.Lock()
+	defer as.Unlock()
+
+	for _, a := range as.alerts {
+		if a.Msg != name {
+			continue
+		}
+		v, _ := valueAt(msg, a.path)
+		value, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		a.value = value
+		as.level(a, a.beyond(value))
+	}
+}
+
+func (as *alerts) start() {
+	as.done = make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-as.done:
+				return
+			case msg := <-as.sends:
+				t := as.thing
+				t.bus.receive(newPacket(t.bus, nil, msg))
+			}
+		}
+	}()
+}
+
+func (as *alerts) stop() {
+	close(as.done)
+
+	as.Lock()
+	defer as.Unlock()
+
+	for _, a := range as.alerts {
+		if a.timer != nil {
+			a.timer.Stop()
+			a.timer = nil
+		}
+	}
+}
+
+// Subscriber handler for GetAlerts
+func (t *Thing) getAlerts(p *Packet) {
+	resp := MsgAlerts{Msg: ReplyAlerts, Alerts: []AlertStatus{}}
+
+	t.alerts.Lock()
+	for _, a := range t.alerts.alerts {
+		resp.Alerts = append(resp.Alerts, a.status())
+	}
+	t.alerts.Unlock()
+
+	p.Marshal(&resp).Reply()
+}
@@ -0,0 +1,153 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+type thermometer struct {
+	alerts chan MsgAlert
+}
+
+func (th *thermometer) Subscribers() Subscribers {
+	return Subscribers{
+		EventAlert: func(p *Packet) {
+			var msg MsgAlert
+			p.Unmarshal(&msg)
+			th.alerts <- msg
+		},
+	}
+}
+
+func (th *thermometer) Assets() *ThingAssets { return &ThingAssets{} }
+
+type reading struct {
+	Msg  string
+	Temp float64
+}
+
+func testAlerts(t *testing.T, cfgs ...AlertConfig) (*Thing, *thermometer) {
+	th := &thermometer{alerts: make(chan MsgAlert, 10)}
+	thing := NewThing(th)
+	thing.Cfg.Id = testId
+	thing.Cfg.Alerts = cfgs
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+	thing.alerts.start()
+	return thing, th
+}
+
+func expectAlert(t *testing.T, th *thermometer, name string, active bool) {
+	select {
+	case msg := <-th.alerts:
+		if msg.Name != name || msg.Active != active {
+			t.Errorf("Got %+v, want %s active %v", msg, name, active)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No alert, want %s active %v", name, active)
+	}
+}
+
+func expectNoAlert(t *testing.T, th *thermometer) {
+	select {
+	case msg := <-th.alerts:
+		t.Errorf("Unexpected alert %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAlertHysteresis(t *testing.T) {
+	thing, th := testAlerts(t,
+		AlertConfig{Name: "Hot", Msg: "Update", Field: "Temp", Op: ">",
+			Threshold: 30, Hysteresis: 2},
+		AlertConfig{Name: "Cold", Msg: "Update", Field: "Temp", Op: "<=",
+			Threshold: 0, Severity: SeverityCritical})
+	defer thing.alerts.stop()
+
+	send := func(temp float64) {
+		thing.alerts.tap(newPacket(thing.bus, nil, &reading{"Update", temp}))
+	}
+
+	send(30)
+	expectNoAlert(t, th)
+	send(30.5)
+	expectAlert(t, th, "Hot", true)
+
+	// Wobbles in the hysteresis band don't clear the alert
+	send(29)
+	send(31)
+	send(28.5)
+	expectNoAlert(t, th)
+	send(28)
+	expectAlert(t, th, "Hot", false)
+
+	send(-1)
+	expectAlert(t, th, "Cold", true)
+
+	thing.alerts.tap(newPacket(thing.bus, nil, &Msg{Msg: "Other"}))
+	expectNoAlert(t, th)
+
+	sock := &recordSocket{}
+	thing.bus.plugin(sock)
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: GetAlerts}))
+
+	var resp MsgAlerts
+	json.Unmarshal([]byte(sock.sent[0]), &resp)
+	if len(resp.Alerts) != 2 || resp.Alerts[0].Active ||
+		!resp.Alerts[1].Active || resp.Alerts[1].Value != -1 ||
+		resp.Alerts[1].Severity != SeverityCritical {
+		t.Errorf("Got %+v", resp)
+	}
+}
+
+func TestAlertDebounce(t *testing.T) {
+	thing, th := testAlerts(t, AlertConfig{Name: "Hot", Msg: "Update",
+		Field: "Temp", Op: ">", Threshold: 30, Debounce: 100})
+	defer thing.alerts.stop()
+
+	send := func(temp float64) {
+		thing.alerts.tap(newPacket(thing.bus, nil, &reading{"Update", temp}))
+	}
+
+	// A spike shorter than Debounce is ignored
+	send(35)
+	time.Sleep(20 * time.Millisecond)
+	send(25)
+	time.Sleep(150 * time.Millisecond)
+	expectNoAlert(t, th)
+
+	send(35)
+	send(36)
+	expectAlert(t, th, "Hot", true)
+	send(20)
+	expectAlert(t, th, "Hot", false)
+}
+
+func TestAlertsBadConfig(t *testing.T) {
+	for _, cfg := range []AlertConfig{
+		{Msg: "Update", Field: "Temp", Op: ">"},
+		{Name: "no field", Msg: "Update", Op: ">"},
+		{Name: "bad op", Msg: "Update", Field: "Temp", Op: "=="},
+		{Name: "bad hysteresis", Msg: "Update", Field: "Temp", Op: ">",
+			Hysteresis: -1},
+		{Name: "bad severity", Msg: "Update", Field: "Temp", Op: ">",
+			Severity: "dire"},
+	} {
+		thing := NewThing(&sparse{})
+		thing.Cfg.Id = testId
+		thing.Cfg.Alerts = []AlertConfig{cfg}
+		if err := thing.build(true); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("%+v: error %v, want %v", cfg, err, ErrBadConfig)
+		}
+	}
+}
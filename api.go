@@ -0,0 +1,291 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// REST API on the public server, for integrations that don't speak the
+// WebSocket protocol:
+//
+//	GET  /{id}/api/state	Thing's state, as _ReplyState JSON
+//	POST /{id}/api/msg	Send the message in the body to Thing
+//	GET  /{id}/api/history	Chart data from Thing's history (see chart.go)
+//
+// A message POSTed, as application/json, is received by Thing as if sent on
+// a WebSocket.  A POST from another origin is refused.  If
+// Thing replies within the timeout (query "timeout", a duration, e.g.
+// "500ms"; the default is 2s), the reply is returned, otherwise the response
+// is 204 No Content if Thing is done with the message, or 202 Accepted if
+// it's not.
+
+// Webhooks, from services such as GitHub or IFTTT, are POSTed to
+// /{id}/webhook/{msg}, as application/json, and received by Thing as message
+// {msg}.  A JSON object body is the message, with Msg set to {msg}; any
+// other body is the message's Body member.  Webhooks don't use Basic auth;
+// instead, the body is signed with Cfg.WebhookSecret, as for outgoing
+// webhooks (see WebhookConfig).  Without a Cfg.WebhookSecret, webhooks are
+// refused.  System messages (starting with "_") can't be sent as webhooks.
+// The response is as for /{id}/api/msg.
+
+// Time an API request waits for a reply, if the request doesn't say
+const apiTimeout = 2 * time.Second
+
+// Socket to catch the reply to an API request
+type apiSocket struct {
+	flags uint32
+	reply chan []byte
+}
+
+func newApiSocket(flags uint32) *apiSocket {
+	return &apiSocket{flags: flags, reply: make(chan []byte, 1)}
+}
+
+func (s *apiSocket) Send(p *Packet) error {
+	msg := make([]byte, len(p.msg))
+	copy(msg, p.msg)
+	select {
+	case s.reply <- msg:
+	default:
+		// Only the first reply counts
+	}
+	return nil
+}
+
+func (s *apiSocket) Close()                {}
+func (s *apiSocket) Name() string          { return "api" }
+func (s *apiSocket) Flags() uint32         { return s.flags }
+func (s *apiSocket) SetFlags(flags uint32) { s.flags = flags }
+func (s *apiSocket) Src() string           { return "SYSTEM" }
+
+// Thing, or bridge child, for the request's {id}; nil, with an error
+// response written, if there's none
+func (t *Thing) apiThing(w http.ResponseWriter, r *http.Request,
+	method string) *Thing {
+
+	if r.Method != method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	id := mux.Vars(r)["id"]
+	if child := t.getChild(id); child != nil {
+		return child
+	}
+	if id != t.id {
+		http.Error(w, "Mismatch on Ids", http.StatusNotFound)
+		return nil
+	}
+	return t
+}
+
+// Receive pkt on thing's bus, and return the reply, if any, within timeout.
+// With no reply, done is whether Thing is done with the message.
+func (t *Thing) apiExchange(pkt *Packet, timeout time.Duration) (reply []byte, done bool) {
+	sock := pkt.src.(*apiSocket)
+	finished := make(chan bool)
+
+	go func() {
+		t.bus.receive(pkt)
+		close(finished)
+	}()
+
+	select {
+	case reply = <-sock.reply:
+		return reply, true
+	case <-finished:
+		// Subscriber is done; it may have replied on the way out
+		select {
+		case reply = <-sock.reply:
+		default:
+		}
+		return reply, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+// Receive pkt on thing's bus, and write the reply, if any, within timeout
+func (t *Thing) apiReceive(w http.ResponseWriter, pkt *Packet,
+	timeout time.Duration) {
+
+	reply, done := t.apiExchange(pkt, timeout)
+	switch {
+	case reply != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(reply)
+	case done:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// GET /{id}/api/state
+func (t *Thing) apiState(w http.ResponseWriter, r *http.Request) {
+	thing := t.apiThing(w, r, "GET")
+	if thing == nil {
+		return
+	}
+
+	msg := Msg{Msg: GetState}
+	pkt := newPacket(thing.bus, newApiSocket(0), &msg)
+	thing.apiReceive(w, pkt, apiTimeout)
+}
+
+// POST /{id}/api/msg
+func (t *Thing) apiMsg(w http.ResponseWriter, r *http.Request) {
+	thing := t.apiThing(w, r, "POST")
+	if thing == nil {
+		return
+	}
+
+	if !t.checkOrigin(r) {
+		http.Error(w, "Cross-origin request", http.StatusForbidden)
+		return
+	}
+	// Forms can't post JSON cross-site
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "Content-Type must be application/json",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	timeout := apiTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, "Bad timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	body := r.Body
+	if t.Cfg.MaxMsgSize > 0 {
+		body = http.MaxBytesReader(w, body, int64(t.Cfg.MaxMsgSize))
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "Reading message: "+err.Error(),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var msg Msg
+	if err := jsonUnmarshal(data, &msg); err != nil || msg.Msg == "" {
+		http.Error(w, "Message must be a JSON object with a Msg",
+			http.StatusBadRequest)
+		return
+	}
+
+	pkt := &Packet{bus: thing.bus, src: newApiSocket(0), msg: data}
+
+	user, _, _ := r.BasicAuth()
+	if u := authUser(r); u != nil {
+		user = u.Name
+	}
+	remote := t.clientAddr(r)
+
+	// Viewers can only send requests, as on a WebSocket
+	if u := authUser(r); u != nil && u.Role == RoleViewer && !isRequest(pkt) {
+		t.auditCommand(pkt, user, remote, AuditRejected, "read only")
+		http.Error(w, "Viewers can only send requests", http.StatusForbidden)
+		return
+	}
+	if !isRequest(pkt) {
+		t.auditCommand(pkt, user, remote, AuditReceived, "")
+	}
+
+	thing.log.printf("API message: %.80s", pkt.String())
+	thing.apiReceive(w, pkt, timeout)
+}
+
+// Message for a webhook's body, as message name.  JSON members are passed
+// through as-is, so large numbers (e.g. GitHub's ids) don't lose precision.
+func webhookMsg(name string, body []byte) ([]byte, error) {
+	msg := map[string]json.RawMessage{}
+
+	switch {
+	case len(bytes.TrimSpace(body)) == 0:
+	case jsonUnmarshal(body, &msg) != nil:
+		if !json.Valid(body) {
+			return nil, errors.New("not JSON")
+		}
+		msg = map[string]json.RawMessage{"Body": body}
+	}
+
+	msg["Msg"], _ = jsonMarshal(name)
+	return jsonMarshal(msg)
+}
+
+// POST /{id}/webhook/{msg}
+func (t *Thing) webhook(w http.ResponseWriter, r *http.Request) {
+	thing := t.apiThing(w, r, "POST")
+	if thing == nil {
+		return
+	}
+
+	name := mux.Vars(r)["msg"]
+	if strings.HasPrefix(name, "_") {
+		http.Error(w, "System messages can't be webhooks", http.StatusForbidden)
+		return
+	}
+
+	secret := t.Cfg.WebhookSecret
+	if secret == "" {
+		http.Error(w, "Webhooks not enabled", http.StatusForbidden)
+		return
+	}
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "application/json" {
+		http.Error(w, "Content-Type must be application/json",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := r.Body
+	if t.Cfg.MaxMsgSize > 0 {
+		body = http.MaxBytesReader(w, body, int64(t.Cfg.MaxMsgSize))
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "Reading webhook: "+err.Error(),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sig := r.Header.Get("X-Merle-Signature")
+	if !hmac.Equal([]byte(sig), []byte(webhookSign(secret, data))) {
+		t.log.printf("Webhook with bad signature [%s]", t.clientAddr(r))
+		http.Error(w, "Bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	data, err = webhookMsg(name, data)
+	if err != nil {
+		http.Error(w, "Bad webhook body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pkt := &Packet{bus: thing.bus, src: newApiSocket(0), msg: data}
+	thing.log.printf("Webhook: %.80s", pkt.String())
+	thing.apiReceive(w, pkt, apiTimeout)
+}
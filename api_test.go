@@ -0,0 +1,162 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echo struct {
+	Msg   string
+	Count int
+}
+
+func (e *echo) getState(p *Packet) {
+	e.Msg = ReplyState
+	p.Marshal(e).Reply()
+}
+
+func (e *echo) Subscribers() Subscribers {
+	return Subscribers{
+		GetState: e.getState,
+		"Echo":   func(p *Packet) { p.Reply() },
+		"Quiet":  func(p *Packet) {},
+		"Slow":   func(p *Packet) { time.Sleep(200 * time.Millisecond) },
+	}
+}
+
+func (e *echo) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestAPI(t *testing.T) {
+	thing := NewThing(&echo{Count: 3})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		thing.web.public.mux.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	api := "/" + testId + "/api/"
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		reply              string
+	}{
+		{"GET", api + "state", "", http.StatusOK, `{"Msg":"_ReplyState","Count":3}`},
+		{"POST", api + "state", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/other/api/state", "", http.StatusNotFound, ""},
+		{"POST", api + "msg", `{"Msg":"Echo","A":1}`, http.StatusOK, `{"Msg":"Echo","A":1}`},
+		{"POST", api + "msg", `{"Msg":"Quiet"}`, http.StatusNoContent, ""},
+		{"POST", api + "msg?timeout=10ms", `{"Msg":"Slow"}`, http.StatusAccepted, ""},
+		{"POST", api + "msg", `{"A":1}`, http.StatusBadRequest, ""},
+		{"POST", api + "msg", `not json`, http.StatusBadRequest, ""},
+		{"POST", api + "msg?timeout=soon", `{"Msg":"Echo"}`, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		code, body := do(test.method, test.path, test.body)
+		if code != test.code || (test.reply != "" && body != test.reply) {
+			t.Errorf("%s %s %s: %d %q, want %d %q", test.method,
+				test.path, test.body, code, body, test.code, test.reply)
+		}
+	}
+
+	// Forms and other origins are refused
+	req := httptest.NewRequest("POST", api+"msg", strings.NewReader(`{"Msg":"Echo"}`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	thing.web.public.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Form POST got %d", w.Code)
+	}
+	req = httptest.NewRequest("POST", api+"msg", strings.NewReader(`{"Msg":"Echo"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "http://evil.example")
+	w = httptest.NewRecorder()
+	thing.web.public.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Cross-origin POST got %d", w.Code)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	thing := NewThing(&echo{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	thing.Cfg.WebhookSecret = "hush"
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := "/" + testId + "/webhook/"
+	js := "application/json"
+	good := func(body string) string { return webhookSign("hush", []byte(body)) }
+
+	tests := []struct {
+		method, path, ct, body, sig string
+		code                        int
+		reply                       string
+	}{
+		{"POST", hook + "Echo", js, `{"id":9007199254740993,"Msg":"X"}`,
+			good(`{"id":9007199254740993,"Msg":"X"}`),
+			http.StatusOK, `{"Msg":"Echo","id":9007199254740993}`},
+		{"POST", hook + "Echo", js, `[1,2]`, good(`[1,2]`),
+			http.StatusOK, `{"Body":[1,2],"Msg":"Echo"}`},
+		{"POST", hook + "Echo", js, "", good(""), http.StatusOK, `{"Msg":"Echo"}`},
+		{"POST", hook + "Quiet", js, "", good(""), http.StatusNoContent, ""},
+		{"POST", hook + "Echo", js, "not json", good("not json"),
+			http.StatusBadRequest, ""},
+		{"POST", hook + "Echo", js, `{"A":1}`, good(`{"A":2}`),
+			http.StatusUnauthorized, ""},
+		{"POST", hook + "Echo", js, `{"A":1}`, "", http.StatusUnauthorized, ""},
+		{"POST", hook + "Echo", "application/x-www-form-urlencoded", "A=1",
+			good("A=1"), http.StatusUnsupportedMediaType, ""},
+		{"POST", hook + "_GetState", js, "", good(""), http.StatusForbidden, ""},
+		{"GET", hook + "Echo", "", "", "", http.StatusMethodNotAllowed, ""},
+		{"POST", "/other/webhook/Echo", js, "", good(""), http.StatusNotFound, ""},
+	}
+
+	post := func(method, path, ct, body, sig string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if ct != "" {
+			req.Header.Set("Content-Type", ct)
+		}
+		if sig != "" {
+			req.Header.Set("X-Merle-Signature", sig)
+		}
+		w := httptest.NewRecorder()
+		thing.web.public.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, test := range tests {
+		w := post(test.method, test.path, test.ct, test.body, test.sig)
+		if w.Code != test.code || (test.reply != "" && w.Body.String() != test.reply) {
+			t.Errorf("%s %s %s: %d %q, want %d %q", test.method, test.path,
+				test.body, w.Code, w.Body.String(), test.code, test.reply)
+		}
+	}
+
+	// Refused without a secret
+	thing.Cfg.WebhookSecret = ""
+	if w := post("POST", hook+"Echo", js, "", good("")); w.Code != http.StatusForbidden {
+		t.Errorf("Without secret got %d", w.Code)
+	}
+}
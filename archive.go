@@ -0,0 +1,235 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Archive configuration.  Archiving batches aged messages into compressed
+// objects uploaded to S3-compatible object storage.  Each object is a gzipped
+// file of JSON records, one record per line:
+//
+//	{"Time":"2022-07-29T10:00:00Z","Id":"00_11_22_33_44_55","Msg":{...}}
+//
+// Objects are named:
+//
+//	<Prefix><Id>/<yyyy>/<mm>/<dd>/<hhmmss.nnnnnnnnn>.jsonl.gz
+type ArchiveConfig struct {
+
+	// S3-compatible endpoint URL, e.g.
+	// "https://s3.us-west-2.amazonaws.com".  Archiving is disabled if
+	// Endpoint is empty.  The default is "".
+	Endpoint string
+
+	// Region.  The default is "us-east-1".
+	Region string
+
+	// Bucket to archive to
+	Bucket string
+
+	// Access key and secret key
+	AccessKey string
+	SecretKey string
+
+	// Prefix for object names.  The default is "merle/".
+	Prefix string
+
+	// Messages to archive.  If empty, all broadcast messages are
+	// archived.  The default is nil.
+	Msgs []string
+
+	// Number of records per object.  The default is 1000.
+	BatchSize uint
+
+	// Maximum age, in seconds, of a record before it's uploaded, even if
+	// the batch isn't full.  The default is 3600.
+	MaxAge uint
+
+	// If ExpireDays is non-zero, a lifecycle rule is put on the bucket to
+	// expire archived objects after ExpireDays.  The bucket's other
+	// lifecycle rules are kept.  The default is 0.
+	ExpireDays uint
+}
+
+type archiveRecord struct {
+	Time time.Time
+	Id   string
+	Msg  json.RawMessage
+}
+
+type archive struct {
+	thing *Thing
+	sync.Mutex
+	cfg     ArchiveConfig
+	s3      *s3Client
+	msgs    map[string]bool
+	records []archiveRecord
+	oldest  time.Time
+	ticker  *time.Ticker
+	done    chan bool
+}
+
+func newArchive(thing *Thing, cfg ArchiveConfig) *archive {
+	// Items left unset, as when Cfg.Archive is set whole in code, take
+	// their defaults
+	def := defaultCfg.Archive
+	if cfg.Region == "" {
+		cfg.Region = def.Region
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = def.Prefix
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = def.BatchSize
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = def.MaxAge
+	}
+
+	a := &archive{
+		thing: thing,
+		cfg:   cfg,
+		s3: newS3Client(cfg.Endpoint, cfg.Region, cfg.Bucket,
+			cfg.AccessKey, cfg.SecretKey),
+		done: make(chan bool),
+	}
+
+	if len(cfg.Msgs) > 0 {
+		a.msgs = make(map[string]bool)
+		for _, msg := range cfg.Msgs {
+			a.msgs[msg] = true
+		}
+	}
+
+	return a
+}
+
+// Bus tap to archive broadcast messages
+func (a *archive) tap(p *Packet) {
+	var msg Msg
+
+	p.Unmarshal(&msg)
+	if a.msgs != nil && !a.msgs[msg.Msg] {
+		return
+	}
+
+	a.add(archiveRecord{
+		Time: time.Now(),
+		Id:   a.thing.id,
+		Msg:  append(json.RawMessage(nil), p.msg...),
+	})
+}
+
+// Add a record to the current batch.  The batch is uploaded when full.
+func (a *archive) add(rec archiveRecord) {
+	a.Lock()
+	if len(a.records) == 0 {
+		a.oldest = rec.Time
+	}
+	a.records = append(a.records, rec)
+
+	var batch []archiveRecord
+	if uint(len(a.records)) >= a.cfg.BatchSize {
+		batch = a.take()
+	}
+	a.Unlock()
+
+	if batch != nil {
+		go a.upload(batch)
+	}
+}
+
+// Take the current batch.  Call with lock held.
+func (a *archive) take() []archiveRecord {
+	batch := a.records
+	a.records = nil
+	return batch
+}
+
+// Upload the batch.  On failure, the batch is put back for the next try, but
+// bounded to ten batches so an unreachable store doesn't eat memory.
+func (a *archive) upload(batch []archiveRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for i := range batch {
+		enc.Encode(&batch[i])
+	}
+	zw.Close()
+
+	first := batch[0]
+	key := a.cfg.Prefix + first.Id + "/" +
+		first.Time.UTC().Format("2006/01/02/150405.000000000") + ".jsonl.gz"
+
+	err := a.s3.putObject(key, "application/gzip", buf.Bytes())
+	if err == nil {
+		a.thing.log.printf("Archived %d record(s) to %s", len(batch), key)
+		return
+	}
+
+	a.thing.log.println("Archive upload failed:", err)
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.records = append(batch, a.records...)
+	max := int(a.cfg.BatchSize) * 10
+	if len(a.records) > max {
+		a.records = a.records[len(a.records)-max:]
+	}
+	a.oldest = a.records[0].Time
+}
+
+func (a *archive) start() {
+	if a.cfg.ExpireDays > 0 {
+		err := a.s3.putLifecycle(a.cfg.Prefix, a.cfg.ExpireDays)
+		if err != nil {
+			a.thing.log.println("Archive lifecycle config failed:", err)
+		}
+	}
+
+	maxAge := time.Duration(a.cfg.MaxAge) * time.Second
+	a.ticker = time.NewTicker(time.Minute)
+
+	go func() {
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-a.ticker.C:
+				var batch []archiveRecord
+				a.Lock()
+				if len(a.records) > 0 &&
+					time.Since(a.oldest) >= maxAge {
+					batch = a.take()
+				}
+				a.Unlock()
+				a.upload(batch)
+			}
+		}
+	}()
+}
+
+func (a *archive) stop() {
+	a.ticker.Stop()
+	a.done <- true
+
+	a.Lock()
+	batch := a.take()
+	a.Unlock()
+	a.upload(batch)
+}
@@ -0,0 +1,73 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestArchiveLifecycle(t *testing.T) {
+	var put string
+	current := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+		`<Rule><ID>logs</ID><Filter><Prefix>logs/</Prefix></Filter>` +
+		`<Status>Enabled</Status><Expiration><Days>7</Days></Expiration></Rule>` +
+		`<Rule><ID>merle-archive</ID><Filter><Prefix>merle/</Prefix></Filter>` +
+		`<Status>Enabled</Status><Expiration><Days>30</Days></Expiration></Rule>` +
+		`</LifecycleConfiguration>`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && current == "":
+			http.Error(w, "NoSuchLifecycleConfiguration", http.StatusNotFound)
+		case r.Method == "GET":
+			w.Write([]byte(current))
+		case r.Method == "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			put = string(body)
+		}
+	}))
+	defer srv.Close()
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unset items take their defaults
+	a := newArchive(thing, ArchiveConfig{Endpoint: srv.URL, Bucket: "b",
+		ExpireDays: 90})
+	if a.cfg.Prefix != "merle/" || a.cfg.BatchSize != 1000 {
+		t.Errorf("Defaults not applied: %+v", a.cfg)
+	}
+
+	// Other rules kept, Merle's replaced
+	if err := a.s3.putLifecycle(a.cfg.Prefix, a.cfg.ExpireDays); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(put, "<ID>logs</ID>") ||
+		strings.Count(put, "<ID>merle-archive</ID>") != 1 ||
+		strings.Contains(put, "<Days>30</Days>") ||
+		!strings.Contains(put, "<Days>90</Days>") {
+		t.Errorf("Put %s", put)
+	}
+
+	// No lifecycle configuration yet
+	current = ""
+	if err := a.s3.putLifecycle(a.cfg.Prefix, a.cfg.ExpireDays); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(put, "<Rule>") != 1 {
+		t.Errorf("Put %s", put)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Audit trail (see Cfg.AuditFile) of who authenticated, from where, and
+// which commands were received or rejected.  The trail is kept in a file,
+// one JSON record per line, and only ever appended to; the last AuditMax
+// records are also kept in memory for GetAudit.
+type audit struct {
+	thing *Thing
+	sync.Mutex
+	file    string
+	max     uint
+	forward bool
+	seq     uint64
+	records []AuditRecord
+}
+
+func newAudit(thing *Thing, file string, max uint, forward bool) *audit {
+	return &audit{
+		thing:   thing,
+		file:    file,
+		max:     max,
+		forward: forward,
+	}
+}
+
+// Load the tail of the audit trail from file.  A missing file is an empty
+// trail.
+func (a *audit) load() error {
+	a.Lock()
+	defer a.Unlock()
+
+	f, err := os.Open(a.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Torn write at tail from a crash; skip it
+			a.thing.log.println("Audit skipping bad record:", err)
+			continue
+		}
+		a.keep(rec)
+		a.seq = rec.Seq
+	}
+
+	return scanner.Err()
+}
+
+// Keep rec in memory, dropping the oldest beyond max
+func (a *audit) keep(rec AuditRecord) {
+	a.records = append(a.records, rec)
+	if a.max > 0 && uint(len(a.records)) > a.max {
+		a.records = a.records[uint(len(a.records))-a.max:]
+	}
+}
+
+// Add rec to the audit trail, and forward it to mother
+func (a *audit) add(rec AuditRecord) {
+	t := a.thing
+
+	a.Lock()
+	a.seq++
+	rec.Seq = a.seq
+	if rec.Time.IsZero() {
+		rec.Time = t.Now()
+	}
+	if rec.Id == "" {
+		rec.Id = t.id
+	}
+	a.keep(rec)
+
+	f, err := os.OpenFile(a.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(&rec)
+		f.Close()
+	}
+	if err != nil {
+		t.log.println("Audit append failed:", err)
+	}
+	a.Unlock()
+
+	if a.forward && !t.isPrime {
+		msg := MsgEventAudit{Msg: EventAudit, Record: rec}
+		a.toMother(newPacket(t.bus, nil, &msg))
+	}
+}
+
+// Send p to mother only; audit records aren't for Thing's UI
+func (a *audit) toMother(p *Packet) {
+	b := a.thing.bus
+
+	b.sockLock.RLock()
+	defer b.sockLock.RUnlock()
+
+	for sock := range b.sockets {
+		if sock.Flags()&sock_flag_mother != 0 {
+			sock.Send(p)
+		}
+	}
+}
+
+// Subscriber handler for GetAudit
+func (t *Thing) getAudit(p *Packet) {
+	if p.src != nil && p.src.Flags()&sock_flag_readonly != 0 {
+		t.log.printf("Ignoring GetAudit from read-only [%s]", p.Src())
+		return
+	}
+
+	var req MsgGetAudit
+	p.Unmarshal(&req)
+
+	a := t.audit
+	reply := MsgAudit{Msg: ReplyAudit, Records: []AuditRecord{}}
+
+	a.Lock()
+	for _, rec := range a.records {
+		if rec.Seq <= req.Since || (req.Kind != "" && rec.Kind != req.Kind) {
+			continue
+		}
+		reply.Records = append(reply.Records, rec)
+		if req.Limit > 0 && uint(len(reply.Records)) >= req.Limit {
+			break
+		}
+	}
+	a.Unlock()
+
+	p.Marshal(&reply).Reply()
+}
+
+// Subscriber handler for EventAudit, on Thing Prime.  Thing's records are
+// added to Thing Prime's audit trail, if any.
+func (t *Thing) auditHeard(p *Packet) {
+	if t.audit == nil || t.primeSock == nil || p.src != t.primeSock {
+		return
+	}
+
+	var msg MsgEventAudit
+	p.Unmarshal(&msg)
+	t.audit.add(msg.Record)
+}
+
+// Audit command message p, from user at remote, with result, and reason if
+// rejected
+func (t *Thing) auditCommand(p *Packet, user, remote, result, reason string) {
+	if t.audit == nil {
+		return
+	}
+
+	var msg Msg
+	p.Unmarshal(&msg)
+
+	t.audit.add(AuditRecord{
+		Kind:   AuditCommand,
+		User:   user,
+		Remote: remote,
+		Msg:    msg.Msg,
+		Result: result,
+		Reason: reason,
+	})
+}
+
+// Audit authentication of user on request r
+func (t *Thing) auditAuth(r *http.Request, user string, ok bool) {
+	if t.audit == nil {
+		return
+	}
+
+	rec := AuditRecord{
+		Kind:   AuditAuth,
+		User:   user,
+		Remote: t.clientAddr(r),
+		Result: AuditOk,
+	}
+	if !ok {
+		rec.Result = AuditFailed
+		rec.Reason = "bad credentials"
+	}
+	t.audit.add(rec)
+}
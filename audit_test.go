@@ -0,0 +1,138 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit")
+
+	thing := NewThing(&toggler{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	thing.audit = newAudit(thing, file, 2, true)
+	thing.bus.subscribe(GetAudit, thing.getAudit)
+
+	mother := &recordSocket{flags: sock_flag_mother}
+	thing.bus.plugin(mother)
+
+	r := httptest.NewRequest("GET", "/ws/"+testId, nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	thing.auditAuth(r, "mallory", false)
+	thing.auditAuth(r, "alice", true)
+	cmd := newPacket(thing.bus, nil, &Msg{Msg: "SetRelay"})
+	thing.auditCommand(cmd, "alice", "ws:10.0.0.1:4321", AuditReceived, "")
+
+	// Each record is forwarded to mother
+	if len(mother.sent) != 3 {
+		t.Fatalf("Forwarded %v, want 3 records", mother.sent)
+	}
+	var event MsgEventAudit
+	json.Unmarshal([]byte(mother.sent[2]), &event)
+	if event.Msg != EventAudit || event.Record.Seq != 3 ||
+		event.Record.Id != testId || event.Record.Msg != "SetRelay" {
+		t.Errorf("Forwarded %+v", event)
+	}
+
+	get := func(sock socketer, req MsgGetAudit) []AuditRecord {
+		t.Helper()
+		req.Msg = GetAudit
+		rec := &recordSocket{flags: sock.Flags()}
+		thing.bus.receive(newPacket(thing.bus, rec, &req))
+		if len(rec.sent) == 0 {
+			return nil
+		}
+		var reply MsgAudit
+		json.Unmarshal([]byte(rec.sent[0]), &reply)
+		return reply.Records
+	}
+
+	// Only the latest AuditMax records are kept in memory
+	records := get(&recordSocket{}, MsgGetAudit{})
+	if len(records) != 2 || records[0].Seq != 2 || records[1].Seq != 3 {
+		t.Fatalf("Got %+v", records)
+	}
+	if records[0].User != "alice" || records[0].Remote != "10.0.0.1:4321" ||
+		records[0].Kind != AuditAuth || records[0].Result != AuditOk {
+		t.Errorf("Got %+v", records[0])
+	}
+
+	records = get(&recordSocket{}, MsgGetAudit{Kind: AuditCommand})
+	if len(records) != 1 || records[0].Msg != "SetRelay" {
+		t.Errorf("Got %+v", records)
+	}
+	records = get(&recordSocket{}, MsgGetAudit{Since: 1, Limit: 1})
+	if len(records) != 1 || records[0].Seq != 2 {
+		t.Errorf("Got %+v", records)
+	}
+
+	// Viewers can't read the audit trail
+	if records = get(&recordSocket{flags: sock_flag_readonly},
+		MsgGetAudit{}); records != nil {
+		t.Errorf("Read-only got %+v", records)
+	}
+
+	// The file has all the records, and numbering carries on after load
+	a := newAudit(thing, file, 10, false)
+	if err := a.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.records) != 3 || a.records[0].User != "mallory" ||
+		a.records[0].Result != AuditFailed {
+		t.Fatalf("Loaded %+v", a.records)
+	}
+	a.add(AuditRecord{Kind: AuditAuth, Result: AuditOk})
+	if a.records[3].Seq != 4 {
+		t.Errorf("Seq %d, want 4", a.records[3].Seq)
+	}
+
+	// Behind a proxy, the address the proxy appended is recorded, not
+	// one the client forged
+	thing.Cfg.TrustProxy = true
+	r.Header.Set("X-Forwarded-For", "10.0.0.99, 203.0.113.7")
+	thing.auditAuth(r, "eve", false)
+	last := thing.audit.records[len(thing.audit.records)-1]
+	if last.User != "eve" || last.Remote != "203.0.113.7" {
+		t.Errorf("Recorded %+v", last)
+	}
+
+	// Thing Prime keeps Thing's records, from Thing only
+	prime := NewThing(&toggler{})
+	prime.Cfg.Id = testId
+	prime.Cfg.IsPrime = true
+	if err := prime.build(false); err != nil {
+		t.Fatal(err)
+	}
+	prime.audit = newAudit(prime, filepath.Join(dir, "prime"), 10, true)
+	prime.primeSock = &recordSocket{}
+
+	prime.bus.receive(newPacket(prime.bus, &recordSocket{}, &event))
+	if len(prime.audit.records) != 0 {
+		t.Errorf("Prime took record from a stranger")
+	}
+	prime.bus.receive(newPacket(prime.bus, prime.primeSock, &event))
+	if len(prime.audit.records) != 1 ||
+		prime.audit.records[0].Time != event.Record.Time ||
+		prime.audit.records[0].Msg != "SetRelay" {
+		t.Errorf("Prime has %+v", prime.audit.records)
+	}
+}
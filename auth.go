@@ -0,0 +1,353 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles
+const (
+	// Admin can access every Thing and manage users, tokens, and tenants
+	// in the admin UI
+	RoleAdmin = "admin"
+	// Operator can view and control Things granted to the operator
+	RoleOperator = "operator"
+	// Viewer can view Things granted to the viewer, but can't send
+	// messages other than requests (GetState, GetIdentity, etc.)
+	RoleViewer = "viewer"
+)
+
+func validRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleOperator, RoleViewer:
+		return true
+	}
+	return false
+}
+
+// AuthUser is a user who can log in to Thing's public web server
+type AuthUser struct {
+	Name string
+	Role string
+	// [Optional] Tenant the user belongs to.  A user in a tenant can only
+	// access the tenant's Things.  The default is "" (no tenant).
+	Tenant string
+	// Ids of Things the user can access.  "*" grants access to every
+	// Thing (in the user's tenant, if any).  Admins don't need grants.
+	Grants []string
+	// bcrypt hash of user's password.  If empty, the password is
+	// validated against the system user with PAM.
+	PasswdHash string
+}
+
+// AuthToken is an API token.  A request with header "Authorization: Bearer
+// <token>" acts as the token's User.  Only a hash of the token is kept.
+type AuthToken struct {
+	// Short id, for listing and deleting the token
+	Id      string
+	Hash    string
+	User    string
+	Name    string
+	Created time.Time
+}
+
+// AuthTenant is a group of Things, by Thing Id, sharing a Prime
+type AuthTenant struct {
+	Name   string
+	Things []string
+}
+
+// AuthData is the users, tokens, and tenants held in an AuthStore
+type AuthData struct {
+	Users   []AuthUser
+	Tokens  []AuthToken
+	Tenants []AuthTenant
+}
+
+// AuthStore persists users, API tokens, tenants, and access grants, managed
+// in the admin UI at /admin on Thing's public web server.
+//
+// NewFileAuthStore returns the default AuthStore, backed by a JSON file.
+// Set Cfg.AuthFile to use the default AuthStore, or use
+// Thing.SetAuthStore() for other backends.
+type AuthStore interface {
+	// Load auth data.  Loading from an empty AuthStore is not an error;
+	// data is left unchanged.
+	Load(data *AuthData) error
+	// Save auth data
+	Save(data *AuthData) error
+}
+
+type fileAuthStore struct {
+	store Store
+}
+
+// NewFileAuthStore returns an AuthStore backed by a JSON file
+func NewFileAuthStore(file string) AuthStore {
+	return &fileAuthStore{store: NewFileStore(file)}
+}
+
+func (s *fileAuthStore) Load(data *AuthData) error {
+	return s.store.Load(data)
+}
+
+func (s *fileAuthStore) Save(data *AuthData) error {
+	return s.store.Save(data)
+}
+
+// SetAuthStore sets the AuthStore for Thing's users.  SetAuthStore overrides
+// Cfg.AuthFile.  Call SetAuthStore before thing.Run().
+func (t *Thing) SetAuthStore(s AuthStore) {
+	t.authStore = s
+}
+
+type authUserKey struct{}
+
+// Authenticated user of the request, or nil if auth store isn't used
+func authUser(r *http.Request) *AuthUser {
+	u, _ := r.Context().Value(authUserKey{}).(*AuthUser)
+	return u
+}
+
+type auth struct {
+	thing *Thing
+	sync.RWMutex
+	store AuthStore
+	data  AuthData
+}
+
+func newAuth(thing *Thing, store AuthStore) *auth {
+	return &auth{thing: thing, store: store}
+}
+
+// (Re)load auth data from the store
+func (a *auth) load() error {
+	var data AuthData
+
+	if err := a.store.Load(&data); err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.data = data
+	a.Unlock()
+
+	return nil
+}
+
+// Change auth data with f and save the result.  If f or the save fails, the
+// auth data is unchanged.
+func (a *auth) update(f func(data *AuthData) error) error {
+	a.Lock()
+	defer a.Unlock()
+
+	data := AuthData{
+		Users:   append([]AuthUser(nil), a.data.Users...),
+		Tokens:  append([]AuthToken(nil), a.data.Tokens...),
+		Tenants: append([]AuthTenant(nil), a.data.Tenants...),
+	}
+
+	if err := f(&data); err != nil {
+		return err
+	}
+
+	if err := a.store.Save(&data); err != nil {
+		return err
+	}
+
+	a.data = data
+
+	return nil
+}
+
+func (a *auth) snapshot() AuthData {
+	a.RLock()
+	defer a.RUnlock()
+	return a.data
+}
+
+// Call with lock held
+func (a *auth) findUser(name string) *AuthUser {
+	for i := range a.data.Users {
+		if a.data.Users[i].Name == name {
+			u := a.data.Users[i]
+			return &u
+		}
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a new random token.  Returns the token and its AuthToken record.
+func newToken(user, name string) (string, AuthToken, error) {
+	var secret [32]byte
+
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", AuthToken{}, err
+	}
+
+	token := hex.EncodeToString(secret[:])
+	hash := hashToken(token)
+
+	return token, AuthToken{
+		Id:      hash[:8],
+		Hash:    hash,
+		User:    user,
+		Name:    name,
+		Created: time.Now(),
+	}, nil
+}
+
+func (a *auth) tokenUser(token string) *AuthUser {
+	hash := []byte(hashToken(token))
+
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, tok := range a.data.Tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(tok.Hash)) == 1 {
+			return a.findUser(tok.User)
+		}
+	}
+
+	return nil
+}
+
+// Is token Cfg.BootToken?
+func (a *auth) bootToken(token string) bool {
+	if a.thing == nil || a.thing.Cfg.BootToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token),
+		[]byte(a.thing.Cfg.BootToken)) == 1
+}
+
+func hashPasswd(passwd string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd),
+		bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Authenticate the request's API token or basic auth user.  Users without a
+// password hash are validated with pam.  Until the store has users,
+// bootUser, if given, is admin, so there's someone to add users; bootUser
+// logs in with pam, or with Cfg.BootToken.  If there are no users and no
+// bootUser, everyone is an operator, as with no authentication.
+func (a *auth) authenticate(r *http.Request, bootUser string,
+	pam func(user, passwd string) (bool, error)) *AuthUser {
+
+	a.RLock()
+	noUsers := len(a.data.Users) == 0
+	a.RUnlock()
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimPrefix(h, "Bearer ")
+		if noUsers && bootUser != "" && a.bootToken(token) {
+			return &AuthUser{Name: bootUser, Role: RoleAdmin}
+		}
+		return a.tokenUser(token)
+	}
+
+	if noUsers && bootUser == "" {
+		return &AuthUser{Role: RoleOperator, Grants: []string{"*"}}
+	}
+
+	name, passwd, ok := r.BasicAuth()
+	if !ok {
+		return nil
+	}
+
+	if noUsers {
+		if name != bootUser {
+			return nil
+		}
+		if ok, _ := pam(name, passwd); !ok {
+			return nil
+		}
+		return &AuthUser{Name: name, Role: RoleAdmin}
+	}
+
+	a.RLock()
+	u := a.findUser(name)
+	a.RUnlock()
+
+	if u == nil {
+		return nil
+	}
+
+	if u.PasswdHash != "" {
+		err := bcrypt.CompareHashAndPassword([]byte(u.PasswdHash),
+			[]byte(passwd))
+		if err != nil {
+			return nil
+		}
+		return u
+	}
+
+	if ok, _ := pam(name, passwd); !ok {
+		return nil
+	}
+
+	return u
+}
+
+// User can access Thing with id
+func (a *auth) canAccess(u *AuthUser, id string) bool {
+	if u.Role == RoleAdmin {
+		return true
+	}
+
+	if u.Tenant != "" {
+		a.RLock()
+		inTenant := false
+		for _, tenant := range a.data.Tenants {
+			if tenant.Name == u.Tenant {
+				inTenant = contains(tenant.Things, id)
+				break
+			}
+		}
+		a.RUnlock()
+		if !inTenant {
+			return false
+		}
+	}
+
+	return contains(u.Grants, "*") || contains(u.Grants, id)
+}
+
+// Packet is a request, such as GetState, which doesn't change Thing
+func isRequest(p *Packet) bool {
+	var msg Msg
+	p.Unmarshal(&msg)
+	return strings.HasPrefix(msg.Msg, "_Get")
+}
+
+// Check a change to users leaves at least one admin
+func checkAdmins(users []AuthUser) error {
+	for _, u := range users {
+		if u.Role == RoleAdmin {
+			return nil
+		}
+	}
+	return fmt.Errorf("At least one admin is required")
+}
@@ -0,0 +1,180 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type memAuthStore struct {
+	data AuthData
+}
+
+func (s *memAuthStore) Load(data *AuthData) error {
+	*data = s.data
+	return nil
+}
+
+func (s *memAuthStore) Save(data *AuthData) error {
+	s.data = *data
+	return nil
+}
+
+func noPam(user, passwd string) (bool, error) {
+	return false, nil
+}
+
+func TestAuthAccess(t *testing.T) {
+	a := newAuth(nil, &memAuthStore{data: AuthData{
+		Tenants: []AuthTenant{{Name: "acme", Things: []string{"a", "b"}}},
+	}})
+	a.load()
+
+	tests := []struct {
+		user AuthUser
+		id   string
+		want bool
+	}{
+		{AuthUser{Role: RoleAdmin}, "x", true},
+		{AuthUser{Role: RoleOperator, Grants: []string{"*"}}, "x", true},
+		{AuthUser{Role: RoleOperator, Grants: []string{"a"}}, "a", true},
+		{AuthUser{Role: RoleOperator, Grants: []string{"a"}}, "b", false},
+		{AuthUser{Role: RoleViewer, Tenant: "acme", Grants: []string{"*"}}, "b", true},
+		{AuthUser{Role: RoleViewer, Tenant: "acme", Grants: []string{"*"}}, "x", false},
+	}
+
+	for _, test := range tests {
+		if got := a.canAccess(&test.user, test.id); got != test.want {
+			t.Errorf("%+v access %s: got %v, want %v", test.user,
+				test.id, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := &memAuthStore{}
+	a := newAuth(nil, store)
+	a.load()
+
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// No users and no boot user: open
+	if u := a.authenticate(r, "", noPam); u == nil || u.Role != RoleOperator {
+		t.Fatalf("Got %+v, want anonymous operator", u)
+	}
+
+	// No users: boot user is admin, once validated
+	r.SetBasicAuth("root", "secret")
+	if u := a.authenticate(r, "root", noPam); u != nil {
+		t.Fatalf("Got %+v, want unauthenticated", u)
+	}
+	pam := func(user, passwd string) (bool, error) {
+		return user == "root" && passwd == "secret", nil
+	}
+	if u := a.authenticate(r, "root", pam); u == nil || u.Role != RoleAdmin {
+		t.Fatalf("Got %+v, want boot admin", u)
+	}
+
+	hash, _ := hashPasswd("pw")
+	token, rec, err := newToken("bob", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.update(func(data *AuthData) error {
+		data.Users = []AuthUser{
+			{Name: "root", Role: RoleAdmin},
+			{Name: "bob", Role: RoleViewer, PasswdHash: hash},
+		}
+		data.Tokens = []AuthToken{rec}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.data.Users) != 2 {
+		t.Fatalf("Users not saved")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "pw")
+	if u := a.authenticate(r, "root", noPam); u == nil || u.Name != "bob" {
+		t.Fatalf("Got %+v, want bob", u)
+	}
+	r.SetBasicAuth("bob", "wrong")
+	if u := a.authenticate(r, "root", noPam); u != nil {
+		t.Fatalf("Got %+v with wrong password", u)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if u := a.authenticate(r, "root", noPam); u == nil || u.Name != "bob" {
+		t.Fatalf("Got %+v, want bob by token", u)
+	}
+	r.Header.Set("Authorization", "Bearer nope")
+	if u := a.authenticate(r, "root", noPam); u != nil {
+		t.Fatalf("Got %+v with bad token", u)
+	}
+
+	// Last admin can't be removed
+	err = a.update(func(data *AuthData) error {
+		data.Users = data.Users[1:]
+		return checkAdmins(data.Users)
+	})
+	if err == nil || len(a.snapshot().Users) != 2 {
+		t.Fatalf("Removed last admin")
+	}
+}
+
+func TestAdminUser(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.SetAuthStore(&memAuthStore{})
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := &AuthUser{Name: "root", Role: RoleAdmin}
+	post := func(user *AuthUser, origin string, form url.Values) int {
+		r := httptest.NewRequest("POST", "http://thing/admin/user",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", origin)
+		r = r.WithContext(context.WithValue(r.Context(), authUserKey{}, user))
+		w := httptest.NewRecorder()
+		thing.adminOnly(thing.adminUser)(w, r)
+		return w.Code
+	}
+
+	form := url.Values{"name": {"root"}, "role": {RoleAdmin}}
+
+	if code := post(admin, "http://evil", form); code != http.StatusForbidden {
+		t.Fatalf("Cross-origin post got %d", code)
+	}
+	viewer := &AuthUser{Name: "bob", Role: RoleViewer}
+	if code := post(viewer, "http://thing", form); code != http.StatusForbidden {
+		t.Fatalf("Viewer post got %d", code)
+	}
+	if code := post(admin, "http://thing", form); code != http.StatusSeeOther {
+		t.Fatalf("Admin post got %d", code)
+	}
+
+	users := thing.auth.snapshot().Users
+	if len(users) != 1 || users[0].Name != "root" {
+		t.Fatalf("Got users %+v", users)
+	}
+
+	form = url.Values{"name": {"root"}, "action": {"delete"}}
+	if code := post(admin, "http://thing", form); code != http.StatusBadRequest {
+		t.Fatalf("Deleting last admin got %d", code)
+	}
+}
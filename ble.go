@@ -0,0 +1,101 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"io"
+)
+
+// Merle's GATT service, for BLE links.  The UUIDs are the Nordic UART
+// Service's, so phone apps that speak NUS, e.g. nRF Connect or a serial
+// terminal, can talk to Thing.
+const (
+	BLEServiceUUID = "6e400001-b5a3-f393-e0a9-e50e24dcca9e"
+	// Write characteristic, for messages to Thing
+	BLECommandUUID = "6e400002-b5a3-f393-e0a9-e50e24dcca9e"
+	// Notify characteristic, for Thing's replies and broadcasts
+	BLEBroadcastUUID = "6e400003-b5a3-f393-e0a9-e50e24dcca9e"
+)
+
+// Largest value notified: the default ATT MTU, 23 bytes, less the 3-byte
+// notification header, so any central can take it
+const bleChunkSize = 20
+
+// BLEPeripheral is a Bluetooth LE radio, in the peripheral role, serving
+// Merle's GATT service.  Wrap the platform's BLE stack, e.g.
+// tinygo.org/x/bluetooth, which runs on Linux (BlueZ) and on
+// microcontrollers, to implement it.
+type BLEPeripheral interface {
+	// Advertise as name, and serve Merle's GATT service: BLECommandUUID,
+	// with write, and BLEBroadcastUUID, with notify.  Each value written
+	// to BLECommandUUID is passed to write, in order.
+	Start(name string, write func(value []byte)) error
+	// Notify value to the centrals subscribed to BLEBroadcastUUID
+	Notify(value []byte) error
+	// Stop advertising and serving
+	Stop()
+}
+
+// BLE link, as a port for a serial socket: values written by the central
+// are read from a pipe; lines written are notified, in chunks.
+type bleLink struct {
+	periph BLEPeripheral
+	sock   *serialSocket
+	r      *io.PipeReader
+	w      *io.PipeWriter
+}
+
+// AddBLE adds a BLE link to Thing, on periph, advertised as name.  Call
+// before Run().  A phone, as central, connected to Thing over BLE is a
+// client of Thing, as on a serial link (see AddSerial): messages are JSON,
+// one per line, written to BLECommandUUID and notified on BLEBroadcastUUID,
+// in as many values as they take.  A BLE link lets a phone talk to Thing
+// before Thing is on a network, e.g. to send Thing Wi-Fi credentials in a
+// message Thing subscribes to.
+func (t *Thing) AddBLE(name string, periph BLEPeripheral) {
+	r, w := io.Pipe()
+	l := &bleLink{periph: periph, r: r, w: w}
+	l.sock = &serialSocket{thing: t, name: name,
+		flags: sock_flag_private, port: l}
+	t.bles = append(t.bles, l)
+}
+
+func (l *bleLink) start() error {
+	err := l.periph.Start(l.sock.name, func(value []byte) {
+		// Blocks until the socket's reader has the value
+		l.w.Write(value)
+	})
+	if err != nil {
+		return err
+	}
+	return l.sock.start()
+}
+
+func (l *bleLink) stop() {
+	l.sock.stop()
+}
+
+func (l *bleLink) Read(p []byte) (int, error) {
+	return l.r.Read(p)
+}
+
+func (l *bleLink) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += bleChunkSize {
+		end := off + bleChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := l.periph.Notify(p[off:end]); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+func (l *bleLink) Close() error {
+	l.periph.Stop()
+	l.w.Close()
+	return l.r.Close()
+}
@@ -0,0 +1,80 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// BLE peripheral, with a central writing and taking notifications
+type fakePeripheral struct {
+	name     string
+	write    func([]byte)
+	notified chan []byte
+	stopped  bool
+}
+
+func (f *fakePeripheral) Start(name string, write func([]byte)) error {
+	f.name, f.write = name, write
+	return nil
+}
+
+func (f *fakePeripheral) Notify(value []byte) error {
+	f.notified <- append([]byte(nil), value...)
+	return nil
+}
+
+func (f *fakePeripheral) Stop() {
+	f.stopped = true
+}
+
+func TestBLE(t *testing.T) {
+	thing := NewThing(&echo{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakePeripheral{notified: make(chan []byte, 10)}
+	thing.AddBLE("merle", f)
+	l := thing.bles[0]
+	if err := l.start(); err != nil {
+		t.Fatal(err)
+	}
+	if f.name != "merle" {
+		t.Errorf("Advertised as %q", f.name)
+	}
+
+	// A message, in values, and its reply, in chunks
+	f.write([]byte(`{"Msg":"Echo","Pad":`))
+	f.write([]byte(`"` + strings.Repeat("x", 30) + "\"}\n"))
+
+	var got string
+	want := `{"Msg":"Echo","Pad":"` + strings.Repeat("x", 30) + "\"}\n"
+	for len(got) < len(want) {
+		select {
+		case value := <-f.notified:
+			if len(value) > bleChunkSize {
+				t.Errorf("Notified %d bytes", len(value))
+			}
+			got += string(value)
+		case <-time.After(time.Second):
+			t.Fatalf("Got %q, want %q", got, want)
+		}
+	}
+	if got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	l.stop()
+	if !f.stopped {
+		t.Errorf("Peripheral not stopped")
+	}
+}
@@ -10,11 +10,15 @@ package merle
 import (
 	"fmt"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 // BridgeThingers is a map of functions which can generate Thingers, keyed by a
 // regular expression (re) of the form: id:model:name.  The keys specify which
-// Things can attach to the bridge.
+// Things can attach to the bridge.  A nil function means the model's UI comes
+// from the model's bundle (see BundleConfig).
 type BridgeThingers map[string]func() Thinger
 
 // A Thing implementing the Bridger interface is a Bridge
@@ -40,39 +44,158 @@ type Bridger interface {
 	BridgeSubscribers() Subscribers
 }
 
+// BridgeLimit limits the number of children matching a pattern that can be
+// attached to the bridge at once.  Match is a regular expression of the form
+// id:model:name, usually a key of BridgeThingers.  For example, to allow at
+// most two relays:
+//
+//	thing.Cfg.BridgeLimits = []merle.BridgeLimit{
+//		{Match: ".*:relays:.*", Max: 2},
+//	}
+//
+// Run fails if a Match isn't a valid regular expression.
+type BridgeLimit struct {
+	Match string
+	Max   uint
+}
+
 // children are the Things connected to the bridge, map keyed by Child Id
 type children map[string]*Thing
 
 // Bridge backing struct
 type bridge struct {
-	thing    *Thing
-	thingers BridgeThingers
-	children children
-	bus      *bus
-	ports    *ports
+	thing *Thing
+	// thingersLock protects thingers, which can change on config reload
+	thingersLock sync.RWMutex
+	thingers     BridgeThingers
+	childrenLock sync.RWMutex
+	children     children
+	bus          *bus
+	ports        *ports
+	// Ports for children discovered on the LAN, keyed by child Id
+	lanPorts map[string]*port
+	done     chan bool
+	// Ids blocked from attaching
+	blockedLock sync.RWMutex
+	blocked     map[string]bool
+	// Spec (id:model:name) of children attached, keyed by port
+	attachedLock sync.Mutex
+	attached     map[*port]string
+	// Cfg.BridgeLimits' Match, compiled
+	limits []*regexp.Regexp
+	// Cfg.BridgeGroups' Match, compiled
+	groupMatch []*regexp.Regexp
+	// Groups added by GroupChild, keyed by child Id
+	groupsLock sync.RWMutex
+	groups     map[string]map[string]bool
+	// Fan-outs waiting on each child's reply, keyed by child Id
+	fanOutLock sync.Mutex
+	fanOuts    map[string][]*fanOutSocket
+}
+
+// Compile each BridgeLimit's Match
+func compileLimits(limits []BridgeLimit) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, limit := range limits {
+		re, err := regexp.Compile(limit.Match)
+		if err != nil {
+			return nil, fmt.Errorf("BridgeLimits regexp error: %s", err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
 }
 
-func newBridge(thing *Thing, portBegin, portEnd uint) *bridge {
+func newBridge(thing *Thing, portBegin, portEnd uint) (*bridge, error) {
 	bridger := thing.thinger.(Bridger)
 
+	limits, err := compileLimits(thing.Cfg.BridgeLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	groupMatch, err := compileGroups(thing.Cfg.BridgeGroups)
+	if err != nil {
+		return nil, err
+	}
+
 	b := &bridge{
-		thing:    thing,
-		thingers: bridger.BridgeThingers(),
-		children: make(children),
+		thing:      thing,
+		thingers:   bridger.BridgeThingers(),
+		children:   make(children),
+		lanPorts:   make(map[string]*port),
+		done:       make(chan bool),
+		blocked:    make(map[string]bool),
+		attached:   make(map[*port]string),
+		limits:     limits,
+		groupMatch: groupMatch,
+		groups:     make(map[string]map[string]bool),
+		fanOuts:    make(map[string][]*fanOutSocket),
 		bus: newBus(thing, thing.Cfg.MaxConnections,
 			bridger.BridgeSubscribers()),
 	}
 
-	b.ports = newPorts(thing, portBegin, portEnd, b.bridgeAttach)
+	for _, id := range thing.Cfg.BridgeBlock {
+		b.blocked[id] = true
+	}
+
+	b.ports = newPorts(thing, portBegin, portEnd,
+		thing.Cfg.BridgePortsFile, b.bridgeAttach)
 	b.thing.web.handleBridgePortId()
+	b.thing.web.handleBridgeChildren(b)
+
+	for _, msg := range []string{GetChildren, DetachChild, BlockChild,
+		UnblockChild, RenameChild, GroupChild, UngroupChild} {
+		thing.bus.subscribe(msg, b.manageChild)
+	}
+	thing.bus.subscribe(FanOut, thing.fanOutMsg)
+
+	return b, nil
+}
+
+// Children, as a list
+func (b *bridge) childThings() []*Thing {
+	b.childrenLock.RLock()
+	defer b.childrenLock.RUnlock()
+
+	things := make([]*Thing, 0, len(b.children))
+	for _, child := range b.children {
+		things = append(things, child)
+	}
 
-	return b
+	return things
 }
 
 func (b *bridge) getChild(id string) *Thing {
+	b.childrenLock.RLock()
+	defer b.childrenLock.RUnlock()
 	return b.children[id]
 }
 
+// Child's name, which RenameChild may change
+func (b *bridge) childName(child *Thing) string {
+	b.childrenLock.RLock()
+	defer b.childrenLock.RUnlock()
+	return child.name
+}
+
+// Whether child is attached.  The port's goroutine sets it, under the
+// lock, as child attaches and detaches.
+func (b *bridge) childOnline(child *Thing) bool {
+	b.childrenLock.RLock()
+	defer b.childrenLock.RUnlock()
+	return child.online
+}
+
+func (b *bridge) setChildOnline(child *Thing, online bool) {
+	b.childrenLock.Lock()
+	defer b.childrenLock.Unlock()
+	child.online = online
+	if online {
+		child.powerLost = false
+	}
+}
+
 func (t *Thing) getChild(id string) *Thing {
 	if !t.isBridge {
 		return nil
@@ -80,6 +203,25 @@ func (t *Thing) getChild(id string) *Thing {
 	return t.bridge.getChild(id)
 }
 
+// Find the BridgeThingers entry matching spec (id:model:name)
+func (b *bridge) match(spec string) (func() Thinger, bool, error) {
+	b.thingersLock.RLock()
+	thingers := b.thingers
+	b.thingersLock.RUnlock()
+
+	for key, f := range thingers {
+		match, err := regexp.MatchString(key, spec)
+		if err != nil {
+			return nil, false, fmt.Errorf("Thinger regexp error: %s", err)
+		}
+		if match {
+			return f, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
 func (b *bridge) newChild(id, model, name string) (*Thing, error) {
 	var thinger Thinger
 
@@ -91,16 +233,20 @@ func (b *bridge) newChild(id, model, name string) (*Thing, error) {
 
 	spec := id + ":" + model + ":" + name
 
-	for key, f := range b.thingers {
-		match, err := regexp.MatchString(key, spec)
-		if err != nil {
-			return nil, fmt.Errorf("Thinger regexp error: %s", err)
-		}
-		if match {
-			if f != nil {
-				thinger = f()
+	f, match, err := b.match(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if match {
+		if f != nil {
+			thinger = f()
+		} else {
+			// No Go code for model; use model's bundle
+			thinger, err = b.thing.bundleThinger(model)
+			if err != nil {
+				return nil, fmt.Errorf("Bundle for [%s]: %s", spec, err)
 			}
-			break
 		}
 	}
 
@@ -114,23 +260,44 @@ func (b *bridge) newChild(id, model, name string) (*Thing, error) {
 	child.Cfg.Model = model
 	child.Cfg.Name = name
 	child.Cfg.IsPrime = true
-
-	err := child.build(false)
+	child.Cfg.Chaos = b.thing.Cfg.Chaos
+	child.Cfg.LinkSeq = b.thing.Cfg.LinkSeq
+	child.Cfg.TrustProxy = b.thing.Cfg.TrustProxy
+	child.Cfg.TrustedProxies = b.thing.Cfg.TrustedProxies
+	child.Cfg.BasePath = b.thing.Cfg.BasePath
+	child.Cfg.SecurityHeaders = b.thing.Cfg.SecurityHeaders
+
+	err = child.build(false)
 	if err != nil {
 		return nil, err
 	}
 
 	b.thing.setAssetsDir(child)
 
+	child.fromThing = b.fanOutHeard
+
+	if b.thing.graphql != nil {
+		b.thing.graphql.watch(child, b)
+	}
+
 	return child, nil
 }
 
 func (b *bridge) sendStatus(child *Thing) {
-	msg := MsgEventStatus{Msg: EventStatus, Id: child.id, Online: child.online}
+	online := b.childOnline(child)
+	msg := MsgEventStatus{Msg: EventStatus, Id: child.id, Online: online,
+		PowerLost: !online && child.powerLost}
 	b.thing.bus.receive(newPacket(b.thing.bus, nil, &msg))
 	newPacket(child.bus, child.primeSock, &msg).Broadcast()
 }
 
+// Send child connected/disconnected msg to the bridge bus and to the
+// bridge's own bus
+func (b *bridge) sendPresence(msg interface{}) {
+	b.bus.receive(newPacket(b.bus, nil, msg))
+	b.thing.bus.receive(newPacket(b.thing.bus, nil, msg))
+}
+
 func (b *bridge) bridgeReady(child *Thing) {
 	child.bridgeSock = newWireSocket("bridge sock", b.bus, nil)
 	child.childSock = newWireSocket("child sock", child.bus, child.bridgeSock)
@@ -139,21 +306,105 @@ func (b *bridge) bridgeReady(child *Thing) {
 	b.bus.plugin(child.childSock)
 	child.bus.plugin(child.bridgeSock)
 
-	child.online = true
+	b.setChildOnline(child, true)
 	b.sendStatus(child)
+	b.sendPresence(&MsgChildConnected{Msg: EventChildConnected,
+		Id: child.id, Model: child.model, Name: b.childName(child)})
+	b.thing.sendMotherHints(child.primeSock)
+	b.thing.sendConfigTemplate(child.primeSock, child.model, child.tags)
+	child.getJournalSince()
 }
 
 func (b *bridge) bridgeCleanup(child *Thing) {
-	child.online = false
+	b.setChildOnline(child, false)
 	b.sendStatus(child)
+	b.sendPresence(&MsgChildDisconnected{Msg: EventChildDisconnected,
+		Id: child.id, Model: child.model, Name: b.childName(child)})
 
 	child.bus.unplug(child.bridgeSock)
 	b.bus.unplug(child.childSock)
+
+	if b.thing.registry != nil {
+		b.thing.registry.gone(child.id)
+	}
+}
+
+// Is a child with id attached on some port?  Call with attachedLock held.
+func (b *bridge) isAttached(id string) bool {
+	for _, spec := range b.attached {
+		if strings.HasPrefix(spec, id+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the bridge full, with MaxChildren children attached?  A child already
+// attached, reconnecting, isn't turned away.
+func (b *bridge) full(id string) bool {
+	max := b.thing.Cfg.MaxChildren
+
+	b.attachedLock.Lock()
+	defer b.attachedLock.Unlock()
+
+	return max > 0 && uint(len(b.attached)) >= max && !b.isAttached(id)
+}
+
+// Reserve a place on the bridge for a child on port p, if the child is within
+// MaxChildren and BridgeLimits
+func (b *bridge) reserve(p *port, id, spec string) error {
+	b.attachedLock.Lock()
+	defer b.attachedLock.Unlock()
+
+	if !b.isAttached(id) {
+		max := b.thing.Cfg.MaxChildren
+		if max > 0 && uint(len(b.attached)) >= max {
+			return fmt.Errorf("Bridge full: MaxChildren %d attached; not attaching [%s]",
+				max, spec)
+		}
+
+		for i, limit := range b.thing.Cfg.BridgeLimits {
+			re := b.limits[i]
+			if !re.MatchString(spec) {
+				continue
+			}
+			count := uint(0)
+			for _, attached := range b.attached {
+				if re.MatchString(attached) {
+					count++
+				}
+			}
+			if count >= limit.Max {
+				return fmt.Errorf("Bridge full: limit %d for \"%s\" attached; not attaching [%s]",
+					limit.Max, limit.Match, spec)
+			}
+		}
+	}
+
+	b.attached[p] = spec
+
+	return nil
+}
+
+func (b *bridge) release(p *port) {
+	b.attachedLock.Lock()
+	delete(b.attached, p)
+	b.attachedLock.Unlock()
 }
 
 func (b *bridge) bridgeAttach(p *port, msg *MsgIdentity) error {
 	var err error
 
+	if b.isBlocked(msg.Id) {
+		return fmt.Errorf("Child [%s] is blocked", msg.Id)
+	}
+
+	spec := msg.Id + ":" + msg.Model + ":" + msg.Name
+	if err := b.reserve(p, msg.Id, spec); err != nil {
+		return err
+	}
+	defer b.release(p)
+
 	child := b.getChild(msg.Id)
 
 	if child == nil {
@@ -161,32 +412,119 @@ func (b *bridge) bridgeAttach(p *port, msg *MsgIdentity) error {
 		if err != nil {
 			return fmt.Errorf("%s: Bridge attach creating new child", err)
 		}
+		b.childrenLock.Lock()
 		b.children[msg.Id] = child
+		b.childrenLock.Unlock()
 	} else {
 		if child.model != msg.Model {
 			return fmt.Errorf("Bridge attach model mismatch")
 		}
-		if child.name != msg.Name {
+		// Child may be renamed on the bridge; check the child's own name
+		if child.Cfg.Name != msg.Name {
 			return fmt.Errorf("Bridge attach name mismatch")
 		}
 	}
 
+	b.childrenLock.Lock()
 	child.primePort = p
+	b.childrenLock.Unlock()
+	child.tags = msg.Tags
 	child.startupTime = msg.StartupTime
+	child.journaling = msg.Journal
+
+	if b.thing.registry != nil {
+		b.thing.registry.seen(msg)
+	}
 
 	return child.runOnPort(p, b.bridgeReady, b.bridgeCleanup)
 }
 
-func (b *bridge) start() {
+// Refresh the bridge match rules from the Bridger.  Children already
+// attached are not affected.
+func (b *bridge) reloadThingers() {
+	thingers := b.thing.thinger.(Bridger).BridgeThingers()
+
+	b.thingersLock.Lock()
+	b.thingers = thingers
+	b.thingersLock.Unlock()
+}
+
+// Attach Things discovered on the LAN which match BridgeThingers.  The
+// bridge dials the Thing's private HTTP server directly, as the Thing's
+// mother, so no tunnel is needed.
+func (b *bridge) lanAttach(things []DiscoveredThing) {
+	for _, d := range things {
+		if d.Id == b.thing.id || d.PortPrivate == 0 {
+			continue
+		}
+
+		spec := d.Id + ":" + d.Model + ":" + d.Name
+		if _, match, _ := b.match(spec); !match {
+			continue
+		}
+
+		if child := b.getChild(d.Id); child != nil && b.childOnline(child) {
+			// Already attached, maybe over a tunnel
+			continue
+		}
+
+		p, ok := b.lanPorts[d.Id]
+		if !ok {
+			p = newPort(b.thing, d.PortPrivate, b.bridgeAttach)
+			b.lanPorts[d.Id] = p
+		}
+
+		p.Lock()
+		if !p.tunnelConnected {
+			// Thing may have moved
+			p.host, p.port = d.Host, d.PortPrivate
+			p.tunnelConnected = true
+			b.thing.log.printf("Attaching LAN Thing [%s] at %s:%d",
+				spec, p.host, p.port)
+			go p.attach()
+		}
+		p.Unlock()
+	}
+}
+
+// Discover Things on the LAN every interval seconds
+func (b *bridge) discover(interval uint) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		things, err := Discover(2 * time.Second)
+		if err != nil {
+			b.thing.log.println("Bridge discovery failed:", err)
+		} else {
+			b.lanAttach(things)
+		}
+
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *bridge) start() error {
 	if err := b.ports.start(); err != nil {
-		b.thing.log.println("Starting bridge error:", err)
+		return err
+	}
+	if interval := b.thing.Cfg.BridgeDiscover; interval > 0 {
+		go b.discover(interval)
 	}
 	msg := Msg{Msg: CmdRun}
 	go b.bus.receive(newPacket(b.bus, nil, &msg))
+	return nil
 }
 
 func (b *bridge) stop() {
 	b.ports.stop()
+	if b.thing.Cfg.BridgeDiscover > 0 {
+		b.done <- true
+	}
 	b.bus.close()
 }
 
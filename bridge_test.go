@@ -0,0 +1,427 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lamp struct {
+	Msg     string
+	On      bool
+	toggled chan bool
+}
+
+func (l *lamp) getState(p *Packet) {
+	l.Msg = ReplyState
+	p.Marshal(l).Reply()
+}
+
+func (l *lamp) toggle(p *Packet) {
+	if !p.IsThing() {
+		p.Broadcast()
+		return
+	}
+	if l.toggled != nil {
+		l.toggled <- true
+	}
+}
+
+func (l *lamp) Subscribers() Subscribers {
+	return Subscribers{
+		CmdRun:     RunForever,
+		GetState:   l.getState,
+		ReplyState: nil,
+		"Toggle":   l.toggle,
+	}
+}
+
+func (l *lamp) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+type lampHub struct {
+	sparse
+	sync.Mutex
+	presence []string
+}
+
+func (h *lampHub) savePresence(p *Packet) {
+	var msg MsgChildConnected
+	p.Unmarshal(&msg)
+
+	h.Lock()
+	h.presence = append(h.presence, msg.Msg+":"+msg.Id+":"+msg.Model)
+	h.Unlock()
+}
+
+func (h *lampHub) BridgeThingers() BridgeThingers {
+	return BridgeThingers{
+		".*:lamp:.*": func() Thinger { return &lamp{} },
+	}
+}
+
+func (h *lampHub) BridgeSubscribers() Subscribers {
+	return Subscribers{
+		EventChildConnected:    h.savePresence,
+		EventChildDisconnected: h.savePresence,
+		"default":              nil,
+	}
+}
+
+func TestBridgeLanAttach(t *testing.T) {
+	child := NewThing(&lamp{})
+	child.Cfg.Id = "lamp01"
+	child.Cfg.Model = "lamp"
+	child.Cfg.PortPrivate = 8092
+	child.Cfg.Advertise = false
+	go child.Run()
+
+	hub := NewThing(&lampHub{})
+	hub.Cfg.Id = "hub01"
+	if err := hub.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for child's private server
+	time.Sleep(time.Second)
+
+	hub.bridge.lanAttach([]DiscoveredThing{
+		{Id: "lamp01", Model: "lamp", Name: "Thingy",
+			Host: "127.0.0.1", PortPrivate: 8092},
+		{Id: "fan01", Model: "fan", Name: "Thingy",
+			Host: "127.0.0.1", PortPrivate: 8093},
+	})
+
+	if _, ok := hub.bridge.lanPorts["fan01"]; ok {
+		t.Errorf("Attaching Thing not matching BridgeThingers")
+	}
+
+	for i := 0; i < 20; i++ {
+		if c := hub.getChild("lamp01"); c != nil && hub.bridge.childOnline(c) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("LAN Thing didn't attach")
+}
+
+func waitOnline(hub *Thing, id string, online bool) bool {
+	for i := 0; i < 20; i++ {
+		if c := hub.getChild(id); c != nil && hub.bridge.childOnline(c) == online {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// Re-attach child found on the LAN, once the bridge has closed the child's
+// last connection
+func reattach(hub *Thing, found []DiscoveredThing) bool {
+	for i := 0; i < 20; i++ {
+		hub.bridge.lanAttach(found)
+		if c := hub.getChild(found[0].Id); c != nil && hub.bridge.childOnline(c) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func TestBridgeChildren(t *testing.T) {
+	lamp02 := &lamp{toggled: make(chan bool, 1)}
+	child := NewThing(lamp02)
+	child.Cfg.Id = "lamp02"
+	child.Cfg.Model = "lamp"
+	child.Cfg.PortPrivate = 8094
+	child.Cfg.Advertise = false
+	go child.Run()
+
+	lampHub := &lampHub{}
+	hub := NewThing(lampHub)
+	hub.Cfg.Id = "hub02"
+	hub.Cfg.BridgeGroups = []BridgeGroup{{Name: "front", Match: ".*:lamp:Porch"}}
+	if err := hub.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+
+	found := []DiscoveredThing{{Id: "lamp02", Model: "lamp", Name: "Thingy",
+		Host: "127.0.0.1", PortPrivate: 8094}}
+
+	hub.bridge.lanAttach(found)
+	if !waitOnline(hub, "lamp02", true) {
+		t.Fatal("LAN Thing didn't attach")
+	}
+
+	// Rename with a message; a renamed child still re-attaches
+
+	sock := &recordSocket{flags: sock_flag_private}
+	msg := MsgChild{Msg: RenameChild, Id: "lamp02", Name: "Porch"}
+	hub.bus.receive(newPacket(hub.bus, sock, &msg))
+
+	var resp MsgChildren
+	if len(sock.sent) != 1 {
+		t.Fatalf("Want one reply, got %v", sock.sent)
+	}
+	json.Unmarshal([]byte(sock.sent[0]), &resp)
+	if len(resp.Children) != 1 || resp.Children[0].Name != "Porch" {
+		t.Errorf("Rename failed: %+v", resp)
+	}
+	// BridgeGroups match the new name
+	if groups := resp.Children[0].Groups; len(groups) != 1 || groups[0] != "front" {
+		t.Errorf("Renamed child in groups %v", groups)
+	}
+
+	private := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		hub.web.private.mux.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := private("POST", "/children/lamp02/detach"); w.Code != http.StatusOK {
+		t.Fatalf("Detach: %d %s", w.Code, w.Body)
+	}
+	if !waitOnline(hub, "lamp02", false) {
+		t.Fatal("Child didn't detach")
+	}
+	if !reattach(hub, found) {
+		t.Fatal("Renamed child didn't re-attach")
+	}
+
+	// Group child and send to the group
+
+	w := private("POST", "/children/lamp02/group?group=porch")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Groups":["front","porch"]`) {
+		t.Fatalf("Group: %d %s", w.Code, w.Body)
+	}
+	newPacket(hub.bus, nil, &Msg{Msg: "Toggle"}).SendGroup("garage")
+	newPacket(hub.bus, nil, &Msg{Msg: "Toggle"}).SendGroup("porch")
+	select {
+	case <-lamp02.toggled:
+	case <-time.After(time.Second):
+		t.Errorf("Child in group didn't get message")
+	}
+	select {
+	case <-lamp02.toggled:
+		t.Errorf("Child got message sent to another group")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Fan-out GetState to the group
+
+	sock = &recordSocket{}
+	hub.bus.receive(newPacket(hub.bus, sock, &MsgFanOut{Msg: FanOut,
+		Group: "porch", Send: []byte(`{"Msg":"_GetState"}`)}))
+	var fan MsgFanOutReply
+	if len(sock.sent) == 1 {
+		json.Unmarshal([]byte(sock.sent[0]), &fan)
+	}
+	if len(fan.Results) != 1 || fan.Results[0].Id != "lamp02" ||
+		fan.Results[0].Status != FanOutReplied ||
+		!strings.Contains(string(fan.Results[0].Reply), ReplyState) {
+		t.Errorf("Fan-out: %v", sock.sent)
+	}
+	results := newPacket(hub.bus, nil, &Msg{Msg: "Toggle"}).FanOut("",
+		100*time.Millisecond)
+	if len(results) != 1 || results[0].Status != FanOutTimeout {
+		t.Errorf("Fan-out without reply: %+v", results)
+	}
+	<-lamp02.toggled
+
+	// Thing's Ack is the reply to a keyed command
+
+	results = newPacket(hub.bus, nil, &msgKeyed{Msg: "Toggle",
+		IdempotencyKey: "fan1"}).FanOut("", time.Second)
+	if len(results) != 1 || results[0].Status != FanOutReplied ||
+		!strings.Contains(string(results[0].Reply), Ack) {
+		t.Errorf("Fan-out command: %+v", results)
+	}
+	<-lamp02.toggled
+
+	// Only to children the user can access
+
+	hub.auth = &auth{thing: hub}
+	viewer := &AuthUser{Name: "v", Role: RoleViewer, Grants: []string{"lamp01"}}
+	send := newPacket(hub.bus, nil, &Msg{Msg: GetState})
+	if results := hub.fanOutAs(send, "", time.Second, viewer); len(results) != 0 {
+		t.Errorf("Fan-out without access: %+v", results)
+	}
+	viewer.Grants = []string{"lamp02"}
+	if results := hub.fanOutAs(send, "", time.Second, viewer); len(results) != 1 {
+		t.Errorf("Fan-out with access: %+v", results)
+	}
+	hub.auth = nil
+
+	lampHub.Lock()
+	presence := strings.Join(lampHub.presence, " ")
+	lampHub.Unlock()
+	want := "_EventChildConnected:lamp02:lamp _EventChildDisconnected:lamp02:lamp " +
+		"_EventChildConnected:lamp02:lamp"
+	if presence != want {
+		t.Errorf("Got presence %q, want %q", presence, want)
+	}
+
+	// Blocked child is detached and stays off
+
+	w = private("POST", "/children/lamp02/block")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Blocked":["lamp02"]`) {
+		t.Fatalf("Block: %d %s", w.Code, w.Body)
+	}
+	if !waitOnline(hub, "lamp02", false) {
+		t.Fatal("Blocked child didn't detach")
+	}
+	hub.bridge.lanAttach(found)
+	time.Sleep(500 * time.Millisecond)
+	if hub.bridge.childOnline(hub.getChild("lamp02")) {
+		t.Errorf("Blocked child re-attached")
+	}
+
+	private("POST", "/children/lamp02/unblock")
+	hub.bridge.lanAttach(found)
+	if !waitOnline(hub, "lamp02", true) {
+		t.Errorf("Unblocked child didn't re-attach")
+	}
+
+	if w := private("POST", "/children/nobody/rename"); w.Code != http.StatusBadRequest {
+		t.Errorf("Rename unknown child: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/children/lamp02/block", nil)
+	r.Header.Set("Origin", "http://evil.example")
+	hub.web.private.mux.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || hub.bridge.isBlocked("lamp02") {
+		t.Errorf("Cross-origin block: %d", w.Code)
+	}
+
+	// Not on the public server
+	sock = &recordSocket{}
+	hub.bus.receive(newPacket(hub.bus, sock, &Msg{Msg: GetChildren}))
+	if len(sock.sent) != 0 {
+		t.Errorf("GetChildren answered on public server")
+	}
+}
+
+func TestBridgePortsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "ports.json")
+
+	p := newPorts(thing, 8000, 8003, file, nil)
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{}
+	for _, id := range []string{"a", "b", "c"} {
+		want[id] = p.getPort(id)
+	}
+
+	// After restart, each Id gets its old port, and a new Id gets the
+	// unassigned port
+
+	p = newPorts(thing, 8000, 8003, file, nil)
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	if port := p.getPort("d"); port != 8003 {
+		t.Errorf("New Id got port %d, want 8003", port)
+	}
+	for _, id := range []string{"c", "b", "a"} {
+		if port := p.getPort(id); port != want[id] {
+			t.Errorf("Id %s got port %d, want %d", id, port, want[id])
+		}
+	}
+
+	// A corrupt map starts empty
+	ioutil.WriteFile(file, []byte(`{"a":80`), 0600)
+	p = newPorts(thing, 8000, 8003, file, nil)
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	if port := p.getPort("d"); port != 8000 {
+		t.Errorf("Id d got port %d after corrupt map, want 8000", port)
+	}
+}
+
+func TestBridgeLimits(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.MaxChildren = 3
+	thing.Cfg.BridgeLimits = []BridgeLimit{{Match: ".*:lamp:.*", Max: 1}}
+
+	limits, err := compileLimits(thing.Cfg.BridgeLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bridge{thing: thing, attached: make(map[*port]string),
+		limits: limits}
+	ports := make([]port, 5)
+
+	if err := b.reserve(&ports[0], "lamp01", "lamp01:lamp:one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.reserve(&ports[1], "lamp02", "lamp02:lamp:two"); err == nil {
+		t.Errorf("Second lamp attached over limit")
+	}
+	// Reconnecting lamp isn't turned away
+	if err := b.reserve(&ports[1], "lamp01", "lamp01:lamp:one"); err != nil {
+		t.Errorf("Reconnecting lamp turned away: %s", err)
+	}
+	if err := b.reserve(&ports[2], "relay01", "relay01:relay:one"); err != nil {
+		t.Fatal(err)
+	}
+	if !b.full("relay02") || b.full("lamp01") {
+		t.Errorf("MaxChildren not enforced")
+	}
+	if err := b.reserve(&ports[3], "relay02", "relay02:relay:two"); err == nil {
+		t.Errorf("Attached over MaxChildren")
+	}
+
+	b.release(&ports[0])
+	b.release(&ports[1])
+	if err := b.reserve(&ports[3], "lamp02", "lamp02:lamp:two"); err != nil {
+		t.Errorf("Lamp turned away after release: %s", err)
+	}
+
+	// Bad regexp fails the build
+	hub := NewThing(&lampHub{})
+	hub.Cfg.Id = "hub03"
+	hub.Cfg.BridgeLimits = []BridgeLimit{{Match: "lamp(", Max: 1}}
+	if err := hub.build(true); err == nil {
+		t.Errorf("Bad BridgeLimits regexp allowed")
+	}
+	hub = NewThing(&lampHub{})
+	hub.Cfg.Id = "hub03"
+	hub.Cfg.BridgeGroups = []BridgeGroup{{Name: "lamps", Match: "lamp("}}
+	if err := hub.build(true); err == nil {
+		t.Errorf("Bad BridgeGroups regexp allowed")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func testBundle(files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644,
+			Size: int64(len(body)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestBundleFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+
+	good := testBundle(map[string]string{
+		"manifest.json":            `{"Model":"sprinkler","Version":"1.0.0","HtmlTemplate":"templates/sprinkler.html"}`,
+		"templates/sprinkler.html": "<html></html>",
+	})
+	older := testBundle(map[string]string{
+		"manifest.json": `{"Model":"sprinkler","Version":"0.9.0"}`,
+	})
+	newer := testBundle(map[string]string{
+		"manifest.json": `{"Model":"sprinkler","Version":"1.10.0"}`,
+	})
+	evil := testBundle(map[string]string{
+		"manifest.json": `{"Model":"evil","Version":"1.0.0"}`,
+		"../escape":     "gotcha",
+	})
+
+	registry := map[string][]byte{
+		"/sprinkler/1.0.0.tar.gz":     good,
+		"/sprinkler/1.0.0.tar.gz.sig": ed25519.Sign(priv, good),
+		"/forged/1.0.0.tar.gz":        good,
+		"/forged/1.0.0.tar.gz.sig":    ed25519.Sign(other, good),
+		"/sprinkler/2.0.0.tar.gz":     older,
+		"/sprinkler/2.0.0.tar.gz.sig": ed25519.Sign(priv, older),
+		"/evil/1.0.0.tar.gz":          evil,
+		"/evil/1.0.0.tar.gz.sig":      ed25519.Sign(priv, evil),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := registry[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newBundles(thing, BundleConfig{
+		URL:  srv.URL,
+		Keys: []string{base64.StdEncoding.EncodeToString(pub)},
+		Dir:  dir,
+		Pins: []string{"sprinkler@1.0.0", "forged@1.0.0", "evil@1.0.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdir, manifest, err := b.get("sprinkler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != "1.0.0" {
+		t.Errorf("Got manifest %+v", manifest)
+	}
+	if _, err := os.Stat(bdir + "/templates/sprinkler.html"); err != nil {
+		t.Errorf("Missing template: %s", err)
+	}
+
+	// Pinned bundle is used from cache
+	srv.Close()
+	if _, _, err := b.get("sprinkler"); err != nil {
+		t.Errorf("Cached bundle: %s", err)
+	}
+	srv = httptest.NewServer(srv.Config.Handler)
+	defer srv.Close()
+	b.cfg.URL = srv.URL
+
+	if _, _, err := b.get("forged"); err == nil {
+		t.Errorf("Accepted bundle signed by untrusted key")
+	}
+	if _, _, err := b.get("evil"); err == nil {
+		t.Errorf("Accepted bundle with path outside bundle")
+	}
+	if _, _, err := b.get("../etc"); err == nil {
+		t.Errorf("Accepted bad model name")
+	}
+
+	// An old signed bundle can't stand in for another version
+	b.cfg.Pins = []string{"sprinkler@2.0.0"}
+	if _, _, err := b.get("sprinkler"); err == nil {
+		t.Errorf("Accepted bundle 0.9.0 as 2.0.0")
+	}
+
+	// Nor can latest go back
+	b.cfg.Pins = nil
+	registry["/sprinkler/latest.tar.gz"] = newer
+	registry["/sprinkler/latest.tar.gz.sig"] = ed25519.Sign(priv, newer)
+	if _, manifest, _ = b.get("sprinkler"); manifest == nil ||
+		manifest.Version != "1.10.0" {
+		t.Fatalf("Latest got %+v", manifest)
+	}
+	registry["/sprinkler/latest.tar.gz"] = older
+	registry["/sprinkler/latest.tar.gz.sig"] = ed25519.Sign(priv, older)
+	if _, manifest, _ = b.get("sprinkler"); manifest == nil ||
+		manifest.Version != "1.10.0" {
+		t.Errorf("Latest rolled back to %+v", manifest)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.9.2", "1.10.0", -1},
+		{"v2.0.0", "1.99", 1},
+		{"1.0.0-rc1", "1.0.0-rc2", -1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d",
+				test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestBundleServeAuth(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.SetAuthStore(&memAuthStore{data: AuthData{
+		Users: []AuthUser{{Name: "root", Role: RoleAdmin}}}})
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/bundles/sprinkler/latest.tar.gz", nil)
+	w := httptest.NewRecorder()
+	thing.web.public.mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Unauthenticated GET got %d", w.Code)
+	}
+}
+
+func TestHttpGetLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+
+	if data, err := httpGet(srv.URL, 100); err != nil || len(data) != 100 {
+		t.Errorf("Got %d bytes, %v", len(data), err)
+	}
+	if _, err := httpGet(srv.URL, 99); err == nil {
+		t.Errorf("Read past limit")
+	}
+}
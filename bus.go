@@ -52,7 +52,26 @@ type bus struct {
 	sockets  sockets
 	socketQ  socketQ
 	// message subscribers
-	subs Subscribers
+	subsLock sync.RWMutex
+	subs     Subscribers
+	// framework's subscribers, kept across SwapThinger
+	sys Subscribers
+	// closed to stop CmdRun, for SwapThinger
+	stop chan bool
+	// messages queued for mother while mother is away
+	outbox *outbox
+	// bumped on each resync with mother, under sockLock
+	resyncSeq uint64
+	// write-ahead journal of broadcast messages
+	journal *journal
+	// last state sent or received as StatePatch
+	patch patchState
+	// taps see every broadcast
+	taps []func(*Packet)
+	// egress taps see every broadcast, redacted, to send off Thing
+	egress []func(*Packet)
+	// drops repeated commands, by IdempotencyKey
+	dedup *dedup
 }
 
 func newBus(thing *Thing, socketsMax uint, subs Subscribers) *bus {
@@ -61,6 +80,8 @@ func newBus(thing *Thing, socketsMax uint, subs Subscribers) *bus {
 		sockets: make(sockets),
 		socketQ: make(socketQ, socketsMax),
 		subs:    subs,
+		sys:     make(Subscribers),
+		stop:    make(chan bool),
 	}
 }
 
@@ -68,10 +89,37 @@ func newBus(thing *Thing, socketsMax uint, subs Subscribers) *bus {
 func (b *bus) plugin(s socketer) {
 	// Queue any plugin attempts beyond socketsMax
 	b.socketQ <- true
+	b.attach(s)
+}
+
+// Reserve a place on the bus for a socket, for attach.  Wait for a place,
+// or, if Cfg.RejectWhenFull, return false if the bus is full.
+func (b *bus) reserve() bool {
+	if !b.thing.Cfg.RejectWhenFull {
+		b.socketQ <- true
+		return true
+	}
+	select {
+	case b.socketQ <- true:
+		return true
+	default:
+		return false
+	}
+}
 
+// Give back a reserved place not used
+func (b *bus) release() {
+	<-b.socketQ
+}
+
+// Plug a socket into the bus, in a reserved place
+func (b *bus) attach(s socketer) {
 	b.sockLock.Lock()
 	b.sockets[s] = true
 	b.sockLock.Unlock()
+
+	b.thing.connected(sockConnection(s))
+	b.sockEvent(SockOpened, s)
 }
 
 // Unplug a socket from the bus
@@ -81,11 +129,77 @@ func (b *bus) unplug(s socketer) {
 	b.sockLock.Unlock()
 
 	<-b.socketQ
+
+	b.thing.disconnected(sockConnection(s))
+	b.sockEvent(SockClosed, s)
 }
 
 // Subscribe to message
 func (b *bus) subscribe(msg string, f func(*Packet)) {
+	b.subsLock.Lock()
+	defer b.subsLock.Unlock()
+
 	b.subs[msg] = f
+	b.sys[msg] = f
+}
+
+// Replace the Thinger's subscribers, keeping the framework's
+func (b *bus) setSubscribers(subs Subscribers) {
+	b.subsLock.Lock()
+	defer b.subsLock.Unlock()
+
+	b.subs = make(Subscribers)
+	for msg, f := range subs {
+		b.subs[msg] = f
+	}
+	for msg, f := range b.sys {
+		b.subs[msg] = f
+	}
+}
+
+func (b *bus) lookup(msg string) (func(*Packet), bool) {
+	b.subsLock.RLock()
+	defer b.subsLock.RUnlock()
+
+	f, match := b.subs[msg]
+	return f, match
+}
+
+// Channel closed when CmdRun should stop
+func (b *bus) stopped() chan bool {
+	b.subsLock.RLock()
+	defer b.subsLock.RUnlock()
+
+	return b.stop
+}
+
+// Ask CmdRun to stop: send CmdStop to the Thinger and close the stop
+// channel, for RunForever
+func (b *bus) stopRun() {
+	msg := Msg{Msg: CmdStop}
+	if f, _ := b.lookup(CmdStop); f != nil {
+		f(newPacket(b, nil, &msg))
+	}
+	close(b.stopped())
+}
+
+func (b *bus) resetStop() {
+	b.subsLock.Lock()
+	defer b.subsLock.Unlock()
+
+	b.stop = make(chan bool)
+}
+
+// Tap the bus.  The tap function is called for each Packet broadcast on the
+// bus.  The tap function must not hold on to the Packet.
+func (b *bus) tap(f func(*Packet)) {
+	b.taps = append(b.taps, f)
+}
+
+// Tap the bus, for a tap sending broadcasts off Thing.  The tap function
+// gets each Packet broadcast, redacted (see Cfg.Redact).
+func (b *bus) tapEgress(f func(*Packet)) {
+	b.egress = append(b.egress, f)
 }
 
 // Receive matches the packet against subscribers and calls the matching
@@ -97,7 +211,25 @@ func (b *bus) receive(p *Packet) {
 
 	p.Unmarshal(&msg)
 
-	f, match := b.subs[msg.Msg]
+	if msg.Msg == CmdStop && p.src != nil {
+		b.thing.log.printf("Dropping [%s]: %.80s", p.Src(), p.String())
+		return
+	}
+
+	// Open sealed messages; see E2EConfig
+	if !b.thing.e2eReceive(p) {
+		return
+	}
+
+	var key string
+	if b.dedup != nil {
+		var ok bool
+		if key, ok = b.dedup.check(p); !ok {
+			return
+		}
+	}
+
+	f, match := b.lookup(msg.Msg)
 	if match {
 		if f != nil {
 			b.thing.log.printf("Received [%s]: %.80s", p.Src(),
@@ -105,7 +237,7 @@ func (b *bus) receive(p *Packet) {
 			f(p)
 		}
 	} else {
-		f, match = b.subs["default"]
+		f, match = b.lookup("default")
 		if match {
 			if f != nil {
 				b.thing.log.printf("Received [%s] by default: %.80s",
@@ -118,11 +250,21 @@ func (b *bus) receive(p *Packet) {
 		}
 	}
 
+	// Command with an IdempotencyKey is applied; Ack it
+	if key != "" && match && f != nil {
+		b.dedup.ack(p, key, false)
+	}
+
 	// Receiving ReplyState is a special case.  The socket is disabled for
 	// broadcasts until ReplyState is received.
 
 	if msg.Msg == ReplyState {
 		p.src.SetFlags(p.src.Flags() | sock_flag_bcast)
+
+		// Full state is the new base for StatePatches that follow
+		if b.thing.isPrime {
+			b.patch.reset(p.msg)
+		}
 	}
 }
 
@@ -136,8 +278,17 @@ func (b *bus) reply(p *Packet) {
 	msg := Msg{}
 	p.Unmarshal(&msg)
 
+	// Sending ReplyState to mother resyncs mother; see resync.
+
+	if msg.Msg == ReplyState && p.src.Flags()&sock_flag_mother != 0 {
+		b.resync(p)
+		return
+	}
+
 	b.thing.log.printf("Reply: %.80s", p.String())
-	p.src.Send(p)
+	if out := b.thing.e2eSeal(p); out != nil {
+		p.src.Send(out)
+	}
 
 	// Sending ReplyState is a special case.  The socket is disabled for
 	// broadcasts until ReplyState is sent.  This ensures other end doesn't
@@ -148,11 +299,29 @@ func (b *bus) reply(p *Packet) {
 	}
 }
 
+// Heartbeats are neither journaled nor held for mother
+func isHeartbeat(p *Packet) bool {
+	var msg Msg
+	p.Unmarshal(&msg)
+	return msg.Msg == Heartbeat
+}
+
 // Broadcast sends the packet to each socket on the bus, expect to the
 // originating socket
 func (b *bus) broadcast(p *Packet) {
 	sent := 0
 	src := p.src
+	mother := src != nil && src.Flags()&sock_flag_mother != 0
+
+	// Taps see the message unsealed
+	out := b.thing.e2eSeal(p)
+	if out == nil {
+		return
+	}
+
+	if b.journal != nil && !isHeartbeat(p) {
+		b.journal.append(out)
+	}
 
 	b.sockLock.RLock()
 	defer b.sockLock.RUnlock()
@@ -177,17 +346,42 @@ func (b *bus) broadcast(p *Packet) {
 			b.thing.log.printf("Broadcast: %.80s", p.String())
 			sent++
 		}
-		sock.Send(p)
+		sock.Send(out)
+		if sock.Flags()&sock_flag_mother != 0 {
+			mother = true
+		}
 	}
 
 	if sent == 0 {
 		b.thing.log.printf("Would Broadcast: %.80s", p.String())
 	}
+
+	// If mother didn't get the broadcast, hold it in the outbox until
+	// mother returns.  A Heartbeat is stale by then.
+
+	if b.outbox != nil && !mother && !isHeartbeat(p) {
+		b.outbox.enqueue(out)
+	}
+
+	for _, tap := range b.taps {
+		tap(p)
+	}
+
+	if len(b.egress) > 0 {
+		p = b.thing.redact(p)
+		for _, tap := range b.egress {
+			tap(p)
+		}
+	}
 }
 
 func (b *bus) send(p *Packet, dst string) {
 	sent := false
 
+	if p = b.thing.e2eSeal(p); p == nil {
+		return
+	}
+
 	b.sockLock.RLock()
 	defer b.sockLock.RUnlock()
 
@@ -0,0 +1,286 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// CalPoint is a point in a calibration lookup table: a Raw reading, and the
+// Value it maps to
+type CalPoint struct {
+	Raw   float64
+	Value float64
+}
+
+// Calibration turns an analog input's raw readings, e.g. ADC counts, into
+// calibrated values.  The Thinger passes each raw reading through
+// Thing.Calibrate() before using or broadcasting the reading.  A raw reading
+// goes through the pipeline:
+//
+//  1. Filter: the average of the last Window raw readings.
+//  2. Table: linear interpolation between the Table's points.  Readings
+//     outside the Table take the nearest end point's Value.
+//  3. Gain and offset: value * Gain + Offset.
+//
+// Each step is skipped if not configured.  Calibrations are configured in
+// Cfg.Calibrations, and edited at runtime with the SetCalibration message.
+// Edits are saved in Cfg.CalibrationFile, and override Cfg.Calibrations
+// when Thing restarts.  For example, for a 10-bit ADC reading 0-5 volts:
+//
+//	thing.Cfg.Calibrations = []merle.Calibration{
+//		{Name: "Volts", Gain: 5.0 / 1023, Window: 8},
+//	}
+//
+//	volts := thing.Calibrate("Volts", float64(adc.Read()))
+type Calibration struct {
+	Name string
+	// [Optional] Number of raw readings averaged.  The default is 0 (no
+	// filter).
+	Window uint
+	// [Optional] Lookup table, at least two points.  The default is nil
+	// (no table).
+	Table []CalPoint
+	// [Optional] The default is 1.
+	Gain float64
+	// [Optional] The default is 0.
+	Offset float64
+}
+
+type calibration struct {
+	Calibration
+	// Raw readings in the filter window
+	window []float64
+	raw    float64
+	value  float64
+}
+
+type calibrations struct {
+	sync.Mutex
+	thing *Thing
+	cals  []*calibration
+	store Store
+}
+
+func validCalibration(cal *Calibration) error {
+	if cal.Name == "" {
+		return fmt.Errorf("Calibration missing Name")
+	}
+	if len(cal.Table) == 1 {
+		return fmt.Errorf("Calibration %s: Table needs at least two points",
+			cal.Name)
+	}
+	return nil
+}
+
+func newCalibrations(thing *Thing, cfgs []Calibration,
+	file string) (*calibrations, error) {
+
+	c := &calibrations{thing: thing}
+
+	for _, cfg := range cfgs {
+		if err := c.set(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if file != "" {
+		c.store = NewFileStore(file)
+	}
+
+	return c, c.load()
+}
+
+func (c *calibrations) find(name string) *calibration {
+	for _, cal := range c.cals {
+		if cal.Name == name {
+			return cal
+		}
+	}
+	return nil
+}
+
+// Add or replace a calibration.  Call with lock held.
+func (c *calibrations) set(cfg Calibration) error {
+	if err := validCalibration(&cfg); err != nil {
+		return err
+	}
+	if cfg.Gain == 0 {
+		cfg.Gain = 1
+	}
+
+	table := make([]CalPoint, len(cfg.Table))
+	copy(table, cfg.Table)
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Raw < table[j].Raw
+	})
+	cfg.Table = table
+
+	if cal := c.find(cfg.Name); cal != nil {
+		cal.Calibration = cfg
+		cal.window = nil
+		return nil
+	}
+
+	c.cals = append(c.cals, &calibration{Calibration: cfg})
+	return nil
+}
+
+// Load calibrations saved from a previous run, overriding those configured
+func (c *calibrations) load() error {
+	if c.store == nil {
+		return nil
+	}
+
+	var saved []Calibration
+	if err := c.store.Load(&saved); err != nil {
+		return err
+	}
+
+	for _, cal := range saved {
+		if err := c.set(cal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Call with lock held
+func (c *calibrations) save() {
+	if c.store == nil {
+		return
+	}
+
+	saved := make([]Calibration, len(c.cals))
+	for i, cal := range c.cals {
+		saved[i] = cal.Calibration
+	}
+
+	if err := c.store.Save(saved); err != nil {
+		c.thing.log.println("Saving calibrations failed:", err)
+	}
+}
+
+// Interpolate raw in table, sorted by Raw
+func lookup(table []CalPoint, raw float64) float64 {
+	last := len(table) - 1
+	if raw <= table[0].Raw {
+		return table[0].Value
+	}
+	if raw >= table[last].Raw {
+		return table[last].Value
+	}
+
+	i := sort.Search(len(table), func(i int) bool {
+		return table[i].Raw >= raw
+	})
+	lo, hi := table[i-1], table[i]
+
+	return lo.Value + (raw-lo.Raw)*(hi.Value-lo.Value)/(hi.Raw-lo.Raw)
+}
+
+// Run raw through the pipeline.  Call with lock held.
+func (cal *calibration) apply(raw float64) float64 {
+	value := raw
+
+	if cal.Window > 1 {
+		cal.window = append(cal.window, raw)
+		if len(cal.window) > int(cal.Window) {
+			cal.window = cal.window[1:]
+		}
+		sum := 0.0
+		for _, r := range cal.window {
+			sum += r
+		}
+		value = sum / float64(len(cal.window))
+	}
+
+	if len(cal.Table) > 0 {
+		value = lookup(cal.Table, value)
+	}
+
+	value = value*cal.Gain + cal.Offset
+
+	cal.raw, cal.value = raw, value
+	return value
+}
+
+// Calibrate runs a raw reading through the named Calibration, returning the
+// calibrated value.  If there's no Calibration named name, raw is returned
+// as is.  During a FaultNaN on name, Calibrate returns NaN.
+func (t *Thing) Calibrate(name string, raw float64) float64 {
+	if nan, ok := t.faultNaN(name); ok {
+		return nan
+	}
+
+	c := t.cals
+	if c == nil {
+		return raw
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	cal := c.find(name)
+	if cal == nil {
+		return raw
+	}
+
+	return cal.apply(raw)
+}
+
+// Subscriber handler for GetCalibration
+func (t *Thing) getCalibration(p *Packet) {
+	c := t.cals
+	resp := MsgCalibrations{Msg: ReplyCalibration,
+		Calibrations: []CalibrationStatus{}}
+
+	c.Lock()
+	for _, cal := range c.cals {
+		resp.Calibrations = append(resp.Calibrations, CalibrationStatus{
+			Calibration: cal.Calibration,
+			Raw:         cal.raw,
+			Value:       cal.value,
+		})
+	}
+	c.Unlock()
+
+	p.Marshal(&resp).Reply()
+}
+
+// Subscriber handler for SetCalibration.  Calibrations are only accepted on
+// the private server.
+func (t *Thing) setCalibration(p *Packet) {
+	var msg MsgCalibration
+
+	if p.src == nil || p.src.Flags()&sock_flag_private == 0 {
+		t.log.println("Ignoring calibration; not on private server")
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	c := t.cals
+	c.Lock()
+	err := c.set(msg.Calibration)
+	if err == nil {
+		c.save()
+	}
+	c.Unlock()
+
+	if err != nil {
+		t.log.println("Setting calibration failed:", err)
+	} else {
+		t.log.printf("Calibration %s set", msg.Calibration.Name)
+	}
+
+	t.getCalibration(p)
+}
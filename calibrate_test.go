@@ -0,0 +1,91 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCalibrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "calibrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&pump{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Calibrations = []Calibration{
+		{Name: "Volts", Gain: 0.5, Offset: 1},
+		{Name: "Level", Window: 2, Table: []CalPoint{
+			{Raw: 100, Value: 10}, {Raw: 0, Value: 0}, {Raw: 200, Value: 50},
+		}},
+	}
+	thing.Cfg.CalibrationFile = filepath.Join(dir, "cals")
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		raw      float64
+		expected float64
+	}{
+		{"Volts", 10, 6},
+		{"Nope", 10, 10},
+		{"Level", 50, 5},
+		// Averaged with 50
+		{"Level", 250, 30},
+		// Clamped to the table
+		{"Level", 1000, 50},
+	}
+
+	for _, test := range tests {
+		if v := thing.Calibrate(test.name, test.raw); v != test.expected {
+			t.Errorf("%s(%f): got %f, want %f", test.name, test.raw,
+				v, test.expected)
+		}
+	}
+
+	set := MsgCalibration{Msg: SetCalibration,
+		Calibration: Calibration{Name: "Volts", Gain: 2}}
+
+	// Only accepted on the private server
+	public := &recordSocket{}
+	thing.bus.receive(newPacket(thing.bus, public, &set))
+	if v := thing.Calibrate("Volts", 10); v != 6 {
+		t.Errorf("Calibration set from public socket: got %f", v)
+	}
+
+	private := &recordSocket{flags: sock_flag_private}
+	thing.bus.receive(newPacket(thing.bus, private, &set))
+	if v := thing.Calibrate("Volts", 10); v != 20 {
+		t.Errorf("Calibration not set: got %f", v)
+	}
+
+	// Calibrations set at runtime are restored on restart
+	cfg := thing.Cfg
+	thing = NewThing(&pump{})
+	thing.Cfg = cfg
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := &recordSocket{}
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: GetCalibration}))
+
+	var resp MsgCalibrations
+	json.Unmarshal([]byte(sock.sent[0]), &resp)
+	if len(resp.Calibrations) != 2 || resp.Calibrations[0].Gain != 2 {
+		t.Errorf("Got %+v", resp)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// CAN bus configuration.  Thing talks to a CAN bus on a SocketCAN interface
+// (Linux only), with CAN frames mapped to messages, and back, as in a DBC
+// file: each of Msgs is a CAN Id, a message, and the message's members, as
+// signals packed into the frame's data.
+//
+// A frame received with a CAN Id in Msgs is received by Thing as the
+// message, as if from a client; subscribe to the message to take it.  A
+// message in Msgs broadcast by Thing is sent on the CAN bus as a frame.
+//
+// Frames with other CAN Ids are dropped, unless they match one of Filters;
+// those are received by Thing as CANFrame messages.  A CANFrame message
+// broadcast by Thing is sent on the CAN bus as is.
+type CANConfig struct {
+
+	// SocketCAN interface, e.g. "can0".  CAN is disabled if Iface is
+	// empty.  The default is "".
+	Iface string
+
+	// CAN frames, and their messages.  The default is nil.
+	Msgs []CANMessage
+
+	// [Optional] Filters for unmapped frames.  The default is nil (unmapped
+	// frames are dropped).
+	Filters []CANFilter
+}
+
+// CANMessage maps frames with CAN Id to message Msg, like a DBC file's BO_
+type CANMessage struct {
+	// Standard (11-bit) CAN Id
+	Id uint32
+	// Message name
+	Msg string
+	// [Optional] Frame data length.  The default is 8.
+	Len uint
+	// Message members, packed in the frame's data
+	Signals []CANSignal
+}
+
+// CANSignal maps message member Field to bits of a frame, like a DBC file's
+// SG_.  Bits are numbered as in a DBC file: Intel (little-endian) signals
+// start at the least significant bit; Motorola (big-endian) signals start at
+// the most significant bit.  The member's value is raw * Scale + Offset.
+type CANSignal struct {
+	Field string
+	// Start bit
+	Start uint
+	// Bits, 1 to 64
+	Len uint
+	// Motorola byte order
+	BigEndian bool
+	// Raw value is two's complement
+	Signed bool
+	// [Optional] The default is 1.
+	Scale float64
+	// [Optional] The default is 0.
+	Offset float64
+}
+
+// CANFilter matches frames with (CAN Id & Mask) == (Id & Mask), as a
+// SocketCAN filter
+type CANFilter struct {
+	Id   uint32
+	Mask uint32
+}
+
+// CAN interface, as opened by canOpen
+type canPort interface {
+	Send(id uint32, data []byte) (int, error)
+	Recv() (id uint32, data []byte, err error)
+	Close() error
+}
+
+// Socket to a CAN bus
+type canSocket struct {
+	sync.Mutex
+	thing  *Thing
+	cfg    CANConfig
+	byId   map[uint32]*CANMessage
+	byMsg  map[string]*CANMessage
+	port   canPort
+	closed bool
+}
+
+func (s *CANSignal) check(len uint) error {
+	if s.Field == "" {
+		return fmt.Errorf("CAN signal missing Field")
+	}
+	if s.Len < 1 || s.Len > 64 {
+		return fmt.Errorf("CAN signal %s Len must be 1 to 64", s.Field)
+	}
+	last := s.Start + s.Len - 1
+	if s.BigEndian {
+		last = s.Start/8*8 + 7 - s.Start%8 + s.Len - 1
+	}
+	if s.Start >= 64 || last >= len*8 {
+		return fmt.Errorf("CAN signal %s doesn't fit in %d bytes",
+			s.Field, len)
+	}
+	return nil
+}
+
+// Signal's mask and shift, in the frame's data as a 64-bit integer, little-
+// or big-endian
+func (s *CANSignal) bits() (mask uint64, shift uint) {
+	mask = math.MaxUint64 >> (64 - s.Len)
+	if s.BigEndian {
+		// DBC's Motorola start bit is the signal's msb, numbered
+		// within its byte
+		msb := s.Start/8*8 + 7 - s.Start%8
+		return mask, 63 - (msb + s.Len - 1)
+	}
+	return mask, s.Start
+}
+
+func (s *CANSignal) order() binary.ByteOrder {
+	if s.BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (s *CANSignal) scale() float64 {
+	if s.Scale == 0 {
+		return 1
+	}
+	return s.Scale
+}
+
+func (s *CANSignal) decode(data *[8]byte) float64 {
+	mask, shift := s.bits()
+	raw := s.order().Uint64(data[:]) >> shift & mask
+
+	value := float64(raw)
+	if s.Signed && raw&(mask^mask>>1) != 0 {
+		value = float64(int64(raw | ^mask))
+	}
+	return value*s.scale() + s.Offset
+}
+
+func (s *CANSignal) encode(data *[8]byte, value float64) {
+	mask, shift := s.bits()
+	raw := uint64(int64(math.Round((value - s.Offset) / s.scale())))
+
+	x := s.order().Uint64(data[:])
+	x = x&^(mask<<shift) | (raw&mask)<<shift
+	s.order().PutUint64(data[:], x)
+}
+
+func newCANSocket(thing *Thing, cfg CANConfig) (*canSocket, error) {
+	s := &canSocket{
+		thing: thing,
+		byId:  make(map[uint32]*CANMessage),
+		byMsg: make(map[string]*CANMessage),
+	}
+
+	// Own copy, for defaults
+	cfg.Msgs = append([]CANMessage(nil), cfg.Msgs...)
+
+	for i := range cfg.Msgs {
+		m := &cfg.Msgs[i]
+		if m.Len == 0 {
+			m.Len = 8
+		}
+		switch {
+		case m.Msg == "":
+			return nil, fmt.Errorf("CAN Id %#x missing Msg", m.Id)
+		case m.Id > 0x7ff:
+			return nil, fmt.Errorf("CAN Id %#x isn't 11 bits", m.Id)
+		case m.Len > 8:
+			return nil, fmt.Errorf("CAN message %s Len over 8", m.Msg)
+		case s.byId[m.Id] != nil:
+			return nil, fmt.Errorf("CAN Id %#x mapped twice", m.Id)
+		case s.byMsg[m.Msg] != nil:
+			return nil, fmt.Errorf("CAN message %s mapped twice", m.Msg)
+		}
+		for j := range m.Signals {
+			if err := m.Signals[j].check(m.Len); err != nil {
+				return nil, err
+			}
+		}
+		s.byId[m.Id] = m
+		s.byMsg[m.Msg] = m
+	}
+	s.cfg = cfg
+
+	return s, nil
+}
+
+// Message for frame; nil if the frame is dropped
+func (s *canSocket) frameMsg(id uint32, data []byte) []byte {
+	m := s.byId[id]
+	if m == nil {
+		for _, f := range s.cfg.Filters {
+			if id&f.Mask == f.Id&f.Mask {
+				msg, _ := json.Marshal(&MsgCANFrame{Msg: CANFrame,
+					Id: id, Data: data})
+				return msg
+			}
+		}
+		return nil
+	}
+
+	var frame [8]byte
+	copy(frame[:], data)
+
+	msg := map[string]interface{}{"Msg": m.Msg}
+	for i := range m.Signals {
+		sig := &m.Signals[i]
+		msg[sig.Field] = sig.decode(&frame)
+	}
+	data, _ = json.Marshal(msg)
+	return data
+}
+
+// Frame for message; ok is false if the message isn't for the CAN bus
+func (s *canSocket) msgFrame(p *Packet) (id uint32, data []byte, ok bool) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(p.msg, &msg); err != nil {
+		return 0, nil, false
+	}
+	name, _ := msg["Msg"].(string)
+
+	if name == CANFrame {
+		var frame MsgCANFrame
+		if err := json.Unmarshal(p.msg, &frame); err != nil {
+			return 0, nil, false
+		}
+		return frame.Id, frame.Data, true
+	}
+
+	m := s.byMsg[name]
+	if m == nil {
+		return 0, nil, false
+	}
+
+	var frame [8]byte
+	for i := range m.Signals {
+		sig := &m.Signals[i]
+		value, _ := msg[sig.Field].(float64)
+		sig.encode(&frame, value)
+	}
+	return m.Id, frame[:m.Len], true
+}
+
+func (s *canSocket) start() error {
+	var err error
+
+	s.port, err = canOpen(s.cfg.Iface)
+	if err != nil {
+		return newError(ErrCAN, err)
+	}
+
+	s.thing.bus.plugin(s)
+	go s.read()
+
+	return nil
+}
+
+func (s *canSocket) stop() {
+	s.Close()
+	s.thing.bus.unplug(s)
+}
+
+// Receive frames until the socket closes
+func (s *canSocket) read() {
+	t := s.thing
+
+	for {
+		id, data, err := s.port.Recv()
+		if err != nil {
+			s.Lock()
+			closed := s.closed
+			s.Unlock()
+			if !closed {
+				t.raise(newError(ErrCAN, err))
+			}
+			return
+		}
+		if msg := s.frameMsg(id, data); msg != nil {
+			t.bus.receive(&Packet{bus: t.bus, src: s, msg: msg})
+		}
+	}
+}
+
+// Send the broadcast message as a frame, if it's for the CAN bus
+func (s *canSocket) Send(p *Packet) error {
+	id, data, ok := s.msgFrame(p)
+	if !ok {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	_, err := s.port.Send(id, data)
+	return err
+}
+
+func (s *canSocket) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.port.Close()
+}
+
+func (s *canSocket) Name() string {
+	return "can:" + s.cfg.Iface
+}
+
+func (s *canSocket) Flags() uint32 {
+	return sock_flag_bcast
+}
+
+func (s *canSocket) SetFlags(flags uint32) {
+}
+
+func (s *canSocket) Src() string {
+	return s.cfg.Iface
+}
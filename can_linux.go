@@ -0,0 +1,25 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"github.com/go-daq/canbus"
+)
+
+// Open SocketCAN interface iface; tests substitute a fake CAN bus
+var canOpen = func(iface string) (canPort, error) {
+	sock, err := canbus.New()
+	if err != nil {
+		return nil, err
+	}
+	if err := sock.Bind(iface); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
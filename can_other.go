@@ -0,0 +1,16 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !linux && !tinygo
+// +build !linux,!tinygo
+
+package merle
+
+import (
+	"fmt"
+)
+
+var canOpen = func(iface string) (canPort, error) {
+	return nil, fmt.Errorf("SocketCAN is only on Linux")
+}
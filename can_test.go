@@ -0,0 +1,187 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// CAN bus, with frames from the bus on rx, and frames sent on tx
+type fakeCAN struct {
+	rx chan MsgCANFrame
+	tx chan MsgCANFrame
+}
+
+func (f *fakeCAN) Send(id uint32, data []byte) (int, error) {
+	f.tx <- MsgCANFrame{Id: id, Data: append([]byte(nil), data...)}
+	return len(data), nil
+}
+
+func (f *fakeCAN) Recv() (uint32, []byte, error) {
+	frame, ok := <-f.rx
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	return frame.Id, frame.Data, nil
+}
+
+func (f *fakeCAN) Close() error {
+	close(f.rx)
+	return nil
+}
+
+// Thing taking frames
+type ecu struct {
+	got chan string
+}
+
+func (e *ecu) Subscribers() Subscribers {
+	return Subscribers{
+		"Engine": func(p *Packet) { e.got <- p.String() },
+		CANFrame: func(p *Packet) { e.got <- p.String() },
+	}
+}
+
+func (e *ecu) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestCANSignal(t *testing.T) {
+	data := [8]byte{0x10, 0x27, 0xf6, 0x12, 0x34}
+
+	tests := []struct {
+		sig  CANSignal
+		want float64
+	}{
+		{CANSignal{Start: 0, Len: 16, Scale: 0.25}, 2500},
+		{CANSignal{Start: 16, Len: 8, Signed: true}, -10},
+		{CANSignal{Start: 16, Len: 8, Offset: -40}, 206},
+		{CANSignal{Start: 31, Len: 16, BigEndian: true}, 0x1234},
+		{CANSignal{Start: 27, Len: 4, BigEndian: true}, 0x2},
+	}
+
+	for _, test := range tests {
+		sig := test.sig
+		if got := sig.decode(&data); got != test.want {
+			t.Errorf("%+v: got %v, want %v", sig, got, test.want)
+		}
+		var frame [8]byte
+		copy(frame[:], data[:])
+		sig.encode(&frame, test.want)
+		if frame != data {
+			t.Errorf("%+v: encoded % x, want % x", sig, frame, data)
+		}
+	}
+
+	bad := []CANSignal{
+		{Field: "A", Start: 0, Len: 0},
+		{Field: "A", Start: 60, Len: 8},
+		{Field: "A", Start: 59, Len: 8, BigEndian: true},
+	}
+	for _, sig := range bad {
+		if sig.check(8) == nil {
+			t.Errorf("%+v fits", sig)
+		}
+	}
+}
+
+func TestCAN(t *testing.T) {
+	e := &ecu{got: make(chan string, 1)}
+	thing := NewThing(e)
+	thing.Cfg.Id = testId
+	thing.Cfg.CAN = CANConfig{
+		Iface: "vcan0",
+		Msgs: []CANMessage{
+			{Id: 0x100, Msg: "Engine", Signals: []CANSignal{
+				{Field: "Rpm", Start: 0, Len: 16, Scale: 0.25},
+				{Field: "Coolant", Start: 16, Len: 8, Offset: -40},
+			}},
+			{Id: 0x200, Msg: "Throttle", Len: 2, Signals: []CANSignal{
+				{Field: "Pos", Start: 7, Len: 16, BigEndian: true,
+					Scale: 0.5},
+			}},
+		},
+		Filters: []CANFilter{{Id: 0x7e8, Mask: 0x7f8}},
+	}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeCAN{rx: make(chan MsgCANFrame), tx: make(chan MsgCANFrame, 1)}
+	saved := canOpen
+	defer func() { canOpen = saved }()
+	canOpen = func(iface string) (canPort, error) { return f, nil }
+
+	s := thing.can
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(want string) {
+		select {
+		case got := <-e.got:
+			if got != want {
+				t.Errorf("Got %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Nothing, want %s", want)
+		}
+	}
+
+	// Mapped, filtered, and dropped frames
+	f.rx <- MsgCANFrame{Id: 0x100, Data: []byte{0x10, 0x27, 0x82, 0, 0, 0, 0, 0}}
+	expect(`{"Coolant":90,"Msg":"Engine","Rpm":2500}`)
+	f.rx <- MsgCANFrame{Id: 0x123, Data: []byte{1}}
+	f.rx <- MsgCANFrame{Id: 0x7e9, Data: []byte{3, 0x41, 0x0d, 0x32}}
+	expect(`{"Msg":"_CANFrame","Id":2025,"Data":"A0ENMg=="}`)
+
+	// Broadcasts, as frames
+	sent := func(msg interface{}, id uint32, data []byte) {
+		thing.bus.broadcast(newPacket(thing.bus, nil, msg))
+		select {
+		case frame := <-f.tx:
+			if frame.Id != id || !bytes.Equal(frame.Data, data) {
+				t.Errorf("Sent %#x % x, want %#x % x", frame.Id,
+					frame.Data, id, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Nothing sent, want %#x", id)
+		}
+	}
+	sent(map[string]interface{}{"Msg": "Throttle", "Pos": 42.5}, 0x200, []byte{0, 85})
+	sent(&MsgCANFrame{Msg: CANFrame, Id: 0x7df, Data: []byte{2, 1, 0x0c}},
+		0x7df, []byte{2, 1, 0x0c})
+	thing.bus.broadcast(newPacket(thing.bus, nil, &Msg{Msg: "Other"}))
+	select {
+	case frame := <-f.tx:
+		t.Errorf("Sent %v", frame)
+	default:
+	}
+
+	s.stop()
+}
+
+func TestCANBadConfig(t *testing.T) {
+	tests := []CANConfig{
+		{Iface: "vcan0", Msgs: []CANMessage{{Id: 0x100}}},
+		{Iface: "vcan0", Msgs: []CANMessage{{Id: 0x800, Msg: "A"}}},
+		{Iface: "vcan0", Msgs: []CANMessage{{Id: 1, Msg: "A"}, {Id: 1, Msg: "B"}}},
+		{Iface: "vcan0", Msgs: []CANMessage{{Id: 1, Msg: "A", Len: 1,
+			Signals: []CANSignal{{Field: "X", Start: 4, Len: 8}}}}},
+	}
+
+	for i, cfg := range tests {
+		thing := NewThing(&sparse{})
+		thing.Cfg.Id = testId
+		thing.Cfg.CAN = cfg
+		if err := thing.build(true); ErrorCode(err) != ErrBadConfig.Code {
+			t.Errorf("Config %d: got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Just enough CBOR (RFC 8949) for Merle messages, as decoded JSON: maps
+// with string keys, arrays, strings, numbers, bools, and null.  Numbers are
+// sent as integers, if whole, otherwise as 32-bit floats, to save bytes.
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborSimple = 7 << 5
+
+	cborFalse   = cborSimple | 20
+	cborTrue    = cborSimple | 21
+	cborNull    = cborSimple | 22
+	cborFloat16 = cborSimple | 25
+	cborFloat32 = cborSimple | 26
+	cborFloat64 = cborSimple | 27
+)
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborWrite(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(cborNull)
+	case bool:
+		if v {
+			buf.WriteByte(cborTrue)
+		} else {
+			buf.WriteByte(cborFalse)
+		}
+	case float64:
+		switch {
+		case v == math.Trunc(v) && v >= 0 && v < 1<<53:
+			cborHead(buf, cborUint, uint64(v))
+		case v == math.Trunc(v) && v < 0 && v > -(1<<53):
+			cborHead(buf, cborNegInt, uint64(-1-v))
+		default:
+			buf.WriteByte(cborFloat32)
+			binary.Write(buf, binary.BigEndian, math.Float32bits(float32(v)))
+		}
+	case string:
+		cborHead(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(v)))
+		for _, e := range v {
+			cborWrite(buf, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cborHead(buf, cborMap, uint64(len(keys)))
+		for _, k := range keys {
+			cborWrite(buf, k)
+			cborWrite(buf, v[k])
+		}
+	}
+}
+
+// CBOR encoding of v, a decoded JSON value
+func cborEncode(v interface{}) []byte {
+	var buf bytes.Buffer
+	cborWrite(&buf, v)
+	return buf.Bytes()
+}
+
+type cborReader struct {
+	data []byte
+	off  int
+}
+
+func (r *cborReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.off) {
+		return nil, fmt.Errorf("CBOR truncated")
+	}
+	b := r.data[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b, nil
+}
+
+// Read an item's head: major type, and argument
+func (r *cborReader) head() (major, info byte, n uint64, err error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]&0xe0, b[0]&0x1f
+
+	size := uint64(0)
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, fmt.Errorf("CBOR indefinite lengths not supported")
+	}
+
+	b, err = r.next(size)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return major, info, n, nil
+}
+
+// Half-precision float bits to float64
+func cborHalf(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(frac, -24)
+	case 31:
+		v = math.Inf(1)
+		if frac != 0 {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		v = -v
+	}
+	return v
+}
+
+func (r *cborReader) read(depth int) (interface{}, error) {
+	if depth > 32 {
+		return nil, fmt.Errorf("CBOR nested too deep")
+	}
+
+	major, info, n, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return float64(n), nil
+	case cborNegInt:
+		return -1 - float64(n), nil
+	case cborText:
+		b, err := r.next(n)
+		return string(b), err
+	case cborArray:
+		if n > uint64(len(r.data)) {
+			return nil, fmt.Errorf("CBOR truncated")
+		}
+		a := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			e, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, e)
+		}
+		return a, nil
+	case cborMap:
+		m := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			k, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("CBOR map key isn't a string")
+			}
+			if m[key], err = r.read(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborSimple:
+		switch info | cborSimple {
+		case cborFalse:
+			return false, nil
+		case cborTrue:
+			return true, nil
+		case cborNull:
+			return nil, nil
+		case cborFloat16:
+			return cborHalf(uint16(n)), nil
+		case cborFloat32:
+			// Shortest decimal for the float32, so 21.7 isn't
+			// 21.700000762939453
+			f := math.Float32frombits(uint32(n))
+			return strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+		case cborFloat64:
+			return math.Float64frombits(n), nil
+		}
+	}
+
+	return nil, fmt.Errorf("CBOR type 0x%02x not supported", major|info)
+}
+
+// Decode CBOR data to a JSON value
+func cborDecode(data []byte) (interface{}, error) {
+	r := &cborReader{data: data}
+	v, err := r.read(0)
+	if err == nil && r.off != len(data) {
+		err = fmt.Errorf("CBOR has %d trailing bytes", len(data)-r.off)
+	}
+	return v, err
+}
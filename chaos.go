@@ -0,0 +1,136 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Chaos configuration, for testing Things over a bad network.  Chaos is
+// injected on Thing's links with mother, or, on Thing Prime or a bridge, on
+// the links with Thing or the bridge's children.  Messages sent on a link
+// are delayed Latency milliseconds, plus up to Jitter milliseconds more,
+// and Drop percent of them are lost.  The link is cut at random, on average
+// every Disconnect seconds, so the reliability layer (outbox, resync) and
+// the UI are exercised.  Messages aren't reordered.
+//
+// Chaos is opt-in: the zero ChaosConfig is no chaos.  Since Cfg.Chaos can be
+// set from the environment (see NewEnvConfig), e.g. MERLE_CHAOS_DROP=10, a
+// test can turn on chaos without rebuilding the Thing.
+type ChaosConfig struct {
+	// Milliseconds added to each message
+	Latency uint
+	// Up to this many more milliseconds added, at random, to each message
+	Jitter uint
+	// Percent of messages dropped
+	Drop uint
+	// Average seconds between disconnects.  Zero is no disconnects.
+	Disconnect uint
+}
+
+func (c *ChaosConfig) enabled() bool {
+	return c.Latency > 0 || c.Jitter > 0 || c.Drop > 0 || c.Disconnect > 0
+}
+
+// Messages to send later
+const chaosQueue = 256
+
+type chaosMsg struct {
+	due time.Time
+	msg []byte
+}
+
+type chaos struct {
+	cfg   ChaosConfig
+	ws    *webSocket
+	queue chan chaosMsg
+	cut   *time.Timer
+	done  chan bool
+}
+
+// Inject chaos on the link on ws, if configured
+func (t *Thing) chaosLink(ws *webSocket) {
+	cfg := t.Cfg.Chaos
+	if !cfg.enabled() {
+		return
+	}
+
+	c := &chaos{cfg: cfg, ws: ws, done: make(chan bool)}
+
+	if cfg.Latency > 0 || cfg.Jitter > 0 {
+		c.queue = make(chan chaosMsg, chaosQueue)
+		go c.sender()
+	}
+
+	if cfg.Disconnect > 0 {
+		// Disconnects are a Poisson process, so time between them is
+		// exponential
+		mean := float64(cfg.Disconnect) * float64(time.Second)
+		c.cut = time.AfterFunc(time.Duration(rand.ExpFloat64()*mean), func() {
+			t.log.printf("Chaos: disconnecting [%s]", ws.name)
+			ws.conn.Close()
+		})
+	}
+
+	t.log.printf("Chaos on [%s]: %+v", ws.name, cfg)
+	ws.chaos = c
+}
+
+func (c *chaos) send(msg []byte) error {
+	if c.cfg.Drop > 0 && uint(rand.Intn(100)) < c.cfg.Drop {
+		return nil
+	}
+
+	if c.queue == nil {
+		return c.ws.conn.WriteMessage(websocket.TextMessage, msg)
+	}
+
+	delay := time.Duration(c.cfg.Latency) * time.Millisecond
+	if c.cfg.Jitter > 0 {
+		delay += time.Duration(rand.Intn(int(c.cfg.Jitter)+1)) * time.Millisecond
+	}
+
+	// Copy, as the sender may reuse msg
+	m := chaosMsg{due: time.Now().Add(delay), msg: append([]byte(nil), msg...)}
+
+	select {
+	case c.queue <- m:
+	case <-c.done:
+	}
+
+	return nil
+}
+
+// Send queued messages, in order, once due
+func (c *chaos) sender() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.queue:
+			if wait := time.Until(m.due); wait > 0 {
+				select {
+				case <-c.done:
+					return
+				case <-time.After(wait):
+				}
+			}
+			c.ws.conn.WriteMessage(websocket.TextMessage, m.msg)
+		}
+	}
+}
+
+func (c *chaos) stop() {
+	if c.cut != nil {
+		c.cut.Stop()
+	}
+	close(c.done)
+}
@@ -0,0 +1,106 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket link to a server that forwards what it reads to got
+func chaosLinkTo(t *testing.T, got chan string) (*websocket.Conn, func()) {
+	var upgrader websocket.Upgrader
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for {
+				_, msg, err := conn.ReadMessage()
+				if err != nil {
+					close(got)
+					return
+				}
+				got <- string(msg)
+			}
+		}))
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, srv.Close
+}
+
+func TestChaos(t *testing.T) {
+	thing := NewThing(&pump{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Chaos = ChaosConfig{Latency: 50, Jitter: 20}
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 10)
+	conn, done := chaosLinkTo(t, got)
+	defer done()
+
+	ws := newWebSocket(thing, "chaos", conn)
+	thing.chaosLink(ws)
+	defer ws.stopChaos()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		msg := Msg{Msg: fmt.Sprintf("m%d", i)}
+		ws.Send(newPacket(thing.bus, nil, &msg))
+	}
+
+	// Delayed, but in order
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-got:
+			if !strings.Contains(msg, fmt.Sprintf("m%d", i)) {
+				t.Errorf("Got %s, want m%d", msg, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Message lost")
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Messages arrived after %s", d)
+	}
+
+	// All dropped
+	thing.Cfg.Chaos = ChaosConfig{Drop: 100}
+	ws2 := newWebSocket(thing, "chaos", conn)
+	thing.chaosLink(ws2)
+	ws2.Send(newPacket(thing.bus, nil, &Msg{Msg: "lost"}))
+	select {
+	case msg := <-got:
+		t.Errorf("Got dropped message %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// No chaos configured, no chaos
+	thing.Cfg.Chaos = ChaosConfig{}
+	ws3 := newWebSocket(thing, "calm", conn)
+	thing.chaosLink(ws3)
+	if ws3.chaos != nil {
+		t.Error("Chaos without config")
+	}
+}
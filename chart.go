@@ -0,0 +1,156 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chart data from Thing's history, for dashboards, with an HTTP GET on the
+// public web server:
+//
+//	/{id}/api/history?msg=Update&field=Temperature&since=24h&points=100
+//
+// "field" is the dotted path to a number or bool in the message, as for
+// Grafana metrics (see grafana.go).  "since" and "until" select the time
+// range, as for /{id}/history.  "points" is the most points returned; if
+// there are more, consecutive points are averaged down to "points".  The
+// response is a ChartSeries, oldest point first.
+//
+// In Thing's HTML template, the sparkline func draws a series, here for the
+// last 24 hours, as a sparkline, with merle.js:
+//
+//	{{sparkline "Update" "Temperature" "24h"}}
+//	<script src="{{.BasePath}}/merle.js"></script>
+//	<script>merle.sparklines()</script>
+
+// ChartPoint is a point in a ChartSeries
+type ChartPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// ChartSeries is the response to /{id}/api/history
+type ChartSeries struct {
+	Msg    string
+	Field  string
+	Points []ChartPoint
+}
+
+// Points of field in msg records in time range [since, until], oldest
+// first, averaged down to max points, if max isn't zero
+func (h *history) chart(msg, field string, since, until time.Time,
+	max int) ([]ChartPoint, error) {
+
+	records, err := h.query(msg, since, until, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	path := strings.Split(field, ".")
+	points := []ChartPoint{}
+
+	// Records are most recent first
+	for i := len(records) - 1; i >= 0; i-- {
+		var v interface{}
+		json.Unmarshal(records[i].Msg, &v)
+		if value, ok := numericValue(v, path); ok {
+			points = append(points, ChartPoint{records[i].Time, value})
+		}
+	}
+
+	if max == 0 || len(points) <= max {
+		return points, nil
+	}
+
+	// Average each bucket of consecutive points into one, at the bucket's
+	// last time
+	down := make([]ChartPoint, max)
+	for i := range down {
+		begin, end := i*len(points)/max, (i+1)*len(points)/max
+		sum := 0.0
+		for _, pt := range points[begin:end] {
+			sum += pt.Value
+		}
+		down[i] = ChartPoint{points[end-1].Time, sum / float64(end-begin)}
+	}
+
+	return down, nil
+}
+
+// GET /{id}/api/history
+func (t *Thing) apiHistory(w http.ResponseWriter, r *http.Request) {
+	thing := t.apiThing(w, r, "GET")
+	if thing == nil {
+		return
+	}
+
+	if thing.history == nil {
+		http.Error(w, "No history", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+
+	msg, field := q.Get("msg"), q.Get("field")
+	if msg == "" || field == "" {
+		http.Error(w, "Missing msg or field", http.StatusBadRequest)
+		return
+	}
+
+	since, err := parseSince(q.Get("since"))
+	if err != nil {
+		http.Error(w, "Bad since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var until time.Time
+	if s := q.Get("until"); s != "" {
+		until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Bad until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var max uint64
+	if s := q.Get("points"); s != "" {
+		max, err = strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			http.Error(w, "Bad points: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	points, err := thing.history.chart(msg, field, since, until, int(max))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ChartSeries{Msg: msg, Field: field,
+		Points: points})
+}
+
+// Template func drawing a sparkline of field in msg over the last since
+// (e.g. "24h").  merle.sparklines() fills in the chart.
+func (t *Thing) sparkline(msg, field, since string) template.HTML {
+	q := url.Values{"msg": {msg}, "field": {field}, "since": {since}}
+	src := t.Cfg.BasePath + "/" + t.id + "/api/history?" + q.Encode()
+	return template.HTML(fmt.Sprintf(`<svg class="merle-sparkline" `+
+		`data-history="%s" viewBox="0 0 100 20" preserveAspectRatio="none">`+
+		`</svg>`, template.HTMLEscapeString(src)))
+}
@@ -0,0 +1,316 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Bridge child management.  Children are listed, detached, blocked, renamed,
+// and grouped with messages on the bridge's private HTTP server (see
+// GetChildren), or with HTTP on the private HTTP server:
+//
+//	GET  /children                   list children and blocked Ids
+//	POST /children/{id}/detach       detach child
+//	POST /children/{id}/block        detach and block child
+//	POST /children/{id}/unblock      unblock child
+//	POST /children/{id}/rename       rename child to form value "name"
+//	POST /children/{id}/group        add child to form value "group"
+//	POST /children/{id}/ungroup      remove child from form value "group"
+//
+// Each replies with the children, coded as MsgChildren.  POSTs from another
+// origin's pages are refused.
+
+// BridgeGroup puts the children matching Match in group Name.  Match is a
+// regular expression of the form id:model:name.  For example, to send to all
+// relays and to the Things in the garage:
+//
+//	thing.Cfg.BridgeGroups = []merle.BridgeGroup{
+//		{Name: "lights", Match: ".*:relays:.*"},
+//		{Name: "garage", Match: ".*:.*:garage_.*"},
+//	}
+//
+// and then, in a bridge subscriber:
+//
+//	p.Marshal(&msg).SendGroup("lights")
+//
+// A child is also in each group named in its own Cfg.Tags, and in groups
+// added with GroupChild.  Run fails if a Match isn't a valid regular
+// expression.
+type BridgeGroup struct {
+	Name  string
+	Match string
+}
+
+// Compile each BridgeGroup's Match
+func compileGroups(groups []BridgeGroup) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, group := range groups {
+		re, err := regexp.Compile(group.Match)
+		if err != nil {
+			return nil, fmt.Errorf("BridgeGroups regexp error: %s", err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Groups child is in, sorted
+func (b *bridge) childGroups(child *Thing) []string {
+	return b.groupsOf(child, b.childName(child))
+}
+
+// Groups child is in, sorted, with BridgeGroups matched against name.  For
+// callers already holding childrenLock.
+func (b *bridge) groupsOf(child *Thing, name string) []string {
+	set := make(map[string]bool)
+
+	for _, tag := range child.tags {
+		set[tag] = true
+	}
+
+	spec := child.id + ":" + child.model + ":" + name
+	for i, re := range b.groupMatch {
+		if re.MatchString(spec) {
+			set[b.thing.Cfg.BridgeGroups[i].Name] = true
+		}
+	}
+
+	b.groupsLock.RLock()
+	for group := range b.groups[child.id] {
+		set[group] = true
+	}
+	b.groupsLock.RUnlock()
+
+	groups := []string{}
+	for group := range set {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	return groups
+}
+
+func (b *bridge) inGroup(child *Thing, group string) bool {
+	for _, g := range b.childGroups(child) {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Send packet to the attached children in group
+func (t *Thing) sendGroup(p *Packet, group string) {
+	if !t.isBridge {
+		t.log.printf("Not a bridge; not sending to group [%s]", group)
+		return
+	}
+
+	b := t.bridge
+	sent := 0
+
+	for _, child := range b.childThings() {
+		if !b.childOnline(child) || !b.inGroup(child, group) {
+			continue
+		}
+		child.childSock.Send(p)
+		sent++
+	}
+
+	t.log.printf("Send to group [%s] (%d children): %.80s", group, sent,
+		p.String())
+}
+
+func (b *bridge) isBlocked(id string) bool {
+	b.blockedLock.RLock()
+	defer b.blockedLock.RUnlock()
+	return b.blocked[id]
+}
+
+func (b *bridge) blockedIds() []string {
+	b.blockedLock.RLock()
+	defer b.blockedLock.RUnlock()
+
+	ids := []string{}
+	for id := range b.blocked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (b *bridge) childList() MsgChildren {
+	return MsgChildren{
+		Msg:      ReplyChildren,
+		Children: b.childStatus(),
+		Blocked:  b.blockedIds(),
+	}
+}
+
+// Close the connection to an attached child
+func (b *bridge) detach(id string) error {
+	child := b.getChild(id)
+	if child == nil || !b.childOnline(child) {
+		return fmt.Errorf("Child [%s] not attached", id)
+	}
+
+	b.thing.log.printf("Detaching child [%s]", id)
+
+	// Kick under the lock so the port isn't swapped by a re-attach
+	b.childrenLock.Lock()
+	child.primePort.kick()
+	b.childrenLock.Unlock()
+
+	return nil
+}
+
+// Do child management op, one of DetachChild, BlockChild, UnblockChild,
+// RenameChild, GroupChild, or UngroupChild
+func (b *bridge) manage(msg *MsgChild) error {
+	id, name := msg.Id, msg.Name
+
+	switch msg.Msg {
+	case DetachChild:
+		return b.detach(id)
+	case BlockChild:
+		if !validId(id) {
+			return fmt.Errorf("Bad Id %q", id)
+		}
+		b.blockedLock.Lock()
+		b.blocked[id] = true
+		b.blockedLock.Unlock()
+		b.thing.log.printf("Blocked child [%s]", id)
+		b.detach(id)
+	case UnblockChild:
+		b.blockedLock.Lock()
+		delete(b.blocked, id)
+		b.blockedLock.Unlock()
+		b.thing.log.printf("Unblocked child [%s]", id)
+	case RenameChild:
+		child := b.getChild(id)
+		if child == nil {
+			return fmt.Errorf("Child [%s] not found", id)
+		}
+		if name == "" || !validName(name) {
+			return fmt.Errorf("Name must contain only alphanumeric or underscore characters")
+		}
+		b.childrenLock.Lock()
+		b.thing.log.printf("Renamed child [%s] %s to %s", id,
+			child.name, name)
+		child.name = name
+		b.childrenLock.Unlock()
+	case GroupChild:
+		if b.getChild(id) == nil {
+			return fmt.Errorf("Child [%s] not found", id)
+		}
+		if msg.Group == "" || !validName(msg.Group) {
+			return fmt.Errorf("Group must contain only alphanumeric or underscore characters")
+		}
+		b.groupsLock.Lock()
+		if b.groups[id] == nil {
+			b.groups[id] = make(map[string]bool)
+		}
+		b.groups[id][msg.Group] = true
+		b.groupsLock.Unlock()
+		b.thing.log.printf("Added child [%s] to group %s", id, msg.Group)
+	case UngroupChild:
+		b.groupsLock.Lock()
+		delete(b.groups[id], msg.Group)
+		b.groupsLock.Unlock()
+		b.thing.log.printf("Removed child [%s] from group %s", id, msg.Group)
+	default:
+		return fmt.Errorf("Unknown child op %s", msg.Msg)
+	}
+	return nil
+}
+
+// Subscriber handler for GetChildren and the child management messages.
+// Only handled on the private HTTP server.
+func (b *bridge) manageChild(p *Packet) {
+	if p.src == nil || p.src.Flags()&sock_flag_private == 0 {
+		b.thing.log.println("Ignoring child management; not on private server")
+		return
+	}
+
+	var msg MsgChild
+	p.Unmarshal(&msg)
+
+	if msg.Msg != GetChildren {
+		if err := b.manage(&msg); err != nil {
+			b.thing.log.println("Child management failed:", err)
+		}
+	}
+
+	resp := b.childList()
+	p.Marshal(&resp).Reply()
+}
+
+var childOps = map[string]string{
+	"detach":  DetachChild,
+	"block":   BlockChild,
+	"unblock": UnblockChild,
+	"rename":  RenameChild,
+	"group":   GroupChild,
+	"ungroup": UngroupChild,
+}
+
+func (b *bridge) childrenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.writeChildren(w)
+}
+
+func (b *bridge) writeChildren(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.childList())
+}
+
+func (b *bridge) childHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !b.thing.checkOrigin(r) {
+		http.Error(w, "Cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	op, ok := childOps[vars["op"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	msg := MsgChild{
+		Msg:   op,
+		Id:    vars["id"],
+		Name:  r.FormValue("name"),
+		Group: r.FormValue("group"),
+	}
+
+	if err := b.manage(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.writeChildren(w)
+}
@@ -0,0 +1,189 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/merliot/merle"
+)
+
+func runBundle(args []string) error {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	genkey := fs.Bool("genkey", false, "Generate a signing key into the key file and print the public key")
+	key := fs.String("key", "bundle.key", "Signing key file")
+	out := fs.String("out", ".", "Output directory; bundle is written to out/model/version.tar.gz")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: merle bundle [flags] dir\n")
+		fmt.Fprintf(fs.Output(), "       merle bundle -genkey [-key file]\n\n")
+		fmt.Fprintf(fs.Output(), "Pack and sign a model's assets in dir as a bundle.  Dir must have a\n")
+		fmt.Fprintf(fs.Output(), "manifest.json with the Model and Version.\n\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if *genkey {
+		pub, err := genKey(*key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Public key (for Cfg.Bundles.Keys): %s\n", pub)
+		return nil
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	file, err := makeBundle(fs.Arg(0), *key, *out)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s and %s.sig\n", file, file)
+	return nil
+}
+
+// Generate an ed25519 key, saving the private key, base64-encoded, in file.
+// Returns the public key, base64-encoded.
+func genKey(file string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv.Seed())); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
+
+func readKey(file string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("bad key in %s", file)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Pack dir into a gzipped tar file
+func tarDir(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("%s: not a regular file", path)
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Pack and sign the bundle in dir.  Returns the bundle file written.
+func makeBundle(dir, keyFile, out string) (string, error) {
+	var manifest merle.BundleManifest
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("manifest.json: %s", err)
+	}
+	if manifest.Model == "" || manifest.Version == "" {
+		return "", fmt.Errorf("manifest.json needs Model and Version")
+	}
+
+	key, err := readKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	bundle, err := tarDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(out, manifest.Model, manifest.Version+".tar.gz")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, bundle, 0644); err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(key, bundle)
+	if err := ioutil.WriteFile(file+".sig", sig, 0644); err != nil {
+		return "", err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMakeBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "bundle.key")
+	pub, err := genKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assets := filepath.Join(dir, "sprinkler")
+	os.MkdirAll(filepath.Join(assets, "templates"), 0755)
+	ioutil.WriteFile(filepath.Join(assets, "manifest.json"),
+		[]byte(`{"Model":"sprinkler","Version":"1.0.0","HtmlTemplate":"templates/sprinkler.html"}`), 0644)
+	ioutil.WriteFile(filepath.Join(assets, "templates", "sprinkler.html"),
+		[]byte("<html></html>"), 0644)
+
+	file, err := makeBundle(assets, keyFile, filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != filepath.Join(dir, "out", "sprinkler", "1.0.0.tar.gz") {
+		t.Errorf("Got bundle file %s", file)
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	sig, _ := ioutil.ReadFile(file + ".sig")
+	key, _ := base64.StdEncoding.DecodeString(pub)
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		t.Errorf("Bundle signature doesn't verify")
+	}
+
+	// Don't clobber an existing key
+	if _, err := genKey(keyFile); err == nil {
+		t.Errorf("Overwrote key file")
+	}
+}
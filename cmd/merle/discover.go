@@ -0,0 +1,61 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/merliot/merle"
+)
+
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for Things to answer")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: merle discover [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "List Things advertising on the LAN with mDNS.\n\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	things, err := merle.Discover(*timeout)
+	if err != nil {
+		return err
+	}
+
+	printDiscovered(os.Stdout, things)
+
+	return nil
+}
+
+func port(p uint) string {
+	if p == 0 {
+		return "-"
+	}
+	return fmt.Sprint(p)
+}
+
+func printDiscovered(out io.Writer, things []merle.DiscoveredThing) {
+	if len(things) == 0 {
+		fmt.Fprintln(out, "No Things found")
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tMODEL\tNAME\tHOST\tPUBLIC\tTLS\tPRIVATE\n")
+	for _, t := range things {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.Id, t.Model,
+			t.Name, t.Host, port(t.PortPublic), port(t.PortPublicTLS),
+			port(t.PortPrivate))
+	}
+	w.Flush()
+}
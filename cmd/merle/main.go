@@ -0,0 +1,71 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Merle is a tool for working with Merle Things.
+//
+// Usage:
+//
+//	merle <command> [arguments]
+//
+// The commands are:
+//
+//	bundle    pack and sign a model's UI bundle
+//	discover  list Things on the LAN
+//	new       create a new Thing project
+//	release   sign a Thing binary for over-the-air update
+//	send      send a message to a running Thing
+//	status    print the status of a running Thing
+//	vet       check a model's message coverage
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"bundle", "pack and sign a model's UI bundle", runBundle},
+	{"discover", "list Things on the LAN", runDiscover},
+	{"new", "create a new Thing project", runNew},
+	{"release", "sign a Thing binary for over-the-air update", runRelease},
+	{"send", "send a message to a running Thing", runSend},
+	{"status", "print the status of a running Thing", runStatus},
+	{"vet", "check a model's message coverage", runVet},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n\n\tmerle <command> [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "The commands are:\n\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-10s%s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"merle <command> -h\" for more information about a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "merle "+c.name+":", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "merle: unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
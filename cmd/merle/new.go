@@ -0,0 +1,385 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"text/template"
+)
+
+const merlePath = "github.com/merliot/merle"
+
+// Project parameters passed to the file templates
+type project struct {
+	Name    string
+	Model   string
+	Module  string
+	Type    string
+	Recv    string
+	Version string
+}
+
+// Project files, keyed by path relative to the project directory.  Templates
+// use [[ ]] delimiters, so the Thing's HTML template can use {{ }}.
+var projectFiles = map[string]string{
+	"go.mod":                          goModTmpl,
+	"[[.Name]].go":                    thingTmpl,
+	"cmd/[[.Name]]/main.go":           mainTmpl,
+	"assets/templates/[[.Name]].html": htmlTmpl,
+}
+
+var validName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+var validModel = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Names which would clash with the generated code's imports
+var reserved = map[string]bool{
+	"main": true, "merle": true, "flag": true, "log": true, "sync": true,
+	"time": true,
+}
+
+func runNew(args []string) error {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	model := fs.String("model", "", "Thing's Model (default name)")
+	module := fs.String("module", "", "Go module path (default name)")
+	dir := fs.String("dir", "", "Project directory (default name)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: merle new [flags] name\n\n")
+		fmt.Fprintf(fs.Output(), "Create a new Thing project in directory name.\n\n")
+		fs.PrintDefaults()
+	}
+
+	// Allow flags before and after name
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	if !validName.MatchString(name) {
+		return fmt.Errorf("name %q must be lowercase letters, digits, or underscores, starting with a letter", name)
+	}
+	if token.Lookup(name).IsKeyword() || reserved[name] {
+		return fmt.Errorf("name %q is reserved", name)
+	}
+	if *model == "" {
+		*model = name
+	}
+	if !validModel.MatchString(*model) {
+		return fmt.Errorf("model %q must contain only alphanumeric or underscore characters", *model)
+	}
+	if *module == "" {
+		*module = name
+	}
+	if *dir == "" {
+		*dir = name
+	}
+
+	if _, err := os.Stat(*dir); err == nil {
+		return fmt.Errorf("%s already exists", *dir)
+	}
+
+	p := project{
+		Name:    name,
+		Model:   *model,
+		Module:  *module,
+		Type:    name,
+		Recv:    receiver(name),
+		Version: merleVersion(),
+	}
+
+	if err := generate(*dir, &p); err != nil {
+		os.RemoveAll(*dir)
+		return err
+	}
+
+	fmt.Printf("Created Thing %s in %s\n\n", name, *dir)
+	fmt.Printf("Next steps:\n\n")
+	fmt.Printf("\tcd %s\n", *dir)
+	if p.Version == "" {
+		fmt.Printf("\tgo get %s\n", merlePath)
+	}
+	fmt.Printf("\tgo mod tidy\n")
+	fmt.Printf("\tgo run ./cmd/%s -port-public 8088\n", name)
+
+	return nil
+}
+
+// Receiver name for the Thinger's methods, not clashing with the Packet
+// parameter p
+func receiver(name string) string {
+	if name[0] == 'p' {
+		return "t"
+	}
+	return name[:1]
+}
+
+// Version of merle this tool was built from, or "" if unknown, e.g. when
+// built from a local checkout
+func merleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Path != merlePath {
+		return ""
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	return ""
+}
+
+func generate(dir string, p *project) error {
+	for path, text := range projectFiles {
+		path, err := execute("path", path, p)
+		if err != nil {
+			return err
+		}
+
+		data, err := execute(path, text, p)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(path, ".go") {
+			src, err := format.Source([]byte(data))
+			if err != nil {
+				return fmt.Errorf("formatting %s: %s", path, err)
+			}
+			data = string(src)
+		}
+
+		file := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func execute(name, text string, p *project) (string, error) {
+	var buf bytes.Buffer
+
+	tmpl, err := template.New(name).Delims("[[", "]]").Funcs(template.FuncMap{
+		"title": strings.Title,
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+const goModTmpl = `module [[.Module]]
+
+go 1.15
+[[- if .Version]]
+
+require github.com/merliot/merle [[.Version]]
+[[- end]]
+`
+
+const thingTmpl = `package [[.Name]]
+
+import (
+	"sync"
+	"time"
+
+	"github.com/merliot/merle"
+)
+
+type [[.Type]] struct {
+	sync.RWMutex
+	Msg     string
+	Counter int
+}
+
+func New[[title .Name]]() merle.Thinger {
+	return &[[.Type]]{}
+}
+
+type msgUpdate struct {
+	Msg     string
+	Counter int
+}
+
+func ([[.Recv]] *[[.Type]]) init(p *merle.Packet) {
+	[[.Recv]].Counter = 0
+}
+
+func ([[.Recv]] *[[.Type]]) run(p *merle.Packet) {
+	ticker := time.NewTicker(time.Second)
+
+	for range ticker.C {
+		[[.Recv]].Lock()
+		[[.Recv]].Counter++
+		msg := msgUpdate{Msg: "Update", Counter: [[.Recv]].Counter}
+		[[.Recv]].Unlock()
+		p.Marshal(&msg).Broadcast()
+	}
+}
+
+func ([[.Recv]] *[[.Type]]) getState(p *merle.Packet) {
+	[[.Recv]].RLock()
+	[[.Recv]].Msg = merle.ReplyState
+	p.Marshal([[.Recv]])
+	[[.Recv]].RUnlock()
+	p.Reply()
+}
+
+func ([[.Recv]] *[[.Type]]) saveState(p *merle.Packet) {
+	[[.Recv]].Lock()
+	p.Unmarshal([[.Recv]])
+	[[.Recv]].Unlock()
+}
+
+func ([[.Recv]] *[[.Type]]) update(p *merle.Packet) {
+	var msg msgUpdate
+	p.Unmarshal(&msg)
+
+	[[.Recv]].Lock()
+	[[.Recv]].Counter = msg.Counter
+	[[.Recv]].Unlock()
+
+	p.Broadcast()
+}
+
+func ([[.Recv]] *[[.Type]]) Subscribers() merle.Subscribers {
+	return merle.Subscribers{
+		merle.CmdInit:    [[.Recv]].init,
+		merle.CmdRun:     [[.Recv]].run,
+		merle.GetState:   [[.Recv]].getState,
+		merle.ReplyState: [[.Recv]].saveState,
+		"Update":         [[.Recv]].update,
+	}
+}
+
+func ([[.Recv]] *[[.Type]]) Assets() *merle.ThingAssets {
+	return &merle.ThingAssets{
+		AssetsDir:    "assets",
+		HtmlTemplate: "templates/[[.Name]].html",
+	}
+}
+`
+
+const mainTmpl = `package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/merliot/merle"
+	"[[.Module]]"
+)
+
+func main() {
+	thing := merle.NewThing([[.Name]].New[[title .Name]]())
+
+	thing.Cfg.Model = "[[.Model]]"
+	thing.Cfg.Name = "[[.Name]]"
+
+	thing.Cfg.PortPublic = 80
+	thing.Cfg.PortPrivate = 8080
+
+	merle.FlagSet(&thing.Cfg)
+
+	flag.Parse()
+
+	log.Fatalln(thing.Run())
+}
+`
+
+const htmlTmpl = `<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<title>{{.Name}}</title>
+	</head>
+	<body>
+		<pre id="identity"></pre>
+		<pre id="counter"></pre>
+
+		<script>
+			var conn
+			var online = false
+
+			identity = document.getElementById("identity")
+			counter = document.getElementById("counter")
+
+			function getIdentity() {
+				conn.send(JSON.stringify({Msg: "_GetIdentity"}))
+			}
+
+			function getState() {
+				conn.send(JSON.stringify({Msg: "_GetState"}))
+			}
+
+			function showCounter(msg) {
+				counter.textContent = "Counter: " + msg.Counter
+				counter.style.opacity = online ? 1.0 : 0.3
+			}
+
+			function connect() {
+				conn = new WebSocket("{{.WebSocket}}")
+
+				conn.onopen = function(evt) {
+					getIdentity()
+				}
+
+				conn.onclose = function(evt) {
+					online = false
+					setTimeout(connect, 1000)
+				}
+
+				conn.onerror = function(err) {
+					conn.close()
+				}
+
+				conn.onmessage = function(evt) {
+					msg = JSON.parse(evt.data)
+					console.log('[[.Name]]', msg)
+
+					switch(msg.Msg) {
+					case "_ReplyIdentity":
+						identity.textContent = msg.Model + " " + msg.Name + " [" + msg.Id + "]"
+						// fall through
+					case "_EventStatus":
+						online = msg.Online
+						getState()
+						break
+					case "_ReplyState":
+					case "Update":
+						showCounter(msg)
+						break
+					}
+				}
+			}
+
+			connect()
+		</script>
+	</body>
+</html>
+`
@@ -0,0 +1,67 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merle-new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proj := filepath.Join(dir, "pump")
+	err = runNew([]string{"pump", "-model", "pump_v2", "-dir", proj,
+		"-module", "example.com/pump"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{"pump.go", "cmd/pump/main.go"} {
+		_, err := parser.ParseFile(token.NewFileSet(),
+			filepath.Join(proj, file), nil, 0)
+		if err != nil {
+			t.Errorf("Generated %s doesn't parse: %s", file, err)
+		}
+	}
+
+	main, err := ioutil.ReadFile(filepath.Join(proj, "cmd/pump/main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"example.com/pump"`, `pump.NewPump()`,
+		`thing.Cfg.Model = "pump_v2"`} {
+		if !strings.Contains(string(main), want) {
+			t.Errorf("main.go missing %s", want)
+		}
+	}
+
+	html, err := ioutil.ReadFile(filepath.Join(proj,
+		"assets/templates/pump.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "{{.WebSocket}}") {
+		t.Errorf("HTML template missing {{.WebSocket}}")
+	}
+
+	// Project exists
+	if err := runNew([]string{"-dir", proj, "pump"}); err == nil {
+		t.Errorf("New over existing project should fail")
+	}
+
+	if err := runNew([]string{"-dir", proj + "2", "func"}); err == nil {
+		t.Errorf("New with keyword name should fail")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/merliot/merle"
+)
+
+func runRelease(args []string) error {
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	key := fs.String("key", "bundle.key", "Signing key file (see merle bundle -genkey)")
+	model := fs.String("model", "", "Model of the Thing the binary is for")
+	version := fs.String("version", "", "Version of the binary")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: merle release -model model -version version [flags] binary\n\n")
+		fmt.Fprintf(fs.Output(), "Sign a Thing binary for over-the-air update.  Prints the signature\n")
+		fmt.Fprintf(fs.Output(), "to send, with the binary's URL and version, in an _Update message.\n\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *model == "" || *version == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	sig, err := signRelease(fs.Arg(0), *key, *model, *version)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Signature: %s\n", sig)
+	return nil
+}
+
+// Sign binary as model's version.  Returns the signature, base64-encoded.
+func signRelease(binary, keyFile, model, version string) (string, error) {
+	key, err := readKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(binary)
+	if err != nil {
+		return "", err
+	}
+
+	sig := ed25519.Sign(key, merle.UpdateSigned(model, version, data))
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
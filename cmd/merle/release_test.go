@@ -0,0 +1,45 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/merliot/merle"
+)
+
+func TestSignRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "bundle.key")
+	pub, err := genKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary := filepath.Join(dir, "thing")
+	ioutil.WriteFile(binary, []byte("binary"), 0755)
+
+	sig, err := signRelease(binary, keyFile, "pump", "1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(pub)
+	s, _ := base64.StdEncoding.DecodeString(sig)
+	if !ed25519.Verify(ed25519.PublicKey(key),
+		merle.UpdateSigned("pump", "1.2.0", []byte("binary")), s) {
+		t.Errorf("Release signature doesn't verify")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/merliot/merle"
+)
+
+// Where to send, and who is sending
+type target struct {
+	addr   string
+	id     string
+	user   string
+	passwd string
+	token  string
+	secure bool
+	// E2E key, to seal and open messages (see merle.E2EConfig)
+	e2eKey string
+}
+
+// WebSocket URL and request header for target.  With an id, the WebSocket is
+// opened on the Thing's public HTTP server, authenticated by API token or
+// user; otherwise, it's a monitor WebSocket on the private HTTP server.
+func (t *target) url() (string, http.Header) {
+	if t.id == "" {
+		return "ws://" + t.addr + "/ws?monitor", nil
+	}
+
+	scheme := "ws://"
+	if t.secure {
+		scheme = "wss://"
+	}
+
+	header := make(http.Header)
+	switch {
+	case t.token != "":
+		header.Set("Authorization", "Bearer "+t.token)
+	case t.user != "":
+		auth := base64.StdEncoding.EncodeToString([]byte(t.user + ":" + t.passwd))
+		header.Set("Authorization", "Basic "+auth)
+	}
+
+	return scheme + t.addr + "/ws/" + t.id, header
+}
+
+func runSend(args []string) error {
+	var tgt target
+
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fs.StringVar(&tgt.addr, "addr", "localhost:8080", "Thing's HTTP server address")
+	fs.StringVar(&tgt.id, "id", "", "Thing's Id; send on the public HTTP server at addr rather than the private server")
+	fs.StringVar(&tgt.user, "user", "", "User on the public HTTP server; password is read from $MERLE_PASSWD")
+	fs.StringVar(&tgt.token, "token", "", "API token for the public HTTP server")
+	fs.BoolVar(&tgt.secure, "tls", false, "Use TLS (wss://) on the public HTTP server")
+	reply := fs.String("reply", "", "Wait for reply message, e.g. _ReplyState, and print it")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for connection and reply")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: merle send [flags] message\n\n")
+		fmt.Fprintf(fs.Output(), "Send a JSON message to a running Thing.  Use \"-\" to read message from stdin.\n\n")
+		fmt.Fprintf(fs.Output(), "If $MERLE_E2E_KEY is set, the message is sealed with the key, and a sealed\nreply is opened (see merle.E2EConfig).  Sealing needs -id.\n\n")
+		fmt.Fprintf(fs.Output(), "Example:\n\n\tmerle send -reply _ReplyState '{\"Msg\":\"_GetState\"}'\n\n")
+		fs.PrintDefaults()
+	}
+
+	// Allow flags before and after message
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	arg := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	msg := []byte(arg)
+	if arg == "-" {
+		var err error
+		if msg, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+
+	tgt.passwd = os.Getenv("MERLE_PASSWD")
+	tgt.e2eKey = os.Getenv("MERLE_E2E_KEY")
+
+	return send(os.Stdout, &tgt, msg, *reply, *timeout)
+}
+
+// Send msg to target and, if reply is given, wait for reply and print it
+func send(out io.Writer, tgt *target, msg []byte, reply string,
+	timeout time.Duration) error {
+
+	var m merle.Msg
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return fmt.Errorf("message is not JSON: %s", err)
+	}
+	if m.Msg == "" {
+		return fmt.Errorf("message is missing Msg")
+	}
+
+	// Framework messages aren't sealed; Thing Prime acts on them
+	var sealer *merle.Sealer
+	if tgt.e2eKey != "" {
+		if tgt.id == "" {
+			return fmt.Errorf("sealing needs -id")
+		}
+		var err error
+		if sealer, err = merle.NewSealer(tgt.e2eKey, tgt.id); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(m.Msg, "_") {
+			if msg, err = sealer.Seal(msg, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	url, header := tgt.url()
+	conn, err := dial(url, header, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		return err
+	}
+
+	if reply == "" {
+		// Close cleanly so the message isn't lost with the connection
+		return conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("no %s reply: %s", reply, err)
+		}
+		var sealed merle.MsgSealed
+		json.Unmarshal(data, &sealed)
+		if sealed.Sealed != "" && sealer != nil {
+			if data, _, err = sealer.Open(data); err != nil {
+				return err
+			}
+		}
+		json.Unmarshal(data, &m)
+		if m.Msg == reply {
+			var buf bytes.Buffer
+			json.Indent(&buf, data, "", "\t")
+			fmt.Fprintln(out, buf.String())
+			return nil
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/merliot/merle"
+)
+
+func TestSend(t *testing.T) {
+	var upgrader websocket.Upgrader
+
+	// Fake Thing answering _GetState on the public server, for bob only
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, passwd, _ := r.BasicAuth(); user != "bob" || passwd != "pw" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/ws/00_11_22" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, data, _ := conn.ReadMessage()
+		if string(data) == `{"Msg":"_GetState"}` {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"Msg":"_EventStatus"}`))
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"Msg":"_ReplyState","On":true}`))
+		}
+	}))
+	defer srv.Close()
+
+	tgt := target{
+		addr:   strings.TrimPrefix(srv.URL, "http://"),
+		id:     "00_11_22",
+		user:   "bob",
+		passwd: "pw",
+	}
+
+	var out bytes.Buffer
+	err := send(&out, &tgt, []byte(`{"Msg":"_GetState"}`), "_ReplyState", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"On": true`) {
+		t.Errorf("Got reply %s", out.String())
+	}
+
+	tgt.passwd = "wrong"
+	err = send(&out, &tgt, []byte(`{"Msg":"_GetState"}`), "", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Got %v, want 401", err)
+	}
+
+	if err := send(&out, &tgt, []byte(`{"Relay":1}`), "", time.Second); err == nil {
+		t.Errorf("Sent message missing Msg")
+	}
+}
+
+func TestSendSealed(t *testing.T) {
+	var upgrader websocket.Upgrader
+
+	key := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	sealer, err := merle.NewThingSealer(key, "00_11_22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake Thing opening Click, and replying with a sealed Click
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, data, _ := conn.ReadMessage()
+		plain, _, err := sealer.Open(data)
+		if err != nil {
+			t.Errorf("Opening %s: %s", data, err)
+			return
+		}
+		sealed, _ := sealer.Seal(plain, time.Now())
+		conn.WriteMessage(websocket.TextMessage, sealed)
+	}))
+	defer srv.Close()
+
+	tgt := target{
+		addr:   strings.TrimPrefix(srv.URL, "http://"),
+		id:     "00_11_22",
+		e2eKey: key,
+	}
+
+	var out bytes.Buffer
+	err = send(&out, &tgt, []byte(`{"Msg":"Click","Relay":1}`), "Click", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"Relay": 1`) {
+		t.Errorf("Got reply %s", out.String())
+	}
+
+	tgt.id = ""
+	if err := send(&out, &tgt, []byte(`{"Msg":"Click"}`), "", time.Second); err == nil {
+		t.Errorf("Sealed without Id")
+	}
+}
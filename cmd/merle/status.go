@@ -0,0 +1,206 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/merliot/merle"
+)
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Thing's private HTTP server address")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for replies")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: merle status [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Print the status of a running Thing.\n\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	replies, err := query(*addr, *timeout, merle.GetIdentity,
+		merle.GetStatus, merle.GetState)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := replies[merle.ReplyIdentity]; !ok {
+		return fmt.Errorf("no reply from Thing at %s", *addr)
+	}
+
+	printStatus(os.Stdout, replies, time.Now())
+
+	return nil
+}
+
+// Open a monitor WebSocket on the Thing's private HTTP server, send a request
+// for each msg, and collect replies, keyed by reply message, until all
+// replies are in or timeout.
+func query(addr string, timeout time.Duration, msgs ...string) (map[string][]byte, error) {
+	conn, err := dial("ws://"+addr+"/ws?monitor", nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, msg := range msgs {
+		err := conn.WriteJSON(&merle.Msg{Msg: msg})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replies := make(map[string][]byte)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	for len(replies) < len(msgs) {
+		var msg merle.Msg
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			// Partial replies, e.g. Thing doesn't know GetStatus
+			break
+		}
+		json.Unmarshal(data, &msg)
+
+		switch msg.Msg {
+		case merle.ReplyIdentity, merle.ReplyStatus, merle.ReplyState:
+			replies[msg.Msg] = data
+		}
+	}
+
+	return replies, nil
+}
+
+func dial(url string, header http.Header, timeout time.Duration) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: timeout}
+	conn, resp, err := dialer.Dial(url, header)
+	if err != nil && resp != nil {
+		// Say why, e.g. "401 Unauthorized"
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return conn, err
+}
+
+func uptime(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	return fmt.Sprintf("%d days %d hours %d mins", days, hours, d/time.Minute)
+}
+
+func printStatus(out io.Writer, replies map[string][]byte, now time.Time) {
+	var id merle.MsgIdentity
+	var status merle.MsgStatus
+
+	json.Unmarshal(replies[merle.ReplyIdentity], &id)
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Id:\t%s\n", id.Id)
+	fmt.Fprintf(w, "Model:\t%s\n", id.Model)
+	fmt.Fprintf(w, "Name:\t%s\n", id.Name)
+	fmt.Fprintf(w, "Online:\t%t\n", id.Online)
+	fmt.Fprintf(w, "Uptime:\t%s\n", uptime(now.Sub(id.StartupTime)))
+	if len(id.Tags) > 0 {
+		fmt.Fprintf(w, "Tags:\t%s\n", strings.Join(id.Tags, ", "))
+	}
+
+	data, ok := replies[merle.ReplyStatus]
+	if !ok {
+		fmt.Fprintf(w, "\nStatus not available\n")
+	} else {
+		json.Unmarshal(data, &status)
+
+		tunnel := status.Tunnel.State
+		if status.Tunnel.Host != "" {
+			tunnel += " (" + status.Tunnel.Host + ")"
+		}
+		fmt.Fprintf(w, "Tunnel:\t%s\n", tunnel)
+
+		if status.TunnelStandby != nil {
+			standby := status.TunnelStandby.State
+			if status.TunnelStandby.Host != "" {
+				standby += " (" + status.TunnelStandby.Host + ")"
+			}
+			fmt.Fprintf(w, "Standby tunnel:\t%s\n", standby)
+		}
+
+		fmt.Fprintf(w, "\nSockets:\n")
+		for _, s := range status.Sockets {
+			var flags []string
+			if s.Mother {
+				flags = append(flags, "mother")
+			}
+			if s.Ready {
+				flags = append(flags, "ready")
+			}
+			if s.Standby {
+				flags = append(flags, "standby")
+			}
+			fmt.Fprintf(w, "\t%s\t%s\n", s.Name, strings.Join(flags, ","))
+		}
+
+		if len(status.Children) > 0 {
+			fmt.Fprintf(w, "\nChildren:\n")
+			for _, c := range status.Children {
+				online := "offline"
+				if c.Online {
+					online = "online"
+				}
+				fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\n", c.Id, c.Model,
+					c.Name, online)
+			}
+		}
+
+		if len(status.Duty) > 0 {
+			fmt.Fprintf(w, "\nDuty:\n")
+			for _, d := range status.Duty {
+				on := "off"
+				if d.On {
+					on = fmt.Sprintf("on %ds", d.OnTime)
+				}
+				fmt.Fprintf(w, "\t%s\t%s\t%d cycles/hour\n", d.Output,
+					on, d.Cycles)
+			}
+		}
+
+		fmt.Fprintf(w, "\nComponents:\n")
+		for _, c := range status.Components {
+			fmt.Fprintf(w, "\t%s\t%s\t%s\n", c.Name, c.State, c.Err)
+		}
+
+		if len(status.Errors) > 0 {
+			fmt.Fprintf(w, "\nErrors:\n")
+			for _, e := range status.Errors {
+				fmt.Fprintf(w, "\t%s\t%s\t%s\n", e.Code,
+					e.Time.Format(time.RFC3339), e.Err)
+			}
+		}
+	}
+
+	w.Flush()
+
+	if data, ok := replies[merle.ReplyState]; ok {
+		var buf bytes.Buffer
+		json.Indent(&buf, data, "\t", "\t")
+		fmt.Fprintf(out, "\nState:\n\t%s\n", buf.String())
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintStatus(t *testing.T) {
+	now := time.Date(2022, 6, 3, 12, 0, 0, 0, time.UTC)
+
+	replies := map[string][]byte{
+		"_ReplyIdentity": []byte(`{"Msg":"_ReplyIdentity","Id":"00_11_22",` +
+			`"Model":"relays","Name":"garage","Online":true,` +
+			`"StartupTime":"2022-06-01T10:30:00Z"}`),
+		"_ReplyStatus": []byte(`{"Msg":"_ReplyStatus",` +
+			`"Sockets":[{"Name":"ws:1.2.3.4:5/ws","Mother":true,"Ready":true}],` +
+			`"Tunnel":{"State":"connected","Host":"hub.example.com"},` +
+			`"Components":[{"Name":"web public","State":"running"}]}`),
+		"_ReplyState": []byte(`{"Msg":"_ReplyState","States":[true,false]}`),
+	}
+
+	var out bytes.Buffer
+	printStatus(&out, replies, now)
+
+	for _, want := range []string{
+		"Id:      00_11_22",
+		"Uptime:  2 days 1 hours 30 mins",
+		"Tunnel:  connected (hub.example.com)",
+		"ws:1.2.3.4:5/ws  mother,ready",
+		`"States": [`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Missing %q in:\n%s", want, out.String())
+		}
+	}
+}
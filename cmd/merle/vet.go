@@ -0,0 +1,63 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Check a model's message coverage with merlevet, the go/analysis checker
+// in github.com/merliot/merle/merlevet.  merlevet is its own module, so it's
+// run, not linked in.
+func runVet(args []string) error {
+	path, err := exec.LookPath("merlevet")
+	if err != nil {
+		return fmt.Errorf("merlevet not found; install it with\n\n\t" +
+			"go install github.com/merliot/merle/merlevet/cmd/merlevet@latest")
+	}
+
+	cmd := exec.Command(path, vetArgs(args)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 3 {
+		// merlevet exits 3 if there are problems
+		return errors.New("problems found")
+	}
+	return err
+}
+
+// Args for merlevet.  A dir, such as mything, is passed as ./mything, so
+// it's not taken as an import path.  The default is the current directory.
+func vetArgs(args []string) []string {
+	pkgs := 0
+	out := make([]string, 0, len(args)+1)
+
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			pkgs++
+			if !filepath.IsAbs(arg) && !strings.HasPrefix(arg, ".") {
+				if info, err := os.Stat(arg); err == nil && info.IsDir() {
+					arg = "./" + arg
+				}
+			}
+		}
+		out = append(out, arg)
+	}
+
+	if pkgs == 0 {
+		out = append(out, ".")
+	}
+
+	return out
+}
@@ -0,0 +1,43 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestVetArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+	os.Mkdir("mything", 0755)
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"."}},
+		{[]string{"-json"}, []string{"-json", "."}},
+		{[]string{"mything"}, []string{"./mything"}},
+		{[]string{"./mything", "github.com/x/y"},
+			[]string{"./mything", "github.com/x/y"}},
+	}
+
+	for _, test := range tests {
+		if got := vetArgs(test.args); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("vetArgs(%q) = %q, want %q", test.args, got,
+				test.want)
+		}
+	}
+}
@@ -21,7 +21,12 @@ type ThingConfig struct {
 	//
 	// [Optional] Thing's Id.  Ids are unique within an application to
 	// differentiate one Thing from another.  Id is optional; if Id is not
-	// given, a system-wide unique Id is assigned.
+	// given, an Id is made up from the hardware: the MAC address of the
+	// primary network interface (e.g. "00_16_3e_2b_4c_01") or, failing
+	// that, the machine-id.  An Id from the MAC address doesn't change
+	// across OS reinstalls, but an Id from the machine-id does, as the OS
+	// install makes a new machine-id.  Set Id to override it, e.g. for
+	// Things cloned from the same image on hardware without a MAC address.
 	Id string
 
 	// Thing's Model.  The default is "Thing".
@@ -30,6 +35,18 @@ type ThingConfig struct {
 	// Thing's Name.  The default is "Thingy".
 	Name string
 
+	// [Optional] Thing's Tags, e.g. "garage".  Mother selects config
+	// templates for Thing by Thing's Model and Tags.  See
+	// ConfigTemplates.  The default is nil (no tags).
+	Tags []string
+
+	// [Optional] Thing's software Version, e.g. "1.2.0", reported in
+	// ReplyIdentity.  Set Version at build time, e.g. with -ldflags, so
+	// mother sees which version each Thing runs after an Update, and
+	// older versions are refused.  Update.Keys need Version set.  The
+	// default is "".
+	Version string
+
 	// [Optional] system User.  If a User is given, any browser views of
 	// the Thing's UI will prompt for user/passwd.  HTTP Basic
 	// Authentication is used and the user/passwd given must match the
@@ -38,6 +55,57 @@ type ThingConfig struct {
 	// "".
 	User string
 
+	// [Optional] If AuthFile is given, users, roles, API tokens, tenants,
+	// and per-Thing access grants are kept in AuthFile, a JSON file, and
+	// managed by admins in the admin UI at /admin on the public web
+	// server.  User is then only used to bootstrap: until AuthFile has
+	// users, User is admin.  See AuthStore.  The default is "" (no admin
+	// UI; only User can log in).
+	AuthFile string
+
+	// [Optional] API token for User, until AuthFile has users.  A request
+	// with "Authorization: Bearer <BootToken>" is User, as admin, so the
+	// first users can be added without User's system password, e.g. in
+	// container mode, where there's no PAM.  Keep BootToken out of
+	// Thing's config file; pass it in the environment (see NewEnvConfig)
+	// or from a secrets file.  The default is "" (no boot token).
+	BootToken string
+
+	// [Optional] System user Thing runs as, once Thing's web servers have
+	// bound their ports.  Thing started as root, to bind ports below 1024
+	// such as 80, switches to RunAs's uid, gid, and groups before
+	// CmdRun, so the Thinger's code, and Thing's templates, don't run as
+	// root.  CmdInit and the Thinger's Setup, which may need root to open
+	// hardware, run before the switch.  Files Thing writes, and the ssh
+	// keys for the tunnel to mother, are then RunAs's.  If RunAs can't be
+	// switched to, Thing stops.
+	//
+	// Once switched, PAM can't read /etc/shadow, so PAM can only check
+	// RunAs's own password.  To log in User other than RunAs, give users
+	// in AuthFile; RunAs with only PAM to log User in is a config error.
+	// RunAs with Update is also a config error: an update re-execs Thing
+	// as RunAs, which can't bind Thing's ports, or replace Thing's binary.
+	//
+	// Root isn't needed at all if Thing's binary is given
+	// CAP_NET_BIND_SERVICE (setcap cap_net_bind_service=+ep), or if
+	// Thing is started by systemd socket activation: a socket passed by
+	// systemd is used for the port it's bound to.  An Update replaces
+	// the binary, dropping CAP_NET_BIND_SERVICE, so with Update, bind
+	// ports below 1024 with socket activation.  The default is "" (no
+	// switch).
+	RunAs string
+
+	// [Optional] Container mode, for Things in a container image without
+	// the host packages Thing otherwise uses.  There's no PAM, so User
+	// needs AuthFile, and logs in with BootToken until AuthFile has users;
+	// users then log in with API tokens, or passwords kept in AuthFile.
+	// The tunnel to mother is made in-process, not with the ssh binary
+	// (see MotherKeyFile).  Thing Prime and bridges find tunnel ports in
+	// /proc/net/tcp, not with ss.  Assets can be built into the binary
+	// (see ThingAssets.FS).  Build with -tags nopam to leave PAM out of
+	// the binary.  The default is false.
+	Container bool
+
 	// [Optional] If PortPublic is non-zero, an HTTP web server is started
 	// on port PortPublic.  PortPublic is typically set to 80.  The HTTP
 	// web server runs Thing's UI.  The default is 0.
@@ -51,12 +119,125 @@ type ThingConfig struct {
 	// The default is 0.
 	PortPublicTLS uint
 
+	// [Optional] Bind addresses for the public HTTP server, the public
+	// HTTPS server, and the private HTTP server.  A bind address is an
+	// IPv4 or IPv6 address, or a network interface name, for all addresses
+	// on the interface.  Link-local IPv6 addresses need a zone, e.g.
+	// "fe80::1%eth0".  For example, to serve the UI only on the LAN
+	// interface of a device which also has an untrusted cellular
+	// interface:
+	//
+	//	thing.Cfg.BindPublic = []string{"wlan0"}
+	//
+	// The default is nil (bind to all interfaces).
+	BindPublic    []string
+	BindPublicTLS []string
+	BindPrivate   []string
+
+	// [Optional] Networks allowed to, and denied from, the public HTTP
+	// and HTTPS servers, as CIDRs or single addresses, e.g.:
+	//
+	//	thing.Cfg.AllowPublicNets = []string{"192.168.1.0/24", "10.8.0.0/16"}
+	//	thing.Cfg.DenyPublicNets = []string{"192.168.1.13"}
+	//
+	// Requests from denied networks, or, if there are allowed networks,
+	// from networks not allowed, are refused before authentication;
+	// requests allowed still need User's, or AuthFile's, credentials.
+	// Behind a trusted proxy (see TrustProxy), the client's address is
+	// the one the proxy appended to X-Forwarded-For.  The default is nil
+	// (all networks allowed).
+	AllowPublicNets []string
+	DenyPublicNets  []string
+
+	// [Optional] TLS certificate and key files for the public HTTPS
+	// server.  If given, the HTTPS server uses the certificate rather than
+	// getting a certificate from Let's Encrypt.  The default is "" (use
+	// Let's Encrypt).
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// [Optional] Thing's public server is behind a reverse proxy, such
+	// as nginx or Caddy, terminating TLS.  The proxy's X-Forwarded-Proto,
+	// X-Forwarded-Host, and X-Forwarded-Prefix headers are trusted for
+	// the URLs in Thing's pages, such as the WebSocket's, and to check
+	// the Origin of WebSocket upgrades and admin form posts.  The
+	// browser's address is taken from the last X-Forwarded-For address,
+	// the one the proxy appended; addresses before it are as the client
+	// sent them.  Only set TrustProxy if the public server can't be
+	// reached except through the proxy, or give TrustedProxies, as
+	// clients can send these headers too.  The default is false.
+	TrustProxy bool
+
+	// [Optional] Addresses of the trusted proxies, as CIDRs or single
+	// addresses.  With TrustProxy and TrustedProxies, X-Forwarded headers
+	// are only trusted on requests from TrustedProxies, and the browser's
+	// address is the last X-Forwarded-For address that isn't one of
+	// TrustedProxies, for chains of proxies.  The default is nil (with
+	// TrustProxy, every request is taken as from the proxy).
+	TrustedProxies []string
+
+	// [Optional] Path Thing's public server is mounted under, e.g.
+	// "/things/garage", so many Things can share one domain behind a
+	// front end proxying /things/garage/ to Thing.  Thing's routes, such
+	// as /{id}, /ws/{id}, and /{id}/assets, are served under BasePath,
+	// and the URLs in Thing's pages include it.  In Thing's HTML template,
+	// BasePath is the {{.BasePath}} param, e.g.:
+	//
+	//	<script src="{{.BasePath}}/merle.js"></script>
+	//
+	// The default is "" (served at /).
+	BasePath string
+
+	// [Optional] Security headers on the public servers' responses:
+	// Strict-Transport-Security (HSTS) over HTTPS, X-Content-Type-Options,
+	// Referrer-Policy, and a Content-Security-Policy only letting Thing's
+	// pages be framed by, and load from, Thing's own server.  Sources
+	// Thing's pages need from elsewhere, such as a CDN, are declared in
+	// ThingAssets.ContentSources.  The default is true.
+	SecurityHeaders bool
+
 	// [Optional] If PortPrivate is non-zero, a private HTTP server is
 	// started on port PortPrivate.  This HTTP server does not server up
 	// the Thing's UI but rather connects to Thing's Mother using a
-	// websocket over HTTP.  The default is 0.
+	// websocket over HTTP.  If PortPrivate is zero and Thing has a
+	// mother (MotherHost or MotherHints), the private HTTP server is
+	// started on any free port, and the tunnel to mother uses that port.
+	// Use zero to run many Things on one development machine without
+	// picking ports by hand.  The default is 0.
 	PortPrivate uint
 
+	// [Optional] Serve the gRPC API on the private HTTP server, for
+	// backend services, as HTTP/2 without TLS.  See proto/merle.proto.
+	// The default is false.
+	GRPC bool
+
+	// [Optional] What to do if the public HTTP or HTTPS server fails, e.g.
+	// if the server's port is in use: FailureFatal, FailureRetry, or
+	// FailureDisable.  The default is FailureFatal (Thing.Run() returns
+	// with an error).
+	PublicFailure string
+
+	// [Optional] What to do if the private HTTP server fails.  Set to
+	// FailureRetry or FailureDisable so a conflicting private port doesn't
+	// take down the public UI.  The default is FailureFatal.
+	PrivateFailure string
+
+	// Seconds between restart attempts for FailureRetry.  The default is
+	// 10.
+	RetryInterval uint
+
+	// [Optional] Advertise Thing on the LAN with mDNS, as service
+	// _merle._tcp, with Thing's Id, Model, Name, and public ports.  Find
+	// advertised Things with Discover() or "merle discover".  Thing Prime
+	// doesn't advertise.  The default is true.
+	Advertise bool
+
+	// [Optional] Also advertise PortPrivate, so a bridge on the LAN can
+	// attach Thing directly (see BridgeDiscover).  The private port is
+	// Thing's management port; anyone on the LAN learns where it is.  The
+	// default is false.
+	AdvertisePrivate bool
+
 	// [Optional] Run as Thing-prime.  The default is false.
 	IsPrime bool
 
@@ -65,13 +246,245 @@ type ThingConfig struct {
 	// reserved port in ip_local_reserved_ports.
 	PortPrime uint
 
+	// [Optional] If StoreFile is given, Thing's state is persisted to
+	// StoreFile, a JSON file.  Thing's state is restored from StoreFile on
+	// Thing restart.  See Store for details.  The default is "" (state is
+	// not persisted).
+	StoreFile string
+
+	// [Optional] Power-on state of Thing's outputs.  See PowerOnRule.
+	// The default is nil (outputs restored from StoreFile, if any).
+	PowerOn []PowerOnRule
+
+	// [Optional] Groups of outputs that must never be on at the same
+	// time.  See Interlock.  The default is nil (no interlocks).
+	Interlocks []Interlock
+
+	// [Optional] Automation rules, evaluated on Thing's broadcasts.  See
+	// Rule.  The default is nil (no rules).
+	Rules []Rule
+
+	// [Optional] Threshold alerts on Thing's broadcasts.  See
+	// AlertConfig.  The default is nil (no alerts).
+	Alerts []AlertConfig
+
+	// [Optional] Notifications configuration.  Send Notify messages Thing
+	// broadcasts by email, SMS, and Web Push.  See NotificationsConfig.
+	// The default is no notifications.
+	Notifications NotificationsConfig
+
+	// [Optional] Limits on how long, and how often, Thing's outputs are
+	// on.  See DutyLimit.  The default is nil (no limits).
+	DutyLimits []DutyLimit
+
+	// [Optional] Runtime counters, with maintenance thresholds, for
+	// Thing's outputs.  See RuntimeCounter.  The default is nil (no
+	// counters).
+	RuntimeCounters []RuntimeCounter
+
+	// [Optional] File to save runtime counters.  The default is "" (the
+	// counters start from zero each time Thing starts).
+	RuntimeFile string
+
+	// [Optional] Digital inputs: debounced buttons, and pulse counters.
+	// See InputConfig.  The default is nil (no inputs).
+	Inputs []InputConfig
+
+	// [Optional] File to save input counters.  The default is "" (the
+	// counters start from zero each time Thing starts).
+	InputsFile string
+
+	// [Optional] Calibrations for Thing's analog inputs.  See
+	// Calibration.  The default is nil (no calibrations).
+	Calibrations []Calibration
+
+	// [Optional] File to save calibrations set with SetCalibration.  The
+	// default is "" (calibrations set at runtime are lost when Thing
+	// stops).
+	CalibrationFile string
+
+	// [Optional] Schedules of messages sent to Thing.  See Schedule.  The
+	// default is nil (no schedules).
+	Schedules []Schedule
+
+	// [Optional] File to save schedules edited with SetSchedule and
+	// DeleteSchedule.  The default is "" (edits are lost when Thing
+	// stops).
+	ScheduleFile string
+
+	// [Optional] Thing's location, in degrees, north and east positive,
+	// for sunrise and sunset Schedules.  The default is 0, 0.
+	Latitude  float64
+	Longitude float64
+
+	// [Optional] If JournalFile is given, messages broadcast by Thing are
+	// journaled to JournalFile.  Thing Prime replays the journal after
+	// reconnecting to Thing to rebuild Thing's state deterministically.
+	// The default is "" (no journal).
+	JournalFile string
+
+	// Maximum number of records kept in the journal.  The default is 1000.
+	JournalMax uint
+
+	// [Optional] If AuditFile is given, authentications and command
+	// messages, received or rejected, are appended to the audit trail in
+	// AuditFile, one JSON AuditRecord per line.  The trail is queried
+	// with GetAudit.  The default is "" (no audit trail).
+	AuditFile string
+
+	// Number of the latest audit records GetAudit can return.  AuditFile
+	// itself isn't trimmed.  The default is 1000.
+	AuditMax uint
+
+	// AuditForward sends each audit record to Thing Prime, in an
+	// EventAudit message, to keep with Thing Prime's own audit trail.
+	// The default is false.
+	AuditForward bool
+
+	// [Optional] If RegistryFile is given, Thing Prime keeps a registry of
+	// the Things it has known, or a bridge of its children, in
+	// RegistryFile: each Thing's identity, firmware Version, Notes, and
+	// when it was first and last seen.  The registry is read and edited
+	// with GetRegistry, SetRegistryNotes, and DeleteRegistry, or at
+	// /registry on the private server.  Thing.SetRegistryStore() overrides
+	// RegistryFile.  The default is "" (no registry).
+	RegistryFile string
+
+	// BroadcastPatch sends Thing's full state, rather than a patch, every
+	// PatchSnapshot patches, so listeners that missed a patch can catch
+	// up.  The default is 100.
+	PatchSnapshot uint
+
 	// MaxConnection is maximum number of inbound connections to a Thing.
 	// Inbound connections are WebSockets from web browsers or WebSockets
 	// from Thing Prime.  The default is 30.  With the default, the 31st
 	// (and higher) concurrent WebSocket connection attempt will block,
-	// waiting for one of the first 30 WebSocket sessions to terminate.
+	// waiting for one of the first 30 WebSocket sessions to terminate,
+	// unless RejectWhenFull.
 	MaxConnections uint
 
+	// [Optional] Reject WebSocket connection attempts beyond
+	// MaxConnections with HTTP 503 Service Unavailable, rather than
+	// holding them until a connection closes, so clients can back off and
+	// retry.
+	RejectWhenFull bool
+
+	// [Optional] Seconds between pings on Thing's WebSockets, inbound and
+	// to children and Things on Thing Prime's ports.  A peer quiet for a
+	// ping interval plus PongTimeout seconds, answering neither pings nor
+	// anything else, is taken as gone and its WebSocket is closed, so
+	// half-open connections don't linger.  The default is 30.  Zero is no
+	// pings.
+	PingInterval uint
+
+	// [Optional] Seconds a peer has to answer a ping.  The default is 10.
+	PongTimeout uint
+
+	// [Optional] Largest message, in bytes, Thing reads from a WebSocket.
+	// A peer sending a larger message is disconnected.  The default is
+	// 1MB.  Zero is no limit.
+	MaxMsgSize uint
+
+	// [Optional] Messages per second a client may send Thing on a
+	// WebSocket, on average, with bursts up to a second's worth.  A client
+	// sending faster is disconnected, so it can't swamp Thing's bus.
+	// Mother, and Things on Thing Prime's ports, aren't limited, as they
+	// catch up in bursts.  The default is 50.  Zero is no limit.
+	MaxMsgRate uint
+
+	// [Optional] Seconds Thing remembers the IdempotencyKey of a command
+	// message.  A sender retrying a command, e.g. across a flaky tunnel,
+	// sets the same IdempotencyKey member on each try:
+	//
+	//	{"Msg":"Click","Relay":1,"State":true,"IdempotencyKey":"f3a9c2"}
+	//
+	// Thing applies the first, drops the rest within the window, and
+	// replies Ack to each.  The default is 60.  Zero is no deduplication.
+	DedupWindow uint
+
+	// [Optional] Number the messages on the link between Thing and
+	// mother, each way, with a LinkSeq member.  The numbers carry on across
+	// reconnects, so messages lost while the tunnel flaps show up as a
+	// gap, and the side seeing the gap resyncs mother with Thing's state.
+	// Both sides strip the member from messages received.  The default is
+	// true.
+	LinkSeq bool
+
+	// [Optional] Seconds between Heartbeat messages broadcast by Thing,
+	// with Thing's uptime, memory, goroutines, and tunnel status.  Once
+	// Thing Prime, or a bridge, hears a Heartbeat, it takes Thing as
+	// offline if three in a row are missed.  The default is 0 (no
+	// Heartbeats).
+	Heartbeat uint
+
+	// [Optional] History configuration.  Record broadcast messages in a
+	// SQLite database, for UIs to plot time-series without an external
+	// database.  See HistoryConfig.  The default is no history.
+	History HistoryConfig
+
+	// [Optional] Access log configuration.  Log requests to Thing's web
+	// servers, including WebSockets and how long they were open.  See
+	// AccessLogConfig.  The default is no access log.
+	AccessLog AccessLogConfig
+
+	// [Optional] End-to-end sealing configuration.  Seal messages, such
+	// as relay commands, between Thing and its users so Thing Prime can
+	// route them but not read or forge them.  See E2EConfig.  The
+	// default is no sealing.
+	E2E E2EConfig
+
+	// [Optional] Archive configuration.  Archive broadcast messages to
+	// S3-compatible object storage.  On Thing Prime, archiving keeps a
+	// long-term record of a fleet of Things.  See ArchiveConfig.  The
+	// default is no archiving.
+	Archive ArchiveConfig
+
+	// [Optional] InfluxDB configuration.  Write broadcast messages as
+	// time-series points to InfluxDB, or any line-protocol endpoint.  See
+	// InfluxConfig.  The default is no writing.
+	Influx InfluxConfig
+
+	// [Optional] Webhooks to POST broadcast messages to.  See
+	// WebhookConfig.  The default is nil (no webhooks).
+	Webhooks []WebhookConfig
+
+	// [Optional] Key webhooks POSTed to Thing, on /{id}/webhook/{msg},
+	// are signed with: the body's HMAC-SHA256, in header:
+	//
+	//	X-Merle-Signature: sha256=<hex digest>
+	//
+	// Webhooks are authenticated by signature, not by User.  The default
+	// is "" (webhooks to Thing are refused).
+	WebhookSecret string
+
+	// [Optional] AWS IoT device shadow configuration.  Mirror Thing's
+	// state into a device shadow, and send desired-state deltas back to
+	// Thing, for a managed cloud alongside, or instead of, Thing Prime.
+	// See ShadowConfig.  The default is no shadow.
+	Shadow ShadowConfig
+
+	// [Optional] LoRaWAN configuration.  Send broadcast messages as
+	// compact LoRaWAN uplinks, and receive downlinks as messages, for
+	// Things that can't hold a WebSocket open.  See LoRaConfig.  The
+	// default is no LoRa.
+	LoRa LoRaConfig
+
+	// [Optional] CAN bus configuration.  Map frames on a SocketCAN
+	// interface to messages, and back.  See CANConfig.  The default is no
+	// CAN bus.
+	CAN CANConfig
+
+	// [Optional] NATS configuration.  Thing and Thing Prime talk through a
+	// NATS server, on subjects derived from Thing's model and Id, instead
+	// of over the SSH tunnel.  Set on both Thing and Thing Prime.  See
+	// NATSConfig.  The default is no NATS.
+	NATS NATSConfig
+
+	// [Optional] LAN configuration.  Share presence, and messages, with
+	// sibling Things on the LAN over UDP multicast.  See LANConfig.  The
+	// default is no LAN sharing.
+	LAN LANConfig
+
 	// ########## Mother configuration.
 	//
 	// This section describes a Thing's mother.  Every Thing has a mother.  A
@@ -90,6 +503,112 @@ type ThingConfig struct {
 	// Port on Host for Mother's private HTTP server
 	MotherPortPrivate uint
 
+	// [Optional] In container mode, the private key file for SSH access
+	// to mother, e.g. "/run/secrets/mother_key".  The default is ""
+	// (~/.ssh/id_ed25519, id_ecdsa, or id_rsa, and any ssh-agent on
+	// SSH_AUTH_SOCK).
+	MotherKeyFile string
+
+	// [Optional] In container mode, the known_hosts file with mother's
+	// host key.  Mother's host key must be known.  The default is ""
+	// (~/.ssh/known_hosts).
+	MotherKnownHosts string
+
+	// [Optional] MotherHostStandby is the host of a standby Thing Prime,
+	// with the same MotherUser and MotherPortPrivate as MotherHost.  Thing
+	// keeps a tunnel to each, so either Thing Prime can reach Thing.  Thing
+	// elects one Thing Prime active; the standby has Thing's state, but
+	// can't change Thing, until the active Thing Prime's connection drops
+	// and the standby takes over.  The default is "" (no standby).
+	MotherHostStandby string
+
+	// [Optional] MotherHints is an ordered list of alternate mother
+	// endpoints.  If Thing is mother (Thing Prime or bridge), the hints
+	// are sent to each child on connect.  The child tries the hints, in
+	// order, if the tunnel to the child's mother can't be created.  This
+	// way, a fleet of Things can be re-homed from mother without touching
+	// each Thing's configuration.  The default is nil (no hints).
+	MotherHints []MotherHint
+
+	// [Optional] File to save mother hints received from mother.  Saved
+	// hints are restored on Thing restart.  The default is "" (hints are
+	// not saved).
+	MotherHintsFile string
+
+	// [Optional] Claim configuration, for a factory-fresh Thing.  The
+	// Thing waits to be claimed on Prime, and is then given its Id, Name,
+	// Tags, mother, and BootToken, overriding those given here.  See
+	// ClaimConfig.  The default is no claiming.
+	Claim ClaimConfig
+
+	// [Optional] Provisioning configuration.  If Thing is mother (Thing
+	// Prime or bridge), admins claim factory-fresh Things, which are then
+	// given their Id and mother (see Claim).  See ProvisionConfig.  The
+	// default is no provisioning.
+	Provision ProvisionConfig
+
+	// [Optional] ConfigTemplates are config templates for a fleet of
+	// Things.  If Thing is mother (Thing Prime or bridge), the templates
+	// matching a child's Model and Tags are merged, in order, and sent to
+	// the child on connect.  List general templates (by Model) before
+	// specific ones (by Tag), so the specific ones win.  The child layers
+	// the template under its own config: a config item set in the
+	// child's code or Configurators overrides the template.  Only items a
+	// fleet shares can be templated: PortPublic, PortPublicTLS,
+	// PublicFailure, PrivateFailure, RetryInterval, Advertise, Alerts,
+	// Schedules, Latitude, Longitude, JournalMax, AuditMax,
+	// PatchSnapshot, MaxConnections, RejectWhenFull, PingInterval,
+	// PongTimeout, MaxMsgSize, MaxMsgRate, DedupWindow, Heartbeat,
+	// History.Msgs, History.Retention, OutboxMax, and LoggingEnabled.
+	// Other items, such as identity, users, auth, keys, and files, are
+	// dropped from templates.
+	//
+	// The child reports where its config drifts from its template.  Items
+	// which aren't reloadable (see Thing.Reload()) drift until the child
+	// restarts with the template saved in TemplateFile.  See
+	// Thing.ConfigDrift().  The default is nil (no templates).
+	ConfigTemplates []ConfigTemplate
+
+	// [Optional] File to save the config template received from mother.
+	// A saved template is layered under Thing's config on Thing restart,
+	// so config items which aren't reloadable take effect.  The default
+	// is "" (template is not saved).
+	TemplateFile string
+
+	// [Optional] Redact rules applied to messages before they leave Thing,
+	// for mother or for a cloud service.  Use redaction for deployments
+	// with privacy constraints on what reaches the cloud.  See RedactRule.
+	// The default is nil (no redaction).
+	Redact []RedactRule
+
+	// [Optional] Key for RedactHash.  Without a key, low-entropy values
+	// such as MAC addresses can be recovered from the hash by brute force.
+	// The default is "".
+	RedactKey string
+
+	// [Optional] If OutboxFile is given, messages broadcast while mother
+	// is not connected are queued in an outbox, saved in OutboxFile.  On
+	// reconnect, the queued messages are replayed, in order, to mother,
+	// and dropped once mother acks the resync.  The outbox survives a
+	// Thing restart.  The default is "" (no outbox).
+	OutboxFile string
+
+	// Maximum number of messages held in the outbox.  If the outbox is
+	// full, the oldest message is dropped to make room.  The default is
+	// 100.
+	OutboxMax uint
+
+	// [Optional] Power-fail input, a file read for power failure, such as
+	// a GPIO value (e.g. "/sys/class/gpio/gpio17/value") wired to a UPS
+	// power-good signal.  When the input reads PowerFailValue, Thing sends
+	// its last gasp to mother and stops.  See Thing.PowerLost().  The
+	// default is "" (no power-fail input).
+	PowerFailInput string
+
+	// Value read from PowerFailInput on power failure, with surrounding
+	// whitespace trimmed.  The default is "0".
+	PowerFailValue string
+
 	// ########## Bridge configuration.
 	//
 	// A Thing implementing the Bridger interface will use this config for
@@ -116,25 +635,224 @@ type ThingConfig struct {
 	// Ending bridge port number
 	BridgePortEnd uint
 
+	// [Optional] If BridgeDiscover is non-zero, the bridge looks for
+	// Things on the LAN, with mDNS, every BridgeDiscover seconds, and
+	// attaches Things matching BridgeThingers directly, over the Thing's
+	// private HTTP server, without an SSH tunnel.  The Things need a
+	// PortPrivate and AdvertisePrivate, and don't need a MotherHost.  Use
+	// on a trusted LAN only: anyone on the LAN can advertise a matching
+	// Thing.  The default is 0 (no discovery).
+	BridgeDiscover uint
+
+	// [Optional] Ids of Things blocked from attaching to the bridge.
+	// More Ids can be blocked, or unblocked, while the bridge runs, with
+	// BlockChild and UnblockChild messages.  The default is nil.
+	BridgeBlock []string
+
+	// [Optional] File to save the bridge's child Id to port assignments.
+	// Saved assignments are restored on bridge restart, so each child
+	// gets its old port back.  The default is "" (assignments are not
+	// saved).
+	BridgePortsFile string
+
+	// [Optional] Maximum number of children attached to the bridge at
+	// once.  Extra children are turned away until a child detaches.  The
+	// default is 0 (no limit).
+	MaxChildren uint
+
+	// [Optional] Limits on the number of children attached at once, per
+	// pattern.  See BridgeLimit.  The default is nil (no limits).
+	BridgeLimits []BridgeLimit
+
+	// [Optional] Groups of children.  See BridgeGroup.  More children can
+	// be grouped while the bridge runs with GroupChild messages.  The
+	// default is nil (no groups).
+	BridgeGroups []BridgeGroup
+
+	// [Optional] Bundle configuration.  A bridge fetches signed UI
+	// bundles for child models it has no Go code for.  See BundleConfig.
+	// The default is no bundles.
+	Bundles BundleConfig
+
+	// [Optional] File to record hardware-originated messages to, with
+	// timing, for replay in demo mode.  The file is overwritten each time
+	// Thing starts.  The default is "" (no recording).
+	RecordFile string
+
+	// [Optional] File of messages, recorded with RecordFile, to replay in
+	// a loop, for demos and UI tests without hardware.  Subscribe to the
+	// recorded messages to update Thing's state, as on Thing Prime.  The
+	// default is "" (no replay).
+	ReplayFile string
+
+	// [Optional] Allow faults to be injected with InjectFault messages,
+	// for testing in demo mode.  See Fault.  Never set FaultInjection on
+	// Things in production.  The default is false.
+	FaultInjection bool
+
+	// [Optional] Chaos injected on Thing's links with mother, or with
+	// Thing or children on Thing Prime or a bridge, for testing.  See
+	// ChaosConfig.  The default is no chaos.
+	Chaos ChaosConfig
+
+	// [Optional] Over-the-air update configuration.  See UpdateConfig.
+	// The default is no updates.
+	Update UpdateConfig
+
 	// Logging enable
 	LoggingEnabled bool
 }
 
+// A Configurator is a source of Thing configuration, such as the environment
+// or a config file.  Configurators are layered under the programmatic Cfg: a
+// Cfg item set in code wins over the same item from a Configurator.  See
+// Thing.AddConfig().
+type Configurator interface {
+	// Parse configuration items from the source into cfg.  Items not in
+	// the source are left unchanged.
+	Parse(cfg *ThingConfig) error
+}
+
 var defaultCfg = ThingConfig{
 	Id:                "",
 	Model:             "Thing",
 	Name:              "Thingy",
+	Tags:              nil,
+	Version:           "",
 	User:              "",
+	AuthFile:          "",
+	BootToken:         "",
+	RunAs:             "",
+	Container:         false,
 	PortPublic:        0,
 	PortPublicTLS:     0,
+	BindPublic:        nil,
+	BindPublicTLS:     nil,
+	BindPrivate:       nil,
+	AllowPublicNets:   nil,
+	DenyPublicNets:    nil,
+	TLSCertFile:       "",
+	TLSKeyFile:        "",
+	TrustProxy:        false,
+	TrustedProxies:    nil,
+	BasePath:          "",
+	SecurityHeaders:   true,
 	PortPrivate:       0,
+	GRPC:              false,
+	PublicFailure:     FailureFatal,
+	PrivateFailure:    FailureFatal,
+	RetryInterval:     10,
+	Advertise:         true,
+	AdvertisePrivate:  false,
 	IsPrime:           false,
 	PortPrime:         8000,
+	StoreFile:         "",
+	PowerOn:           nil,
+	Interlocks:        nil,
+	DutyLimits:        nil,
+	JournalFile:       "",
+	JournalMax:        1000,
+	AuditFile:         "",
+	AuditMax:          1000,
+	AuditForward:      false,
+	RegistryFile:      "",
+	PatchSnapshot:     100,
 	MaxConnections:    30,
+	RejectWhenFull:    false,
+	PingInterval:      30,
+	PongTimeout:       10,
+	MaxMsgSize:        1 << 20,
+	MaxMsgRate:        50,
+	DedupWindow:       60,
+	LinkSeq:           true,
+	Heartbeat:         0,
 	MotherHost:        "",
 	MotherUser:        "",
 	MotherPortPrivate: 8080,
+	MotherKeyFile:     "",
+	MotherKnownHosts:  "",
+	MotherHostStandby: "",
+	MotherHints:       nil,
+	MotherHintsFile:   "",
+	ConfigTemplates:   nil,
+	TemplateFile:      "",
+	Redact:            nil,
+	RedactKey:         "",
+	OutboxFile:        "",
+	OutboxMax:         100,
+	RuntimeCounters:   nil,
+	RuntimeFile:       "",
+	Inputs:            nil,
+	InputsFile:        "",
+	Calibrations:      nil,
+	CalibrationFile:   "",
+	Schedules:         nil,
+	ScheduleFile:      "",
+	Latitude:          0,
+	Longitude:         0,
+	RecordFile:        "",
+	ReplayFile:        "",
+	FaultInjection:    false,
+	PowerFailInput:    "",
+	PowerFailValue:    "0",
 	BridgePortBegin:   8000,
 	BridgePortEnd:     8040,
+	BridgeDiscover:    0,
+	BridgeBlock:       nil,
+	BridgePortsFile:   "",
+	MaxChildren:       0,
+	BridgeLimits:      nil,
+	BridgeGroups:      nil,
 	LoggingEnabled:    true,
+	History: HistoryConfig{
+		Retention: 604800,
+	},
+	E2E: E2EConfig{
+		Window: 60,
+	},
+	AccessLog: AccessLogConfig{
+		Format: AccessLogCommon,
+	},
+	Bundles: BundleConfig{
+		Dir: "bundles",
+	},
+	Archive: ArchiveConfig{
+		Region:    "us-east-1",
+		Prefix:    "merle/",
+		BatchSize: 1000,
+		MaxAge:    3600,
+	},
+	Influx: InfluxConfig{
+		BatchSize: 100,
+		MaxAge:    10,
+	},
+	Webhooks:      nil,
+	WebhookSecret: "",
+	Rules:         nil,
+	Alerts:        nil,
+	Notifications: NotificationsConfig{
+		MinSeverity: SeverityInfo,
+		RateLimit:   20,
+	},
+	Shadow: ShadowConfig{
+		DeltaMsg: "ShadowDelta",
+		Interval: 10,
+	},
+	LoRa: LoRaConfig{
+		Baud:     115200,
+		FPort:    1,
+		MaxSize:  51,
+		Interval: 60,
+	},
+	CAN: CANConfig{},
+	NATS: NATSConfig{
+		Prefix: "merle",
+	},
+	LAN: LANConfig{
+		Beacon: 10,
+	},
+	Claim:     ClaimConfig{},
+	Provision: ProvisionConfig{},
+	Chaos:     ChaosConfig{},
+	Update:    UpdateConfig{},
 }
@@ -0,0 +1,69 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+)
+
+type envConfig struct {
+	prefix string
+}
+
+// NewEnvConfig returns a Configurator which reads Thing configuration from
+// environment variables.  The variable name is the prefix followed by the
+// Cfg item name in upper snake case.  Items in nested configs are prefixed
+// with the nested config name.  For example, with prefix "MERLE_":
+//
+//	MERLE_MODEL=thermo
+//	MERLE_NAME=garage
+//	MERLE_PORT_PUBLIC=80
+//	MERLE_MOTHER_HOST=example.com
+//	MERLE_HISTORY_FILE=/var/lib/merle/history.db
+//	MERLE_ARCHIVE_MSGS=Update,Alarm
+//
+// List items such as MERLE_ARCHIVE_MSGS are comma-separated.  Lists of
+// structs, such as MERLE_MOTHER_HINTS, are JSON arrays.
+//
+// Use NewEnvConfig for container deployments, to configure a Thing without
+// flags or config files baked into the image.
+func NewEnvConfig(prefix string) Configurator {
+	return &envConfig{prefix: prefix}
+}
+
+func (e *envConfig) Parse(cfg *ThingConfig) error {
+	return e.parse(reflect.ValueOf(cfg).Elem(), e.prefix)
+}
+
+func (e *envConfig) parse(v reflect.Value, prefix string) error {
+	typ := v.Type()
+
+	for i := 0; i < v.NumField(); i++ {
+		name := prefix + snakeCase(typ.Field(i).Name)
+		f := v.Field(i)
+
+		if f.Kind() == reflect.Struct {
+			if err := e.parse(f, name+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(f, s); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEnvConfig(t *testing.T) {
+	env := map[string]string{
+		"TEST_MODEL":           "thermo",
+		"TEST_NAME":            "garage",
+		"TEST_PORT_PUBLIC":     "8080",
+		"TEST_PORT_PUBLIC_TLS": "443",
+		"TEST_HISTORY_MSGS":    "Update, Alarm",
+		"TEST_MOTHER_HINTS":    `[{"Host":"backup"}]`,
+		"TEST_LATITUDE":        "45.5",
+		"TEST_LONGITUDE":       "-122.25",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	thing := NewThing(&sparse{})
+	thing.AddConfig(NewEnvConfig("TEST_"))
+
+	// Set in code, so wins over environment
+	thing.Cfg.Name = "attic"
+
+	if err := thing.configure(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &thing.Cfg
+	if cfg.Model != "thermo" || cfg.Name != "attic" ||
+		cfg.PortPublic != 8080 || cfg.PortPublicTLS != 443 {
+		t.Errorf("Bad config: %+v", cfg)
+	}
+	if len(cfg.History.Msgs) != 2 || cfg.History.Msgs[1] != "Alarm" {
+		t.Errorf("Bad History.Msgs: %v", cfg.History.Msgs)
+	}
+	if cfg.Latitude != 45.5 || cfg.Longitude != -122.25 {
+		t.Errorf("Bad location: %v, %v", cfg.Latitude, cfg.Longitude)
+	}
+	if len(cfg.MotherHints) != 1 || cfg.MotherHints[0].Host != "backup" {
+		t.Errorf("Bad MotherHints: %v", cfg.MotherHints)
+	}
+
+	os.Setenv("TEST_PORT_PRIVATE", "eighty")
+	defer os.Unsetenv("TEST_PORT_PRIVATE")
+	bad := NewThing(&sparse{})
+	bad.AddConfig(NewEnvConfig("TEST_"))
+	if err := bad.configure(); err == nil {
+		t.Errorf("Bad port accepted")
+	}
+}
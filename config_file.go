@@ -0,0 +1,113 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type fileConfig struct {
+	file   string
+	format string
+}
+
+// NewJSONConfig returns a Configurator which reads Thing configuration from a
+// JSON file.  Keys are Cfg item names, matched without regard to case.
+// Nested configs are objects.  Items not in the file keep their defaults.
+//
+//	{
+//		"Model": "thermo",
+//		"Name": "garage",
+//		"PortPublic": 80,
+//		"History": {
+//			"File": "/var/lib/merle/history.db"
+//		}
+//	}
+func NewJSONConfig(file string) Configurator {
+	return &fileConfig{file: file, format: "json"}
+}
+
+// NewTomlConfig returns a Configurator which reads Thing configuration from a
+// TOML file.  Keys are as in NewJSONConfig.  Nested configs are tables.
+//
+//	Model = "thermo"
+//	Name = "garage"
+//	PortPublic = 80
+//
+//	[History]
+//	File = "/var/lib/merle/history.db"
+func NewTomlConfig(file string) Configurator {
+	return &fileConfig{file: file, format: "toml"}
+}
+
+// NewYamlConfig returns a Configurator which reads Thing configuration from a
+// YAML file.  Keys are as in NewJSONConfig.  Nested configs are mappings.
+//
+//	Model: thermo
+//	Name: garage
+//	PortPublic: 80
+//	History:
+//	  File: /var/lib/merle/history.db
+func NewYamlConfig(file string) Configurator {
+	return &fileConfig{file: file, format: "yaml"}
+}
+
+// NewFileConfig returns a Configurator which reads Thing configuration from a
+// JSON, TOML, or YAML file.  The format is picked by the file extension:
+// ".json", ".toml", or ".yaml"/".yml".
+func NewFileConfig(file string) Configurator {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+	if format == "yml" {
+		format = "yaml"
+	}
+	return &fileConfig{file: file, format: format}
+}
+
+func (f *fileConfig) Parse(cfg *ThingConfig) error {
+	data, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		return err
+	}
+
+	// TOML and YAML are decoded generically and re-coded as JSON, so all
+	// formats match keys to Cfg items the same way
+
+	var m map[string]interface{}
+
+	switch f.format {
+	case "json":
+	case "toml":
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("%s: %s", f.file, err)
+		}
+		data, err = json.Marshal(m)
+	case "yaml":
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("%s: %s", f.file, err)
+		}
+		data, err = json.Marshal(m)
+	default:
+		return fmt.Errorf("%s: unknown config format \"%s\"", f.file, f.format)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", f.file, err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("%s: %s", f.file, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"thing.json": `{"Model": "thermo", "PortPublic": 80, "History": {"File": "h.db"}}`,
+		"thing.toml": "Model = \"thermo\"\nPortPublic = 80\n[History]\nFile = \"h.db\"\n",
+		"thing.yml":  "Model: thermo\nPortPublic: 80\nHistory:\n  File: h.db\n",
+	}
+
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := defaultCfg
+		if err := NewFileConfig(file).Parse(&cfg); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if cfg.Model != "thermo" || cfg.PortPublic != 80 ||
+			cfg.History.File != "h.db" || cfg.Name != defaultCfg.Name {
+			t.Errorf("%s: bad config: %+v", name, cfg)
+		}
+	}
+}
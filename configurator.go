@@ -0,0 +1,154 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Parse Thing's Configurators and layer the result under Cfg.  A Cfg item
+// still at its default value is taken from the Configurators.
+func (t *Thing) configure() error {
+	// Keep Cfg as set in code, to layer again on reload
+	t.codeCfg = t.Cfg
+
+	cfg, err := t.layeredCfg()
+	if err != nil {
+		return err
+	}
+
+	// Layer again with the config template saved from mother
+	if cfg.TemplateFile != "" {
+		if err := t.template.load(cfg.TemplateFile); err != nil {
+			return fmt.Errorf("Loading config template: %s", err)
+		}
+		if cfg, err = t.layeredCfg(); err != nil {
+			return err
+		}
+	}
+
+	// Cfg may already be read, through config(), while Run starts
+	t.cfgLock.Lock()
+	t.Cfg = cfg
+	t.cfgLock.Unlock()
+
+	return nil
+}
+
+// Return Cfg set in code, layered over Thing's Configurators, layered over
+// Thing's config template from mother
+func (t *Thing) layeredCfg() (ThingConfig, error) {
+	cfg := t.codeCfg
+	tmpl := t.template.get()
+
+	if len(t.configs) == 0 && tmpl == nil {
+		return cfg, nil
+	}
+
+	layered := defaultCfg
+	if tmpl != nil {
+		if err := applyTemplate(&layered, tmpl.Config); err != nil {
+			return cfg, fmt.Errorf("Applying config template: %s", err)
+		}
+	}
+	for _, c := range t.configs {
+		if err := c.Parse(&layered); err != nil {
+			return cfg, fmt.Errorf("Parsing config: %s", err)
+		}
+	}
+
+	layer(reflect.ValueOf(&cfg).Elem(), reflect.ValueOf(&layered).Elem(),
+		reflect.ValueOf(&defaultCfg).Elem())
+
+	return cfg, nil
+}
+
+// Copy fields from under into cfg, where cfg's field is still the default
+func layer(cfg, under, def reflect.Value) {
+	for i := 0; i < cfg.NumField(); i++ {
+		f := cfg.Field(i)
+		if f.Kind() == reflect.Struct {
+			layer(f, under.Field(i), def.Field(i))
+			continue
+		}
+		if reflect.DeepEqual(f.Interface(), def.Field(i).Interface()) {
+			f.Set(under.Field(i))
+		}
+	}
+}
+
+// Set config field from string s.  Slices of strings are comma-separated.
+// Other slices are JSON arrays.
+func setField(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(u)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(x)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() == reflect.String {
+			var ss []string
+			for _, e := range strings.Split(s, ",") {
+				if e = strings.TrimSpace(e); e != "" {
+					ss = append(ss, e)
+				}
+			}
+			f.Set(reflect.ValueOf(ss))
+			return nil
+		}
+		return json.Unmarshal([]byte(s), f.Addr().Interface())
+	default:
+		return fmt.Errorf("Unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// Convert config field name to upper snake case, e.g. PortPublicTLS to
+// PORT_PUBLIC_TLS
+func snakeCase(name string) string {
+	var b strings.Builder
+
+	r := []rune(name)
+	for i := range r {
+		if i > 0 && unicode.IsUpper(r[i]) &&
+			(unicode.IsLower(r[i-1]) ||
+				(i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r[i]))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,160 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestProcListeningPorts(t *testing.T) {
+	table := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F91 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0 100 0 0 10 0
+   1: 0100007F:1F92 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 2 1 0 20 4 30 10 -1
+   2: 00000000:1F93 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3 1 0 100 0 0 10 0
+   3: 0100007F:1F94 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 4 1 0 100 0 0 10 0
+   4: 0100007F:2382 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 5 1 0 100 0 0 10 0
+`
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tcp")
+	if err := ioutil.WriteFile(file, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 8081 and 8084 listen on loopback; 8082 is connected, not
+	// listening; 8083 listens on every address; 9090 is out of range
+	listeners, err := procListeningPorts(file, 8081, 9080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 || !listeners[8081] || !listeners[8084] {
+		t.Errorf("Listeners %v", listeners)
+	}
+
+	if _, err := procListeningPorts(filepath.Join(dir, "none"), 8081, 9080); err == nil {
+		t.Error("Missing table read")
+	}
+}
+
+type embedded struct {
+	dashboard
+}
+
+func (e *embedded) Assets() *ThingAssets {
+	return &ThingAssets{
+		FS: fstest.MapFS{
+			"web/templates/thing.html": {Data: []byte(`{{.Id}} {{celsius .Temp}}`)},
+			"web/js/thing.js":          {Data: []byte("js")},
+		},
+		AssetsDir:    "web",
+		HtmlTemplate: "templates/thing.html",
+	}
+}
+
+func TestAssetsFS(t *testing.T) {
+	thing := NewThing(&embedded{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		thing.web.public.mux.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/" + testId, http.StatusOK, testId + " 100.0C"},
+		{"/" + testId + "/assets/js/thing.js", http.StatusOK, "js"},
+		{"/" + testId + "/assets/js/missing.js", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		code, body := get(test.path)
+		if code != test.code || (test.body != "" && body != test.body) {
+			t.Errorf("GET %s: %d %q, want %d %q", test.path, code, body,
+				test.code, test.body)
+		}
+	}
+}
+
+func TestContainer(t *testing.T) {
+	thing := NewThing(&toggler{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Container = true
+	thing.Cfg.User = "admin"
+	if err := thing.build(false); ErrorCode(err) != ErrBadConfig.Code {
+		t.Errorf("User without AuthFile: %v", err)
+	}
+
+	// No PAM
+	w := &webPublic{thing: thing}
+	if ok, err := w.pamValidate("admin", "secret"); ok || err != errNoPAM {
+		t.Errorf("PAM validated: %v %v", ok, err)
+	}
+
+	// Boot user logs in with the boot token, until there are users
+	thing.Cfg.BootToken = "boot"
+	a := newAuth(thing, &memAuthStore{})
+	a.load()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer boot")
+	if u := a.authenticate(r, "admin", w.pamValidate); u == nil ||
+		u.Name != "admin" || u.Role != RoleAdmin {
+		t.Errorf("Got %+v, want boot admin", u)
+	}
+	r.Header.Set("Authorization", "Bearer nope")
+	if u := a.authenticate(r, "admin", w.pamValidate); u != nil {
+		t.Errorf("Got %+v with bad boot token", u)
+	}
+	a.update(func(data *AuthData) error {
+		data.Users = []AuthUser{{Name: "root", Role: RoleAdmin}}
+		return nil
+	})
+	r.Header.Set("Authorization", "Bearer boot")
+	if u := a.authenticate(r, "admin", w.pamValidate); u != nil {
+		t.Errorf("Got %+v with boot token, once there are users", u)
+	}
+
+	// Mother's host key must be known
+	dir, err := ioutil.TempDir("", "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	thing.Cfg.MotherKnownHosts = filepath.Join(dir, "known_hosts")
+	tun := newTunnel(thing, "mother", "merle", 8080, 8000, "")
+	_, err = tun.sshDial(MotherHint{Host: "mother", User: "merle"})
+	if ErrorCode(err) != ErrTunnel.Code {
+		t.Errorf("Dialed with no known_hosts: %v", err)
+	}
+
+	// Nor any key
+	ioutil.WriteFile(thing.Cfg.MotherKnownHosts, nil, 0600)
+	thing.Cfg.MotherKeyFile = filepath.Join(dir, "id_ed25519")
+	_, err = tun.sshDial(MotherHint{Host: "mother", User: "merle"})
+	if ErrorCode(err) != ErrTunnelAuth.Code {
+		t.Errorf("Dialed with no key: %v", err)
+	}
+}
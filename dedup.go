@@ -0,0 +1,141 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deduplication of command messages by IdempotencyKey, on Thing's bus (see
+// Cfg.DedupWindow).  Thing applies the first command with a key and drops
+// repeats within the window, replying Ack to each.  Thing Prime doesn't
+// dedup; it passes keyed commands on to Thing, and routes Thing's Acks back
+// to the commands' senders.
+
+// Most keys held, whatever the window
+const dedupMax = 10000
+
+// Members of a keyed command, or Ack
+type msgKeyed struct {
+	Msg            string
+	IdempotencyKey string
+}
+
+type dedupKey struct {
+	key  string
+	seen time.Time
+}
+
+type dedup struct {
+	thing  *Thing
+	window time.Duration
+	sync.Mutex
+	// Keys seen, oldest first
+	keys []dedupKey
+	seen map[string]bool
+	// On Thing Prime, the sender of each keyed command
+	senders map[string]socketer
+}
+
+func newDedup(thing *Thing, window uint) *dedup {
+	return &dedup{
+		thing:   thing,
+		window:  time.Duration(window) * time.Second,
+		seen:    make(map[string]bool),
+		senders: make(map[string]socketer),
+	}
+}
+
+// Forget keys older than the window.  Call with lock held.
+func (d *dedup) prune(now time.Time) {
+	for len(d.keys) > 0 && (len(d.keys) > dedupMax ||
+		now.Sub(d.keys[0].seen) > d.window) {
+		delete(d.seen, d.keys[0].key)
+		delete(d.senders, d.keys[0].key)
+		d.keys = d.keys[1:]
+	}
+}
+
+// Note key.  Returns true if key was already seen.  Call with lock held.
+func (d *dedup) note(key string) bool {
+	now := time.Now()
+	d.prune(now)
+	if d.seen[key] {
+		return true
+	}
+	d.seen[key] = true
+	d.keys = append(d.keys, dedupKey{key: key, seen: now})
+	return false
+}
+
+// Check the packet received.  Returns the key of a command to apply and Ack
+// once applied, if any, and false if the packet is dropped.
+func (d *dedup) check(p *Packet) (string, bool) {
+	var msg msgKeyed
+	p.Unmarshal(&msg)
+
+	key := msg.IdempotencyKey
+	if key == "" || p.src == nil {
+		return "", true
+	}
+
+	if d.thing.isPrime {
+		return "", d.relay(p, &msg)
+	}
+
+	if msg.Msg == Ack || strings.HasPrefix(msg.Msg, "_") {
+		return "", true
+	}
+
+	d.Lock()
+	dup := d.note(key)
+	d.Unlock()
+
+	if dup {
+		d.thing.log.printf("Dropping duplicate [%s]: %.80s", p.Src(),
+			p.String())
+		d.ack(p, key, true)
+		return "", false
+	}
+
+	return key, true
+}
+
+// On Thing Prime, note the sender of a keyed command, and pass Thing's Ack
+// back to the sender.  Returns false if the packet is done with.
+func (d *dedup) relay(p *Packet, msg *msgKeyed) bool {
+	key := msg.IdempotencyKey
+	fromThing := p.src == d.thing.primeSock
+
+	d.Lock()
+	defer d.Unlock()
+
+	if msg.Msg == Ack {
+		if !fromThing {
+			return false
+		}
+		sender, ok := d.senders[key]
+		delete(d.senders, key)
+		if ok {
+			sender.Send(p)
+		}
+		return false
+	}
+
+	if !fromThing && !strings.HasPrefix(msg.Msg, "_") {
+		d.note(key)
+		d.senders[key] = p.src
+	}
+
+	return true
+}
+
+// Ack the command in p
+func (d *dedup) ack(p *Packet, key string, duplicate bool) {
+	msg := MsgAck{Msg: Ack, IdempotencyKey: key, Duplicate: duplicate}
+	newPacket(p.bus, p.src, &msg).Reply()
+}
@@ -0,0 +1,116 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"testing"
+	"time"
+)
+
+// Relay toggled by each Toggle applied
+type toggler struct {
+	toggles int
+}
+
+func (t *toggler) Subscribers() Subscribers {
+	return Subscribers{
+		"Toggle":  func(p *Packet) { t.toggles++ },
+		"Ignored": nil,
+		"Forward": Broadcast,
+	}
+}
+
+func (t *toggler) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestDedup(t *testing.T) {
+	relay := &toggler{}
+	thing := NewThing(relay)
+	thing.Cfg.Id = testId
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := &recordSocket{}
+	send := func(msg string) {
+		thing.bus.receive(&Packet{bus: thing.bus, src: sock, msg: []byte(msg)})
+	}
+
+	// A retry is dropped, and both are acked
+	send(`{"Msg":"Toggle","IdempotencyKey":"k1"}`)
+	send(`{"Msg":"Toggle","IdempotencyKey":"k1"}`)
+	send(`{"Msg":"Toggle","IdempotencyKey":"k2"}`)
+	if relay.toggles != 2 {
+		t.Errorf("Toggled %d times, want 2", relay.toggles)
+	}
+	want := []string{
+		`{"Msg":"_Ack","IdempotencyKey":"k1","Duplicate":false}`,
+		`{"Msg":"_Ack","IdempotencyKey":"k1","Duplicate":true}`,
+		`{"Msg":"_Ack","IdempotencyKey":"k2","Duplicate":false}`,
+	}
+	if len(sock.sent) != len(want) {
+		t.Fatalf("Got %q, want %q", sock.sent, want)
+	}
+	for i := range want {
+		if sock.sent[i] != want[i] {
+			t.Errorf("Got %s, want %s", sock.sent[i], want[i])
+		}
+	}
+
+	// Without a key, or unhandled, there's no Ack
+	sock.sent = nil
+	send(`{"Msg":"Toggle"}`)
+	send(`{"Msg":"Ignored","IdempotencyKey":"k3"}`)
+	if relay.toggles != 3 || len(sock.sent) != 0 {
+		t.Errorf("Toggled %d times, sent %q", relay.toggles, sock.sent)
+	}
+
+	// Keys are forgotten after the window
+	thing.bus.dedup.window = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	send(`{"Msg":"Toggle","IdempotencyKey":"k1"}`)
+	if relay.toggles != 4 {
+		t.Errorf("Toggled %d times after window, want 4", relay.toggles)
+	}
+}
+
+func TestDedupPrime(t *testing.T) {
+	thing := NewThing(&toggler{})
+	thing.Cfg.Id = testId
+	thing.Cfg.IsPrime = true
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &recordSocket{flags: sock_flag_bcast}
+	browser := &recordSocket{}
+	thing.primeSock = remote
+	thing.bus.plugin(remote)
+
+	// The command is passed on to Thing, whatever its key
+	for i := 0; i < 2; i++ {
+		thing.bus.receive(&Packet{bus: thing.bus, src: browser,
+			msg: []byte(`{"Msg":"Forward","IdempotencyKey":"k1"}`)})
+	}
+	if len(remote.sent) != 2 || len(browser.sent) != 0 {
+		t.Fatalf("Thing got %q, browser got %q", remote.sent, browser.sent)
+	}
+
+	// Thing's Ack goes back to the sender only
+	ack := `{"Msg":"_Ack","IdempotencyKey":"k1","Duplicate":false}`
+	thing.bus.receive(&Packet{bus: thing.bus, src: remote, msg: []byte(ack)})
+	if len(browser.sent) != 1 || browser.sent[0] != ack {
+		t.Errorf("Browser got %q", browser.sent)
+	}
+
+	// An Ack not from Thing, or for no command, goes nowhere
+	thing.bus.receive(&Packet{bus: thing.bus, src: browser, msg: []byte(ack)})
+	thing.bus.receive(&Packet{bus: thing.bus, src: remote, msg: []byte(ack)})
+	if len(browser.sent) != 1 || len(remote.sent) != 2 {
+		t.Errorf("Thing got %q, browser got %q", remote.sent, browser.sent)
+	}
+}
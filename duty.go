@@ -0,0 +1,272 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DutyLimit limits how long, and how often, an output is on, to protect
+// actuators such as pumps and compressors from a runaway rule or a stuck
+// client.  Output is a bool member in Thing's state, named as in
+// PowerOnRule.
+//
+// If Output stays on for MaxOnTime seconds, Thing cuts it off: Output is
+// set false in Thing's state, and EventDutyCutoff is sent to Thing's
+// Subscribers().  Subscribe to EventDutyCutoff to switch the actuator off
+// and broadcast the new state to Thing's UI.
+//
+// If Output has switched on MaxCycles times in the last hour, switching it
+// on again with UpdateState is rejected with a StateRejection.
+//
+// A zero MaxOnTime or MaxCycles is no limit.  For example, to run a pump for
+// no more than 10 minutes at a time, and no more than 4 times an hour:
+//
+//	thing.Cfg.DutyLimits = []merle.DutyLimit{
+//		{Output: "Pump", MaxOnTime: 600, MaxCycles: 4},
+//	}
+type DutyLimit struct {
+	Output    string
+	MaxOnTime uint
+	MaxCycles uint
+}
+
+type duty struct {
+	sync.Mutex
+	thing  *Thing
+	limits []DutyLimit
+	// Time each output switched on, or zero if off
+	onSince []time.Time
+	// Times each output switched on in the last hour
+	cycles [][]time.Time
+	// Cutoff timer for each output, while on
+	timers []*time.Timer
+}
+
+func newDuty(thing *Thing, limits []DutyLimit) (*duty, error) {
+	for _, limit := range limits {
+		if limit.Output == "" {
+			return nil, fmt.Errorf("Duty limit missing Output")
+		}
+	}
+	return &duty{
+		thing:   thing,
+		limits:  limits,
+		onSince: make([]time.Time, len(limits)),
+		cycles:  make([][]time.Time, len(limits)),
+		timers:  make([]*time.Timer, len(limits)),
+	}, nil
+}
+
+// Cycles of output i in the hour before now.  Call with lock held.
+func (d *duty) recent(i int, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, cycle := range d.cycles[i] {
+		if now.Sub(cycle) < time.Hour {
+			recent = append(recent, cycle)
+		}
+	}
+	d.cycles[i] = recent
+	return recent
+}
+
+// Start the cutoff timer for output i, on since since.  Call with lock held.
+func (d *duty) arm(i int, since time.Time) {
+	limit := d.limits[i]
+	if limit.MaxOnTime == 0 {
+		return
+	}
+	left := since.Add(time.Duration(limit.MaxOnTime) * time.Second).
+		Sub(time.Now())
+	d.timers[i] = time.AfterFunc(left, func() { d.cutoff(i, since) })
+}
+
+func (d *duty) disarm(i int) {
+	if d.timers[i] != nil {
+		d.timers[i].Stop()
+		d.timers[i] = nil
+	}
+}
+
+// Start cutoff timers for outputs on at startup
+func (d *duty) start() error {
+	state, err := d.thing.currentState()
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+
+	for i, limit := range d.limits {
+		if boolAt(state, strings.Split(limit.Output, ".")) {
+			d.onSince[i] = now
+			d.arm(i, now)
+		}
+	}
+
+	return nil
+}
+
+func (d *duty) stop() {
+	d.Lock()
+	defer d.Unlock()
+
+	for i := range d.limits {
+		d.disarm(i)
+	}
+}
+
+// Check the change from before to after, both decoded JSON, against the
+// duty limits
+func (d *duty) check(before, after interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+
+	for i, limit := range d.limits {
+		if limit.MaxCycles == 0 {
+			continue
+		}
+		path := strings.Split(limit.Output, ".")
+		if boolAt(before, path) || !boolAt(after, path) {
+			continue
+		}
+		if n := len(d.recent(i, now)); n >= int(limit.MaxCycles) {
+			return &StateRejection{Field: limit.Output,
+				Reason: fmt.Sprintf("duty limit; on %d times in "+
+					"the last hour", n)}
+		}
+	}
+
+	return nil
+}
+
+// Record the change from before to after, once committed
+func (d *duty) update(before, after interface{}) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+
+	for i, limit := range d.limits {
+		path := strings.Split(limit.Output, ".")
+		was, is := boolAt(before, path), boolAt(after, path)
+		switch {
+		case !was && is:
+			d.onSince[i] = now
+			d.cycles[i] = append(d.recent(i, now), now)
+			d.arm(i, now)
+		case was && !is:
+			d.onSince[i] = time.Time{}
+			d.disarm(i)
+		}
+	}
+}
+
+// Cut off output i, on since since.  The output is cut off even if a
+// validator would reject the change.
+func (d *duty) cutoff(i int, since time.Time) {
+	t := d.thing
+	output := d.limits[i].Output
+
+	cut, err := d.switchOff(i, since)
+	if err != nil {
+		t.log.printf("Duty cutoff of %s failed: %s", output, err)
+		return
+	}
+	if !cut {
+		return
+	}
+
+	onTime := uint(time.Since(since).Seconds())
+	t.log.printf("Duty cutoff: %s on for %d seconds", output, onTime)
+
+	msg := MsgDutyCutoff{Msg: EventDutyCutoff, Output: output,
+		OnTime: onTime}
+	t.bus.receive(newPacket(t.bus, nil, &msg))
+}
+
+func (d *duty) switchOff(i int, since time.Time) (bool, error) {
+	t := d.thing
+	thinger := t.getThinger()
+
+	if l, ok := thinger.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	// Output may have switched off, and maybe on again, since the timer
+	// fired
+	d.Lock()
+	current := d.onSince[i].Equal(since)
+	d.Unlock()
+	if !current {
+		return false, nil
+	}
+
+	state, err := json.Marshal(thinger)
+	if err != nil {
+		return false, err
+	}
+
+	var before, after interface{}
+	json.Unmarshal(state, &before)
+	json.Unmarshal(state, &after)
+
+	path := strings.Split(d.limits[i].Output, ".")
+	if err := setOutput(after, path, false); err != nil {
+		return false, err
+	}
+
+	data, err := json.Marshal(after)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, thinger); err != nil {
+		return false, err
+	}
+
+	t.outputsChanged(before, after)
+
+	if t.store != nil {
+		if err := t.store.Save(thinger); err != nil {
+			t.log.println("Saving state failed:", err)
+		}
+	}
+
+	return true, nil
+}
+
+func (d *duty) status() []DutyStatus {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	status := make([]DutyStatus, len(d.limits))
+
+	for i, limit := range d.limits {
+		status[i] = DutyStatus{
+			Output: limit.Output,
+			On:     !d.onSince[i].IsZero(),
+			Cycles: uint(len(d.recent(i, now))),
+		}
+		if status[i].On {
+			status[i].OnTime = uint(now.Sub(d.onSince[i]).Seconds())
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,318 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// E2EConfig configures end-to-end sealing of messages between Thing and
+// its users' browsers, or the merle CLI, so a Thing Prime run by someone
+// else can route the messages but not read or forge them.  Thing Prime
+// doesn't need E2EConfig; it passes sealed messages along as-is.
+//
+// A sealed message is coded as MsgSealed.  Thing seals the Msgs it sends,
+// and opens sealed messages it receives.  Msgs received unsealed, or
+// replayed, are dropped.
+type E2EConfig struct {
+
+	// Key shared by Thing and its users, base64-encoded.  Key is a
+	// 16-, 24-, or 32-byte AES key, e.g. from:
+	//
+	//	head -c 32 /dev/urandom | base64
+	//
+	// Sealing is disabled if Key is empty.  The default is "".
+	Key string
+
+	// Messages sealed, by Msg.  Framework messages (those starting with
+	// "_") can't be sealed, as Thing Prime acts on them.  Thing Prime
+	// can't keep its copy of Thing's state up-to-date from sealed
+	// messages, so use Thing.UpdateState, which also sends Thing Prime
+	// a StatePatch, if Thing Prime serves Thing's state.
+	Msgs []string
+
+	// Sealed messages received more than Window seconds from when they
+	// were sealed are dropped.  The default is 60.
+	Window uint
+}
+
+// A Sealer seals and opens messages to and from a Thing, with the Thing's
+// E2EConfig.Key.  Use a Sealer in clients of Thing other than merle.js.
+type Sealer struct {
+	aead cipher.AEAD
+	id   string
+	// Who seals: sealerUser or sealerThing.  A Sealer only opens what
+	// the other end sealed, so a sealed message can't be reflected back
+	// to its sender.
+	from string
+}
+
+const (
+	sealerUser  = "user"
+	sealerThing = "thing"
+)
+
+// NewSealer returns a Sealer for a user's messages to and from Thing id,
+// using base64-encoded key.
+func NewSealer(key, id string) (*Sealer, error) {
+	return newSealer(key, id, sealerUser)
+}
+
+// NewThingSealer returns a Sealer for Thing id's end, using base64-encoded
+// key.  Things built with merle don't need NewThingSealer.
+func NewThingSealer(key, id string) (*Sealer, error) {
+	return newSealer(key, id, sealerThing)
+}
+
+func newSealer(key, id, from string) (*Sealer, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("E2E key: %s", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("E2E key: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead, id: id, from: from}, nil
+}
+
+// The other end of the Sealer
+func (s *Sealer) to() string {
+	if s.from == sealerThing {
+		return sealerUser
+	}
+	return sealerThing
+}
+
+// Msg, Time, the Thing's Id, and who sealed are authenticated with the
+// sealed message, so a sealed message can't be passed off as another, to
+// another Thing, or back to its sender.
+func (s *Sealer) additional(from, msg string, ms int64) []byte {
+	return []byte(s.id + "\x00" + from + "\x00" + msg + "\x00" +
+		strconv.FormatInt(ms, 10))
+}
+
+// Seal msg, a JSON message with a Msg member, into a MsgSealed message
+// sealed at now
+func (s *Sealer) Seal(msg []byte, now time.Time) ([]byte, error) {
+	m, err := s.seal(msg, now)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&m)
+}
+
+func (s *Sealer) seal(msg []byte, now time.Time) (MsgSealed, error) {
+	var m Msg
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return MsgSealed{}, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return MsgSealed{}, err
+	}
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+	sealed := s.aead.Seal(nonce, nonce, msg, s.additional(s.from, m.Msg, ms))
+
+	return MsgSealed{
+		Msg:    m.Msg,
+		Time:   ms,
+		Sealed: base64.StdEncoding.EncodeToString(sealed),
+	}, nil
+}
+
+// Open MsgSealed message msg, returning the message sealed, and when it was
+// sealed.  Open fails if the message was altered, or wasn't sealed with
+// Sealer's key for Sealer's Thing by the other end.
+func (s *Sealer) Open(msg []byte) ([]byte, time.Time, error) {
+	var m MsgSealed
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return nil, time.Time{}, err
+	}
+	sent := time.Unix(0, m.Time*int64(time.Millisecond))
+
+	sealed, err := base64.StdEncoding.DecodeString(m.Sealed)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return nil, sent, fmt.Errorf("Sealed message is malformed")
+	}
+
+	n := s.aead.NonceSize()
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:],
+		s.additional(s.to(), m.Msg, m.Time))
+	if err != nil {
+		return nil, sent, fmt.Errorf("Sealed message failed to open")
+	}
+
+	// The Msg in the clear must be the Msg sealed
+	var inner Msg
+	if err := json.Unmarshal(plain, &inner); err != nil || inner.Msg != m.Msg {
+		return nil, sent, fmt.Errorf("Sealed message Msg mismatch")
+	}
+
+	return plain, sent, nil
+}
+
+// Thing's end of sealing
+type e2e struct {
+	thing  *Thing
+	sealer *Sealer
+	msgs   map[string]bool
+	window time.Duration
+	// nonces of messages opened within window, to drop replays
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+func newE2E(thing *Thing, cfg E2EConfig) (*e2e, error) {
+	sealer, err := NewThingSealer(cfg.Key, thing.id)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &e2e{
+		thing:  thing,
+		sealer: sealer,
+		msgs:   make(map[string]bool),
+		window: time.Duration(cfg.Window) * time.Second,
+		seen:   make(map[string]time.Time),
+	}
+	if e.window == 0 {
+		e.window = 60 * time.Second
+	}
+
+	for _, msg := range cfg.Msgs {
+		if strings.HasPrefix(msg, "_") {
+			return nil, fmt.Errorf("E2E can't seal framework message %s", msg)
+		}
+		e.msgs[msg] = true
+	}
+
+	return e, nil
+}
+
+// Open sealed message p in place.  Each sealed message can be opened once,
+// within window.
+func (e *e2e) open(p *Packet) error {
+	plain, sent, err := e.sealer.Open(p.msg)
+	if err != nil {
+		return err
+	}
+
+	now := e.thing.Now()
+	if d := now.Sub(sent); d > e.window || d < -e.window {
+		return fmt.Errorf("Sealed message is outside window (%s)", d)
+	}
+
+	var m MsgSealed
+	p.Unmarshal(&m)
+
+	if !e.remember(m.Sealed, sent, now) {
+		return fmt.Errorf("Sealed message replayed")
+	}
+
+	p.msg = plain
+	return nil
+}
+
+// Remember the nonce of a message sealed at sent, by Thing or by a user.
+// Returns false if the nonce was seen before.
+func (e *e2e) remember(sealed string, sent, now time.Time) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	for nonce, t := range e.seen {
+		if now.Sub(t) > e.window {
+			delete(e.seen, nonce)
+		}
+	}
+	// The sealed message starts with its nonce
+	nonce := sealed[:base64.StdEncoding.EncodedLen(e.sealer.aead.NonceSize())]
+	if _, ok := e.seen[nonce]; ok {
+		return false
+	}
+	e.seen[nonce] = sent
+	return true
+}
+
+// Receiving side of sealing.  On Thing, sealed messages are opened, and
+// messages that should have been sealed are dropped.  On Thing Prime,
+// sealed messages are passed along, unopened.  Returns false if p is
+// dropped or passed along.
+func (t *Thing) e2eReceive(p *Packet) bool {
+	var m MsgSealed
+	p.Unmarshal(&m)
+
+	if m.Sealed == "" {
+		if t.e2e != nil && p.src != nil && t.e2e.msgs[m.Msg] {
+			t.log.printf("Dropping unsealed [%s]: %.80s", p.Src(),
+				p.String())
+			t.auditCommand(p, "", p.Src(), AuditRejected, "not sealed")
+			return false
+		}
+		return true
+	}
+
+	if t.isPrime {
+		p.Broadcast()
+		return false
+	}
+
+	if t.e2e == nil {
+		t.log.printf("Dropping sealed [%s]; no E2E key: %.80s", p.Src(),
+			p.String())
+		return false
+	}
+
+	if err := t.e2e.open(p); err != nil {
+		t.log.printf("Dropping sealed [%s]: %s", p.Src(), err)
+		t.auditCommand(p, "", p.Src(), AuditRejected, err.Error())
+		return false
+	}
+
+	return true
+}
+
+// Sending side of sealing: p, sealed if it's one of the E2EConfig.Msgs
+func (t *Thing) e2eSeal(p *Packet) *Packet {
+	if t.e2e == nil {
+		return p
+	}
+
+	var m Msg
+	p.Unmarshal(&m)
+	if !t.e2e.msgs[m.Msg] {
+		return p
+	}
+
+	now := t.Now()
+	sealed, err := t.e2e.sealer.seal(p.msg, now)
+	if err != nil {
+		t.log.printf("Sealing failed, not sending: %s", err)
+		return nil
+	}
+	t.e2e.remember(sealed.Sealed, now, now)
+
+	out := p.clone(p.bus, p.src)
+	out.Marshal(&sealed)
+	return out
+}
@@ -0,0 +1,130 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const testE2EKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestE2E(t *testing.T) {
+	relay := &toggler{}
+	thing := NewThing(relay)
+	thing.Cfg.Id = testId
+	thing.Cfg.E2E = E2EConfig{Key: testE2EKey, Msgs: []string{"Toggle", "Forward"}}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	sealer, err := NewSealer(testE2EKey, testId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(s *Sealer, msg string, when time.Time) []byte {
+		t.Helper()
+		sealed, err := s.Seal([]byte(msg), when)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+
+	sock := &recordSocket{}
+	other := &recordSocket{flags: sock_flag_bcast}
+	thing.bus.plugin(other)
+	send := func(msg []byte) {
+		thing.bus.receive(&Packet{bus: thing.bus, src: sock, msg: msg})
+	}
+
+	// Unsealed, sealed, replayed, stale, and forged
+	send([]byte(`{"Msg":"Toggle"}`))
+	sealed := seal(sealer, `{"Msg":"Toggle"}`, time.Now())
+	send(sealed)
+	send(sealed)
+	send(seal(sealer, `{"Msg":"Toggle"}`, time.Now().Add(-2*time.Minute)))
+	forger, _ := NewSealer("ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=", testId)
+	send(seal(forger, `{"Msg":"Toggle"}`, time.Now()))
+	elsewhere, _ := NewSealer(testE2EKey, "other_thing")
+	send(seal(elsewhere, `{"Msg":"Toggle"}`, time.Now()))
+	if relay.toggles != 1 {
+		t.Errorf("Toggled %d times, want 1", relay.toggles)
+	}
+
+	// A sealed message can't pass for another Msg
+	var swapped MsgSealed
+	json.Unmarshal(seal(sealer, `{"Msg":"Toggle"}`, time.Now()), &swapped)
+	swapped.Msg = "Forward"
+	msg, _ := json.Marshal(&swapped)
+	send(msg)
+	if len(other.sent) != 0 {
+		t.Errorf("Forwarded %v", other.sent)
+	}
+
+	// Broadcasts of sealed Msgs leave Thing sealed
+	send(seal(sealer, `{"Msg":"Forward","Value":42}`, time.Now()))
+	if len(other.sent) != 1 {
+		t.Fatalf("Forwarded %v, want 1", other.sent)
+	}
+	plain, _, err := sealer.Open([]byte(other.sent[0]))
+	if err != nil || string(plain) != `{"Msg":"Forward","Value":42}` {
+		t.Errorf("Opened %s, %v", plain, err)
+	}
+
+	// What Thing sealed can't be reflected back to Thing as a command
+	send([]byte(other.sent[0]))
+	if len(other.sent) != 1 {
+		t.Errorf("Reflected message forwarded %v", other.sent[1:])
+	}
+	thingSide, _ := NewThingSealer(testE2EKey, testId)
+	if _, _, err := thingSide.Open([]byte(other.sent[0])); err == nil {
+		t.Errorf("Thing opened its own sealed message")
+	}
+
+	for _, cfg := range []E2EConfig{
+		{Key: testE2EKey, Msgs: []string{GetState}},
+		{Key: "c2hvcnQ="},
+	} {
+		bad := NewThing(&toggler{})
+		bad.Cfg.Id = testId
+		bad.Cfg.E2E = cfg
+		if err := bad.build(true); err == nil {
+			t.Errorf("Built with %+v", cfg)
+		}
+	}
+}
+
+func TestE2EPrime(t *testing.T) {
+	relay := &toggler{}
+	prime := NewThing(relay)
+	prime.Cfg.Id = testId
+	prime.Cfg.IsPrime = true
+	if err := prime.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	toThing := &recordSocket{flags: sock_flag_bcast}
+	prime.primeSock = toThing
+	prime.bus.plugin(toThing)
+	browser := &recordSocket{flags: sock_flag_bcast}
+	prime.bus.plugin(browser)
+
+	// Thing Prime passes sealed messages along, unopened
+	sealer, _ := NewSealer(testE2EKey, testId)
+	sealed, _ := sealer.Seal([]byte(`{"Msg":"Toggle"}`), time.Now())
+	prime.bus.receive(&Packet{bus: prime.bus, src: browser, msg: sealed})
+
+	if relay.toggles != 0 {
+		t.Errorf("Thing Prime toggled")
+	}
+	if len(toThing.sent) != 1 || toThing.sent[0] != string(sealed) {
+		t.Errorf("Sent Thing %v", toThing.sent)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Error is a framework error.  Code names the failure, and is stable, so
+// programs can react to specific failures; Err, if set, is the cause.  Test
+// for a failure with errors.Is and the Err* values below:
+//
+//	if err := thing.Run(); errors.Is(err, merle.ErrListen) {
+//		// port in use?
+//	}
+//
+// Framework errors are also reported, as they happen, in EventError to
+// Thing's Subscribers, in ReplyStatus, and from the private server's
+// /errors endpoint.
+type Error struct {
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Code
+	}
+	return e.Code + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches errors with the same Code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Framework errors.  The Codes of the errors mother answers a Thing's port
+// request with are also the answers, on the wire.
+var (
+	// Mother has no free port for the Thing's tunnel
+	ErrNoPortsAvailable = &Error{Code: "no ports available"}
+	// Mother's port for the Thing is in use
+	ErrPortBusy = &Error{Code: "port busy"}
+	// Mother's bridge has blocked the Thing
+	ErrBlocked = &Error{Code: "blocked"}
+	// Mother's bridge is full
+	ErrBridgeFull = &Error{Code: "bridge full"}
+	// A Thing with the same Id is attached to mother's bridge
+	ErrDuplicateId = &Error{Code: "duplicate id"}
+	// Mother refused the tunnel's SSH credentials
+	ErrTunnelAuth = &Error{Code: "tunnel auth"}
+	// The tunnel to mother failed, for other reasons
+	ErrTunnel = &Error{Code: "tunnel"}
+	// The Thing's HTML template didn't parse
+	ErrTemplateParse = &Error{Code: "template parse"}
+	// Thing's configuration is invalid
+	ErrBadConfig = &Error{Code: "bad config"}
+	// A server couldn't listen on its port
+	ErrListen = &Error{Code: "listen"}
+	// A WebSocket peer sent a message over Cfg.MaxMsgSize
+	ErrMsgTooBig = &Error{Code: "message too big"}
+	// A WebSocket client sent messages faster than Cfg.MaxMsgRate
+	ErrFlood = &Error{Code: "flood"}
+	// A webhook's POST failed, after retries
+	ErrWebhook = &Error{Code: "webhook"}
+	// AWS IoT device shadow is unreachable, or refused an update
+	ErrShadow = &Error{Code: "shadow"}
+	// A notification backend failed to send
+	ErrNotify = &Error{Code: "notify"}
+	// The LoRaWAN modem failed to start, or to send an uplink
+	ErrLoRa = &Error{Code: "lora"}
+	// The CAN interface couldn't be opened, or failed
+	ErrCAN = &Error{Code: "can"}
+	// The NATS server is unreachable, or refused Thing
+	ErrNATS = &Error{Code: "nats"}
+	// Thing couldn't join the LAN multicast group
+	ErrLAN = &Error{Code: "lan"}
+	// Thing couldn't drop root for Cfg.RunAs
+	ErrPrivileges = &Error{Code: "privileges"}
+)
+
+// New error like kind, caused by err
+func newError(kind *Error, err error) *Error {
+	return &Error{Code: kind.Code, Err: err}
+}
+
+// ErrorCode returns the Code of the first Error in err's chain, or "" if
+// there's none
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// Keep err, the latest of its Code, for ReplyStatus and /errors
+func (t *Thing) keepError(err error) MsgError {
+	msg := MsgError{Msg: EventError, Code: ErrorCode(err), Err: err.Error(),
+		Time: time.Now()}
+
+	t.errsLock.Lock()
+	if t.errs == nil {
+		t.errs = make(map[string]MsgError)
+	}
+	t.errs[msg.Code] = msg
+	t.errsLock.Unlock()
+
+	return msg
+}
+
+// Report framework error err: log it, keep it, and send EventError to
+// Thing's Subscribers
+func (t *Thing) raise(err error) {
+	t.log.printf("Error [%s]: %s", ErrorCode(err), err)
+	msg := t.keepError(err)
+	t.bus.receive(newPacket(t.bus, nil, &msg))
+}
+
+// Errors returns the latest framework error of each Code, oldest first
+func (t *Thing) Errors() []MsgError {
+	t.errsLock.Lock()
+	defer t.errsLock.Unlock()
+
+	errs := []MsgError{}
+	for _, msg := range t.errs {
+		errs = append(errs, msg)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Time.Before(errs[j].Time)
+	})
+	return errs
+}
@@ -0,0 +1,106 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type faulty struct {
+	errs chan MsgError
+}
+
+func (f *faulty) error(p *Packet) {
+	var msg MsgError
+	p.Unmarshal(&msg)
+	f.errs <- msg
+}
+
+func (f *faulty) Subscribers() Subscribers {
+	return Subscribers{EventError: f.error}
+}
+
+func (f *faulty) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("Starting tunnel failed: %w",
+		newError(ErrTunnelAuth, errors.New("Permission denied (publickey)")))
+
+	if !errors.Is(err, ErrTunnelAuth) {
+		t.Errorf("%s isn't ErrTunnelAuth", err)
+	}
+	if errors.Is(err, ErrTunnel) {
+		t.Errorf("%s is ErrTunnel", err)
+	}
+	if code := ErrorCode(err); code != ErrTunnelAuth.Code {
+		t.Errorf("Code %q, want %q", code, ErrTunnelAuth.Code)
+	}
+	if code := ErrorCode(errors.New("other")); code != "" {
+		t.Errorf("Code %q for plain error", code)
+	}
+
+	if err := sshError([]byte("ssh: connect to host mother: Connection refused\n"),
+		errors.New("exit status 255")); !errors.Is(err, ErrTunnel) {
+		t.Errorf("%s isn't ErrTunnel", err)
+	}
+	if err := sshError(nil, errors.New("exit status 255")); err.Error() !=
+		"tunnel: exit status 255" {
+		t.Errorf("Got %q", err)
+	}
+}
+
+func TestErrorListen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	port := uint(ln.Addr().(*net.TCPAddr).Port)
+	if _, err := listen([]string{"127.0.0.1"}, port); !errors.Is(err, ErrListen) {
+		t.Errorf("Listen on busy port: %v, want ErrListen", err)
+	}
+}
+
+func TestRaise(t *testing.T) {
+	state := &faulty{errs: make(chan MsgError, 3)}
+	thing := NewThing(state)
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	thing.raise(ErrBridgeFull)
+	thing.raise(newError(ErrTunnel, errors.New("first")))
+	thing.raise(newError(ErrTunnel, errors.New("second")))
+
+	for _, want := range []string{"bridge full", "tunnel: first"} {
+		select {
+		case msg := <-state.errs:
+			if msg.Err != want {
+				t.Errorf("EventError %q, want %q", msg.Err, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No EventError for %q", want)
+		}
+	}
+	<-state.errs
+
+	// Latest of each code is kept
+	errs := thing.Errors()
+	if len(errs) != 2 {
+		t.Fatalf("Errors %+v, want 2", errs)
+	}
+	if errs[0].Code != ErrBridgeFull.Code || errs[1].Err != "tunnel: second" {
+		t.Errorf("Errors %+v", errs)
+	}
+}
@@ -237,5 +237,8 @@ const html = `
 func (b *Bmp180) Assets() *merle.ThingAssets {
 	return &merle.ThingAssets{
 		HtmlTemplateText: html,
+		ContentSources: map[string][]string{
+			"script-src": {"cdn.rawgit.com"},
+		},
 	}
 }
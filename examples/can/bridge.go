@@ -2,7 +2,10 @@
 
 package can
 
-import "github.com/merliot/merle"
+import (
+	"github.com/merliot/merle"
+	"github.com/merliot/merle/examples/obd2"
+)
 
 type bridge struct {
 }
@@ -14,6 +17,7 @@ func NewBridge() merle.Thinger {
 func (b *bridge) BridgeThingers() merle.BridgeThingers {
 	return merle.BridgeThingers{
 		".*:can_node:.*": func() merle.Thinger { return NewNode() },
+		".*:obd2:.*":     func() merle.Thinger { return obd2.NewObd2() },
 	}
 }
 
@@ -19,9 +19,10 @@ func main() {
 	thing.Cfg.PortPrivate = 8080
 
 	flag.StringVar(&node.Iface, "iface", "can0", "CAN interface")
+	flag.UintVar(&node.Rate, "rate", 100, "Max CAN frames sent per second")
 
-	flag.StringVar(&thing.Cfg.MotherHost, "rhost", "", "Remote host")
-	flag.StringVar(&thing.Cfg.MotherUser, "ruser", "merle", "Remote user")
+	thing.Cfg.MotherUser = "merle"
+	merle.FlagSet(&thing.Cfg)
 
 	flag.Parse()
 
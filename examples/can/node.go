@@ -4,18 +4,47 @@ package can
 
 import (
 	"log"
+	"sync"
 
 	"github.com/go-daq/canbus"
 	"github.com/merliot/merle"
 )
 
+// A CAN node receives frames from the CAN bus and broadcasts them as CAN
+// messages.  Frames are sent on the CAN bus with messages:
+//
+//	{"Msg": "CAN", "Id": 2015, "Data": "AgEMAAAAAAA="}
+//	{"Msg": "CANSend", "Id": 2015, "Data": "AgEMAAAAAAA="}
+//	{"Msg": "CANSignal", "Signal": "throttle", "Value": 42.5}
+//	{"Msg": "CANRun", "Sequence": "rpm"}
+//	{"Msg": "CANStop", "Sequence": "rpm"}
+//
+// CAN messages are also broadcast on the bridge to other nodes.  Only Ids in
+// Allow are sent, at no more than Rate frames per second.
 type node struct {
+	sync.Mutex
 	Iface string
-	sock  *canbus.Socket
+	// Ids allowed to send; empty allows all Ids
+	Allow []uint32
+	// Max frames sent per second
+	Rate uint
+	// Named signals, for CANSignal and Sequence Steps
+	Signals map[string]Signal
+	// Named sequences, for CANRun and CANStop
+	Sequences map[string]Sequence
+	sock      *canbus.Socket
+	limit     limiter
+	running   map[string]chan bool
 }
 
 func NewNode() *node {
-	return &node{Iface: "can0"}
+	return &node{
+		Iface:     "can0",
+		Rate:      100,
+		Signals:   make(map[string]Signal),
+		Sequences: make(map[string]Sequence),
+		running:   make(map[string]chan bool),
+	}
 }
 
 type canMsg struct {
@@ -56,7 +85,7 @@ func (n *node) can(p *merle.Packet) {
 		var msg canMsg
 
 		p.Unmarshal(&msg)
-		_, err := n.sock.Send(msg.Id, msg.Data)
+		err := n.send(&Frame{Id: msg.Id, Data: msg.Data})
 		if err != nil {
 			log.Println("Error writing CAN socket:", err)
 		}
@@ -70,6 +99,10 @@ func (n *node) Subscribers() merle.Subscribers {
 		merle.GetState:   merle.ReplyStateEmpty,
 		merle.ReplyState: nil,
 		"CAN":            n.can,
+		"CANSend":        n.canSend,
+		"CANSignal":      n.canSignal,
+		"CANRun":         n.canRun,
+		"CANStop":        n.canStop,
 	}
 }
 
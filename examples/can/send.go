@@ -0,0 +1,280 @@
+// file: examples/can/send.go
+
+package can
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/merliot/merle"
+)
+
+// Frame is a CAN frame to send
+type Frame struct {
+	Id   uint32
+	Data []byte
+}
+
+// Signal is a named value packed into a CAN frame.  The raw value,
+// (value - Offset) / Scale, is packed big-endian into Len bytes starting at
+// byte Start of the frame.  A Scale of zero is taken as one.
+type Signal struct {
+	Id     uint32
+	Start  uint
+	Len    uint
+	Scale  float64
+	Offset float64
+}
+
+func (s Signal) frame(value float64) (*Frame, error) {
+	if s.Len == 0 || s.Len > 8 || s.Start+s.Len > 8 {
+		return nil, fmt.Errorf("Signal doesn't fit in a frame")
+	}
+
+	scale := s.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	raw := uint64(math.Round((value - s.Offset) / scale))
+
+	data := make([]byte, s.Start+s.Len)
+	for i := s.Start + s.Len; i > s.Start; i-- {
+		data[i-1] = byte(raw)
+		raw >>= 8
+	}
+
+	return &Frame{Id: s.Id, Data: data}, nil
+}
+
+// Step of a Sequence: send Frame, or Signal with Value, and then wait Delay
+// milliseconds
+type Step struct {
+	Frame  *Frame
+	Signal string
+	Value  float64
+	Delay  uint
+}
+
+// Sequence is a script of Steps, run Repeat times, or until stopped if Repeat
+// is zero.  For example, to poll OBD-II engine RPM (PID 0x0C) once a second:
+//
+//	node.Sequences["rpm"] = can.Sequence{
+//		Steps: []can.Step{{
+//			Frame: &can.Frame{Id: 0x7DF,
+//				Data: []byte{0x02, 0x01, 0x0C, 0, 0, 0, 0, 0}},
+//			Delay: 1000,
+//		}},
+//	}
+//
+// Replies from the ECU (Id 0x7E8) are broadcast as CAN messages.
+type Sequence struct {
+	Steps  []Step
+	Repeat uint
+}
+
+// Send Id, Data
+type msgSend struct {
+	Msg  string
+	Id   uint32
+	Data []byte
+}
+
+// Send Signal with Value
+type msgSignal struct {
+	Msg    string
+	Signal string
+	Value  float64
+}
+
+// Run or stop Sequence
+type msgSequence struct {
+	Msg      string
+	Sequence string
+}
+
+// Token bucket limiting frames sent per second
+type limiter struct {
+	sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow(rate uint) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+		if l.tokens > float64(rate) {
+			l.tokens = float64(rate)
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (n *node) allowed(id uint32) bool {
+	if len(n.Allow) == 0 {
+		return true
+	}
+	for _, allow := range n.Allow {
+		if id == allow {
+			return true
+		}
+	}
+	return false
+}
+
+// Send frame on the CAN bus, if the frame's Id is allowed and the send
+// rate isn't exceeded
+func (n *node) send(f *Frame) error {
+	if n.sock == nil {
+		return fmt.Errorf("CAN bus not open")
+	}
+	if len(f.Data) > 8 {
+		return fmt.Errorf("Frame data longer than 8 bytes")
+	}
+	if !n.allowed(f.Id) {
+		return fmt.Errorf("Id %#x not allowed", f.Id)
+	}
+	if !n.limit.allow(n.Rate) {
+		return fmt.Errorf("Send rate over %d frames/sec; dropping Id %#x",
+			n.Rate, f.Id)
+	}
+
+	_, err := n.sock.Send(f.Id, f.Data)
+	return err
+}
+
+func (n *node) sendSignal(name string, value float64) error {
+	signal, ok := n.Signals[name]
+	if !ok {
+		return fmt.Errorf("Unknown signal %s", name)
+	}
+	f, err := signal.frame(value)
+	if err != nil {
+		return fmt.Errorf("Signal %s: %s", name, err)
+	}
+	return n.send(f)
+}
+
+func (n *node) canSend(p *merle.Packet) {
+	if !p.IsThing() {
+		// Forward to Thing
+		p.Broadcast()
+		return
+	}
+
+	var msg msgSend
+	p.Unmarshal(&msg)
+
+	if err := n.send(&Frame{Id: msg.Id, Data: msg.Data}); err != nil {
+		log.Println("CAN send failed:", err)
+	}
+}
+
+func (n *node) canSignal(p *merle.Packet) {
+	if !p.IsThing() {
+		// Forward to Thing
+		p.Broadcast()
+		return
+	}
+
+	var msg msgSignal
+	p.Unmarshal(&msg)
+
+	if err := n.sendSignal(msg.Signal, msg.Value); err != nil {
+		log.Println("CAN send failed:", err)
+	}
+}
+
+func (n *node) runSequence(name string, seq Sequence, stop chan bool) {
+	defer func() {
+		n.Lock()
+		if n.running[name] == stop {
+			delete(n.running, name)
+		}
+		n.Unlock()
+	}()
+
+	if len(seq.Steps) == 0 {
+		return
+	}
+
+	for i := uint(0); seq.Repeat == 0 || i < seq.Repeat; i++ {
+		for _, step := range seq.Steps {
+			var err error
+			if step.Frame != nil {
+				err = n.send(step.Frame)
+			} else {
+				err = n.sendSignal(step.Signal, step.Value)
+			}
+			if err != nil {
+				log.Printf("Sequence %s: %s", name, err)
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(step.Delay) * time.Millisecond):
+			}
+		}
+	}
+}
+
+func (n *node) canRun(p *merle.Packet) {
+	if !p.IsThing() {
+		// Forward to Thing
+		p.Broadcast()
+		return
+	}
+
+	var msg msgSequence
+	p.Unmarshal(&msg)
+
+	seq, ok := n.Sequences[msg.Sequence]
+	if !ok {
+		log.Println("Unknown sequence", msg.Sequence)
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if _, running := n.running[msg.Sequence]; running {
+		return
+	}
+	stop := make(chan bool)
+	n.running[msg.Sequence] = stop
+	go n.runSequence(msg.Sequence, seq, stop)
+}
+
+func (n *node) canStop(p *merle.Packet) {
+	if !p.IsThing() {
+		// Forward to Thing
+		p.Broadcast()
+		return
+	}
+
+	var msg msgSequence
+	p.Unmarshal(&msg)
+
+	n.Lock()
+	defer n.Unlock()
+
+	if stop, running := n.running[msg.Sequence]; running {
+		close(stop)
+		delete(n.running, msg.Sequence)
+	}
+}
@@ -20,12 +20,14 @@ func main() {
 	thing.Cfg.PortPublic = 80
 	thing.Cfg.PortPrivate = 8080
 
+	// Record positions for the map's track and for GPX/GeoJSON export,
+	// and trips.  Enable with -history-file.
+	thing.Cfg.History.Msgs = []string{"Update", "TripEnd"}
+
 	flag.BoolVar(&gps.Demo, "demo", false, "Run in Demo mode")
 
-	flag.StringVar(&thing.Cfg.MotherHost, "rhost", "", "Remote host")
-	flag.StringVar(&thing.Cfg.MotherUser, "ruser", "merle", "Remote user")
-	flag.BoolVar(&thing.Cfg.IsPrime, "prime", false, "Run as Thing Prime")
-	flag.UintVar(&thing.Cfg.PortPublicTLS, "TLS", 0, "TLS port")
+	thing.Cfg.MotherUser = "merle"
+	merle.FlagSet(&thing.Cfg)
 
 	flag.Parse()
 
@@ -15,7 +15,17 @@ type gps struct {
 	sync.RWMutex
 	lastLat  float64
 	lastLong float64
-	Demo     bool
+	lastFix  time.Time
+	fixed    bool
+	// Since when position hasn't moved, on a trip
+	still time.Time
+	Demo  bool
+	// Trip in progress, or nil
+	Trip *Trip
+	// Total distance of trips, in km
+	Odometer float64
+	// Trip totals, keyed by date (YYYY-MM-DD)
+	Days map[string]*Day
 }
 
 func NewGps() *gps {
@@ -28,9 +38,17 @@ type msg struct {
 	Long float64
 }
 
+type state struct {
+	Msg      string
+	Lat      float64
+	Long     float64
+	Trip     *Trip
+	Odometer float64
+	Days     map[string]*Day
+}
+
 func (g *gps) run(p *merle.Packet) {
 	var telit telit.Telit
-	msg := &msg{Msg: "Update"}
 
 	err := telit.Init()
 	if err != nil {
@@ -39,16 +57,8 @@ func (g *gps) run(p *merle.Packet) {
 	}
 
 	for {
-		msg.Lat, msg.Long = telit.Location()
-
-		g.Lock()
-		if msg.Lat != g.lastLat || msg.Long != g.lastLong {
-			g.lastLat = msg.Lat
-			g.lastLong = msg.Long
-			p.Marshal(&msg).Broadcast()
-		}
-		g.Unlock()
-
+		lat, long := telit.Location()
+		g.sample(p, lat, long, time.Now())
 		time.Sleep(time.Minute)
 	}
 }
@@ -167,44 +177,45 @@ var places = [...]place{
 	{24.6, 73.73},
 }
 
+// Demo drives between places, stopping for 7 minutes after every 5 places
 func (g *gps) runDemo(p *merle.Packet) {
-	msg := &msg{Msg: "Update"}
-	p.Marshal(&msg).Broadcast()
-
 	i := 0
-	for {
-		msg.Lat = places[i].lat
-		msg.Long = places[i].long
-
-		g.Lock()
-		g.lastLat = places[i].lat
-		g.lastLong = places[i].long
-		g.Unlock()
-
-		p.Marshal(&msg).Broadcast()
+	for step := 0; ; step++ {
+		if step%12 < 5 {
+			i = (i + 1) % len(places)
+		}
+		g.sample(p, places[i].lat, places[i].long, time.Now())
 		time.Sleep(time.Minute)
-		i = (i + 1) % len(places)
 	}
 }
 
 func (g *gps) getState(p *merle.Packet) {
 	g.RLock()
 	defer g.RUnlock()
-	msg := &msg{Msg: merle.ReplyState, Lat: g.lastLat, Long: g.lastLong}
+	msg := &state{Msg: merle.ReplyState, Lat: g.lastLat, Long: g.lastLong,
+		Trip: g.Trip, Odometer: g.Odometer, Days: g.Days}
 	p.Marshal(&msg).Reply()
 }
 
 func (g *gps) saveState(p *merle.Packet) {
 	g.Lock()
 	defer g.Unlock()
-	var msg msg
+	var msg state
 	p.Unmarshal(&msg)
 	g.lastLat = msg.Lat
 	g.lastLong = msg.Long
+	g.Trip = msg.Trip
+	g.Odometer = msg.Odometer
+	g.Days = msg.Days
 }
 
 func (g *gps) update(p *merle.Packet) {
-	g.saveState(p)
+	var msg msg
+	p.Unmarshal(&msg)
+	g.Lock()
+	g.lastLat = msg.Lat
+	g.lastLong = msg.Long
+	g.Unlock()
 	p.Broadcast()
 }
 
@@ -214,6 +225,8 @@ func (g *gps) Subscribers() merle.Subscribers {
 		merle.GetState:   g.getState,
 		merle.ReplyState: g.saveState,
 		"Update":         g.update,
+		"TripStart":      g.tripStart,
+		"TripEnd":        g.tripEnd,
 	}
 
 	if g.Demo {
@@ -252,6 +265,16 @@ const html = `
 			z-index: 2000;
 			cursor: wait;
 		}
+		#track {
+			position: fixed;
+			top: 10px;
+			right: 10px;
+			z-index: 1000;
+			padding: 5px;
+			background-color: white;
+			font-family: sans-serif;
+			font-size: 14px;
+		}
 		#offline {
 			position: absolute;
 			top: 50%;
@@ -264,6 +287,17 @@ const html = `
 	</head>
 	<body style="margin: 0">
 		<div id="map" style="height:100%"></div>
+		<div id="track">
+			Track
+			<select id="since" onchange="getTrack()">
+				<option value="1h">1 hour</option>
+				<option value="24h" selected>24 hours</option>
+				<option value="168h">7 days</option>
+			</select>
+			<a id="gpx" href="">GPX</a>
+			<a id="geojson" href="">GeoJSON</a>
+			<div id="trips"></div>
+		</div>
 		<div id="overlay">
 			<div id="offline">Offline</div>
 		</div>
@@ -283,6 +317,26 @@ const html = `
 			popup = "ID: {{.Id}}<br>Model: {{.Model}}<br>Name: {{.Name}}"
 			marker = L.marker([0, 0]).addTo(map).bindPopup(popup);
 
+			<!-- Track of positions from history, if history is enabled -->
+			track = L.polyline([], {color: 'blue'}).addTo(map)
+
+			function getTrack() {
+				since = document.getElementById("since").value
+				url = "/{{.Id}}/track?msg=Update&since=" + since
+				document.getElementById("gpx").href = url + "&format=gpx"
+				document.getElementById("geojson").href = url + "&format=geojson"
+
+				fetch(url + "&format=geojson")
+					.then(resp => resp.ok ? resp.json() : null)
+					.then(feature => {
+						if (feature == null) {
+							return
+						}
+						track.setLatLngs(feature.geometry.coordinates.map(
+							c => [c[1], c[0]]))
+					})
+			}
+
 			function getState() {
 				conn.send(JSON.stringify({Msg: "_GetState"}))
 			}
@@ -291,6 +345,18 @@ const html = `
 				conn.send(JSON.stringify({Msg: "_GetIdentity"}))
 			}
 
+			function showTrips(msg) {
+				today = new Date().toISOString().slice(0, 10)
+				day = (msg.Days || {})[today] || {Trips: 0, Distance: 0}
+				trips = "Odometer: " + msg.Odometer.toFixed(1) + " km" +
+					"<br>Today: " + day.Trips + " trips, " +
+					day.Distance.toFixed(1) + " km"
+				if (msg.Trip != null) {
+					trips += "<br>On a trip"
+				}
+				document.getElementById("trips").innerHTML = trips
+			}
+
 			function show() {
 				overlay = document.getElementById("overlay")
 				if (online) {
@@ -326,13 +392,23 @@ const html = `
 					case "_EventStatus":
 						online = msg.Online
 						getState()
+						getTrack()
 						break
 					case "_ReplyState":
+						showTrips(msg)
+						// fall through
 					case "Update":
+						if (msg.Msg == "Update") {
+							track.addLatLng([msg.Lat, msg.Long])
+						}
 						marker.setLatLng([msg.Lat, msg.Long])
 						map.panTo([msg.Lat, msg.Long])
 						show()
 						break
+					case "TripStart":
+					case "TripEnd":
+						getState()
+						break
 					}
 				}
 			}
@@ -345,5 +421,10 @@ const html = `
 func (g *gps) Assets() *merle.ThingAssets {
 	return &merle.ThingAssets{
 		HtmlTemplateText: html,
+		ContentSources: map[string][]string{
+			"script-src": {"https://unpkg.com"},
+			"style-src":  {"https://unpkg.com"},
+			"img-src":    {"https://unpkg.com", "https://*.tile.openstreetmap.org"},
+		},
 	}
 }
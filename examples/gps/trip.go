@@ -0,0 +1,172 @@
+// file: examples/gps/trip.go
+
+package gps
+
+import (
+	"math"
+	"time"
+
+	"github.com/merliot/merle"
+)
+
+// A trip starts when position moves at least tripMinMove km between samples,
+// and ends once position hasn't moved tripMinMove km for tripStopAfter.
+const (
+	tripMinMove   = 0.05
+	tripStopAfter = 5 * time.Minute
+	// Days of trip totals kept
+	tripDays = 31
+)
+
+// Trip is a journey from Start to End.  Distance is in km; Duration in
+// seconds.
+type Trip struct {
+	Start    time.Time
+	End      time.Time
+	Distance float64
+	Duration uint
+}
+
+// Day is the total of trips ending on a day
+type Day struct {
+	Trips    uint
+	Distance float64
+	Duration uint
+}
+
+type msgTripStart struct {
+	Msg  string
+	Trip Trip
+}
+
+type msgTripEnd struct {
+	Msg  string
+	Trip Trip
+}
+
+// Great-circle distance, in km, between two positions
+func distance(lat1, long1, lat2, long2 float64) float64 {
+	const earthRadius = 6371.0
+	rad := math.Pi / 180
+
+	dLat := (lat2 - lat1) * rad
+	dLong := (long2 - long1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*
+			math.Sin(dLong/2)*math.Sin(dLong/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// Sample position at time now.  Position updates and trip start/end are
+// broadcast.
+func (g *gps) sample(p *merle.Packet, lat, long float64, now time.Time) {
+	var update *msg
+	var start *msgTripStart
+	var end *msgTripEnd
+
+	g.Lock()
+
+	if g.fixed {
+		moved := distance(g.lastLat, g.lastLong, lat, long)
+
+		switch {
+		case g.Trip == nil && moved >= tripMinMove:
+			g.Trip = &Trip{Start: g.lastFix, Distance: moved}
+			g.still = time.Time{}
+			start = &msgTripStart{Msg: "TripStart", Trip: *g.Trip}
+		case g.Trip != nil && moved >= tripMinMove:
+			g.Trip.Distance += moved
+			g.still = time.Time{}
+		case g.Trip != nil && g.still.IsZero():
+			g.Trip.Distance += moved
+			g.still = g.lastFix
+		case g.Trip != nil && now.Sub(g.still) >= tripStopAfter:
+			trip := *g.Trip
+			trip.End = g.still
+			trip.Duration = uint(trip.End.Sub(trip.Start).Seconds())
+			g.addTrip(trip)
+			end = &msgTripEnd{Msg: "TripEnd", Trip: trip}
+		}
+	}
+
+	if !g.fixed || lat != g.lastLat || long != g.lastLong {
+		update = &msg{Msg: "Update", Lat: lat, Long: long}
+	}
+
+	g.fixed = true
+	g.lastLat, g.lastLong = lat, long
+	g.lastFix = now
+
+	g.Unlock()
+
+	if update != nil {
+		p.Marshal(update).Broadcast()
+	}
+	if start != nil {
+		p.Marshal(start).Broadcast()
+	}
+	if end != nil {
+		p.Marshal(end).Broadcast()
+	}
+}
+
+// Add trip to the odometer and to the trip's day.  Call with lock held.
+func (g *gps) addTrip(trip Trip) {
+	g.Trip = nil
+	g.Odometer += trip.Distance
+
+	if g.Days == nil {
+		g.Days = make(map[string]*Day)
+	}
+
+	date := trip.End.Format("2006-01-02")
+	day, ok := g.Days[date]
+	if !ok {
+		day = &Day{}
+		g.Days[date] = day
+	}
+	day.Trips++
+	day.Distance += trip.Distance
+	day.Duration += trip.Duration
+
+	cutoff := trip.End.AddDate(0, 0, -tripDays).Format("2006-01-02")
+	for date := range g.Days {
+		if date < cutoff {
+			delete(g.Days, date)
+		}
+	}
+}
+
+// On Thing Prime, follow trips started on Thing
+func (g *gps) tripStart(p *merle.Packet) {
+	if p.IsThing() {
+		return
+	}
+
+	var msg msgTripStart
+	p.Unmarshal(&msg)
+
+	g.Lock()
+	g.Trip = &msg.Trip
+	g.Unlock()
+
+	p.Broadcast()
+}
+
+// On Thing Prime, total trips ended on Thing
+func (g *gps) tripEnd(p *merle.Packet) {
+	if p.IsThing() {
+		return
+	}
+
+	var msg msgTripEnd
+	p.Unmarshal(&msg)
+
+	g.Lock()
+	g.addTrip(msg.Trip)
+	g.Unlock()
+
+	p.Broadcast()
+}
@@ -18,5 +18,9 @@ func main() {
 	thing.Cfg.PortPublicTLS = 443
 	thing.Cfg.PortPrivate = 8080
 
+	thing.Cfg.BridgeGroups = []merle.BridgeGroup{
+		{Name: "lights", Match: ".*:relays:.*"},
+	}
+
 	log.Fatalln(thing.Run())
 }
@@ -1,6 +1,7 @@
 package hub
 
 import (
+	"encoding/json"
 	"sync"
 
 	"github.com/merliot/merle"
@@ -61,6 +62,23 @@ func (h *hub) getState(p *merle.Packet) {
 	p.Reply()
 }
 
+// Send message Send to a group of children, e.g. to turn off all of the
+// lights:
+//
+//	{"Msg": "SendGroup", "Group": "lights",
+//	 "Send": {"Msg": "Click", "Relay": 0, "State": false}}
+type msgSendGroup struct {
+	Msg   string
+	Group string
+	Send  json.RawMessage
+}
+
+func (h *hub) sendGroup(p *merle.Packet) {
+	var msg msgSendGroup
+	p.Unmarshal(&msg)
+	p.Marshal(msg.Send).SendGroup(msg.Group)
+}
+
 func (h *hub) init(p *merle.Packet) {
 	h.Children = make(map[string]child)
 }
@@ -71,6 +89,7 @@ func (h *hub) Subscribers() merle.Subscribers {
 		merle.CmdRun:      merle.RunForever,
 		merle.GetState:    h.getState,
 		merle.EventStatus: h.update,
+		"SendGroup":       h.sendGroup,
 	}
 }
 
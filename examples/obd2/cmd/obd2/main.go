@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/merliot/merle"
+	"github.com/merliot/merle/examples/obd2"
+)
+
+func main() {
+	obd2 := obd2.NewObd2()
+	thing := merle.NewThing(obd2)
+
+	thing.Cfg.Model = "obd2"
+	thing.Cfg.Name = "obie"
+	thing.Cfg.User = "merle"
+
+	thing.Cfg.PortPublic = 80
+	thing.Cfg.PortPrivate = 8080
+
+	flag.StringVar(&obd2.Iface, "iface", "can0", "CAN interface")
+	flag.UintVar(&obd2.Poll, "poll", 1, "Seconds between polls")
+	flag.BoolVar(&obd2.Demo, "demo", false, "Run in Demo mode")
+
+	thing.Cfg.MotherUser = "merle"
+	merle.FlagSet(&thing.Cfg)
+
+	flag.Parse()
+
+	log.Fatalln(thing.Run())
+}
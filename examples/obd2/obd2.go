@@ -0,0 +1,554 @@
+// file: examples/obd2/obd2.go
+
+package obd2
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-daq/canbus"
+	"github.com/merliot/merle"
+)
+
+// OBD-II over CAN (ISO 15765-4, 11-bit Ids).  Requests are sent to the
+// functional address 0x7DF; ECUs reply on 0x7E8-0x7EF.
+const (
+	idRequest  = 0x7DF
+	idReplyMin = 0x7E8
+	idReplyMax = 0x7EF
+)
+
+// OBD-II modes
+const (
+	modeCurrent = 0x01
+	modeDtcs    = 0x03
+	modeClear   = 0x04
+)
+
+// Mode 01 PIDs
+const (
+	pidCoolant = 0x05
+	pidRpm     = 0x0C
+	pidSpeed   = 0x0D
+	pidFuel    = 0x2F
+)
+
+// How long a ClearCodes confirmation token is good for
+const confirmTimeout = 30 * time.Second
+
+type obd2 struct {
+	sync.RWMutex
+	Iface string
+	// Seconds between polls
+	Poll uint
+	Demo bool
+	last update
+	sock *canbus.Socket
+	// Reassembled replies from ECUs
+	replies chan []byte
+	// One request outstanding at a time
+	reqLock sync.Mutex
+	// ClearCodes confirmation
+	token   string
+	expires time.Time
+	// On Thing Prime, ClearCodes waiting on Thing's ConfirmClear, by Ask
+	asks map[string]ask
+}
+
+// ClearCodes forwarded to Thing, to answer with Thing's ConfirmClear
+type ask struct {
+	p       *merle.Packet
+	expires time.Time
+}
+
+func NewObd2() *obd2 {
+	return &obd2{
+		Iface:   "can0",
+		Poll:    1,
+		replies: make(chan []byte, 8),
+		asks:    make(map[string]ask),
+	}
+}
+
+// Vehicle state.  Coolant is in degrees C, Speed in km/h, and Fuel in
+// percent.  Dtcs are the stored diagnostic trouble codes, e.g. "P0301".
+type update struct {
+	Msg     string
+	Rpm     float64
+	Speed   float64
+	Coolant float64
+	Fuel    float64
+	Dtcs    []string
+}
+
+// ClearCodes, with the Token from ConfirmClear to confirm.  Ask is set by
+// Thing Prime when forwarding ClearCodes, and echoed in ConfirmClear, so
+// Thing Prime answers only the browser that asked.
+type msgClear struct {
+	Msg   string
+	Token string
+	Ask   string
+}
+
+// Result of ClearCodes
+type msgCleared struct {
+	Msg string
+	Err string
+}
+
+// Receive frames from ECUs, reassembling multi-frame (ISO-TP) replies
+func (o *obd2) recv() {
+	var msg []byte
+	var want int
+
+	for {
+		id, data, err := o.sock.Recv()
+		if err != nil {
+			log.Println("Error reading CAN socket:", err)
+			return
+		}
+		if id < idReplyMin || id > idReplyMax || len(data) < 2 {
+			continue
+		}
+
+		switch data[0] >> 4 {
+		case 0: // Single frame
+			n := int(data[0] & 0x0F)
+			if n < len(data) {
+				o.reply(data[1 : 1+n])
+			}
+		case 1: // First frame; ask ECU for the rest
+			want = int(data[0]&0x0F)<<8 | int(data[1])
+			msg = append([]byte{}, data[2:]...)
+			o.sock.Send(id-8, []byte{0x30, 0, 0, 0, 0, 0, 0, 0})
+		case 2: // Consecutive frame
+			if msg == nil {
+				continue
+			}
+			msg = append(msg, data[1:]...)
+			if len(msg) >= want {
+				o.reply(msg[:want])
+				msg = nil
+			}
+		}
+	}
+}
+
+func (o *obd2) reply(r []byte) {
+	select {
+	case o.replies <- append([]byte{}, r...):
+	default:
+		// Nobody asking
+	}
+}
+
+// Send request and wait for the positive reply
+func (o *obd2) request(mode byte, pid ...byte) ([]byte, error) {
+	o.reqLock.Lock()
+	defer o.reqLock.Unlock()
+
+	// Drop stale replies
+	for len(o.replies) > 0 {
+		<-o.replies
+	}
+
+	data := make([]byte, 8)
+	data[0] = byte(1 + len(pid))
+	data[1] = mode
+	copy(data[2:], pid)
+
+	if _, err := o.sock.Send(idRequest, data); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(time.Second)
+
+	for {
+		select {
+		case r := <-o.replies:
+			if r[0] == 0x7F && len(r) >= 3 && r[1] == mode {
+				return nil, fmt.Errorf("Mode %#02x refused: %#02x", mode, r[2])
+			}
+			if r[0] != mode+0x40 {
+				continue
+			}
+			if len(pid) > 0 && (len(r) < 2 || r[1] != pid[0]) {
+				continue
+			}
+			return r, nil
+		case <-timeout:
+			return nil, fmt.Errorf("No reply to mode %#02x", mode)
+		}
+	}
+}
+
+// Read n data bytes of mode 01 pid
+func (o *obd2) readPid(pid byte, n int) ([]byte, error) {
+	r, err := o.request(modeCurrent, pid)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) < 2+n {
+		return nil, fmt.Errorf("Short reply for PID %#02x", pid)
+	}
+	return r[2 : 2+n], nil
+}
+
+// Decode a DTC's two bytes, e.g. 0x03 0x01 is "P0301"
+func dtc(a, b byte) string {
+	return fmt.Sprintf("%c%d%X%02X", "PCBU"[a>>6], (a>>4)&0x3, a&0x0F, b)
+}
+
+func (o *obd2) readDtcs() ([]string, error) {
+	r, err := o.request(modeDtcs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reply is 0x43, the number of DTCs, and then two bytes per DTC
+	dtcs := []string{}
+	if len(r) < 2 {
+		return dtcs, nil
+	}
+	for i := 0; i < int(r[1]) && 3+2*i < len(r); i++ {
+		a, b := r[2+2*i], r[3+2*i]
+		if a != 0 || b != 0 {
+			dtcs = append(dtcs, dtc(a, b))
+		}
+	}
+
+	return dtcs, nil
+}
+
+// Poll the ECUs.  Values not read keep their last value, and Dtcs are nil if
+// not read.
+func (o *obd2) poll(readDtcs bool) update {
+	o.RLock()
+	u := o.last
+	o.RUnlock()
+
+	u.Msg = "Update"
+	u.Dtcs = nil
+
+	if a, err := o.readPid(pidRpm, 2); err == nil {
+		u.Rpm = float64(int(a[0])<<8|int(a[1])) / 4
+	}
+	if a, err := o.readPid(pidSpeed, 1); err == nil {
+		u.Speed = float64(a[0])
+	}
+	if a, err := o.readPid(pidCoolant, 1); err == nil {
+		u.Coolant = float64(a[0]) - 40
+	}
+	if a, err := o.readPid(pidFuel, 1); err == nil {
+		u.Fuel = math.Round(float64(a[0])*1000/255) / 10
+	}
+	if readDtcs {
+		if dtcs, err := o.readDtcs(); err == nil {
+			u.Dtcs = dtcs
+		} else {
+			log.Println("Reading DTCs failed:", err)
+		}
+	}
+
+	return u
+}
+
+func (o *obd2) demoPoll(readDtcs bool) update {
+	o.RLock()
+	u := o.last
+	o.RUnlock()
+
+	t := float64(time.Now().Unix())
+
+	// Demo starts with two codes, until cleared
+	if readDtcs && u.Dtcs == nil {
+		u.Dtcs = []string{"P0301", "P0420"}
+	} else {
+		u.Dtcs = nil
+	}
+
+	u.Msg = "Update"
+	u.Rpm = math.Round(1800 + 900*math.Sin(t/10))
+	u.Speed = math.Round(60 + 30*math.Sin(t/10))
+	u.Coolant = 90
+	// Tank drains over 1000 minutes, and then is filled again
+	u.Fuel = math.Round(1000-math.Mod(t/60, 1000)) / 10
+	return u
+}
+
+// Save polled values, keeping the last Dtcs if none were read.  Returns
+// the saved values.
+func (o *obd2) save(u update) update {
+	o.Lock()
+	defer o.Unlock()
+
+	if u.Dtcs == nil {
+		u.Dtcs = o.last.Dtcs
+	}
+	o.last = u
+
+	return u
+}
+
+func (o *obd2) run(p *merle.Packet) {
+	var err error
+
+	poll := o.poll
+	if o.Demo {
+		poll = o.demoPoll
+	} else {
+		o.sock, err = canbus.New()
+		if err != nil {
+			log.Println("Creating CAN bus failed:", err)
+			return
+		}
+		if err = o.sock.Bind(o.Iface); err != nil {
+			log.Printf("Binding to %s failed: %s", o.Iface, err)
+			return
+		}
+		go o.recv()
+	}
+
+	interval := time.Duration(o.Poll) * time.Second
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	for i := 0; ; i++ {
+		// DTCs change rarely; read them every 30 polls
+		u := o.save(poll(i%30 == 0))
+		p.Marshal(&u).Broadcast()
+		time.Sleep(interval)
+	}
+}
+
+func (o *obd2) getState(p *merle.Packet) {
+	o.RLock()
+	u := o.last
+	o.RUnlock()
+
+	u.Msg = merle.ReplyState
+	p.Marshal(&u).Reply()
+}
+
+func (o *obd2) saveState(p *merle.Packet) {
+	var u update
+	p.Unmarshal(&u)
+	o.save(u)
+}
+
+func (o *obd2) update(p *merle.Packet) {
+	o.saveState(p)
+	p.Broadcast()
+}
+
+func newToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Clearing codes also resets the emissions readiness monitors, so it takes two
+// steps: ClearCodes without a Token is answered with ConfirmClear and a Token,
+// and ClearCodes with the Token clears the codes.
+func (o *obd2) clearCodes(p *merle.Packet) {
+	var msg msgClear
+	p.Unmarshal(&msg)
+
+	if !p.IsThing() {
+		// Forward to Thing, remembering who asked, if asking
+		if msg.Token == "" {
+			msg.Ask = newToken()
+			now := time.Now()
+			o.Lock()
+			for id, a := range o.asks {
+				if now.After(a.expires) {
+					delete(o.asks, id)
+				}
+			}
+			o.asks[msg.Ask] = ask{p, now.Add(confirmTimeout)}
+			o.Unlock()
+		}
+		p.Marshal(&msg).Broadcast()
+		return
+	}
+
+	o.Lock()
+	confirmed := msg.Token != "" && msg.Token == o.token &&
+		time.Now().Before(o.expires)
+	if !confirmed {
+		o.token = newToken()
+		o.expires = time.Now().Add(confirmTimeout)
+		msg = msgClear{Msg: "ConfirmClear", Token: o.token, Ask: msg.Ask}
+		o.Unlock()
+		p.Marshal(&msg).Reply()
+		return
+	}
+	o.token = ""
+	o.Unlock()
+
+	resp := msgCleared{Msg: "CodesCleared"}
+	if o.Demo {
+		o.Lock()
+		o.last.Dtcs = []string{}
+		o.Unlock()
+	} else if _, err := o.request(modeClear); err != nil {
+		resp.Err = err.Error()
+	} else if dtcs, err := o.readDtcs(); err == nil {
+		o.Lock()
+		o.last.Dtcs = dtcs
+		o.Unlock()
+	}
+
+	p.Marshal(&resp).Broadcast()
+	p.Marshal(&resp).Reply()
+
+	o.RLock()
+	u := o.last
+	o.RUnlock()
+	u.Msg = "Update"
+	p.Marshal(&u).Broadcast()
+}
+
+// On Thing Prime, pass Thing's ConfirmClear on to the browser that asked
+func (o *obd2) confirmClear(p *merle.Packet) {
+	var msg msgClear
+	p.Unmarshal(&msg)
+
+	o.Lock()
+	a, ok := o.asks[msg.Ask]
+	delete(o.asks, msg.Ask)
+	o.Unlock()
+
+	if ok {
+		a.p.Marshal(&msg).Reply()
+	}
+}
+
+func (o *obd2) Subscribers() merle.Subscribers {
+	return merle.Subscribers{
+		merle.CmdRun:     o.run,
+		merle.GetState:   o.getState,
+		merle.ReplyState: o.saveState,
+		"Update":         o.update,
+		"ClearCodes":     o.clearCodes,
+		"ConfirmClear":   o.confirmClear,
+		"CodesCleared":   merle.Broadcast,
+	}
+}
+
+const html = `
+<html lang="en">
+	<head>
+		<meta name="viewport" content="width=device-width, initial-scale=1">
+		<style>
+		body { font-family: sans-serif; margin: 20px; }
+		td { padding: 4px 16px 4px 0; }
+		.value { font-size: 32px; }
+		#offline { color: red; display: none; }
+		</style>
+	</head>
+	<body>
+		<h2>{{.Name}} <span id="offline">(offline)</span></h2>
+		<table>
+			<tr><td>RPM</td><td class="value" id="rpm">-</td></tr>
+			<tr><td>Speed (km/h)</td><td class="value" id="speed">-</td></tr>
+			<tr><td>Coolant (&deg;C)</td><td class="value" id="coolant">-</td></tr>
+			<tr><td>Fuel (%)</td><td class="value" id="fuel">-</td></tr>
+		</table>
+		<h3>Trouble codes</h3>
+		<ul id="dtcs"></ul>
+		<button id="clear" onclick="clearCodes()">Clear codes</button>
+
+		<script>
+			var conn
+			var online = false
+
+			function send(msg) {
+				conn.send(JSON.stringify(msg))
+			}
+
+			function clearCodes() {
+				send({Msg: "ClearCodes"})
+			}
+
+			function show(msg) {
+				document.getElementById("rpm").textContent = msg.Rpm
+				document.getElementById("speed").textContent = msg.Speed
+				document.getElementById("coolant").textContent = msg.Coolant
+				document.getElementById("fuel").textContent = msg.Fuel
+				var dtcs = document.getElementById("dtcs")
+				dtcs.innerHTML = ""
+				var codes = msg.Dtcs || []
+				codes.forEach(function(code) {
+					var li = document.createElement("li")
+					li.textContent = code
+					dtcs.appendChild(li)
+				})
+				if (codes.length == 0) {
+					dtcs.innerHTML = "<li>None</li>"
+				}
+				document.getElementById("clear").disabled = !online || codes.length == 0
+			}
+
+			function connect() {
+				conn = new WebSocket("{{.WebSocket}}")
+
+				conn.onopen = function(evt) {
+					send({Msg: "_GetIdentity"})
+				}
+
+				conn.onclose = function(evt) {
+					online = false
+					document.getElementById("offline").style.display = "inline"
+					setTimeout(connect, 1000)
+				}
+
+				conn.onerror = function(err) {
+					conn.close()
+				}
+
+				conn.onmessage = function(evt) {
+					msg = JSON.parse(evt.data)
+
+					switch(msg.Msg) {
+					case "_ReplyIdentity":
+					case "_EventStatus":
+						online = msg.Online
+						document.getElementById("offline").style.display =
+							online ? "none" : "inline"
+						send({Msg: "_GetState"})
+						break
+					case "_ReplyState":
+					case "Update":
+						show(msg)
+						break
+					case "ConfirmClear":
+						if (confirm("Clear trouble codes?  This also resets the emissions readiness monitors.")) {
+							send({Msg: "ClearCodes", Token: msg.Token})
+						}
+						break
+					case "CodesCleared":
+						if (msg.Err) {
+							alert("Clearing codes failed: " + msg.Err)
+						}
+						break
+					}
+				}
+			}
+
+			connect()
+		</script>
+	</body>
+</html>`
+
+func (o *obd2) Assets() *merle.ThingAssets {
+	return &merle.ThingAssets{
+		HtmlTemplateText: html,
+	}
+}
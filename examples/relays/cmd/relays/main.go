@@ -18,10 +18,8 @@ func main() {
 	thing.Cfg.PortPublic = 80
 	thing.Cfg.PortPrivate = 8080
 
-	flag.StringVar(&thing.Cfg.MotherHost, "rhost", "", "Remote host")
-	flag.StringVar(&thing.Cfg.MotherUser, "ruser", "merle", "Remote user")
-	flag.BoolVar(&thing.Cfg.IsPrime, "prime", false, "Run as Thing Prime")
-	flag.UintVar(&thing.Cfg.PortPublicTLS, "TLS", 0, "TLS port")
+	thing.Cfg.MotherUser = "merle"
+	merle.FlagSet(&thing.Cfg)
 
 	flag.Parse()
 
@@ -12,6 +12,8 @@ import (
 
 type Relays struct {
 	sync.RWMutex
+	// Clicks are applied one at a time, so none are lost
+	clicks  sync.Mutex
 	drivers [4]*gpio.RelayDriver
 	Msg     string
 	States  [4]bool
@@ -30,10 +32,17 @@ func (r *Relays) run(p *merle.Packet) {
 	r.drivers[2] = gpio.NewRelayDriver(adaptor, "35") // GPIO 19
 	r.drivers[3] = gpio.NewRelayDriver(adaptor, "37") // GPIO 26
 
-	for _, driver := range r.drivers {
+	// Restore relays to saved state, if any
+	r.RLock()
+	for i, driver := range r.drivers {
 		driver.Start()
-		driver.Off()
+		if r.States[i] {
+			driver.On()
+		} else {
+			driver.Off()
+		}
 	}
+	r.RUnlock()
 
 	select {}
 }
@@ -62,9 +71,24 @@ func (r *Relays) click(p *merle.Packet) {
 	var msg MsgClick
 	p.Unmarshal(&msg)
 
-	r.Lock()
-	r.States[msg.Relay] = msg.State
-	r.Unlock()
+	if msg.Relay < 0 || msg.Relay >= len(r.States) {
+		return
+	}
+
+	r.clicks.Lock()
+	defer r.clicks.Unlock()
+
+	r.RLock()
+	states := r.States
+	r.RUnlock()
+	states[msg.Relay] = msg.State
+
+	// UpdateState validates the change (e.g. against Cfg.Interlocks),
+	// applies it, and saves the state
+	change := struct{ States [4]bool }{states}
+	if err := p.Marshal(&change).UpdateState(); err != nil {
+		return
+	}
 
 	if p.IsThing() {
 		if msg.State {
@@ -74,7 +98,7 @@ func (r *Relays) click(p *merle.Packet) {
 		}
 	}
 
-	p.Broadcast()
+	p.Marshal(&msg).Broadcast()
 }
 
 func (r *Relays) Subscribers() merle.Subscribers {
@@ -104,8 +128,8 @@ const html = `
 			<label for="relay3"> Relay 3 </label>
 		</div>
 
+		<script src="{{.BasePath}}/merle.js"></script>
 		<script>
-			var conn
 			var online = false
 
 			relays = []
@@ -114,14 +138,6 @@ const html = `
 			}
 			buttons = document.getElementById("buttons")
 
-			function getState() {
-				conn.send(JSON.stringify({Msg: "_GetState"}))
-			}
-
-			function getIdentity() {
-				conn.send(JSON.stringify({Msg: "_GetIdentity"}))
-			}
-
 			function saveState(msg) {
 				for (var i = 0; i < relays.length; i++) {
 					relays[i].checked = msg.States[i]
@@ -135,50 +151,37 @@ const html = `
 				buttons.style.display = "block"
 			}
 
-			function sendClick(relay, num) {
-				conn.send(JSON.stringify({Msg: "Click", Relay: num,
-					State: relay.checked}))
+			function saveStatus(msg) {
+				online = msg.Online
+				showAll()
 			}
 
-			function connect() {
-				conn = new WebSocket("{{.WebSocket}}")
-
-				conn.onopen = function(evt) {
-					getIdentity()
-				}
+			function sendClick(relay, num) {
+				thing.send({Msg: "Click", Relay: num, State: relay.checked})
+			}
 
-				conn.onclose = function(evt) {
-					online = false
+			// merle.js gets the state on connect, and reconnects
+			var thing = merle.connect("{{.WebSocket}}", {
+				"_ReplyIdentity": saveStatus,
+				"_EventStatus": saveStatus,
+				"_ReplyState": function(msg) {
+					saveState(msg)
 					showAll()
-					setTimeout(connect, 1000)
-				}
-
-				conn.onerror = function(err) {
-					conn.close()
-				}
-
-				conn.onmessage = function(evt) {
-					msg = JSON.parse(evt.data)
-					console.log('relays', msg)
-
-					switch(msg.Msg) {
-					case "_ReplyIdentity":
-					case "_EventStatus":
-						online = msg.Online
-						getState()
-						break
-					case "_ReplyState":
-						saveState(msg)
-						showAll()
-						break
-					case "Click":
-						relays[msg.Relay].checked = msg.State
-						break
+				},
+				"Click": function(msg) {
+					relays[msg.Relay].checked = msg.State
+				},
+			}, {
+				online: function(on) {
+					if (on) {
+						thing.send({Msg: "_GetIdentity"})
+						return
 					}
-				}
-			}
-
-			connect()
+					online = false
+					showAll()
+				},
+				log: true,
+			})
 		</script>
 	</body>
 </html>`
@@ -3,44 +3,85 @@
 //go:build tinygo
 // +build tinygo
 
-// tinygo flash -target=arduino-nano33 examples/tinygo/blink.go
+// tinygo flash -target=pico examples/tinygo/blink.go
+//
+// The Thing talks Merle messages, one JSON message per line, on the USB
+// serial port.  Try it from a terminal on the host:
+//
+//	{"Msg":"_GetState"}
+//	{"Msg":"Pause"}
 
 package main
 
 import (
 	"machine"
+	"sync"
 	"time"
 
 	"github.com/merliot/merle"
 )
 
-// Access point info
-const ssid = ""
-const pass = ""
-
 type blinky struct {
+	sync.Mutex
+	led    machine.Pin
+	Msg    string
+	State  bool
+	Paused bool
+}
+
+type msgState struct {
+	Msg   string
+	State bool
 }
 
 func (b *blinky) init(p *merle.Packet) {
-	merle.Nano33ConnectAP(ssid, pass)
+	b.led = machine.LED
+	b.led.Configure(machine.PinConfig{Mode: machine.PinOutput})
 }
 
 func (b *blinky) run(p *merle.Packet) {
-	led := machine.LED
-	led.Configure(machine.PinConfig{Mode: machine.PinOutput})
 	for {
-		led.Low()
 		time.Sleep(time.Millisecond * 500)
 
-		led.High()
-		time.Sleep(time.Millisecond * 500)
+		b.Lock()
+		if !b.Paused {
+			b.State = !b.State
+			b.led.Set(b.State)
+			msg := msgState{Msg: "Update", State: b.State}
+			p.Marshal(&msg).Broadcast()
+		}
+		b.Unlock()
 	}
 }
 
+func (b *blinky) getState(p *merle.Packet) {
+	b.Lock()
+	defer b.Unlock()
+	b.Msg = merle.ReplyState
+	p.Marshal(b).Reply()
+}
+
+func (b *blinky) pause(p *merle.Packet) {
+	b.Lock()
+	b.Paused = true
+	b.Unlock()
+	p.Broadcast()
+}
+
+func (b *blinky) resume(p *merle.Packet) {
+	b.Lock()
+	b.Paused = false
+	b.Unlock()
+	p.Broadcast()
+}
+
 func (b *blinky) Subscribers() merle.Subscribers {
 	return merle.Subscribers{
-		merle.CmdInit: b.init,
-		merle.CmdRun:  b.run,
+		merle.CmdInit:  b.init,
+		merle.CmdRun:   b.run,
+		merle.GetState: b.getState,
+		"Pause":        b.pause,
+		"Resume":       b.resume,
 	}
 }
 
@@ -50,5 +91,11 @@ func (b *blinky) Assets() *merle.ThingAssets {
 
 func main() {
 	thing := merle.NewThing(&blinky{})
+	thing.Cfg.Id = "pico"
+	thing.Cfg.Model = "blinky"
+	thing.Cfg.Name = "blinky"
+	// The log shares the serial port with the messages
+	thing.Cfg.LoggingEnabled = false
+	thing.AddSerial("usb", merle.UART(machine.Serial))
 	thing.Run()
 }
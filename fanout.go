@@ -0,0 +1,194 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fan-out timeout if FanOut message doesn't give one
+const fanOutTimeout = 2 * time.Second
+
+// Socket to catch a child's reply to a fan-out.  A request is replied to by
+// the child.  A command goes on to the child's Thing; Thing's Ack of the
+// command's IdempotencyKey, or Thing's broadcast of the command's Msg once
+// applied, is the reply.
+type fanOutSocket struct {
+	flags uint32
+	reply chan []byte
+	msg   string
+	key   string
+}
+
+func (s *fanOutSocket) Send(p *Packet) error {
+	msg := make([]byte, len(p.msg))
+	copy(msg, p.msg)
+	select {
+	case s.reply <- msg:
+	default:
+		// Only the first reply counts
+	}
+	return nil
+}
+
+func (s *fanOutSocket) Close()                {}
+func (s *fanOutSocket) Name() string          { return "fan-out" }
+func (s *fanOutSocket) Flags() uint32         { return s.flags }
+func (s *fanOutSocket) SetFlags(flags uint32) { s.flags = flags }
+func (s *fanOutSocket) Src() string           { return "SYSTEM" }
+
+// User authenticated on p's websocket, if any
+func sockUser(p *Packet) *AuthUser {
+	if ws, ok := p.src.(*webSocket); ok {
+		return ws.auth
+	}
+	return nil
+}
+
+// Wait on child's reply to the fan-out on sock
+func (b *bridge) fanOutWait(child *Thing, sock *fanOutSocket) {
+	b.fanOutLock.Lock()
+	defer b.fanOutLock.Unlock()
+	b.fanOuts[child.id] = append(b.fanOuts[child.id], sock)
+}
+
+func (b *bridge) fanOutDone(child *Thing, sock *fanOutSocket) {
+	b.fanOutLock.Lock()
+	defer b.fanOutLock.Unlock()
+
+	socks := b.fanOuts[child.id]
+	for i, s := range socks {
+		if s == sock {
+			socks = append(socks[:i], socks[i+1:]...)
+			break
+		}
+	}
+	if len(socks) == 0 {
+		delete(b.fanOuts, child.id)
+	} else {
+		b.fanOuts[child.id] = socks
+	}
+}
+
+// Child heard p from its Thing; pass p to the fan-outs waiting on it
+func (b *bridge) fanOutHeard(child *Thing, p *Packet) {
+	var msg msgKeyed
+	p.Unmarshal(&msg)
+
+	b.fanOutLock.Lock()
+	defer b.fanOutLock.Unlock()
+
+	for _, sock := range b.fanOuts[child.id] {
+		acked := msg.Msg == Ack && sock.key != "" &&
+			msg.IdempotencyKey == sock.key
+		if acked || msg.Msg == sock.msg {
+			sock.Send(p)
+		}
+	}
+}
+
+// Send packet to the bridge's children, or to the children in group if group
+// isn't "", and collect each child's reply, waiting up to timeout
+func (t *Thing) fanOut(p *Packet, group string, timeout time.Duration) []FanOutResult {
+	return t.fanOutAs(p, group, timeout, nil)
+}
+
+// Fan-out as user.  If user isn't nil, only the children user can access are
+// sent to.
+func (t *Thing) fanOutAs(p *Packet, group string, timeout time.Duration,
+	user *AuthUser) []FanOutResult {
+
+	if !t.isBridge {
+		t.log.println("Not a bridge; not fanning out")
+		return []FanOutResult{}
+	}
+
+	b := t.bridge
+	var children []*Thing
+
+	for _, child := range b.childThings() {
+		if user != nil && t.auth != nil && !t.auth.canAccess(user, child.id) {
+			continue
+		}
+		if group == "" || b.inGroup(child, group) {
+			children = append(children, child)
+		}
+	}
+
+	var cmd msgKeyed
+	p.Unmarshal(&cmd)
+	if isRequest(p) {
+		cmd = msgKeyed{}
+	}
+
+	t.log.printf("Fan-out to %d children: %.80s", len(children), p.String())
+
+	results := make([]FanOutResult, len(children))
+	var wg sync.WaitGroup
+
+	for i, child := range children {
+		results[i] = FanOutResult{Id: child.id}
+
+		if !b.childOnline(child) {
+			results[i].Status = FanOutOffline
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *FanOutResult, child *Thing) {
+			defer wg.Done()
+
+			sock := &fanOutSocket{reply: make(chan []byte, 1),
+				msg: cmd.Msg, key: cmd.IdempotencyKey}
+			b.fanOutWait(child, sock)
+			defer b.fanOutDone(child, sock)
+
+			go child.bus.receive(p.clone(child.bus, sock))
+
+			select {
+			case reply := <-sock.reply:
+				result.Status = FanOutReplied
+				result.Reply = reply
+			case <-time.After(timeout):
+				result.Status = FanOutTimeout
+			}
+		}(&results[i], child)
+	}
+
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Id < results[j].Id
+	})
+
+	return results
+}
+
+// Subscriber handler for FanOut
+func (t *Thing) fanOutMsg(p *Packet) {
+	var msg MsgFanOut
+	p.Unmarshal(&msg)
+
+	timeout := time.Duration(msg.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = fanOutTimeout
+	}
+
+	resp := MsgFanOutReply{Msg: ReplyFanOut, Results: []FanOutResult{}}
+
+	if len(msg.Send) == 0 {
+		t.log.println("Fan-out missing message to Send")
+	} else {
+		send := &Packet{bus: t.bus, msg: msg.Send}
+		resp.Results = t.fanOutAs(send, msg.Group, timeout, sockUser(p))
+	}
+
+	p.Marshal(&resp).Reply()
+}
@@ -0,0 +1,339 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault kinds
+const (
+	// Thing.Calibrate(Target) returns NaN, as from a dead sensor
+	FaultNaN = "nan"
+	// Output Target, a bool member in Thing's state named as in
+	// PowerOnRule, is stuck: UpdateState leaves it as is, as with a
+	// welded relay
+	FaultStuck = "stuck"
+	// Mother's connections drop, and keep dropping as mother reconnects
+	FaultTunnel = "tunnel"
+	// Thing.Now() jumps Value seconds, e.g. -3600 for an hour back
+	FaultClock = "clock"
+)
+
+// How often mother's connections are dropped during a FaultTunnel
+const faultFlap = time.Second
+
+// Fault is a failure injected into a Thing, to check that rules, alerts, and
+// safe-state logic hold up before deploying to hardware.  Faults are
+// injected with the InjectFault message, on Thing's private server, if
+// Cfg.FaultInjection is set.
+//
+// A fault lasts Duration seconds, or, if Duration is zero, until cleared
+// with ClearFaults.  Thing handles the fault Kinds above; other Kinds are
+// for the Thinger.  A Thinger simulating its hardware, e.g. in demo mode,
+// implements Faulter to be told of faults as they come and go.
+type Fault struct {
+	Kind     string
+	Target   string  `json:",omitempty"`
+	Value    float64 `json:",omitempty"`
+	Duration uint    `json:",omitempty"`
+}
+
+// Faulter is implemented by a Thinger to simulate injected faults.  Fault is
+// called with active true when f is injected, and with active false when f
+// ends.
+type Faulter interface {
+	Fault(f Fault, active bool)
+}
+
+type activeFault struct {
+	Fault
+	timer *time.Timer
+}
+
+type faults struct {
+	sync.Mutex
+	thing  *Thing
+	active []*activeFault
+	skew   time.Duration
+	ticker *time.Ticker
+	done   chan bool
+}
+
+func newFaults(thing *Thing) *faults {
+	return &faults{thing: thing}
+}
+
+// Tell the Thinger, if it's a Faulter
+func (f *faults) tell(fault Fault, active bool) {
+	if h, ok := f.thing.thinger.(Faulter); ok {
+		h.Fault(fault, active)
+	}
+}
+
+// Is a fault of kind on target active?  Call with lock held.
+func (f *faults) has(kind, target string) bool {
+	for _, a := range f.active {
+		if a.Kind == kind && (target == "" || a.Target == target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *faults) inject(fault Fault) error {
+	switch fault.Kind {
+	case "":
+		return fmt.Errorf("Fault missing Kind")
+	case FaultNaN, FaultStuck:
+		if fault.Target == "" {
+			return fmt.Errorf("Fault %s missing Target", fault.Kind)
+		}
+	}
+
+	f.Lock()
+
+	a := &activeFault{Fault: fault}
+	f.active = append(f.active, a)
+
+	switch fault.Kind {
+	case FaultClock:
+		f.skew += time.Duration(fault.Value * float64(time.Second))
+	case FaultTunnel:
+		if f.ticker == nil {
+			f.flap()
+		}
+	}
+
+	if fault.Duration > 0 {
+		a.timer = time.AfterFunc(time.Duration(fault.Duration)*time.Second,
+			func() { f.end(a) })
+	}
+
+	f.Unlock()
+
+	f.thing.log.printf("Fault injected: %+v", fault)
+	f.tell(fault, true)
+
+	if fault.Kind == FaultTunnel {
+		f.drop()
+	}
+
+	return nil
+}
+
+// Remove a from the active faults.  Call with lock held.
+func (f *faults) remove(a *activeFault) bool {
+	for i, active := range f.active {
+		if active != a {
+			continue
+		}
+		f.active = append(f.active[:i], f.active[i+1:]...)
+		if a.timer != nil {
+			a.timer.Stop()
+		}
+		if a.Kind == FaultClock {
+			f.skew -= time.Duration(a.Value * float64(time.Second))
+		}
+		if a.Kind == FaultTunnel && !f.has(FaultTunnel, "") {
+			f.ticker.Stop()
+			close(f.done)
+			f.ticker = nil
+		}
+		return true
+	}
+	return false
+}
+
+// Fault a ends
+func (f *faults) end(a *activeFault) {
+	f.Lock()
+	removed := f.remove(a)
+	f.Unlock()
+
+	if removed {
+		f.thing.log.printf("Fault cleared: %+v", a.Fault)
+		f.tell(a.Fault, false)
+	}
+}
+
+func (f *faults) clear() {
+	f.Lock()
+	active := make([]*activeFault, len(f.active))
+	copy(active, f.active)
+	for _, a := range active {
+		f.remove(a)
+	}
+	f.Unlock()
+
+	for _, a := range active {
+		f.thing.log.printf("Fault cleared: %+v", a.Fault)
+		f.tell(a.Fault, false)
+	}
+}
+
+func (f *faults) list() []Fault {
+	f.Lock()
+	defer f.Unlock()
+
+	list := []Fault{}
+	for _, a := range f.active {
+		list = append(list, a.Fault)
+	}
+	return list
+}
+
+// Close mother's connections
+func (f *faults) drop() {
+	b := f.thing.bus
+
+	var socks []socketer
+	b.sockLock.RLock()
+	for sock := range b.sockets {
+		if sock.Flags()&sock_flag_mother != 0 {
+			socks = append(socks, sock)
+		}
+	}
+	b.sockLock.RUnlock()
+
+	for _, sock := range socks {
+		f.thing.log.printf("Fault: dropping [%s]", sock.Name())
+		sock.Close()
+	}
+}
+
+// Keep dropping mother's connections.  Call with lock held.
+func (f *faults) flap() {
+	f.ticker = time.NewTicker(faultFlap)
+	f.done = make(chan bool)
+
+	go func(ticker *time.Ticker, done chan bool) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				f.drop()
+			}
+		}
+	}(f.ticker, f.done)
+}
+
+func (f *faults) nan(name string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.has(FaultNaN, name)
+}
+
+// Leave stuck outputs in changes, JSON, as they are in state, JSON
+func (f *faults) stick(changes, state []byte) []byte {
+	f.Lock()
+	var stuck []string
+	for _, a := range f.active {
+		if a.Kind == FaultStuck {
+			stuck = append(stuck, a.Target)
+		}
+	}
+	f.Unlock()
+
+	if len(stuck) == 0 {
+		return changes
+	}
+
+	var c, s interface{}
+	if json.Unmarshal(changes, &c) != nil || json.Unmarshal(state, &s) != nil {
+		return changes
+	}
+
+	for _, output := range stuck {
+		path := strings.Split(output, ".")
+		// Not an error if the change doesn't touch the output
+		setOutput(c, path, boolAt(s, path))
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return changes
+	}
+	return data
+}
+
+// Now returns the current time, as Thing sees it.  Thing's clock is the
+// system clock, or the clock set with SetClock, unless jumped by a
+// FaultClock.  Thingers simulating time-based behavior should use Now, so
+// clock faults and test clocks reach them.
+func (t *Thing) Now() time.Time {
+	now := time.Now
+	if t.clock != nil {
+		now = t.clock
+	}
+	if t.faults == nil {
+		return now()
+	}
+	t.faults.Lock()
+	defer t.faults.Unlock()
+	return now().Add(t.faults.skew)
+}
+
+// Private server only
+func (t *Thing) faultAllowed(p *Packet) bool {
+	if p.src == nil || p.src.Flags()&sock_flag_private == 0 {
+		t.log.println("Ignoring fault message; not on private server")
+		return false
+	}
+	return true
+}
+
+func (t *Thing) replyFaults(p *Packet) {
+	resp := MsgFaults{Msg: ReplyFaults, Faults: t.faults.list()}
+	p.Marshal(&resp).Reply()
+}
+
+// Subscriber handler for InjectFault
+func (t *Thing) injectFault(p *Packet) {
+	var msg MsgFault
+
+	if !t.faultAllowed(p) {
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	if err := t.faults.inject(msg.Fault); err != nil {
+		t.log.println("Injecting fault failed:", err)
+	}
+
+	t.replyFaults(p)
+}
+
+// Subscriber handler for ClearFaults
+func (t *Thing) clearFaults(p *Packet) {
+	if !t.faultAllowed(p) {
+		return
+	}
+	t.faults.clear()
+	t.replyFaults(p)
+}
+
+// Subscriber handler for GetFaults
+func (t *Thing) getFaults(p *Packet) {
+	t.replyFaults(p)
+}
+
+// NaN, if a FaultNaN is active for the calibration name
+func (t *Thing) faultNaN(name string) (float64, bool) {
+	if t.faults != nil && t.faults.nan(name) {
+		return math.NaN(), true
+	}
+	return 0, false
+}
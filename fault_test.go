@@ -0,0 +1,112 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+type faultyPump struct {
+	pump
+	faults []Fault
+}
+
+func (f *faultyPump) Fault(fault Fault, active bool) {
+	if active {
+		f.faults = append(f.faults, fault)
+	}
+}
+
+type closeSocket struct {
+	recordSocket
+	sync.Mutex
+	closed bool
+}
+
+func (s *closeSocket) Close() {
+	s.Lock()
+	s.closed = true
+	s.Unlock()
+}
+
+func TestFaults(t *testing.T) {
+	state := &faultyPump{}
+	thing := NewThing(state)
+	thing.Cfg.Id = testId
+	thing.Cfg.FaultInjection = true
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	private := &recordSocket{flags: sock_flag_private}
+	inject := func(f Fault) {
+		msg := MsgFault{Msg: InjectFault, Fault: f}
+		thing.bus.receive(newPacket(thing.bus, private, &msg))
+	}
+
+	// Only accepted on the private server
+	msg := MsgFault{Msg: InjectFault, Fault: Fault{Kind: FaultNaN, Target: "Temp"}}
+	thing.bus.receive(newPacket(thing.bus, &recordSocket{}, &msg))
+	if v := thing.Calibrate("Temp", 20); v != 20 {
+		t.Errorf("Fault injected from public socket: got %f", v)
+	}
+
+	inject(Fault{Kind: FaultNaN, Target: "Temp"})
+	if v := thing.Calibrate("Temp", 20); !math.IsNaN(v) {
+		t.Errorf("Got %f, want NaN", v)
+	}
+
+	inject(Fault{Kind: FaultStuck, Target: "Pump"})
+	if err := thing.UpdateState(&struct{ Pump bool }{true}); err != nil {
+		t.Fatal(err)
+	}
+	if state.Pump {
+		t.Error("Stuck output switched")
+	}
+
+	inject(Fault{Kind: FaultClock, Value: 3600})
+	if skew := thing.Now().Sub(time.Now()); skew < 59*time.Minute {
+		t.Errorf("Clock skew %s", skew)
+	}
+
+	mother := &closeSocket{recordSocket: recordSocket{flags: sock_flag_mother}}
+	thing.bus.plugin(mother)
+	inject(Fault{Kind: FaultTunnel})
+	mother.Lock()
+	closed := mother.closed
+	mother.Unlock()
+	if !closed {
+		t.Error("Mother's connection not dropped")
+	}
+
+	inject(Fault{Kind: "flood", Target: "Basement"})
+	if len(state.faults) != 5 || state.faults[4].Kind != "flood" {
+		t.Errorf("Thinger told of faults %+v", state.faults)
+	}
+
+	var resp MsgFaults
+	json.Unmarshal([]byte(private.sent[len(private.sent)-1]), &resp)
+	if len(resp.Faults) != 5 {
+		t.Errorf("Got %+v", resp)
+	}
+
+	thing.bus.receive(newPacket(thing.bus, private, &Msg{Msg: ClearFaults}))
+	if v := thing.Calibrate("Temp", 20); v != 20 {
+		t.Errorf("Got %f after clear", v)
+	}
+	if skew := thing.Now().Sub(time.Now()); skew > time.Second {
+		t.Errorf("Clock skew %s after clear", skew)
+	}
+	if err := thing.UpdateState(&struct{ Pump bool }{true}); err != nil || !state.Pump {
+		t.Errorf("Output still stuck after clear: %v", err)
+	}
+}
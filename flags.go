@@ -0,0 +1,140 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Short flag names kept from earlier examples, so existing command lines
+// still work
+var flagAliases = map[string]string{
+	"rhost": "mother-host",
+	"ruser": "mother-user",
+	"prime": "is-prime",
+	"TLS":   "port-public-tls",
+	"store": "store-file",
+}
+
+// Flag value backed by a ThingConfig field.  A secret field's value isn't
+// shown as the flag's default.
+type cfgValue struct {
+	v      reflect.Value
+	secret bool
+}
+
+func (c cfgValue) String() string {
+	if !c.v.IsValid() {
+		return ""
+	}
+	if c.secret && !c.v.IsZero() {
+		return "*****"
+	}
+	switch c.v.Kind() {
+	case reflect.Slice:
+		if c.v.Type().Elem().Kind() == reflect.String {
+			return strings.Join(c.v.Interface().([]string), ",")
+		}
+		if c.v.Len() == 0 {
+			return ""
+		}
+		data, _ := json.Marshal(c.v.Interface())
+		return string(data)
+	}
+	return fmt.Sprint(c.v.Interface())
+}
+
+func (c cfgValue) Set(s string) error {
+	return setField(c.v, s)
+}
+
+func (c cfgValue) IsBoolFlag() bool {
+	return c.v.Kind() == reflect.Bool
+}
+
+// FlagSet registers a command-line flag, on flag.CommandLine, for each item in
+// cfg.  Call FlagSet after setting cfg items in code, and before
+// flag.Parse().  Flag names are the cfg item names in lower kebab case, e.g.
+// -port-public for PortPublic, and -history-file for History.File.  List
+// flags, such as -archive-msgs, are comma-separated.
+//
+// The default for each flag is the item's value in cfg, if set in code,
+// otherwise the item's value from the environment, if set.  The environment
+// variable name is MERLE_ followed by the item name in upper snake case, as
+// in NewEnvConfig, e.g. MERLE_PORT_PUBLIC.  So a flag given on the command
+// line wins over cfg set in code, which wins over the environment, as with
+// AddConfig.  Secret items, such as BootToken, are masked in the defaults
+// shown by -h.
+//
+//	func main() {
+//		thing := merle.NewThing(&thing{})
+//		thing.Cfg.PortPublic = 80
+//		merle.FlagSet(&thing.Cfg)
+//		flag.Parse()
+//		log.Fatalln(thing.Run())
+//	}
+//
+// FlagSet returns flag.CommandLine, for adding more flags.
+func FlagSet(cfg *ThingConfig) *flag.FlagSet {
+	addFlags(flag.CommandLine, cfg)
+	return flag.CommandLine
+}
+
+func addFlags(fs *flag.FlagSet, cfg *ThingConfig) {
+	secrets := map[interface{}]bool{&cfg.Webhooks: true, &cfg.Rules: true}
+	for _, secret := range cfgSecrets(cfg) {
+		secrets[secret] = true
+	}
+
+	registerFlags(fs, reflect.ValueOf(cfg).Elem(),
+		reflect.ValueOf(&defaultCfg).Elem(), secrets, "", "")
+
+	for alias, name := range flagAliases {
+		if f := fs.Lookup(name); f != nil {
+			fs.Var(f.Value, alias, "Alias for -"+name)
+		}
+	}
+}
+
+// Register flags for v's fields.  A field still at its default, def, is
+// taken from the environment.
+func registerFlags(fs *flag.FlagSet, v, def reflect.Value,
+	secrets map[interface{}]bool, prefix, usage string) {
+
+	typ := v.Type()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := typ.Field(i)
+		name := prefix + snakeCase(field.Name)
+		f := v.Field(i)
+
+		if f.Kind() == reflect.Struct {
+			registerFlags(fs, f, def.Field(i), secrets, name+"_",
+				field.Name+" ")
+			continue
+		}
+
+		isDefault := reflect.DeepEqual(f.Interface(), def.Field(i).Interface())
+		if s, ok := os.LookupEnv("MERLE_" + name); ok && isDefault {
+			if err := setField(f, s); err != nil {
+				fmt.Fprintf(fs.Output(), "Ignoring MERLE_%s: %s\n",
+					name, err)
+			}
+		}
+
+		flagName := strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		secret := secrets[f.Addr().Interface()]
+		fs.Var(cfgValue{f, secret}, flagName, usage+field.Name+
+			" (env MERLE_"+name+")")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	os.Setenv("MERLE_NAME", "fromenv")
+	os.Setenv("MERLE_MODEL", "fromenv")
+	os.Setenv("MERLE_PORT_PUBLIC", "8080")
+	os.Setenv("MERLE_BOOT_TOKEN", "hush")
+	defer os.Unsetenv("MERLE_NAME")
+	defer os.Unsetenv("MERLE_MODEL")
+	defer os.Unsetenv("MERLE_PORT_PUBLIC")
+	defer os.Unsetenv("MERLE_BOOT_TOKEN")
+
+	cfg := defaultCfg
+	cfg.PortPublic = 80
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	addFlags(fs, &cfg)
+
+	err := fs.Parse([]string{"-model", "fromflag", "-prime", "-TLS", "443",
+		"-history-msgs", "Update,Alarm", "-latitude", "45.5",
+		"-longitude", "-122.25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flag, then code, then environment
+	if cfg.Model != "fromflag" || cfg.Name != "fromenv" || cfg.PortPublic != 80 {
+		t.Errorf("Bad precedence: %+v", cfg)
+	}
+	if cfg.BootToken != "hush" || fs.Lookup("boot-token").DefValue != "*****" {
+		t.Errorf("Bad secret: %q shown as %q", cfg.BootToken,
+			fs.Lookup("boot-token").DefValue)
+	}
+	if !cfg.IsPrime || cfg.PortPublicTLS != 443 {
+		t.Errorf("Bad aliases: %+v", cfg)
+	}
+	if len(cfg.History.Msgs) != 2 || cfg.History.Msgs[0] != "Update" {
+		t.Errorf("Bad History.Msgs: %v", cfg.History.Msgs)
+	}
+	if cfg.Latitude != 45.5 || cfg.Longitude != -122.25 {
+		t.Errorf("Bad location: %v, %v", cfg.Latitude, cfg.Longitude)
+	}
+}
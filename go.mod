@@ -1,15 +1,19 @@
 module github.com/merliot/merle
 
-go 1.15
+go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/go-daq/canbus v0.0.0-20161123191156-079be98fdbd7
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/msteinert/pam v1.0.0
 	github.com/pkg/errors v0.9.1
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
 	gobot.io/x/gobot v1.16.0
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	gopkg.in/yaml.v3 v3.0.1
 	tinygo.org/x/drivers v0.21.0
 )
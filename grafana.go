@@ -0,0 +1,280 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Grafana JSON datasource for Thing's history.  Point a Grafana JSON (or
+// SimpleJSON) datasource at the public web server:
+//
+//	https://host/{id}/grafana
+//
+// Metrics are named Msg.Path, where Path is the dotted path to a number or
+// bool in the message, e.g. "Update.Temperature" or "Update.Relays.0".
+// Bools chart as 0 or 1.
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange    `json:"range"`
+	MaxDataPoints uint            `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target string `json:"target"`
+	// [value, unix time in msecs]
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaMetric struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// Message types in history
+func (h *history) msgTypes() ([]string, error) {
+	rows, err := h.db.Query("SELECT DISTINCT msg FROM history ORDER BY msg")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, rows.Err()
+}
+
+// Collect dotted paths to the numbers and bools in v
+func numericPaths(paths []string, path string, v interface{}) []string {
+	switch v := v.(type) {
+	case float64, bool:
+		paths = append(paths, path)
+	case map[string]interface{}:
+		for k, e := range v {
+			if path == "" && k == "Msg" {
+				continue
+			}
+			paths = numericPaths(paths, path+"."+k, e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			paths = numericPaths(paths, path+"."+strconv.Itoa(i), e)
+		}
+	}
+	return paths
+}
+
+// Number or bool at dotted path in v
+func numericValue(v interface{}, path []string) (float64, bool) {
+	for _, k := range path {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			v = c[k]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(c) {
+				return 0, false
+			}
+			v = c[i]
+		default:
+			return 0, false
+		}
+	}
+
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// Metrics available: the numeric paths in the most recent record of each
+// message type
+func (h *history) metrics() ([]string, error) {
+	msgs, err := h.msgTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []string
+	for _, msg := range msgs {
+		records, err := h.query(msg, time.Time{}, time.Time{}, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		var v interface{}
+		json.Unmarshal(records[0].Msg, &v)
+		for _, path := range numericPaths(nil, "", v) {
+			metrics = append(metrics, msg+path)
+		}
+	}
+
+	sort.Strings(metrics)
+
+	return metrics, nil
+}
+
+// Time series for metric target in time range [from, to], oldest first,
+// averaged down across the range to max points, if max isn't zero
+func (h *history) series(target string, from, to time.Time,
+	max uint) (grafanaSeries, error) {
+
+	series := grafanaSeries{Target: target, Datapoints: [][2]float64{}}
+
+	parts := strings.SplitN(target, ".", 2)
+	if len(parts) != 2 {
+		return series, nil
+	}
+
+	points, err := h.chart(parts[0], parts[1], from, to, int(max))
+	if err != nil {
+		return series, err
+	}
+
+	for _, pt := range points {
+		msecs := float64(pt.Time.UnixNano() / int64(time.Millisecond))
+		series.Datapoints = append(series.Datapoints,
+			[2]float64{pt.Value, msecs})
+	}
+
+	return series, nil
+}
+
+// Find the Thing, or bridge child, with history for the request
+func (t *Thing) grafanaThing(w http.ResponseWriter, r *http.Request) *Thing {
+	id := mux.Vars(r)["id"]
+
+	if child := t.getChild(id); child != nil {
+		t = child
+	} else if id != t.id {
+		http.Error(w, "Mismatch on Ids", http.StatusNotFound)
+		return nil
+	}
+
+	if t.history == nil {
+		http.Error(w, "No history", http.StatusNotFound)
+		return nil
+	}
+
+	return t
+}
+
+func grafanaReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Datasource connection test on GET /{id}/grafana/
+func (t *Thing) grafanaTest(w http.ResponseWriter, r *http.Request) {
+	if t.grafanaThing(w, r) != nil {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// List metrics on POST /{id}/grafana/search (SimpleJSON) or POST
+// /{id}/grafana/metrics (JSON datasource)
+func (t *Thing) grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thing := t.grafanaThing(w, r)
+	if thing == nil {
+		return
+	}
+
+	metrics, err := thing.history.metrics()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/metrics") {
+		list := []grafanaMetric{}
+		for _, m := range metrics {
+			list = append(list, grafanaMetric{Label: m, Value: m})
+		}
+		grafanaReply(w, list)
+		return
+	}
+
+	if metrics == nil {
+		metrics = []string{}
+	}
+	grafanaReply(w, metrics)
+}
+
+// Query time series on POST /{id}/grafana/query
+func (t *Thing) grafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var q grafanaQuery
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thing := t.grafanaThing(w, r)
+	if thing == nil {
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Bad query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := []grafanaSeries{}
+	for _, target := range q.Targets {
+		if target.Target == "" {
+			continue
+		}
+		series, err := thing.history.series(target.Target,
+			q.Range.From, q.Range.To, q.MaxDataPoints)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp = append(resp, series)
+	}
+
+	grafanaReply(w, resp)
+}
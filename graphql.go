@@ -0,0 +1,1151 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GraphQL endpoint, at /graphql on a bridge's, or Thing Prime's, private
+// server, for fleet UIs.  One query gets the children, their identities,
+// connection status, and latest state; a subscription streams what the
+// children broadcast.  The schema:
+//
+//	type Query {
+//		thing: Thing!                   # the bridge, or Thing Prime
+//		children(online: Boolean, group: String): [Thing!]!
+//		child(id: String!): Thing
+//		blocked: [String!]!
+//	}
+//
+//	type Subscription {
+//		events(id: String, msgs: [String!]): Event!
+//	}
+//
+//	type Thing {
+//		id: String!
+//		model: String!
+//		name: String!
+//		online: Boolean!
+//		powerLost: Boolean!
+//		startupTime: String!            # RFC 3339
+//		tags: [String!]!
+//		groups: [String!]!
+//		state: JSON                     # _ReplyState; null if no reply
+//	}
+//
+//	type Event {
+//		id: String!                     # child's Id
+//		msg: String!
+//		message: JSON!                  # the message broadcast
+//		thing: Thing!
+//	}
+//
+// A Thing Prime's only child is the Thing it's attached to.  Queries are
+// POSTed as JSON, {"query", "variables", "operationName"}, or sent with GET.
+// A subscription is answered with Server-Sent Events, an "event: next" for
+// each message, as in the GraphQL over SSE protocol.  Variables, fragments,
+// and @skip and @include work; introspection and mutations don't.
+
+// Parsed GraphQL document
+type gqlDoc struct {
+	ops   []*gqlOp
+	frags map[string]*gqlFrag
+}
+
+type gqlOp struct {
+	// query, mutation, or subscription
+	kind string
+	name string
+	vars []*gqlVarDef
+	sel  []*gqlSel
+}
+
+type gqlVarDef struct {
+	name    string
+	nonNull bool
+	def     interface{}
+	hasDef  bool
+}
+
+type gqlFrag struct {
+	on  string
+	sel []*gqlSel
+}
+
+// Selection: a field, a fragment spread, or an inline fragment
+type gqlSel struct {
+	alias  string
+	name   string
+	args   map[string]interface{}
+	dirs   map[string]map[string]interface{}
+	sel    []*gqlSel
+	spread string
+	inline bool
+	on     string
+}
+
+// Field's key in the result
+func (s *gqlSel) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// Variable, in a value
+type gqlVar string
+
+// Token kinds
+const (
+	gqlEOF = iota
+	gqlName
+	gqlStr
+	gqlNum
+	gqlPunct
+)
+
+type gqlParser struct {
+	src  string
+	pos  int
+	kind int
+	// Token; a string token is unquoted
+	tok string
+	err error
+}
+
+func (p *gqlParser) fail(format string, a ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("Syntax error at %d: %s", p.pos,
+			fmt.Sprintf(format, a...))
+	}
+	p.kind, p.tok = gqlEOF, ""
+}
+
+func gqlNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
+
+// Next token
+func (p *gqlParser) next() {
+	if p.err != nil {
+		return
+	}
+
+	// Commas are whitespace, in GraphQL
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if strings.IndexByte(" \t\r\n,", c) >= 0 {
+			p.pos++
+		} else {
+			break
+		}
+	}
+
+	if p.pos == len(p.src) {
+		p.kind, p.tok = gqlEOF, ""
+		return
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+
+	switch {
+	case gqlNameChar(c) && !(c >= '0' && c <= '9'):
+		for p.pos < len(p.src) && gqlNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.kind, p.tok = gqlName, p.src[start:p.pos]
+	case c == '-' || (c >= '0' && c <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		p.kind, p.tok = gqlNum, p.src[start:p.pos]
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			p.fail("Unterminated string")
+			return
+		}
+		p.kind, p.tok = gqlStr, p.src[p.pos+3:p.pos+3+end]
+		p.pos += end + 6
+	case c == '"':
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != '"'; p.pos++ {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		if p.pos >= len(p.src) {
+			p.fail("Unterminated string")
+			return
+		}
+		p.pos++
+		// String escapes are JSON's
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &p.tok); err != nil {
+			p.fail("Bad string %s", p.src[start:p.pos])
+			return
+		}
+		p.kind = gqlStr
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.kind, p.tok = gqlPunct, "..."
+	case strings.IndexByte("!$():=@[]{}", c) >= 0:
+		p.pos++
+		p.kind, p.tok = gqlPunct, string(c)
+	default:
+		p.fail("Unexpected character %q", c)
+	}
+}
+
+func (p *gqlParser) is(punct string) bool {
+	return p.kind == gqlPunct && p.tok == punct
+}
+
+func (p *gqlParser) skip(punct string) bool {
+	if p.is(punct) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(punct string) {
+	if !p.skip(punct) {
+		p.fail("Expected %s, got %q", punct, p.tok)
+	}
+}
+
+func (p *gqlParser) name() string {
+	if p.kind != gqlName {
+		p.fail("Expected name, got %q", p.tok)
+		return ""
+	}
+	name := p.tok
+	p.next()
+	return name
+}
+
+func (p *gqlParser) keyword(word string) {
+	if p.kind != gqlName || p.tok != word {
+		p.fail("Expected %s, got %q", word, p.tok)
+		return
+	}
+	p.next()
+}
+
+func parseGraphQL(src string) (*gqlDoc, error) {
+	p := &gqlParser{src: src}
+	doc := &gqlDoc{frags: make(map[string]*gqlFrag)}
+
+	p.next()
+	for p.kind != gqlEOF {
+		switch {
+		case p.is("{"):
+			doc.ops = append(doc.ops, &gqlOp{kind: "query",
+				sel: p.selections()})
+		case p.kind == gqlName && p.tok == "fragment":
+			p.next()
+			name := p.name()
+			p.keyword("on")
+			frag := &gqlFrag{on: p.name()}
+			p.directives()
+			frag.sel = p.selections()
+			doc.frags[name] = frag
+		case p.kind == gqlName && (p.tok == "query" ||
+			p.tok == "mutation" || p.tok == "subscription"):
+			op := &gqlOp{kind: p.tok}
+			p.next()
+			if p.kind == gqlName {
+				op.name = p.name()
+			}
+			if p.skip("(") {
+				for !p.skip(")") && p.err == nil {
+					op.vars = append(op.vars, p.varDef())
+				}
+			}
+			p.directives()
+			op.sel = p.selections()
+			doc.ops = append(doc.ops, op)
+		default:
+			p.fail("Unexpected %q", p.tok)
+		}
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	if len(doc.ops) == 0 {
+		return nil, errors.New("No operation in query")
+	}
+
+	for _, op := range doc.ops {
+		if err := doc.checkSpreads(op.sel); err != nil {
+			return nil, err
+		}
+	}
+	for _, frag := range doc.frags {
+		if err := doc.checkSpreads(frag.sel); err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// Fragments spread must be defined
+func (d *gqlDoc) checkSpreads(sels []*gqlSel) error {
+	for _, s := range sels {
+		if s.spread != "" && d.frags[s.spread] == nil {
+			return fmt.Errorf("Unknown fragment %s", s.spread)
+		}
+		if err := d.checkSpreads(s.sel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *gqlDoc) operation(name string) (*gqlOp, error) {
+	if name == "" {
+		if len(d.ops) > 1 {
+			return nil, errors.New("operationName is required for more than one operation")
+		}
+		return d.ops[0], nil
+	}
+	for _, op := range d.ops {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown operation %s", name)
+}
+
+func (p *gqlParser) varDef() *gqlVarDef {
+	p.expect("$")
+	v := &gqlVarDef{name: p.name()}
+	p.expect(":")
+	v.nonNull = p.typeRef()
+	if p.skip("=") {
+		v.def, v.hasDef = p.value(true), true
+	}
+	p.directives()
+	return v
+}
+
+// Skip type reference; return whether it's non-null
+func (p *gqlParser) typeRef() bool {
+	if p.skip("[") {
+		p.typeRef()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	return p.skip("!")
+}
+
+func (p *gqlParser) selections() []*gqlSel {
+	var sels []*gqlSel
+
+	p.expect("{")
+	for !p.skip("}") && p.err == nil {
+		sels = append(sels, p.selection())
+	}
+
+	return sels
+}
+
+func (p *gqlParser) selection() *gqlSel {
+	s := &gqlSel{}
+
+	if p.skip("...") {
+		if p.kind == gqlName && p.tok != "on" {
+			s.spread = p.name()
+			s.dirs = p.directives()
+			return s
+		}
+		s.inline = true
+		if p.kind == gqlName {
+			p.next()
+			s.on = p.name()
+		}
+		s.dirs = p.directives()
+		s.sel = p.selections()
+		return s
+	}
+
+	s.name = p.name()
+	if p.skip(":") {
+		s.alias, s.name = s.name, p.name()
+	}
+	if p.is("(") {
+		s.args = p.arguments()
+	}
+	s.dirs = p.directives()
+	if p.is("{") {
+		s.sel = p.selections()
+	}
+
+	return s
+}
+
+func (p *gqlParser) arguments() map[string]interface{} {
+	args := make(map[string]interface{})
+
+	p.expect("(")
+	for !p.skip(")") && p.err == nil {
+		name := p.name()
+		p.expect(":")
+		args[name] = p.value(false)
+	}
+
+	return args
+}
+
+func (p *gqlParser) directives() map[string]map[string]interface{} {
+	var dirs map[string]map[string]interface{}
+
+	for p.skip("@") {
+		if dirs == nil {
+			dirs = make(map[string]map[string]interface{})
+		}
+		name := p.name()
+		var args map[string]interface{}
+		if p.is("(") {
+			args = p.arguments()
+		}
+		dirs[name] = args
+	}
+
+	return dirs
+}
+
+// Value; a constant value can't have variables.  Values are as JSON decodes
+// them; an enum value is a string.
+func (p *gqlParser) value(constant bool) interface{} {
+	switch {
+	case p.kind == gqlStr:
+		s := p.tok
+		p.next()
+		return s
+	case p.kind == gqlNum:
+		f, err := strconv.ParseFloat(p.tok, 64)
+		if err != nil {
+			p.fail("Bad number %s", p.tok)
+			return nil
+		}
+		p.next()
+		return f
+	case p.kind == gqlName:
+		switch name := p.name(); name {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		default:
+			return name
+		}
+	case !constant && p.skip("$"):
+		return gqlVar(p.name())
+	case p.skip("["):
+		list := []interface{}{}
+		for !p.skip("]") && p.err == nil {
+			list = append(list, p.value(constant))
+		}
+		return list
+	case p.skip("{"):
+		obj := make(map[string]interface{})
+		for !p.skip("}") && p.err == nil {
+			name := p.name()
+			p.expect(":")
+			obj[name] = p.value(constant)
+		}
+		return obj
+	}
+
+	p.fail("Unexpected %q", p.tok)
+	return nil
+}
+
+// Result object, keeping the fields in the order queried
+type gqlResult []gqlMember
+
+type gqlMember struct {
+	key string
+	val interface{}
+}
+
+func (r gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	for i, m := range r {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.key)
+		val, err := json.Marshal(m.val)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+type gqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// GraphQL object type
+type gqlObject interface {
+	gqlType() string
+	// Value of field name, with arguments args.  A value is a scalar (as
+	// JSON encodes it), a gqlObject, or a []gqlObject.
+	gqlField(name string, args map[string]interface{}) (interface{}, error)
+}
+
+func gqlUnknown(typ, name string) error {
+	return fmt.Errorf("Cannot query field %s on type %s", name, typ)
+}
+
+// Execution of an operation
+type gqlExec struct {
+	frags map[string]*gqlFrag
+	vars  map[string]interface{}
+	sync.Mutex
+	errs []gqlError
+}
+
+func newGqlExec(doc *gqlDoc, op *gqlOp, given map[string]interface{}) (*gqlExec, error) {
+	e := &gqlExec{frags: doc.frags, vars: make(map[string]interface{})}
+
+	for _, v := range op.vars {
+		val, ok := given[v.name]
+		if !ok && v.hasDef {
+			val = v.def
+		}
+		if v.nonNull && val == nil {
+			return nil, fmt.Errorf("Variable $%s is required", v.name)
+		}
+		e.vars[v.name] = val
+	}
+
+	return e, nil
+}
+
+func (e *gqlExec) fail(path []interface{}, err error) {
+	e.Lock()
+	e.errs = append(e.errs, gqlError{Message: err.Error(), Path: path})
+	e.Unlock()
+}
+
+// Value, with variables substituted
+func (e *gqlExec) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVar:
+		return e.vars[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = e.value(v[i])
+		}
+		return list
+	case map[string]interface{}:
+		return e.args(v)
+	}
+	return v
+}
+
+func (e *gqlExec) args(args map[string]interface{}) map[string]interface{} {
+	vals := make(map[string]interface{})
+	for name, v := range args {
+		vals[name] = e.value(v)
+	}
+	return vals
+}
+
+// Selected, for @skip and @include
+func (e *gqlExec) selected(s *gqlSel) bool {
+	if d, ok := s.dirs["skip"]; ok && e.value(d["if"]) == true {
+		return false
+	}
+	if d, ok := s.dirs["include"]; ok && e.value(d["if"]) != true {
+		return false
+	}
+	return true
+}
+
+// Fields selected on an object of type typ, with fragments flattened, and
+// fields with the same key merged
+func (e *gqlExec) collect(typ string, sels, fields []*gqlSel,
+	spread map[string]bool) []*gqlSel {
+
+	for _, s := range sels {
+		if !e.selected(s) {
+			continue
+		}
+		switch {
+		case s.spread != "":
+			frag := e.frags[s.spread]
+			if spread[s.spread] || frag.on != typ {
+				continue
+			}
+			spread[s.spread] = true
+			fields = e.collect(typ, frag.sel, fields, spread)
+		case s.inline:
+			if s.on == "" || s.on == typ {
+				fields = e.collect(typ, s.sel, fields, spread)
+			}
+		default:
+			merged := false
+			for i, f := range fields {
+				if f.key() == s.key() {
+					m := *f
+					m.sel = append(append([]*gqlSel{}, f.sel...), s.sel...)
+					fields[i] = &m
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				fields = append(fields, s)
+			}
+		}
+	}
+
+	return fields
+}
+
+func gqlPath(path []interface{}, elem interface{}) []interface{} {
+	return append(append([]interface{}{}, path...), elem)
+}
+
+func (e *gqlExec) object(obj gqlObject, sels []*gqlSel, path []interface{}) gqlResult {
+	fields := e.collect(obj.gqlType(), sels, nil, make(map[string]bool))
+	result := make(gqlResult, len(fields))
+
+	for i, f := range fields {
+		result[i].key = f.key()
+		if f.name == "__typename" {
+			result[i].val = obj.gqlType()
+			continue
+		}
+		fpath := gqlPath(path, f.key())
+		v, err := obj.gqlField(f.name, e.args(f.args))
+		if err != nil {
+			e.fail(fpath, err)
+			continue
+		}
+		result[i].val = e.complete(v, f, fpath)
+	}
+
+	return result
+}
+
+// Complete field f's value v, resolving objects' selections.  The objects
+// in a list are resolved concurrently, as a field, such as a child's state,
+// may wait on the child.
+func (e *gqlExec) complete(v interface{}, f *gqlSel, path []interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case gqlObject:
+		if len(f.sel) == 0 {
+			e.fail(path, fmt.Errorf("Field %s needs a selection", f.name))
+			return nil
+		}
+		return e.object(v, f.sel, path)
+	case []gqlObject:
+		if len(f.sel) == 0 {
+			e.fail(path, fmt.Errorf("Field %s needs a selection", f.name))
+			return nil
+		}
+		list := make([]interface{}, len(v))
+		var wg sync.WaitGroup
+		for i := range v {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				list[i] = e.object(v[i], f.sel, gqlPath(path, i))
+			}(i)
+		}
+		wg.Wait()
+		return list
+	}
+
+	if len(f.sel) > 0 {
+		e.fail(path, fmt.Errorf("Field %s has no subfields", f.name))
+		return nil
+	}
+	return v
+}
+
+// String argument; "" if not given
+func gqlString(args map[string]interface{}, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("Argument %s must be a String", name)
+}
+
+// List of String argument; a String is a list of one
+func gqlStrings(args map[string]interface{}, name string) ([]string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := make([]string, len(v))
+		for i := range v {
+			s, ok := v[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("Argument %s must be a list of String", name)
+			}
+			list[i] = s
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("Argument %s must be a list of String", name)
+}
+
+// Boolean argument, and whether it's given
+func gqlBool(args map[string]interface{}, name string) (bool, bool, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return false, false, nil
+	case bool:
+		return v, true, nil
+	}
+	return false, false, fmt.Errorf("Argument %s must be a Boolean", name)
+}
+
+// Thing, as a GraphQL object
+type gqlThing struct {
+	thing *Thing
+	// Bridge the Thing is a child of, if any
+	bridge *bridge
+}
+
+// Whether the Thing is online; a bridge's child is read under the bridge's
+// lock
+func (g *gqlThing) online() bool {
+	if g.bridge != nil {
+		return g.bridge.childOnline(g.thing)
+	}
+	return g.thing.online
+}
+
+func (g *gqlThing) gqlType() string {
+	return "Thing"
+}
+
+func (g *gqlThing) gqlField(name string, args map[string]interface{}) (interface{}, error) {
+	t := g.thing
+
+	switch name {
+	case "id":
+		return t.id, nil
+	case "model":
+		return t.model, nil
+	case "name":
+		return t.name, nil
+	case "online":
+		return g.online(), nil
+	case "powerLost":
+		return !g.online() && t.powerLost, nil
+	case "startupTime":
+		return t.startupTime.Format(time.RFC3339), nil
+	case "tags":
+		return append([]string{}, t.tags...), nil
+	case "groups":
+		if g.bridge == nil {
+			return []string{}, nil
+		}
+		return g.bridge.childGroups(t), nil
+	case "state":
+		return g.state(), nil
+	}
+
+	return nil, gqlUnknown("Thing", name)
+}
+
+// Thing's state, as Thing replies to GetState; nil if there's no reply
+func (g *gqlThing) state() interface{} {
+	t := g.thing
+
+	if t.isPrime && !g.online() {
+		return nil
+	}
+
+	msg := Msg{Msg: GetState}
+	reply, _ := t.apiExchange(newPacket(t.bus, newApiSocket(0), &msg), apiTimeout)
+	if reply == nil {
+		return nil
+	}
+	return json.RawMessage(reply)
+}
+
+type gqlQuery struct {
+	thing *Thing
+}
+
+func (q *gqlQuery) gqlType() string {
+	return "Query"
+}
+
+func (q *gqlQuery) gqlField(name string, args map[string]interface{}) (interface{}, error) {
+	t := q.thing
+
+	switch name {
+	case "thing":
+		return &gqlThing{thing: t}, nil
+	case "children":
+		online, hasOnline, err := gqlBool(args, "online")
+		if err != nil {
+			return nil, err
+		}
+		group, err := gqlString(args, "group")
+		if err != nil {
+			return nil, err
+		}
+		list := []gqlObject{}
+		for _, child := range q.children() {
+			if hasOnline && child.online() != online {
+				continue
+			}
+			if group != "" && (child.bridge == nil ||
+				!child.bridge.inGroup(child.thing, group)) {
+				continue
+			}
+			list = append(list, child)
+		}
+		return list, nil
+	case "child":
+		id, err := gqlString(args, "id")
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, errors.New("Argument id is required")
+		}
+		for _, child := range q.children() {
+			if child.thing.id == id {
+				return child, nil
+			}
+		}
+		return nil, nil
+	case "blocked":
+		if !t.isBridge {
+			return []string{}, nil
+		}
+		return t.bridge.blockedIds(), nil
+	}
+
+	return nil, gqlUnknown("Query", name)
+}
+
+// Bridge's children, sorted by Id, or the Thing Thing Prime is attached to
+func (q *gqlQuery) children() []*gqlThing {
+	t := q.thing
+	var things []*gqlThing
+
+	switch {
+	case t.isBridge:
+		for _, child := range t.bridge.childThings() {
+			things = append(things, &gqlThing{thing: child,
+				bridge: t.bridge})
+		}
+		sort.Slice(things, func(i, j int) bool {
+			return things[i].thing.id < things[j].thing.id
+		})
+	case t.isPrime && t.primeId != "":
+		things = append(things, &gqlThing{thing: t})
+	}
+
+	return things
+}
+
+// A message a child broadcast, for a subscription
+type gqlEvent struct {
+	child *gqlThing
+	msg   string
+	data  json.RawMessage
+}
+
+func (ev *gqlEvent) gqlType() string {
+	return "Event"
+}
+
+func (ev *gqlEvent) gqlField(name string, args map[string]interface{}) (interface{}, error) {
+	switch name {
+	case "id":
+		return ev.child.thing.id, nil
+	case "msg":
+		return ev.msg, nil
+	case "message":
+		return ev.data, nil
+	case "thing":
+		return ev.child, nil
+	}
+	return nil, gqlUnknown("Event", name)
+}
+
+// GraphQL for a bridge or Thing Prime
+type graphql struct {
+	thing *Thing
+	sync.Mutex
+	subs map[*gqlSub]bool
+}
+
+// Subscription to events, for a child's Id and messages, if given
+type gqlSub struct {
+	id     string
+	msgs   map[string]bool
+	events chan *gqlEvent
+}
+
+func newGraphQL(t *Thing) *graphql {
+	g := &graphql{thing: t, subs: make(map[*gqlSub]bool)}
+	if t.isPrime {
+		t.bus.tap(g.tap(&gqlThing{thing: t}))
+	}
+	return g
+}
+
+// Watch bridge child's broadcasts
+func (g *graphql) watch(child *Thing, b *bridge) {
+	child.bus.tap(g.tap(&gqlThing{thing: child, bridge: b}))
+}
+
+func (g *graphql) tap(child *gqlThing) func(*Packet) {
+	return func(p *Packet) {
+		var msg Msg
+		p.Unmarshal(&msg)
+
+		g.Lock()
+		defer g.Unlock()
+
+		for sub := range g.subs {
+			if sub.id != "" && sub.id != child.thing.id {
+				continue
+			}
+			if len(sub.msgs) > 0 && !sub.msgs[msg.Msg] {
+				continue
+			}
+			ev := &gqlEvent{child: child, msg: msg.Msg,
+				data: append(json.RawMessage{}, p.msg...)}
+			select {
+			case sub.events <- ev:
+			default:
+				g.thing.log.printf("GraphQL subscription behind; dropped %s",
+					msg.Msg)
+			}
+		}
+	}
+}
+
+// GraphQL request, as POSTed
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+func gqlFail(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(gqlResponse{Errors: []gqlError{{Message: msg}}})
+}
+
+func (g *graphql) handler(w http.ResponseWriter, r *http.Request) {
+	var req gqlRequest
+
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				gqlFail(w, http.StatusBadRequest, "Bad variables: "+err.Error())
+				return
+			}
+		}
+	case "POST":
+		body := r.Body
+		if max := g.thing.Cfg.MaxMsgSize; max > 0 {
+			body = http.MaxBytesReader(w, body, int64(max))
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			gqlFail(w, http.StatusRequestEntityTooLarge,
+				"Reading request: "+err.Error())
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			req.Query = string(data)
+		} else if err := json.Unmarshal(data, &req); err != nil {
+			gqlFail(w, http.StatusBadRequest, "Bad request: "+err.Error())
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		gqlFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		gqlFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e, err := newGqlExec(doc, op, req.Variables)
+	if err != nil {
+		gqlFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch op.kind {
+	case "query":
+		data := e.object(&gqlQuery{thing: g.thing}, op.sel, nil)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gqlResponse{Data: data, Errors: e.errs})
+	case "subscription":
+		g.subscribe(w, r, e, op)
+	default:
+		gqlFail(w, http.StatusBadRequest, "Mutations aren't supported")
+	}
+}
+
+// Stream events for the subscription, until the request ends
+func (g *graphql) subscribe(w http.ResponseWriter, r *http.Request,
+	e *gqlExec, op *gqlOp) {
+
+	t := g.thing
+
+	fields := e.collect("Subscription", op.sel, nil, make(map[string]bool))
+	if len(fields) != 1 || fields[0].name != "events" {
+		gqlFail(w, http.StatusBadRequest, "Subscription must select events, only")
+		return
+	}
+	f := fields[0]
+
+	args := e.args(f.args)
+	id, err := gqlString(args, "id")
+	if err != nil {
+		gqlFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	msgs, err := gqlStrings(args, "msgs")
+	if err != nil {
+		gqlFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if !t.bus.reserve() {
+		t.log.printf("GraphQL subscription rejected [%s]; %d connections max",
+			r.RemoteAddr, t.Cfg.MaxConnections)
+		gqlFail(w, http.StatusServiceUnavailable, "Too many connections")
+		return
+	}
+	defer t.bus.release()
+
+	sub := &gqlSub{id: id, msgs: make(map[string]bool),
+		events: make(chan *gqlEvent, 100)}
+	for _, msg := range msgs {
+		sub.msgs[msg] = true
+	}
+
+	g.Lock()
+	g.subs[sub] = true
+	g.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	t.log.printf("GraphQL subscription opened [%s]", r.RemoteAddr)
+
+	var ping <-chan time.Time
+	if t.Cfg.PingInterval > 0 {
+		ticker := time.NewTicker(time.Duration(t.Cfg.PingInterval) * time.Second)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+loop:
+	for {
+		select {
+		case <-r.Context().Done():
+			break loop
+		case ev := <-sub.events:
+			e.errs = nil
+			path := []interface{}{f.key()}
+			data := gqlResult{{key: f.key(), val: e.complete(ev, f, path)}}
+			resp, _ := json.Marshal(gqlResponse{Data: data, Errors: e.errs})
+			if _, err := fmt.Fprintf(w, "event: next\ndata: %s\n\n", resp); err != nil {
+				break loop
+			}
+			flusher.Flush()
+		case <-ping:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				break loop
+			}
+			flusher.Flush()
+		}
+	}
+
+	g.Lock()
+	delete(g.subs, sub)
+	g.Unlock()
+
+	t.log.printf("GraphQL subscription closed [%s]", r.RemoteAddr)
+}
@@ -0,0 +1,142 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphQLParse(t *testing.T) {
+	good := []string{
+		`{ thing { id } }`,
+		`query Q($id: String! = "x", $on: [Boolean]) { child(id: $id) { ...F @skip(if: $on) } }
+		 fragment F on Thing { id, name # comment
+		 }`,
+		`subscription { events(msgs: ["A", "B"]) { ... on Event { msg } } }`,
+		`{ a: thing { b: id } children(online: true, group: """g""") { id } }`,
+	}
+	bad := []string{
+		``,
+		`{ thing { id }`,
+		`{ thing { ...Missing } }`,
+		`{ child(id: "x) { id } }`,
+		`query { child(id: 1.2.3) { id } }`,
+		`fragment F Thing { id }`,
+		`{ thing % }`,
+	}
+
+	for _, q := range good {
+		if _, err := parseGraphQL(q); err != nil {
+			t.Errorf("%s: %s", q, err)
+		}
+	}
+	for _, q := range bad {
+		if _, err := parseGraphQL(q); err == nil {
+			t.Errorf("%s: parsed", q)
+		}
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	child := NewThing(&lamp{})
+	child.Cfg.Id = "lamp03"
+	child.Cfg.Model = "lamp"
+	child.Cfg.PortPrivate = 8096
+	child.Cfg.Advertise = false
+	go child.Run()
+
+	hub := NewThing(&lampHub{})
+	hub.Cfg.Id = "hub03"
+	if err := hub.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+
+	hub.bridge.lanAttach([]DiscoveredThing{{Id: "lamp03", Model: "lamp",
+		Name: "Thingy", Host: "127.0.0.1", PortPrivate: 8096}})
+	if !waitOnline(hub, "lamp03", true) {
+		t.Fatal("LAN Thing didn't attach")
+	}
+
+	post := func(body string) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		hub.web.private.mux.ServeHTTP(w, r)
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	code, got := post(`{"query":"query($id: String!) { hub: thing { id } ` +
+		`children { id model online state ...f } child(id: $id) { name groups } ` +
+		`blocked } fragment f on Thing { __typename }","variables":{"id":"lamp03"}}`)
+	want := `{"data":{"hub":{"id":"hub03"},"children":[{"id":"lamp03",` +
+		`"model":"lamp","online":true,"state":{"Msg":"_ReplyState","On":false},` +
+		`"__typename":"Thing"}],"child":{"name":"Thingy","groups":[]},"blocked":[]}}`
+	if code != http.StatusOK || got != want {
+		t.Errorf("Got %d %s, want %s", code, got, want)
+	}
+
+	code, got = post(`{"query":"{ children(online: false) { id } child(id: \"nobody\") { id } }"}`)
+	if want := `{"data":{"children":[],"child":null}}`; got != want {
+		t.Errorf("Got %d %s, want %s", code, got, want)
+	}
+
+	code, got = post(`{"query":"{ children { color } }"}`)
+	if code != http.StatusOK || !strings.Contains(got,
+		`"errors":[{"message":"Cannot query field color on type Thing","path":["children",0,"color"]}]`) {
+		t.Errorf("Unknown field: %d %s", code, got)
+	}
+
+	if code, got = post(`{"query":"mutation { detach }"}`); code != http.StatusBadRequest {
+		t.Errorf("Mutation: %d %s", code, got)
+	}
+	if code, got = post(`{"query":"{ thing { id "}`); code != http.StatusBadRequest {
+		t.Errorf("Syntax error: %d %s", code, got)
+	}
+
+	// Subscribe to a child's Toggles
+
+	ts := httptest.NewServer(hub.web.private.mux)
+	defer ts.Close()
+
+	q := url.QueryEscape(`subscription { events(id: "lamp03", msgs: "Toggle") { id msg message } }`)
+	resp, err := http.Get(ts.URL + "/graphql?query=" + q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Subscription Content-Type %s", ct)
+	}
+
+	lamp := hub.getChild("lamp03")
+	lamp.bus.broadcast(newPacket(lamp.bus, nil, &Msg{Msg: "Other"}))
+	lamp.bus.broadcast(newPacket(lamp.bus, nil, &Msg{Msg: "Toggle"}))
+
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	want = `data: {"data":{"events":{"id":"lamp03","msg":"Toggle","message":{"Msg":"Toggle"}}}}`
+	if lines[0] != "event: next" || lines[1] != want {
+		t.Errorf("Got %q, want %s", lines, want)
+	}
+}
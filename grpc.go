@@ -0,0 +1,410 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// gRPC API on the private server, for backend services, with Cfg.GRPC set.
+// The service is in proto/merle.proto; generate client stubs from it.
+//
+// The server speaks gRPC's framing over HTTP/2, without TLS (h2c), and
+// codes the service's few, flat, protobuf messages itself.  Compressed
+// messages aren't supported.  On a bridge, metadata "merle-id" picks a
+// child.
+
+const grpcService = "merle.Thing"
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+)
+
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// Protobuf wire types
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+var errProtobuf = errors.New("Bad protobuf message")
+
+func pbTag(b []byte, field int, wire int) []byte {
+	return pbVarint64(b, uint64(field)<<3|uint64(wire))
+}
+
+func pbVarint64(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// Append field, unless it's the zero value, as proto3 does
+func pbUint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return pbVarint64(pbTag(b, field, pbVarint), v)
+}
+
+func pbBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return pbUint(b, field, 1)
+}
+
+func pbString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = pbVarint64(pbTag(b, field, pbBytes), uint64(len(s)))
+	return append(b, s...)
+}
+
+// Decode a protobuf message, calling f for each varint and bytes field;
+// other fields are skipped
+func pbDecode(data []byte, f func(field int, v uint64, b []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtobuf
+		}
+		data = data[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case pbVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errProtobuf
+			}
+			data = data[n:]
+			f(field, v, nil)
+		case pbBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errProtobuf
+			}
+			f(field, 0, data[n:n+int(l)])
+			data = data[n+int(l):]
+		case pbFixed64:
+			if len(data) < 8 {
+				return errProtobuf
+			}
+			data = data[8:]
+		case pbFixed32:
+			if len(data) < 4 {
+				return errProtobuf
+			}
+			data = data[4:]
+		default:
+			return errProtobuf
+		}
+	}
+	return nil
+}
+
+// Read a length-prefixed gRPC message, of at most max bytes, if max is
+// non-zero
+func grpcRead(r io.Reader, max uint) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "Reading request: " + err.Error()}
+	}
+	if hdr[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "Compression not supported"}
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if max > 0 && uint(n) > max {
+		return nil, &grpcError{grpcResourceExhausted,
+			fmt.Sprintf("Message is %d bytes; max is %d", n, max)}
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "Reading request: " + err.Error()}
+	}
+	return data, nil
+}
+
+// Length-prefixed gRPC message
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// Msg for a JSON message; an empty Msg if there's none
+func grpcMsg(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	var msg Msg
+	jsonUnmarshal(data, &msg)
+	b := pbString(nil, 1, msg.Msg)
+	return pbString(b, 2, string(data))
+}
+
+// Serve gRPC on the private server
+func (w *web) handleGRPC(t *Thing) {
+	p := w.private
+	p.mux.PathPrefix("/" + grpcService + "/").HandlerFunc(t.grpcHandler)
+	// Wrap the server's handler, so gRPC calls are access logged too
+	p.server.Handler = h2c.NewHandler(p.server.Handler, &http2.Server{})
+}
+
+func (t *Thing) grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	var err error
+
+	thing := t
+	if id := r.Header.Get("merle-id"); id != "" && id != t.id {
+		thing = t.getChild(id)
+		if thing == nil {
+			err = &grpcError{grpcNotFound, "No Thing with Id " + id}
+		}
+	}
+
+	if err == nil {
+		switch path.Base(r.URL.Path) {
+		case "SendMsg":
+			err = thing.grpcSendMsg(w, r)
+		case "StreamMsgs":
+			err = thing.grpcStreamMsgs(w, r)
+		case "GetIdentity":
+			err = thing.grpcGetIdentity(w, r)
+		default:
+			err = &grpcError{grpcUnimplemented, "Unknown method " + r.URL.Path}
+		}
+	}
+
+	// Status goes in the trailers
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcUnavailable, err.Error()
+		var gerr *grpcError
+		if errors.As(err, &gerr) {
+			code = gerr.code
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(msg))
+}
+
+// SendMsg: receive the message as if from a WebSocket client, and return
+// Thing's reply, if any
+func (t *Thing) grpcSendMsg(w http.ResponseWriter, r *http.Request) error {
+	data, err := grpcRead(r.Body, t.Cfg.MaxMsgSize)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	timeout := apiTimeout
+	err = pbDecode(data, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			body = b
+		case 2:
+			if v > 0 {
+				timeout = time.Duration(v) * time.Millisecond
+			}
+		}
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	var msg Msg
+	if err := jsonUnmarshal(body, &msg); err != nil || msg.Msg == "" {
+		return &grpcError{grpcInvalidArgument,
+			"Message must be a JSON object with a Msg"}
+	}
+
+	pkt := &Packet{bus: t.bus, src: newApiSocket(sock_flag_private), msg: body}
+	t.log.printf("gRPC message: %.80s", pkt.String())
+
+	reply, _ := t.apiExchange(pkt, timeout)
+	_, err = w.Write(grpcFrame(grpcMsg(reply)))
+	return err
+}
+
+// GetIdentity
+func (t *Thing) grpcGetIdentity(w http.ResponseWriter, r *http.Request) error {
+	if _, err := grpcRead(r.Body, t.Cfg.MaxMsgSize); err != nil {
+		return err
+	}
+
+	id := t.identity()
+	b := pbString(nil, 1, id.Id)
+	b = pbString(b, 2, id.Model)
+	b = pbString(b, 3, id.Name)
+	b = pbBool(b, 4, id.Online)
+	b = pbUint(b, 5, uint64(id.StartupTime.UnixNano()/int64(time.Millisecond)))
+	b = pbBool(b, 6, id.Journal)
+	for _, tag := range id.Tags {
+		b = pbVarint64(pbTag(b, 7, pbBytes), uint64(len(tag)))
+		b = append(b, tag...)
+	}
+	b = pbUint(b, 8, uint64(id.Protocol))
+	b = pbString(b, 9, id.Version)
+
+	_, err := w.Write(grpcFrame(b))
+	return err
+}
+
+// Socket streaming Thing's broadcasts to a StreamMsgs call
+type grpcSocket struct {
+	thing *Thing
+	name  string
+	flags uint32
+	// Only these messages, if any
+	msgs map[string]bool
+	sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	closed  chan bool
+	once    sync.Once
+}
+
+func (s *grpcSocket) Send(p *Packet) error {
+	var msg Msg
+	p.Unmarshal(&msg)
+
+	// The stream starts with ReplyState, whatever the filter
+	if len(s.msgs) > 0 && !s.msgs[msg.Msg] && msg.Msg != ReplyState {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.w.Write(grpcFrame(grpcMsg(p.msg))); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *grpcSocket) Close() {
+	s.once.Do(func() { close(s.closed) })
+}
+
+func (s *grpcSocket) Name() string {
+	return s.name
+}
+
+// Flags are set from the stream's goroutine while broadcasts read them
+func (s *grpcSocket) Flags() uint32 {
+	return atomic.LoadUint32(&s.flags)
+}
+
+func (s *grpcSocket) SetFlags(flags uint32) {
+	atomic.StoreUint32(&s.flags, flags)
+}
+
+func (s *grpcSocket) Src() string {
+	return s.thing.id
+}
+
+// StreamMsgs: Thing's state, then Thing's broadcasts, until the call ends
+func (t *Thing) grpcStreamMsgs(w http.ResponseWriter, r *http.Request) error {
+	data, err := grpcRead(r.Body, t.Cfg.MaxMsgSize)
+	if err != nil {
+		return err
+	}
+
+	msgs := make(map[string]bool)
+	err = pbDecode(data, func(field int, v uint64, b []byte) {
+		if field == 1 {
+			msgs[string(b)] = true
+		}
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("Streaming unsupported")
+	}
+
+	if !t.bus.reserve() {
+		t.log.printf("gRPC stream rejected [%s]; %d connections max",
+			r.RemoteAddr, t.Cfg.MaxConnections)
+		return &grpcError{grpcUnavailable, "Too many connections"}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sock := &grpcSocket{
+		thing:   t,
+		name:    "grpc:" + r.RemoteAddr,
+		msgs:    msgs,
+		w:       w,
+		flusher: flusher,
+		closed:  make(chan bool),
+	}
+
+	t.log.printf("gRPC stream opened [%s]", sock.name)
+	t.bus.attach(sock)
+
+	// Broadcasts follow ReplyState
+	msg := Msg{Msg: GetState}
+	t.bus.receive(newPacket(t.bus, sock, &msg))
+
+	select {
+	case <-r.Context().Done():
+	case <-sock.closed:
+	}
+
+	t.log.printf("gRPC stream closed [%s]", sock.name)
+	t.bus.unplug(sock)
+
+	return nil
+}
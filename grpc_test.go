@@ -0,0 +1,174 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// gRPC client, over h2c
+type grpcClient struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+}
+
+func newGrpcClient(t *testing.T, url string) *grpcClient {
+	return &grpcClient{t: t, url: url, client: &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}}
+}
+
+func (c *grpcClient) call(ctx context.Context, method string, req []byte,
+	header map[string]string) *http.Response {
+
+	r, _ := http.NewRequestWithContext(ctx, "POST", c.url+"/merle.Thing/"+method,
+		bytes.NewReader(grpcFrame(req)))
+	r.Header.Set("Content-Type", "application/grpc")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// Unary call; the response message and grpc-status
+func (c *grpcClient) unary(method string, req []byte,
+	header map[string]string) ([]byte, string) {
+
+	resp := c.call(context.Background(), method, req, header)
+	defer resp.Body.Close()
+
+	msg, _ := grpcRead(resp.Body, 0)
+	io.Copy(ioutil.Discard, resp.Body)
+	return msg, resp.Trailer.Get("Grpc-Status")
+}
+
+// Decoded Msg's JSON
+func grpcJSON(t *testing.T, msg []byte) string {
+	var json string
+	if err := pbDecode(msg, func(field int, v uint64, b []byte) {
+		if field == 2 {
+			json = string(b)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return json
+}
+
+func TestGRPC(t *testing.T) {
+	thing := NewThing(&dimmer{got: make(chan string, 1)})
+	thing.Cfg.Id = testId
+	thing.Cfg.Model = "dimmer"
+	thing.Cfg.Tags = []string{"hall"}
+	thing.Cfg.GRPC = true
+	rec := &accessRecorder{}
+	thing.SetAccessLogger(rec)
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(thing.web.private.server.Handler)
+	defer ts.Close()
+	c := newGrpcClient(t, ts.URL)
+
+	// GetIdentity
+	msg, status := c.unary("GetIdentity", nil, nil)
+	if status != "0" {
+		t.Fatalf("GetIdentity status %s", status)
+	}
+	got := map[int]interface{}{}
+	pbDecode(msg, func(field int, v uint64, b []byte) {
+		if b != nil {
+			got[field] = string(b)
+		} else {
+			got[field] = v
+		}
+	})
+	if got[1] != testId || got[2] != "dimmer" || got[7] != "hall" ||
+		got[8] != uint64(ProtocolVersion) {
+		t.Errorf("Identity %v", got)
+	}
+	if e := rec.wait(1); len(e) == 0 || e[0].Server != "private" ||
+		!strings.HasSuffix(e[0].URI, "/GetIdentity") {
+		t.Errorf("Access log %+v", e)
+	}
+
+	// SendMsg, with and without a reply
+	req := pbString(nil, 1, `{"Msg":"_GetState"}`)
+	msg, status = c.unary("SendMsg", req, nil)
+	if json := grpcJSON(t, msg); status != "0" || json != `{"Msg":"_ReplyState"}` {
+		t.Errorf("SendMsg got %s, status %s", json, status)
+	}
+	req = pbString(nil, 1, `{"Msg":"Dim"}`)
+	if msg, status = c.unary("SendMsg", req, nil); status != "0" || len(msg) != 0 {
+		t.Errorf("SendMsg got %q, status %s", msg, status)
+	}
+
+	// Errors
+	if _, status = c.unary("SendMsg", pbString(nil, 1, `"Dim"`), nil); status != "3" {
+		t.Errorf("Bad message status %s", status)
+	}
+	if _, status = c.unary("Reboot", nil, nil); status != "12" {
+		t.Errorf("Unknown method status %s", status)
+	}
+	if _, status = c.unary("GetIdentity", nil, map[string]string{"merle-id": "other"}); status != "5" {
+		t.Errorf("Unknown Id status %s", status)
+	}
+
+	// StreamMsgs, for Click only, starts with ReplyState
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := c.call(ctx, "StreamMsgs", pbString(nil, 1, "Click"), nil)
+	msg, err := grpcRead(resp.Body, 0)
+	if err != nil || grpcJSON(t, msg) != `{"Msg":"_ReplyState"}` {
+		t.Fatalf("Stream started with %q, %v", msg, err)
+	}
+
+	thing.bus.broadcast(newPacket(thing.bus, nil, &Msg{Msg: "Dim"}))
+	thing.bus.broadcast(newPacket(thing.bus, nil, &Msg{Msg: "Click"}))
+	msg, err = grpcRead(resp.Body, 0)
+	if err != nil || grpcJSON(t, msg) != `{"Msg":"Click"}` {
+		t.Errorf("Stream got %q, %v", msg, err)
+	}
+
+	cancel()
+	resp.Body.Close()
+
+	// Stream's socket is unplugged
+	for i := 0; i < 100; i++ {
+		thing.bus.sockLock.RLock()
+		n := len(thing.bus.sockets)
+		thing.bus.sockLock.RUnlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Stream still plugged in")
+}
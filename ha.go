@@ -0,0 +1,108 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import "sync"
+
+// Election of the active Thing Prime, if Thing has a standby Thing Prime (see
+// Cfg.MotherHostStandby).  Thing keeps a tunnel to each Thing Prime, and each
+// Thing Prime connects back to Thing as mother.  Thing is the referee: the
+// first Thing Prime to connect is active and the others are standby.  If the
+// active Thing Prime's connection drops, the longest-connected standby is
+// promoted.  There's no fail-back; a promoted Thing Prime stays active while
+// it's connected.
+//
+// Both Thing Primes get Thing's broadcasts, so both keep Thing's state.
+// Thing only takes requests (_Get*) from a standby, so a standby's clients
+// can watch Thing but not change it.
+type election struct {
+	sync.Mutex
+	thing *Thing
+	// Mother sockets, in connect order.  First is active.
+	mothers []socketer
+	// Bumped on each change of active Thing Prime
+	term uint
+}
+
+func newElection(t *Thing) *election {
+	return &election{thing: t}
+}
+
+// Tell Thing Prime on sock its role.  Call with lock held.
+func (e *election) send(sock socketer, active bool) {
+	msg := MsgPrimeRole{Msg: SetPrimeRole, Active: active, Term: e.term}
+	if err := sock.Send(newPacket(e.thing.bus, nil, &msg)); err != nil {
+		e.thing.log.println("Sending Prime role failed:", err)
+	}
+}
+
+// Thing Prime connected on sock
+func (e *election) join(sock socketer) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.mothers = append(e.mothers, sock)
+
+	active := len(e.mothers) == 1
+	if active {
+		e.term++
+		e.thing.log.printf("Prime [%s] is active, term %d", sock.Name(), e.term)
+	} else {
+		e.thing.log.printf("Prime [%s] is standby", sock.Name())
+	}
+
+	e.send(sock, active)
+}
+
+// Thing Prime on sock disconnected
+func (e *election) leave(sock socketer) {
+	e.Lock()
+	defer e.Unlock()
+
+	for i, mother := range e.mothers {
+		if mother != sock {
+			continue
+		}
+		e.mothers = append(e.mothers[:i], e.mothers[i+1:]...)
+		if i == 0 && len(e.mothers) > 0 {
+			e.term++
+			e.thing.log.printf("Failover: Prime [%s] is active, term %d",
+				e.mothers[0].Name(), e.term)
+			e.send(e.mothers[0], true)
+		}
+		return
+	}
+}
+
+func (e *election) isActive(sock socketer) bool {
+	e.Lock()
+	defer e.Unlock()
+	return len(e.mothers) > 0 && e.mothers[0] == sock
+}
+
+// Subscriber handler for SetPrimeRole, on Thing Prime.  The role is only
+// accepted from Thing.
+func (t *Thing) setPrimeRole(p *Packet) {
+	var msg MsgPrimeRole
+
+	if t.primeSock == nil || p.src != t.primeSock {
+		t.log.println("Ignoring Prime role; not from Thing")
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	if msg.Active {
+		t.log.printf("Prime is active, term %d", msg.Term)
+	} else {
+		t.log.println("Prime is standby")
+	}
+
+	t.isStandby = !msg.Active
+	t.sendStatus()
+}
@@ -0,0 +1,135 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Heartbeats (see Cfg.Heartbeat).  Thing broadcasts Heartbeat every
+// interval.  Thing Prime, and a bridge for each child, watch for Thing's
+// Heartbeats; once Thing has sent one, missing three in a row means Thing is
+// wedged, or the link is, even if the WebSocket looks fine.  The WebSocket
+// to Thing is closed, so Thing goes offline as if it had hung up, and Thing
+// reconnects when it can.
+
+// Heartbeats missed before Thing is taken as offline
+const heartbeatMisses = 3
+
+type heartbeat struct {
+	thing    *Thing
+	interval time.Duration
+	done     chan bool
+	beating  sync.WaitGroup
+	sync.Mutex
+	// On Thing Prime, fires when Thing's Heartbeats stop
+	timer *time.Timer
+}
+
+func newHeartbeat(thing *Thing, interval uint) *heartbeat {
+	return &heartbeat{
+		thing:    thing,
+		interval: time.Duration(interval) * time.Second,
+	}
+}
+
+func (h *heartbeat) start() error {
+	h.done = make(chan bool)
+	h.beating.Add(1)
+	go h.beat(h.done)
+	return nil
+}
+
+func (h *heartbeat) stop() {
+	close(h.done)
+	h.beating.Wait()
+}
+
+// Broadcast Heartbeat every interval, until done
+func (h *heartbeat) beat(done chan bool) {
+	defer h.beating.Done()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			msg := h.status()
+			newPacket(h.thing.bus, nil, &msg).Broadcast()
+		}
+	}
+}
+
+func (h *heartbeat) status() MsgHeartbeat {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	t := h.thing
+	return MsgHeartbeat{
+		Msg:        Heartbeat,
+		Id:         t.id,
+		Interval:   uint(h.interval / time.Second),
+		Uptime:     uint64(time.Since(t.startupTime) / time.Second),
+		MemAlloc:   mem.Alloc,
+		MemSys:     mem.Sys,
+		Goroutines: runtime.NumGoroutine(),
+		Tunnel:     t.tunnel.getStatus(),
+	}
+}
+
+// On Thing Prime, Thing's Heartbeat is heard on p.src.  Watch for the next.
+func (h *heartbeat) heard(p *Packet) {
+	var msg MsgHeartbeat
+	p.Unmarshal(&msg)
+
+	if msg.Interval == 0 {
+		return
+	}
+
+	sock := p.src
+	quiet := heartbeatMisses * time.Duration(msg.Interval) * time.Second
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(quiet, func() {
+		h.thing.log.printf("Heartbeats from [%s] stopped for %s; "+
+			"taking Thing offline", sock.Name(), quiet)
+		sock.Close()
+	})
+}
+
+// On Thing Prime, stop watching; Thing is gone
+func (h *heartbeat) unwatch() {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+}
+
+// Subscriber handler for Heartbeat, on Thing Prime (or a bridge's child).
+// Heartbeats are only taken from Thing.
+func (t *Thing) heartbeatHeard(p *Packet) {
+	if t.primeSock == nil || p.src != t.primeSock {
+		t.log.println("Ignoring heartbeat; not from Thing")
+		return
+	}
+	t.heartbeat.heard(p)
+	p.Broadcast()
+}
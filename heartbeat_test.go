@@ -0,0 +1,115 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func (s *closeSocket) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
+}
+
+func TestHeartbeat(t *testing.T) {
+	thing := NewThing(&toggler{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Heartbeat = 1
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := thing.heartbeat.status()
+	if msg.Msg != Heartbeat || msg.Id != testId || msg.Interval != 1 ||
+		msg.MemAlloc == 0 || msg.Goroutines == 0 ||
+		msg.Tunnel.State != TunnelDisabled {
+		t.Errorf("Heartbeat %+v", msg)
+	}
+
+	// Heartbeats aren't held for mother
+	dir, err := ioutil.TempDir("", "heartbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	thing.bus.outbox = newOutbox(thing, filepath.Join(dir, "outbox"), 10)
+	newPacket(thing.bus, nil, &msg).Broadcast()
+	if n := len(thing.bus.outbox.entries); n != 0 {
+		t.Errorf("Outbox holds %d", n)
+	}
+
+	sock := &recordSocket{flags: sock_flag_bcast | sock_flag_mother}
+	thing.bus.plugin(sock)
+	thing.heartbeat.interval = 10 * time.Millisecond
+	thing.heartbeat.start()
+	time.Sleep(50 * time.Millisecond)
+	thing.heartbeat.stop()
+
+	if len(sock.sent) == 0 {
+		t.Fatal("No Heartbeats")
+	}
+	var got MsgHeartbeat
+	if err := json.Unmarshal([]byte(sock.sent[0]), &got); err != nil ||
+		got.Msg != Heartbeat || got.Id != testId {
+		t.Errorf("Got %s", sock.sent[0])
+	}
+}
+
+func TestHeartbeatPrime(t *testing.T) {
+	thing := NewThing(&toggler{})
+	thing.Cfg.Id = testId
+	thing.Cfg.IsPrime = true
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &closeSocket{}
+	browser := &closeSocket{recordSocket: recordSocket{flags: sock_flag_bcast}}
+	thing.primeSock = remote
+	thing.bus.plugin(browser)
+
+	beat := func(src socketer) {
+		msg := MsgHeartbeat{Msg: Heartbeat, Id: testId, Interval: 60}
+		thing.bus.receive(newPacket(thing.bus, src, &msg))
+	}
+
+	// Only Thing's Heartbeats count
+	beat(browser)
+	if thing.heartbeat.timer != nil {
+		t.Fatal("Watching browser's Heartbeat")
+	}
+
+	// Thing's are passed on, and watched
+	beat(remote)
+	if len(browser.sent) != 1 {
+		t.Errorf("Browser got %q", browser.sent)
+	}
+
+	thing.heartbeat.Lock()
+	thing.heartbeat.timer.Reset(time.Millisecond)
+	thing.heartbeat.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	if !remote.isClosed() || browser.isClosed() {
+		t.Error("Thing not taken offline")
+	}
+
+	// Once Thing's gone, stop watching
+	remote = &closeSocket{}
+	thing.primeSock = remote
+	beat(remote)
+	thing.heartbeat.unwatch()
+	if thing.heartbeat.timer != nil {
+		t.Error("Still watching")
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// History configuration.  History records broadcast messages, with
+// timestamps, in a SQLite database.  Query history with a GetHistory message
+// or with an HTTP GET on the public web server:
+//
+//	/{id}/history?msg=Update&since=24h&limit=100
+//
+// "since" is a duration (e.g. "90m", "24h") back from now, or an RFC 3339
+// time.  "until" is an optional RFC 3339 time.  "limit" is the maximum number
+// of records returned, most recent records first.
+//
+// History can also be charted in Grafana, using a JSON datasource with URL
+// /{id}/grafana.  See grafana.go.  Positions in history can be exported as a
+// GPX or GeoJSON track with /{id}/track.  See track.go.
+type HistoryConfig struct {
+
+	// SQLite database file.  History is disabled if File is empty.  The
+	// default is "".
+	File string
+
+	// Messages to record.  If empty, all broadcast messages are recorded.
+	// The default is nil.
+	Msgs []string
+
+	// Records older than Retention seconds are pruned from history.  If
+	// Cfg.Archive is configured, pruned records are archived first.  If
+	// Retention is zero, records are never pruned.  The default is 604800
+	// (one week).
+	Retention uint
+}
+
+type history struct {
+	thing     *Thing
+	db        *sql.DB
+	msgs      map[string]bool
+	retention time.Duration
+	rows      chan historyRow
+	writer    sync.WaitGroup
+	ticker    *time.Ticker
+	done      chan bool
+}
+
+// A broadcast message waiting to be written to history
+type historyRow struct {
+	time time.Time
+	msg  string
+	data string
+}
+
+// Rows waiting to be written, at most.  Past that, broadcasts aren't
+// recorded until the writer catches up.
+const historyBacklog = 1000
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS history (
+	time INTEGER NOT NULL,
+	id   TEXT NOT NULL,
+	msg  TEXT NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS history_msg_time ON history (msg, time);
+`
+
+func newHistory(thing *Thing, cfg HistoryConfig) (*history, error) {
+	db, err := sql.Open("sqlite3", cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows only one writer
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	h := &history{
+		thing:     thing,
+		db:        db,
+		retention: time.Duration(cfg.Retention) * time.Second,
+		rows:      make(chan historyRow, historyBacklog),
+		done:      make(chan bool),
+	}
+
+	if len(cfg.Msgs) > 0 {
+		h.msgs = make(map[string]bool)
+		for _, msg := range cfg.Msgs {
+			h.msgs[msg] = true
+		}
+	}
+
+	return h, nil
+}
+
+// Row for p, if p's message is recorded
+func (h *history) row(p *Packet) (historyRow, bool) {
+	var msg Msg
+
+	p.Unmarshal(&msg)
+	if h.msgs != nil && !h.msgs[msg.Msg] {
+		return historyRow{}, false
+	}
+
+	return historyRow{time: time.Now(), msg: msg.Msg, data: p.String()}, true
+}
+
+// Bus tap to record broadcast messages.  The tap runs with the bus's sockets
+// locked, so rows are handed to the writer (see start) rather than written
+// here.
+func (h *history) tap(p *Packet) {
+	row, ok := h.row(p)
+	if !ok {
+		return
+	}
+
+	select {
+	case h.rows <- row:
+	default:
+		h.thing.log.println("History writer behind; dropping", row.msg)
+	}
+}
+
+func (h *history) insert(row historyRow) {
+	_, err := h.db.Exec("INSERT INTO history (time, id, msg, data) VALUES (?, ?, ?, ?)",
+		row.time.UnixNano(), h.thing.id, row.msg, row.data)
+	if err != nil {
+		h.thing.log.println("History insert failed:", err)
+	}
+}
+
+// Query history for messages of type msg in time range [since, until],
+// most recent first.  A zero until means now.  A zero limit means no limit.
+func (h *history) query(msg string, since, until time.Time,
+	limit uint) ([]HistoryRecord, error) {
+
+	if until.IsZero() {
+		until = time.Now()
+	}
+
+	q := "SELECT time, data FROM history WHERE msg = ? AND time >= ? AND time <= ? ORDER BY time DESC"
+	args := []interface{}{msg, since.UnixNano(), until.UnixNano()}
+	if limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := h.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []HistoryRecord{}
+	for rows.Next() {
+		var nsec int64
+		var data string
+		if err := rows.Scan(&nsec, &data); err != nil {
+			return nil, err
+		}
+		records = append(records, HistoryRecord{
+			Time: time.Unix(0, nsec),
+			Msg:  json.RawMessage(data),
+		})
+	}
+
+	return records, rows.Err()
+}
+
+// Subscriber handler for GetHistory
+func (h *history) getHistory(p *Packet) {
+	var req MsgGetHistory
+
+	p.Unmarshal(&req)
+
+	records, err := h.query(req.Type, req.Since, req.Until, req.Limit)
+	if err != nil {
+		h.thing.log.println("History query failed:", err)
+	}
+
+	resp := MsgHistory{Msg: ReplyHistory, Type: req.Type, Records: records}
+	p.Marshal(&resp).Reply()
+}
+
+// Prune records older than retention, archiving them first if archiving
+func (h *history) prune() {
+	if h.retention == 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-h.retention).UnixNano()
+
+	if archive := h.thing.archive; archive != nil {
+		rows, err := h.db.Query("SELECT time, id, data FROM history WHERE time < ? ORDER BY time",
+			cutoff)
+		if err != nil {
+			h.thing.log.println("History prune failed:", err)
+			return
+		}
+		for rows.Next() {
+			var nsec int64
+			var id, data string
+			if err := rows.Scan(&nsec, &id, &data); err != nil {
+				break
+			}
+			archive.add(archiveRecord{
+				Time: time.Unix(0, nsec),
+				Id:   id,
+				Msg:  json.RawMessage(data),
+			})
+		}
+		rows.Close()
+	}
+
+	_, err := h.db.Exec("DELETE FROM history WHERE time < ?", cutoff)
+	if err != nil {
+		h.thing.log.println("History prune failed:", err)
+	}
+}
+
+func (h *history) start() {
+	h.writer.Add(1)
+	go func() {
+		defer h.writer.Done()
+		for row := range h.rows {
+			h.insert(row)
+		}
+	}()
+
+	h.ticker = time.NewTicker(time.Minute)
+
+	go func() {
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-h.ticker.C:
+				h.prune()
+			}
+		}
+	}()
+}
+
+func (h *history) stop() {
+	h.ticker.Stop()
+	h.done <- true
+
+	// Write the rows still waiting
+	close(h.rows)
+	h.writer.Wait()
+
+	h.db.Close()
+}
+
+// Parse "since" query param as a duration back from now, or as a RFC 3339
+// time
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Dump Thing's history
+func (t *Thing) historyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// If this Thing is a Bridge, and the ID matches a child ID, then dump
+	// the child's history
+	child := t.getChild(id)
+	if child != nil {
+		child.historyHandler(w, r)
+		return
+	}
+
+	if id != "" && id != t.id {
+		http.Error(w, "Mismatch on Ids", http.StatusNotFound)
+		return
+	}
+
+	if t.history == nil {
+		http.Error(w, "No history", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+
+	since, err := parseSince(q.Get("since"))
+	if err != nil {
+		http.Error(w, "Bad since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var until time.Time
+	if s := q.Get("until"); s != "" {
+		until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Bad until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var limit uint64
+	if s := q.Get("limit"); s != "" {
+		limit, err = strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			http.Error(w, "Bad limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := t.history.query(q.Get("msg"), since, until, uint(limit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := MsgHistory{Msg: ReplyHistory, Type: q.Get("msg"), Records: records}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
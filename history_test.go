@@ -0,0 +1,244 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type update struct {
+	Msg   string
+	Value int
+}
+
+// Record p in history now, rather than by the writer
+func record(h *history, p *Packet) {
+	if row, ok := h.row(p); ok {
+		h.insert(row)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := HistoryConfig{
+		File: filepath.Join(dir, "history.db"),
+		Msgs: []string{"Update"},
+	}
+	h, err := newHistory(thing, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.start()
+	defer h.stop()
+
+	since := time.Now()
+
+	for i := 0; i < 3; i++ {
+		h.tap(newPacket(thing.bus, nil, &update{Msg: "Update", Value: i}))
+		h.tap(newPacket(thing.bus, nil, &Msg{Msg: "Ignored"}))
+	}
+
+	// Written by the writer, shortly
+	for i := 0; i < 20; i++ {
+		if records, _ := h.query("Update", since, time.Time{}, 0); len(records) == 3 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	records, err := h.query("Update", since, time.Time{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Got %d records, want 2", len(records))
+	}
+
+	// Most recent first
+	want := []string{`{"Msg":"Update","Value":2}`, `{"Msg":"Update","Value":1}`}
+	for i := range want {
+		if string(records[i].Msg) != want[i] {
+			t.Errorf("Record %d: got %s, want %s", i, records[i].Msg, want[i])
+		}
+	}
+
+	records, _ = h.query("Ignored", since, time.Time{}, 0)
+	if len(records) != 0 {
+		t.Errorf("Recorded unselected message")
+	}
+}
+
+func TestGrafana(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grafana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newHistory(thing, HistoryConfig{File: filepath.Join(dir, "history.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+
+	from := time.Now()
+	for i := 0; i < 3; i++ {
+		record(h, newPacket(thing.bus, nil, &update{Msg: "Update", Value: i}))
+	}
+
+	metrics, err := h.metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0] != "Update.Value" {
+		t.Fatalf("Got metrics %v", metrics)
+	}
+
+	series, err := h.series("Update.Value", from, time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series.Datapoints) != 3 {
+		t.Fatalf("Got %d datapoints, want 3", len(series.Datapoints))
+	}
+	for i, dp := range series.Datapoints {
+		if dp[0] != float64(i) {
+			t.Errorf("Datapoint %d: got %v, want %d", i, dp[0], i)
+		}
+	}
+
+	// MaxDataPoints covers the whole range, not just the latest points
+	series, _ = h.series("Update.Value", from, time.Now(), 2)
+	if len(series.Datapoints) != 2 || series.Datapoints[0][0] != 0 ||
+		series.Datapoints[1][0] != 1.5 {
+		t.Errorf("Got %v", series.Datapoints)
+	}
+}
+
+type position struct {
+	Msg  string
+	Lat  float64
+	Long float64
+}
+
+func TestTrack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newHistory(thing, HistoryConfig{File: filepath.Join(dir, "history.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+
+	since := time.Now()
+	for i := 0; i < 3; i++ {
+		record(h, newPacket(thing.bus, nil, &position{Msg: "Update",
+			Lat: float64(i), Long: float64(-i)}))
+	}
+	record(h, newPacket(thing.bus, nil, &update{Msg: "Update", Value: 4}))
+
+	points, err := h.track("Update", since, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("Got %d points, want 3", len(points))
+	}
+
+	// Oldest first
+	for i, pt := range points {
+		if pt.Lat != float64(i) || pt.Long != float64(-i) {
+			t.Errorf("Point %d: got %+v", i, pt)
+		}
+	}
+}
+
+func TestHistoryChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&dashboard{
+		html: `{{sparkline "Update" "Value" "24h"}}`,
+	})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	thing.Cfg.History.File = filepath.Join(dir, "history.db")
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+	defer thing.history.db.Close()
+
+	for i := 0; i < 5; i++ {
+		record(thing.history, newPacket(thing.bus, nil, &update{Msg: "Update", Value: i}))
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		thing.web.public.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// 0 1 2 3 4 averaged down to 2 points
+	w := get("/" + testId + "/api/history?msg=Update&field=Value&since=1h&points=2")
+	var series ChartSeries
+	json.Unmarshal(w.Body.Bytes(), &series)
+	if w.Code != http.StatusOK || len(series.Points) != 2 ||
+		series.Points[0].Value != 0.5 || series.Points[1].Value != 3 {
+		t.Errorf("Got %d %+v", w.Code, series)
+	}
+
+	if w := get("/" + testId + "/api/history?msg=Update"); w.Code != http.StatusBadRequest {
+		t.Errorf("Missing field: got %d", w.Code)
+	}
+
+	w = get("/")
+	want := `data-history="/` + testId + `/api/history?field=Value&amp;msg=Update&amp;since=24h"`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Got %s, want %s", w.Body.String(), want)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+// Setupper is implemented by a Thinger to set up its hardware, e.g. open
+// GPIO pins, outside of CmdRun.  Setup is called after CmdInit, once
+// Thing's state is restored and the power-on rules are applied, and before
+// Thing's framework components start and CmdRun is sent.  If Setup returns
+// an error, Thing.Run() returns the error.
+//
+// Setup isn't called on Thing Prime, which has no CmdRun.
+type Setupper interface {
+	Setup() error
+}
+
+// Teardowner is implemented by a Thinger to release its hardware, e.g. close
+// GPIO pins, when Thing shuts down.  Teardown is called after CmdRun returns,
+// Thing's state is saved, and Thing's framework components are stopped.
+//
+// On SwapThinger, the old Thinger is torn down once its CmdRun returns, and
+// the new Thinger is set up before its CmdRun.
+type Teardowner interface {
+	Teardown()
+}
+
+// Connection is a connection to Thing, passed to a Connectioner
+type Connection struct {
+	// Connection name, e.g. "ws:10.0.0.5:40012/ws" for a websocket, or
+	// "tunnel:mother.example.com" for the tunnel to mother
+	Name string
+	// Connection is with mother: Thing's tunnel to mother, or mother's
+	// websocket back to Thing
+	Mother bool
+	// Connection is on Thing's private server
+	Private bool
+}
+
+// Connectioner is implemented by a Thinger to hear about connections to
+// Thing: websockets opening and closing, and Thing's tunnel to mother
+// coming up and going down.  Connected and Disconnected are called from the
+// connection's goroutine, and should return quickly.
+type Connectioner interface {
+	Connected(Connection)
+	Disconnected(Connection)
+}
+
+// Call the Thinger's Setup, if it's a Setupper
+func setup(thinger Thinger) error {
+	if s, ok := thinger.(Setupper); ok {
+		return s.Setup()
+	}
+	return nil
+}
+
+// Call the Thinger's Teardown, if it's a Teardowner
+func teardown(thinger Thinger) {
+	if t, ok := thinger.(Teardowner); ok {
+		t.Teardown()
+	}
+}
+
+func sockConnection(sock socketer) Connection {
+	return Connection{
+		Name:    sock.Name(),
+		Mother:  sock.Flags()&sock_flag_mother != 0,
+		Private: sock.Flags()&sock_flag_private != 0,
+	}
+}
+
+// Send the Thinger SockOpened or SockClosed for s, if subscribed
+func (b *bus) sockEvent(event string, s socketer) {
+	if _, match := b.lookup(event); !match {
+		return
+	}
+
+	kind := b.sockKind(s)
+	msg := MsgSock{Msg: event, Name: s.Name(), Kind: kind}
+
+	b.sockLock.RLock()
+	for sock := range b.sockets {
+		if b.sockKind(sock) == kind {
+			msg.Open++
+		}
+	}
+	b.sockLock.RUnlock()
+
+	b.receive(newPacket(b, nil, &msg))
+}
+
+func (t *Thing) connected(c Connection) {
+	if h, ok := t.getThinger().(Connectioner); ok {
+		h.Connected(c)
+	}
+}
+
+func (t *Thing) disconnected(c Connection) {
+	if h, ok := t.getThinger().(Connectioner); ok {
+		h.Disconnected(c)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"testing"
+)
+
+// Counts its watchers
+type watched struct {
+	events []MsgSock
+}
+
+func (w *watched) sock(p *Packet) {
+	var msg MsgSock
+	p.Unmarshal(&msg)
+	w.events = append(w.events, msg)
+}
+
+func (w *watched) Subscribers() Subscribers {
+	return Subscribers{
+		SockOpened: w.sock,
+		SockClosed: w.sock,
+	}
+}
+
+func (w *watched) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestSockEvents(t *testing.T) {
+	w := &watched{}
+	thing := NewThing(w)
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	ui1 := &webSocket{thing: thing, name: "ui1"}
+	ui2 := &webSocket{thing: thing, name: "ui2"}
+	mother := &webSocket{thing: thing, name: "mother", flags: sock_flag_mother}
+	serial := &recordSocket{}
+
+	thing.bus.plugin(ui1)
+	thing.bus.plugin(mother)
+	thing.bus.plugin(ui2)
+	thing.bus.plugin(serial)
+	thing.bus.unplug(ui1)
+	thing.bus.unplug(ui2)
+	thing.bus.unplug(mother)
+
+	want := []MsgSock{
+		{SockOpened, "ui1", SockClient, 1},
+		{SockOpened, "mother", SockMother, 1},
+		{SockOpened, "ui2", SockClient, 2},
+		{SockOpened, "record", SockLink, 1},
+		{SockClosed, "ui1", SockClient, 1},
+		{SockClosed, "ui2", SockClient, 0},
+		{SockClosed, "mother", SockMother, 0},
+	}
+	if len(w.events) != len(want) {
+		t.Fatalf("Got %v, want %v", w.events, want)
+	}
+	for i := range want {
+		if w.events[i] != want[i] {
+			t.Errorf("Got %v, want %v", w.events[i], want[i])
+		}
+	}
+
+	// On Thing Prime, the socket to Thing
+	prime := NewThing(&watched{})
+	prime.Cfg.Id = testId
+	prime.Cfg.IsPrime = true
+	if err := prime.build(false); err != nil {
+		t.Fatal(err)
+	}
+	sock := &webSocket{thing: prime, name: "port:8000"}
+	prime.primeSock = sock
+	if kind := prime.bus.sockKind(sock); kind != SockThing {
+		t.Errorf("Kind %s, want %s", kind, SockThing)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxDB configuration.  Broadcast messages are written, in batches, as
+// time-series points in InfluxDB line protocol, to InfluxDB or any endpoint
+// that takes line protocol (Telegraf, VictoriaMetrics, QuestDB).  A message
+// is a point with measurement Msg, tags id, model and name, and a field for
+// each number or bool member.  Members of nested objects are fields named
+// by path, e.g. Position_Lat.  Members of other types are skipped, as are
+// messages with no fields.  For example, bmp180's Update:
+//
+//	Update,id=00_16_3e_30_e5_f5,model=bmp180,name=bmp180 Pressure=101325i,Temperature=215i 1659088800000000000
+type InfluxConfig struct {
+
+	// Write URL, with the database or bucket, e.g. for InfluxDB 2:
+	// "http://localhost:8086/api/v2/write?org=home&bucket=merle".
+	// Timestamps are in nanoseconds.  Writing is disabled if URL is empty.
+	// The default is "".
+	URL string
+
+	// [Optional] API token, sent as "Authorization: Token <Token>".  The
+	// default is "" (none).
+	Token string
+
+	// Messages to write.  If empty, all broadcast messages are written.
+	// The default is nil.
+	Msgs []string
+
+	// Number of points per write.  The default is 100.
+	BatchSize uint
+
+	// Maximum age, in seconds, of a point before it's written, even if the
+	// batch isn't full.  The default is 10.
+	MaxAge uint
+}
+
+type influx struct {
+	thing *Thing
+	sync.Mutex
+	cfg    InfluxConfig
+	client *http.Client
+	msgs   map[string]bool
+	tags   string
+	lines  []string
+	oldest time.Time
+	ticker *time.Ticker
+	done   chan bool
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+var influxKeyEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+func newInflux(thing *Thing, cfg InfluxConfig) *influx {
+	x := &influx{
+		thing:  thing,
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		tags: ",id=" + influxTagEscaper.Replace(thing.id) +
+			",model=" + influxTagEscaper.Replace(thing.model) +
+			",name=" + influxTagEscaper.Replace(thing.name),
+		done: make(chan bool),
+	}
+
+	if len(cfg.Msgs) > 0 {
+		x.msgs = make(map[string]bool)
+		for _, msg := range cfg.Msgs {
+			x.msgs[msg] = true
+		}
+	}
+
+	return x
+}
+
+// Add fields for v, a JSON value, named name, to fields
+func influxFields(fields map[string]string, name string, v interface{}) {
+	switch v := v.(type) {
+	case json.Number:
+		s := v.String()
+		if strings.ContainsAny(s, ".eE") {
+			fields[name] = s
+		} else {
+			fields[name] = s + "i"
+		}
+	case bool:
+		fields[name] = fmt.Sprint(v)
+	case map[string]interface{}:
+		for k, vv := range v {
+			if name != "" {
+				k = name + "_" + k
+			}
+			influxFields(fields, k, vv)
+		}
+	}
+}
+
+// Line protocol for msg, at time ts; "" if msg has no fields
+func (x *influx) line(msg []byte, ts time.Time) string {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return ""
+	}
+	name, _ := m["Msg"].(string)
+	delete(m, "Msg")
+
+	fields := map[string]string{}
+	influxFields(fields, "", m)
+	if name == "" || len(fields) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(influxKeyEscaper.Replace(name))
+	b.WriteString(x.tags)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxTagEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(fields[k])
+	}
+	fmt.Fprintf(&b, " %d", ts.UnixNano())
+
+	return b.String()
+}
+
+// Bus tap to write broadcast messages
+func (x *influx) tap(p *Packet) {
+	var msg Msg
+
+	p.Unmarshal(&msg)
+	if x.msgs != nil && !x.msgs[msg.Msg] {
+		return
+	}
+
+	line := x.line(p.msg, time.Now())
+	if line == "" {
+		return
+	}
+
+	x.Lock()
+	if len(x.lines) == 0 {
+		x.oldest = time.Now()
+	}
+	x.lines = append(x.lines, line)
+
+	var batch []string
+	if uint(len(x.lines)) >= x.cfg.BatchSize {
+		batch = x.take()
+	}
+	x.Unlock()
+
+	if batch != nil {
+		go x.write(batch)
+	}
+}
+
+// Take the current batch.  Call with lock held.
+func (x *influx) take() []string {
+	batch := x.lines
+	x.lines = nil
+	return batch
+}
+
+func (x *influx) post(body []byte) error {
+	req, err := http.NewRequest("POST", x.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if x.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+x.cfg.Token)
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// Write the batch.  On failure, the batch is put back for the next try, but
+// bounded to ten batches so an unreachable database doesn't eat memory.
+func (x *influx) write(batch []string) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := x.post([]byte(strings.Join(batch, "\n") + "\n"))
+	if err == nil {
+		return
+	}
+
+	x.thing.log.println("InfluxDB write failed:", err)
+
+	x.Lock()
+	defer x.Unlock()
+
+	x.lines = append(batch, x.lines...)
+	max := int(x.cfg.BatchSize) * 10
+	if len(x.lines) > max {
+		x.lines = x.lines[len(x.lines)-max:]
+	}
+}
+
+func (x *influx) start() {
+	maxAge := time.Duration(x.cfg.MaxAge) * time.Second
+	x.ticker = time.NewTicker(time.Second)
+
+	go func() {
+		for {
+			select {
+			case <-x.done:
+				return
+			case <-x.ticker.C:
+				var batch []string
+				x.Lock()
+				if len(x.lines) > 0 &&
+					time.Since(x.oldest) >= maxAge {
+					batch = x.take()
+				}
+				x.Unlock()
+				x.write(batch)
+			}
+		}
+	}()
+}
+
+func (x *influx) stop() {
+	x.ticker.Stop()
+	x.done <- true
+
+	x.Lock()
+	batch := x.take()
+	x.Unlock()
+	x.write(batch)
+}
@@ -0,0 +1,93 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Model = "bmp180"
+	thing.Cfg.Name = "yard"
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	x := newInflux(thing, thing.Cfg.Influx)
+	ts := time.Unix(0, 42)
+
+	tests := []struct {
+		msg, line string
+	}{
+		{`{"Msg":"Update","Temperature":215,"Pressure":101325}`,
+			`Update,id=` + testId + `,model=bmp180,name=yard Pressure=101325i,Temperature=215i 42`},
+		{`{"Msg":"Fix","Pos":{"Lat":45.5,"Long":-122.6},"Valid":true,"Text":"x"}`,
+			`Fix,id=` + testId + `,model=bmp180,name=yard Pos_Lat=45.5,Pos_Long=-122.6,Valid=true 42`},
+		{`{"Msg":"Hello","Text":"hi"}`, ""},
+		{`not json`, ""},
+	}
+
+	for _, test := range tests {
+		if line := x.line([]byte(test.msg), ts); line != test.line {
+			t.Errorf("%s: %q, want %q", test.msg, line, test.line)
+		}
+	}
+}
+
+func TestInflux(t *testing.T) {
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Header.Get("Authorization") != "Token tok" {
+			t.Errorf("Authorization %q", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Influx.URL = srv.URL
+	thing.Cfg.Influx.Token = "tok"
+	thing.Cfg.Influx.Msgs = []string{"Update"}
+	thing.Cfg.Influx.BatchSize = 2
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	x := thing.influx
+	x.tap(newPacket(thing.bus, nil, &Msg{Msg: "Other"}))
+	for i := 0; i < 2; i++ {
+		x.tap(newPacket(thing.bus, nil, &struct {
+			Msg string
+			N   int
+		}{"Update", i}))
+	}
+
+	select {
+	case body := <-bodies:
+		lines := 0
+		for _, c := range body {
+			if c == '\n' {
+				lines++
+			}
+		}
+		if lines != 2 {
+			t.Errorf("Batch %q, want 2 lines", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Batch not written")
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Input kinds
+const (
+	// Button sends EventInput on each debounced edge
+	InputButton = "button"
+	// Counter counts pulses: debounced rising edges, calls to
+	// Thing.Pulse(), or increments of a hardware counter fed with
+	// Thing.SetInputCount()
+	InputCounter = "counter"
+)
+
+const (
+	// How often input Files are read
+	inputPoll = 10 * time.Millisecond
+	// How often counters are saved
+	inputSave = time.Minute
+	// Default rate window
+	inputRateWindow = 60
+)
+
+// InputConfig is a digital input, such as a button or a pulse meter.  Inputs
+// save each Thinger from reimplementing debouncing and pulse math.
+//
+// An input is read from File, such as a sysfs GPIO value file, or fed by the
+// Thinger with Thing.SetInput(), Thing.Pulse(), or Thing.SetInputCount().
+// The input is active when File reads ActiveValue.
+//
+// A level change must hold for Debounce milliseconds before it's taken.  A
+// button sends EventInput to Thing's Subscribers() on each debounced edge.
+// A counter counts rising edges, and reports its Count, Total (Count times
+// Scale, e.g. liters per pulse), and Rate (Total per second, over the last
+// RateWindow seconds).  Counts are saved in Cfg.InputsFile, so they survive
+// Thing restarts.  Get inputs with Thing.Input() or the GetInputs message.
+//
+//	thing.Cfg.Inputs = []merle.InputConfig{
+//		{Name: "Door", Kind: merle.InputButton, Debounce: 20,
+//			File: "/sys/class/gpio/gpio17/value"},
+//		{Name: "Water", Kind: merle.InputCounter, Scale: 0.5},
+//	}
+type InputConfig struct {
+	Name string
+	// InputButton or InputCounter
+	Kind string
+	// [Optional] File to read the input from.  The default is "" (the
+	// Thinger feeds the input).
+	File string
+	// [Optional] Value File reads when the input is active.  The default
+	// is "1".
+	ActiveValue string
+	// [Optional] Debounce time, in milliseconds.  The default is 0 (no
+	// debouncing).
+	Debounce uint
+	// [Optional] Counter units per pulse.  The default is 1.
+	Scale float64
+	// [Optional] Counter rate window, in seconds.  The default is 60.
+	RateWindow uint
+	// [Optional] Modulus of a hardware counter fed with SetInputCount,
+	// e.g. 65536 for a 16-bit counter.  Counts are taken modulo Wrap, so
+	// the counter wrapping around isn't a jump.  The default is 0 (the
+	// counter doesn't wrap).
+	Wrap uint64
+}
+
+// Count at a time, for rate
+type inputSample struct {
+	time  time.Time
+	count uint64
+}
+
+type input struct {
+	cfg     InputConfig
+	active  bool
+	pending bool
+	timer   *time.Timer
+	count   uint64
+	raw     uint64
+	hasRaw  bool
+	samples []inputSample
+}
+
+type inputs struct {
+	sync.Mutex
+	thing  *Thing
+	inputs []*input
+	store  Store
+	ticker *time.Ticker
+	done   chan bool
+}
+
+func newInputs(thing *Thing, cfgs []InputConfig, file string) (*inputs, error) {
+	ins := &inputs{thing: thing}
+
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("Input missing Name")
+		}
+		if ins.find(cfg.Name) != nil {
+			return nil, fmt.Errorf("Duplicate input %s", cfg.Name)
+		}
+		switch cfg.Kind {
+		case InputButton, InputCounter:
+		default:
+			return nil, fmt.Errorf("Input %s: unknown kind \"%s\"",
+				cfg.Name, cfg.Kind)
+		}
+		if cfg.ActiveValue == "" {
+			cfg.ActiveValue = "1"
+		}
+		if cfg.Scale == 0 {
+			cfg.Scale = 1
+		}
+		if cfg.RateWindow == 0 {
+			cfg.RateWindow = inputRateWindow
+		}
+		ins.inputs = append(ins.inputs, &input{cfg: cfg})
+	}
+
+	if file != "" {
+		ins.store = NewFileStore(file)
+	}
+
+	return ins, ins.load()
+}
+
+func (ins *inputs) find(name string) *input {
+	for _, in := range ins.inputs {
+		if in.cfg.Name == name {
+			return in
+		}
+	}
+	return nil
+}
+
+// Load counts saved from a previous run
+func (ins *inputs) load() error {
+	if ins.store == nil {
+		return nil
+	}
+
+	var counts map[string]uint64
+	if err := ins.store.Load(&counts); err != nil {
+		return err
+	}
+
+	for name, count := range counts {
+		if in := ins.find(name); in != nil && in.cfg.Kind == InputCounter {
+			in.count = count
+		}
+	}
+
+	return nil
+}
+
+// Call with lock held
+func (ins *inputs) save() {
+	if ins.store == nil {
+		return
+	}
+
+	counts := make(map[string]uint64)
+	for _, in := range ins.inputs {
+		if in.cfg.Kind == InputCounter {
+			counts[in.cfg.Name] = in.count
+		}
+	}
+
+	if err := ins.store.Save(counts); err != nil {
+		ins.thing.log.println("Saving input counts failed:", err)
+	}
+}
+
+// Add n pulses to counter.  Call with lock held.
+func (in *input) add(n uint64, now time.Time) {
+	// The first sample is the count before the first pulse
+	if len(in.samples) == 0 {
+		in.samples = append(in.samples, inputSample{now, in.count})
+	}
+
+	in.count += n
+
+	// One sample per second is plenty for the rate
+	last := len(in.samples) - 1
+	if last > 0 && now.Sub(in.samples[last].time) < time.Second {
+		in.samples[last].count = in.count
+	} else {
+		in.samples = append(in.samples, inputSample{now, in.count})
+	}
+
+	window := time.Duration(in.cfg.RateWindow) * time.Second
+	for len(in.samples) > 1 && now.Sub(in.samples[1].time) > window {
+		in.samples = in.samples[1:]
+	}
+}
+
+// Counter rate, in units per second.  Call with lock held.
+func (in *input) rate(now time.Time) float64 {
+	window := time.Duration(in.cfg.RateWindow) * time.Second
+
+	if len(in.samples) == 0 {
+		return 0
+	}
+
+	// Count at the start of the window
+	start := in.samples[0].count
+	for _, sample := range in.samples[1:] {
+		if now.Sub(sample.time) < window {
+			break
+		}
+		start = sample.count
+	}
+
+	return float64(in.count-start) * in.cfg.Scale / window.Seconds()
+}
+
+// Take a debounced level.  Returns the event to send, if any.  Call with
+// lock held.
+func (in *input) take(active bool, now time.Time) *MsgInput {
+	if active == in.active {
+		return nil
+	}
+	in.active = active
+
+	if in.cfg.Kind == InputCounter {
+		if active {
+			in.add(1, now)
+		}
+		return nil
+	}
+
+	return &MsgInput{Msg: EventInput, Name: in.cfg.Name, Active: active,
+		Time: now}
+}
+
+func (ins *inputs) send(msg *MsgInput) {
+	if msg != nil {
+		ins.thing.bus.receive(newPacket(ins.thing.bus, nil, msg))
+	}
+}
+
+// Input's raw level changed to active.  The level is taken once it's held
+// for the debounce time.
+func (ins *inputs) level(in *input, active bool) {
+	ins.Lock()
+
+	if in.cfg.Debounce == 0 {
+		msg := in.take(active, time.Now())
+		ins.Unlock()
+		ins.send(msg)
+		return
+	}
+
+	defer ins.Unlock()
+
+	if in.timer != nil && active == in.pending {
+		return
+	}
+	if in.timer != nil {
+		in.timer.Stop()
+		in.timer = nil
+	}
+	if active == in.active {
+		return
+	}
+
+	in.pending = active
+	debounce := time.Duration(in.cfg.Debounce) * time.Millisecond
+	in.timer = time.AfterFunc(debounce, func() {
+		ins.Lock()
+		if in.timer == nil || in.pending != active {
+			ins.Unlock()
+			return
+		}
+		in.timer = nil
+		msg := in.take(active, time.Now())
+		ins.Unlock()
+		ins.send(msg)
+	})
+}
+
+func (ins *inputs) poll() {
+	for _, in := range ins.inputs {
+		if in.cfg.File == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(in.cfg.File)
+		if err != nil {
+			continue
+		}
+		ins.level(in, strings.TrimSpace(string(data)) == in.cfg.ActiveValue)
+	}
+}
+
+func (ins *inputs) start() error {
+	polled := false
+
+	// Fail now, rather than later, if an input can't be read
+	for _, in := range ins.inputs {
+		if in.cfg.File == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(in.cfg.File); err != nil {
+			return err
+		}
+		polled = true
+	}
+
+	ins.ticker = time.NewTicker(inputPoll)
+	ins.done = make(chan bool)
+
+	go func() {
+		lastSave := time.Now()
+		for {
+			select {
+			case <-ins.done:
+				return
+			case now := <-ins.ticker.C:
+				if polled {
+					ins.poll()
+				}
+				if now.Sub(lastSave) >= inputSave {
+					ins.Lock()
+					ins.save()
+					ins.Unlock()
+					lastSave = now
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (ins *inputs) stop() {
+	ins.ticker.Stop()
+	close(ins.done)
+
+	ins.Lock()
+	defer ins.Unlock()
+
+	for _, in := range ins.inputs {
+		if in.timer != nil {
+			in.timer.Stop()
+			in.timer = nil
+		}
+	}
+	ins.save()
+}
+
+// Call with lock held
+func (in *input) status(now time.Time) InputStatus {
+	status := InputStatus{Name: in.cfg.Name, Kind: in.cfg.Kind,
+		Active: in.active}
+	if in.cfg.Kind == InputCounter {
+		status.Count = in.count
+		status.Total = float64(in.count) * in.cfg.Scale
+		status.Rate = in.rate(now)
+	}
+	return status
+}
+
+func (t *Thing) input(name string) (*input, error) {
+	if t.inputs == nil {
+		return nil, fmt.Errorf("No inputs")
+	}
+	in := t.inputs.find(name)
+	if in == nil {
+		return nil, fmt.Errorf("No input %s", name)
+	}
+	return in, nil
+}
+
+// SetInput feeds an input's raw level, for inputs without a File.  The level
+// is debounced.
+func (t *Thing) SetInput(name string, active bool) error {
+	in, err := t.input(name)
+	if err != nil {
+		return err
+	}
+	t.inputs.level(in, active)
+	return nil
+}
+
+// Pulse counts a pulse on a counter input, e.g. from an interrupt handler.
+// The pulse isn't debounced.
+func (t *Thing) Pulse(name string) error {
+	in, err := t.input(name)
+	if err != nil {
+		return err
+	}
+	t.inputs.Lock()
+	in.add(1, time.Now())
+	t.inputs.Unlock()
+	return nil
+}
+
+// SetInputCount feeds a hardware counter's raw value to a counter input.  The
+// input counts the increase since the last raw value, modulo the input's
+// Wrap.  The first raw value after Thing starts is the baseline.
+func (t *Thing) SetInputCount(name string, raw uint64) error {
+	in, err := t.input(name)
+	if err != nil {
+		return err
+	}
+
+	t.inputs.Lock()
+	defer t.inputs.Unlock()
+
+	if in.hasRaw {
+		delta := raw - in.raw
+		if in.cfg.Wrap > 0 {
+			delta = (raw + in.cfg.Wrap - in.raw%in.cfg.Wrap) % in.cfg.Wrap
+		}
+		if delta > 0 {
+			in.add(delta, time.Now())
+		}
+	}
+	in.raw, in.hasRaw = raw, true
+
+	return nil
+}
+
+// Input returns an input's status
+func (t *Thing) Input(name string) (InputStatus, error) {
+	in, err := t.input(name)
+	if err != nil {
+		return InputStatus{}, err
+	}
+	t.inputs.Lock()
+	defer t.inputs.Unlock()
+	return in.status(time.Now()), nil
+}
+
+// Subscriber handler for GetInputs
+func (t *Thing) getInputs(p *Packet) {
+	resp := MsgInputs{Msg: ReplyInputs, Inputs: []InputStatus{}}
+
+	t.inputs.Lock()
+	now := time.Now()
+	for _, in := range t.inputs.inputs {
+		resp.Inputs = append(resp.Inputs, in.status(now))
+	}
+	t.inputs.Unlock()
+
+	p.Marshal(&resp).Reply()
+}
@@ -0,0 +1,131 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type meter struct {
+	events chan MsgInput
+}
+
+func (m *meter) input(p *Packet) {
+	var msg MsgInput
+	p.Unmarshal(&msg)
+	m.events <- msg
+}
+
+func (m *meter) Subscribers() Subscribers {
+	return Subscribers{EventInput: m.input}
+}
+
+func (m *meter) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	door := filepath.Join(dir, "door")
+	if err := ioutil.WriteFile(door, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state := &meter{events: make(chan MsgInput, 10)}
+	thing := NewThing(state)
+	thing.Cfg.Id = testId
+	thing.Cfg.Inputs = []InputConfig{
+		{Name: "Door", Kind: InputButton, File: door},
+		{Name: "Button", Kind: InputButton, Debounce: 20},
+		{Name: "Water", Kind: InputCounter, Scale: 0.5},
+		{Name: "Meter", Kind: InputCounter, Wrap: 65536},
+	}
+	thing.Cfg.InputsFile = filepath.Join(dir, "inputs")
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := thing.inputs.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(name string, active bool) {
+		select {
+		case msg := <-state.events:
+			if msg.Name != name || msg.Active != active {
+				t.Errorf("Got event %+v, want %s %t", msg, name, active)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No event for %s", name)
+		}
+	}
+
+	// Polled input
+	if err := ioutil.WriteFile(door, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("Door", true)
+
+	// Bounces shorter than Debounce are one edge
+	thing.SetInput("Button", true)
+	thing.SetInput("Button", false)
+	thing.SetInput("Button", true)
+	expect("Button", true)
+	select {
+	case msg := <-state.events:
+		t.Errorf("Got extra event %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 3; i++ {
+		thing.Pulse("Water")
+	}
+	water, _ := thing.Input("Water")
+	if water.Count != 3 || water.Total != 1.5 || water.Rate != 1.5/60 {
+		t.Errorf("Got %+v", water)
+	}
+
+	// Hardware counter wraps from 65530 to 4
+	thing.SetInputCount("Meter", 65530)
+	thing.SetInputCount("Meter", 4)
+	if m, _ := thing.Input("Meter"); m.Count != 10 {
+		t.Errorf("Got %+v", m)
+	}
+
+	if err := thing.SetInput("Nope", true); err == nil {
+		t.Error("Set unknown input")
+	}
+
+	thing.inputs.stop()
+
+	// Counts are restored on restart
+	cfg := thing.Cfg
+	thing = NewThing(&meter{})
+	thing.Cfg = cfg
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := &recordSocket{}
+	thing.bus.plugin(sock)
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: GetInputs}))
+
+	var resp MsgInputs
+	json.Unmarshal([]byte(sock.sent[0]), &resp)
+	if len(resp.Inputs) != 4 || resp.Inputs[2].Count != 3 ||
+		resp.Inputs[3].Count != 10 {
+		t.Errorf("Got %+v", resp)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interlock is a group of outputs that must never be on at the same time,
+// such as the forward and reverse windings of a motor, or heat and cool on
+// an HVAC unit.  Outputs are bool members in Thing's state, named as in
+// PowerOnRule.  If MinOffTime is non-zero, an output in the group can't
+// switch on within MinOffTime seconds of any output in the group switching
+// off.
+//
+// Interlocks are enforced on state changes made with UpdateState, whichever
+// client or rule made the change.  A change breaking an interlock is
+// rejected with a StateRejection.  For example:
+//
+//	thing.Cfg.Interlocks = []merle.Interlock{
+//		{Outputs: []string{"Forward", "Reverse"}, MinOffTime: 2},
+//	}
+type Interlock struct {
+	Outputs    []string
+	MinOffTime uint
+}
+
+type interlocks struct {
+	sync.Mutex
+	groups []Interlock
+	// Time an output in each group last switched off
+	lastOff []time.Time
+}
+
+func newInterlocks(groups []Interlock) (*interlocks, error) {
+	for _, group := range groups {
+		if len(group.Outputs) < 2 {
+			return nil, fmt.Errorf("Interlock needs two or more Outputs")
+		}
+	}
+	return &interlocks{
+		groups:  groups,
+		lastOff: make([]time.Time, len(groups)),
+	}, nil
+}
+
+// Bool at path in v, a decoded JSON object or array
+func boolAt(v interface{}, path []string) bool {
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return false
+			}
+			v = node[i]
+		default:
+			return false
+		}
+	}
+	on, _ := v.(bool)
+	return on
+}
+
+func outputsOn(state interface{}, outputs []string) []bool {
+	on := make([]bool, len(outputs))
+	for i, output := range outputs {
+		on[i] = boolAt(state, strings.Split(output, "."))
+	}
+	return on
+}
+
+// Thing's current state, as decoded JSON.  If the Thinger is a sync.Locker,
+// it's locked while marshaling.
+func (t *Thing) currentState() (interface{}, error) {
+	thinger := t.getThinger()
+
+	if l, ok := thinger.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	data, err := json.Marshal(thinger)
+	if err != nil {
+		return nil, err
+	}
+
+	var state interface{}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// Thing watches outputs switched by state changes
+func (t *Thing) watchesOutputs() bool {
+	return t.interlocks != nil || t.duty != nil || t.runtime != nil
+}
+
+// Decode the change from state to proposed, both JSON
+func decodeChange(state, proposed []byte) (before, after interface{}, err error) {
+	if err = json.Unmarshal(state, &before); err != nil {
+		return
+	}
+	err = json.Unmarshal(proposed, &after)
+	return
+}
+
+// Record outputs switched by a committed change
+func (t *Thing) outputsChanged(before, after interface{}) {
+	if t.interlocks != nil {
+		t.interlocks.update(before, after)
+	}
+	if t.duty != nil {
+		t.duty.update(before, after)
+	}
+	if t.runtime != nil {
+		t.runtime.update(after)
+	}
+}
+
+// Check the change from before to after, both decoded JSON, against the
+// interlocks
+func (il *interlocks) check(before, after interface{}) error {
+	il.Lock()
+	defer il.Unlock()
+
+	now := time.Now()
+
+	for g, group := range il.groups {
+		was := outputsOn(before, group.Outputs)
+		is := outputsOn(after, group.Outputs)
+
+		lastOff := il.lastOff[g]
+		for i := range group.Outputs {
+			if was[i] && !is[i] {
+				lastOff = now
+			}
+		}
+
+		on := ""
+		for i, output := range group.Outputs {
+			if !is[i] {
+				continue
+			}
+			if on != "" {
+				return &StateRejection{Field: output,
+					Reason: "interlocked with " + on}
+			}
+			on = output
+			if was[i] || group.MinOffTime == 0 {
+				continue
+			}
+			minOff := time.Duration(group.MinOffTime) * time.Second
+			if wait := lastOff.Add(minOff).Sub(now); wait > 0 {
+				return &StateRejection{Field: output,
+					Reason: fmt.Sprintf("interlock off-time; wait %s",
+						wait.Round(time.Millisecond))}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Record the change from before to after, once committed
+func (il *interlocks) update(before, after interface{}) {
+	il.Lock()
+	defer il.Unlock()
+
+	now := time.Now()
+
+	for g, group := range il.groups {
+		was := outputsOn(before, group.Outputs)
+		is := outputsOn(after, group.Outputs)
+		for i := range group.Outputs {
+			if was[i] && !is[i] {
+				il.lastOff[g] = now
+			}
+		}
+	}
+}
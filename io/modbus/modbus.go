@@ -0,0 +1,496 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+// Package modbus is a Modbus master (client) for Things, to get PLC and
+// instrument data onto Thing's bus.  A Master polls a map of registers, over
+// Modbus TCP or RTU, and broadcasts their values as a message; a command
+// message writes coils and holding registers.  The register map is
+// declared in Config:
+//
+//	m, err := modbus.New(modbus.Config{
+//		Addr: "192.168.1.20",
+//		Registers: []modbus.Register{
+//			{Field: "Temp", Kind: modbus.Input, Address: 0, Scale: 0.1},
+//			{Field: "Setpoint", Kind: modbus.Holding, Address: 10,
+//				Type: modbus.Float32, Writable: true},
+//			{Field: "Pump", Kind: modbus.Coil, Address: 0, Writable: true},
+//		},
+//	})
+//	thing := merle.NewThing(m)
+//
+// Thing broadcasts {"Msg":"Modbus","Temp":21.5,"Setpoint":22,"Pump":false}
+// when a value changes, and writes the Setpoint register on
+// {"Msg":"ModbusWrite","Setpoint":23}.
+//
+// A Master is a merle.Thinger, for a Thing that's only a Modbus gateway;
+// other Things use Master's Poll and Write from their own Thinger.
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/merliot/merle"
+	"github.com/tarm/serial"
+)
+
+// Register kinds (Modbus tables)
+const (
+	Coil     = "coil"
+	Discrete = "discrete"
+	Holding  = "holding"
+	Input    = "input"
+)
+
+// Register value types.  32-bit values span two registers, high word first,
+// unless Register.Swap.
+const (
+	Uint16  = "uint16"
+	Int16   = "int16"
+	Uint32  = "uint32"
+	Int32   = "int32"
+	Float32 = "float32"
+)
+
+// Register maps message member Field to a coil, discrete input, holding
+// register, or input register.  A register's value is raw * Scale + Offset;
+// a coil's or discrete input's is a bool.
+type Register struct {
+	Field string
+	// Coil, Discrete, Holding, or Input
+	Kind string
+	// Zero-based address
+	Address uint16
+	// [Optional] Value type, for Holding and Input registers.  The
+	// default is Uint16.
+	Type string
+	// [Optional] 32-bit value's low word first
+	Swap bool
+	// [Optional] The default is 1.
+	Scale float64
+	// [Optional] The default is 0.
+	Offset float64
+	// Field can be written, for Coil and Holding
+	Writable bool
+}
+
+// Config configures a Master.  Set Addr for Modbus TCP, or Device for
+// Modbus RTU.
+type Config struct {
+	// Modbus TCP server address, host[:port].  The default port is 502.
+	Addr string
+	// Modbus RTU serial device, e.g. "/dev/ttyUSB0"
+	Device string
+	// [Optional] RTU baud rate.  The default is 9600.
+	Baud uint
+	// [Optional] RTU parity, "N", "E", or "O".  The default is "E", as
+	// the Modbus spec says.
+	Parity string
+	// [Optional] Unit (slave) id.  The default is 1.
+	Unit uint8
+	// [Optional] Milliseconds between polls.  The default is 1000.
+	Poll uint
+	// [Optional] Milliseconds to wait for a response.  The default is
+	// 1000.
+	Timeout uint
+	// [Optional] Message broadcast with the registers' values.  The
+	// default is "Modbus".
+	Msg string
+	// [Optional] Command message to write registers.  The default is
+	// "ModbusWrite".
+	WriteMsg string
+	// Register map
+	Registers []Register
+}
+
+// Master polls and writes a Modbus server's registers.  See New.
+type Master struct {
+	sync.Mutex
+	cfg    Config
+	fields map[string]*Register
+	trans  transport
+	values map[string]interface{}
+	// Closed to stop run
+	stopped chan bool
+}
+
+func (r *Register) words() uint16 {
+	switch r.Type {
+	case Uint32, Int32, Float32:
+		return 2
+	}
+	return 1
+}
+
+func (r *Register) scale() float64 {
+	if r.Scale == 0 {
+		return 1
+	}
+	return r.Scale
+}
+
+func (r *Register) check() error {
+	switch {
+	case r.Field == "":
+		return fmt.Errorf("Register missing Field")
+	case r.Field == "Msg":
+		return fmt.Errorf("Register Field can't be Msg")
+	}
+	switch r.Kind {
+	case Coil, Discrete:
+		if r.Kind == Discrete && r.Writable {
+			return fmt.Errorf("Register %s: discrete inputs can't be written", r.Field)
+		}
+		return nil
+	case Holding, Input:
+		if r.Kind == Input && r.Writable {
+			return fmt.Errorf("Register %s: input registers can't be written", r.Field)
+		}
+	default:
+		return fmt.Errorf("Register %s: unknown Kind %q", r.Field, r.Kind)
+	}
+	switch r.Type {
+	case Uint16, Int16, Uint32, Int32, Float32:
+	default:
+		return fmt.Errorf("Register %s: unknown Type %q", r.Field, r.Type)
+	}
+	return nil
+}
+
+// New Master, with cfg.  The Master connects to the server when it first
+// polls.
+func New(cfg Config) (*Master, error) {
+	if (cfg.Addr == "") == (cfg.Device == "") {
+		return nil, fmt.Errorf("Set one of Addr or Device")
+	}
+	if cfg.Baud == 0 {
+		cfg.Baud = 9600
+	}
+	if cfg.Parity == "" {
+		cfg.Parity = "E"
+	}
+	switch cfg.Parity {
+	case "N", "E", "O":
+	default:
+		return nil, fmt.Errorf("Parity must be N, E, or O")
+	}
+	if cfg.Unit == 0 {
+		cfg.Unit = 1
+	}
+	if cfg.Poll == 0 {
+		cfg.Poll = 1000
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 1000
+	}
+	if cfg.Msg == "" {
+		cfg.Msg = "Modbus"
+	}
+	if cfg.WriteMsg == "" {
+		cfg.WriteMsg = "ModbusWrite"
+	}
+
+	m := &Master{fields: make(map[string]*Register)}
+
+	cfg.Registers = append([]Register(nil), cfg.Registers...)
+	for i := range cfg.Registers {
+		r := &cfg.Registers[i]
+		if r.Type == "" && (r.Kind == Holding || r.Kind == Input) {
+			r.Type = Uint16
+		}
+		if err := r.check(); err != nil {
+			return nil, err
+		}
+		if m.fields[r.Field] != nil {
+			return nil, fmt.Errorf("Register %s mapped twice", r.Field)
+		}
+		m.fields[r.Field] = r
+	}
+	m.cfg = cfg
+
+	return m, nil
+}
+
+func (m *Master) timeout() time.Duration {
+	return time.Duration(m.cfg.Timeout) * time.Millisecond
+}
+
+// Connect to the server, if not connected
+func (m *Master) connect() error {
+	if m.trans != nil {
+		return nil
+	}
+
+	if m.cfg.Addr != "" {
+		t, err := dialTCP(m.cfg.Addr, m.timeout())
+		if err != nil {
+			return err
+		}
+		m.trans = t
+		return nil
+	}
+
+	port, err := serial.OpenPort(&serial.Config{Name: m.cfg.Device,
+		Baud: int(m.cfg.Baud), ReadTimeout: m.timeout(),
+		Parity: serial.Parity(m.cfg.Parity[0])})
+	if err != nil {
+		return err
+	}
+	m.trans = &rtu{port: port}
+	return nil
+}
+
+// Send request pdu, reconnecting next time if the connection failed
+func (m *Master) request(pdu []byte) ([]byte, error) {
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+	resp, err := m.trans.request(m.cfg.Unit, pdu)
+	if err != nil && (len(resp) == 0 || resp[0]&fnException == 0) {
+		m.trans.Close()
+		m.trans = nil
+	}
+	return resp, err
+}
+
+func (m *Master) read(r *Register) (interface{}, error) {
+	fn := map[string]byte{Coil: fnReadCoils, Discrete: fnReadDiscrete,
+		Holding: fnReadHolding, Input: fnReadInput}[r.Kind]
+
+	count := r.words()
+	if r.Kind == Coil || r.Kind == Discrete {
+		count = 1
+	}
+
+	pdu := []byte{fn, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], r.Address)
+	binary.BigEndian.PutUint16(pdu[3:], count)
+
+	resp, err := m.request(pdu)
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s: %s", r.Field, err)
+	}
+
+	data := resp[2:]
+	if int(resp[1]) != len(data) {
+		return nil, fmt.Errorf("Reading %s: bad byte count", r.Field)
+	}
+
+	if r.Kind == Coil || r.Kind == Discrete {
+		if len(data) < 1 {
+			return nil, fmt.Errorf("Reading %s: no data", r.Field)
+		}
+		return data[0]&1 != 0, nil
+	}
+
+	if len(data) != int(count)*2 {
+		return nil, fmt.Errorf("Reading %s: got %d bytes", r.Field, len(data))
+	}
+	if count == 2 && r.Swap {
+		data = append(data[2:4:4], data[0:2]...)
+	}
+
+	var raw float64
+	switch r.Type {
+	case Uint16:
+		raw = float64(binary.BigEndian.Uint16(data))
+	case Int16:
+		raw = float64(int16(binary.BigEndian.Uint16(data)))
+	case Uint32:
+		raw = float64(binary.BigEndian.Uint32(data))
+	case Int32:
+		raw = float64(int32(binary.BigEndian.Uint32(data)))
+	case Float32:
+		raw = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	}
+	return raw*r.scale() + r.Offset, nil
+}
+
+// Poll reads the registers, and returns their values, by Field
+func (m *Master) Poll() (map[string]interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	values := make(map[string]interface{})
+	for i := range m.cfg.Registers {
+		r := &m.cfg.Registers[i]
+		v, err := m.read(r)
+		if err != nil {
+			return nil, err
+		}
+		values[r.Field] = v
+	}
+	return values, nil
+}
+
+// Write value to Field's coil or register.  A coil's value is a bool.
+func (m *Master) Write(field string, value interface{}) error {
+	r := m.fields[field]
+	if r == nil {
+		return fmt.Errorf("No register %s", field)
+	}
+	if !r.Writable {
+		return fmt.Errorf("Register %s isn't writable", field)
+	}
+
+	var pdu []byte
+
+	if r.Kind == Coil {
+		on, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("Coil %s value must be a bool", field)
+		}
+		pdu = []byte{fnWriteCoil, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[1:], r.Address)
+		if on {
+			pdu[3] = 0xff
+		}
+	} else {
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("Register %s value must be a number", field)
+		}
+		raw := (v - r.Offset) / r.scale()
+
+		data := make([]byte, 4)
+		switch r.Type {
+		case Uint16, Int16:
+			binary.BigEndian.PutUint16(data, uint16(int64(math.Round(raw))))
+			data = data[:2]
+		case Uint32, Int32:
+			binary.BigEndian.PutUint32(data, uint32(int64(math.Round(raw))))
+		case Float32:
+			binary.BigEndian.PutUint32(data, math.Float32bits(float32(raw)))
+		}
+		if len(data) == 4 && r.Swap {
+			data = append(data[2:4:4], data[0:2]...)
+		}
+
+		if len(data) == 2 {
+			pdu = append([]byte{fnWriteRegister, 0, 0}, data...)
+		} else {
+			pdu = []byte{fnWriteRegisters, 0, 0, 0, 2, 4}
+			pdu = append(pdu, data...)
+		}
+		binary.BigEndian.PutUint16(pdu[1:], r.Address)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, err := m.request(pdu); err != nil {
+		return fmt.Errorf("Writing %s: %s", field, err)
+	}
+	return nil
+}
+
+// Close the connection to the server
+func (m *Master) Close() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.trans != nil {
+		m.trans.Close()
+		m.trans = nil
+	}
+}
+
+// Values from the last poll
+func (m *Master) state() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+
+	state := make(map[string]interface{})
+	for k, v := range m.values {
+		state[k] = v
+	}
+	return state
+}
+
+func (m *Master) run(p *merle.Packet) {
+	ticker := time.NewTicker(time.Duration(m.cfg.Poll) * time.Millisecond)
+	defer ticker.Stop()
+
+	m.Lock()
+	stopped := make(chan bool)
+	m.stopped = stopped
+	m.Unlock()
+
+	failing := false
+
+	for {
+		values, err := m.Poll()
+		switch {
+		case err != nil && !failing:
+			log.Println("Modbus poll failed:", err)
+			failing = true
+		case err == nil:
+			failing = false
+			m.Lock()
+			changed := !reflect.DeepEqual(values, m.values)
+			m.values = values
+			m.Unlock()
+			if changed {
+				values["Msg"] = m.cfg.Msg
+				p.Marshal(values).Broadcast()
+			}
+		}
+		select {
+		case <-stopped:
+			m.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Master) stop(p *merle.Packet) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.stopped != nil {
+		close(m.stopped)
+		m.stopped = nil
+	}
+}
+
+func (m *Master) getState(p *merle.Packet) {
+	state := m.state()
+	state["Msg"] = merle.ReplyState
+	p.Marshal(state).Reply()
+}
+
+func (m *Master) write(p *merle.Packet) {
+	var msg map[string]interface{}
+	p.Unmarshal(&msg)
+	for field, value := range msg {
+		if field == "Msg" {
+			continue
+		}
+		if err := m.Write(field, value); err != nil {
+			log.Println("Modbus write failed:", err)
+		}
+	}
+}
+
+func (m *Master) Subscribers() merle.Subscribers {
+	return merle.Subscribers{
+		merle.CmdRun:   m.run,
+		merle.CmdStop:  m.stop,
+		merle.GetState: m.getState,
+		m.cfg.WriteMsg: m.write,
+	}
+}
+
+func (m *Master) Assets() *merle.ThingAssets {
+	return &merle.ThingAssets{}
+}
@@ -0,0 +1,277 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/merliot/merle"
+	"github.com/merliot/merle/merletest"
+)
+
+// Modbus server, with 16 coils and 16 registers
+type slave struct {
+	sync.Mutex
+	coils     [16]bool
+	registers [16]uint16
+}
+
+// Response PDU to request PDU
+func (s *slave) handle(pdu []byte) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	fn := pdu[0]
+	addr := int(binary.BigEndian.Uint16(pdu[1:]))
+	n := int(binary.BigEndian.Uint16(pdu[3:]))
+
+	switch fn {
+	case fnReadCoils:
+		if addr+n > len(s.coils) {
+			break
+		}
+		resp := []byte{fn, byte((n + 7) / 8)}
+		resp = append(resp, make([]byte, (n+7)/8)...)
+		for i := 0; i < n; i++ {
+			if s.coils[addr+i] {
+				resp[2+i/8] |= 1 << (i % 8)
+			}
+		}
+		return resp
+	case fnReadHolding, fnReadInput:
+		if addr+n > len(s.registers) {
+			break
+		}
+		resp := []byte{fn, byte(n * 2)}
+		for i := 0; i < n; i++ {
+			resp = append(resp, byte(s.registers[addr+i]>>8),
+				byte(s.registers[addr+i]))
+		}
+		return resp
+	case fnWriteCoil:
+		if addr >= len(s.coils) {
+			break
+		}
+		s.coils[addr] = pdu[3] == 0xff
+		return pdu
+	case fnWriteRegister:
+		if addr >= len(s.registers) {
+			break
+		}
+		s.registers[addr] = uint16(n)
+		return pdu
+	case fnWriteRegisters:
+		if addr+n > len(s.registers) {
+			break
+		}
+		for i := 0; i < n; i++ {
+			s.registers[addr+i] = binary.BigEndian.Uint16(pdu[6+i*2:])
+		}
+		return pdu[:5]
+	}
+
+	// Illegal data address
+	return []byte{fn | fnException, 2}
+}
+
+// Serve Modbus TCP on l
+func (s *slave) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				header := make([]byte, tcpHeaderLen)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+				if _, err := io.ReadFull(conn, pdu); err != nil {
+					return
+				}
+				resp := s.handle(pdu)
+				binary.BigEndian.PutUint16(header[4:], uint16(len(resp)+1))
+				conn.Write(append(header, resp...))
+			}
+		}()
+	}
+}
+
+// Serial port to an RTU slave, answering each request written
+type rtuPort struct {
+	slave *slave
+	resp  bytes.Buffer
+}
+
+func (p *rtuPort) Write(adu []byte) (int, error) {
+	crc := crc16(adu[:len(adu)-2])
+	if adu[len(adu)-2] != byte(crc) || adu[len(adu)-1] != byte(crc>>8) {
+		return len(adu), nil
+	}
+	resp := append([]byte{adu[0]}, p.slave.handle(adu[1:len(adu)-2])...)
+	crc = crc16(resp)
+	p.resp.Write(append(resp, byte(crc), byte(crc>>8)))
+	return len(adu), nil
+}
+
+func (p *rtuPort) Read(buf []byte) (int, error) {
+	// Dribble, as a serial port does
+	if len(buf) > 3 {
+		buf = buf[:3]
+	}
+	n, _ := p.resp.Read(buf)
+	return n, nil
+}
+
+func (p *rtuPort) Close() error {
+	return nil
+}
+
+var registers = []Register{
+	{Field: "Temp", Kind: Input, Address: 0, Type: Int16, Scale: 0.1},
+	{Field: "Flow", Kind: Holding, Address: 2, Type: Float32, Writable: true},
+	{Field: "Count", Kind: Holding, Address: 4, Type: Uint32, Swap: true},
+	{Field: "Level", Kind: Holding, Address: 6, Offset: -100, Writable: true},
+	{Field: "Pump", Kind: Coil, Address: 3, Writable: true},
+}
+
+func testMaster(t *testing.T, m *Master, s *slave) {
+	s.registers[0] = uint16(0xffff - 214) // -21.5
+	f := math.Float32bits(12.5)
+	s.registers[2], s.registers[3] = uint16(f>>16), uint16(f)
+	s.registers[4], s.registers[5] = 0x0001, 0x0002
+	s.registers[6] = 150
+	s.coils[3] = true
+
+	values, err := m.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"Temp": -21.5, "Flow": 12.5,
+		"Count": float64(0x00020001), "Level": 50.0, "Pump": true}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s is %v, want %v", k, values[k], v)
+		}
+	}
+
+	if err := m.Write("Flow", 7.25); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write("Level", -20.0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write("Pump", false); err != nil {
+		t.Fatal(err)
+	}
+	f = math.Float32bits(7.25)
+	if s.registers[2] != uint16(f>>16) || s.registers[3] != uint16(f) ||
+		s.registers[6] != 80 || s.coils[3] {
+		t.Errorf("Writes didn't land: %v %v", s.registers, s.coils)
+	}
+
+	if err := m.Write("Temp", 1.0); err == nil {
+		t.Errorf("Wrote read-only Temp")
+	}
+	if err := m.Write("Pump", 1.0); err == nil {
+		t.Errorf("Wrote a number to coil Pump")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &slave{}
+	go s.serveTCP(l)
+
+	m, err := New(Config{Addr: l.Addr().String(), Registers: registers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	testMaster(t, m, s)
+
+	// Exceptions
+	m.fields["Pump"].Address = 99
+	if _, err := m.Poll(); err == nil {
+		t.Errorf("No exception for a bad address")
+	}
+}
+
+func TestRTU(t *testing.T) {
+	// CRC-16/MODBUS check value
+	if crc := crc16([]byte("123456789")); crc != 0x4b37 {
+		t.Errorf("CRC is %#x", crc)
+	}
+
+	s := &slave{}
+	m, err := New(Config{Device: "/dev/fake", Registers: registers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.trans = &rtu{port: &rtuPort{slave: s}}
+
+	testMaster(t, m, s)
+}
+
+func TestThinger(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &slave{}
+	s.registers[6] = 150
+	go s.serveTCP(l)
+
+	m, err := New(Config{Addr: l.Addr().String(), Poll: 10,
+		Registers: registers[3:4]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := merletest.New(t, merle.NewThing(m))
+	h.Run()
+	h.ExpectBroadcast(merletest.Fields(map[string]interface{}{
+		"Msg": "Modbus", "Level": 50}))
+
+	h.Send(map[string]interface{}{"Msg": "ModbusWrite", "Level": 60})
+	h.ExpectBroadcast(merletest.Fields(map[string]interface{}{
+		"Msg": "Modbus", "Level": 60}))
+}
+
+func TestBadConfig(t *testing.T) {
+	tests := []Config{
+		{},
+		{Addr: "plc", Device: "/dev/ttyUSB0"},
+		{Device: "/dev/ttyUSB0", Parity: "X"},
+		{Addr: "plc", Registers: []Register{{Field: "A", Kind: "table"}}},
+		{Addr: "plc", Registers: []Register{{Field: "A", Kind: Input, Writable: true}}},
+		{Addr: "plc", Registers: []Register{{Field: "A", Kind: Holding, Type: "int8"}}},
+		{Addr: "plc", Registers: []Register{{Field: "A", Kind: Coil}, {Field: "A", Kind: Coil}}},
+	}
+
+	for i, cfg := range tests {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Config %d: no error", i)
+		}
+	}
+}
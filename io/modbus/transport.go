@@ -0,0 +1,192 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Modbus function codes
+const (
+	fnReadCoils      = 0x01
+	fnReadDiscrete   = 0x02
+	fnReadHolding    = 0x03
+	fnReadInput      = 0x04
+	fnWriteCoil      = 0x05
+	fnWriteRegister  = 0x06
+	fnWriteRegisters = 0x10
+	// Set in an exception response's function code
+	fnException = 0x80
+)
+
+// Largest ADU, and Modbus TCP's MBAP header length
+const (
+	maxAdu       = 260
+	tcpHeaderLen = 7
+)
+
+// transport sends a request PDU to unit, and returns the response PDU
+type transport interface {
+	request(unit uint8, pdu []byte) ([]byte, error)
+	Close() error
+}
+
+// Check the response PDU for an exception
+func exception(pdu []byte) error {
+	if len(pdu) >= 2 && pdu[0]&fnException != 0 {
+		return fmt.Errorf("Modbus exception %d, function %#x",
+			pdu[1], pdu[0]&^fnException)
+	}
+	if len(pdu) < 2 {
+		return fmt.Errorf("Modbus response too short")
+	}
+	return nil
+}
+
+// Modbus TCP
+type tcp struct {
+	conn    net.Conn
+	timeout time.Duration
+	txid    uint16
+}
+
+func dialTCP(addr string, timeout time.Duration) (*tcp, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "502")
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &tcp{conn: conn, timeout: timeout}, nil
+}
+
+func (t *tcp) request(unit uint8, pdu []byte) ([]byte, error) {
+	t.txid++
+
+	adu := make([]byte, tcpHeaderLen, tcpHeaderLen+len(pdu))
+	binary.BigEndian.PutUint16(adu[0:], t.txid)
+	binary.BigEndian.PutUint16(adu[4:], uint16(len(pdu)+1))
+	adu[6] = unit
+	adu = append(adu, pdu...)
+
+	t.conn.SetDeadline(time.Now().Add(t.timeout))
+	if _, err := t.conn.Write(adu); err != nil {
+		return nil, err
+	}
+
+	for {
+		header := make([]byte, tcpHeaderLen)
+		if _, err := io.ReadFull(t.conn, header); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(header[4:]))
+		if n < 2 || n > maxAdu {
+			return nil, fmt.Errorf("Modbus TCP length %d", n)
+		}
+		resp := make([]byte, n-1)
+		if _, err := io.ReadFull(t.conn, resp); err != nil {
+			return nil, err
+		}
+		// Skip a late response to an earlier, timed-out, request
+		if binary.BigEndian.Uint16(header[0:]) != t.txid {
+			continue
+		}
+		return resp, exception(resp)
+	}
+}
+
+func (t *tcp) Close() error {
+	return t.conn.Close()
+}
+
+// Modbus RTU, on a serial port
+type rtu struct {
+	port io.ReadWriteCloser
+}
+
+// CRC-16/MODBUS
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Read len(buf) bytes.  A serial port read returning nothing has timed out.
+func readFull(r io.Reader, buf []byte) error {
+	for off := 0; off < len(buf); {
+		n, err := r.Read(buf[off:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("Modbus RTU timed out")
+		}
+		off += n
+	}
+	return nil
+}
+
+func (r *rtu) request(unit uint8, pdu []byte) ([]byte, error) {
+	adu := append([]byte{unit}, pdu...)
+	crc := crc16(adu)
+	adu = append(adu, byte(crc), byte(crc>>8))
+
+	if _, err := r.port.Write(adu); err != nil {
+		return nil, err
+	}
+
+	// RTU frames aren't delimited, so the response's length is by its
+	// function code: unit, function, and CRC, around an exception code,
+	// a byte count and the bytes read, or the address and value written
+	resp := make([]byte, 3, maxAdu)
+	if err := readFull(r.port, resp); err != nil {
+		return nil, err
+	}
+
+	n := 0
+	switch fn := resp[1]; {
+	case fn&fnException != 0:
+		n = 5
+	case fn <= fnReadInput:
+		n = 5 + int(resp[2])
+	default:
+		n = 8
+	}
+	resp = resp[:n]
+	if err := readFull(r.port, resp[3:]); err != nil {
+		return nil, err
+	}
+
+	if crc16(resp[:n-2]) != binary.LittleEndian.Uint16(resp[n-2:]) {
+		return nil, fmt.Errorf("Modbus RTU bad CRC")
+	}
+	if resp[0] != unit {
+		return nil, fmt.Errorf("Modbus RTU response from unit %d", resp[0])
+	}
+
+	pdu = resp[1 : n-2]
+	return pdu, exception(pdu)
+}
+
+func (r *rtu) Close() error {
+	return r.port.Close()
+}
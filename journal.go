@@ -0,0 +1,194 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal is a write-ahead log of Thing's state-changing messages.  Every
+// message broadcast by Thing is appended to the journal, with a sequence
+// number, before it's sent.  The journal is kept in a file, one JSON record
+// per line, so it survives Thing restarts.
+//
+// Thing Prime uses the journal to resync after reconnecting to Thing.  Thing
+// Prime asks for journal records since the last sequence number Thing Prime
+// applied (GetJournalSince) and replays the records (ReplyJournal), in order,
+// on Thing Prime's bus.
+type journal struct {
+	thing *Thing
+	sync.Mutex
+	file    string
+	max     uint
+	seq     uint64
+	records []JournalRecord
+}
+
+func newJournal(thing *Thing, file string, max uint) *journal {
+	return &journal{
+		thing: thing,
+		file:  file,
+		max:   max,
+	}
+}
+
+// Load the journal from file.  A missing file is an empty journal.
+func (j *journal) load() error {
+	j.Lock()
+	defer j.Unlock()
+
+	f, err := os.Open(j.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var rec JournalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Torn write at tail from a crash; drop it
+			j.thing.log.println("Journal skipping bad record:", err)
+			continue
+		}
+		j.records = append(j.records, rec)
+		j.seq = rec.Seq
+	}
+
+	j.trim()
+
+	return scanner.Err()
+}
+
+// Keep only the last max records in memory
+func (j *journal) trim() {
+	if j.max > 0 && uint(len(j.records)) > j.max {
+		j.records = j.records[uint(len(j.records))-j.max:]
+	}
+}
+
+// Rewrite the journal file with just the records in memory
+func (j *journal) compact() error {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	for i := range j.records {
+		enc.Encode(&j.records[i])
+	}
+
+	tmp := j.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.file)
+}
+
+// Append the Packet's message to the journal
+func (j *journal) append(p *Packet) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.seq++
+	rec := JournalRecord{
+		Seq:  j.seq,
+		Time: time.Now(),
+		Msg:  append(json.RawMessage(nil), p.msg...),
+	}
+	j.records = append(j.records, rec)
+
+	f, err := os.OpenFile(j.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		j.thing.log.println("Journal append failed:", err)
+		return
+	}
+	err = json.NewEncoder(f).Encode(&rec)
+	f.Close()
+	if err != nil {
+		j.thing.log.println("Journal append failed:", err)
+	}
+
+	// Let the file grow to twice max before compacting, so compaction
+	// cost is amortized over many appends.
+
+	if j.max > 0 && uint(len(j.records)) >= 2*j.max {
+		j.trim()
+		if err := j.compact(); err != nil {
+			j.thing.log.println("Journal compact failed:", err)
+		}
+	}
+}
+
+// Subscriber handler for GetJournalSince
+func (j *journal) getJournalSince(p *Packet) {
+	var req MsgGetJournalSince
+
+	p.Unmarshal(&req)
+
+	j.Lock()
+	resp := MsgJournal{Msg: ReplyJournal, Seq: j.seq, Complete: true}
+	for _, rec := range j.records {
+		if rec.Seq > req.Seq {
+			resp.Records = append(resp.Records, rec)
+		}
+	}
+	// Records between req.Seq and the oldest record held have been
+	// trimmed, so the journal can't fully catch up the requester
+	if len(j.records) > 0 && j.records[0].Seq > req.Seq+1 {
+		resp.Complete = false
+	}
+	j.Unlock()
+
+	p.Marshal(&resp).Reply()
+}
+
+// Thing Prime subscriber handler for ReplyJournal.  Replay the records not
+// yet applied on Thing Prime's bus, as if they came from Thing.
+func (t *Thing) replayJournal(p *Packet) {
+	var msg MsgJournal
+
+	p.Unmarshal(&msg)
+
+	if !msg.Complete {
+		t.log.println("Journal incomplete; some messages since last sync are lost")
+	}
+
+	// Thing's journal restarted from scratch; start over
+	if msg.Seq < t.journalSeq {
+		t.journalSeq = 0
+		t.getJournalSince()
+		return
+	}
+
+	for _, rec := range msg.Records {
+		if rec.Seq <= t.journalSeq {
+			continue
+		}
+		t.bus.receive(&Packet{bus: t.bus, src: p.src, msg: rec.Msg})
+		t.journalSeq = rec.Seq
+	}
+}
+
+// Thing Prime asks Thing for journal records since last sync
+func (t *Thing) getJournalSince() {
+	if !t.journaling {
+		return
+	}
+	msg := MsgGetJournalSince{Msg: GetJournalSince, Seq: t.journalSeq}
+	t.primeSock.Send(newPacket(t.bus, nil, &msg))
+}
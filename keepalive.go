@@ -0,0 +1,87 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keep the WebSocket alive, and reap it if the peer goes quiet.  Thing pings
+// the peer every Cfg.PingInterval seconds.  A pong, or any message, from the
+// peer pushes out the read deadline; if the peer is quiet for a ping
+// interval plus Cfg.PongTimeout seconds, the pending read fails, and the
+// WebSocket is unplugged from the bus as if the peer had hung up, so the
+// usual disconnect events follow.
+func (t *Thing) keepalive(ws *webSocket) {
+	if t.Cfg.PingInterval == 0 {
+		return
+	}
+
+	interval := time.Duration(t.Cfg.PingInterval) * time.Second
+	timeout := time.Duration(t.Cfg.PongTimeout) * time.Second
+
+	ws.quiet = interval + timeout
+	ws.alive()
+	ws.conn.SetPongHandler(func(string) error {
+		ws.alive()
+		return nil
+	})
+
+	ws.pinger = time.NewTicker(interval)
+	ws.done = make(chan bool)
+
+	go func(ticker *time.Ticker, done chan bool) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// WriteControl is safe alongside Send's writes
+				deadline := time.Now().Add(timeout)
+				if err := ws.conn.WriteControl(websocket.PingMessage,
+					nil, deadline); err != nil {
+					return
+				}
+			}
+		}
+	}(ws.pinger, ws.done)
+}
+
+// Peer is alive; push out the read deadline
+func (ws *webSocket) alive() {
+	if ws.quiet > 0 {
+		ws.conn.SetReadDeadline(time.Now().Add(ws.quiet))
+	}
+}
+
+// Read a message from the peer
+func (ws *webSocket) read() ([]byte, error) {
+	_, msg, err := ws.conn.ReadMessage()
+	if err = ws.check(err); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			ws.thing.log.printf("Websocket [%s] quiet for %s; reaping",
+				ws.name, ws.quiet)
+		}
+		return nil, err
+	}
+	ws.alive()
+	if ws.link != nil {
+		msg = ws.link.receive(ws, msg)
+	}
+	return msg, nil
+}
+
+func (ws *webSocket) stopKeepalive() {
+	if ws.pinger != nil {
+		ws.pinger.Stop()
+		close(ws.done)
+	}
+}
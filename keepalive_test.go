@@ -0,0 +1,76 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKeepalive(t *testing.T) {
+	thing := NewThing(&pump{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PingInterval = 1
+	thing.Cfg.PongTimeout = 1
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(thing.ws))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// Reading answers pings
+	alive, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Never reads, so never answers pings; a half-open peer
+	quiet, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quiet.Close()
+
+	sockets := func() int {
+		thing.bus.sockLock.RLock()
+		defer thing.bus.sockLock.RUnlock()
+		return len(thing.bus.sockets)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for sockets() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := sockets(); n != 2 {
+		t.Fatalf("Got %d sockets, want 2", n)
+	}
+
+	// Quiet peer reaped after a ping interval plus the pong timeout
+	deadline = time.Now().Add(4 * time.Second)
+	for sockets() != 1 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := sockets(); n != 1 {
+		t.Fatalf("Got %d sockets, want 1", n)
+	}
+}
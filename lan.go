@@ -0,0 +1,490 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LAN configuration.  Things on the same LAN share presence, and messages,
+// directly with each other over UDP multicast, for local automation that
+// can't wait on a round trip through a bridge or Thing Prime.
+//
+// Each Thing multicasts a beacon, with its Id, model, name, and ports, every
+// Beacon seconds.  A sibling Thing heard for the first time is received by
+// Thing as EventLANPeerUp; a sibling not heard for three beacons, or saying
+// goodbye as it stops, as EventLANPeerDown.  See Thing.LANPeers.
+//
+// Broadcast messages in Msgs are multicast to siblings as they're sent.
+// Siblings' messages in Msgs are received by Thing as if from a client, with
+// Packet.Src the sibling's Id; a Reply goes back to the sibling.  Messages
+// from siblings aren't multicast again.  Sharing messages needs a Key, so
+// only siblings can send them.
+type LANConfig struct {
+
+	// Multicast group and port, e.g. "239.255.77.82:7482".  LAN mode is
+	// disabled if Group is empty.  The default is "".
+	Group string
+
+	// [Optional] Network interface to multicast on, e.g. "eth0".  The
+	// default is "" (the system's choice).
+	Iface string
+
+	// Messages shared with siblings.  Msgs needs Key.  The default is nil
+	// (presence only).
+	Msgs []string
+
+	// [Optional] Seconds between beacons.  The default is 10.
+	Beacon uint
+
+	// [Optional] Key shared by siblings.  If set, datagrams are signed with
+	// HMAC-SHA256, and datagrams not signed with Key are dropped, as are
+	// datagrams already heard, or sent more than 30 seconds from now, so
+	// siblings' clocks must agree to within 30 seconds.  The default is ""
+	// (not signed).
+	Key string
+}
+
+// Largest datagram sent, to stay clear of IP fragmentation
+const lanMaxSize = 1400
+
+// Signed datagrams sent further than this from now are dropped, and those
+// heard within it are remembered, to drop replays
+const lanWindow = 30 * time.Second
+
+// Datagram between siblings.  Every datagram says who it's from.
+type lanDatagram struct {
+	Id            string
+	Model         string
+	Name          string
+	PortPublic    uint
+	PortPublicTLS uint
+	PortPrivate   uint
+	// When sent, in Unix nanoseconds; unique to the sender
+	Time int64
+	// Goodbye, as Thing stops
+	Bye bool `json:",omitempty"`
+	// Shared message; a beacon has none
+	Msg json.RawMessage `json:",omitempty"`
+}
+
+// UDP socket joined to the group, as opened by lanListen
+type lanConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	Close() error
+}
+
+// Join the group; tests substitute a fake LAN
+var lanListen = func(ifi *net.Interface, group *net.UDPAddr) (lanConn, error) {
+	return net.ListenMulticastUDP("udp4", ifi, group)
+}
+
+// Socket to the group, for Thing's broadcasts
+type lan struct {
+	sync.Mutex
+	thing *Thing
+	cfg   LANConfig
+	group *net.UDPAddr
+	msgs  map[string]bool
+	conn  lanConn
+	peers map[string]*lanPeer
+	// Last Time sent
+	sent int64
+	// Signed datagrams heard within lanWindow, by sender and Time
+	heardAt map[lanStamp]time.Time
+	done    chan bool
+	sync.WaitGroup
+}
+
+type lanStamp struct {
+	id   string
+	time int64
+}
+
+// Socket to a sibling, as the source of the sibling's messages
+type lanPeer struct {
+	lan   *lan
+	id    string
+	addr  *net.UDPAddr
+	seen  time.Time
+	thing DiscoveredThing
+}
+
+func newLAN(thing *Thing, cfg LANConfig) (*lan, error) {
+	group, err := net.ResolveUDPAddr("udp4", cfg.Group)
+	if err != nil {
+		return nil, fmt.Errorf("LAN Group: %s", err)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("LAN Group %s isn't multicast", cfg.Group)
+	}
+	if cfg.Beacon == 0 {
+		return nil, fmt.Errorf("LAN Beacon must be non-zero")
+	}
+	if len(cfg.Msgs) > 0 && cfg.Key == "" {
+		return nil, fmt.Errorf("LAN Msgs need Key")
+	}
+
+	l := &lan{
+		thing:   thing,
+		cfg:     cfg,
+		group:   group,
+		msgs:    make(map[string]bool),
+		peers:   make(map[string]*lanPeer),
+		heardAt: make(map[lanStamp]time.Time),
+	}
+	for _, msg := range cfg.Msgs {
+		if strings.HasPrefix(msg, "_") {
+			return nil, fmt.Errorf("LAN can't share system message %s", msg)
+		}
+		l.msgs[msg] = true
+	}
+
+	return l, nil
+}
+
+func (l *lan) start() error {
+	var ifi *net.Interface
+	var err error
+
+	if l.cfg.Iface != "" {
+		ifi, err = net.InterfaceByName(l.cfg.Iface)
+		if err != nil {
+			return newError(ErrLAN, err)
+		}
+	}
+
+	l.conn, err = lanListen(ifi, l.group)
+	if err != nil {
+		return newError(ErrLAN, err)
+	}
+
+	l.thing.bus.plugin(l)
+	l.thing.log.printf("LAN joined %s", l.cfg.Group)
+
+	l.done = make(chan bool)
+	l.Add(2)
+	go l.read()
+	go l.beacon()
+
+	return nil
+}
+
+func (l *lan) stop() {
+	close(l.done)
+	l.send(&lanDatagram{Bye: true}, l.group)
+	l.conn.Close()
+	l.Wait()
+	l.thing.bus.unplug(l)
+}
+
+// Sign data, if there's a key
+func (l *lan) sign(data []byte) []byte {
+	if l.cfg.Key == "" {
+		return data
+	}
+	mac := hmac.New(sha256.New, []byte(l.cfg.Key))
+	mac.Write(data)
+	return append(mac.Sum(nil), data...)
+}
+
+// Check datagram's signature, if there's a key, and return its data
+func (l *lan) open(datagram []byte) ([]byte, bool) {
+	if l.cfg.Key == "" {
+		return datagram, true
+	}
+	if len(datagram) < sha256.Size {
+		return nil, false
+	}
+	sum, data := datagram[:sha256.Size], datagram[sha256.Size:]
+	mac := hmac.New(sha256.New, []byte(l.cfg.Key))
+	mac.Write(data)
+	return data, hmac.Equal(sum, mac.Sum(nil))
+}
+
+// Send d, from Thing, to addr
+func (l *lan) send(d *lanDatagram, addr *net.UDPAddr) error {
+	t := l.thing
+
+	d.Id = t.id
+	d.Model = t.model
+	d.Name = t.name
+	d.PortPublic = t.web.public.port
+	d.PortPublicTLS = t.web.public.portTLS
+	d.PortPrivate = t.web.private.port
+
+	// Time is unique, even if the clock hasn't moved, or steps back
+	l.Lock()
+	l.sent++
+	if now := t.Now().UnixNano(); now > l.sent {
+		l.sent = now
+	}
+	d.Time = l.sent
+	l.Unlock()
+
+	data, _ := json.Marshal(d)
+	data = l.sign(data)
+	if len(data) > lanMaxSize {
+		return fmt.Errorf("LAN datagram is %d bytes; max is %d",
+			len(data), lanMaxSize)
+	}
+
+	_, err := l.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// Send the message in p to addr, if it's shared
+func (l *lan) share(p *Packet, addr *net.UDPAddr) error {
+	var msg Msg
+	p.Unmarshal(&msg)
+	if !l.msgs[msg.Msg] {
+		return nil
+	}
+	return l.send(&lanDatagram{Msg: p.msg}, addr)
+}
+
+// Beacon, and drop siblings gone quiet, until stopped
+func (l *lan) beacon() {
+	defer l.Done()
+
+	interval := time.Duration(l.cfg.Beacon) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		l.send(&lanDatagram{}, l.group)
+
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		var quiet []string
+		l.Lock()
+		for id, peer := range l.peers {
+			if time.Since(peer.seen) > 3*interval {
+				quiet = append(quiet, id)
+			}
+		}
+		for stamp, at := range l.heardAt {
+			if time.Since(at) > 2*lanWindow {
+				delete(l.heardAt, stamp)
+			}
+		}
+		l.Unlock()
+		for _, id := range quiet {
+			l.lost(id)
+		}
+	}
+}
+
+// Receive datagrams until the socket closes
+func (l *lan) read() {
+	defer l.Done()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		l.receive(buf[:n], src)
+	}
+}
+
+func (l *lan) receive(datagram []byte, src *net.UDPAddr) {
+	t := l.thing
+
+	data, ok := l.open(datagram)
+	if !ok {
+		return
+	}
+
+	var d lanDatagram
+	if err := json.Unmarshal(data, &d); err != nil || d.Id == "" {
+		return
+	}
+	// Thing's own, looped back
+	if d.Id == t.id {
+		return
+	}
+	if !l.fresh(&d) {
+		return
+	}
+
+	if d.Bye {
+		l.lost(d.Id)
+		return
+	}
+
+	peer := l.heard(&d, src)
+
+	if d.Msg == nil {
+		return
+	}
+	var msg Msg
+	if err := json.Unmarshal(d.Msg, &msg); err != nil || !l.msgs[msg.Msg] {
+		return
+	}
+	t.bus.receive(&Packet{bus: t.bus, src: peer, msg: d.Msg})
+}
+
+// Whether d, if signed, was sent within lanWindow of now, and not heard
+// before.  A datagram heard before is a replay.
+func (l *lan) fresh(d *lanDatagram) bool {
+	if l.cfg.Key == "" {
+		return true
+	}
+
+	sent := time.Unix(0, d.Time)
+	skew := l.thing.Now().Sub(sent)
+	if skew > lanWindow || skew < -lanWindow {
+		return false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	stamp := lanStamp{d.Id, d.Time}
+	if _, ok := l.heardAt[stamp]; ok {
+		return false
+	}
+	l.heardAt[stamp] = time.Now()
+	return true
+}
+
+// Sibling heard from; a new sibling is up
+func (l *lan) heard(d *lanDatagram, src *net.UDPAddr) *lanPeer {
+	l.Lock()
+	peer, ok := l.peers[d.Id]
+	if !ok {
+		peer = &lanPeer{lan: l, id: d.Id}
+		l.peers[d.Id] = peer
+	}
+	peer.addr = src
+	peer.seen = time.Now()
+	peer.thing = DiscoveredThing{Id: d.Id, Model: d.Model,
+		Name: d.Name, Host: src.IP.String(), PortPublic: d.PortPublic,
+		PortPublicTLS: d.PortPublicTLS, PortPrivate: d.PortPrivate}
+	l.Unlock()
+
+	if !ok {
+		l.thing.log.printf("LAN sibling up [%s]", d.Id)
+		// Beacon back, so the sibling needn't wait for the next one
+		l.send(&lanDatagram{}, src)
+		l.event(EventLANPeerUp, peer)
+	}
+
+	return peer
+}
+
+// Sibling gone
+func (l *lan) lost(id string) {
+	l.Lock()
+	peer, ok := l.peers[id]
+	delete(l.peers, id)
+	l.Unlock()
+
+	if ok {
+		l.thing.log.printf("LAN sibling down [%s]", id)
+		l.event(EventLANPeerDown, peer)
+	}
+}
+
+func (l *lan) event(event string, peer *lanPeer) {
+	t := l.thing
+
+	l.Lock()
+	msg := MsgLANPeer{Msg: event, Id: peer.id, Model: peer.thing.Model,
+		Name: peer.thing.Name, Host: peer.thing.Host}
+	l.Unlock()
+
+	t.bus.receive(newPacket(t.bus, peer, &msg))
+}
+
+// Multicast Thing's broadcast, if it's shared, and not from a sibling
+func (l *lan) Send(p *Packet) error {
+	if _, ok := p.src.(*lanPeer); ok {
+		return nil
+	}
+	return l.share(p, l.group)
+}
+
+func (l *lan) Close() {
+}
+
+func (l *lan) Name() string {
+	return "lan:" + l.cfg.Group
+}
+
+func (l *lan) Flags() uint32 {
+	return sock_flag_bcast
+}
+
+func (l *lan) SetFlags(flags uint32) {
+}
+
+func (l *lan) Src() string {
+	return l.cfg.Group
+}
+
+// Reply to the sibling, if the message is shared
+func (p *lanPeer) Send(pkt *Packet) error {
+	p.lan.Lock()
+	addr := p.addr
+	p.lan.Unlock()
+	return p.lan.share(pkt, addr)
+}
+
+func (p *lanPeer) Close() {
+}
+
+func (p *lanPeer) Name() string {
+	return "lan:" + p.id
+}
+
+func (p *lanPeer) Flags() uint32 {
+	return 0
+}
+
+func (p *lanPeer) SetFlags(flags uint32) {
+}
+
+func (p *lanPeer) Src() string {
+	return p.id
+}
+
+// LANPeers returns the sibling Things heard on the LAN, sorted by Id.  See
+// LANConfig.
+func (t *Thing) LANPeers() []DiscoveredThing {
+	peers := []DiscoveredThing{}
+	if t.lan == nil {
+		return peers
+	}
+
+	t.lan.Lock()
+	for _, peer := range t.lan.peers {
+		peers = append(peers, peer.thing)
+	}
+	t.lan.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Id < peers[j].Id
+	})
+
+	return peers
+}
@@ -0,0 +1,217 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// LAN, delivering datagrams to the group, or to one host
+type fakeLAN struct {
+	sync.Mutex
+	group *net.UDPAddr
+	conns []*fakeLANConn
+}
+
+type lanDelivery struct {
+	data []byte
+	src  *net.UDPAddr
+}
+
+type fakeLANConn struct {
+	lan  *fakeLAN
+	addr *net.UDPAddr
+	rx   chan lanDelivery
+}
+
+func (f *fakeLAN) join(host string) *fakeLANConn {
+	f.Lock()
+	defer f.Unlock()
+	c := &fakeLANConn{lan: f, rx: make(chan lanDelivery, 100),
+		addr: &net.UDPAddr{IP: net.ParseIP(host), Port: f.group.Port}}
+	f.conns = append(f.conns, c)
+	return c
+}
+
+func (c *fakeLANConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	d, ok := <-c.rx
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	return copy(b, d.data), d.src, nil
+}
+
+func (c *fakeLANConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	f := c.lan
+	f.Lock()
+	defer f.Unlock()
+	for _, to := range f.conns {
+		if addr.IP.Equal(f.group.IP) || addr.IP.Equal(to.addr.IP) {
+			select {
+			case to.rx <- lanDelivery{append([]byte(nil), b...), c.addr}:
+			default:
+			}
+		}
+	}
+	return len(b), nil
+}
+
+func (c *fakeLANConn) Close() error {
+	f := c.lan
+	f.Lock()
+	defer f.Unlock()
+	for i, to := range f.conns {
+		if to == c {
+			f.conns = append(f.conns[:i], f.conns[i+1:]...)
+			close(c.rx)
+			break
+		}
+	}
+	return nil
+}
+
+// Thing noting what it hears from siblings
+type sibling struct {
+	got chan string
+}
+
+func (s *sibling) note(p *Packet) {
+	var msg Msg
+	p.Unmarshal(&msg)
+	s.got <- msg.Msg + ":" + p.Src()
+}
+
+func (s *sibling) Subscribers() Subscribers {
+	return Subscribers{
+		EventLANPeerUp:   s.note,
+		EventLANPeerDown: s.note,
+		"Door":           func(p *Packet) { p.Marshal(&Msg{Msg: "DoorAck"}).Reply() },
+		"DoorAck":        s.note,
+	}
+}
+
+func (s *sibling) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestLAN(t *testing.T) {
+	cfg := LANConfig{Group: "239.255.77.82:7482", Msgs: []string{"Door", "DoorAck"},
+		Beacon: 10, Key: "shh"}
+	group, _ := net.ResolveUDPAddr("udp4", cfg.Group)
+	f := &fakeLAN{group: group}
+
+	saved := lanListen
+	defer func() { lanListen = saved }()
+
+	newSibling := func(id, host string) (*Thing, *sibling) {
+		s := &sibling{got: make(chan string, 10)}
+		thing := NewThing(s)
+		thing.Cfg.Id = id
+		thing.Cfg.LAN = cfg
+		if err := thing.build(true); err != nil {
+			t.Fatal(err)
+		}
+		lanListen = func(*net.Interface, *net.UDPAddr) (lanConn, error) {
+			return f.join(host), nil
+		}
+		if err := thing.lan.start(); err != nil {
+			t.Fatal(err)
+		}
+		return thing, s
+	}
+
+	expect := func(s *sibling, want string) {
+		select {
+		case got := <-s.got:
+			if got != want {
+				t.Errorf("Got %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Nothing, want %s", want)
+		}
+	}
+
+	a, sa := newSibling("front", "10.0.0.1")
+	b, sb := newSibling("porch", "10.0.0.2")
+
+	// Each hears the other
+	expect(sa, "_EventLANPeerUp:porch")
+	expect(sb, "_EventLANPeerUp:front")
+	peers := a.LANPeers()
+	if len(peers) != 1 || peers[0].Id != "porch" || peers[0].Host != "10.0.0.2" {
+		t.Errorf("Peers %+v", peers)
+	}
+
+	// A's broadcast reaches B, and B's reply comes back to A only
+	spy := f.join("10.0.0.4")
+	a.bus.broadcast(newPacket(a.bus, nil, &Msg{Msg: "Door"}))
+	expect(sa, "DoorAck:porch")
+
+	// A replay of A's broadcast, and a stale signed datagram, are dropped
+	var door []byte
+	for door == nil {
+		select {
+		case d := <-spy.rx:
+			if bytes.Contains(d.data, []byte(`"Msg":{"Msg":"Door"}`)) {
+				door = d.data
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Door not heard")
+		}
+	}
+	spy.WriteToUDP(door, group)
+	spy.WriteToUDP(a.lan.sign([]byte(`{"Id":"rogue","Time":1,"Msg":{"Msg":"DoorAck"}}`)), group)
+	spy.Close()
+	select {
+	case got := <-sa.got:
+		t.Errorf("Got %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Unshared messages, and unsigned datagrams, are dropped
+	a.bus.broadcast(newPacket(a.bus, nil, &Msg{Msg: "Other"}))
+	conn := f.join("10.0.0.3")
+	conn.WriteToUDP([]byte(`{"Id":"rogue","Msg":{"Msg":"DoorAck"}}`), group)
+	conn.Close()
+	select {
+	case got := <-sa.got:
+		t.Errorf("Got %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// B says goodbye
+	b.lan.stop()
+	expect(sa, "_EventLANPeerDown:porch")
+	if peers := a.LANPeers(); len(peers) != 0 {
+		t.Errorf("Peers %+v after goodbye", peers)
+	}
+
+	a.lan.stop()
+}
+
+func TestLANBadConfig(t *testing.T) {
+	tests := []LANConfig{
+		{Group: "10.0.0.1:7482", Beacon: 10},
+		{Group: "239.255.77.82", Beacon: 10},
+		{Group: "239.255.77.82:7482"},
+		{Group: "239.255.77.82:7482", Beacon: 10, Msgs: []string{GetState}, Key: "shh"},
+		{Group: "239.255.77.82:7482", Beacon: 10, Msgs: []string{"Door"}},
+	}
+
+	for i, cfg := range tests {
+		thing := NewThing(&sparse{})
+		thing.Cfg.Id = testId
+		thing.Cfg.LAN = cfg
+		if err := thing.build(true); ErrorCode(err) != ErrBadConfig.Code {
+			t.Errorf("Config %d: got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Component states
+const (
+	// Component is not started, or has been stopped
+	ComponentStopped = "stopped"
+	// Component is running
+	ComponentRunning = "running"
+	// Component failed, but Thing runs on without it
+	ComponentDegraded = "degraded"
+)
+
+// Failure policies, for what to do when a component fails, e.g. when a web
+// server can't listen on its port because the port is in use.  See
+// Cfg.PublicFailure and Cfg.PrivateFailure.
+const (
+	// Thing.Run() returns with an error
+	FailureFatal = "fatal"
+	// Thing runs on without the component, and the component is
+	// restarted every Cfg.RetryInterval seconds until it's running
+	// again
+	FailureRetry = "retry"
+	// Thing runs on without the component
+	FailureDisable = "disable"
+)
+
+func validFailure(policy string) bool {
+	switch policy {
+	case FailureFatal, FailureRetry, FailureDisable:
+		return true
+	}
+	return false
+}
+
+// ComponentStatus is the status of one of Thing's framework components, such
+// as the public web server or the tunnel to mother.  See Thing.Components().
+type ComponentStatus struct {
+	Name  string
+	State string
+	// Last error, if the component failed
+	Err string
+}
+
+type component struct {
+	ComponentStatus
+	policy   string
+	started  bool
+	retrying bool
+	start    func() error
+	stop     func()
+}
+
+// Lifecycle manager for Thing's framework components.  Components are started
+// in the order added and stopped in reverse order.
+type lifecycle struct {
+	thing *Thing
+	sync.Mutex
+	comps   []*component
+	retry   time.Duration
+	stopped bool
+	done    chan bool
+	// fatal component failure after start
+	failed chan error
+}
+
+func newLifecycle(thing *Thing, retry time.Duration) *lifecycle {
+	return &lifecycle{
+		thing:  thing,
+		retry:  retry,
+		done:   make(chan bool),
+		failed: make(chan error, 1),
+	}
+}
+
+func (l *lifecycle) add(name string, policy string, start func() error, stop func()) {
+	l.comps = append(l.comps, &component{
+		ComponentStatus: ComponentStatus{Name: name, State: ComponentStopped},
+		policy:          policy,
+		start:           start,
+		stop:            stop,
+	})
+}
+
+// Start components, in order.  If a component with FailureFatal policy fails
+// to start, the components already started are stopped and the error is
+// returned.
+func (l *lifecycle) start() error {
+	for i, c := range l.comps {
+		err := c.start()
+
+		l.Lock()
+		if err == nil {
+			c.State, c.Err = ComponentRunning, ""
+			c.started = true
+			l.Unlock()
+			continue
+		}
+		c.State, c.Err = ComponentDegraded, err.Error()
+		l.Unlock()
+
+		if ErrorCode(err) != "" {
+			l.thing.raise(err)
+		}
+
+		switch c.policy {
+		case FailureFatal:
+			for j := i - 1; j >= 0; j-- {
+				l.stopComponent(l.comps[j])
+			}
+			return fmt.Errorf("Starting %s failed: %w", c.Name, err)
+		case FailureRetry:
+			l.thing.log.printf("Starting %s failed, retrying: %s",
+				c.Name, err)
+			l.Lock()
+			l.retryComponent(c)
+			l.Unlock()
+		default:
+			l.thing.log.printf("Starting %s failed, running without it: %s",
+				c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Restart component every retry interval until it's running.  Call with lock
+// held.
+func (l *lifecycle) retryComponent(c *component) {
+	if c.retrying || l.stopped {
+		return
+	}
+	c.retrying = true
+
+	go func() {
+		ticker := time.NewTicker(l.retry)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+			}
+
+			l.Lock()
+			started := c.started
+			c.started = false
+			l.Unlock()
+
+			if started {
+				c.stop()
+			}
+
+			err := c.start()
+
+			l.Lock()
+			if err != nil {
+				c.Err = err.Error()
+				l.Unlock()
+				continue
+			}
+			c.retrying, c.started = false, true
+			stopped := l.stopped
+			if !stopped {
+				c.State, c.Err = ComponentRunning, ""
+			}
+			l.Unlock()
+
+			if stopped {
+				// Lost race with stop
+				c.stop()
+			} else {
+				l.thing.log.printf("%s running again", c.Name)
+			}
+			return
+		}
+	}()
+}
+
+func (l *lifecycle) stopComponent(c *component) {
+	l.Lock()
+	started := c.started
+	c.State, c.started = ComponentStopped, false
+	l.Unlock()
+
+	if started {
+		c.stop()
+	}
+}
+
+// Stop components, in reverse order
+func (l *lifecycle) stop() {
+	l.Lock()
+	if !l.stopped {
+		l.stopped = true
+		close(l.done)
+	}
+	l.Unlock()
+
+	for i := len(l.comps) - 1; i >= 0; i-- {
+		l.stopComponent(l.comps[i])
+	}
+}
+
+// Report a component failure after start.  Call fail from the component's
+// goroutines rather than killing the process.
+func (l *lifecycle) fail(name string, err error) {
+	if ErrorCode(err) != "" {
+		l.thing.raise(err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for _, c := range l.comps {
+		if c.Name != name {
+			continue
+		}
+		c.State, c.Err = ComponentDegraded, err.Error()
+		switch c.policy {
+		case FailureFatal:
+		case FailureRetry:
+			l.thing.log.printf("%s failed, retrying: %s", name, err)
+			l.retryComponent(c)
+			return
+		default:
+			l.thing.log.printf("%s failed, running without it: %s",
+				name, err)
+			return
+		}
+		break
+	}
+
+	l.thing.log.printf("%s failed: %s", name, err)
+
+	select {
+	case l.failed <- fmt.Errorf("%s failed: %w", name, err):
+	default:
+		// Already failing
+	}
+}
+
+// Run f until f returns or a component fails fatally
+func (l *lifecycle) run(f func() error) error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case err := <-l.failed:
+		return err
+	}
+}
+
+func (l *lifecycle) status() []ComponentStatus {
+	l.Lock()
+	defer l.Unlock()
+
+	status := make([]ComponentStatus, len(l.comps))
+	for i, c := range l.comps {
+		status[i] = c.ComponentStatus
+	}
+
+	return status
+}
+
+// Components returns the status of Thing's framework components, in start
+// order.  A Thing with degraded components is still running, but without
+// some function, e.g. without a tunnel to mother.
+func (t *Thing) Components() []ComponentStatus {
+	if t.lifecycle == nil {
+		return nil
+	}
+	return t.lifecycle.status()
+}
@@ -0,0 +1,92 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	var events []string
+
+	thing := NewThing(&sparse{})
+	thing.log = newLogger("", false)
+
+	comp := func(name string, policy string, err error) {
+		thing.lifecycle.add(name, policy,
+			func() error { events = append(events, "start "+name); return err },
+			func() { events = append(events, "stop "+name) })
+	}
+
+	thing.lifecycle = newLifecycle(thing, 10*time.Millisecond)
+	comp("a", FailureFatal, nil)
+	comp("b", FailureDisable, fmt.Errorf("oops"))
+	comp("c", FailureFatal, nil)
+
+	if err := thing.lifecycle.start(); err != nil {
+		t.Fatal(err)
+	}
+	if s := thing.Components()[1]; s.State != ComponentDegraded || s.Err != "oops" {
+		t.Errorf("Got %+v, want degraded b", s)
+	}
+	thing.lifecycle.stop()
+
+	want := []string{"start a", "start b", "start c", "stop c", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Got %v, want %v", events, want)
+	}
+
+	// Fatal component fails to start; started components are stopped
+	events = nil
+	thing.lifecycle = newLifecycle(thing, 10*time.Millisecond)
+	comp("a", FailureFatal, nil)
+	comp("c", FailureFatal, fmt.Errorf("port in use"))
+
+	if err := thing.lifecycle.start(); err == nil {
+		t.Errorf("Start should have failed")
+	}
+
+	want = []string{"start a", "start c", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("Got %v, want %v", events, want)
+	}
+
+	// Fatal component fails after start
+	err := thing.lifecycle.run(func() error {
+		thing.lifecycle.fail("a", fmt.Errorf("gone"))
+		select {}
+	})
+	if err == nil {
+		t.Errorf("Run should have returned failure")
+	}
+
+	// Component fails to start, and is retried until it starts
+	tries := 0
+	thing.lifecycle = newLifecycle(thing, 10*time.Millisecond)
+	thing.lifecycle.add("d", FailureRetry,
+		func() error {
+			if tries++; tries < 3 {
+				return fmt.Errorf("port in use")
+			}
+			return nil
+		}, func() {})
+
+	if err := thing.lifecycle.start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && thing.Components()[0].State != ComponentRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := thing.Components()[0]; s.State != ComponentRunning || tries != 3 {
+		t.Errorf("Got %+v after %d tries, want running after 3", s, tries)
+	}
+	thing.lifecycle.stop()
+}
@@ -0,0 +1,78 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Limit what the peer on the WebSocket can send: messages are no bigger
+// than Cfg.MaxMsgSize and, if rated, come no faster than Cfg.MaxMsgRate.
+// The peer is disconnected on a violation, and the violation is raised as
+// an Error, naming the peer.
+func (t *Thing) limit(ws *webSocket, rated bool) {
+	if t.Cfg.MaxMsgSize > 0 {
+		ws.conn.SetReadLimit(int64(t.Cfg.MaxMsgSize))
+	}
+	if rated && t.Cfg.MaxMsgRate > 0 {
+		ws.rate = float64(t.Cfg.MaxMsgRate)
+		ws.tokens = ws.rate
+		ws.last = time.Now()
+	}
+}
+
+// Take a token for a message, if there's one.  The bucket holds a second's
+// worth of messages, and refills at the rate.
+func (ws *webSocket) take() bool {
+	if ws.rate == 0 {
+		return true
+	}
+
+	now := time.Now()
+	ws.tokens += now.Sub(ws.last).Seconds() * ws.rate
+	if ws.tokens > ws.rate {
+		ws.tokens = ws.rate
+	}
+	ws.last = now
+
+	if ws.tokens < 1 {
+		return false
+	}
+	ws.tokens--
+	return true
+}
+
+// Check the message just read against the limits
+func (ws *webSocket) check(err error) error {
+	t := ws.thing
+
+	if errors.Is(err, websocket.ErrReadLimit) {
+		// The close frame was sent on the way out of the read
+		err = newError(ErrMsgTooBig, fmt.Errorf("Websocket [%s] sent "+
+			"a message over %d bytes", ws.name, t.Cfg.MaxMsgSize))
+		t.raise(err)
+		return err
+	}
+
+	if err == nil && !ws.take() {
+		err = newError(ErrFlood, fmt.Errorf("Websocket [%s] sent over "+
+			"%d messages per second", ws.name, t.Cfg.MaxMsgRate))
+		t.raise(err)
+		close := websocket.FormatCloseMessage(websocket.ClosePolicyViolation,
+			"too many messages")
+		ws.conn.WriteControl(websocket.CloseMessage, close,
+			time.Now().Add(time.Second))
+		return err
+	}
+
+	return err
+}
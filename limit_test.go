@@ -0,0 +1,120 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLimits(t *testing.T) {
+	thing := NewThing(&pump{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PingInterval = 0
+	thing.Cfg.MaxMsgSize = 100
+	thing.Cfg.MaxMsgRate = 5
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(thing.ws))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// Send msg, repeated, until the WebSocket is closed, returning the
+	// close code
+	closed := func(msg string, repeat int) int {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		for i := 0; i < repeat; i++ {
+			conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, _, err := conn.ReadMessage()
+			if ce, ok := err.(*websocket.CloseError); ok {
+				return ce.Code
+			}
+			if err != nil {
+				return 0
+			}
+		}
+	}
+
+	ping := `{"Msg":"Ping"}`
+	if code := closed(ping, 5); code != 0 {
+		t.Errorf("Closed within limits, code %d", code)
+	}
+
+	big := `{"Msg":"Ping","Pad":"` + strings.Repeat("x", 100) + `"}`
+	if code := closed(big, 1); code != websocket.CloseMessageTooBig {
+		t.Errorf("Big message closed with %d", code)
+	}
+
+	if code := closed(ping, 20); code != websocket.ClosePolicyViolation {
+		t.Errorf("Flood closed with %d", code)
+	}
+
+	codes := map[string]bool{}
+	for _, e := range thing.Errors() {
+		codes[e.Code] = true
+	}
+	if !codes[ErrMsgTooBig.Code] || !codes[ErrFlood.Code] {
+		t.Errorf("Errors %+v", thing.Errors())
+	}
+}
+
+func TestRejectWhenFull(t *testing.T) {
+	thing := NewThing(&pump{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PingInterval = 0
+	thing.Cfg.MaxConnections = 1
+	thing.Cfg.RejectWhenFull = true
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(thing.ws))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Second connection: %v %v, want 503", resp, err)
+	}
+
+	// A place opens when the first closes
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		second, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			second.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection after close: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
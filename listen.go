@@ -0,0 +1,179 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Listen on port at each bind address.  A bind address is an IPv4 or IPv6
+// address (with optional zone, for link-local addresses, e.g.
+// "fe80::1%eth0"), or a network interface name, e.g. "eth0", meaning each
+// address on the interface.  With no bind addresses, listen on port on all
+// interfaces.  If port is zero, a free port is picked, and the same port is
+// used for all bind addresses.
+//
+// If any listen fails, listeners already opened are closed and the error is
+// returned.
+//
+// Sockets passed by systemd socket activation for port are used as is,
+// whatever the bind addresses.
+func listen(binds []string, port uint) ([]net.Listener, error) {
+	var hosts []string
+
+	if lns := activated(port); len(lns) > 0 {
+		return lns, nil
+	}
+
+	if len(binds) == 0 {
+		hosts = append(hosts, "")
+	}
+
+	for _, bind := range binds {
+		ips, err := bindIPs(bind)
+		if err != nil {
+			return nil, newError(ErrListen, err)
+		}
+		hosts = append(hosts, ips...)
+	}
+
+	var lns []net.Listener
+
+	for _, host := range hosts {
+		p := strconv.FormatUint(uint64(port), 10)
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, p))
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, newError(ErrListen, err)
+		}
+		lns = append(lns, ln)
+		if port == 0 {
+			port = uint(ln.Addr().(*net.TCPAddr).Port)
+		}
+	}
+
+	return lns, nil
+}
+
+// Resolve bind address to IP addresses
+func bindIPs(bind string) ([]string, error) {
+	if bind == "" || net.ParseIP(stripZone(bind)) != nil {
+		return []string{bind}, nil
+	}
+
+	ifc, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	ifAddrs, err := ifc.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	for _, addr := range ifAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.String()
+		if ipNet.IP.IsLinkLocalUnicast() && ipNet.IP.To4() == nil {
+			ip += "%" + ifc.Name
+		}
+		ips = append(ips, ip)
+	}
+
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no addresses on interface", Addr: bind}
+	}
+
+	return ips, nil
+}
+
+func stripZone(addr string) string {
+	for i := range addr {
+		if addr[i] == '%' {
+			return addr[:i]
+		}
+	}
+	return addr
+}
+
+// Sockets passed by systemd, not yet claimed
+var activation struct {
+	sync.Once
+	sync.Mutex
+	lns []net.Listener
+}
+
+// First fd passed by systemd socket activation
+const listenFdsStart = 3
+
+// Claim the sockets passed by systemd socket activation (see
+// sd_listen_fds(3)) listening on port.  Port zero claims none.
+func activated(port uint) []net.Listener {
+	activation.Do(func() {
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		// Not for children
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		if pid != os.Getpid() {
+			return
+		}
+		for fd := listenFdsStart; fd < listenFdsStart+fds; fd++ {
+			f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err == nil {
+				activation.lns = append(activation.lns, ln)
+			}
+		}
+	})
+
+	if port == 0 {
+		return nil
+	}
+
+	activation.Lock()
+	defer activation.Unlock()
+
+	var lns, rest []net.Listener
+	for _, ln := range activation.lns {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok && uint(addr.Port) == port {
+			lns = append(lns, ln)
+		} else {
+			rest = append(rest, ln)
+		}
+	}
+	activation.lns = rest
+
+	return lns
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// Listener addresses, for logging
+func listenAddrs(lns []net.Listener) []string {
+	addrs := make([]string, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr().String()
+	}
+	return addrs
+}
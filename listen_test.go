@@ -0,0 +1,80 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	closeAll := func(lns []net.Listener) {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+
+	lns, err := listen([]string{"127.0.0.1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 1 || lns[0].Addr().(*net.TCPAddr).IP.String() != "127.0.0.1" {
+		t.Errorf("Bad listeners: %v", listenAddrs(lns))
+	}
+	closeAll(lns)
+
+	ifc, err := net.InterfaceByIndex(1)
+	if err == nil {
+		lns, err = listen([]string{ifc.Name}, 0)
+		if err != nil {
+			t.Errorf("Listen on interface %s: %s", ifc.Name, err)
+		}
+		closeAll(lns)
+	}
+
+	// Port picked
+	lns, err = listen(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lns[0].Addr().(*net.TCPAddr).Port == 0 {
+		t.Errorf("Port not picked: %v", listenAddrs(lns))
+	}
+	closeAll(lns)
+
+	if _, err := listen([]string{"nosuchif0"}, 0); err == nil {
+		t.Errorf("Listen on missing interface should fail")
+	}
+}
+
+func TestListenActivated(t *testing.T) {
+	// Nothing passed by systemd
+	if lns := activated(0); lns != nil {
+		t.Fatalf("Activated %v", listenAddrs(lns))
+	}
+
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer passed.Close()
+	port := uint(passed.Addr().(*net.TCPAddr).Port)
+
+	activation.Lock()
+	activation.lns = []net.Listener{passed}
+	activation.Unlock()
+
+	// The passed socket is used, once, whatever the bind address
+	lns, err := listen([]string{"::1"}, port)
+	if err != nil || len(lns) != 1 || lns[0] != passed {
+		t.Fatalf("Listen got %v, %v", listenAddrs(lns), err)
+	}
+	if _, err := listen(nil, port); err == nil {
+		t.Error("Port listened on twice")
+	}
+}
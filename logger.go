@@ -2,39 +2,46 @@
 // Use of this source code is governed by a BSD-style license that can be found
 // in the LICENSE file.
 
-//go:build !tinygo
-// +build !tinygo
-
 package merle
 
 import (
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 type logger struct {
 	log     *log.Logger
-	enabled bool
+	enabled uint32
 }
 
 func newLogger(prefix string, enabled bool) *logger {
-	return &logger{log: log.New(os.Stderr, prefix, 0), enabled: enabled}
+	l := &logger{log: log.New(os.Stderr, prefix, 0)}
+	l.setEnabled(enabled)
+	return l
+}
+
+// Logging can be enabled/disabled on config reload while Thing is running
+func (l *logger) setEnabled(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&l.enabled, v)
+}
+
+func (l *logger) isEnabled() bool {
+	return atomic.LoadUint32(&l.enabled) == 1
 }
 
 func (l *logger) printf(format string, v ...interface{}) {
-	if l.enabled {
+	if l.isEnabled() {
 		l.log.Printf(format, v...)
 	}
 }
 
 func (l *logger) println(v ...interface{}) {
-	if l.enabled {
+	if l.isEnabled() {
 		l.log.Println(v...)
 	}
 }
-
-func (l *logger) fatalln(v ...interface{}) {
-	if l.enabled {
-		l.log.Fatalln(v...)
-	}
-}
@@ -0,0 +1,398 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// LoRaWAN configuration.  For Things in the field, on batteries, that can't
+// hold a WebSocket open, Thing's broadcasts in Msgs are sent as LoRaWAN
+// uplinks, through an AT-command LoRaWAN modem (RAK RUI3, e.g. RAK3172) on a
+// serial port.  The modem must be set up with the device's keys (AT+DEVEUI,
+// AT+APPEUI, AT+APPKEY); Thing joins the network when LoRa starts.
+//
+// An uplink payload is the message, CBOR-encoded (RFC 8949), with numbers
+// sent as integers, if whole, or 32-bit floats.  A payload over MaxSize is
+// truncated by dropping the message's members, last first, by name, until
+// it fits; Msg is always kept.  Uplinks are at most one every Interval
+// seconds; if a message is broadcast again before it's sent, only the latest
+// is sent.
+//
+// Downlinks are CBOR-encoded messages too, and are received by Thing as if
+// from a client.
+//
+// On the other side of the gateway, the network server's HTTP integration
+// (The Things Stack, or ChirpStack) can POST uplinks to Thing's public
+// server, at /{id}/lora, where they're decoded and received by Thing, e.g.
+// by a Thing standing in for the field device.
+type LoRaConfig struct {
+
+	// Serial device of the LoRaWAN modem, e.g. "/dev/ttyUSB0".  LoRa is
+	// disabled if Device is empty.  The default is "".
+	Device string
+
+	// [Optional] Modem baud rate.  The default is 115200.
+	Baud uint
+
+	// Broadcast messages to send as uplinks.  The default is nil (none;
+	// only downlinks are received).
+	Msgs []string
+
+	// [Optional] LoRaWAN port for uplinks.  The default is 1.
+	FPort uint
+
+	// [Optional] Largest uplink payload, in bytes.  The default is 51, the
+	// most at the slowest data rates.
+	MaxSize uint
+
+	// [Optional] Seconds between uplinks, for the duty cycle.  The
+	// default is 60.
+	Interval uint
+
+	// [Optional] Send confirmed uplinks.  The default is false.
+	Confirmed bool
+}
+
+// How long the modem has to answer a command
+const loraTimeout = 5 * time.Second
+
+// Open the modem's serial port; tests substitute a fake modem
+var loraOpen = func(device string, baud int) (io.ReadWriteCloser, error) {
+	return serial.OpenPort(&serial.Config{Name: device, Baud: baud})
+}
+
+type lora struct {
+	thing *Thing
+	cfg   LoRaConfig
+	msgs  map[string]bool
+	port  io.ReadWriteCloser
+	sync.Mutex
+	// Msgs waiting to go, oldest first, and each's latest payload
+	pending []string
+	latest  map[string][]byte
+	// Modem's answers to commands
+	answers chan string
+	failing bool
+	ticker  *time.Ticker
+	done    chan bool
+}
+
+func newLoRa(thing *Thing, cfg LoRaConfig) (*lora, error) {
+	if cfg.FPort < 1 || cfg.FPort > 223 {
+		return nil, fmt.Errorf("LoRa FPort must be 1 to 223")
+	}
+	if cfg.MaxSize == 0 || cfg.Interval == 0 {
+		return nil, fmt.Errorf("LoRa MaxSize and Interval must be non-zero")
+	}
+
+	l := &lora{
+		thing:   thing,
+		cfg:     cfg,
+		msgs:    make(map[string]bool),
+		latest:  make(map[string][]byte),
+		answers: make(chan string, 1),
+	}
+	for _, msg := range cfg.Msgs {
+		l.msgs[msg] = true
+	}
+
+	return l, nil
+}
+
+// CBOR payload for msg, truncated to fit in max bytes; nil if even Msg
+// alone doesn't fit
+func loraPayload(msg map[string]interface{}, max int) []byte {
+	payload := cborEncode(msg)
+	if len(payload) <= max {
+		return payload
+	}
+
+	var keys []string
+	for k := range msg {
+		if k != "Msg" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for i := len(keys) - 1; i >= 0 && len(payload) > max; i-- {
+		delete(msg, keys[i])
+		payload = cborEncode(msg)
+	}
+	if len(payload) > max {
+		return nil
+	}
+	return payload
+}
+
+// Bus tap to queue broadcast messages in Msgs as uplinks
+func (l *lora) tap(p *Packet) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(p.msg, &msg); err != nil {
+		return
+	}
+	name, _ := msg["Msg"].(string)
+	if !l.msgs[name] {
+		return
+	}
+
+	payload := loraPayload(msg, int(l.cfg.MaxSize))
+	if payload == nil {
+		l.thing.log.printf("LoRa dropping %s; doesn't fit in %d bytes",
+			name, l.cfg.MaxSize)
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.latest[name]; !ok {
+		l.pending = append(l.pending, name)
+	}
+	l.latest[name] = payload
+}
+
+// Send a command to the modem, and wait for the modem's answer
+func (l *lora) command(cmd string) error {
+	// Drop a stale answer, from a command that timed out
+	select {
+	case <-l.answers:
+	default:
+	}
+
+	if _, err := io.WriteString(l.port, cmd+"\r\n"); err != nil {
+		return err
+	}
+
+	select {
+	case answer := <-l.answers:
+		if answer != "OK" {
+			return fmt.Errorf("%s: %s", cmd, answer)
+		}
+		return nil
+	case <-time.After(loraTimeout):
+		return fmt.Errorf("%s: modem didn't answer", cmd)
+	}
+}
+
+// Send the oldest pending message as an uplink.  Errors are raised once,
+// until an uplink goes.
+func (l *lora) uplink() {
+	l.Lock()
+	if len(l.pending) == 0 {
+		l.Unlock()
+		return
+	}
+	name := l.pending[0]
+	payload := l.latest[name]
+	l.pending = l.pending[1:]
+	delete(l.latest, name)
+	l.Unlock()
+
+	err := l.command(fmt.Sprintf("AT+SEND=%d:%X", l.cfg.FPort, payload))
+
+	switch {
+	case err != nil && !l.failing:
+		l.failing = true
+		l.thing.raise(newError(ErrLoRa, err))
+	case err == nil && l.failing:
+		l.failing = false
+	}
+
+	if err != nil {
+		// Try again next time, unless there's a newer one
+		l.Lock()
+		if _, ok := l.latest[name]; !ok {
+			l.latest[name] = payload
+			l.pending = append([]string{name}, l.pending...)
+		}
+		l.Unlock()
+	}
+}
+
+// Message from a CBOR payload; the payload must be a map with a Msg
+func loraMsg(payload []byte) ([]byte, error) {
+	v, err := cborDecode(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Payload isn't a message")
+	}
+	if name, _ := msg["Msg"].(string); name == "" {
+		return nil, fmt.Errorf("Payload missing Msg")
+	}
+	return json.Marshal(msg)
+}
+
+// Downlink event, "+EVT:RX_1:<rssi>:<snr>:UNICAST:<port>:<payload>"
+func (l *lora) downlink(fields []string) {
+	t := l.thing
+
+	if len(fields) < 7 {
+		return
+	}
+	payload, err := hex.DecodeString(fields[6])
+	if err != nil || len(payload) == 0 {
+		return
+	}
+
+	data, err := loraMsg(payload)
+	if err != nil {
+		t.log.printf("LoRa bad downlink: %s", err)
+		return
+	}
+
+	pkt := &Packet{bus: t.bus, src: newApiSocket(0), msg: data}
+	t.log.printf("LoRa downlink: %.80s", pkt.String())
+	t.bus.receive(pkt)
+}
+
+// Read the modem's answers and events
+func (l *lora) read() {
+	t := l.thing
+	scanner := bufio.NewScanner(l.port)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "OK", strings.HasSuffix(line, "_ERROR"):
+			// RUI3 errors look like AT_BUSY_ERROR
+			select {
+			case l.answers <- line:
+			default:
+			}
+		case line == "", strings.HasPrefix(line, "AT"):
+			// Command echo
+		case strings.HasPrefix(line, "+EVT:RX_"):
+			l.downlink(strings.Split(line, ":"))
+		case strings.HasPrefix(line, "+EVT:"):
+			t.log.printf("LoRa %s", line)
+		}
+	}
+}
+
+func (l *lora) start() error {
+	var err error
+
+	l.port, err = loraOpen(l.cfg.Device, int(l.cfg.Baud))
+	if err != nil {
+		return newError(ErrLoRa, err)
+	}
+	go l.read()
+
+	confirmed := 0
+	if l.cfg.Confirmed {
+		confirmed = 1
+	}
+	if err == nil {
+		err = l.command("AT+CFM=" + strconv.Itoa(confirmed))
+	}
+	if err == nil {
+		// Join, with retries, in the background; the modem sends
+		// +EVT:JOINED
+		err = l.command("AT+JOIN=1:0:10:8")
+	}
+	if err != nil {
+		l.port.Close()
+		return newError(ErrLoRa, err)
+	}
+
+	l.ticker = time.NewTicker(time.Duration(l.cfg.Interval) * time.Second)
+	l.done = make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-l.ticker.C:
+				l.uplink()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (l *lora) stop() {
+	l.ticker.Stop()
+	close(l.done)
+	l.port.Close()
+}
+
+// Uplink as POSTed by a network server's HTTP integration: The Things
+// Stack's uplink_message.frm_payload, or ChirpStack's data; base64
+type loraUplink struct {
+	UplinkMessage struct {
+		FrmPayload string `json:"frm_payload"`
+	} `json:"uplink_message"`
+	Data string `json:"data"`
+}
+
+// POST /{id}/lora
+func (t *Thing) loraHandler(w http.ResponseWriter, r *http.Request) {
+	thing := t.apiThing(w, r, "POST")
+	if thing == nil {
+		return
+	}
+
+	// Uplinks are messages, which viewers can't send
+	if u := authUser(r); u != nil && u.Role == RoleViewer {
+		http.Error(w, "Viewers can't send uplinks", http.StatusForbidden)
+		return
+	}
+
+	body := r.Body
+	if t.Cfg.MaxMsgSize > 0 {
+		body = http.MaxBytesReader(w, body, int64(t.Cfg.MaxMsgSize))
+	}
+
+	var up loraUplink
+	data, err := ioutil.ReadAll(body)
+	if err == nil {
+		err = json.Unmarshal(data, &up)
+	}
+	if err != nil {
+		http.Error(w, "Bad uplink: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	encoded := up.UplinkMessage.FrmPayload
+	if encoded == "" {
+		encoded = up.Data
+	}
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil {
+		data, err = loraMsg(payload)
+	}
+	if err != nil {
+		http.Error(w, "Bad uplink payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pkt := &Packet{bus: thing.bus, src: newApiSocket(0), msg: data}
+	thing.log.printf("LoRa uplink: %.80s", pkt.String())
+	thing.apiReceive(w, pkt, apiTimeout)
+}
@@ -0,0 +1,214 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Thing taking downlinks
+type valve struct {
+	opened chan string
+}
+
+func (v *valve) Subscribers() Subscribers {
+	return Subscribers{
+		"Open": func(p *Packet) { v.opened <- p.String() },
+	}
+}
+
+func (v *valve) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestCBOR(t *testing.T) {
+	in := `{"Msg":"Update","Temp":21.7,"Count":-3,"Big":70000,"On":true,` +
+		`"Off":false,"None":null,"List":[1,"two",[]],"Sub":{"A":{}}}`
+
+	var want interface{}
+	json.Unmarshal([]byte(in), &want)
+
+	data := cborEncode(want)
+	got, err := cborDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	// RFC 8949 examples
+	if x := fmt.Sprintf("%x", cborEncode(float64(1000000))); x != "1a000f4240" {
+		t.Errorf("1000000 is %s", x)
+	}
+	if v, _ := cborDecode([]byte{0xf9, 0x3c, 0x00}); v != 1.0 {
+		t.Errorf("Half 1.0 is %v", v)
+	}
+
+	for _, bad := range []string{"", "a2", "7f", "62ff", "a10101", "1b0000"} {
+		data, _ := hex.DecodeString(bad)
+		if _, err := cborDecode(data); err == nil {
+			t.Errorf("Decoded bad %q", bad)
+		}
+	}
+}
+
+func TestLoRaPayload(t *testing.T) {
+	msg := map[string]interface{}{"Msg": "Update", "A": 1.0,
+		"B": strings.Repeat("x", 20), "C": strings.Repeat("y", 20)}
+
+	// C then B are dropped
+	payload := loraPayload(msg, 30)
+	got, _ := cborDecode(payload)
+	want := map[string]interface{}{"Msg": "Update", "A": 1.0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	if loraPayload(map[string]interface{}{"Msg": "Update"}, 5) != nil {
+		t.Errorf("Msg alone doesn't fit, but payload isn't nil")
+	}
+}
+
+func TestLoRa(t *testing.T) {
+	v := &valve{opened: make(chan string, 1)}
+	thing := NewThing(v)
+	thing.Cfg.Id = testId
+	thing.Cfg.LoRa.Device = "/dev/fake"
+	thing.Cfg.LoRa.Msgs = []string{"Update"}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake modem: answers OK to commands, and sends on lines
+	toThingR, toThingW := io.Pipe()
+	toModemR, toModemW := io.Pipe()
+	saved := loraOpen
+	defer func() { loraOpen = saved }()
+	loraOpen = func(device string, baud int) (io.ReadWriteCloser, error) {
+		return &pipePort{Reader: toThingR, Writer: toModemW, r: toThingR}, nil
+	}
+
+	cmds := make(chan string, 10)
+	busy := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(toModemR)
+		for scanner.Scan() {
+			cmd := strings.TrimSpace(scanner.Text())
+			cmds <- cmd
+			reply := "OK"
+			select {
+			case <-busy:
+				reply = "AT_BUSY_ERROR"
+			default:
+			}
+			io.WriteString(toThingW, cmd+"\r\n"+reply+"\r\n")
+		}
+	}()
+
+	expect := func(want string) {
+		select {
+		case cmd := <-cmds:
+			if cmd != want {
+				t.Errorf("Got %s, want %s", cmd, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No command, want %s", want)
+		}
+	}
+
+	l := thing.lora
+	if err := l.start(); err != nil {
+		t.Fatal(err)
+	}
+	expect("AT+CFM=0")
+	expect("AT+JOIN=1:0:10:8")
+
+	// Only the latest Update goes
+	thing.bus.broadcast(newPacket(thing.bus, nil,
+		map[string]interface{}{"Msg": "Update", "N": 1}))
+	thing.bus.broadcast(newPacket(thing.bus, nil,
+		map[string]interface{}{"Msg": "Update", "N": 2}))
+	thing.bus.broadcast(newPacket(thing.bus, nil, &Msg{Msg: "Other"}))
+	l.uplink()
+	expect(fmt.Sprintf("AT+SEND=1:%X",
+		cborEncode(map[string]interface{}{"Msg": "Update", "N": 2.0})))
+	if len(l.pending) != 0 {
+		t.Errorf("Pending %v, want none", l.pending)
+	}
+
+	// Failed uplinks are raised, and sent again
+	busy <- true
+	thing.bus.broadcast(newPacket(thing.bus, nil,
+		map[string]interface{}{"Msg": "Update", "N": 0}))
+	l.uplink()
+	expect(fmt.Sprintf("AT+SEND=1:%X",
+		cborEncode(map[string]interface{}{"Msg": "Update", "N": 0.0})))
+	if !l.failing || len(l.pending) != 1 {
+		t.Errorf("Failed uplink not kept")
+	}
+
+	// Downlinks are messages to Thing
+	down := cborEncode(map[string]interface{}{"Msg": "Open", "Secs": 30.0})
+	io.WriteString(toThingW, fmt.Sprintf("+EVT:RX_1:-70:8:UNICAST:1:%X\r\n", down))
+	select {
+	case got := <-v.opened:
+		if got != `{"Msg":"Open","Secs":30}` {
+			t.Errorf("Got downlink %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("No downlink")
+	}
+
+	l.stop()
+}
+
+func TestLoRaHandler(t *testing.T) {
+	thing := NewThing(&echo{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := base64.StdEncoding.EncodeToString(
+		cborEncode(map[string]interface{}{"Msg": "Echo", "Temp": 21.7}))
+
+	tests := []struct {
+		body  string
+		code  int
+		reply string
+	}{
+		{`{"uplink_message":{"frm_payload":"` + payload + `"}}`,
+			http.StatusOK, `{"Msg":"Echo","Temp":21.7}`},
+		{`{"data":"` + payload + `"}`,
+			http.StatusOK, `{"Msg":"Echo","Temp":21.7}`},
+		{`{"data":"AQ=="}`, http.StatusBadRequest, ""},
+		{`not json`, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/"+testId+"/lora",
+			strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		thing.web.public.mux.ServeHTTP(w, req)
+		if w.Code != test.code || (test.reply != "" && w.Body.String() != test.reply) {
+			t.Errorf("%s: %d %q, want %d %q", test.body, w.Code,
+				w.Body.String(), test.code, test.reply)
+		}
+	}
+}
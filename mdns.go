@@ -0,0 +1,356 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Things advertise themselves on the LAN with mDNS (multicast DNS, RFC 6762)
+// as service _merle._tcp.  The service's TXT record has Thing's id, model,
+// name, and public ports, and the private port only if Cfg.AdvertisePrivate.
+// Find Things on the LAN with Discover().
+
+const mdnsService = "_merle._tcp.local."
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Seconds advertised records are good for
+const mdnsTTL = 120
+
+// DiscoveredThing is a Thing found on the LAN by Discover()
+type DiscoveredThing struct {
+	Id    string
+	Model string
+	Name  string
+	// IP address of Thing's host
+	Host          string
+	PortPublic    uint
+	PortPublicTLS uint
+	PortPrivate   uint
+}
+
+type mdns struct {
+	thing *Thing
+	conn  *net.UDPConn
+	sync.WaitGroup
+}
+
+func newMdns(thing *Thing) *mdns {
+	return &mdns{thing: thing}
+}
+
+func (m *mdns) instance() string {
+	return m.thing.id + "." + mdnsService
+}
+
+func mdnsHost() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "merle"
+	}
+	host = strings.SplitN(host, ".", 2)[0]
+	return host + ".local."
+}
+
+// Non-loopback IPv4 addresses of this host
+func mdnsAddrs() []net.IP {
+	var ips []net.IP
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if ip := ipnet.IP.To4(); ip != nil && !ip.IsLoopback() {
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	return ips
+}
+
+func mdnsName(s string) dnsmessage.Name {
+	name, _ := dnsmessage.NewName(s)
+	return name
+}
+
+// Thing's service records
+func (m *mdns) records(ttl uint32) []dnsmessage.Resource {
+	t := m.thing
+	instance := mdnsName(m.instance())
+	host := mdnsName(mdnsHost())
+
+	var private uint
+	if t.Cfg.AdvertisePrivate {
+		private = t.web.private.port
+	}
+
+	port := t.web.public.port
+	if port == 0 {
+		port = t.web.public.portTLS
+	}
+	if port == 0 {
+		port = private
+	}
+
+	hdr := func(name dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ,
+			Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+
+	rrs := []dnsmessage.Resource{
+		{
+			Header: hdr(mdnsName(mdnsService), dnsmessage.TypePTR),
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		},
+		{
+			Header: hdr(instance, dnsmessage.TypeSRV),
+			Body: &dnsmessage.SRVResource{Target: host,
+				Port: uint16(port)},
+		},
+		{
+			Header: hdr(instance, dnsmessage.TypeTXT),
+			Body: &dnsmessage.TXTResource{TXT: []string{
+				"id=" + t.id,
+				"model=" + t.model,
+				"name=" + t.name,
+				"public=" + strconv.FormatUint(uint64(t.web.public.port), 10),
+				"tls=" + strconv.FormatUint(uint64(t.web.public.portTLS), 10),
+				"private=" + strconv.FormatUint(uint64(private), 10),
+			}},
+		},
+	}
+
+	for _, ip := range mdnsAddrs() {
+		var a [4]byte
+		copy(a[:], ip)
+		rrs = append(rrs, dnsmessage.Resource{
+			Header: hdr(host, dnsmessage.TypeA),
+			Body:   &dnsmessage.AResource{A: a},
+		})
+	}
+
+	return rrs
+}
+
+// Build a response with Thing's records
+func (m *mdns) response(id uint16, questions []dnsmessage.Question,
+	ttl uint32) ([]byte, error) {
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, Response: true,
+			Authoritative: true},
+		Questions: questions,
+		Answers:   m.records(ttl),
+	}
+
+	return msg.Pack()
+}
+
+// Query asks for Thing's service or instance
+func (m *mdns) asked(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch q.Type {
+	case dnsmessage.TypePTR, dnsmessage.TypeALL:
+		if name == mdnsService {
+			return true
+		}
+	}
+	return name == strings.ToLower(m.instance())
+}
+
+func (m *mdns) answer(buf []byte, src *net.UDPAddr) {
+	var p dnsmessage.Parser
+
+	hdr, err := p.Start(buf)
+	if err != nil || hdr.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	for _, q := range questions {
+		if !m.asked(q) {
+			continue
+		}
+		if src.Port != mdnsGroup.Port {
+			// Legacy unicast query (RFC 6762 section 6.7), such
+			// as from Discover(): answer to sender
+			if resp, err := m.response(hdr.ID, questions, mdnsTTL); err == nil {
+				m.conn.WriteToUDP(resp, src)
+			}
+		} else {
+			m.announce(mdnsTTL)
+		}
+		return
+	}
+}
+
+func (m *mdns) announce(ttl uint32) {
+	resp, err := m.response(0, nil, ttl)
+	if err != nil {
+		m.thing.log.println("mDNS response failed:", err)
+		return
+	}
+	m.conn.WriteToUDP(resp, mdnsGroup)
+}
+
+func (m *mdns) start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+
+	m.thing.log.printf("Advertising %s on mDNS", m.instance())
+	m.announce(mdnsTTL)
+
+	m.Add(1)
+	go func() {
+		defer m.Done()
+		buf := make([]byte, 9000)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m.answer(buf[:n], src)
+		}
+	}()
+
+	return nil
+}
+
+func (m *mdns) stop() {
+	// Goodbye: zero TTL withdraws the records
+	m.announce(0)
+	m.conn.Close()
+	m.Wait()
+}
+
+// Parse a response into found Things, keyed by Id.  Host is taken from the
+// response's source address.
+func parseDiscovery(buf []byte, src net.IP, found map[string]*DiscoveredThing) {
+	var p dnsmessage.Parser
+
+	hdr, err := p.Start(buf)
+	if err != nil || !hdr.Response {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		if rh.Type != dnsmessage.TypeTXT ||
+			!strings.HasSuffix(strings.ToLower(rh.Name.String()), "."+mdnsService) {
+			p.SkipAnswer()
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return
+		}
+
+		var d DiscoveredThing
+		for _, kv := range txt.TXT {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			port, _ := strconv.ParseUint(parts[1], 10, 16)
+			switch parts[0] {
+			case "id":
+				d.Id = parts[1]
+			case "model":
+				d.Model = parts[1]
+			case "name":
+				d.Name = parts[1]
+			case "public":
+				d.PortPublic = uint(port)
+			case "tls":
+				d.PortPublicTLS = uint(port)
+			case "private":
+				d.PortPrivate = uint(port)
+			}
+		}
+		if d.Id == "" {
+			continue
+		}
+		if rh.TTL == 0 {
+			// Goodbye
+			delete(found, d.Id)
+			continue
+		}
+		d.Host = src.String()
+		found[d.Id] = &d
+	}
+}
+
+// Discover finds Things advertising on the LAN, waiting timeout for answers.
+// Things are returned sorted by Id.
+func Discover(timeout time.Duration) ([]DiscoveredThing, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  mdnsName(mdnsService),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(buf, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("Sending mDNS query: %s", err)
+	}
+
+	found := make(map[string]*DiscoveredThing)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	buf = make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// Deadline
+			break
+		}
+		parseDiscovery(buf[:n], src.IP, found)
+	}
+
+	things := []DiscoveredThing{}
+	for _, d := range found {
+		things = append(things, *d)
+	}
+	sort.Slice(things, func(i, j int) bool {
+		return things[i].Id < things[j].Id
+	})
+
+	return things, nil
+}
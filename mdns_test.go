@@ -0,0 +1,76 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMdnsAnswer(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Model = "relays"
+	thing.Cfg.Name = "garage"
+	thing.Cfg.PortPublic = 8081
+	thing.Cfg.PortPrivate = 6001
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	m := thing.mdns
+	if m == nil {
+		t.Fatal("Thing not advertising")
+	}
+
+	q := dnsmessage.Question{Name: mdnsName(mdnsService),
+		Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	if !m.asked(q) {
+		t.Errorf("Not answering service query")
+	}
+	q.Name = mdnsName("_http._tcp.local.")
+	if m.asked(q) {
+		t.Errorf("Answering other service query")
+	}
+
+	resp, err := m.response(1, nil, mdnsTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]*DiscoveredThing)
+	parseDiscovery(resp, net.IPv4(10, 0, 0, 7), found)
+
+	d, ok := found[testId]
+	if !ok {
+		t.Fatalf("Thing not discovered: %v", found)
+	}
+	want := DiscoveredThing{Id: testId, Model: "relays", Name: "garage",
+		Host: "10.0.0.7", PortPublic: 8081}
+	if *d != want {
+		t.Errorf("Got %+v, want %+v", *d, want)
+	}
+
+	// Private port only if asked
+	thing.Cfg.AdvertisePrivate = true
+	resp, _ = m.response(1, nil, mdnsTTL)
+	parseDiscovery(resp, net.IPv4(10, 0, 0, 7), found)
+	want.PortPrivate = 6001
+	if *found[testId] != want {
+		t.Errorf("Got %+v, want %+v", *found[testId], want)
+	}
+
+	// Goodbye removes the Thing
+	bye, _ := m.response(0, nil, 0)
+	parseDiscovery(bye, net.IPv4(10, 0, 0, 7), found)
+	if len(found) != 0 {
+		t.Errorf("Thing still discovered after goodbye")
+	}
+}
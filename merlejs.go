@@ -0,0 +1,364 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+)
+
+// merle.js is a helper for Thing UIs in the browser, served by Thing's
+// public HTTP server at /merle.js.  It connects to Thing's WebSocket, asks
+// for Thing's state on each connect, reconnects with backoff when the
+// connection drops, and dispatches messages by Msg to handlers:
+//
+//	<script src="{{.BasePath}}/merle.js"></script>
+//	<script>
+//		var thing = merle.connect("{{.WebSocket}}", {
+//			"_ReplyState": function(msg) { ... },
+//			"Click": function(msg) { ... },
+//		}, {
+//			online: function(online) { ... },
+//		})
+//		thing.send({Msg: "Click", Relay: 1, State: true})
+//	</script>
+//
+// A "default" handler, like Subscribers' "default", gets messages with no
+// handler.  Options are:
+//
+//	getState:   send _GetState on each connect (default true)
+//	backoffMin: first reconnect delay, in milliseconds (default 500)
+//	backoffMax: longest reconnect delay, in milliseconds (default 30000)
+//	online:     called with true on connect, false on disconnect
+//	log:        log each message to the console (default false)
+//	e2e:        seal and open messages end-to-end (see E2EConfig), as
+//	            {key: Key, id: Thing's Id, msgs: Msgs}; e.g. with the key
+//	            in the page's URL fragment, which isn't sent to the server:
+//	            {key: location.hash.slice(1), id: "{{.Id}}", msgs: ["Click"]}
+//
+// With e2e, sealing and opening are asynchronous (WebCrypto, which needs
+// https or localhost), but messages are still sent and dispatched in order.
+// Messages in msgs that arrive unsealed are dropped.
+//
+// merle.sparkline(el, url, opts) draws chart data from /{id}/api/history (see
+// chart.go) in svg element el, and returns a sparkline; add(value) appends a
+// live value.  merle.sparklines(root, opts) draws a sparkline in each element
+// with a data-history URL, as from the sparkline template func, under root
+// (default the document), and returns the sparklines in document order.
+// Options are:
+//
+//	points:     the most points drawn (default 100)
+const merleJS = `// merle.js, served by Merle.  See merlejs.go.
+var merle = (function() {
+	"use strict"
+
+	function toBase64(bytes) {
+		var s = ""
+		for (var i = 0; i < bytes.length; i++) {
+			s += String.fromCharCode(bytes[i])
+		}
+		return btoa(s)
+	}
+
+	function fromBase64(s) {
+		var raw = atob(s)
+		var bytes = new Uint8Array(raw.length)
+		for (var i = 0; i < raw.length; i++) {
+			bytes[i] = raw.charCodeAt(i)
+		}
+		return bytes
+	}
+
+	// AES-GCM sealing of messages to and from Thing; see MsgSealed
+	function sealer(cfg) {
+		var enc = new TextEncoder()
+		var dec = new TextDecoder()
+		var msgs = {}
+		;(cfg.msgs || []).forEach(function(m) {
+			msgs[m] = true
+		})
+		var key = crypto.subtle.importKey("raw", fromBase64(cfg.key),
+			"AES-GCM", false, ["encrypt", "decrypt"])
+
+		// Users seal with "user"; only what Thing sealed, with
+		// "thing", opens
+		function additional(from, msg, time) {
+			return enc.encode(cfg.id + "\x00" + from + "\x00" + msg +
+				"\x00" + time)
+		}
+
+		return {
+			sealed: function(msg) {
+				return msgs[msg.Msg] === true
+			},
+			seal: function(msg) {
+				var iv = crypto.getRandomValues(new Uint8Array(12))
+				var time = Date.now()
+				return key.then(function(k) {
+					return crypto.subtle.encrypt({name: "AES-GCM", iv: iv,
+						additionalData: additional("user", msg.Msg, time)},
+						k, enc.encode(JSON.stringify(msg)))
+				}).then(function(ct) {
+					var buf = new Uint8Array(iv.length + ct.byteLength)
+					buf.set(iv)
+					buf.set(new Uint8Array(ct), iv.length)
+					return {Msg: msg.Msg, Time: time, Sealed: toBase64(buf)}
+				})
+			},
+			open: function(msg) {
+				var buf = fromBase64(msg.Sealed)
+				return key.then(function(k) {
+					return crypto.subtle.decrypt({name: "AES-GCM",
+						iv: buf.subarray(0, 12),
+						additionalData: additional("thing", msg.Msg,
+							msg.Time)},
+						k, buf.subarray(12))
+				}).then(function(plain) {
+					var inner = JSON.parse(dec.decode(plain))
+					if (inner.Msg !== msg.Msg) {
+						throw new Error("Msg mismatch")
+					}
+					return inner
+				})
+			},
+		}
+	}
+
+	function connect(url, handlers, opts) {
+		opts = opts || {}
+		handlers = handlers || {}
+
+		var backoffMin = opts.backoffMin || 500
+		var backoffMax = opts.backoffMax || 30000
+		var getState = opts.getState !== false
+		var e2e = opts.e2e ? sealer(opts.e2e) : null
+		// Chains keeping sealed messages in order
+		var sending = Promise.resolve()
+		var receiving = Promise.resolve()
+
+		var thing = {
+			conn: null,
+			connected: false,
+			closed: false,
+		}
+		var backoff = backoffMin
+		var timer = null
+
+		function online(on) {
+			if (thing.connected === on) {
+				return
+			}
+			thing.connected = on
+			if (opts.online) {
+				opts.online(on)
+			}
+		}
+
+		function dispatch(msg) {
+			var handler = handlers[msg.Msg] || handlers["default"]
+			if (handler) {
+				handler(msg)
+			}
+		}
+
+		function reconnect() {
+			if (thing.closed || timer) {
+				return
+			}
+			// Back off, doubling to backoffMax, with jitter so clients
+			// don't all reconnect at once
+			var delay = backoff / 2 + Math.random() * backoff / 2
+			backoff = Math.min(backoff * 2, backoffMax)
+			timer = setTimeout(function() {
+				timer = null
+				open()
+			}, delay)
+		}
+
+		function open() {
+			var conn
+			try {
+				conn = new WebSocket(url)
+			} catch (err) {
+				reconnect()
+				return
+			}
+			thing.conn = conn
+
+			conn.onopen = function() {
+				backoff = backoffMin
+				online(true)
+				if (getState) {
+					thing.send({Msg: "_GetState"})
+				}
+			}
+
+			conn.onclose = function() {
+				online(false)
+				reconnect()
+			}
+
+			conn.onerror = function() {
+				conn.close()
+			}
+
+			conn.onmessage = function(evt) {
+				var msg
+				try {
+					msg = JSON.parse(evt.data)
+				} catch (err) {
+					return
+				}
+				if (!e2e) {
+					deliver(msg)
+					return
+				}
+				receiving = receiving.then(function() {
+					if (msg.Sealed) {
+						return e2e.open(msg)
+					}
+					if (e2e.sealed(msg)) {
+						throw new Error("not sealed")
+					}
+					return msg
+				}).then(deliver).catch(function(err) {
+					console.log("merle dropping", msg.Msg, err)
+				})
+			}
+		}
+
+		function deliver(msg) {
+			if (opts.log) {
+				console.log("merle", msg)
+			}
+			dispatch(msg)
+			// Thing back online, via mother; catch up
+			if (getState && msg.Msg === "_EventStatus" && msg.Online) {
+				thing.send({Msg: "_GetState"})
+			}
+		}
+
+		// Send msg to Thing; false if not connected
+		thing.send = function(msg) {
+			if (!thing.conn || thing.conn.readyState !== WebSocket.OPEN) {
+				return false
+			}
+			if (!e2e) {
+				thing.conn.send(JSON.stringify(msg))
+				return true
+			}
+			var conn = thing.conn
+			sending = sending.then(function() {
+				return e2e.sealed(msg) ? e2e.seal(msg) : msg
+			}).then(function(out) {
+				conn.send(JSON.stringify(out))
+			}).catch(function(err) {
+				console.log("merle not sending", msg.Msg, err)
+			})
+			return true
+		}
+
+		// Close the connection, for good
+		thing.close = function() {
+			thing.closed = true
+			if (timer) {
+				clearTimeout(timer)
+				timer = null
+			}
+			if (thing.conn) {
+				thing.conn.close()
+			}
+		}
+
+		open()
+
+		return thing
+	}
+
+	// Draw values as a polyline, scaled to svg el's viewBox
+	function draw(el, values) {
+		var box = el.viewBox && el.viewBox.baseVal
+		var w = (box && box.width) || 100
+		var h = (box && box.height) || 20
+		var min = Math.min.apply(null, values)
+		var span = Math.max.apply(null, values) - min || 1
+
+		var points = values.map(function(v, i) {
+			var x = values.length > 1 ? i * w / (values.length - 1) : w
+			var y = h - (v - min) * h / span
+			return x.toFixed(2) + "," + y.toFixed(2)
+		})
+
+		var line = el.querySelector("polyline")
+		if (!line) {
+			line = document.createElementNS("http://www.w3.org/2000/svg", "polyline")
+			line.setAttribute("fill", "none")
+			line.setAttribute("stroke", "currentColor")
+			line.setAttribute("vector-effect", "non-scaling-stroke")
+			el.appendChild(line)
+		}
+		line.setAttribute("points", points.join(" "))
+	}
+
+	function sparkline(el, url, opts) {
+		opts = opts || {}
+
+		var max = opts.points || 100
+		var values = []
+
+		function trim() {
+			if (values.length > max) {
+				values = values.slice(values.length - max)
+			}
+		}
+
+		var line = {
+			// Append a live value, e.g. from an Update message
+			add: function(value) {
+				values.push(value)
+				trim()
+				draw(el, values)
+			},
+		}
+
+		var sep = url.indexOf("?") < 0 ? "?" : "&"
+		fetch(url + sep + "points=" + max, {credentials: "same-origin"})
+			.then(function(resp) {
+				return resp.json()
+			})
+			.then(function(series) {
+				// Live values added while fetching come after
+				values = series.Points.map(function(pt) {
+					return pt.Value
+				}).concat(values)
+				trim()
+				if (values.length) {
+					draw(el, values)
+				}
+			})
+			.catch(function(err) {
+				console.log("merle sparkline", url, err)
+			})
+
+		return line
+	}
+
+	function sparklines(root, opts) {
+		var els = (root || document).querySelectorAll("[data-history]")
+		return Array.prototype.map.call(els, function(el) {
+			return sparkline(el, el.getAttribute("data-history"), opts)
+		})
+	}
+
+	return {connect: connect, sparkline: sparkline, sparklines: sparklines}
+})()
+`
+
+func merleJSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write([]byte(merleJS))
+}
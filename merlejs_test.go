@@ -0,0 +1,35 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMerleJS(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Served ahead of /{id}
+	req := httptest.NewRequest("GET", "/merle.js", nil)
+	w := httptest.NewRecorder()
+	thing.web.public.mux.ServeHTTP(w, req)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/javascript" {
+		t.Errorf("Content-Type %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), "return {connect: connect, sparkline: sparkline") {
+		t.Errorf("Not merle.js: %.80s", w.Body.String())
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+// Package merletest provides a harness for unit-testing Thingers.  The
+// harness runs a Thing with no servers or hardware, injects messages onto
+// Thing's bus, as if from a client, and checks the replies and broadcasts
+// that come back:
+//
+//	func TestClick(t *testing.T) {
+//		h := merletest.New(t, merle.NewThing(&relays{}))
+//
+//		click := &MsgClick{Msg: "Click", Relay: 1, State: true}
+//		h.Send(click)
+//		h.ExpectBroadcast(merletest.Fields(click))
+//
+//		h.Send(&merle.Msg{Msg: merle.GetState})
+//		h.ExpectReply(merletest.Msg(merle.ReplyState))
+//	}
+//
+// Thing's clock (see Thing.Now) is the harness's Clock, which only moves
+// when the test moves it.
+package merletest
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/merliot/merle"
+)
+
+// How long Expect waits for a message, by default
+const DefaultTimeout = time.Second
+
+// Harness runs a Thing under test.  See New.
+type Harness struct {
+	// Thing under test
+	Thing *merle.Thing
+	// Thing's clock
+	Clock *Clock
+	// How long ExpectReply and ExpectBroadcast wait for a message
+	Timeout time.Duration
+
+	tb       testing.TB
+	client   *merle.TestPort
+	private  *merle.TestPort
+	observer *merle.TestPort
+	running  chan error
+
+	mu         sync.Mutex
+	replies    [][]byte
+	broadcasts [][]byte
+	arrived    chan bool
+}
+
+// New starts thing under test.  Configure thing's Cfg before calling New;
+// if Cfg.Id isn't set, the Id is "merletest".  Thing receives CmdInit, but
+// not CmdRun; call Run to run CmdRun.  The harness is stopped when the test
+// ends.
+func New(tb testing.TB, thing *merle.Thing) *Harness {
+	tb.Helper()
+
+	h := &Harness{
+		Thing:   thing,
+		Clock:   NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)),
+		Timeout: DefaultTimeout,
+		tb:      tb,
+		arrived: make(chan bool, 1),
+	}
+
+	if thing.Cfg.Id == "" {
+		thing.Cfg.Id = "merletest"
+	}
+	thing.SetClock(h.Clock.Now)
+
+	if err := thing.StartTest(); err != nil {
+		tb.Fatalf("Starting Thing: %s", err)
+	}
+
+	h.client = thing.TestPort("client", false, h.receive)
+	h.private = thing.TestPort("private", true, h.receive)
+	h.observer = thing.TestPort("observer", false, h.observe)
+
+	tb.Cleanup(h.stop)
+
+	return h
+}
+
+func (h *Harness) stop() {
+	h.Thing.StopTest()
+	if h.running != nil {
+		select {
+		case <-h.running:
+		case <-time.After(h.Timeout):
+			h.tb.Errorf("CmdRun didn't stop")
+		}
+	}
+}
+
+// Run runs Thing's CmdRun, in the background, until the test ends.
+func (h *Harness) Run() {
+	h.running = make(chan error, 1)
+	go func() {
+		h.running <- h.Thing.TestRun()
+	}()
+}
+
+func (h *Harness) record(list *[][]byte, msg []byte) {
+	h.mu.Lock()
+	*list = append(*list, msg)
+	h.mu.Unlock()
+
+	select {
+	case h.arrived <- true:
+	default:
+	}
+}
+
+// Client ports keep replies; broadcasts are kept by the observer, which
+// sees them all
+func (h *Harness) receive(msg []byte, reply bool) {
+	if reply {
+		h.record(&h.replies, msg)
+	}
+}
+
+func (h *Harness) observe(msg []byte, reply bool) {
+	h.record(&h.broadcasts, msg)
+}
+
+func (h *Harness) marshal(msg interface{}) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		h.tb.Fatalf("Marshaling %+v: %s", msg, err)
+	}
+	return data
+}
+
+// Send msg to Thing, as from a client on Thing's public server.  Send
+// returns after Thing's subscriber for the message returns.
+func (h *Harness) Send(msg interface{}) {
+	h.tb.Helper()
+	h.client.Receive(h.marshal(msg))
+}
+
+// SendPrivate sends msg to Thing, as from a client on Thing's private
+// server.
+func (h *Harness) SendPrivate(msg interface{}) {
+	h.tb.Helper()
+	h.private.Receive(h.marshal(msg))
+}
+
+// Replies returns the replies not yet matched by ExpectReply
+func (h *Harness) Replies() [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([][]byte(nil), h.replies...)
+}
+
+// Broadcasts returns the broadcasts not yet matched by ExpectBroadcast
+func (h *Harness) Broadcasts() [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([][]byte(nil), h.broadcasts...)
+}
+
+// Reset forgets the replies and broadcasts so far
+func (h *Harness) Reset() {
+	h.mu.Lock()
+	h.replies, h.broadcasts = nil, nil
+	h.mu.Unlock()
+}
+
+// Take the first message in list matching m
+func (h *Harness) take(list *[][]byte, m Matcher) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, msg := range *list {
+		if m(msg) {
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			return msg
+		}
+	}
+	return nil
+}
+
+func (h *Harness) expect(what string, list *[][]byte, m Matcher) []byte {
+	h.tb.Helper()
+
+	timeout := time.After(h.Timeout)
+	for {
+		if msg := h.take(list, m); msg != nil {
+			return msg
+		}
+		select {
+		case <-h.arrived:
+		case <-timeout:
+			h.mu.Lock()
+			got := make([]string, len(*list))
+			for i, msg := range *list {
+				got[i] = string(msg)
+			}
+			h.mu.Unlock()
+			h.tb.Fatalf("No matching %s in %s; got %q", what, h.Timeout, got)
+			return nil
+		}
+	}
+}
+
+// ExpectReply waits for a reply matching m, and returns it.  The test fails
+// if no reply matches within Timeout.  A reply is only matched once.
+func (h *Harness) ExpectReply(m Matcher) []byte {
+	h.tb.Helper()
+	return h.expect("reply", &h.replies, m)
+}
+
+// ExpectBroadcast waits for a broadcast matching m, and returns it.  The
+// test fails if no broadcast matches within Timeout.  A broadcast is only
+// matched once.
+func (h *Harness) ExpectBroadcast(m Matcher) []byte {
+	h.tb.Helper()
+	return h.expect("broadcast", &h.broadcasts, m)
+}
+
+// ExpectNoBroadcast fails the test if a broadcast so far matches m
+func (h *Harness) ExpectNoBroadcast(m Matcher) {
+	h.tb.Helper()
+	if msg := h.take(&h.broadcasts, m); msg != nil {
+		h.tb.Errorf("Unexpected broadcast %s", msg)
+	}
+}
+
+// Decode msg into v, failing the test if msg doesn't decode
+func (h *Harness) Decode(msg []byte, v interface{}) {
+	h.tb.Helper()
+	if err := json.Unmarshal(msg, v); err != nil {
+		h.tb.Fatalf("Decoding %s: %s", msg, err)
+	}
+}
+
+// Matcher matches a message, JSON-encoded
+type Matcher func(msg []byte) bool
+
+// Msg matches messages named name
+func Msg(name string) Matcher {
+	return func(msg []byte) bool {
+		var m merle.Msg
+		return json.Unmarshal(msg, &m) == nil && m.Msg == name
+	}
+}
+
+// Fields matches messages with the members of v, JSON-encoded.  Members of
+// the message not in v aren't compared.  A struct encodes all its members,
+// except those omitted with omitempty, so use a map to match on just some
+// members:
+//
+//	merletest.Fields(map[string]interface{}{"Msg": "Click", "Relay": 1})
+func Fields(v interface{}) Matcher {
+	want, err := json.Marshal(v)
+	if err != nil {
+		return func([]byte) bool { return false }
+	}
+	var w interface{}
+	json.Unmarshal(want, &w)
+
+	return func(msg []byte) bool {
+		var m interface{}
+		if json.Unmarshal(msg, &m) != nil {
+			return false
+		}
+		return subset(w, m)
+	}
+}
+
+// Is want contained in got?  Objects match if got has each of want's
+// members; anything else must be equal.
+func subset(want, got interface{}) bool {
+	wm, ok := want.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(want, got)
+	}
+	gm, ok := got.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for k, wv := range wm {
+		gv, ok := gm[k]
+		if !ok || !subset(wv, gv) {
+			return false
+		}
+	}
+	return true
+}
+
+// All matches messages matched by each of ms
+func All(ms ...Matcher) Matcher {
+	return func(msg []byte) bool {
+		for _, m := range ms {
+			if !m(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Clock is a fake clock, for Thing.Now.  The clock only moves when set or
+// advanced.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock set to now
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set the clock to now
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// Advance the clock by d
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
@@ -0,0 +1,152 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merletest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/merliot/merle"
+)
+
+type switches struct {
+	sync.Mutex
+	done    chan bool
+	Msg     string
+	States  [2]bool
+	Changed time.Time
+}
+
+type msgFlip struct {
+	Msg    string
+	Switch int
+	State  bool
+}
+
+type msgTick struct {
+	Msg  string
+	Time time.Time
+}
+
+func (s *switches) run(p *merle.Packet) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			msg := msgTick{Msg: "Tick", Time: p.Now()}
+			p.Marshal(&msg).Broadcast()
+		}
+	}
+}
+
+func (s *switches) init(p *merle.Packet) {
+	s.done = make(chan bool)
+}
+
+func (s *switches) stop(p *merle.Packet) {
+	close(s.done)
+}
+
+func (s *switches) getState(p *merle.Packet) {
+	s.Lock()
+	s.Msg = merle.ReplyState
+	p.Marshal(s)
+	s.Unlock()
+	p.Reply()
+}
+
+func (s *switches) flip(p *merle.Packet) {
+	var msg msgFlip
+	p.Unmarshal(&msg)
+
+	s.Lock()
+	s.States[msg.Switch] = msg.State
+	s.Changed = p.Now()
+	s.Unlock()
+
+	p.Broadcast()
+}
+
+func (s *switches) Subscribers() merle.Subscribers {
+	return merle.Subscribers{
+		merle.CmdInit:  s.init,
+		merle.CmdRun:   s.run,
+		merle.CmdStop:  s.stop,
+		merle.GetState: s.getState,
+		"Flip":         s.flip,
+	}
+}
+
+func (s *switches) Assets() *merle.ThingAssets {
+	return &merle.ThingAssets{}
+}
+
+func TestHarness(t *testing.T) {
+	h := New(t, merle.NewThing(&switches{}))
+
+	h.Clock.Advance(time.Hour)
+
+	h.Send(&msgFlip{Msg: "Flip", Switch: 1, State: true})
+	h.ExpectBroadcast(Fields(map[string]interface{}{"Msg": "Flip", "Switch": 1}))
+	h.ExpectNoBroadcast(Msg("Flip"))
+
+	h.Send(&merle.Msg{Msg: merle.GetState})
+	reply := h.ExpectReply(All(Msg(merle.ReplyState),
+		Fields(map[string]interface{}{"States": []bool{false, true}})))
+
+	var state switches
+	h.Decode(reply, &state)
+	if want := h.Clock.Now(); !state.Changed.Equal(want) {
+		t.Errorf("Changed %s, want %s", state.Changed, want)
+	}
+
+	if len(h.Replies()) != 0 || len(h.Broadcasts()) != 0 {
+		t.Errorf("Left over: %q %q", h.Replies(), h.Broadcasts())
+	}
+
+	// Private replies are kept too
+	h.SendPrivate(&merle.Msg{Msg: merle.GetIdentity})
+	h.ExpectReply(Fields(map[string]interface{}{"Id": "merletest"}))
+
+	h.Run()
+
+	tick := h.ExpectBroadcast(Msg("Tick"))
+	var msg msgTick
+	h.Decode(tick, &msg)
+	if !msg.Time.Equal(h.Clock.Now()) {
+		t.Errorf("Tick at %s, want %s", msg.Time, h.Clock.Now())
+	}
+}
+
+func TestFields(t *testing.T) {
+	msg := []byte(`{"Msg":"Flip","Switch":1,"State":true,"Nested":{"A":1,"B":2}}`)
+
+	tests := []struct {
+		want     interface{}
+		expected bool
+	}{
+		{map[string]interface{}{"Msg": "Flip"}, true},
+		{map[string]interface{}{"Switch": 1, "State": true}, true},
+		{map[string]interface{}{"Switch": 2}, false},
+		{map[string]interface{}{"Missing": 1}, false},
+		{map[string]interface{}{"Nested": map[string]int{"B": 2}}, true},
+		{&msgFlip{Msg: "Flip", Switch: 1}, false},
+		{&msgFlip{Msg: "Flip", Switch: 1, State: true}, true},
+	}
+
+	for _, test := range tests {
+		if got := Fields(test.want)(msg); got != test.expected {
+			t.Errorf("Fields(%+v): got %t, want %t", test.want, got,
+				test.expected)
+		}
+	}
+}
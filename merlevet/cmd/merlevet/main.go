@@ -0,0 +1,19 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Merlevet checks a model's message coverage (see package merlevet).  Run it
+// on packages, or as a vet tool:
+//
+//	merlevet ./mything
+//	go vet -vettool=$(which merlevet) ./mything
+package main
+
+import (
+	"github.com/merliot/merle/merlevet"
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() {
+	singlechecker.Main(merlevet.Analyzer)
+}
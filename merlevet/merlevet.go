@@ -0,0 +1,340 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Package merlevet defines an Analyzer that checks a model's message
+// coverage.  Messages sent, in Go or in the model's template JS, are
+// cross-referenced with the messages handled, by the model's Subscribers or
+// by the template's JS, to flag messages sent but never handled, or handled
+// but never sent.
+//
+// Message names are resolved with type information, so a message named by
+// a constant, from any package, or sent in a struct of any type with a Msg
+// field, is found.  System messages, those starting with "_", are handled by
+// Thing and aren't checked, nor are BridgeSubscribers, which handle other
+// models' messages.
+//
+// Run the Analyzer with the merlevet command, with "merle vet", which runs
+// merlevet, or as a vet tool:
+//
+//	go install github.com/merliot/merle/merlevet/cmd/merlevet@latest
+//	merlevet ./mything
+//	go vet -vettool=$(which merlevet) ./mything
+//
+// merlevet is its own module, as golang.org/x/tools needs a newer Go than
+// package merle.
+package merlevet
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+const doc = `check a model's message coverage
+
+Messages sent, in Go or in the model's template JS, are cross-referenced
+with the messages handled, by the model's Subscribers or by the template's
+JS, to flag messages sent but never handled, or handled but never sent.
+Template JS is read from Go string literals, and from .html, .htm, .js,
+and .tmpl files in the package's directory or below.`
+
+// Analyzer checks a model's message coverage
+var Analyzer = &analysis.Analyzer{
+	Name: "merlevet",
+	Doc:  doc,
+	Run:  run,
+}
+
+const merlePath = "github.com/merliot/merle"
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	if len(pass.Files) == 0 {
+		return nil, nil
+	}
+
+	c := newCoverage()
+
+	for _, f := range pass.Files {
+		c.scanGo(pass, f)
+	}
+
+	dir := filepath.Dir(pass.Fset.File(pass.Files[0].Pos()).Name())
+	if err := c.scanAssets(pass.Fset, dir); err != nil {
+		return nil, err
+	}
+
+	for _, p := range c.problems() {
+		pass.Reportf(p.pos, "%s", p.msg)
+	}
+
+	return nil, nil
+}
+
+// Where messages are sent and handled
+type msgSite map[string][]token.Pos
+
+func (s msgSite) add(msg string, pos token.Pos) {
+	s[msg] = append(s[msg], pos)
+}
+
+type coverage struct {
+	goSent    msgSite
+	goHandled msgSite
+	jsSent    msgSite
+	jsHandled msgSite
+	// BridgeSubscribers
+	bridge msgSite
+	// Subscribers has a "default" handler
+	catchAll bool
+}
+
+func newCoverage() *coverage {
+	return &coverage{
+		goSent:    msgSite{},
+		goHandled: msgSite{},
+		jsSent:    msgSite{},
+		jsHandled: msgSite{},
+		bridge:    msgSite{},
+	}
+}
+
+var (
+	// JS sending: JSON.stringify({Msg: "Click", ...})
+	jsSendRe = regexp.MustCompile(`\bMsg\s*:\s*["'](\w+)["']`)
+	// JS handling: case "Click":, msg.Msg == "Click", or a merle.js
+	// handler, "Click": function(msg)
+	jsCaseRe    = regexp.MustCompile(`\bcase\s+["'](\w+)["']\s*:`)
+	jsEqualRe   = regexp.MustCompile(`\.Msg\s*===?\s*["'](\w+)["']`)
+	jsHandlerRe = regexp.MustCompile(`["'](\w+)["']\s*:\s*function\b`)
+)
+
+// Messages sent and handled by JS in text.  at gives the position of an
+// offset in text.
+func (c *coverage) scanJS(text string, at func(offset int) token.Pos) {
+	for _, m := range jsSendRe.FindAllStringSubmatchIndex(text, -1) {
+		c.jsSent.add(text[m[2]:m[3]], at(m[0]))
+	}
+	for _, re := range []*regexp.Regexp{jsCaseRe, jsEqualRe, jsHandlerRe} {
+		for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+			c.jsHandled.add(text[m[2]:m[3]], at(m[0]))
+		}
+	}
+}
+
+// Message name of e, if e is a string constant
+func msgName(pass *analysis.Pass, e ast.Expr) (string, bool) {
+	tv, ok := pass.TypesInfo.Types[e]
+	if !ok || tv.Value == nil || tv.Value.Kind() != constant.String {
+		return "", false
+	}
+	return constant.StringVal(tv.Value), true
+}
+
+// Whether t is merle.Subscribers, under any alias
+func isSubscribers(t types.Type) bool {
+	named, ok := types.Unalias(t).(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == merlePath &&
+		obj.Name() == "Subscribers"
+}
+
+// Whether field is a struct's Msg field
+func isMsgField(pass *analysis.Pass, field ast.Expr) bool {
+	id, ok := field.(*ast.Ident)
+	if !ok || id.Name != "Msg" {
+		return false
+	}
+	v, ok := pass.TypesInfo.ObjectOf(id).(*types.Var)
+	return ok && v.IsField()
+}
+
+// Add messages subscribed to in Subscribers literals in n to handled
+func subscribed(pass *analysis.Pass, n ast.Node, handled msgSite) msgSite {
+	ast.Inspect(n, func(n ast.Node) bool {
+		lit, ok := n.(*ast.CompositeLit)
+		if !ok || !isSubscribers(pass.TypesInfo.TypeOf(lit)) {
+			return true
+		}
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			if msg, ok := msgName(pass, kv.Key); ok {
+				handled.add(msg, kv.Pos())
+			}
+		}
+		return false
+	})
+	return handled
+}
+
+func (c *coverage) scanGo(pass *analysis.Pass, f *ast.File) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			// A bridge's subscribers handle messages from children,
+			// which are other models, so aren't expected to be sent
+			// here
+			if n.Name.Name == "BridgeSubscribers" && n.Recv != nil {
+				subscribed(pass, n, c.bridge)
+				return false
+			}
+		case *ast.CompositeLit:
+			if isSubscribers(pass.TypesInfo.TypeOf(n)) {
+				subscribed(pass, n, c.goHandled)
+				if _, ok := c.goHandled["default"]; ok {
+					delete(c.goHandled, "default")
+					c.catchAll = true
+				}
+				return false
+			}
+		case *ast.KeyValueExpr:
+			// Msg{Msg: "Update", ...}
+			if isMsgField(pass, n.Key) {
+				if msg, ok := msgName(pass, n.Value); ok {
+					c.goSent.add(msg, n.Pos())
+				}
+			}
+		case *ast.AssignStmt:
+			if len(n.Lhs) != len(n.Rhs) {
+				break
+			}
+			for i, lhs := range n.Lhs {
+				switch lhs := lhs.(type) {
+				case *ast.SelectorExpr:
+					// t.Msg = "Update"
+					if !isMsgField(pass, lhs.Sel) {
+						continue
+					}
+					if msg, ok := msgName(pass, n.Rhs[i]); ok {
+						c.goSent.add(msg, n.Pos())
+					}
+				case *ast.IndexExpr:
+					// subs["Click"] = t.click
+					if !isSubscribers(pass.TypesInfo.TypeOf(lhs.X)) {
+						continue
+					}
+					if msg, ok := msgName(pass, lhs.Index); ok {
+						c.goHandled.add(msg, n.Pos())
+					}
+				}
+			}
+		case *ast.BasicLit:
+			// Templates embedded in Go
+			if n.Kind == token.STRING {
+				c.scanLit(n)
+			}
+		}
+		return true
+	})
+}
+
+// Scan JS in string literal lit.  Offsets are exact in raw strings;
+// otherwise the literal's position is used.
+func (c *coverage) scanLit(lit *ast.BasicLit) {
+	s, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return
+	}
+	raw := strings.HasPrefix(lit.Value, "`")
+	c.scanJS(s, func(offset int) token.Pos {
+		if raw {
+			return lit.Pos() + 1 + token.Pos(offset)
+		}
+		return lit.Pos()
+	})
+}
+
+func isAsset(path string) bool {
+	switch filepath.Ext(path) {
+	case ".html", ".htm", ".js", ".tmpl":
+		return true
+	}
+	return false
+}
+
+// Scan templates and JS files in dir or below.  The files are added to fset,
+// for positions.
+func (c *coverage) scanAssets(fset *token.FileSet, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isAsset(path) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tf := fset.AddFile(path, -1, len(data))
+		tf.SetLinesForContent(data)
+		c.scanJS(string(data), func(offset int) token.Pos {
+			return tf.Pos(offset)
+		})
+		return nil
+	})
+}
+
+func system(msg string) bool {
+	return strings.HasPrefix(msg, "_")
+}
+
+type problem struct {
+	pos token.Pos
+	msg string
+}
+
+func (c *coverage) problems() []problem {
+	var problems []problem
+
+	report := func(sites msgSite, ok func(string) bool, what string) {
+		for msg, positions := range sites {
+			if system(msg) || ok(msg) {
+				continue
+			}
+			problems = append(problems, problem{positions[0],
+				"message " + strconv.Quote(msg) + " " + what})
+		}
+	}
+
+	handledGo := func(msg string) bool {
+		return c.catchAll || len(c.goHandled[msg]) > 0
+	}
+	handled := func(msg string) bool {
+		return handledGo(msg) || len(c.jsHandled[msg]) > 0 ||
+			len(c.bridge[msg]) > 0
+	}
+	sent := func(msg string) bool {
+		return len(c.goSent[msg]) > 0 || len(c.jsSent[msg]) > 0 ||
+			len(c.bridge[msg]) > 0
+	}
+
+	// Messages from the UI go to Thing's Subscribers.  Messages from
+	// Thing go to the UI, or, on Thing Prime or a bridge, to Thing's
+	// Subscribers.  A bridge shares messages with its children.
+	report(c.jsSent, handledGo, "sent by JS but never handled by Subscribers")
+	report(c.goSent, handled, "sent but never handled")
+	report(c.goHandled, sent, "handled by Subscribers but never sent")
+	report(c.jsHandled, sent, "handled by JS but never sent")
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].pos < problems[j].pos
+	})
+	return problems
+}
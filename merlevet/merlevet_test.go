@@ -0,0 +1,45 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merlevet
+
+import (
+	"go/token"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+func TestAnalyzer(t *testing.T) {
+	analysistest.Run(t, analysistest.TestData(), Analyzer, "model")
+}
+
+func TestAssets(t *testing.T) {
+	fset := token.NewFileSet()
+	c := newCoverage()
+	if err := c.scanAssets(fset, filepath.Join("testdata", "src", "assets")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`ui.js:1:8: message "Ghost" handled by JS but never sent`,
+		`ui.js:3:21: message "Phantom" handled by JS but never sent`,
+		`ui.js:4:27: message "Click" sent by JS but never handled by Subscribers`,
+	}
+
+	problems := c.problems()
+	if len(problems) != len(expected) {
+		t.Fatalf("Got %d problems, want %d: %v", len(problems),
+			len(expected), problems)
+	}
+	for i, p := range problems {
+		posn := fset.Position(p.pos)
+		got := filepath.Base(posn.Filename) + ":" + posn.String()[len(posn.Filename)+1:] +
+			": " + p.msg
+		if got != expected[i] {
+			t.Errorf("Got %q, want %q", got, expected[i])
+		}
+	}
+}
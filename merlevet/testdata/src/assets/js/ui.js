@@ -0,0 +1,4 @@
+if (msg.Msg === "Ghost") {
+}
+merle.connect(url, {"Phantom": function(msg) {}})
+conn.send(JSON.stringify({Msg: "Click"}))
@@ -0,0 +1,21 @@
+// Stub of package merle, for testing
+
+package merle
+
+const (
+	CmdRun     = "_CmdRun"
+	GetState   = "_GetState"
+	ReplyState = "_ReplyState"
+)
+
+type Msg struct {
+	Msg string
+}
+
+type Packet struct{}
+
+func (p *Packet) Marshal(msg interface{}) *Packet { return p }
+func (p *Packet) Broadcast()                      {}
+func (p *Packet) Reply()                          {}
+
+type Subscribers map[string]func(*Packet)
@@ -0,0 +1,58 @@
+package model
+
+import (
+	m "github.com/merliot/merle"
+)
+
+const msgTick = "Tick"
+
+type subs = m.Subscribers
+
+type model struct {
+	Msg string
+}
+
+type msgUpdate struct {
+	Msg   string
+	Value int
+}
+
+func (t *model) run(p *m.Packet) {
+	msg := struct{ Msg string }{Msg: msgTick}
+	p.Marshal(&msg).Broadcast()
+	t.Msg = "Orphan" // want `message "Orphan" sent but never handled`
+	p.Marshal(t).Broadcast()
+	p.Marshal(&msgUpdate{Msg: "Update", Value: 1}).Broadcast()
+}
+
+func (t *model) getState(p *m.Packet) {
+	p.Marshal(&m.Msg{Msg: m.ReplyState}).Reply()
+}
+
+func (t *model) handle(p *m.Packet) {}
+
+func (t *model) Subscribers() m.Subscribers {
+	s := subs{
+		m.CmdRun:   t.run,
+		m.GetState: t.getState,
+		"Click":    t.handle,
+		"Update":   t.handle,
+		"Stale":    t.handle, // want `message "Stale" handled by Subscribers but never sent`
+	}
+	s["Late"] = t.handle // want `message "Late" handled by Subscribers but never sent`
+	return s
+}
+
+func (t *model) BridgeSubscribers() m.Subscribers {
+	return m.Subscribers{
+		"Child":   t.handle,
+		"default": nil,
+	}
+}
+
+const (
+	sendClick = "conn.send(JSON.stringify({Msg: 'Click'}))"
+	sendLost  = "conn.send(JSON.stringify({Msg: 'Lost'}))" // want `message "Lost" sent by JS but never handled by Subscribers`
+	onMessage = "switch(msg.Msg) { case '_ReplyState': case 'Tick': case 'Child': break }"
+	onGhost   = "if (msg.Msg === 'Ghost') {}" // want `message "Ghost" handled by JS but never sent`
+)
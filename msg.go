@@ -4,7 +4,10 @@
 
 package merle
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // System messages.  System messages are prefixed with '_'.
 const (
@@ -18,7 +21,7 @@ const (
 
 	// CmdRun is Thing's main loop.  All Things must subscribe and handle
 	// CmdRun, via Subscribers().  CmdRun should run forever; it is an error
-	// for CmdRun handler to exit.
+	// for CmdRun handler to exit, unless stopped by CmdStop.
 	//
 	// CmdRun is not sent to Thing Prime.  Thing Prime does not have a main
 	// loop.
@@ -28,6 +31,15 @@ const (
 	// is optional and doesn't need to run forever.
 	CmdRun = "_CmdRun"
 
+	// CmdStop asks Thing's CmdRun handler to return, so Thing.SwapThinger
+	// can swap in a new Thinger.  Thing can optionally subscribe and handle
+	// CmdStop via Subscribers(), to end its main loop.  The CmdStop
+	// handler should not wait for CmdRun to return.  RunForever returns on
+	// CmdStop without subscribing.
+	//
+	// CmdStop is only sent internally; CmdStop from a socket is dropped.
+	CmdStop = "_CmdStop"
+
 	// GetIdentity requests Thing's identity.  Thing does not need to
 	// subscribe to GetIdentity.  Thing will internally respond with a
 	// ReplyIdentity message.
@@ -80,6 +92,453 @@ const (
 	//
 	// EventStatus message is coded as MsgEventStatus.
 	EventStatus = "_EventStatus"
+
+	// EventChildConnected is sent by a bridge when a child attaches, and
+	// EventChildDisconnected when the child's connection drops.  Both are
+	// sent to the bridge bus, for BridgeSubscribers(), and to the
+	// bridge's own bus, for Subscribers().  Subscribe to broadcast them
+	// to the bridge's UI.
+	//
+	// EventChildConnected message is coded as MsgChildConnected.
+	EventChildConnected = "_EventChildConnected"
+
+	// EventChildDisconnected message is coded as MsgChildDisconnected.
+	EventChildDisconnected = "_EventChildDisconnected"
+
+	// EventPowerLost is Thing's last gasp to mother on power failure.
+	// See Thing.PowerLost().  Thing Prime broadcasts EventPowerLost to
+	// its listeners, and the EventStatus sent when Thing goes offline has
+	// PowerLost set.  EventPowerLost message is coded as
+	// MsgEventPowerLost.
+	EventPowerLost = "_EventPowerLost"
+
+	// SetPrimeRole is sent from Thing to each of its Thing Primes, if
+	// Thing has a standby Thing Prime (see Cfg.MotherHostStandby), when
+	// the Thing Prime connects and on failover.  Thing Prime does not need
+	// to subscribe to SetPrimeRole.
+	//
+	// SetPrimeRole message is coded as MsgPrimeRole.
+	SetPrimeRole = "_SetPrimeRole"
+
+	// EventDutyCutoff is sent to Thing's Subscribers() when Thing cuts off
+	// an output for running over its DutyLimit's MaxOnTime.  The output
+	// is already off in Thing's state.  Subscribe to switch the actuator
+	// off and broadcast to Thing's UI.
+	//
+	// EventDutyCutoff message is coded as MsgDutyCutoff.
+	EventDutyCutoff = "_EventDutyCutoff"
+
+	// EventResync is sent from Thing to mother to end a resync, after
+	// Thing's ReplyState to mother and any messages held in Thing's
+	// outbox.  Mother acks with ResyncAck.  Thing Prime does not need to
+	// subscribe to EventResync.
+	//
+	// EventResync message is coded as MsgEventResync.
+	EventResync = "_EventResync"
+
+	// ResyncAck is sent from mother to Thing to ack EventResync.  Thing
+	// drops the outbox messages replayed in the resync.  Thing does not
+	// need to subscribe to ResyncAck.
+	//
+	// ResyncAck message is coded as MsgResyncAck.
+	ResyncAck = "_ResyncAck"
+
+	// SetMotherHints is sent from mother to Thing with an ordered list of
+	// alternate mother endpoints.  Thing does not need to subscribe to
+	// SetMotherHints.  Thing will internally save the hints and try them,
+	// in order, if the tunnel to mother can't be created.
+	//
+	// SetMotherHints is only accepted from mother.
+	//
+	// SetMotherHints message is coded as MsgMotherHints.
+	SetMotherHints = "_SetMotherHints"
+
+	// SetConfigTemplate is sent from mother to Thing with Thing's config
+	// template, merged from the mother's Cfg.ConfigTemplates matching
+	// Thing.  Thing does not need to subscribe to SetConfigTemplate.
+	// Thing will internally layer the template under Thing's own config
+	// and reload.
+	//
+	// SetConfigTemplate is only accepted from mother.
+	//
+	// SetConfigTemplate message is coded as MsgConfigTemplate.
+	SetConfigTemplate = "_SetConfigTemplate"
+
+	// EventConfigDrift is broadcast by Thing when Thing gets a config
+	// template, and on each reload, listing the template config items
+	// where Thing's config differs from the template.  Mother does not
+	// need to subscribe to EventConfigDrift.  Mother saves the drift (see
+	// Thing.ConfigDrift()) and forwards the message to mother's listeners.
+	//
+	// EventConfigDrift message is coded as MsgConfigDrift.
+	EventConfigDrift = "_EventConfigDrift"
+
+	// GetStatus requests Thing's runtime status: connected sockets,
+	// tunnel state, children, and framework components.  Thing does not
+	// need to subscribe to GetStatus.  Thing will internally respond with
+	// a ReplyStatus message.
+	//
+	// GetStatus is only answered on Thing's private HTTP server.
+	GetStatus = "_GetStatus"
+
+	// Response to GetStatus.  ReplyStatus message is coded as MsgStatus.
+	ReplyStatus = "_ReplyStatus"
+
+	// GetHistory requests Thing's history of a message type.  Thing does
+	// not need to subscribe to GetHistory.  If Thing has history enabled
+	// (see HistoryConfig), Thing will internally respond with a
+	// ReplyHistory message.
+	//
+	// GetHistory message is coded as MsgGetHistory.
+	GetHistory = "_GetHistory"
+
+	// Response to GetHistory.  ReplyHistory message is coded as
+	// MsgHistory.
+	ReplyHistory = "_ReplyHistory"
+
+	// GetRuntime requests Thing's runtime counters.  Thing does not need
+	// to subscribe to GetRuntime.  If Thing has runtime counters (see
+	// RuntimeCounter), Thing will internally respond with a ReplyRuntime
+	// message.
+	GetRuntime = "_GetRuntime"
+
+	// ResetRuntime marks an output serviced, clearing its service
+	// counters.  Thing does not need to subscribe to ResetRuntime.  Thing
+	// will internally respond with a ReplyRuntime message.
+	//
+	// ResetRuntime message is coded as MsgResetRuntime.
+	ResetRuntime = "_ResetRuntime"
+
+	// Response to GetRuntime and ResetRuntime.  ReplyRuntime message is
+	// coded as MsgRuntime.
+	ReplyRuntime = "_ReplyRuntime"
+
+	// EventServiceDue is sent to Thing's Subscribers() when an output's
+	// runtime counters reach the output's service thresholds.  See
+	// RuntimeCounter.
+	//
+	// EventServiceDue message is coded as MsgServiceDue.
+	EventServiceDue = "_EventServiceDue"
+
+	// GetInputs requests the status of Thing's inputs.  Thing does not
+	// need to subscribe to GetInputs.  If Thing has inputs (see
+	// InputConfig), Thing will internally respond with a ReplyInputs
+	// message.
+	GetInputs = "_GetInputs"
+
+	// Response to GetInputs.  ReplyInputs message is coded as MsgInputs.
+	ReplyInputs = "_ReplyInputs"
+
+	// EventInput is sent to Thing's Subscribers() on each debounced edge
+	// of a button input.  See InputConfig.
+	//
+	// EventInput message is coded as MsgInput.
+	EventInput = "_EventInput"
+
+	// GetAlerts requests the status of Thing's alerts.  Thing does not
+	// need to subscribe to GetAlerts.  If Thing has alerts (see
+	// AlertConfig), Thing will internally respond with a ReplyAlerts
+	// message.
+	GetAlerts = "_GetAlerts"
+
+	// Response to GetAlerts.  ReplyAlerts message is coded as MsgAlerts.
+	ReplyAlerts = "_ReplyAlerts"
+
+	// EventAlert is sent to Thing's Subscribers() when an alert is raised
+	// or cleared.  See AlertConfig.  Subscribe to broadcast to Thing's UI,
+	// or to act on the alert.
+	//
+	// EventAlert message is coded as MsgAlert.
+	EventAlert = "_EventAlert"
+
+	// CANFrame is a raw CAN frame, received from the CAN bus, for frames
+	// matching CANConfig's Filters, or broadcast by Thing, to send on the
+	// CAN bus.  See CANConfig.
+	//
+	// CANFrame message is coded as MsgCANFrame.
+	CANFrame = "_CANFrame"
+
+	// EventLANPeerUp is received by Thing when a sibling Thing is first
+	// heard on the LAN, and EventLANPeerDown when the sibling goes quiet,
+	// or stops.  See LANConfig.  Subscribe to broadcast them to Thing's
+	// UI, or to act on them.
+	//
+	// EventLANPeerUp message is coded as MsgLANPeer.
+	EventLANPeerUp = "_EventLANPeerUp"
+
+	// EventLANPeerDown message is coded as MsgLANPeer.
+	EventLANPeerDown = "_EventLANPeerDown"
+
+	// Ack is Thing's reply to a command message with an IdempotencyKey
+	// member, once Thing has applied the command, or dropped it as a
+	// duplicate of one already applied.  Thing does not need to subscribe
+	// to Ack.  Thing Prime passes Thing's Ack back to the command's
+	// sender.  See Cfg.DedupWindow.
+	//
+	// Ack message is coded as MsgAck.
+	Ack = "_Ack"
+
+	// Heartbeat is broadcast by Thing every Cfg.Heartbeat seconds, with
+	// Thing's uptime, memory, goroutine count, and tunnel status.  Thing
+	// does not need to subscribe to Heartbeat.  Thing Prime, and a bridge
+	// for each child, pass Heartbeats on, and take Thing as offline if
+	// Heartbeats stop.
+	//
+	// Heartbeat message is coded as MsgHeartbeat.
+	Heartbeat = "_Heartbeat"
+
+	// SockOpened is received by Thing when a socket is plugged into
+	// Thing's bus, and SockClosed when the socket is unplugged, with the
+	// socket's name and kind (SockClient, SockMother, ...).  Open counts
+	// the sockets of that kind still open, so a Thinger can, say, pause
+	// polling that's only for show while no one is watching:
+	//
+	//	func (t *thing) sockClosed(p *merle.Packet) {
+	//		var msg merle.MsgSock
+	//		p.Unmarshal(&msg)
+	//		if msg.Kind == merle.SockClient && msg.Open == 0 {
+	//			t.pause()
+	//		}
+	//	}
+	//
+	// SockOpened and SockClosed are only sent if subscribed to.
+	//
+	// SockOpened message is coded as MsgSock.
+	SockOpened = "_SockOpened"
+
+	// SockClosed message is coded as MsgSock.
+	SockClosed = "_SockClosed"
+
+	// GetAudit requests records from Thing's audit trail (see
+	// Cfg.AuditFile).  Thing does not need to subscribe to GetAudit.  If
+	// Thing has an audit trail, Thing will internally respond with a
+	// ReplyAudit message.  Read-only (viewer) sockets can't get the audit
+	// trail.
+	//
+	// GetAudit message is coded as MsgGetAudit.
+	GetAudit = "_GetAudit"
+
+	// Response to GetAudit.  ReplyAudit message is coded as MsgAudit.
+	ReplyAudit = "_ReplyAudit"
+
+	// EventAudit is sent by Thing to mother for each audit record, if
+	// Cfg.AuditForward.  Thing Prime adds the record to its own audit
+	// trail.  Thing does not need to subscribe to EventAudit.
+	//
+	// EventAudit message is coded as MsgEventAudit.
+	EventAudit = "_EventAudit"
+
+	// GetRegistry requests Thing Prime's, or a bridge's, registry of the
+	// Things it has known (see Cfg.RegistryFile).  Thing does not need to
+	// subscribe to GetRegistry.  If the registry is enabled, Thing will
+	// internally respond with a ReplyRegistry message.
+	//
+	// GetRegistry, SetRegistryNotes, and DeleteRegistry are only handled
+	// on the private HTTP server.
+	GetRegistry = "_GetRegistry"
+
+	// Response to GetRegistry, SetRegistryNotes, and DeleteRegistry.
+	// ReplyRegistry message is coded as MsgRegistry.
+	ReplyRegistry = "_ReplyRegistry"
+
+	// SetRegistryNotes sets the Notes kept in the registry for Id.
+	// SetRegistryNotes message is coded as MsgRegistryEdit.
+	SetRegistryNotes = "_SetRegistryNotes"
+
+	// DeleteRegistry forgets Id, if Id isn't connected.  DeleteRegistry
+	// message is coded as MsgRegistryEdit.
+	DeleteRegistry = "_DeleteRegistry"
+
+	// GetCalibration requests Thing's calibrations.  Thing does not need
+	// to subscribe to GetCalibration.  Thing will internally respond with
+	// a ReplyCalibration message.
+	GetCalibration = "_GetCalibration"
+
+	// SetCalibration adds or replaces a calibration (see Calibration).
+	// Thing does not need to subscribe to SetCalibration.  Thing will
+	// internally respond with a ReplyCalibration message.
+	// SetCalibration is only accepted on Thing's private server.
+	//
+	// SetCalibration message is coded as MsgCalibration.
+	SetCalibration = "_SetCalibration"
+
+	// Response to GetCalibration and SetCalibration.  ReplyCalibration
+	// message is coded as MsgCalibrations.
+	ReplyCalibration = "_ReplyCalibration"
+
+	// GetSchedules requests Thing's schedules.  Thing does not need to
+	// subscribe to GetSchedules.  Thing will internally respond with a
+	// ReplySchedules message.
+	GetSchedules = "_GetSchedules"
+
+	// SetSchedule adds or replaces a schedule (see Schedule), by Name.
+	// Thing does not need to subscribe to SetSchedule.  Thing will
+	// internally respond with a ReplySchedules message.  SetSchedule is
+	// only accepted on Thing's private server.
+	//
+	// SetSchedule message is coded as MsgSchedule.
+	SetSchedule = "_SetSchedule"
+
+	// DeleteSchedule deletes the schedule named Schedule.Name.  Thing will
+	// internally respond with a ReplySchedules message.  DeleteSchedule is
+	// only accepted on Thing's private server.
+	//
+	// DeleteSchedule message is coded as MsgSchedule.
+	DeleteSchedule = "_DeleteSchedule"
+
+	// Response to GetSchedules, SetSchedule, and DeleteSchedule.
+	// ReplySchedules message is coded as MsgSchedules.
+	ReplySchedules = "_ReplySchedules"
+
+	// Update asks Thing to update its binary over the air (see
+	// UpdateConfig).  Thing does not need to subscribe to Update.  Update
+	// is only accepted from mother.  If the update fails, Thing will
+	// internally respond with a ReplyUpdate message; if it succeeds,
+	// Thing restarts with the new binary.
+	//
+	// Update message is coded as MsgUpdate.
+	Update = "_Update"
+
+	// Response to a failed Update.  ReplyUpdate message is coded as
+	// MsgUpdateResult.
+	ReplyUpdate = "_ReplyUpdate"
+
+	// InjectFault injects a fault (see Fault).  Thing does not need to
+	// subscribe to InjectFault.  InjectFault is only accepted on Thing's
+	// private server, and only if Cfg.FaultInjection is set.  Thing will
+	// internally respond with a ReplyFaults message.
+	//
+	// InjectFault message is coded as MsgFault.
+	InjectFault = "_InjectFault"
+
+	// ClearFaults ends all injected faults.  Thing will internally
+	// respond with a ReplyFaults message.
+	ClearFaults = "_ClearFaults"
+
+	// GetFaults requests the injected faults active.  Thing will
+	// internally respond with a ReplyFaults message.
+	GetFaults = "_GetFaults"
+
+	// Response to InjectFault, ClearFaults, and GetFaults.  ReplyFaults
+	// message is coded as MsgFaults.
+	ReplyFaults = "_ReplyFaults"
+
+	// EventError is sent to Thing's Subscribers() when the framework
+	// fails, e.g. mother has no port for Thing's tunnel.  Code is the
+	// Error Code (see Error).  Subscribe to react to specific failures,
+	// e.g. to show them on Thing's UI.
+	//
+	// EventError message is coded as MsgError.
+	EventError = "_EventError"
+
+	// GetJournalSince requests journal records since a sequence number.
+	// Thing does not need to subscribe to GetJournalSince.  If Thing has
+	// a journal (see Cfg.JournalFile), Thing will internally respond with
+	// a ReplyJournal message.  Thing Prime sends GetJournalSince to Thing
+	// after (re)connecting to Thing, to resync Thing Prime's state.
+	//
+	// GetJournalSince message is coded as MsgGetJournalSince.
+	GetJournalSince = "_GetJournalSince"
+
+	// Response to GetJournalSince.  ReplyJournal message is coded as
+	// MsgJournal.  Thing Prime replays the journal records on Thing
+	// Prime's bus, so Thing Prime does not need to subscribe to
+	// ReplyJournal.
+	ReplyJournal = "_ReplyJournal"
+
+	// StatePatch is broadcast by Thing, in place of a full state update,
+	// when Thing calls Packet.BroadcastPatch().  Thing Prime does not need
+	// to subscribe to StatePatch.  Thing Prime applies the patch to the
+	// last state received and passes the full state to Thing Prime's
+	// ReplyState subscriber.
+	//
+	// StatePatch message is coded as MsgStatePatch.
+	StatePatch = "_StatePatch"
+
+	// GetChildren requests a bridge's children and blocked Ids.  The
+	// bridge does not need to subscribe to GetChildren.  The bridge will
+	// internally respond with a ReplyChildren message.
+	//
+	// GetChildren, and the child management messages that follow, are
+	// only handled on the bridge's private HTTP server.
+	GetChildren = "_GetChildren"
+
+	// Response to GetChildren, and to each child management message.
+	// ReplyChildren message is coded as MsgChildren.
+	ReplyChildren = "_ReplyChildren"
+
+	// DetachChild closes the bridge's connection to a child.  A child
+	// still tunneled to the bridge re-attaches; use BlockChild to keep
+	// the child off.  DetachChild message is coded as MsgChild.
+	DetachChild = "_DetachChild"
+
+	// BlockChild detaches a child, if attached, and blocks the Id from
+	// attaching to the bridge.  BlockChild message is coded as MsgChild.
+	BlockChild = "_BlockChild"
+
+	// UnblockChild lets a blocked Id attach to the bridge again.
+	// UnblockChild message is coded as MsgChild.
+	UnblockChild = "_UnblockChild"
+
+	// RenameChild changes the name the bridge shows for a child.  The
+	// child Thing keeps its own name; the bridge still matches
+	// BridgeThingers, and checks re-attaches, against the child's own
+	// name.  RenameChild message is coded as MsgChild, with the new Name.
+	RenameChild = "_RenameChild"
+
+	// GroupChild adds a child to a group.  Packets can be sent to a
+	// group of children with Packet.SendGroup().  GroupChild message is
+	// coded as MsgChild, with the Group.
+	GroupChild = "_GroupChild"
+
+	// UngroupChild removes a child from a group added by GroupChild.
+	// Groups from Cfg.BridgeGroups, or from the child's Tags, stay.
+	// UngroupChild message is coded as MsgChild, with the Group.
+	UngroupChild = "_UngroupChild"
+
+	// FanOut sends message Send to each of a bridge's children, or to the
+	// children in Group, and collects the children's replies.  The bridge
+	// does not need to subscribe to FanOut.  The bridge will internally
+	// respond with a ReplyFanOut message once each child has replied, or
+	// after Timeout milliseconds (2 seconds if Timeout is zero).  A child
+	// replies to a request itself; for a command, the child's reply is
+	// Thing's Ack of the command's IdempotencyKey, or Thing's broadcast of
+	// the command's Msg.  Only the children the user can access are sent
+	// to.  See also Packet.FanOut().  FanOut message is coded as MsgFanOut.
+	FanOut = "_FanOut"
+
+	// Response to FanOut.  ReplyFanOut message is coded as
+	// MsgFanOutReply.
+	ReplyFanOut = "_ReplyFanOut"
+
+	// Notify is broadcast by Thing to notify people, by email, SMS, or Web
+	// Push (see NotificationsConfig), and Thing's UIs, of an event.
+	//
+	// Notify message is coded as MsgNotify.
+	Notify = "_Notify"
+
+	// SubscribePush subscribes a browser to Thing's Web Push
+	// notifications.  Thing does not need to subscribe to SubscribePush.
+	//
+	// SubscribePush message is coded as MsgPushSubscription.
+	SubscribePush = "_SubscribePush"
+)
+
+// Notification severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Fan-out result status
+const (
+	// Child replied
+	FanOutReplied = "replied"
+	// Child didn't reply in time
+	FanOutTimeout = "timeout"
+	// Child isn't attached
+	FanOutOffline = "offline"
 )
 
 // All messages in Merle build on this basic struct.  All messages have a
@@ -98,13 +557,77 @@ type Msg struct {
 //
 // 1. If Thing Prime, send to all listeners (browsers) on Thing Prime.
 // 2. If Bridge, send to mother bus and to bridge bus.
+//
+// PowerLost is set if Thing went offline after sending EventPowerLost.
+// Standby is set if Thing Prime is Thing's standby Thing Prime (see
+// Cfg.MotherHostStandby); Thing can't be changed from a standby.
 type MsgEventStatus struct {
+	Msg       string
+	Id        string
+	Online    bool
+	PowerLost bool
+	Standby   bool
+}
+
+// Prime role message sent in SetPrimeRole.  One Thing Prime is Active; the
+// others are standby.  Term is bumped each time the active Thing Prime
+// changes.
+type MsgPrimeRole struct {
 	Msg    string
-	Id     string
-	Online bool
+	Active bool
+	Term   uint
+}
+
+// Duty cutoff message sent in EventDutyCutoff.  OnTime is how long, in
+// seconds, Output was on.
+type MsgDutyCutoff struct {
+	Msg    string
+	Output string
+	OnTime uint
+}
+
+// Resync message sent in EventResync.  Seq numbers Thing's resyncs; Events
+// is the number of outbox messages replayed; Version is Thing's StatePatch
+// version.
+type MsgEventResync struct {
+	Msg     string
+	Seq     uint64
+	Events  uint
+	Version uint64
 }
 
-// Thing identification message return in ReplyIdentity
+// Resync ack message sent in ResyncAck
+type MsgResyncAck struct {
+	Msg string
+	Seq uint64
+}
+
+// Power lost message sent in EventPowerLost
+type MsgEventPowerLost struct {
+	Msg  string
+	Id   string
+	Time time.Time
+}
+
+// Bridge child attached message sent in EventChildConnected
+type MsgChildConnected struct {
+	Msg   string
+	Id    string
+	Model string
+	Name  string
+}
+
+// Bridge child detached message sent in EventChildDisconnected
+type MsgChildDisconnected struct {
+	Msg   string
+	Id    string
+	Model string
+	Name  string
+}
+
+// Thing identification message return in ReplyIdentity.  Journal is true if
+// Thing keeps a journal for GetJournalSince.  Tags are Thing's Cfg.Tags.
+// Protocol is the WebSocket protocol version, ProtocolVersion.
 type MsgIdentity struct {
 	Msg         string
 	Id          string
@@ -112,4 +635,588 @@ type MsgIdentity struct {
 	Name        string
 	Online      bool
 	StartupTime time.Time
+	Journal     bool
+	Tags        []string
+	Protocol    int
+	// Thing's software version (Cfg.Version)
+	Version string `json:",omitempty"`
+}
+
+// ProtocolVersion is the version of the WebSocket and REST contract
+// documented in PROTOCOL.md.  The version is bumped on incompatible changes
+// to the contract; new optional message members don't change the version.
+const ProtocolVersion = 1
+
+// An alternate mother endpoint.  If User is empty, Cfg.MotherUser is used.  If
+// PortPrivate is zero, Cfg.MotherPortPrivate is used.
+type MotherHint struct {
+	Host        string
+	User        string
+	PortPrivate uint
+}
+
+// Mother hints message sent in SetMotherHints
+type MsgMotherHints struct {
+	Msg   string
+	Hints []MotherHint
+}
+
+// A config template, held by mother, for children matching Model and Tag.  An
+// empty Model or Tag matches any child.  Config holds config items by name,
+// as in a JSON config file (see NewJSONConfig), e.g.:
+//
+//	merle.ConfigTemplate{
+//		Name:  "garage",
+//		Model: "relays",
+//		Tag:   "garage",
+//		Config: map[string]interface{}{
+//			"PortPublic": 80,
+//			"History":    map[string]interface{}{"Retention": 86400},
+//		},
+//	}
+type ConfigTemplate struct {
+	Name   string
+	Model  string
+	Tag    string
+	Config map[string]interface{}
+}
+
+// Config template message sent in SetConfigTemplate.  Templates are the
+// names of the templates merged into Config, in merge order.
+type MsgConfigTemplate struct {
+	Msg       string
+	Templates []string
+	Config    map[string]interface{}
+}
+
+// A config item where Thing's config differs from Thing's template
+type ConfigDriftItem struct {
+	Template interface{}
+	Actual   interface{}
+}
+
+// Config drift message broadcast in EventConfigDrift.  Drift is keyed by config
+// item path, e.g. "PortPublic" or "History.Retention".  An empty Drift means
+// Thing's config matches Thing's template.
+type MsgConfigDrift struct {
+	Msg       string
+	Id        string
+	Templates []string
+	Drift     map[string]ConfigDriftItem
+}
+
+// Status of a socket connected to Thing.  Mother is true for the socket to
+// mother.  Ready is true once the socket is receiving broadcasts.
+type SocketStatus struct {
+	Name   string
+	Mother bool
+	Ready  bool
+	// Mother is a standby Thing Prime
+	Standby bool
+}
+
+// Tunnel states
+const (
+	// Tunnel is not configured, e.g. Thing has no mother
+	TunnelDisabled = "disabled"
+	// Tunnel is trying to connect to mother
+	TunnelConnecting = "connecting"
+	// Tunnel is connected to mother
+	TunnelConnected = "connected"
+)
+
+// Status of the tunnel to mother.  Host is the mother host, when connecting
+// or connected.
+type TunnelStatus struct {
+	State string
+	Host  string
+}
+
+// Status of a bridge's child
+type ChildStatus struct {
+	Id     string
+	Model  string
+	Name   string
+	Online bool
+	Groups []string
+}
+
+// Child management message sent in DetachChild, BlockChild, UnblockChild,
+// RenameChild, GroupChild, and UngroupChild.  Name is only used by
+// RenameChild, and Group by GroupChild and UngroupChild.
+type MsgChild struct {
+	Msg   string
+	Id    string
+	Name  string
+	Group string
+}
+
+// Fan-out message sent in FanOut
+type MsgFanOut struct {
+	Msg     string
+	Group   string
+	Timeout uint
+	Send    json.RawMessage
+}
+
+// Result of fan-out to a child.  Reply is the child's reply, if Status is
+// FanOutReplied.
+type FanOutResult struct {
+	Id     string
+	Status string
+	Reply  json.RawMessage `json:",omitempty"`
+}
+
+// Fan-out results returned in ReplyFanOut, one per child, sorted by Id
+type MsgFanOutReply struct {
+	Msg     string
+	Results []FanOutResult
+}
+
+// Children message returned in ReplyChildren.  Blocked are the Ids blocked
+// from attaching to the bridge.
+type MsgChildren struct {
+	Msg      string
+	Children []ChildStatus
+	Blocked  []string
+}
+
+// Status message returned in ReplyStatus
+type MsgStatus struct {
+	Msg     string
+	Sockets []SocketStatus
+	Tunnel  TunnelStatus
+	// Tunnel to standby Thing Prime, if Cfg.MotherHostStandby
+	TunnelStandby *TunnelStatus `json:",omitempty"`
+	Children      []ChildStatus
+	Components    []ComponentStatus
+	Duty          []DutyStatus `json:",omitempty"`
+	// Latest framework error of each Code
+	Errors []MsgError
+}
+
+// Duty status of an output with a DutyLimit.  OnTime is how long, in
+// seconds, Output has been on; Cycles is how many times Output switched on
+// in the last hour.
+type DutyStatus struct {
+	Output string
+	On     bool
+	OnTime uint
+	Cycles uint
+}
+
+// Runtime counters of an output with a RuntimeCounter.  OnTime, in seconds,
+// and Cycles are totals; ServiceOnTime and ServiceCycles are since the output
+// was Serviced.  Due is set once the output is due for service.
+type RuntimeStatus struct {
+	Output        string
+	OnTime        uint
+	Cycles        uint
+	ServiceOnTime uint
+	ServiceCycles uint
+	Serviced      time.Time
+	Due           bool
+}
+
+// Runtime counters message sent in ReplyRuntime
+type MsgRuntime struct {
+	Msg      string
+	Counters []RuntimeStatus
+}
+
+// Reset runtime message sent in ResetRuntime
+type MsgResetRuntime struct {
+	Msg    string
+	Output string
+}
+
+// Service due message sent in EventServiceDue.  Hours and Cycles are since
+// Output was last serviced.
+type MsgServiceDue struct {
+	Msg    string
+	Output string
+	Hours  uint
+	Cycles uint
+}
+
+// Status of an input.  For a counter, Count is the pulses counted, Total is
+// Count times the input's Scale, and Rate is Total per second over the
+// input's RateWindow.
+type InputStatus struct {
+	Name   string
+	Kind   string
+	Active bool
+	Count  uint64  `json:",omitempty"`
+	Total  float64 `json:",omitempty"`
+	Rate   float64 `json:",omitempty"`
+}
+
+// Inputs message sent in ReplyInputs
+type MsgInputs struct {
+	Msg    string
+	Inputs []InputStatus
+}
+
+// Input message sent in EventInput, on a debounced edge of button Name
+type MsgInput struct {
+	Msg    string
+	Name   string
+	Active bool
+	Time   time.Time
+}
+
+// Status of an alert.  Value is the last value of the alert's Field, and
+// Time is when the alert was last raised or cleared; zero if never.
+type AlertStatus struct {
+	Name      string
+	Severity  string
+	Active    bool
+	Value     float64
+	Threshold float64
+	Time      time.Time
+}
+
+// Alerts message sent in ReplyAlerts
+type MsgAlerts struct {
+	Msg    string
+	Alerts []AlertStatus
+}
+
+// Alert message sent in EventAlert, when alert Name is raised (Active) or
+// cleared
+type MsgAlert struct {
+	Msg string
+	AlertStatus
+}
+
+// CAN frame message sent in CANFrame.  Data is up to 8 bytes.
+type MsgCANFrame struct {
+	Msg  string
+	Id   uint32
+	Data []byte
+}
+
+// Sibling Thing message sent in EventLANPeerUp and EventLANPeerDown.  Host
+// is the sibling's IP address.
+type MsgLANPeer struct {
+	Msg   string
+	Id    string
+	Model string
+	Name  string
+	Host  string
+}
+
+// Ack message sent in Ack.  Duplicate is set if the command was dropped, as
+// the command with IdempotencyKey was already applied.
+type MsgAck struct {
+	Msg            string
+	IdempotencyKey string
+	Duplicate      bool
+}
+
+// Heartbeat message broadcast in Heartbeat.  Interval is the seconds
+// between Heartbeats; Uptime is seconds since Thing started.  MemAlloc and
+// MemSys are bytes of heap allocated, and bytes obtained from the OS.
+type MsgHeartbeat struct {
+	Msg        string
+	Id         string
+	Interval   uint
+	Uptime     uint64
+	MemAlloc   uint64
+	MemSys     uint64
+	Goroutines int
+	Tunnel     TunnelStatus
+}
+
+// Socket kinds, in MsgSock
+const (
+	// A client, such as a UI, on a WebSocket, SSE, or gRPC
+	SockClient = "client"
+	// Thing's mother: Thing Prime, or a bridge
+	SockMother = "mother"
+	// On Thing Prime, or a bridge's child, Thing
+	SockThing = "thing"
+	// Between a bridge and its child
+	SockBridge = "bridge"
+	// A serial, CAN, LAN, NATS, or other link
+	SockLink = "link"
+)
+
+// Socket message sent in SockOpened and SockClosed.  Open is the number of
+// sockets of Kind open on Thing's bus, after the change.
+type MsgSock struct {
+	Msg  string
+	Name string
+	Kind string
+	Open int
+}
+
+// Calibration message sent in SetCalibration
+type MsgCalibration struct {
+	Msg         string
+	Calibration Calibration
+}
+
+// Status of a calibration.  Raw is the last raw reading, and Value its
+// calibrated value.
+type CalibrationStatus struct {
+	Calibration
+	Raw   float64
+	Value float64
+}
+
+// Calibrations message sent in ReplyCalibration
+type MsgCalibrations struct {
+	Msg          string
+	Calibrations []CalibrationStatus
+}
+
+// Schedule message sent in SetSchedule and DeleteSchedule
+type MsgSchedule struct {
+	Msg      string
+	Schedule Schedule
+}
+
+// Status of a schedule.  Next is when the schedule next fires; zero if
+// never.
+type ScheduleStatus struct {
+	Schedule
+	Next time.Time
+}
+
+// Schedules message sent in ReplySchedules
+type MsgSchedules struct {
+	Msg       string
+	Schedules []ScheduleStatus
+}
+
+// Notification message sent in Notify.  Severity is one of the Severity*
+// values; the default is SeverityInfo.
+type MsgNotify struct {
+	Msg      string
+	Severity string
+	Title    string
+	Body     string
+}
+
+// Push subscription message sent in SubscribePush
+type MsgPushSubscription struct {
+	Msg          string
+	Subscription PushSubscription
+}
+
+// Update message sent in Update.  Signature is the base64-encoded ed25519
+// signature of the binary at URL (see UpdateConfig).
+type MsgUpdate struct {
+	Msg       string
+	URL       string
+	Version   string
+	Signature string
+}
+
+// Update result message sent in ReplyUpdate
+type MsgUpdateResult struct {
+	Msg     string
+	Version string
+	Err     string
+}
+
+// Fault message sent in InjectFault
+type MsgFault struct {
+	Msg   string
+	Fault Fault
+}
+
+// Faults message sent in ReplyFaults, with the faults active
+type MsgFaults struct {
+	Msg    string
+	Faults []Fault
+}
+
+// Framework error message sent in EventError, and kept for ReplyStatus.
+// Code is the Error's Code, and Err the error's text.
+type MsgError struct {
+	Msg  string
+	Code string
+	Err  string
+	Time time.Time
+}
+
+// History request message sent in GetHistory.  Type is the message type to
+// fetch.  Records are returned in time range [Since, Until], most recent
+// first.  If Until is zero, Until is now.  If Limit is zero, there is no
+// limit on the number of records returned.
+type MsgGetHistory struct {
+	Msg   string
+	Type  string
+	Since time.Time
+	Until time.Time
+	Limit uint
+}
+
+// A history record is a message and the time the message was broadcast
+type HistoryRecord struct {
+	Time time.Time
+	Msg  json.RawMessage
+}
+
+// History message returned in ReplyHistory
+type MsgHistory struct {
+	Msg     string
+	Type    string
+	Records []HistoryRecord
+}
+
+// Journal request message sent in GetJournalSince.  Records with sequence
+// numbers greater than Seq are requested.
+type MsgGetJournalSince struct {
+	Msg string
+	Seq uint64
+}
+
+// A journal record is a message broadcast by Thing, with a sequence number
+// and the time the message was broadcast
+type JournalRecord struct {
+	Seq  uint64
+	Time time.Time
+	Msg  json.RawMessage
+}
+
+// Journal message returned in ReplyJournal.  Seq is the latest sequence
+// number in the journal.  If Complete is false, some records requested were
+// trimmed from the journal and can't be replayed.
+type MsgJournal struct {
+	Msg      string
+	Seq      uint64
+	Complete bool
+	Records  []JournalRecord
+}
+
+// State patch message broadcast by BroadcastPatch.  Version increments by
+// one with each StatePatch.  If Full is true, Patch is Thing's full state.
+// Otherwise, Patch is a JSON merge patch (RFC 7386) to apply to the state of
+// the previous Version.
+//
+// A listener that misses a Version should get full state with GetState (the
+// next Version following ReplyState is always good), or wait for the next
+// Full StatePatch.  Here's how to apply a StatePatch in javascript:
+//
+//	function mergePatch(target, patch) {
+//		if (patch === null || typeof patch !== "object" || Array.isArray(patch)) {
+//			return patch
+//		}
+//		if (target === null || typeof target !== "object" || Array.isArray(target)) {
+//			target = {}
+//		}
+//		for (const key in patch) {
+//			if (patch[key] === null) {
+//				delete target[key]
+//			} else {
+//				target[key] = mergePatch(target[key], patch[key])
+//			}
+//		}
+//		return target
+//	}
+type MsgStatePatch struct {
+	Msg     string
+	Version uint64
+	Full    bool
+	Patch   json.RawMessage
+}
+
+// Audit record kinds
+const (
+	// A user authenticated, or failed to
+	AuditAuth = "auth"
+	// A command message was received, or rejected
+	AuditCommand = "command"
+)
+
+// Audit record results
+const (
+	AuditOk       = "ok"
+	AuditFailed   = "failed"
+	AuditReceived = "received"
+	AuditRejected = "rejected"
+)
+
+// An AuditRecord is an entry in Thing's audit trail.  Seq numbers records
+// in the audit trail.  Id is the Thing the record is from; on Thing Prime,
+// records forwarded from Thing keep Thing's Id.  User and Remote are who,
+// and from where, if known.  For AuditCommand records, Msg is the command
+// message.  Reason is why authentication failed, or the command was
+// rejected.
+type AuditRecord struct {
+	Seq    uint64
+	Time   time.Time
+	Id     string
+	Kind   string
+	User   string `json:",omitempty"`
+	Remote string `json:",omitempty"`
+	Msg    string `json:",omitempty"`
+	Result string
+	Reason string `json:",omitempty"`
+}
+
+// Audit request message sent in GetAudit.  Records with Seq greater than
+// Since are requested, oldest first, up to Limit records (zero is no
+// limit).  If Kind is given, only records of that Kind are returned.
+type MsgGetAudit struct {
+	Msg   string
+	Since uint64
+	Kind  string
+	Limit uint
+}
+
+// Audit response message sent in ReplyAudit
+type MsgAudit struct {
+	Msg     string
+	Records []AuditRecord
+}
+
+// Audit record message sent in EventAudit
+type MsgEventAudit struct {
+	Msg    string
+	Record AuditRecord
+}
+
+// A Thing known to Thing Prime, or to a bridge, in the registry.  Id, Model,
+// Name, Tags, and Version are as Thing last identified itself.  Notes are
+// set with SetRegistryNotes.  FirstSeen is when Thing first connected, and
+// LastSeen when Thing was last connected (now, if Online).
+type RegistryEntry struct {
+	Id        string
+	Model     string
+	Name      string
+	Tags      []string `json:",omitempty"`
+	Notes     string   `json:",omitempty"`
+	Version   string   `json:",omitempty"`
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Online    bool
+}
+
+// Registry message sent in ReplyRegistry.  Entries are sorted by Id.
+type MsgRegistry struct {
+	Msg     string
+	Entries []RegistryEntry
+}
+
+// Registry edit message sent in SetRegistryNotes and DeleteRegistry.  Notes
+// is only used by SetRegistryNotes.
+type MsgRegistryEdit struct {
+	Msg   string
+	Id    string
+	Notes string
+}
+
+// A sealed message (see E2EConfig).  Msg is the sealed message's Msg, in
+// the clear, for routing.  Time is when the message was sealed, in
+// milliseconds since the Unix epoch.  Sealed is the base64-encoded AES-GCM
+// nonce and ciphertext of the message, with the Thing's Id, Msg, and Time
+// as additional data.
+type MsgSealed struct {
+	Msg    string
+	Time   int64
+	Sealed string
 }
@@ -0,0 +1,271 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// NATS server, enough for Thing and Thing Prime
+type fakeNATS struct {
+	sync.Mutex
+	l     net.Listener
+	token string
+	// Each connection's subscriptions, subject by sid
+	subs map[net.Conn]map[string]string
+}
+
+func newFakeNATS(t *testing.T, token string) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNATS{l: l, token: token,
+		subs: make(map[net.Conn]map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) url() string {
+	return "nats://" + f.l.Addr().String()
+}
+
+func (f *fakeNATS) close() {
+	f.l.Close()
+	f.Lock()
+	for conn := range f.subs {
+		conn.Close()
+	}
+	f.Unlock()
+}
+
+func natsMatch(pattern, subject string) bool {
+	p, s := strings.Split(pattern, "."), strings.Split(subject, ".")
+	if len(p) != len(s) {
+		return false
+	}
+	for i := range p {
+		if p[i] != "*" && p[i] != s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	f.Lock()
+	f.subs[conn] = make(map[string]string)
+	f.Unlock()
+
+	defer func() {
+		f.Lock()
+		delete(f.subs, conn)
+		f.Unlock()
+		conn.Close()
+	}()
+
+	write := func(s string) {
+		f.Lock()
+		conn.Write([]byte(s))
+		f.Unlock()
+	}
+
+	write(`INFO {"server_id":"fake","max_payload":1048576}` + "\r\n")
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "CONNECT":
+			var connect struct {
+				Token string `json:"auth_token"`
+			}
+			json.Unmarshal([]byte(line[len("CONNECT "):]), &connect)
+			if connect.Token != f.token {
+				write("-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			write("PONG\r\n")
+		case "SUB":
+			f.Lock()
+			f.subs[conn][args[2]] = args[1]
+			f.Unlock()
+		case "PUB":
+			n, _ := strconv.Atoi(args[2])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			f.Lock()
+			for c, subs := range f.subs {
+				for sid, pattern := range subs {
+					if natsMatch(pattern, args[1]) {
+						fmt.Fprintf(c, "MSG %s %s %d\r\n%s", args[1],
+							sid, n, data)
+					}
+				}
+			}
+			f.Unlock()
+		}
+	}
+}
+
+// Thing, or Thing Prime, noting the messages it gets
+type dimmer struct {
+	got chan string
+}
+
+func (d *dimmer) note(p *Packet) {
+	select {
+	case d.got <- p.String():
+	default:
+	}
+}
+
+func (d *dimmer) Subscribers() Subscribers {
+	return Subscribers{
+		GetState: func(p *Packet) { p.Marshal(&Msg{Msg: ReplyState}).Reply() },
+		"Click":  d.note,
+		"Dim":    d.note,
+	}
+}
+
+func (d *dimmer) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestNATS(t *testing.T) {
+	f := newFakeNATS(t, "")
+	defer f.close()
+
+	primeDimmer := &dimmer{got: make(chan string, 1)}
+	prime := NewThing(primeDimmer)
+	prime.Cfg.IsPrime = true
+	prime.Cfg.PortPublic = 0
+	prime.Cfg.NATS.URL = f.url()
+	if err := prime.build(true); err != nil {
+		t.Fatal(err)
+	}
+	prime.nats.done = make(chan bool)
+	primed := make(chan bool)
+	go func() {
+		prime.nats.primeRun()
+		close(primed)
+	}()
+
+	thingDimmer := &dimmer{got: make(chan string, 1)}
+	thing := NewThing(thingDimmer)
+	thing.Cfg.Id = testId
+	thing.Cfg.NATS.URL = f.url()
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := thing.nats.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Broadcasts flow once Thing Prime has attached, and has Thing's state
+	expect := func(from *Thing, to *dimmer, msg string) {
+		want := `{"Msg":"` + msg + `"}`
+		for i := 0; i < 100; i++ {
+			from.bus.broadcast(newPacket(from.bus, nil, &Msg{Msg: msg}))
+			select {
+			case got := <-to.got:
+				if got != want {
+					t.Errorf("Got %s, want %s", got, want)
+				}
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		t.Fatalf("%s didn't arrive", msg)
+	}
+	expect(thing, primeDimmer, "Click")
+	expect(prime, thingDimmer, "Dim")
+
+	if prime.id != testId || prime.primeId != testId {
+		t.Errorf("Thing Prime attached to %s", prime.id)
+	}
+
+	thing.nats.stop()
+	close(prime.nats.done)
+	f.close()
+	<-primed
+}
+
+func TestNATSAuth(t *testing.T) {
+	f := newFakeNATS(t, "s3cret")
+	defer f.close()
+
+	addr := f.l.Addr().String()
+	tests := []struct {
+		cfg NATSConfig
+		ok  bool
+	}{
+		{NATSConfig{URL: "nats://" + addr}, false},
+		{NATSConfig{URL: "nats://" + addr, Token: "wrong"}, false},
+		{NATSConfig{URL: "nats://" + addr, Token: "s3cret"}, true},
+		{NATSConfig{URL: "nats://s3cret@" + addr}, true},
+	}
+
+	for i, test := range tests {
+		c, err := natsDial(test.cfg, "test", 0, 0)
+		if (err == nil) != test.ok {
+			t.Errorf("Dial %d: got %v", i, err)
+		}
+		if c != nil {
+			c.close()
+			<-c.done
+		}
+	}
+}
+
+func TestNATSBadConfig(t *testing.T) {
+	tests := []struct {
+		model string
+		cfg   NATSConfig
+	}{
+		{"lamp", NATSConfig{URL: "http://nats", Prefix: "merle"}},
+		{"lamp", NATSConfig{URL: "nats://nats"}},
+		{"lamp.v2", NATSConfig{URL: "nats://nats", Prefix: "merle"}},
+	}
+
+	for i, test := range tests {
+		thing := NewThing(&sparse{})
+		thing.Cfg.Id = testId
+		thing.Cfg.Model = test.model
+		thing.Cfg.NATS = test.cfg
+		if err := thing.build(true); ErrorCode(err) != ErrBadConfig.Code {
+			t.Errorf("Config %d: got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Networks allowed to, and denied from, the public servers (see
+// Cfg.AllowPublicNets and Cfg.DenyPublicNets)
+type netFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Parse CIDRs, or single addresses
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Bad address \"%s\"", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip,
+				Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad network \"%s\"", s)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Filter for allow and deny lists, or nil if both are empty
+func newNetFilter(allow, deny []string) (*netFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	var f netFilter
+	var err error
+
+	if f.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Denied networks are refused, even if allowed.  If there are allowed
+// networks, ip must be in one.
+func (f *netFilter) allowed(ip net.IP) bool {
+	if ip == nil || netsContain(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || netsContain(f.allow, ip)
+}
+
+// Refuse requests to next from networks not allowed, before they get
+// to authentication
+func (w *webPublic) filter(next http.Handler) http.Handler {
+	t := w.thing
+	if t.netFilter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if !t.netFilter.allowed(net.ParseIP(t.clientIP(r))) {
+			http.Error(writer, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, r)
+	})
+}
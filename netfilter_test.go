@@ -0,0 +1,112 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNetFilter(t *testing.T) {
+	f, err := newNetFilter([]string{"192.168.1.0/24", "10.0.0.1", "fd00::/8"},
+		[]string{"192.168.1.13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.7", true},
+		{"192.168.1.13", false},
+		{"192.168.2.7", false},
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"::ffff:192.168.1.7", true},
+		{"fd12::1", true},
+		{"2001:db8::1", false},
+	}
+	for _, test := range tests {
+		if got := f.allowed(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%s allowed %t, want %t", test.ip, got, test.want)
+		}
+	}
+	if f.allowed(nil) {
+		t.Error("Bad address allowed")
+	}
+
+	// Deny only
+	f, _ = newNetFilter(nil, []string{"203.0.113.0/24"})
+	if f.allowed(net.ParseIP("203.0.113.9")) || !f.allowed(net.ParseIP("8.8.8.8")) {
+		t.Error("Deny list")
+	}
+
+	if f, err := newNetFilter(nil, nil); f != nil || err != nil {
+		t.Errorf("Empty lists: %v %v", f, err)
+	}
+	for _, bad := range []string{"192.168.1.0/33", "garage", ""} {
+		if _, err := newNetFilter([]string{bad}, nil); err == nil {
+			t.Errorf("Bad network %q accepted", bad)
+		}
+	}
+}
+
+func TestPublicNets(t *testing.T) {
+	thing := NewThing(&dashboard{html: "home"})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	thing.Cfg.User = "root"
+	thing.Cfg.AllowPublicNets = []string{"192.168.1.0/24"}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(remote, forwarded string) int {
+		req := httptest.NewRequest("GET", "/"+testId, nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		thing.web.public.handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Allowed still needs credentials
+	if code := get("192.168.1.7:1234", ""); code != http.StatusUnauthorized {
+		t.Errorf("Allowed: %d", code)
+	}
+	if code := get("8.8.8.8:1234", ""); code != http.StatusForbidden {
+		t.Errorf("Not allowed: %d", code)
+	}
+
+	// Forwarded address only counts behind a trusted proxy
+	if code := get("192.168.1.1:1234", "8.8.8.8"); code != http.StatusUnauthorized {
+		t.Errorf("Untrusted proxy: %d", code)
+	}
+	thing.Cfg.TrustProxy = true
+	if code := get("192.168.1.1:1234", "8.8.8.8"); code != http.StatusForbidden {
+		t.Errorf("Trusted proxy: %d", code)
+	}
+
+	// A client can't pass for an allowed address by forging the start of
+	// X-Forwarded-For; the proxy appends the client's real address
+	if code := get("192.168.1.1:1234", "192.168.1.7, 8.8.8.8"); code != http.StatusForbidden {
+		t.Errorf("Forged X-Forwarded-For: %d", code)
+	}
+
+	bad := NewThing(&dashboard{})
+	bad.Cfg.Id = testId
+	bad.Cfg.DenyPublicNets = []string{"nowhere"}
+	if err := bad.build(true); ErrorCode(err) != ErrBadConfig.Code {
+		t.Errorf("Bad network: %v", err)
+	}
+}
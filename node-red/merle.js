@@ -0,0 +1,237 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Node-RED nodes for Merle Things.  See PROTOCOL.md for the WebSocket
+// contract.
+
+const WebSocket = require("ws")
+
+// Supported merle.ProtocolVersion
+const protocol = 1
+
+module.exports = function(RED) {
+
+	// Config node: one WebSocket to a Thing, shared by the in, out, and
+	// request nodes
+	function MerleThingNode(config) {
+		RED.nodes.createNode(this, config)
+
+		const node = this
+		node.listeners = []
+		node.closing = false
+
+		function url() {
+			const scheme = config.tls ? "wss://" : "ws://"
+			if (config.thingId) {
+				return scheme + config.addr + "/ws/" + config.thingId
+			}
+			return "ws://" + config.addr + "/ws?monitor"
+		}
+
+		function headers() {
+			const creds = node.credentials || {}
+			if (creds.token) {
+				return {Authorization: "Bearer " + creds.token}
+			}
+			if (creds.user) {
+				const auth = Buffer.from(creds.user + ":" + (creds.passwd || ""))
+				return {Authorization: "Basic " + auth.toString("base64")}
+			}
+			return {}
+		}
+
+		function status(fill, text) {
+			node.listeners.forEach(l => l.status({fill: fill, shape: "dot", text: text}))
+		}
+
+		function connect() {
+			const ws = new WebSocket(url(), {headers: headers()})
+			node.ws = ws
+
+			ws.on("open", function() {
+				status("green", "connected")
+				node.sendMsg({Msg: "_GetIdentity"})
+				node.sendMsg({Msg: "_GetState"})
+			})
+
+			ws.on("message", function(data) {
+				let msg
+				try {
+					msg = JSON.parse(data)
+				} catch (e) {
+					node.warn("Bad message from Thing: " + data)
+					return
+				}
+				if (msg.Msg === "_ReplyIdentity" && msg.Protocol > protocol) {
+					node.warn("Thing protocol " + msg.Protocol +
+						" is newer than " + protocol)
+				}
+				node.listeners.forEach(l => l.fromThing(msg))
+			})
+
+			ws.on("error", function(err) {
+				status("red", err.message)
+			})
+
+			ws.on("close", function() {
+				node.ws = null
+				if (!node.closing) {
+					status("yellow", "reconnecting")
+					node.timer = setTimeout(connect, 5000)
+				}
+			})
+		}
+
+		node.sendMsg = function(msg) {
+			if (!node.ws || node.ws.readyState !== WebSocket.OPEN) {
+				return false
+			}
+			node.ws.send(JSON.stringify(msg))
+			return true
+		}
+
+		node.register = function(listener) {
+			node.listeners.push(listener)
+			if (node.listeners.length === 1) {
+				connect()
+			}
+		}
+
+		node.deregister = function(listener) {
+			node.listeners = node.listeners.filter(l => l !== listener)
+		}
+
+		node.on("close", function(done) {
+			node.closing = true
+			clearTimeout(node.timer)
+			if (node.ws) {
+				node.ws.close()
+			}
+			done()
+		})
+	}
+
+	RED.nodes.registerType("merle thing", MerleThingNode, {
+		credentials: {
+			user: {type: "text"},
+			passwd: {type: "password"},
+			token: {type: "password"},
+		}
+	})
+
+	// Output messages from Thing, optionally filtered by type
+	function MerleInNode(config) {
+		RED.nodes.createNode(this, config)
+
+		const node = this
+		const thing = RED.nodes.getNode(config.thing)
+		const types = (config.msgs || "").split(",").map(s => s.trim()).filter(s => s)
+
+		node.fromThing = function(msg) {
+			if (types.length > 0 && !types.includes(msg.Msg)) {
+				return
+			}
+			node.send({topic: msg.Msg, payload: msg})
+		}
+
+		if (thing) {
+			thing.register(node)
+			node.on("close", () => thing.deregister(node))
+		}
+	}
+
+	RED.nodes.registerType("merle in", MerleInNode)
+
+	function checkPayload(node, msg) {
+		if (typeof msg.payload !== "object" || typeof msg.payload.Msg !== "string") {
+			node.error("payload must be an object with a Msg member", msg)
+			return false
+		}
+		return true
+	}
+
+	// Send msg.payload to Thing
+	function MerleOutNode(config) {
+		RED.nodes.createNode(this, config)
+
+		const node = this
+		const thing = RED.nodes.getNode(config.thing)
+
+		node.fromThing = function() {}
+
+		node.on("input", function(msg) {
+			if (!checkPayload(node, msg)) {
+				return
+			}
+			if (!thing || !thing.sendMsg(msg.payload)) {
+				node.error("not connected to Thing", msg)
+			}
+		})
+
+		if (thing) {
+			thing.register(node)
+			node.on("close", () => thing.deregister(node))
+		}
+	}
+
+	RED.nodes.registerType("merle out", MerleOutNode)
+
+	// Send msg.payload to Thing and output the reply.  The reply to
+	// "_GetX" or "GetX" is "_ReplyX" or "ReplyX", unless msg.reply names
+	// the reply type.
+	function MerleRequestNode(config) {
+		RED.nodes.createNode(this, config)
+
+		const node = this
+		const thing = RED.nodes.getNode(config.thing)
+		const timeout = (parseFloat(config.timeout) || 5) * 1000
+		let pending = []
+
+		function replyType(msg) {
+			if (msg.reply) {
+				return msg.reply
+			}
+			return msg.payload.Msg.replace(/^(_?)Get/, "$1Reply")
+		}
+
+		node.fromThing = function(reply) {
+			const i = pending.findIndex(p => p.reply === reply.Msg)
+			if (i < 0) {
+				return
+			}
+			const p = pending.splice(i, 1)[0]
+			clearTimeout(p.timer)
+			p.msg.payload = reply
+			p.msg.topic = reply.Msg
+			node.send(p.msg)
+		}
+
+		node.on("input", function(msg) {
+			if (!checkPayload(node, msg)) {
+				return
+			}
+			const p = {reply: replyType(msg), msg: msg}
+			p.timer = setTimeout(function() {
+				pending = pending.filter(q => q !== p)
+				node.error("no " + p.reply + " reply", msg)
+			}, timeout)
+			pending.push(p)
+			if (!thing || !thing.sendMsg(msg.payload)) {
+				clearTimeout(p.timer)
+				pending = pending.filter(q => q !== p)
+				node.error("not connected to Thing", msg)
+			}
+		})
+
+		if (thing) {
+			thing.register(node)
+			node.on("close", function() {
+				pending.forEach(p => clearTimeout(p.timer))
+				thing.deregister(node)
+			})
+		}
+	}
+
+	RED.nodes.registerType("merle request", MerleRequestNode)
+}
@@ -0,0 +1,14 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo && nopam
+// +build !tinygo,nopam
+
+package merle
+
+// Built without PAM (-tags nopam), e.g. for a container image without
+// libpam.  Users log in with API tokens, or passwords kept in Cfg.AuthFile.
+func (w *webPublic) pamValidate(user, passwd string) (bool, error) {
+	return false, errNoPAM
+}
@@ -0,0 +1,453 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifications configuration.  Thing sends a notification, by email, SMS,
+// and Web Push, for each Notify message it broadcasts:
+//
+//	msg := merle.MsgNotify{Msg: merle.Notify, Severity: merle.SeverityWarning,
+//		Title: "Freezer", Body: "Temperature above -10C"}
+//	p.Marshal(&msg).Broadcast()
+//
+// Notifications below MinSeverity are skipped, as are all but critical
+// notifications in quiet hours.  Beyond RateLimit, notifications are
+// dropped, so a flapping sensor can't flood a phone.  Each backend is
+// enabled by its config.
+type NotificationsConfig struct {
+
+	// Least severity notified: "info", "warning", or "critical".  The
+	// default is "info".
+	MinSeverity string
+
+	// Notifications per hour, with bursts up to RateLimit.  The default
+	// is 20.  Zero is no limit.
+	RateLimit uint
+
+	// Quiet hours, in Thing's local time, "HH:MM", e.g. "22:00" to
+	// "07:00".  The default is "" (no quiet hours).
+	QuietStart string
+	QuietEnd   string
+
+	// Email, with SMTP.  See SMTPConfig.
+	SMTP SMTPConfig
+
+	// SMS, with Twilio.  See TwilioConfig.
+	Twilio TwilioConfig
+
+	// Web Push, to browsers.  See WebPushConfig.
+	WebPush WebPushConfig
+}
+
+// SMTP configuration.  Email is disabled if Host is empty.
+type SMTPConfig struct {
+	Host string
+	// The default is 587
+	Port uint
+	// [Optional] PLAIN authentication.  The default is "" (none).
+	User     string
+	Password string
+	From     string
+	To       []string
+}
+
+// Twilio configuration.  SMS is disabled if AccountSID is empty.
+type TwilioConfig struct {
+	AccountSID string
+	AuthToken  string
+	// Twilio phone number to send from, e.g. "+15017122661"
+	From string
+	To   []string
+	// [Optional] API URL.  The default is "https://api.twilio.com".
+	URL string
+}
+
+// Web Push configuration.  Web Push is disabled if PrivateKey is empty.
+// Browsers subscribe with their PushSubscription, in a SubscribePush
+// message, using the VAPID public key for PrivateKey as the
+// applicationServerKey.  Generate a VAPID key pair with, e.g.:
+//
+//	npx web-push generate-vapid-keys
+type WebPushConfig struct {
+	// VAPID private key, base64url
+	PrivateKey string
+	// Contact for the push service, e.g. "mailto:admin@example.com"
+	Subject string
+	// [Optional] Subscriptions.  The default is nil.
+	Subscriptions []PushSubscription
+	// [Optional] File to save subscriptions from SubscribePush.  The
+	// default is "" (subscriptions are lost when Thing stops).
+	SubscriptionsFile string
+}
+
+var severities = map[string]int{
+	SeverityInfo:     0,
+	SeverityWarning:  1,
+	SeverityCritical: 2,
+}
+
+type notifications struct {
+	thing *Thing
+	cfg   NotificationsConfig
+	sync.Mutex
+	minSeverity int
+	// Quiet hours, in minutes after midnight; start == end is none
+	quietStart, quietEnd int
+	tokens               float64
+	last                 time.Time
+	http                 *http.Client
+	vapid                *ecdsa.PrivateKey
+	subs                 []PushSubscription
+	store                Store
+	queue                chan MsgNotify
+	done                 chan bool
+}
+
+// Minutes after midnight for "HH:MM"
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Bad time \"%s\"; want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func newNotifications(thing *Thing, cfg NotificationsConfig) (*notifications, error) {
+	n := &notifications{
+		thing:  thing,
+		cfg:    cfg,
+		tokens: float64(cfg.RateLimit),
+		last:   time.Now(),
+		http:   &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan MsgNotify, notifyQueueLen),
+		done:   make(chan bool),
+	}
+
+	severity := cfg.MinSeverity
+	if severity == "" {
+		severity = SeverityInfo
+	}
+	var ok bool
+	if n.minSeverity, ok = severities[severity]; !ok {
+		return nil, fmt.Errorf("Unknown MinSeverity \"%s\"", cfg.MinSeverity)
+	}
+
+	if cfg.QuietStart != "" || cfg.QuietEnd != "" {
+		var err error
+		if n.quietStart, err = parseClock(cfg.QuietStart); err != nil {
+			return nil, fmt.Errorf("QuietStart: %s", err)
+		}
+		if n.quietEnd, err = parseClock(cfg.QuietEnd); err != nil {
+			return nil, fmt.Errorf("QuietEnd: %s", err)
+		}
+	}
+
+	if cfg.WebPush.PrivateKey != "" {
+		var err error
+		if n.vapid, err = vapidKey(cfg.WebPush.PrivateKey); err != nil {
+			return nil, err
+		}
+		n.subs = append(n.subs, cfg.WebPush.Subscriptions...)
+		if cfg.WebPush.SubscriptionsFile != "" {
+			n.store = NewFileStore(cfg.WebPush.SubscriptionsFile)
+			var saved []PushSubscription
+			if err := n.store.Load(&saved); err != nil {
+				return nil, err
+			}
+			for _, sub := range saved {
+				n.subscribe(sub)
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// In quiet hours at now
+func (n *notifications) quiet(now time.Time) bool {
+	if n.quietStart == n.quietEnd {
+		return false
+	}
+	min := now.Hour()*60 + now.Minute()
+	if n.quietStart < n.quietEnd {
+		return min >= n.quietStart && min < n.quietEnd
+	}
+	// Over midnight
+	return min >= n.quietStart || min < n.quietEnd
+}
+
+// Take a token for a notification at now, if under the rate limit.  Call
+// with lock held.
+func (n *notifications) take(now time.Time) bool {
+	if n.cfg.RateLimit == 0 {
+		return true
+	}
+	limit := float64(n.cfg.RateLimit)
+	if now.After(n.last) {
+		n.tokens += now.Sub(n.last).Hours() * limit
+		if n.tokens > limit {
+			n.tokens = limit
+		}
+		n.last = now
+	}
+	if n.tokens < 1 {
+		return false
+	}
+	n.tokens--
+	return true
+}
+
+// Whether to send msg at now
+func (n *notifications) allow(msg *MsgNotify, now time.Time) bool {
+	severity, ok := severities[msg.Severity]
+	if !ok {
+		severity = severities[SeverityInfo]
+	}
+	if severity < n.minSeverity {
+		return false
+	}
+	if severity < severities[SeverityCritical] && n.quiet(now) {
+		n.thing.log.printf("Notification in quiet hours: %s", msg.Title)
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if !n.take(now) {
+		n.thing.log.printf("Notification over rate limit: %s", msg.Title)
+		return false
+	}
+	return true
+}
+
+// Bus tap to send Notify messages
+func (n *notifications) tap(p *Packet) {
+	var msg MsgNotify
+
+	p.Unmarshal(&msg)
+	if msg.Msg != Notify || !n.allow(&msg, time.Now()) {
+		return
+	}
+
+	select {
+	case n.queue <- msg:
+	default:
+		n.thing.log.printf("Notifications backed up; dropped %s", msg.Title)
+	}
+}
+
+// One line, for email headers
+var oneLine = strings.NewReplacer("\r", " ", "\n", " ")
+
+func (n *notifications) subject(msg *MsgNotify) string {
+	subject := n.thing.name + ": " + oneLine.Replace(msg.Title)
+	if msg.Severity != "" && msg.Severity != SeverityInfo {
+		subject = "[" + strings.ToUpper(msg.Severity) + "] " + subject
+	}
+	return subject
+}
+
+func (n *notifications) email(msg *MsgNotify) error {
+	cfg := n.cfg.SMTP
+
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := cfg.Host + ":" + strconv.Itoa(int(port))
+
+	var auth smtp.Auth
+	if cfg.User != "" {
+		auth = smtp.PlainAuth("", cfg.User, cfg.Password, cfg.Host)
+	}
+
+	body := "From: " + cfg.From + "\r\n" +
+		"To: " + strings.Join(cfg.To, ", ") + "\r\n" +
+		"Subject: " + n.subject(msg) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + msg.Body + "\r\n"
+
+	return smtp.SendMail(addr, auth, cfg.From, cfg.To, []byte(body))
+}
+
+func (n *notifications) sms(msg *MsgNotify) error {
+	cfg := n.cfg.Twilio
+
+	base := cfg.URL
+	if base == "" {
+		base = "https://api.twilio.com"
+	}
+	api := base + "/2010-04-01/Accounts/" + cfg.AccountSID + "/Messages.json"
+
+	text := n.subject(msg)
+	if msg.Body != "" {
+		text += "\n" + msg.Body
+	}
+
+	for _, to := range cfg.To {
+		form := url.Values{"From": {cfg.From}, "To": {to}, "Body": {text}}
+		req, err := http.NewRequest("POST", api, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(cfg.AccountSID, cfg.AuthToken)
+
+		resp, err := n.http.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("Twilio, to %s: %s", to, resp.Status)
+		}
+	}
+
+	return nil
+}
+
+func (n *notifications) push(msg *MsgNotify) error {
+	payload, _ := jsonMarshal(map[string]string{
+		"title":    n.subject(msg),
+		"body":     msg.Body,
+		"severity": msg.Severity,
+	})
+
+	n.Lock()
+	subs := append([]PushSubscription(nil), n.subs...)
+	n.Unlock()
+
+	var firstErr error
+	for i := range subs {
+		gone, err := webPush(n.http, n.vapid, n.cfg.WebPush.Subject,
+			&subs[i], payload)
+		if gone {
+			n.unsubscribe(subs[i].Endpoint)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Web Push: %s", err)
+		}
+	}
+	return firstErr
+}
+
+// Send msg on each backend configured
+func (n *notifications) send(msg *MsgNotify) {
+	n.thing.log.printf("Notify [%s]: %s", msg.Severity, msg.Title)
+
+	var errs []string
+	if n.cfg.SMTP.Host != "" {
+		if err := n.email(msg); err != nil {
+			errs = append(errs, "SMTP: "+err.Error())
+		}
+	}
+	if n.cfg.Twilio.AccountSID != "" {
+		if err := n.sms(msg); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if n.vapid != nil {
+		if err := n.push(msg); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		n.thing.raise(newError(ErrNotify,
+			fmt.Errorf("%s", strings.Join(errs, "; "))))
+	}
+}
+
+// Add or replace sub, by Endpoint.  Call with lock held.
+func (n *notifications) subscribe(sub PushSubscription) {
+	for i := range n.subs {
+		if n.subs[i].Endpoint == sub.Endpoint {
+			n.subs[i] = sub
+			return
+		}
+	}
+	n.subs = append(n.subs, sub)
+}
+
+func (n *notifications) unsubscribe(endpoint string) {
+	n.Lock()
+	defer n.Unlock()
+	for i := range n.subs {
+		if n.subs[i].Endpoint == endpoint {
+			n.subs = append(n.subs[:i], n.subs[i+1:]...)
+			n.save()
+			return
+		}
+	}
+}
+
+// Call with lock held
+func (n *notifications) save() {
+	if n.store == nil {
+		return
+	}
+	if err := n.store.Save(n.subs); err != nil {
+		n.thing.log.println("Saving push subscriptions failed:", err)
+	}
+}
+
+func (n *notifications) start() {
+	go func() {
+		for {
+			select {
+			case <-n.done:
+				return
+			case msg := <-n.queue:
+				n.send(&msg)
+			}
+		}
+	}()
+}
+
+func (n *notifications) stop() {
+	n.done <- true
+}
+
+// Subscriber handler for SubscribePush
+func (t *Thing) subscribePush(p *Packet) {
+	var msg MsgPushSubscription
+	n := t.notifs
+
+	p.Unmarshal(&msg)
+
+	if n.vapid == nil {
+		t.log.println("Ignoring push subscription; Web Push not configured")
+		return
+	}
+	if msg.Subscription.Endpoint == "" {
+		t.log.println("Ignoring push subscription; missing Endpoint")
+		return
+	}
+
+	n.Lock()
+	n.subscribe(msg.Subscription)
+	n.save()
+	n.Unlock()
+
+	t.log.printf("Push subscription [%s]", p.Src())
+}
@@ -0,0 +1,261 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+func testNotifications(t *testing.T, cfg NotificationsConfig) *notifications {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Name = "freezer"
+	thing.Cfg.Notifications = cfg
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+	// Clock starts before the tests' times
+	thing.notifs.last = time.Time{}
+	return thing.notifs
+}
+
+func TestNotifyAllow(t *testing.T) {
+	n := testNotifications(t, NotificationsConfig{
+		MinSeverity: SeverityWarning,
+		RateLimit:   2,
+		QuietStart:  "22:00",
+		QuietEnd:    "07:00",
+		SMTP:        SMTPConfig{Host: "localhost"},
+	})
+
+	day := time.Date(2022, 7, 27, 12, 0, 0, 0, time.Local)
+	night := time.Date(2022, 7, 27, 23, 30, 0, 0, time.Local)
+
+	info := &MsgNotify{Severity: SeverityInfo}
+	warning := &MsgNotify{Severity: SeverityWarning}
+	critical := &MsgNotify{Severity: SeverityCritical}
+
+	if n.allow(info, day) {
+		t.Errorf("Info allowed below MinSeverity")
+	}
+	if n.allow(warning, night) {
+		t.Errorf("Warning allowed in quiet hours")
+	}
+	if !n.allow(critical, night) || !n.allow(warning, night.Add(8*time.Hour)) {
+		t.Errorf("Allowed notifications refused")
+	}
+	// A burst of RateLimit, then refused
+	morning := night.Add(8 * time.Hour)
+	if !n.allow(critical, morning) || n.allow(critical, morning) {
+		t.Errorf("Burst not limited to RateLimit")
+	}
+	if !n.allow(critical, night.Add(9*time.Hour)) {
+		t.Errorf("Rate limit didn't refill")
+	}
+
+	if _, err := newNotifications(n.thing, NotificationsConfig{
+		QuietStart: "10pm"}); err == nil {
+		t.Errorf("Bad QuietStart accepted")
+	}
+}
+
+func TestNotifySMS(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.URL.Path != "/2010-04-01/Accounts/AC1/Messages.json" ||
+			user != "AC1" || pass != "tok" {
+			t.Errorf("Request %s, auth %s:%s", r.URL.Path, user, pass)
+		}
+		r.ParseForm()
+		got = append(got, r.Form.Get("To")+" "+r.Form.Get("Body"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	n := testNotifications(t, NotificationsConfig{
+		Twilio: TwilioConfig{AccountSID: "AC1", AuthToken: "tok",
+			From: "+1000", To: []string{"+1555", "+1666"}, URL: srv.URL},
+	})
+
+	msg := MsgNotify{Severity: SeverityCritical, Title: "Warm", Body: "-2C"}
+	if err := n.sms(&msg); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"+1555 [CRITICAL] freezer: Warm\n-2C",
+		"+1666 [CRITICAL] freezer: Warm\n-2C"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("SMS %q, want %q", got, want)
+	}
+}
+
+// Minimal SMTP server, returning the message data received
+func fakeSMTP(t *testing.T) (addr string, data chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = make(chan string, 1)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "220 fake\r\n")
+		var body strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				data <- body.String()
+				io.WriteString(conn, "250 ok\r\n")
+			case inData:
+				body.WriteString(line)
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				io.WriteString(conn, "354 go\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				io.WriteString(conn, "221 bye\r\n")
+				return
+			default:
+				io.WriteString(conn, "250 ok\r\n")
+			}
+		}
+	}()
+
+	return l.Addr().String(), data
+}
+
+func TestNotifyEmail(t *testing.T) {
+	addr, data := fakeSMTP(t)
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := net.LookupPort("tcp", port)
+
+	n := testNotifications(t, NotificationsConfig{
+		SMTP: SMTPConfig{Host: host, Port: uint(p), From: "thing@example.com",
+			To: []string{"me@example.com"}},
+	})
+
+	msg := MsgNotify{Severity: SeverityWarning, Title: "Warm\r\nBcc: x", Body: "-8C"}
+	if err := n.email(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	body := <-data
+	if !strings.Contains(body, "Subject: [WARNING] freezer: Warm  Bcc: x\r\n") ||
+		!strings.Contains(body, "\r\n\r\n-8C") {
+		t.Errorf("Email %q", body)
+	}
+}
+
+func TestWebPush(t *testing.T) {
+	curve := elliptic.P256()
+
+	// VAPID key, and the browser's subscription keys
+	vapid, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	uaPrivate, uaX, uaY, _ := elliptic.GenerateKey(curve, rand.Reader)
+	auth := make([]byte, 16)
+	rand.Read(auth)
+
+	var payload []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		// Check the VAPID JWT signature
+		jwt := strings.TrimPrefix(strings.Split(r.Header.Get("Authorization"), ",")[0], "vapid t=")
+		parts := strings.Split(jwt, ".")
+		sig, _ := b64Decode(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(sig) != 64 || !ecdsa.Verify(&vapid.PublicKey, hash[:],
+			new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			t.Errorf("Bad VAPID signature")
+		}
+
+		// Decrypt, as the browser would
+		body, _ := ioutil.ReadAll(r.Body)
+		salt, keyLen := body[:16], int(body[20])
+		if binary.BigEndian.Uint32(body[16:20]) != 4096 || keyLen != 65 {
+			t.Fatalf("Bad header")
+		}
+		asPublic := body[21 : 21+keyLen]
+		asX, asY := elliptic.Unmarshal(curve, asPublic)
+		sx, _ := curve.ScalarMult(asX, asY, uaPrivate)
+		secret := make([]byte, 32)
+		sx.FillBytes(secret)
+		uaPublic := elliptic.Marshal(curve, uaX, uaY)
+
+		read := func(r io.Reader, n int) []byte {
+			out := make([]byte, n)
+			io.ReadFull(r, out)
+			return out
+		}
+		info := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+		ikm := read(hkdf.New(sha256.New, secret, auth, info), 32)
+		cek := read(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), 16)
+		nonce := read(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), 12)
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		plain, err := gcm.Open(nil, nonce, body[21+keyLen:], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = plain[:len(plain)-1]
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	d := make([]byte, 32)
+	vapid.D.FillBytes(d)
+	n := testNotifications(t, NotificationsConfig{
+		WebPush: WebPushConfig{PrivateKey: b64.EncodeToString(d),
+			Subject: "mailto:me@example.com"},
+	})
+
+	// Browser subscribes
+	sub := MsgPushSubscription{Msg: SubscribePush}
+	sub.Subscription.Endpoint = srv.URL + "/push/1"
+	sub.Subscription.Keys.P256dh = b64.EncodeToString(elliptic.Marshal(curve, uaX, uaY))
+	sub.Subscription.Keys.Auth = b64.EncodeToString(auth)
+	n.thing.bus.receive(newPacket(n.thing.bus, &recordSocket{}, &sub))
+
+	msg := MsgNotify{Severity: SeverityInfo, Title: "Defrosted", Body: "0C"}
+	if err := n.push(&msg); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"body":"0C","severity":"info","title":"freezer: Defrosted"}`
+	if string(payload) != want {
+		t.Errorf("Payload %s, want %s", payload, want)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// Webhook configuration.  Thing POSTs the messages it broadcasts to the
+// webhook's URL, e.g. to ping Slack or Home Assistant on an Alert, without
+// HTTP code in the Thinger.
+//
+// The body is the message's JSON, or, with a Template, the template
+// executed with:
+//
+//	.Id, .Model, .Name	Thing's identity
+//	.Time			when the message was broadcast
+//	.Msg			the message, e.g. .Msg.Msg, .Msg.Temp
+//
+// The template func json formats a value as JSON, quoting and escaping
+// strings.  For Slack:
+//
+//	{"text": {{json (printf "%s: %v" .Name .Msg.Text)}}}
+//
+// With a Secret, the body is signed with HMAC-SHA256, in header:
+//
+//	X-Merle-Signature: sha256=<hex digest>
+type WebhookConfig struct {
+
+	// URL to POST to
+	URL string
+
+	// Messages to POST.  If empty, all broadcast messages are POSTed.
+	// The default is nil.
+	Msgs []string
+
+	// [Optional] text/template for the body.  The default is "" (the
+	// message's JSON).
+	Template string
+
+	// [Optional] Content-Type of the body.  The default is
+	// "application/json".
+	ContentType string
+
+	// [Optional] Key to sign the body with.  The default is "" (not
+	// signed).
+	Secret string
+
+	// [Optional] Tries after the first, with backoff doubling from a
+	// second, if the POST fails or the response isn't 2xx.  The default is
+	// 0 (no retries).
+	Retries uint
+
+	// [Optional] Timeout, in seconds, for each try.  The default is 0
+	// (10 seconds).
+	Timeout uint
+}
+
+// X-Merle-Signature of body, signed with secret
+func webhookSign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Messages queued for a webhook, beyond which messages are dropped, so a
+// down endpoint doesn't eat memory
+const notifyQueueLen = 100
+
+type notifyMsg struct {
+	Id    string
+	Model string
+	Name  string
+	Time  time.Time
+	Msg   map[string]interface{}
+	raw   []byte
+}
+
+type notifier struct {
+	thing  *Thing
+	cfg    WebhookConfig
+	msgs   map[string]bool
+	templ  *template.Template
+	client *http.Client
+	queue  chan *notifyMsg
+	done   chan bool
+}
+
+type notifiers []*notifier
+
+func newNotifiers(thing *Thing, cfgs []WebhookConfig) (notifiers, error) {
+	var ns notifiers
+
+	for _, cfg := range cfgs {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("Webhook missing URL")
+		}
+
+		n := &notifier{
+			thing: thing,
+			cfg:   cfg,
+			queue: make(chan *notifyMsg, notifyQueueLen),
+		}
+
+		if len(cfg.Msgs) > 0 {
+			n.msgs = make(map[string]bool)
+			for _, msg := range cfg.Msgs {
+				n.msgs[msg] = true
+			}
+		}
+
+		if cfg.Template != "" {
+			templ, err := template.New(cfg.URL).Funcs(template.FuncMap{
+				"json": func(v interface{}) (string, error) {
+					data, err := jsonMarshal(v)
+					return string(data), err
+				},
+			}).Parse(cfg.Template)
+			if err != nil {
+				return nil, fmt.Errorf("Webhook %s template: %s",
+					cfg.URL, err)
+			}
+			n.templ = templ
+		}
+
+		timeout := time.Duration(cfg.Timeout) * time.Second
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		n.client = &http.Client{Timeout: timeout}
+
+		ns = append(ns, n)
+	}
+
+	return ns, nil
+}
+
+// Bus tap to queue broadcast messages for the webhooks
+func (ns notifiers) tap(p *Packet) {
+	var msg Msg
+
+	p.Unmarshal(&msg)
+
+	for _, n := range ns {
+		if n.msgs != nil && !n.msgs[msg.Msg] {
+			continue
+		}
+
+		m := &notifyMsg{
+			Id:    n.thing.id,
+			Model: n.thing.model,
+			Name:  n.thing.name,
+			Time:  time.Now(),
+			raw:   append([]byte(nil), p.msg...),
+		}
+
+		select {
+		case n.queue <- m:
+		default:
+			n.thing.log.printf("Webhook %s backed up; dropped %.80s",
+				n.cfg.URL, p.String())
+		}
+	}
+}
+
+func (ns notifiers) start() {
+	for _, n := range ns {
+		n.done = make(chan bool)
+		go n.run()
+	}
+}
+
+func (ns notifiers) stop() {
+	for _, n := range ns {
+		close(n.done)
+	}
+}
+
+func (n *notifier) run() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case m := <-n.queue:
+			if err := n.deliver(m); err != nil {
+				n.thing.raise(newError(ErrWebhook, err))
+			}
+		}
+	}
+}
+
+// Body for m
+func (n *notifier) body(m *notifyMsg) ([]byte, error) {
+	if n.templ == nil {
+		return m.raw, nil
+	}
+
+	if err := json.Unmarshal(m.raw, &m.Msg); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := n.templ.Execute(&buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// POST m, retrying with backoff on failure
+func (n *notifier) deliver(m *notifyMsg) error {
+	body, err := n.body(m)
+	if err != nil {
+		return fmt.Errorf("%s: %s", n.cfg.URL, err)
+	}
+
+	backoff := time.Second
+	for try := uint(0); ; try++ {
+		err = n.post(body)
+		if err == nil || try == n.cfg.Retries {
+			return err
+		}
+		select {
+		case <-n.done:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *notifier) post(body []byte) error {
+	req, err := http.NewRequest("POST", n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	ct := n.cfg.ContentType
+	if ct == "" {
+		ct = "application/json"
+	}
+	req.Header.Set("Content-Type", ct)
+
+	if n.cfg.Secret != "" {
+		req.Header.Set("X-Merle-Signature", webhookSign(n.cfg.Secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", n.cfg.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type alert struct {
+	Msg  string
+	Text string
+}
+
+func TestWebhooks(t *testing.T) {
+	tries := 0
+	bodies := make(chan string, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("shh"))
+		mac.Write(body)
+		sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if r.Header.Get("X-Merle-Signature") != sig {
+			t.Errorf("Bad signature %q", r.Header.Get("X-Merle-Signature"))
+		}
+		// Fail the first try, to retry
+		if tries++; tries == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		bodies <- string(body)
+	}))
+	defer srv.Close()
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Name = "garage"
+	thing.Cfg.Webhooks = []WebhookConfig{{
+		URL:      srv.URL,
+		Msgs:     []string{"Alert"},
+		Template: `{"text":{{json (printf "%s: %s" .Name .Msg.Text)}}}`,
+		Secret:   "shh",
+		Retries:  1,
+	}}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	thing.notifiers.start()
+	defer thing.notifiers.stop()
+
+	thing.notifiers.tap(newPacket(thing.bus, nil, &Msg{Msg: "Other"}))
+	thing.notifiers.tap(newPacket(thing.bus, nil,
+		&alert{Msg: "Alert", Text: `door "open"`}))
+
+	select {
+	case body := <-bodies:
+		want := `{"text":"garage: door \"open\""}`
+		if body != want {
+			t.Errorf("Body %s, want %s", body, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not delivered")
+	}
+
+	if tries != 2 {
+		t.Errorf("Tries %d, want 2", tries)
+	}
+}
+
+func TestWebhookBadTemplate(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Webhooks = []WebhookConfig{{URL: "http://x", Template: "{{"}}
+	if err := thing.build(true); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("Build error %v, want %v", err, ErrBadConfig)
+	}
+}
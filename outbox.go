@@ -0,0 +1,269 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// An outbox entry is a queued message.  In the file, an entry queued ahead of
+// the others is marked First.
+type outboxEntry struct {
+	Msg   json.RawMessage
+	First bool `json:",omitempty"`
+	// Unique in the outbox, to match replayed entries on ack
+	seq uint64
+}
+
+// Outbox is a bounded, file-backed queue of messages broadcast while mother
+// isn't connected.  Queued messages are replayed, in order, to mother on
+// reconnect, and stay queued until mother acks the resync (see bus.resync).
+// If the connection drops before the ack, they're replayed again, so mother
+// gets each message at least once.
+//
+// A message the same as the message queued just before it isn't queued
+// again, so repeated identical updates don't fill the outbox.  Otherwise,
+// messages are replayed as they were sent: A, B, A is replayed as A, B, A.
+//
+// The file is a log, one entry per line.  Queuing a message appends it to the
+// file.  The file is rewritten when entries are dropped after a resync, or
+// once it's grown to twice the entries queued.
+type outbox struct {
+	thing *Thing
+	sync.Mutex
+	file    string
+	max     uint
+	entries []outboxEntry
+	// Last entry seq
+	seq uint64
+	// Entries in the file, including those since dropped
+	logged int
+	// Entries replayed in resync sentSeq, awaiting mother's ack
+	sent    map[uint64]bool
+	sentSeq uint64
+}
+
+func newOutbox(thing *Thing, file string, max uint) *outbox {
+	return &outbox{
+		thing: thing,
+		file:  file,
+		max:   max,
+	}
+}
+
+// Load outbox from file.  A missing file is an empty outbox.  An entry cut
+// short by a crash mid-append, and anything after it, is dropped.
+func (o *outbox) load() error {
+	o.Lock()
+	defer o.Unlock()
+
+	f, err := os.Open(o.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(f)
+	for {
+		var e outboxEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			o.thing.log.println("Outbox load error; dropping the rest:", err)
+			break
+		}
+		o.add(e)
+	}
+	f.Close()
+
+	return o.save()
+}
+
+// Save outbox to file.  Write to a temp file first and then rename so a crash
+// mid-write doesn't lose the outbox.
+func (o *outbox) save() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range o.entries {
+		e.First = false
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+
+	tmp := o.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	o.logged = len(o.entries)
+	return os.Rename(tmp, o.file)
+}
+
+// Append entry e to file
+func (o *outbox) append(e outboxEntry) error {
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(o.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	o.logged++
+	return err
+}
+
+// Queue the Packet's message.  If the outbox is full, the oldest message is
+// dropped.
+func (o *outbox) enqueue(p *Packet) {
+	o.queue(p, false)
+}
+
+// Queue the Packet's message ahead of the other messages, to be replayed
+// first
+func (o *outbox) enqueueFirst(p *Packet) {
+	o.queue(p, true)
+}
+
+func (o *outbox) queue(p *Packet, first bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	msg := make(json.RawMessage, len(p.msg))
+	copy(msg, p.msg)
+	entry := outboxEntry{Msg: msg, First: first}
+	if !o.add(entry) {
+		return
+	}
+
+	var err error
+	if o.logged >= 2*len(o.entries) {
+		err = o.save()
+	} else {
+		err = o.append(entry)
+	}
+	if err != nil {
+		o.thing.log.println("Outbox save error:", err)
+	}
+}
+
+// Add entry e, at the front if e.First, unless it's the same as its
+// neighbour.  If the outbox is full, the oldest entry is dropped.  Returns
+// false if e wasn't added.
+func (o *outbox) add(e outboxEntry) bool {
+	if n := len(o.entries); n > 0 {
+		next := o.entries[n-1]
+		if e.First {
+			next = o.entries[0]
+		}
+		// A replayed entry may be acked, and dropped, so a repeat of it
+		// is kept
+		if !o.sent[next.seq] && bytes.Equal(next.Msg, e.Msg) {
+			return false
+		}
+	}
+
+	if o.max > 0 && uint(len(o.entries)) >= o.max {
+		o.thing.log.printf("Outbox full; dropping: %.80s", o.entries[0].Msg)
+		o.entries = o.entries[1:]
+	}
+
+	o.seq++
+	e.seq = o.seq
+	if e.First {
+		o.entries = append([]outboxEntry{e}, o.entries...)
+	} else {
+		o.entries = append(o.entries, e)
+	}
+
+	return true
+}
+
+// Replay the outbox, in order, on the socket, for resync seq.  Replayed
+// entries stay queued until ack(seq).  StatePatch entries are dropped rather
+// than replayed: the state snapshot sent on resync supersedes them.  The
+// number of entries replayed is returned.
+func (o *outbox) replay(sock socketer, seq uint64) uint {
+	o.Lock()
+	defer o.Unlock()
+
+	var entries []outboxEntry
+	for _, e := range o.entries {
+		var msg Msg
+		json.Unmarshal(e.Msg, &msg)
+		if msg.Msg != StatePatch {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) != len(o.entries) {
+		o.entries = entries
+		if err := o.save(); err != nil {
+			o.thing.log.println("Outbox save error:", err)
+		}
+	}
+
+	o.sent = make(map[uint64]bool)
+	o.sentSeq = seq
+
+	if len(o.entries) == 0 {
+		return 0
+	}
+
+	o.thing.log.printf("Outbox replaying %d message(s) to [%s]",
+		len(o.entries), sock.Name())
+
+	for _, e := range o.entries {
+		p := &Packet{bus: o.thing.bus, msg: e.Msg}
+		if err := sock.Send(p); err != nil {
+			o.thing.log.println("Outbox replay error:", err)
+			break
+		}
+		o.sent[e.seq] = true
+	}
+
+	return uint(len(o.sent))
+}
+
+// Mother acked resync seq; drop the entries replayed in the resync
+func (o *outbox) ack(seq uint64) {
+	o.Lock()
+	defer o.Unlock()
+
+	if seq != o.sentSeq || len(o.sent) == 0 {
+		return
+	}
+
+	var entries []outboxEntry
+	for _, e := range o.entries {
+		if !o.sent[e.seq] {
+			entries = append(entries, e)
+		}
+	}
+	o.entries = entries
+	o.sent = nil
+
+	if err := o.save(); err != nil {
+		o.thing.log.println("Outbox save error:", err)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Socket that records what's sent to it
+type recordSocket struct {
+	flags uint32
+	sent  []string
+}
+
+func (s *recordSocket) Send(p *Packet) error {
+	s.sent = append(s.sent, p.String())
+	return nil
+}
+
+func (s *recordSocket) Close()                {}
+func (s *recordSocket) Name() string          { return "record" }
+func (s *recordSocket) Flags() uint32         { return s.flags }
+func (s *recordSocket) SetFlags(flags uint32) { s.flags = flags }
+func (s *recordSocket) Src() string           { return "record" }
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "outbox")
+	o := newOutbox(thing, file, 3)
+
+	for _, m := range []string{"a", "a", "b", "a", "c"} {
+		o.enqueue(newPacket(thing.bus, nil, &Msg{Msg: m}))
+	}
+
+	// The repeated "a" is queued once, the later "a" keeps its place, and
+	// the oldest ("a") is dropped to stay within max of 3.  A partial
+	// entry, from a crash mid-append, is dropped on load.
+
+	f, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"Msg":{"Msg":"d`)
+	f.Close()
+
+	o = newOutbox(thing, file, 3)
+	if err := o.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sock recordSocket
+	if n := o.replay(&sock, 1); n != 3 {
+		t.Errorf("Replayed %d, want 3", n)
+	}
+
+	want := []string{`{"Msg":"b"}`, `{"Msg":"a"}`, `{"Msg":"c"}`}
+	if len(sock.sent) != len(want) {
+		t.Fatalf("Replayed %v, want %v", sock.sent, want)
+	}
+	for i := range want {
+		if sock.sent[i] != want[i] {
+			t.Errorf("Replayed %v, want %v", sock.sent, want)
+		}
+	}
+
+	// Replayed entries are kept until mother acks the resync
+
+	o.ack(2)
+	if len(o.entries) != 3 {
+		t.Errorf("Outbox dropped entries on wrong ack: %v", o.entries)
+	}
+	o.ack(1)
+
+	o = newOutbox(thing, file, 3)
+	o.load()
+	if len(o.entries) != 0 {
+		t.Errorf("Outbox not empty after ack: %v", o.entries)
+	}
+}
+
+func TestPowerLost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	thing.bus.outbox = newOutbox(thing, filepath.Join(dir, "outbox"), 10)
+	thing.bus.outbox.enqueue(newPacket(thing.bus, nil, &Msg{Msg: "Update"}))
+
+	// Last gasp goes to mother ahead of the outbox
+
+	mother := &recordSocket{flags: sock_flag_bcast | sock_flag_mother}
+	thing.bus.plugin(mother)
+
+	thing.PowerLost()
+	thing.PowerLost()
+
+	if len(mother.sent) != 2 ||
+		!strings.Contains(mother.sent[0], EventPowerLost) ||
+		mother.sent[1] != `{"Msg":"Update"}` {
+		t.Errorf("Mother got %v", mother.sent)
+	}
+}
+
+func TestResync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	thing.bus.outbox = newOutbox(thing, filepath.Join(dir, "outbox"), 10)
+	thing.bus.outbox.enqueue(newPacket(thing.bus, nil, &Msg{Msg: "Update"}))
+	thing.bus.outbox.enqueue(newPacket(thing.bus, nil,
+		&MsgStatePatch{Msg: StatePatch, Version: 7}))
+
+	mother := &recordSocket{flags: sock_flag_mother}
+	thing.bus.plugin(mother)
+
+	newPacket(thing.bus, mother, &Msg{Msg: ReplyState}).Reply()
+
+	// Outbox, minus the StatePatch, then snapshot, then EventResync
+
+	if len(mother.sent) != 3 ||
+		mother.sent[0] != `{"Msg":"Update"}` ||
+		mother.sent[1] != `{"Msg":"_ReplyState"}` {
+		t.Fatalf("Mother got %v", mother.sent)
+	}
+	var resync MsgEventResync
+	json.Unmarshal([]byte(mother.sent[2]), &resync)
+	if resync.Msg != EventResync || resync.Seq != 1 || resync.Events != 1 {
+		t.Errorf("Got resync %+v", resync)
+	}
+	if mother.flags&sock_flag_bcast == 0 {
+		t.Errorf("Mother not ready for broadcasts after resync")
+	}
+
+	ack := MsgResyncAck{Msg: ResyncAck, Seq: resync.Seq}
+	thing.bus.receive(newPacket(thing.bus, mother, &ack))
+	if len(thing.bus.outbox.entries) != 0 {
+		t.Errorf("Outbox not empty after ack: %v",
+			thing.bus.outbox.entries)
+	}
+}
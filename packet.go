@@ -4,6 +4,8 @@
 
 package merle
 
+import "time"
+
 // A Packet is the basic unit of communication in Merle.  Thing Subscribers() receive, process and optional forward
 // Packets.  A Packet contains a single message and the message is JSON-encoded.
 type Packet struct {
@@ -50,6 +52,11 @@ func (p *Packet) Src() string {
 	return p.src.Src()
 }
 
+// Now is the current time, as the Packet's Thing sees it.  See Thing.Now.
+func (p *Packet) Now() time.Time {
+	return p.bus.thing.Now()
+}
+
 // Reply back to sender of Packet.  Do not hold locks when calling Reply().
 func (p *Packet) Reply() {
 	p.bus.reply(p)
@@ -68,6 +75,25 @@ func (p *Packet) Send(dst string) {
 	p.bus.send(p, dst)
 }
 
+// Send Packet to the bridge's attached children in group.  Call on a bridge,
+// from the bridge's Subscribers or BridgeSubscribers.  See BridgeGroup.
+func (p *Packet) SendGroup(group string) {
+	p.bus.thing.sendGroup(p, group)
+}
+
+// Send Packet to each of the bridge's children, or to the children in group
+// if group isn't "", and return the children's replies, waiting up to
+// timeout for each reply.  Call on a bridge, from the bridge's Subscribers or
+// BridgeSubscribers.  For example, to read the state of all of the lights:
+//
+//	msg := merle.Msg{Msg: merle.GetState}
+//	for _, result := range p.Marshal(&msg).FanOut("lights", time.Second) {
+//		...
+//	}
+func (p *Packet) FanOut(group string, timeout time.Duration) []FanOutResult {
+	return p.bus.thing.fanOut(p, group, timeout)
+}
+
 // Test if this is the real Thing or Thing Prime.
 //
 // If p.IsThing() is not true, then we're on Thing Prime and should not access
@@ -102,7 +128,8 @@ func Broadcast(p *Packet) {
 func NoInit(p *Packet) {
 }
 
-// Subscriber helper function to run forever.  Only applicable for CmdRun.
+// Subscriber helper function to run forever, or until stopped by CmdStop.
+// Only applicable for CmdRun.
 //
 //	return merle.Subscribers{
 //		...
@@ -115,7 +142,7 @@ func RunForever(p *Packet) {
 	if msg.Msg != CmdRun {
 		return
 	}
-	select {}
+	<-p.bus.stopped()
 }
 
 // Subscriber helper function to return empty state in response to GetState.
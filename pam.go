@@ -0,0 +1,47 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo && !nopam
+// +build !tinygo,!nopam
+
+package merle
+
+import (
+	"errors"
+
+	"github.com/msteinert/pam"
+)
+
+// Validate user's passwd with PAM.  In container mode, there's no PAM to
+// ask.
+func (w *webPublic) pamValidate(user, passwd string) (bool, error) {
+	if w.thing.Cfg.Container {
+		return false, errNoPAM
+	}
+
+	trans, err := pam.StartFunc("", user,
+		func(s pam.Style, msg string) (string, error) {
+			switch s {
+			case pam.PromptEchoOff:
+				return passwd, nil
+			}
+			return "", errors.New("Unrecognized message style")
+		})
+	if err != nil {
+		w.thing.log.println("PAM Start:", err)
+		return false, err
+	}
+	err = trans.Authenticate(0)
+	if err != nil {
+		w.thing.log.printf("Authenticate [%s,%s]: %s", user, passwd, err)
+		return false, err
+	}
+	err = trans.AcctMgmt(0)
+	if err != nil {
+		w.thing.log.printf("Authenticate [%s,%s]: %s", user, passwd, err)
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// Patch state is the last state sent or received as a StatePatch on a bus
+type patchState struct {
+	sync.Mutex
+	state   map[string]interface{}
+	version uint64
+	// patches since last full snapshot
+	count uint
+}
+
+// mergeDiff returns the JSON merge patch (RFC 7386) which transforms a into b
+func mergeDiff(a, b map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+
+	for k, bv := range b {
+		av, ok := a[k]
+		if !ok {
+			patch[k] = bv
+			continue
+		}
+		am, aIsMap := av.(map[string]interface{})
+		bm, bIsMap := bv.(map[string]interface{})
+		if aIsMap && bIsMap {
+			if sub := mergeDiff(am, bm); len(sub) > 0 {
+				patch[k] = sub
+			}
+			continue
+		}
+		if !reflect.DeepEqual(av, bv) {
+			patch[k] = bv
+		}
+	}
+
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			patch[k] = nil
+		}
+	}
+
+	return patch
+}
+
+// mergeApply applies the JSON merge patch (RFC 7386) to target
+func mergeApply(target interface{}, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	tm, ok := target.(map[string]interface{})
+	if !ok {
+		tm = make(map[string]interface{})
+	}
+
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = mergeApply(tm[k], v)
+		}
+	}
+
+	return tm
+}
+
+// Decode message into a generic map, minus the Msg member
+func stateMap(msg []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "Msg")
+	return m, nil
+}
+
+// BroadcastPatch broadcasts the change in Thing's state since the last
+// BroadcastPatch, rather than the full state.  The Packet holds the full
+// state, as in a ReplyState.  Use BroadcastPatch for Things with large state,
+// where only a small part of the state changes at a time.
+//
+//	func (t *thing) update(p *merle.Packet) {
+//		t.Lock()
+//		t.Points[i] = newValue
+//		p.Marshal(t)
+//		t.Unlock()
+//		p.BroadcastPatch()
+//	}
+//
+// The change is sent as a StatePatch message containing a JSON merge patch
+// (RFC 7386).  Every Cfg.PatchSnapshot patches, the full state is sent
+// instead, so listeners that missed a patch can resync.
+//
+// Do not hold locks when calling BroadcastPatch.
+func (p *Packet) BroadcastPatch() {
+	b := p.bus
+	ps := &b.patch
+
+	state, err := stateMap(p.msg)
+	if err != nil {
+		b.thing.log.println("BroadcastPatch: bad state:", err)
+		return
+	}
+
+	ps.Lock()
+	ps.version++
+	msg := MsgStatePatch{Msg: StatePatch, Version: ps.version}
+	if ps.state == nil || ps.count >= b.thing.Cfg.PatchSnapshot {
+		msg.Full = true
+		msg.Patch, _ = json.Marshal(state)
+		ps.count = 0
+	} else {
+		msg.Patch, _ = json.Marshal(mergeDiff(ps.state, state))
+		ps.count++
+	}
+	ps.state = state
+	ps.Unlock()
+
+	p.Marshal(&msg).Broadcast()
+}
+
+// Reset the bus's patch state to the full state message.  Version is
+// unknown, so the next patch is accepted as is.
+func (ps *patchState) reset(msg []byte) {
+	state, err := stateMap(msg)
+	if err != nil {
+		return
+	}
+	ps.Lock()
+	ps.state = state
+	ps.version = 0
+	ps.Unlock()
+}
+
+// Thing Prime subscriber handler for StatePatch.  Apply the patch to Thing
+// Prime's copy of Thing's state and pass the full state on to Thing Prime's
+// ReplyState subscriber.  Then forward the patch to Thing Prime's listeners.
+//
+// If a patch was missed, Thing Prime asks Thing for full state with
+// GetState.
+func (t *Thing) applyStatePatch(p *Packet) {
+	var msg MsgStatePatch
+	var patch interface{}
+
+	ps := &t.bus.patch
+
+	p.Unmarshal(&msg)
+	if err := json.Unmarshal(msg.Patch, &patch); err != nil {
+		t.log.println("Bad StatePatch:", err)
+		return
+	}
+
+	ps.Lock()
+	switch {
+	case msg.Full:
+		ps.state, _ = patch.(map[string]interface{})
+	case ps.state != nil && (ps.version == 0 || msg.Version == ps.version+1):
+		ps.state = mergeApply(ps.state, patch).(map[string]interface{})
+	default:
+		// Missed a patch; resync
+		ps.state = nil
+	}
+	ps.version = msg.Version
+	state := ps.state
+	ps.Unlock()
+
+	if state == nil {
+		t.log.printf("StatePatch version %d out of sync; getting state",
+			msg.Version)
+		get := Msg{Msg: GetState}
+		if p.src != nil {
+			p.src.Send(newPacket(t.bus, nil, &get))
+		}
+		return
+	}
+
+	full := make(map[string]interface{}, len(state)+1)
+	for k, v := range state {
+		full[k] = v
+	}
+	full["Msg"] = ReplyState
+
+	t.bus.receive(newPacket(t.bus, p.src, full))
+
+	// Receiving ReplyState reset the version
+	ps.Lock()
+	ps.version = msg.Version
+	ps.Unlock()
+
+	p.Broadcast()
+}
@@ -0,0 +1,35 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	a, _ := stateMap([]byte(`{"Msg":"_ReplyState","A":1,"B":{"C":2,"D":3},"E":[1,2],"F":"x"}`))
+	b, _ := stateMap([]byte(`{"Msg":"_ReplyState","A":1,"B":{"C":2,"D":4},"E":[1,2,3]}`))
+
+	patch := mergeDiff(a, b)
+
+	got, _ := json.Marshal(patch)
+	want := `{"B":{"D":4},"E":[1,2,3],"F":null}`
+	if string(got) != want {
+		t.Errorf("Patch: got %s, want %s", got, want)
+	}
+
+	// Round trip through JSON, as a listener would see it
+	var decoded interface{}
+	json.Unmarshal(got, &decoded)
+
+	if applied := mergeApply(a, decoded); !reflect.DeepEqual(applied, b) {
+		t.Errorf("Apply: got %v, want %v", applied, b)
+	}
+}
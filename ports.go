@@ -8,8 +8,11 @@
 package merle
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -25,6 +28,9 @@ type portAttachCb func(*port, *MsgIdentity) error
 type port struct {
 	thing *Thing
 	sync.Mutex
+	// host is "" for a tunnel port on localhost, or a LAN-discovered
+	// Thing's host
+	host              string
 	port              uint
 	tunnelTrying      bool
 	tunnelTryingUntil time.Time
@@ -52,26 +58,25 @@ type ports struct {
 	ticker   *time.Ticker
 	done     chan bool
 	ports    []port
+	mapLock  sync.Mutex
 	portMap  map[string]*port
+	mapFile  string
 	attachCb portAttachCb
 }
 
-func newPorts(thing *Thing, begin, end uint, attachCb portAttachCb) *ports {
+func newPorts(thing *Thing, begin, end uint, mapFile string,
+	attachCb portAttachCb) *ports {
 	return &ports{
 		thing:    thing,
 		begin:    begin,
 		end:      end,
 		done:     make(chan bool),
 		portMap:  make(map[string]*port),
+		mapFile:  mapFile,
 		attachCb: attachCb,
 	}
 }
 
-func (p *port) readMessage() (msg []byte, err error) {
-	_, msg, err = p.ws.ReadMessage()
-	return msg, err
-}
-
 func (p *port) writeMessage(msg []byte) {
 	p.ws.WriteMessage(websocket.TextMessage, msg)
 }
@@ -79,8 +84,13 @@ func (p *port) writeMessage(msg []byte) {
 func (p *port) wsOpen() error {
 	var err error
 
+	host := p.host
+	if host == "" {
+		host = "localhost"
+	}
+
 	u := url.URL{Scheme: "ws",
-		Host: "localhost:" + strconv.FormatUint(uint64(p.port), 10),
+		Host: host + ":" + strconv.FormatUint(uint64(p.port), 10),
 		Path: "/ws"}
 
 	p.ws, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
@@ -149,6 +159,13 @@ func (p *port) wsConnect() (resp *MsgIdentity, err error) {
 	return resp, nil
 }
 
+// Close the port's websocket, detaching the Thing on the port
+func (p *port) kick() {
+	if ws := p.ws; ws != nil {
+		ws.Close()
+	}
+}
+
 func (p *port) wsDisconnect() {
 	p.wsClose()
 	p.Lock()
@@ -171,8 +188,13 @@ func (p *port) attach() {
 }
 
 // listeningPorts are ports in the range [begin, end] with an active listener.
-// An active listener is a Merle tunnel end-point port.
-func listeningPorts(begin, end uint) (map[uint]bool, error) {
+// An active listener is a Merle tunnel end-point port.  In container mode,
+// there's no ss; see procListeningPorts.
+func listeningPorts(t *Thing, begin, end uint) (map[uint]bool, error) {
+	if t.Cfg.Container {
+		return procListeningPorts(procNetTCP, begin, end)
+	}
+
 	listeners := make(map[uint]bool)
 
 	// ss -Hntl4p src 127.0.0.1 sport ge 8081 sport le 9080
@@ -206,6 +228,52 @@ func listeningPorts(begin, end uint) (map[uint]bool, error) {
 	return listeners, nil
 }
 
+// Kernel's table of IPv4 TCP sockets
+const procNetTCP = "/proc/net/tcp"
+
+// Socket state LISTEN, in procNetTCP
+const tcpListen = "0A"
+
+// listeningPorts, read from file, a procNetTCP table.  Lines are:
+//
+//	sl  local_address rem_address   st ...
+//	 0: 0100007F:1F91 00000000:0000 0A ...
+//
+// with the local address in hex, in host byte order, and the port in hex.
+func procListeningPorts(file string, begin, end uint) (map[uint]bool, error) {
+	listeners := make(map[uint]bool)
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return listeners, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != tcpListen {
+			continue
+		}
+		local := strings.Split(fields[1], ":")
+		if len(local) != 2 || !loopback(local[0]) {
+			continue
+		}
+		port, err := strconv.ParseUint(local[1], 16, 16)
+		if err != nil {
+			continue
+		}
+		if uint(port) >= begin && uint(port) <= end {
+			listeners[uint(port)] = true
+		}
+	}
+
+	return listeners, nil
+}
+
+// Is addr, in hex in host byte order, 127.0.0.1?
+func loopback(addr string) bool {
+	return addr == "0100007F" || addr == "7F000001"
+}
+
 func (p *port) connect() {
 	p.Lock()
 	defer p.Unlock()
@@ -227,7 +295,7 @@ func (p *port) disconnect() {
 }
 
 func (p *port) scan() error {
-	listeners, err := listeningPorts(p.port, p.port)
+	listeners, err := listeningPorts(p.thing, p.port, p.port)
 	if err != nil {
 		return err
 	}
@@ -257,7 +325,26 @@ func (p *port) run() error {
 	return nil
 }
 
-func (p *ports) nextPort() (port *port) {
+// Id assigned port, or "" if port is unassigned
+func (p *ports) owner(port *port) string {
+	for id, assigned := range p.portMap {
+		if assigned == port {
+			return id
+		}
+	}
+	return ""
+}
+
+// Next port to assign.  Ports assigned to other Ids are taken only if there
+// are no unassigned ports.
+func (p *ports) nextPort() *port {
+	if port := p.scanPorts(false); port != nil {
+		return port
+	}
+	return p.scanPorts(true)
+}
+
+func (p *ports) scanPorts(takeAssigned bool) (port *port) {
 
 	for i := uint(0); i < p.num; i++ {
 		port = &p.ports[p.next]
@@ -265,6 +352,10 @@ func (p *ports) nextPort() (port *port) {
 		if p.next >= p.num {
 			p.next = 0
 		}
+		owner := p.owner(port)
+		if owner != "" && !takeAssigned {
+			continue
+		}
 		port.Lock()
 		if port.tunnelConnected {
 			port.Unlock()
@@ -278,6 +369,7 @@ func (p *ports) nextPort() (port *port) {
 		port.tunnelTrying = true
 		port.tunnelTryingUntil = time.Now().Add(2 * time.Second)
 		port.Unlock()
+		delete(p.portMap, owner)
 		return
 	}
 
@@ -289,6 +381,9 @@ func (p *ports) getPort(id string) int {
 	var port *port
 	var ok bool
 
+	p.mapLock.Lock()
+	defer p.mapLock.Unlock()
+
 	if port, ok = p.portMap[id]; ok {
 		port.Lock()
 		if port.tunnelConnected {
@@ -302,11 +397,98 @@ func (p *ports) getPort(id string) int {
 			return -1 // No more ports; try later
 		}
 		p.portMap[id] = port
+		if err := p.saveMap(); err != nil {
+			p.thing.log.println("Saving bridge port map failed:", err)
+		}
 	}
 
 	return int(port.port)
 }
 
+// Assign a port to id, without waiting for id's tunnel, e.g. to authorize
+// id's key for the port before id asks for it
+func (p *ports) assign(id string) (uint, error) {
+	p.mapLock.Lock()
+	defer p.mapLock.Unlock()
+
+	if port, ok := p.portMap[id]; ok {
+		return port.port, nil
+	}
+
+	port := p.nextPort()
+	if port == nil {
+		return 0, fmt.Errorf("No ports available for %s", id)
+	}
+	p.portMap[id] = port
+	if err := p.saveMap(); err != nil {
+		p.thing.log.println("Saving bridge port map failed:", err)
+	}
+
+	return port.port, nil
+}
+
+// Load the Id to port map saved from a previous run.  Ids mapped to ports
+// outside of [begin, end] are dropped.  A corrupt map is logged and
+// dropped, and the bridge starts with no assignments.
+func (p *ports) loadMap() error {
+	if p.mapFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(p.mapFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]uint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		p.thing.log.printf("Bridge port map %s is corrupt; starting empty: %s",
+			p.mapFile, err)
+		return nil
+	}
+
+	p.mapLock.Lock()
+	defer p.mapLock.Unlock()
+
+	for id, num := range saved {
+		if num < p.begin || num > p.end {
+			continue
+		}
+		p.portMap[id] = &p.ports[num-p.begin]
+	}
+
+	p.thing.log.printf("Restored %d bridge port assignments", len(p.portMap))
+
+	return nil
+}
+
+// Save the Id to port map.  Call with mapLock held.
+func (p *ports) saveMap() error {
+	if p.mapFile == "" {
+		return nil
+	}
+
+	saved := make(map[string]uint)
+	for id, port := range p.portMap {
+		saved[id] = port.port
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.mapFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p.mapFile)
+}
+
 func (p *ports) init() error {
 	if p.begin == 0 {
 		return fmt.Errorf("Begin port is zero")
@@ -329,12 +511,20 @@ func (p *ports) init() error {
 
 	p.thing.log.printf("Bridge ports[%d-%d]", p.begin, p.end)
 
+	p.mapLock.Lock()
+	p.portMap = make(map[string]*port)
+	p.mapLock.Unlock()
+
+	if err := p.loadMap(); err != nil {
+		return fmt.Errorf("Loading bridge port map: %s", err)
+	}
+
 	return nil
 }
 
 func (p *ports) scan() error {
 
-	listeners, err := listeningPorts(p.begin, p.end)
+	listeners, err := listeningPorts(p.thing, p.begin, p.end)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,138 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// How often the power-fail input is read
+const powerPoll = 100 * time.Millisecond
+
+// Power monitor watches Cfg.PowerFailInput for power failure
+type power struct {
+	thing  *Thing
+	input  string
+	value  string
+	ticker *time.Ticker
+	done   chan bool
+}
+
+func newPower(thing *Thing, input, value string) *power {
+	return &power{
+		thing: thing,
+		input: input,
+		value: value,
+	}
+}
+
+func (p *power) failed() (bool, error) {
+	data, err := ioutil.ReadFile(p.input)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == p.value, nil
+}
+
+func (p *power) start() error {
+	// Fail now, rather than on power failure, if the input can't be read
+	if _, err := p.failed(); err != nil {
+		return err
+	}
+
+	p.ticker = time.NewTicker(powerPoll)
+	p.done = make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-p.ticker.C:
+				failed, err := p.failed()
+				if err != nil {
+					p.thing.log.println("Reading power-fail input:", err)
+					continue
+				}
+				if failed {
+					p.thing.PowerLost()
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (p *power) stop() {
+	p.ticker.Stop()
+	close(p.done)
+}
+
+// PowerLost sends a last-gasp EventPowerLost message to mother, ahead of
+// anything queued in the outbox, and then flushes the outbox and stops
+// Thing: Run returns an error.  Thing Prime is told power was lost, so it can
+// tell a power outage from a network failure.
+//
+// PowerLost is called by Thing when Cfg.PowerFailInput reads
+// Cfg.PowerFailValue.  Call PowerLost directly for other power-fail
+// detectors, such as a UPS monitor.  Only the first call has effect.
+func (t *Thing) PowerLost() {
+	t.powerOnce.Do(t.lastGasp)
+}
+
+func (t *Thing) lastGasp() {
+	t.log.println("Power lost!")
+
+	msg := MsgEventPowerLost{Msg: EventPowerLost, Id: t.id,
+		Time: time.Now()}
+	p := newPacket(t.bus, nil, &msg)
+
+	var mothers []socketer
+
+	t.bus.sockLock.RLock()
+	for sock := range t.bus.sockets {
+		if sock.Flags()&sock_flag_mother != 0 {
+			mothers = append(mothers, sock)
+		}
+	}
+	t.bus.sockLock.RUnlock()
+
+	for _, sock := range mothers {
+		if err := sock.Send(p); err != nil {
+			t.log.println("Sending power lost failed:", err)
+		}
+		if t.bus.outbox != nil {
+			t.bus.outbox.replay(sock, 0)
+		}
+	}
+
+	if len(mothers) == 0 && t.bus.outbox != nil {
+		t.bus.outbox.enqueueFirst(p)
+	}
+
+	if t.lifecycle != nil {
+		t.lifecycle.fail("power", fmt.Errorf("Power lost"))
+	}
+}
+
+// Subscriber handler for EventPowerLost, on Thing Prime (or a bridge's
+// child).  Thing is expected to go offline next.
+func (t *Thing) savePowerLost(p *Packet) {
+	var msg MsgEventPowerLost
+	p.Unmarshal(&msg)
+
+	t.log.printf("Thing lost power at %s", msg.Time.Format(time.RFC3339))
+	t.powerLost = true
+
+	p.Broadcast()
+}
@@ -0,0 +1,136 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Power-on actions
+const (
+	// Restore output to the state saved in the Store
+	PowerOnRestore = "restore"
+	// Output is off (false) at power-on
+	PowerOnOff = "off"
+	// Output is on (true) at power-on
+	PowerOnOn = "on"
+)
+
+// PowerOnRule sets the power-on state of an output.  Field is the output's
+// bool member in Thing's state, with nested members, and array elements,
+// separated by ".".  Rules are applied after Thing's state is loaded from the
+// Store and before CmdRun, so the Thinger's CmdRun drives hardware to the
+// power-on state.  For example, for the relays example, to keep relay 0 off
+// after an outage, whatever its state before:
+//
+//	thing.Cfg.PowerOn = []merle.PowerOnRule{
+//		{Field: "States.0", Action: merle.PowerOnOff},
+//	}
+//
+// Outputs without a rule are restored.
+type PowerOnRule struct {
+	Field string
+	// Action is one of PowerOnRestore, PowerOnOff, or PowerOnOn
+	Action string
+}
+
+func validPowerOn(rules []PowerOnRule) error {
+	for _, rule := range rules {
+		switch rule.Action {
+		case PowerOnRestore, PowerOnOff, PowerOnOn:
+		default:
+			return fmt.Errorf("Unknown power-on action \"%s\"", rule.Action)
+		}
+		if rule.Field == "" {
+			return fmt.Errorf("Power-on rule missing Field")
+		}
+	}
+	return nil
+}
+
+// Set the bool at path in v, a decoded JSON object or array
+func setOutput(v interface{}, path []string, on bool) error {
+	var next interface{}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		var ok bool
+		if next, ok = v[path[0]]; !ok {
+			return fmt.Errorf("No member %s", path[0])
+		}
+		if len(path) == 1 {
+			if _, ok := next.(bool); !ok {
+				return fmt.Errorf("%s is not a bool", path[0])
+			}
+			v[path[0]] = on
+			return nil
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(v) {
+			return fmt.Errorf("No element %s", path[0])
+		}
+		next = v[i]
+		if len(path) == 1 {
+			if _, ok := next.(bool); !ok {
+				return fmt.Errorf("Element %s is not a bool", path[0])
+			}
+			v[i] = on
+			return nil
+		}
+	default:
+		return fmt.Errorf("No member %s", path[0])
+	}
+
+	return setOutput(next, path[1:], on)
+}
+
+// Apply power-on rules to the Thinger.  If the Thinger is a sync.Locker,
+// it's locked while applying.
+func (t *Thing) applyPowerOn() error {
+	if len(t.Cfg.PowerOn) == 0 {
+		return nil
+	}
+
+	if l, ok := t.thinger.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	data, err := json.Marshal(t.thinger)
+	if err != nil {
+		return err
+	}
+
+	var state interface{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	for _, rule := range t.Cfg.PowerOn {
+		if rule.Action == PowerOnRestore {
+			continue
+		}
+		err := setOutput(state, strings.Split(rule.Field, "."),
+			rule.Action == PowerOnOn)
+		if err != nil {
+			return fmt.Errorf("Power-on %s: %s", rule.Field, err)
+		}
+		t.log.printf("Power-on %s: %s", rule.Field, rule.Action)
+	}
+
+	if data, err = json.Marshal(state); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, t.thinger)
+}
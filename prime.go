@@ -14,11 +14,11 @@ func (t *Thing) getPrimePort(id string) string {
 	defer t.primePort.Unlock()
 
 	if t.primePort.tunnelConnected {
-		return "port busy"
+		return ErrPortBusy.Code
 	}
 
 	if t.primeId != "" && t.primeId != id {
-		return "no ports available"
+		return ErrNoPortsAvailable.Code
 	}
 
 	return fmt.Sprintf("%d", t.primePort.port)
@@ -31,11 +31,20 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 	var msg = Msg{Msg: GetState}
 	var err error
 
+	t.chaosLink(sock)
+	t.keepalive(sock)
+	t.limit(sock, false)
+
 	t.log.printf("Websocket opened [%s]", name)
 
 	t.primeSock = sock
 	t.bus.plugin(sock)
 
+	if t.link != nil {
+		sock.link = t.link
+		t.link.asked()
+	}
+
 	// Send GetState msg to Thing
 	sock.Send(pkt.Marshal(&msg))
 
@@ -43,7 +52,7 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 		// new pkt for each rcv
 		var pkt = newPacket(t.bus, sock, nil)
 
-		pkt.msg, err = p.readMessage()
+		pkt.msg, err = sock.read()
 		if err != nil {
 			t.log.printf("Websocket closed [%s]", name)
 			break
@@ -51,6 +60,10 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 
 		pkt.Unmarshal(&msg)
 
+		if t.fromThing != nil {
+			t.fromThing(t, pkt)
+		}
+
 		t.bus.receive(pkt)
 
 		if msg.Msg == ReplyState {
@@ -59,6 +72,11 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 	}
 
 	t.bus.unplug(sock)
+	sock.stop()
+
+	if t.heartbeat != nil {
+		t.heartbeat.unwatch()
+	}
 
 	cleanup(t)
 
@@ -66,22 +84,43 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 }
 
 func (t *Thing) sendStatus() {
-	msg := MsgEventStatus{Msg: EventStatus, Id: t.id, Online: t.online}
+	msg := MsgEventStatus{Msg: EventStatus, Id: t.id, Online: t.online,
+		PowerLost: !t.online && t.powerLost, Standby: t.isStandby}
 	newPacket(t.bus, t.primeSock, &msg).Broadcast()
 }
 
+// Send mother hints, if any, to child on the socket
+func (t *Thing) sendMotherHints(sock socketer) {
+	if len(t.Cfg.MotherHints) == 0 {
+		return
+	}
+	msg := MsgMotherHints{Msg: SetMotherHints, Hints: t.Cfg.MotherHints}
+	sock.Send(newPacket(t.bus, nil, &msg))
+}
+
 func (t *Thing) primeReady(self *Thing) {
 	t.online = true
-	t.web.public.start()
+	t.powerLost = false
+	if err := t.web.public.start(); err != nil {
+		t.lifecycle.fail("web public", err)
+	}
 	t.sendStatus()
+	t.sendMotherHints(t.primeSock)
+	t.sendConfigTemplate(t.primeSock, t.model, t.tags)
+	t.getJournalSince()
 }
 
 func (t *Thing) primeCleanup(self *Thing) {
 	t.online = false
+	t.isStandby = false
 	t.sendStatus()
+	if t.registry != nil {
+		t.registry.gone(t.id)
+	}
 }
 
-func (t *Thing) primeAttach(p *port, msg *MsgIdentity) error {
+// Take on Thing's identity, attaching to Thing
+func (t *Thing) primeIdentity(msg *MsgIdentity) error {
 	if msg.Model != t.Cfg.Model {
 		return fmt.Errorf("Model mis-match: want %s, got %s",
 			t.Cfg.Model, msg.Model)
@@ -90,19 +129,55 @@ func (t *Thing) primeAttach(p *port, msg *MsgIdentity) error {
 	t.id = msg.Id
 	t.model = msg.Model
 	t.name = msg.Name
+	t.tags = msg.Tags
 	t.online = msg.Online
 	t.startupTime = msg.StartupTime
+	t.journaling = msg.Journal
 	t.primeId = t.id
 
+	if t.registry != nil {
+		t.registry.seen(msg)
+	}
+
 	prefix := "[" + t.id + "] "
 	t.log = newLogger(prefix, t.Cfg.LoggingEnabled)
 
 	t.setAssetsDir(t)
 
+	return nil
+}
+
+func (t *Thing) primeAttach(p *port, msg *MsgIdentity) error {
+	if err := t.primeIdentity(msg); err != nil {
+		return err
+	}
 	return t.runOnPort(p, t.primeReady, t.primeCleanup)
 }
 
+// Thing Prime's public web server is started when Thing Prime first
+// attaches to Thing, so only (re)start the server if attached
+func (t *Thing) primeStartPublic() error {
+	if !t.online {
+		return nil
+	}
+	return t.web.public.start()
+}
+
 func (t *Thing) primeRun() error {
-	t.web.private.start()
-	return t.primePort.run()
+	if err := t.lifecycle.start(); err != nil {
+		return err
+	}
+
+	t.logConfigReport()
+
+	run := t.primePort.run
+	if t.nats != nil {
+		run = t.nats.primeRun
+	}
+
+	err := t.lifecycle.run(run)
+
+	t.lifecycle.stop()
+
+	return err
 }
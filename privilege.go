@@ -0,0 +1,71 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Drop root for Cfg.RunAs, once Thing's web servers have their ports, but
+// before they serve, so no request is handled as root.  A port that can't
+// be bound now is left for the server's start to bind, and fail, under
+// the server's own failure policy.
+func (t *Thing) dropPrivileges() error {
+	t.web.public.bindPorts()
+	t.web.private.bindPorts()
+
+	u, err := user.Lookup(t.Cfg.RunAs)
+	if err != nil {
+		return newError(ErrPrivileges, err)
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return newError(ErrPrivileges, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return newError(ErrPrivileges, err)
+	}
+
+	var gids []int
+	groups, err := u.GroupIds()
+	if err != nil {
+		return newError(ErrPrivileges, err)
+	}
+	for _, g := range groups {
+		if id, err := strconv.Atoi(g); err == nil {
+			gids = append(gids, id)
+		}
+	}
+
+	if os.Getuid() == uid && os.Getgid() == gid {
+		t.log.printf("Already running as user \"%s\"", u.Username)
+		return nil
+	}
+
+	// Groups first; once uid is dropped, groups can't be changed
+	if err := syscall.Setgroups(gids); err != nil {
+		return newError(ErrPrivileges, fmt.Errorf("setgroups: %s", err))
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return newError(ErrPrivileges, fmt.Errorf("setgid %d: %s", gid, err))
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return newError(ErrPrivileges, fmt.Errorf("setuid %d: %s", uid, err))
+	}
+
+	t.log.printf("Running as user \"%s\" (uid %d, gid %d)", u.Username,
+		uid, gid)
+
+	return nil
+}
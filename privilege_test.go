@@ -0,0 +1,81 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"errors"
+	"net"
+	"os/user"
+	"testing"
+)
+
+func TestRunAs(t *testing.T) {
+	thing := NewThing(&toggler{})
+	thing.Cfg.Id = testId
+	thing.Cfg.IsPrime = true
+	thing.Cfg.PortPublic = 0
+	thing.Cfg.RunAs = "no_such_merle_user"
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := thing.dropPrivileges(); !errors.Is(err, ErrPrivileges) {
+		t.Errorf("Unknown user: %v", err)
+	}
+
+	// PAM can't check User's password as RunAs
+	bad := NewThing(&toggler{})
+	bad.Cfg.Id = testId
+	bad.Cfg.User = "merle"
+	bad.Cfg.RunAs = "nobody"
+	if err := bad.build(true); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("RunAs with PAM: %v", err)
+	}
+
+	// Updates can't re-exec as RunAs
+	bad = NewThing(&toggler{})
+	bad.Cfg.Id = testId
+	bad.Cfg.RunAs = "nobody"
+	bad.Cfg.Update.Keys = []string{"key"}
+	if err := bad.build(true); !errors.Is(err, ErrBadConfig) {
+		t.Errorf("RunAs with Update: %v", err)
+	}
+
+	// Already RunAs; ports are bound, to serve later
+	me, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	thing.Cfg.RunAs = me.Username
+	thing.web.public.port = freePort(t)
+	thing.web.private.port = freePort(t)
+	if err := thing.dropPrivileges(); err != nil {
+		t.Fatal(err)
+	}
+	if len(thing.web.public.lns) == 0 {
+		t.Fatal("Public port not bound")
+	}
+	if len(thing.web.private.lns) == 0 {
+		t.Fatal("Private port not bound")
+	}
+	thing.web.public.stop()
+	thing.web.private.stop()
+	if thing.web.public.lns != nil || thing.web.private.lns != nil {
+		t.Error("Ports still bound")
+	}
+}
+
+// A port free to listen on
+func freePort(t *testing.T) uint {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return uint(ln.Addr().(*net.TCPAddr).Port)
+}
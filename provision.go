@@ -0,0 +1,662 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Provisioning onboards factory-fresh Things.  A fresh Thing boots with a
+// claim code (see ClaimConfig), and asks Prime for its provision until an
+// admin claims the Thing on Prime (see ProvisionConfig), giving the Thing
+// an Id.  The Thing then keeps its provision: its Id, name, mother, and
+// credentials.
+
+// ClaimConfig configures a factory-fresh Thing to wait to be claimed
+type ClaimConfig struct {
+
+	// Code the Thing is claimed with, e.g. printed on the Thing's label.
+	// Codes are at least 8 characters.  Claiming is disabled if Code is
+	// empty.  The default is "".
+	Code string
+
+	// URL of Prime's public HTTP server, e.g. "https://prime.example.com".
+	// The Thing asks for its provision, POSTing Code to URL/claim, every
+	// Cfg.RetryInterval seconds until claimed.
+	URL string
+
+	// File the provision is kept in, once claimed.  Once File has a
+	// provision, the Thing doesn't ask again.  If Cfg.MotherKeyFile is
+	// given, and doesn't exist, the Thing makes a new SSH key in
+	// MotherKeyFile, and sends Prime the public key to authorize.
+	File string
+}
+
+// ProvisionConfig configures Prime to provision the Things admins claim.
+// Claims are made on the admin page (/admin), or with the JSON API at
+// /admin/claims, and need Cfg.AuthFile.
+type ProvisionConfig struct {
+
+	// File claims are kept in.  Provisioning is disabled if File is
+	// empty.  The default is "".
+	File string
+
+	// Mother given to claimed Things.  MotherPortPrivate defaults to
+	// Cfg.PortPrivate.
+	MotherHost        string
+	MotherUser        string
+	MotherPortPrivate uint
+
+	// [Optional] known_hosts file with mother's host key, given to claimed
+	// Things so they can trust mother.  The default is "".
+	KnownHosts string
+
+	// [Optional] authorized_keys file of MotherUser, where the SSH public
+	// keys of claimed Things are added, restricted to forwarding the
+	// Thing's tunnel port, and to opening mother's private port.  Prime
+	// must be the mother, Thing Prime or a bridge, to know the Thing's
+	// tunnel port.  The default is "".
+	AuthorizedKeys string
+}
+
+// Provision is what a claimed Thing is given, and keeps in ClaimConfig.File
+type Provision struct {
+	Id                string
+	Name              string   `json:",omitempty"`
+	Tags              []string `json:",omitempty"`
+	MotherHost        string
+	MotherUser        string
+	MotherPortPrivate uint
+	// Lines of known_hosts for mother's host key
+	KnownHosts string `json:",omitempty"`
+	// Cfg.BootToken, for the first admin of the Thing's public server
+	BootToken string `json:",omitempty"`
+}
+
+// Claim is a Thing claimed on Prime, by its claim code
+type Claim struct {
+	// SHA-256 of the claim code
+	CodeHash string
+	Id       string
+	Name     string   `json:",omitempty"`
+	Tags     []string `json:",omitempty"`
+	// Admin who made the claim
+	By      string
+	Created time.Time
+	// When the Thing got its provision; zero if not yet
+	Delivered time.Time
+	// Thing's SSH public key, if the Thing sent one
+	PublicKey string `json:",omitempty"`
+	BootToken string `json:",omitempty"`
+}
+
+// Claim request, to POST /admin/claims
+type claimRequest struct {
+	Code string
+	Id   string
+	Name string
+	Tags []string
+}
+
+// Claim request, from the Thing, to POST /claim
+type provisionRequest struct {
+	Code      string
+	PublicKey string
+}
+
+var (
+	errNotClaimed = errors.New("Not claimed yet")
+	errDelivered  = errors.New("Already provisioned")
+)
+
+const claimCodeMin = 8
+
+// Unknown claim codes an address can try in claimWindow before it's locked
+// out, until the window ends.  A Thing waiting to be claimed asks with the
+// same code each time, so only guessing codes is locked out.
+const (
+	claimGuessMax = 10
+	claimWindow   = time.Hour
+)
+
+// Unknown codes tried by an address
+type claimGuesses struct {
+	start time.Time
+	codes map[string]bool
+}
+
+// Prime's claims
+type provision struct {
+	thing *Thing
+	sync.Mutex
+	cfg     ProvisionConfig
+	store   Store
+	claims  []Claim
+	guesses map[string]*claimGuesses
+}
+
+func newProvision(thing *Thing, cfg ProvisionConfig) *provision {
+	if cfg.MotherPortPrivate == 0 {
+		cfg.MotherPortPrivate = thing.Cfg.PortPrivate
+	}
+	return &provision{
+		thing:   thing,
+		cfg:     cfg,
+		store:   NewFileStore(cfg.File),
+		guesses: make(map[string]*claimGuesses),
+	}
+}
+
+// Address addr, a client IP, has tried too many unknown codes
+func (p *provision) lockedOut(addr string, now time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	for a, g := range p.guesses {
+		if now.Sub(g.start) > claimWindow {
+			delete(p.guesses, a)
+		}
+	}
+
+	g := p.guesses[addr]
+	return g != nil && len(g.codes) >= claimGuessMax
+}
+
+// Address addr tried code, which isn't claimed
+func (p *provision) guessed(addr, code string, now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	g := p.guesses[addr]
+	if g == nil {
+		g = &claimGuesses{start: now, codes: make(map[string]bool)}
+		p.guesses[addr] = g
+	}
+	g.codes[hashToken(code)] = true
+}
+
+// Port on mother, this Thing, Thing id tunnels to
+func (p *provision) tunnelPort(id string) (uint, error) {
+	t := p.thing
+	switch {
+	case t.isBridge:
+		return t.bridge.ports.assign(id)
+	case t.isPrime:
+		return t.Cfg.PortPrime, nil
+	}
+	return 0, fmt.Errorf("Not mother; tunnel port for %s unknown", id)
+}
+
+func (p *provision) load() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.store.Load(&p.claims)
+}
+
+// Claims, without secrets
+func (p *provision) list() []Claim {
+	p.Lock()
+	defer p.Unlock()
+
+	claims := make([]Claim, len(p.claims))
+	for i, c := range p.claims {
+		c.BootToken = ""
+		claims[i] = c
+	}
+	return claims
+}
+
+// Claim the Thing with req.Code as req.Id, by admin.  The Claim returned
+// has the BootToken the Thing will get.
+func (p *provision) claim(req claimRequest, by string) (Claim, error) {
+	if len(req.Code) < claimCodeMin {
+		return Claim{}, fmt.Errorf("Claim code must be at least %d characters", claimCodeMin)
+	}
+	if req.Id == "" || !validId(req.Id) {
+		return Claim{}, fmt.Errorf("Id must contain only alphanumeric or underscore characters")
+	}
+	if !validName(req.Name) {
+		return Claim{}, fmt.Errorf("Name must contain only alphanumeric or underscore characters")
+	}
+
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return Claim{}, err
+	}
+
+	claim := Claim{
+		CodeHash:  hashToken(req.Code),
+		Id:        req.Id,
+		Name:      req.Name,
+		Tags:      req.Tags,
+		By:        by,
+		Created:   time.Now(),
+		BootToken: hex.EncodeToString(secret[:]),
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	for _, c := range p.claims {
+		if c.CodeHash == claim.CodeHash {
+			return Claim{}, fmt.Errorf("Code is already claimed, as %s", c.Id)
+		}
+		if c.Id == req.Id {
+			return Claim{}, fmt.Errorf("Id %s is already claimed", req.Id)
+		}
+	}
+
+	claims := append(append([]Claim(nil), p.claims...), claim)
+	if err := p.store.Save(&claims); err != nil {
+		return Claim{}, err
+	}
+	p.claims = claims
+
+	return claim, nil
+}
+
+// Drop the claim for id, so its code can be claimed again
+func (p *provision) unclaim(id string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	var claims []Claim
+	for _, c := range p.claims {
+		if c.Id != id {
+			claims = append(claims, c)
+		}
+	}
+	if len(claims) == len(p.claims) {
+		return fmt.Errorf("Id %s isn't claimed", id)
+	}
+	if err := p.store.Save(&claims); err != nil {
+		return err
+	}
+	p.claims = claims
+	return nil
+}
+
+// Provision for the Thing with code.  A provision is given once, or again
+// only to the Thing with the same public key, in case the Thing didn't
+// keep it.
+func (p *provision) deliver(code, publicKey string) (*Provision, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	hash := []byte(hashToken(code))
+	i := -1
+	for j := range p.claims {
+		if subtle.ConstantTimeCompare([]byte(p.claims[j].CodeHash), hash) == 1 {
+			i = j
+		}
+	}
+	if i < 0 {
+		return nil, errNotClaimed
+	}
+
+	c := p.claims[i]
+	if !c.Delivered.IsZero() && (c.PublicKey == "" || c.PublicKey != publicKey) {
+		return nil, errDelivered
+	}
+
+	prov := &Provision{
+		Id:                c.Id,
+		Name:              c.Name,
+		Tags:              c.Tags,
+		MotherHost:        p.cfg.MotherHost,
+		MotherUser:        p.cfg.MotherUser,
+		MotherPortPrivate: p.cfg.MotherPortPrivate,
+		BootToken:         c.BootToken,
+	}
+	if p.cfg.KnownHosts != "" {
+		hosts, err := ioutil.ReadFile(p.cfg.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		prov.KnownHosts = string(hosts)
+	}
+
+	if c.Delivered.IsZero() {
+		if publicKey != "" && p.cfg.AuthorizedKeys != "" {
+			port, err := p.tunnelPort(c.Id)
+			if err != nil {
+				return nil, err
+			}
+			if err := authorizeKey(p.cfg.AuthorizedKeys, publicKey, c.Id,
+				port, p.cfg.MotherPortPrivate); err != nil {
+				return nil, err
+			}
+		}
+		c.Delivered = time.Now()
+		c.PublicKey = publicKey
+		claims := append([]Claim(nil), p.claims...)
+		claims[i] = c
+		if err := p.store.Save(&claims); err != nil {
+			return nil, err
+		}
+		p.claims = claims
+	}
+
+	return prov, nil
+}
+
+// Add Thing id's key to authorized_keys file, good only for the tunnel:
+// listening on port, and opening mother's private port, to ask for port
+func authorizeKey(file, key, id string, port, private uint) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "restrict,port-forwarding,permitlisten=\"%d\","+
+		"permitopen=\"localhost:%d\" %s merle:%s\n", port, private, key, id)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Thing asks for its provision on POST /claim, with its code in the body.
+// No login is needed; the code is the Thing's secret.  An address guessing
+// codes is locked out for a while.
+func (t *Thing) claimHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr := t.clientAddr(r)
+	ip := t.clientIP(r)
+	if t.provision.lockedOut(ip, time.Now()) {
+		t.log.printf("Claim refused [%s]: too many codes tried", addr)
+		http.Error(w, "Too many claim codes tried", http.StatusTooManyRequests)
+		return
+	}
+
+	var req provisionRequest
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &req)
+	}
+	if err == nil && req.PublicKey != "" {
+		var key ssh.PublicKey
+		key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+		if err == nil {
+			req.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		}
+	}
+	if err == nil && req.Code == "" {
+		err = errors.New("missing Code")
+	}
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prov, err := t.provision.deliver(req.Code, req.PublicKey)
+	switch err {
+	case nil:
+	case errNotClaimed:
+		t.provision.guessed(ip, req.Code, time.Now())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errDelivered:
+		t.log.printf("Claim refused [%s]: %s", addr, err)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	default:
+		t.log.printf("Claim failed [%s]: %s", addr, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t.log.printf("Provisioned %s [%s]", prov.Id, addr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prov)
+}
+
+// JSON API for claims on /admin/claims: GET lists claims; POST a
+// claimRequest claims a Thing, and returns the Claim, with the BootToken;
+// DELETE ?id=<id> drops a claim.
+func (t *Thing) claimsAPI(w http.ResponseWriter, r *http.Request) {
+	u := authUser(r)
+	if u == nil || u.Role != RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		// Forms can't post JSON cross-site
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "Content-Type must be application/json",
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		var req claimRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		claim, err := t.provision.claim(req, u.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		t.log.printf("Admin %s claimed %s", u.Name, req.Id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&claim)
+		return
+	case "DELETE":
+		// Cross-site requests can't DELETE without a preflight
+		id := r.URL.Query().Get("id")
+		if err := t.provision.unclaim(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		t.log.printf("Admin %s unclaimed %s", u.Name, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.provision.list())
+}
+
+// Claim or unclaim a Thing on POST /admin/claim.  The new claim's
+// BootToken is shown once, on the page returned.
+func (t *Thing) adminClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.FormValue("action") == "delete" {
+		id := r.FormValue("id")
+		err := t.provision.unclaim(id)
+		if err == nil {
+			t.log.printf("Admin %s unclaimed %s", authUser(r).Name, id)
+		}
+		t.adminDone(w, r, err)
+		return
+	}
+
+	req := claimRequest{
+		Code: strings.TrimSpace(r.FormValue("code")),
+		Id:   strings.TrimSpace(r.FormValue("id")),
+		Name: strings.TrimSpace(r.FormValue("name")),
+		Tags: formList(r, "tags"),
+	}
+	claim, err := t.provision.claim(req, authUser(r).Name)
+	if err != nil {
+		t.adminDone(w, r, err)
+		return
+	}
+
+	t.log.printf("Admin %s claimed %s", authUser(r).Name, req.Id)
+	t.renderAdminPage(w, r, adminPage{NewBootToken: claim.BootToken}, nil)
+}
+
+// Wait to be claimed, if Cfg.Claim.Code is given, and take on the
+// provision.  Called before building Thing, as the provision gives Thing
+// its Id.
+func (t *Thing) claimed() error {
+	cfg := t.Cfg.Claim
+	if cfg.Code == "" {
+		return nil
+	}
+	if cfg.URL == "" || cfg.File == "" {
+		return fmt.Errorf("Claim needs URL and File")
+	}
+
+	store := NewFileStore(cfg.File)
+	var prov Provision
+	if err := store.Load(&prov); err != nil {
+		return fmt.Errorf("Loading provision: %s", err)
+	}
+
+	if prov.Id == "" {
+		publicKey, err := t.claimKey()
+		if err != nil {
+			return fmt.Errorf("Claim key: %s", err)
+		}
+		log := newLogger("[claim] ", t.Cfg.LoggingEnabled)
+		log.printf("Waiting to be claimed at %s", cfg.URL)
+		for {
+			p, err := fetchProvision(cfg.URL, cfg.Code, publicKey)
+			if err == nil {
+				prov = *p
+				break
+			}
+			if err != errNotClaimed {
+				log.println("Claim failed:", err)
+			}
+			time.Sleep(time.Duration(t.Cfg.RetryInterval) * time.Second)
+		}
+		if err := store.Save(&prov); err != nil {
+			return fmt.Errorf("Saving provision: %s", err)
+		}
+		log.printf("Claimed as %s", prov.Id)
+	}
+
+	return t.provisioned(&prov)
+}
+
+// Ask Prime at url for the provision for code
+func fetchProvision(url, code, publicKey string) (*Provision, error) {
+	body, _ := json.Marshal(&provisionRequest{Code: code, PublicKey: publicKey})
+	url = strings.TrimRight(url, "/") + "/claim"
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errNotClaimed
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var prov Provision
+	if err := json.NewDecoder(resp.Body).Decode(&prov); err != nil {
+		return nil, err
+	}
+	if !validId(prov.Id) || prov.Id == "" {
+		return nil, fmt.Errorf("Bad Id %q", prov.Id)
+	}
+	return &prov, nil
+}
+
+// Thing's SSH public key for mother, in authorized_keys format, making a
+// new key in Cfg.MotherKeyFile if there isn't one.  Without MotherKeyFile,
+// Thing doesn't send a key.
+func (t *Thing) claimKey() (string, error) {
+	file := t.Cfg.MotherKeyFile
+	if file == "" {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return "", err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// Take on prov.  Mother's known hosts are kept next to Cfg.Claim.File,
+// unless Cfg.MotherKnownHosts is given.
+func (t *Thing) provisioned(prov *Provision) error {
+	t.Cfg.Id = prov.Id
+	if prov.Name != "" {
+		t.Cfg.Name = prov.Name
+	}
+	if len(prov.Tags) > 0 {
+		t.Cfg.Tags = prov.Tags
+	}
+	t.Cfg.MotherHost = prov.MotherHost
+	t.Cfg.MotherUser = prov.MotherUser
+	t.Cfg.MotherPortPrivate = prov.MotherPortPrivate
+	if t.Cfg.BootToken == "" {
+		t.Cfg.BootToken = prov.BootToken
+	}
+
+	if prov.KnownHosts != "" && t.Cfg.MotherKnownHosts == "" {
+		file := t.Cfg.Claim.File + ".known_hosts"
+		if err := ioutil.WriteFile(file, []byte(prov.KnownHosts), 0600); err != nil {
+			return err
+		}
+		t.Cfg.MotherKnownHosts = file
+	}
+
+	return nil
+}
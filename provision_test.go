@@ -0,0 +1,221 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKnownHosts = "mother.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"
+
+func TestProvision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	ioutil.WriteFile(knownHosts, []byte(testKnownHosts), 0600)
+	authorizedKeys := filepath.Join(dir, "authorized_keys")
+
+	prime := NewThing(&sparse{})
+	prime.Cfg.Id = testId
+	prime.Cfg.IsPrime = true
+	prime.SetAuthStore(&memAuthStore{})
+	prime.Cfg.Provision = ProvisionConfig{
+		File:           filepath.Join(dir, "claims"),
+		MotherHost:     "mother.example.com",
+		MotherUser:     "merle",
+		KnownHosts:     knownHosts,
+		AuthorizedKeys: authorizedKeys,
+	}
+	if err := prime.build(true); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(prime.web.public.mux)
+	defer srv.Close()
+
+	admin := &AuthUser{Name: "root", Role: RoleAdmin}
+	claim := func(user *AuthUser, req string) (int, Claim) {
+		r := httptest.NewRequest("POST", "http://prime/admin/claims",
+			strings.NewReader(req))
+		r.Header.Set("Content-Type", "application/json")
+		r = r.WithContext(context.WithValue(r.Context(), authUserKey{}, user))
+		w := httptest.NewRecorder()
+		prime.claimsAPI(w, r)
+		var c Claim
+		json.Unmarshal(w.Body.Bytes(), &c)
+		return w.Code, c
+	}
+
+	// Not claimed yet
+	if _, err := fetchProvision(srv.URL, "ABCD1234", ""); err != errNotClaimed {
+		t.Errorf("Got %v, want %v", err, errNotClaimed)
+	}
+
+	viewer := &AuthUser{Name: "bob", Role: RoleViewer}
+	req := `{"Code":"ABCD1234","Id":"relay_1","Name":"garage","Tags":["north"]}`
+	if code, _ := claim(viewer, req); code != http.StatusForbidden {
+		t.Errorf("Viewer claim got %d", code)
+	}
+	code, c := claim(admin, req)
+	if code != http.StatusCreated || c.Id != "relay_1" || c.BootToken == "" ||
+		c.By != "root" {
+		t.Fatalf("Claim got %d %+v", code, c)
+	}
+	if code, _ := claim(admin, req); code != http.StatusConflict {
+		t.Errorf("Claimed twice, got %d", code)
+	}
+	if code, _ := claim(admin, `{"Code":"short","Id":"relay_2"}`); code != http.StatusConflict {
+		t.Errorf("Claimed short code, got %d", code)
+	}
+
+	// Fresh Thing waiting with the code makes a key, and is provisioned
+	thing := NewThing(&sparse{})
+	thing.Cfg.Claim = ClaimConfig{
+		Code: "ABCD1234",
+		URL:  srv.URL,
+		File: filepath.Join(dir, "provision"),
+	}
+	thing.Cfg.MotherKeyFile = filepath.Join(dir, "mother_key")
+	if err := thing.claimed(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := thing.Cfg
+	if cfg.Id != "relay_1" || cfg.Name != "garage" || cfg.Tags[0] != "north" ||
+		cfg.MotherHost != "mother.example.com" || cfg.MotherUser != "merle" ||
+		cfg.MotherPortPrivate != prime.Cfg.PortPrivate ||
+		cfg.BootToken != c.BootToken {
+		t.Errorf("Provisioned as %+v", cfg)
+	}
+	hosts, _ := ioutil.ReadFile(cfg.MotherKnownHosts)
+	if string(hosts) != testKnownHosts {
+		t.Errorf("Known hosts %q", hosts)
+	}
+	publicKey, _ := thing.claimKey()
+	keys, _ := ioutil.ReadFile(authorizedKeys)
+	want := fmt.Sprintf("restrict,port-forwarding,permitlisten=\"%d\","+
+		"permitopen=\"localhost:%d\" %s merle:relay_1\n",
+		prime.Cfg.PortPrime, prime.Cfg.PortPrivate, publicKey)
+	if string(keys) != want {
+		t.Errorf("Authorized keys %q", keys)
+	}
+
+	// Only the Thing with the key can get the provision again
+	if _, err := fetchProvision(srv.URL, "ABCD1234", publicKey); err != nil {
+		t.Errorf("Provision again: %s", err)
+	}
+	if _, err := fetchProvision(srv.URL, "ABCD1234", ""); err == nil ||
+		!strings.Contains(err.Error(), "410") {
+		t.Errorf("Got %v, want 410", err)
+	}
+
+	// The provision is kept, so restarts don't need Prime
+	srv.Close()
+	again := NewThing(&sparse{})
+	again.Cfg.Claim = thing.Cfg.Claim
+	if err := again.claimed(); err != nil || again.Cfg.Id != "relay_1" {
+		t.Errorf("Restarted as %s: %v", again.Cfg.Id, err)
+	}
+
+	// Claim on the admin page shows the boot token
+	form := url.Values{"code": {"EFGH5678"}, "id": {"relay_2"}}
+	r := httptest.NewRequest("POST", "http://prime/admin/claim",
+		strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "http://prime")
+	r = r.WithContext(context.WithValue(r.Context(), authUserKey{}, admin))
+	w := httptest.NewRecorder()
+	prime.adminOnly(prime.adminClaim)(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "relay_2") ||
+		!strings.Contains(w.Body.String(), "Boot token") {
+		t.Errorf("Admin claim got %d: %s", w.Code, w.Body.String())
+	}
+
+	bad := NewThing(&sparse{})
+	bad.Cfg.Id = testId
+	bad.Cfg.Provision.File = filepath.Join(dir, "claims")
+	if err := bad.build(true); err == nil {
+		t.Errorf("Provisioning without AuthFile")
+	}
+
+	// Without being mother, the tunnel port isn't known
+	bad = NewThing(&sparse{})
+	bad.Cfg.Id = testId
+	bad.SetAuthStore(&memAuthStore{})
+	bad.Cfg.Provision = prime.Cfg.Provision
+	if err := bad.build(true); err == nil {
+		t.Errorf("Authorizing keys without being mother")
+	}
+}
+
+func TestProvisionLockout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prime := NewThing(&sparse{})
+	prime.Cfg.Id = testId
+	prime.SetAuthStore(&memAuthStore{})
+	prime.Cfg.Provision.File = filepath.Join(dir, "claims")
+	if err := prime.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(code string) int {
+		r := httptest.NewRequest("POST", "/claim",
+			strings.NewReader(`{"Code":"`+code+`"}`))
+		w := httptest.NewRecorder()
+		prime.web.public.mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Asking again with the same code is waiting, not guessing
+	for i := 0; i < claimGuessMax+1; i++ {
+		if code := post("ABCD1234"); code != http.StatusNotFound {
+			t.Fatalf("Waiting got %d", code)
+		}
+	}
+	for i := 1; i < claimGuessMax; i++ {
+		post(fmt.Sprintf("GUESS%04d", i))
+	}
+	if code := post("ABCD1234"); code != http.StatusTooManyRequests {
+		t.Errorf("Guessing got %d", code)
+	}
+
+	// Until the window ends
+	if !prime.provision.lockedOut("192.0.2.1", time.Now()) {
+		t.Fatalf("Not locked out")
+	}
+	now := time.Now().Add(claimWindow + time.Minute)
+	if prime.provision.lockedOut("192.0.2.1", now) {
+		t.Errorf("Still locked out")
+	}
+
+	// The code is in the body, not the URL
+	r := httptest.NewRequest("POST", "/claim/ABCD1234", nil)
+	w := httptest.NewRecorder()
+	prime.web.public.mux.ServeHTTP(w, r)
+	if w.Code == http.StatusNotFound && strings.Contains(w.Body.String(), errNotClaimed.Error()) {
+		t.Errorf("Code taken from URL")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Behind a reverse proxy (see Cfg.TrustProxy), the request Thing sees is
+// the proxy's: r.TLS is nil, r.Host may be the backend's, and
+// r.RemoteAddr is the proxy.  The proxy's X-Forwarded-* headers say what
+// the browser asked for.
+
+// First of a header's comma-separated values, as a chain of proxies
+// appends theirs
+func firstForwarded(r *http.Request, header string) string {
+	value := r.Header.Get(header)
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// Request r is from a trusted proxy: TrustProxy is set and, if there are
+// TrustedProxies, r is from one of them
+func (t *Thing) fromProxy(r *http.Request) bool {
+	if !t.Cfg.TrustProxy {
+		return false
+	}
+	if t.proxies == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return t.proxies.allowed(net.ParseIP(host))
+}
+
+// The request as the browser made it: scheme ("http" or "https"), host,
+// and the path prefix the proxy stripped, if any.
+func (t *Thing) forwarded(r *http.Request) (scheme, host, prefix string) {
+	scheme = "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	host = r.Host
+
+	if !t.fromProxy(r) {
+		return
+	}
+
+	switch proto := strings.ToLower(firstForwarded(r, "X-Forwarded-Proto")); proto {
+	case "http", "https":
+		scheme = proto
+	}
+	if fwdHost := firstForwarded(r, "X-Forwarded-Host"); fwdHost != "" {
+		host = fwdHost
+	}
+	prefix = strings.TrimRight(firstForwarded(r, "X-Forwarded-Prefix"), "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	return
+}
+
+// Path the browser sees Thing's routes under: the proxy's prefix, if any,
+// and Cfg.BasePath
+func (t *Thing) basePath(r *http.Request) string {
+	_, _, prefix := t.forwarded(r)
+	return prefix + t.Cfg.BasePath
+}
+
+// Address of the browser.  Behind a trusted proxy, the last address in
+// X-Forwarded-For, which the proxy appended; the client can forge those
+// before it.  Further TrustedProxies in a chain of proxies are skipped.
+func (t *Thing) clientAddr(r *http.Request) string {
+	if !t.fromProxy(r) {
+		return r.RemoteAddr
+	}
+
+	fwd := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	addrs := strings.Split(fwd, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if addr == "" {
+			continue
+		}
+		if i > 0 && t.proxies != nil && t.proxies.allowed(net.ParseIP(addr)) {
+			continue
+		}
+		return addr
+	}
+
+	return r.RemoteAddr
+}
+
+// Client's IP, without the port
+func (t *Thing) clientIP(r *http.Request) string {
+	addr := t.clientAddr(r)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Request's Origin (or Referer) matches the host the browser asked for
+func (t *Thing) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	_, host, _ := t.forwarded(r)
+	return strings.EqualFold(u.Host, host)
+}
+
+// WebSocket upgrades are allowed from Thing's own pages, or from clients
+// that aren't browsers and send no Origin
+func (t *Thing) checkOrigin(r *http.Request) bool {
+	if r.Header.Get("Origin") == "" {
+		return true
+	}
+	return t.sameOrigin(r)
+}
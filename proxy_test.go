@@ -0,0 +1,87 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustProxy(t *testing.T) {
+	thing := NewThing(&toggler{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/"+testId, nil)
+	r.Host = "127.0.0.1:8080"
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "things.example.com, 127.0.0.1")
+	r.Header.Set("X-Forwarded-Prefix", "/garage/")
+	r.Header.Set("X-Forwarded-For", "10.9.9.9, 203.0.113.7")
+	r.Header.Set("Origin", "https://things.example.com")
+
+	check := func(host, ws, client string, origin bool) {
+		t.Helper()
+		params := thing.templateParams(r)
+		if params["Host"] != host {
+			t.Errorf("Host %v, want %s", params["Host"], host)
+		}
+		if params["WebSocket"] != template.JSStr(ws) {
+			t.Errorf("WebSocket %v, want %s", params["WebSocket"], ws)
+		}
+		if addr := thing.clientAddr(r); addr != client {
+			t.Errorf("Client %s, want %s", addr, client)
+		}
+		if ok := thing.checkOrigin(r); ok != origin {
+			t.Errorf("Origin allowed %t, want %t", ok, origin)
+		}
+	}
+
+	// Headers are ignored unless the proxy is trusted
+	check("127.0.0.1:8080", "ws://127.0.0.1:8080/ws/"+testId,
+		"10.0.0.1:4321", false)
+
+	thing.Cfg.TrustProxy = true
+	check("things.example.com", "wss://things.example.com/garage/ws/"+testId,
+		"203.0.113.7", true)
+
+	// Not a browser
+	r.Header.Del("Origin")
+	if !thing.checkOrigin(r) {
+		t.Error("Upgrade without Origin refused")
+	}
+
+	// Bogus scheme is ignored
+	r.Header.Set("X-Forwarded-Proto", "gopher")
+	if scheme, _, _ := thing.forwarded(r); scheme != "http" {
+		t.Errorf("Scheme %s", scheme)
+	}
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("Origin", "https://things.example.com")
+
+	// Only TrustedProxies are trusted, and are skipped in the chain
+	thing.Cfg.TrustedProxies = []string{"10.0.0.0/24"}
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Forwarded-For", "10.9.9.9, 203.0.113.7, 10.0.0.2")
+	check("things.example.com", "wss://things.example.com/garage/ws/"+testId,
+		"203.0.113.7", true)
+	r.RemoteAddr = "192.168.1.1:4321"
+	check("127.0.0.1:8080", "ws://127.0.0.1:8080/ws/"+testId,
+		"192.168.1.1:4321", false)
+
+	thing.Cfg.TrustedProxies = []string{"proxy"}
+	if err := thing.build(false); ErrorCode(err) != ErrBadConfig.Code {
+		t.Errorf("Bad trusted proxy: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pause between replays of a recording
+const replayPause = time.Second
+
+// A recorded message.  Offset is milliseconds since the recording started.
+type recording struct {
+	Offset int64
+	Msg    json.RawMessage
+}
+
+// Recorder of hardware-originated messages, with timing, to Cfg.RecordFile.
+// A message is hardware-originated if the Thinger broadcasts it from CmdRun,
+// rather than in reply to a client, and it's the model's message rather than
+// a system message (Msg starting with "_").  The recording is one JSON
+// record per line.
+//
+// Replay the recording in demo mode with Cfg.ReplayFile.
+type recorder struct {
+	sync.Mutex
+	thing *Thing
+	file  string
+	f     *os.File
+	w     *bufio.Writer
+	began time.Time
+}
+
+func newRecorder(thing *Thing, file string) *recorder {
+	return &recorder{thing: thing, file: file}
+}
+
+func (r *recorder) start() error {
+	f, err := os.Create(r.file)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.f, r.w = f, bufio.NewWriter(f)
+	r.began = time.Now()
+	r.Unlock()
+
+	r.thing.log.println("Recording to", r.file)
+	return nil
+}
+
+func (r *recorder) stop() {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.f == nil {
+		return
+	}
+	r.w.Flush()
+	r.f.Close()
+	r.f, r.w = nil, nil
+}
+
+// Bus tap
+func (r *recorder) tap(p *Packet) {
+	var msg Msg
+
+	if p.src != nil {
+		return
+	}
+	p.Unmarshal(&msg)
+	if strings.HasPrefix(msg.Msg, "_") {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.w == nil {
+		return
+	}
+
+	rec := recording{
+		Offset: time.Since(r.began).Milliseconds(),
+		Msg:    append(json.RawMessage(nil), p.msg...),
+	}
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		return
+	}
+	r.w.Write(append(data, '\n'))
+
+	// Flush as we go, so a recording cut short by a crash is still good
+	if err := r.w.Flush(); err != nil {
+		r.thing.log.println("Recording failed:", err)
+	}
+}
+
+// Replayer of a recording made with Cfg.RecordFile, in a loop, at the
+// recorded pace.  Each message goes to the Thinger's subscriber for the
+// message, as on Thing Prime, so the subscriber can update Thing's state and
+// broadcast the message.  A message with no subscriber is broadcast as is.
+type replayer struct {
+	thing *Thing
+	file  string
+	recs  []recording
+	done  chan bool
+}
+
+func newReplayer(thing *Thing, file string) *replayer {
+	return &replayer{thing: thing, file: file}
+}
+
+func loadRecording(file string) ([]recording, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []recording
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var rec recording
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, line, err)
+		}
+		recs = append(recs, rec)
+	}
+
+	return recs, scanner.Err()
+}
+
+func (r *replayer) play(rec recording) {
+	b := r.thing.bus
+	p := &Packet{bus: b, msg: rec.Msg}
+
+	var msg Msg
+	p.Unmarshal(&msg)
+
+	if _, ok := b.lookup(msg.Msg); ok {
+		b.receive(p)
+	} else {
+		b.broadcast(p)
+	}
+}
+
+func (r *replayer) start() error {
+	recs, err := loadRecording(r.file)
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		return fmt.Errorf("Nothing recorded in %s", r.file)
+	}
+
+	r.recs = recs
+	r.done = make(chan bool)
+
+	r.thing.log.printf("Replaying %d message(s) from %s", len(recs), r.file)
+
+	go func() {
+		for {
+			start := time.Now()
+			for _, rec := range r.recs {
+				wait := time.Until(start.Add(
+					time.Duration(rec.Offset) * time.Millisecond))
+				select {
+				case <-r.done:
+					return
+				case <-time.After(wait):
+				}
+				r.play(rec)
+			}
+			// Pause between loops
+			select {
+			case <-r.done:
+				return
+			case <-time.After(replayPause):
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *replayer) stop() {
+	close(r.done)
+}
@@ -0,0 +1,90 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type sensor struct {
+	updates chan string
+}
+
+func (s *sensor) update(p *Packet) {
+	s.updates <- p.String()
+}
+
+func (s *sensor) Subscribers() Subscribers {
+	return Subscribers{"Update": s.update}
+}
+
+func (s *sensor) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "recording")
+
+	thing := NewThing(&sensor{})
+	thing.Cfg.Id = testId
+	thing.Cfg.RecordFile = file
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := thing.recorder.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	update := struct {
+		Msg   string
+		Level int
+	}{"Update", 7}
+
+	// Only the Thinger's own model messages are recorded
+	thing.bus.broadcast(newPacket(thing.bus, nil, &update))
+	thing.bus.broadcast(newPacket(thing.bus, nil, &Msg{Msg: EventInput}))
+	thing.bus.broadcast(newPacket(thing.bus, &recordSocket{}, &update))
+	thing.recorder.stop()
+
+	recs, err := loadRecording(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || string(recs[0].Msg) != `{"Msg":"Update","Level":7}` {
+		t.Fatalf("Recorded %+v", recs)
+	}
+
+	state := &sensor{updates: make(chan string, 1)}
+	thing = NewThing(state)
+	thing.Cfg.Id = testId
+	thing.Cfg.ReplayFile = file
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := thing.replayer.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer thing.replayer.stop()
+
+	select {
+	case msg := <-state.updates:
+		if msg != `{"Msg":"Update","Level":7}` {
+			t.Errorf("Replayed %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("Nothing replayed")
+	}
+}
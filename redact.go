@@ -0,0 +1,170 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Redaction actions
+const (
+	// Drop the field
+	RedactDrop = "drop"
+	// Replace the field with a keyed hash (HMAC-SHA256) of the field.
+	// The same value always hashes the same, so hashed values can still
+	// be matched upstream, but can't be read.
+	RedactHash = "hash"
+	// Round a numeric field to Digits decimal places, e.g. to reduce GPS
+	// precision
+	RedactRound = "round"
+)
+
+// A RedactRule redacts a message field before the message leaves Thing: for
+// mother, and for the services Thing sends its broadcasts to (see Archive,
+// Influx, Webhooks, Shadow, and LoRa).  Messages to other listeners (e.g.
+// browsers on Thing's LAN) are not redacted.
+//
+// For example, to reduce GPS precision to about 1km and hide a MAC address
+// upstream:
+//
+//	thing.Cfg.Redact = []merle.RedactRule{
+//		{Msg: "Update", Field: "Lat", Action: merle.RedactRound, Digits: 2},
+//		{Msg: "Update", Field: "Long", Action: merle.RedactRound, Digits: 2},
+//		{Field: "Station.MAC", Action: merle.RedactHash},
+//	}
+type RedactRule struct {
+	// Message type to redact.  If empty, all messages match.
+	Msg string
+	// Field to redact.  Nested fields are separated with a ".".
+	Field string
+	// Action is one of RedactDrop, RedactHash, or RedactRound
+	Action string
+	// Decimal places kept for RedactRound
+	Digits uint
+}
+
+type redactor struct {
+	rules []RedactRule
+	key   []byte
+}
+
+func newRedactor(rules []RedactRule, key string) (*redactor, error) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case RedactDrop, RedactHash, RedactRound:
+		default:
+			return nil, fmt.Errorf("Unknown redact action \"%s\"", rule.Action)
+		}
+		if rule.Field == "" {
+			return nil, fmt.Errorf("Redact rule missing Field")
+		}
+	}
+	return &redactor{rules: rules, key: []byte(key)}, nil
+}
+
+func (r *redactor) hash(v interface{}) string {
+	h := hmac.New(sha256.New, r.key)
+	fmt.Fprint(h, v)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Apply rule to the field at path in m.  Returns true if the field was
+// redacted.
+func (r *redactor) apply(m map[string]interface{}, path []string, rule *RedactRule) bool {
+	v, ok := m[path[0]]
+	if !ok {
+		return false
+	}
+
+	if len(path) > 1 {
+		if sub, ok := v.(map[string]interface{}); ok {
+			return r.apply(sub, path[1:], rule)
+		}
+		return false
+	}
+
+	switch rule.Action {
+	case RedactDrop:
+		delete(m, path[0])
+	case RedactHash:
+		m[path[0]] = r.hash(v)
+	case RedactRound:
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return false
+		}
+		scale := math.Pow(10, float64(rule.Digits))
+		m[path[0]] = math.Round(f*scale) / scale
+	}
+	return true
+}
+
+// Redact the message.  The original message is returned if no field is
+// redacted.  Numbers are decoded as json.Number, so numbers not redacted
+// pass through as-is, without losing precision.
+func (r *redactor) redact(msg []byte) []byte {
+	var m map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return msg
+	}
+
+	typ, _ := m["Msg"].(string)
+	redacted := false
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.Msg != "" && rule.Msg != typ {
+			continue
+		}
+		if r.apply(m, strings.Split(rule.Field, "."), rule) {
+			redacted = true
+		}
+	}
+
+	if !redacted {
+		return msg
+	}
+
+	out, err := json.Marshal(m)
+	if err != nil {
+		return msg
+	}
+
+	return out
+}
+
+// Redact msg leaving Thing.  Every message leaving Thing, for mother or for
+// an egress tap, is redacted here.
+func (t *Thing) redactMsg(msg []byte) []byte {
+	if t.redactor == nil {
+		return msg
+	}
+	return t.redactor.redact(msg)
+}
+
+// Redacted copy of p, for egress taps
+func (t *Thing) redact(p *Packet) *Packet {
+	if t.redactor == nil {
+		return p
+	}
+	return &Packet{bus: p.bus, src: p.src, msg: t.redactMsg(p.msg)}
+}
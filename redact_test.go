@@ -0,0 +1,69 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r, err := newRedactor([]RedactRule{
+		{Msg: "Update", Field: "Lat", Action: RedactRound, Digits: 2},
+		{Field: "Station.MAC", Action: RedactHash},
+		{Msg: "Update", Field: "Secret", Action: RedactDrop},
+	}, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte(`{"Msg":"Update","Lat":45.12345,"Secret":"x","Count":9007199254740993}`)
+	got := string(r.redact(msg))
+	want := `{"Count":9007199254740993,"Lat":45.12,"Msg":"Update"}`
+	if got != want {
+		t.Errorf("Got %s, want %s", got, want)
+	}
+
+	// Untouched if no field is redacted
+	msg = []byte(`{"Msg":"Other",  "Lat":45.12345}`)
+	if got := r.redact(msg); &got[0] != &msg[0] {
+		t.Errorf("Re-marshaled %s", got)
+	}
+
+	got = string(r.redact([]byte(`{"Msg":"Other","Station":{"MAC":"00:16:3e:30:e5:f5"}}`)))
+	if strings.Contains(got, "00:16") || !strings.Contains(got, `"MAC":"`) {
+		t.Errorf("Hashed %s", got)
+	}
+
+	if _, err := newRedactor([]RedactRule{{Field: "A", Action: "blur"}}, ""); err == nil {
+		t.Errorf("Unknown action allowed")
+	}
+}
+
+func TestRedactEgress(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Redact = []RedactRule{{Field: "Lat", Action: RedactDrop}}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	var local, egress string
+	thing.bus.tap(func(p *Packet) { local = p.String() })
+	thing.bus.tapEgress(func(p *Packet) { egress = p.String() })
+
+	thing.bus.broadcast(newPacket(thing.bus, nil,
+		&struct{ Msg, Lat string }{"Update", "45.1"}))
+
+	if !strings.Contains(local, "Lat") {
+		t.Errorf("Local tap got %s", local)
+	}
+	if egress != `{"Msg":"Update"}` {
+		t.Errorf("Egress tap got %s", egress)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Registry of the Things known to Thing Prime, or to a bridge (see
+// Cfg.RegistryFile).  Entries outlive the connection, so Things that have
+// gone away are still known.
+type registry struct {
+	thing *Thing
+	sync.Mutex
+	store   Store
+	entries map[string]*RegistryEntry
+}
+
+func newRegistry(thing *Thing, store Store) *registry {
+	return &registry{
+		thing:   thing,
+		store:   store,
+		entries: make(map[string]*RegistryEntry),
+	}
+}
+
+// SetRegistryStore sets the Store used to persist the registry of Things
+// known to Thing Prime, or to a bridge.  SetRegistryStore overrides
+// Cfg.RegistryFile.  Call SetRegistryStore before thing.Run().
+func (t *Thing) SetRegistryStore(s Store) {
+	t.regStore = s
+}
+
+// Load the registry from the Store.  No Thing is connected yet.
+func (r *registry) load() error {
+	r.Lock()
+	defer r.Unlock()
+
+	var entries []RegistryEntry
+	if err := r.store.Load(&entries); err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].Online = false
+		r.entries[entries[i].Id] = &entries[i]
+	}
+	return nil
+}
+
+// Entries, sorted by Id.  Call with lock held.
+func (r *registry) sorted() []RegistryEntry {
+	entries := make([]RegistryEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id < entries[j].Id
+	})
+	return entries
+}
+
+// Save the registry.  Call with lock held.
+func (r *registry) save() {
+	entries := r.sorted()
+	if err := r.store.Save(&entries); err != nil {
+		r.thing.log.println("Saving registry failed:", err)
+	}
+}
+
+// Thing identified itself with msg on connecting
+func (r *registry) seen(msg *MsgIdentity) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+
+	e := r.entries[msg.Id]
+	if e == nil {
+		e = &RegistryEntry{Id: msg.Id, FirstSeen: now}
+		r.entries[msg.Id] = e
+		r.thing.log.printf("Registered [%s]", msg.Id)
+	}
+
+	e.Model = msg.Model
+	e.Name = msg.Name
+	e.Tags = msg.Tags
+	e.Version = msg.Version
+	e.LastSeen = now
+	e.Online = true
+
+	r.save()
+}
+
+// Thing id disconnected
+func (r *registry) gone(id string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if e := r.entries[id]; e != nil {
+		e.LastSeen = time.Now()
+		e.Online = false
+		r.save()
+	}
+}
+
+// Entries, with LastSeen now for Things connected
+func (r *registry) list() []RegistryEntry {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	entries := r.sorted()
+	for i := range entries {
+		if entries[i].Online {
+			entries[i].LastSeen = now
+		}
+	}
+	return entries
+}
+
+func (r *registry) get(id string) (RegistryEntry, bool) {
+	for _, e := range r.list() {
+		if e.Id == id {
+			return e, true
+		}
+	}
+	return RegistryEntry{}, false
+}
+
+// Do registry edit, one of SetRegistryNotes or DeleteRegistry
+func (r *registry) edit(msg *MsgRegistryEdit) error {
+	r.Lock()
+	defer r.Unlock()
+
+	e := r.entries[msg.Id]
+	if e == nil {
+		return fmt.Errorf("Thing [%s] not in registry", msg.Id)
+	}
+
+	switch msg.Msg {
+	case SetRegistryNotes:
+		e.Notes = msg.Notes
+	case DeleteRegistry:
+		if e.Online {
+			return fmt.Errorf("Thing [%s] is connected", msg.Id)
+		}
+		delete(r.entries, msg.Id)
+		r.thing.log.printf("Unregistered [%s]", msg.Id)
+	default:
+		return fmt.Errorf("Unknown registry op %s", msg.Msg)
+	}
+
+	r.save()
+	return nil
+}
+
+func (r *registry) reply() MsgRegistry {
+	return MsgRegistry{Msg: ReplyRegistry, Entries: r.list()}
+}
+
+// Subscriber handler for GetRegistry, SetRegistryNotes, and DeleteRegistry.
+// Only handled on the private HTTP server.
+func (r *registry) manage(p *Packet) {
+	if p.src == nil || p.src.Flags()&sock_flag_private == 0 {
+		r.thing.log.println("Ignoring registry; not on private server")
+		return
+	}
+
+	var msg MsgRegistryEdit
+	p.Unmarshal(&msg)
+
+	if msg.Msg != GetRegistry {
+		if err := r.edit(&msg); err != nil {
+			r.thing.log.println("Registry edit failed:", err)
+		}
+	}
+
+	resp := r.reply()
+	p.Marshal(&resp).Reply()
+}
+
+func (r *registry) registryHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.reply())
+}
+
+// GET the entry for id, POST form value notes to set its Notes, or DELETE
+// it.  POST and DELETE from another origin's pages are refused.
+func (r *registry) entryHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	var msg MsgRegistryEdit
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		msg = MsgRegistryEdit{Msg: SetRegistryNotes, Id: id,
+			Notes: req.FormValue("notes")}
+	case "DELETE":
+		msg = MsgRegistryEdit{Msg: DeleteRegistry, Id: id}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if msg.Msg != "" && !r.thing.checkOrigin(req) {
+		http.Error(w, "Cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	if _, ok := r.get(id); !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	if msg.Msg != "" {
+		if err := r.edit(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	if msg.Msg == DeleteRegistry {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	e, _ := r.get(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&e)
+}
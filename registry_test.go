@@ -0,0 +1,145 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "registry")
+
+	newPrime := func() *Thing {
+		prime := NewThing(&toggler{})
+		prime.Cfg.Id = testId
+		prime.Cfg.IsPrime = true
+		prime.Cfg.RegistryFile = file
+		if err := prime.build(true); err != nil {
+			t.Fatal(err)
+		}
+		return prime
+	}
+	prime := newPrime()
+
+	identity := MsgIdentity{Msg: ReplyIdentity, Id: "relay_1", Model: "Thing",
+		Name: "garage", Tags: []string{"north"}, Version: "1.2.0"}
+	if err := prime.primeIdentity(&identity); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(flags uint32, req MsgRegistryEdit) []RegistryEntry {
+		t.Helper()
+		rec := &recordSocket{flags: flags}
+		prime.bus.receive(newPacket(prime.bus, rec, &req))
+		if len(rec.sent) == 0 {
+			return nil
+		}
+		var reply MsgRegistry
+		json.Unmarshal([]byte(rec.sent[0]), &reply)
+		return reply.Entries
+	}
+
+	entries := get(sock_flag_private, MsgRegistryEdit{Msg: GetRegistry})
+	if len(entries) != 1 || entries[0].Id != "relay_1" ||
+		entries[0].Version != "1.2.0" || entries[0].Tags[0] != "north" ||
+		!entries[0].Online || entries[0].FirstSeen.IsZero() {
+		t.Fatalf("Got %+v", entries)
+	}
+
+	// Only on the private server
+	if entries = get(0, MsgRegistryEdit{Msg: GetRegistry}); entries != nil {
+		t.Errorf("Public got %+v", entries)
+	}
+	get(0, MsgRegistryEdit{Msg: SetRegistryNotes, Id: "relay_1", Notes: "x"})
+
+	entries = get(sock_flag_private, MsgRegistryEdit{Msg: SetRegistryNotes,
+		Id: "relay_1", Notes: "behind the door"})
+	if entries[0].Notes != "behind the door" {
+		t.Errorf("Notes %q", entries[0].Notes)
+	}
+
+	// Connected Things can't be forgotten
+	entries = get(sock_flag_private, MsgRegistryEdit{Msg: DeleteRegistry,
+		Id: "relay_1"})
+	if len(entries) != 1 {
+		t.Errorf("Deleted connected Thing")
+	}
+
+	// Gone, but still known, after restart
+	prime.primeCleanup(prime)
+	prime = newPrime()
+	entries = prime.registry.list()
+	if len(entries) != 1 || entries[0].Online ||
+		entries[0].Notes != "behind the door" ||
+		entries[0].LastSeen.Before(entries[0].FirstSeen) {
+		t.Fatalf("Reloaded %+v", entries)
+	}
+	first := entries[0].FirstSeen
+
+	identity.Version = "1.3.0"
+	prime.primeIdentity(&identity)
+	entries = prime.registry.list()
+	if entries[0].Version != "1.3.0" || !entries[0].FirstSeen.Equal(first) {
+		t.Errorf("Seen again %+v", entries[0])
+	}
+	prime.primeCleanup(prime)
+
+	// REST on the private server
+	srv := httptest.NewServer(prime.web.private.mux)
+	defer srv.Close()
+
+	resp, err := http.PostForm(srv.URL+"/registry/relay_1",
+		url.Values{"notes": {"moved"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e RegistryEntry
+	json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || e.Notes != "moved" {
+		t.Errorf("POST got %d %+v", resp.StatusCode, e)
+	}
+
+	resp, _ = http.Get(srv.URL + "/registry/nobody")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET nobody got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("DELETE", srv.URL+"/registry/relay_1", nil)
+	req.Header.Set("Origin", "http://evil.example")
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Cross-origin DELETE got %d", resp.StatusCode)
+	}
+
+	req.Header.Del("Origin")
+	resp, _ = http.DefaultClient.Do(req)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE got %d", resp.StatusCode)
+	}
+
+	resp, _ = http.Get(srv.URL + "/registry")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"Entries":[]`) {
+		t.Errorf("GET got %s", body)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reload re-reads Thing's Configurators (see AddConfig), layered over Thing's
+// config template from mother (see Cfg.ConfigTemplates), and applies the
+// reloadable config items to the running Thing.  Websockets and the tunnel to
+// mother stay up.  The reloadable items are:
+//
+//	User                        basic authentication user
+//	TLSCertFile, TLSKeyFile     public HTTPS server certificate
+//	LoggingEnabled              logging
+//
+// Also, if Thing is a bridge, the bridge match rules are refreshed by calling
+// the Bridger's BridgeThingers(), and, if Thing has an AuthStore, users,
+// tokens, and tenants are reloaded from the AuthStore.
+//
+// The reloaded config is swapped in whole, once every item is applied; if an
+// item fails, such as a bad certificate, Thing keeps its config as it was.
+// Other config items changed since Thing started are ignored until Thing
+// restarts.  Reload is called when Thing receives a SIGHUP, a POST to
+// /reload on Thing's private HTTP server, or a new config template from
+// mother.
+func (t *Thing) Reload() error {
+	cfg, err := t.layeredCfg()
+	if err != nil {
+		t.log.println("Reloading config failed:", err)
+		return err
+	}
+
+	// Let mother know if config now drifts from template
+	defer t.sendConfigDrift()
+
+	next := t.config()
+	next.LoggingEnabled = cfg.LoggingEnabled
+	next.User = cfg.User
+	next.TLSCertFile = cfg.TLSCertFile
+	next.TLSKeyFile = cfg.TLSKeyFile
+
+	// Reload cert files even if paths didn't change; the cert may have
+	// been renewed in place
+	err = t.web.public.setCertFiles(next.TLSCertFile, next.TLSKeyFile)
+	if err != nil {
+		t.log.println("Reloading TLS certificate failed:", err)
+		return err
+	}
+	t.web.public.setUser(next.User)
+	t.log.setEnabled(next.LoggingEnabled)
+
+	t.cfgLock.Lock()
+	t.Cfg = next
+	t.cfgLock.Unlock()
+
+	if t.isBridge {
+		t.bridge.reloadThingers()
+	}
+
+	if t.auth != nil {
+		if err := t.auth.load(); err != nil {
+			t.log.println("Reloading auth failed:", err)
+			return err
+		}
+	}
+
+	t.log.println("Config reloaded")
+
+	return nil
+}
+
+// Thing's config, as last configured or reloaded
+func (t *Thing) config() ThingConfig {
+	t.cfgLock.RLock()
+	defer t.cfgLock.RUnlock()
+	return t.Cfg
+}
+
+// Reload config on SIGHUP
+func (t *Thing) startReload() error {
+	t.reload = make(chan os.Signal, 1)
+	signal.Notify(t.reload, syscall.SIGHUP)
+
+	go func() {
+		for range t.reload {
+			t.Reload()
+		}
+	}()
+
+	return nil
+}
+
+func (t *Thing) stopReload() {
+	signal.Stop(t.reload)
+	close(t.reload)
+}
+
+// Reload config on POST to /reload
+func (t *Thing) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := t.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
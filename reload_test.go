@@ -0,0 +1,71 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "thing.json")
+	write := func(data string) {
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"User": "alice", "PortPublic": 8080}`)
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.AddConfig(NewJSONConfig(file))
+	if err := thing.configure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	write(`{"User": "bob", "PortPublic": 9090, "LoggingEnabled": false}`)
+
+	if err := thing.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if user := thing.web.public.getUser(); user != "bob" {
+		t.Errorf("Got user %s, want bob", user)
+	}
+	if thing.log.isEnabled() {
+		t.Errorf("Logging still enabled")
+	}
+	// Not reloadable
+	if thing.Cfg.PortPublic != 8080 {
+		t.Errorf("PortPublic changed on reload")
+	}
+
+	write(`{"TLSCertFile": "missing.crt", "TLSKeyFile": "missing.key"}`)
+
+	if err := thing.Reload(); err == nil {
+		t.Errorf("Reload with missing cert should fail")
+	}
+	// Nothing applied from the failed reload
+	if user := thing.web.public.getUser(); user != "bob" ||
+		thing.Cfg.User != "bob" || thing.Cfg.TLSCertFile != "" {
+		t.Errorf("Failed reload applied user %q, cert %q", user,
+			thing.Cfg.TLSCertFile)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ConfigReport is Thing's configuration as running: which servers are
+// active, how clients authenticate, where TLS certificates come from, and
+// where Thing tunnels to, with warnings about configurations that start but
+// likely don't work.  Thing logs the report on start, and serves it from
+// the private HTTP server's /config endpoint.
+type ConfigReport struct {
+	Id    string
+	Model string
+	Name  string
+	Prime bool
+	// Active servers
+	Servers []ServerReport
+	// Public server authentication: "none", "basic" (Cfg.User), or
+	// "store" (Cfg.AuthFile)
+	Auth string
+	// Public HTTPS certificate: "off", "file" (Cfg.TLSCertFile), or
+	// "letsencrypt"
+	TLS string
+	// Tunnel target, "user@host:port", or "hints" for Cfg.MotherHints;
+	// "" if no mother
+	Mother        string `json:",omitempty"`
+	MotherStandby string `json:",omitempty"`
+	Warnings      []string
+	// Effective config, with secrets masked
+	Cfg ThingConfig
+}
+
+// ServerReport is an active server in ConfigReport
+type ServerReport struct {
+	Name string
+	Port uint
+	// Bind addresses; none is all interfaces
+	Bind []string `json:",omitempty"`
+}
+
+// Secret items in cfg, masked in reports.  Webhooks' and Rules' secrets are
+// within their slices.
+func cfgSecrets(cfg *ThingConfig) []*string {
+	return []*string{&cfg.RedactKey, &cfg.BootToken,
+		&cfg.WebhookSecret,
+		&cfg.E2E.Key, &cfg.Claim.Code,
+		&cfg.Archive.AccessKey, &cfg.Archive.SecretKey,
+		&cfg.Influx.Token, &cfg.Notifications.SMTP.Password,
+		&cfg.Notifications.Twilio.AuthToken,
+		&cfg.Notifications.WebPush.PrivateKey}
+}
+
+// ConfigReport reports Thing's configuration as running.  Call after Run
+// starts Thing.
+func (t *Thing) ConfigReport() ConfigReport {
+	cfg := t.config()
+	for _, secret := range cfgSecrets(&cfg) {
+		if *secret != "" {
+			*secret = "*****"
+		}
+	}
+	cfg.Webhooks = append([]WebhookConfig(nil), cfg.Webhooks...)
+	for i := range cfg.Webhooks {
+		if cfg.Webhooks[i].Secret != "" {
+			cfg.Webhooks[i].Secret = "*****"
+		}
+	}
+	cfg.Rules = append([]Rule(nil), cfg.Rules...)
+	for i := range cfg.Rules {
+		if cfg.Rules[i].Webhook.Secret != "" {
+			cfg.Rules[i].Webhook.Secret = "*****"
+		}
+	}
+
+	r := ConfigReport{
+		Id:       t.id,
+		Model:    t.model,
+		Name:     t.name,
+		Prime:    t.isPrime,
+		Servers:  []ServerReport{},
+		Auth:     "none",
+		TLS:      "off",
+		Warnings: t.misconfigs(),
+		Cfg:      cfg,
+	}
+
+	if w := t.web; w != nil {
+		if w.public.port != 0 {
+			r.Servers = append(r.Servers, ServerReport{"public",
+				w.public.port, w.public.bind})
+			if w.public.portTLS != 0 {
+				r.Servers = append(r.Servers, ServerReport{"public TLS",
+					w.public.portTLS, w.public.bindTLS})
+			}
+		}
+		// The private server's port is picked on start, if zero
+		if w.private.port != 0 {
+			r.Servers = append(r.Servers, ServerReport{"private",
+				w.private.port, w.private.bind})
+		}
+	}
+	if t.primePort != nil {
+		r.Servers = append(r.Servers, ServerReport{"prime",
+			t.primePort.port, nil})
+	}
+
+	switch {
+	case t.auth != nil:
+		r.Auth = "store"
+	case cfg.User != "":
+		r.Auth = "basic"
+	}
+
+	switch {
+	case cfg.PortPublicTLS == 0:
+	case cfg.TLSCertFile != "":
+		r.TLS = "file"
+	default:
+		r.TLS = "letsencrypt"
+	}
+
+	if len(t.Cfg.MotherHints) > 0 {
+		r.Mother = "hints"
+	} else if t.Cfg.MotherHost != "" {
+		r.Mother = fmt.Sprintf("%s@%s:%d", t.Cfg.MotherUser,
+			t.Cfg.MotherHost, t.Cfg.MotherPortPrivate)
+		if t.Cfg.MotherHostStandby != "" {
+			r.MotherStandby = fmt.Sprintf("%s@%s:%d", t.Cfg.MotherUser,
+				t.Cfg.MotherHostStandby, t.Cfg.MotherPortPrivate)
+		}
+	}
+
+	return r
+}
+
+// Configurations that start, but likely don't do what was meant
+func (t *Thing) misconfigs() []string {
+	c := t.config()
+	cfg := &c
+	hasMother := cfg.MotherHost != "" || len(cfg.MotherHints) > 0
+	warnings := []string{}
+
+	warn := func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}
+
+	if cfg.PortPublicTLS != 0 && cfg.PortPublic == 0 {
+		warn("PortPublicTLS is set, but PortPublic isn't; the public " +
+			"HTTPS server only runs with the public HTTP server")
+	}
+
+	if cfg.PortPublicTLS != 0 && cfg.TLSCertFile == "" {
+		host, _ := os.Hostname()
+		if !strings.Contains(host, ".") {
+			warn("PortPublicTLS is set without TLSCertFile, so the "+
+				"certificate comes from Let's Encrypt, which needs a "+
+				"public DNS name; host name \"%s\" isn't one", host)
+		}
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		warn("TLSCertFile and TLSKeyFile must be given together")
+	}
+
+	if cfg.IsPrime && hasMother {
+		warn("IsPrime is set, but so is a mother (MotherHost or " +
+			"MotherHints); Thing Prime doesn't tunnel to a mother")
+	}
+
+	if !cfg.IsPrime && cfg.PortPublic == 0 && cfg.PortPublicTLS == 0 &&
+		cfg.PortPrivate == 0 && !hasMother {
+		warn("No ports are set and there's no mother, so nothing can " +
+			"reach Thing; set PortPublic or PortPrivate")
+	}
+
+	if cfg.PortPublic != 0 && cfg.User == "" && cfg.AuthFile == "" &&
+		t.authStore == nil {
+		warn("The public server has no authentication; anyone who "+
+			"can reach port %d can control Thing", cfg.PortPublic)
+	}
+
+	if cfg.MotherHost != "" && cfg.MotherUser == "" {
+		warn("MotherHost is set without MotherUser; the tunnel to " +
+			"mother won't start")
+	}
+
+	return warnings
+}
+
+// Log the configuration report, once Thing starts
+func (t *Thing) logConfigReport() {
+	r := t.ConfigReport()
+
+	servers := []string{}
+	for _, s := range r.Servers {
+		servers = append(servers, fmt.Sprintf("%s:%d", s.Name, s.Port))
+	}
+	t.log.printf("Config: servers [%s], auth %s, TLS %s, mother \"%s\"",
+		strings.Join(servers, " "), r.Auth, r.TLS, r.Mother)
+
+	for _, warning := range r.Warnings {
+		t.log.println("Config warning:", warning)
+	}
+}
+
+// Serve the configuration report, as JSON
+func (t *Thing) configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.ConfigReport())
+}
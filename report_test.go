@@ -0,0 +1,88 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConfigReport(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	thing.Cfg.PortPublicTLS = 8443
+	thing.Cfg.TLSCertFile = "cert.pem"
+	thing.Cfg.User = "merle"
+	thing.Cfg.MotherHost = "mother.example.com"
+	thing.Cfg.MotherUser = "tunnel"
+	thing.Cfg.RedactKey = "secret"
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/config", nil)
+	w := httptest.NewRecorder()
+	thing.configHandler(w, req)
+
+	var r ConfigReport
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Servers) != 2 || r.Servers[0].Port != 8080 ||
+		r.Servers[1].Port != 8443 {
+		t.Errorf("Servers %+v", r.Servers)
+	}
+	if r.Auth != "basic" || r.TLS != "file" {
+		t.Errorf("Auth %s, TLS %s", r.Auth, r.TLS)
+	}
+	if r.Mother != "tunnel@mother.example.com:8080" {
+		t.Errorf("Mother %s", r.Mother)
+	}
+	if r.Cfg.RedactKey == "secret" {
+		t.Errorf("RedactKey not masked")
+	}
+	if len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "TLSKeyFile") {
+		t.Errorf("Warnings %q", r.Warnings)
+	}
+}
+
+func TestMisconfigs(t *testing.T) {
+	tests := []struct {
+		cfg  func(*ThingConfig)
+		want string
+	}{
+		{func(c *ThingConfig) {}, "No ports"},
+		{func(c *ThingConfig) { c.PortPublic = 80 }, "no authentication"},
+		{func(c *ThingConfig) {
+			c.PortPublicTLS, c.TLSCertFile, c.TLSKeyFile = 443, "c", "k"
+		}, "only runs with the public HTTP server"},
+		{func(c *ThingConfig) {
+			c.IsPrime, c.MotherHost, c.MotherUser = true, "mother", "me"
+		}, "Thing Prime doesn't tunnel"},
+		{func(c *ThingConfig) { c.MotherHost = "mother" }, "MotherUser"},
+		{func(c *ThingConfig) { c.PortPrivate = 8080 }, ""},
+	}
+
+	for _, test := range tests {
+		thing := NewThing(&sparse{})
+		test.cfg(&thing.Cfg)
+
+		warnings := thing.misconfigs()
+		switch {
+		case test.want == "" && len(warnings) != 0:
+			t.Errorf("Unexpected warnings %q", warnings)
+		case test.want != "" && (len(warnings) != 1 ||
+			!strings.Contains(warnings[0], test.want)):
+			t.Errorf("Warnings %q, want %q", warnings, test.want)
+		}
+	}
+}
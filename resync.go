@@ -0,0 +1,87 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+// Resync mother on (re)connect.  Mother asks for Thing's state with
+// GetState, and Thing's reply, in p, starts the resync.  Mother gets, in
+// order:
+//
+//  1. The outbox: messages broadcast while mother was away.  StatePatches
+//     are dropped, as the snapshot supersedes them.
+//  2. The ReplyState snapshot.
+//  3. EventResync, with the resync's Seq, the number of outbox Events
+//     replayed, and Thing's StatePatch Version, so mother's next patch
+//     follows on from the snapshot.
+//
+// Mother acks with ResyncAck, and only then are the replayed messages
+// dropped from the outbox.  Broadcasts are held off until the resync is
+// sent, so mother misses nothing in between.
+func (b *bus) resync(p *Packet) {
+	sock := p.src
+
+	b.sockLock.Lock()
+	defer b.sockLock.Unlock()
+
+	b.resyncSeq++
+	msg := MsgEventResync{Msg: EventResync, Seq: b.resyncSeq}
+
+	if b.outbox != nil {
+		msg.Events = b.outbox.replay(sock, msg.Seq)
+	}
+
+	b.thing.log.printf("Reply: %.80s", p.String())
+	sock.Send(p)
+	sock.SetFlags(sock.Flags() | sock_flag_bcast)
+
+	b.patch.Lock()
+	msg.Version = b.patch.version
+	b.patch.Unlock()
+
+	b.thing.log.printf("Resync %d with [%s]: %d event(s), version %d",
+		msg.Seq, sock.Name(), msg.Events, msg.Version)
+	sock.Send(newPacket(b, nil, &msg))
+}
+
+// Subscriber handler for ResyncAck.  Acks are only accepted from mother.
+func (t *Thing) resyncAck(p *Packet) {
+	var msg MsgResyncAck
+
+	if p.src == nil || p.src.Flags()&sock_flag_mother == 0 {
+		t.log.println("Ignoring resync ack; not from mother")
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	if t.bus.outbox != nil {
+		t.bus.outbox.ack(msg.Seq)
+	}
+}
+
+// Subscriber handler for EventResync, on Thing Prime (or a bridge's child).
+// Thing Prime has Thing's snapshot; patches now follow on from Thing's
+// version.
+func (t *Thing) resynced(p *Packet) {
+	var msg MsgEventResync
+	p.Unmarshal(&msg)
+
+	ps := &t.bus.patch
+	ps.Lock()
+	ps.version = msg.Version
+	ps.Unlock()
+
+	if t.link != nil {
+		t.link.resynced()
+	}
+
+	t.log.printf("Resync %d: %d event(s), version %d", msg.Seq,
+		msg.Events, msg.Version)
+
+	ack := MsgResyncAck{Msg: ResyncAck, Seq: msg.Seq}
+	p.Marshal(&ack).Reply()
+}
@@ -0,0 +1,310 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule is an automation: when Thing broadcasts message When, and the If
+// conditions hold, the rule's actions run, in order: Send is sent to Thing,
+// as if from a client; Set is applied to Thing's state with UpdateState;
+// and the broadcast message is POSTed to Webhook (see WebhookConfig).  For
+// example, in a YAML config file:
+//
+//	rules:
+//	  - name: cool-off
+//	    when: Update
+//	    if: ["Temperature > 30"]
+//	    edge: true
+//	    send: {Msg: Click, Relay: 1, State: true}
+//
+// A condition is "<field> <op> <value>", where field is a member of the
+// message, with dots for nested members (e.g. "Pos.Lat"), op is one of ==,
+// !=, <, <=, >, >=, and value is JSON (30, true, "heat") or a bare string
+// (heat).  A condition on a missing member doesn't hold.
+type Rule struct {
+
+	// Name, for logs
+	Name string
+
+	// Msg of the broadcast message the rule is evaluated on
+	When string
+
+	// Conditions, all of which must hold.  The default is nil (always).
+	If []string
+
+	// [Optional] Fire only when the conditions become true, and not again
+	// until they've been false.  The default is false (fire on every
+	// message the conditions hold for).
+	Edge bool
+
+	// [Optional] Message to send Thing.  The default is nil (none).
+	Send map[string]interface{}
+
+	// [Optional] State changes.  The default is nil (none).
+	Set map[string]interface{}
+
+	// [Optional] Webhook to POST the message to.  Msgs is ignored.  The
+	// default is none.
+	Webhook WebhookConfig
+}
+
+type ruleCond struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+type rule struct {
+	Rule
+	conds    []ruleCond
+	notifier *notifier
+	// Conditions held on the last message, for Edge
+	held bool
+}
+
+type rules struct {
+	thing *Thing
+	sync.Mutex
+	rules []*rule
+	fired chan func()
+	done  chan bool
+}
+
+var ruleOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func parseCond(s string) (ruleCond, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return ruleCond{}, fmt.Errorf("Condition \"%s\" isn't \"<field> <op> <value>\"", s)
+	}
+
+	cond := ruleCond{path: strings.Split(fields[0], "."), op: fields[1]}
+
+	ok := false
+	for _, op := range ruleOps {
+		ok = ok || cond.op == op
+	}
+	if !ok {
+		return ruleCond{}, fmt.Errorf("Condition \"%s\": unknown op \"%s\"", s, cond.op)
+	}
+
+	value := strings.Join(fields[2:], " ")
+	if err := json.Unmarshal([]byte(value), &cond.value); err != nil {
+		cond.value = value
+	}
+
+	return cond, nil
+}
+
+func newRules(thing *Thing, cfgs []Rule) (*rules, error) {
+	rs := &rules{thing: thing, fired: make(chan func(), notifyQueueLen)}
+
+	for _, cfg := range cfgs {
+		if cfg.When == "" {
+			return nil, fmt.Errorf("Rule \"%s\" missing When", cfg.Name)
+		}
+		if cfg.Send != nil {
+			if msg, _ := cfg.Send["Msg"].(string); msg == "" {
+				return nil, fmt.Errorf("Rule \"%s\": Send missing Msg", cfg.Name)
+			}
+		}
+
+		r := &rule{Rule: cfg}
+		for _, s := range cfg.If {
+			cond, err := parseCond(s)
+			if err != nil {
+				return nil, fmt.Errorf("Rule \"%s\": %s", cfg.Name, err)
+			}
+			r.conds = append(r.conds, cond)
+		}
+
+		if cfg.Webhook.URL != "" {
+			webhook := cfg.Webhook
+			webhook.Msgs = nil
+			ns, err := newNotifiers(thing, []WebhookConfig{webhook})
+			if err != nil {
+				return nil, fmt.Errorf("Rule \"%s\": %s", cfg.Name, err)
+			}
+			r.notifier = ns[0]
+		}
+
+		rs.rules = append(rs.rules, r)
+	}
+
+	return rs, nil
+}
+
+// Value at path in v, a decoded JSON object
+func valueAt(v interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		node, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = node[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func compare(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func (c ruleCond) holds(msg map[string]interface{}) bool {
+	v, ok := valueAt(msg, c.path)
+	if !ok {
+		return false
+	}
+
+	switch v := v.(type) {
+	case float64:
+		want, ok := c.value.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case v < want:
+			return compare(c.op, -1)
+		case v > want:
+			return compare(c.op, 1)
+		}
+		return compare(c.op, 0)
+	case string:
+		want, ok := c.value.(string)
+		if !ok {
+			return false
+		}
+		return compare(c.op, strings.Compare(v, want))
+	case bool:
+		want, ok := c.value.(bool)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "==":
+			return v == want
+		case "!=":
+			return v != want
+		}
+	}
+
+	return false
+}
+
+func (r *rule) holds(msg map[string]interface{}) bool {
+	for _, cond := range r.conds {
+		if !cond.holds(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Bus tap to evaluate the rules on broadcast messages.  Actions run on the
+// rules' goroutine, as the bus is busy broadcasting.
+func (rs *rules) tap(p *Packet) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(p.msg, &msg); err != nil {
+		return
+	}
+	name, _ := msg["Msg"].(string)
+
+	rs.Lock()
+	defer rs.Unlock()
+
+	for _, r := range rs.rules {
+		if r.When != name {
+			continue
+		}
+		held := r.holds(msg)
+		fire := held && !(r.Edge && r.held)
+		r.held = held
+		if !fire {
+			continue
+		}
+
+		r, raw := r, append([]byte(nil), p.msg...)
+		select {
+		case rs.fired <- func() { rs.fire(r, raw) }:
+		default:
+			rs.thing.log.printf("Rules backed up; dropped rule \"%s\"", r.Name)
+		}
+	}
+}
+
+// Run r's actions, for broadcast message raw
+func (rs *rules) fire(r *rule, raw []byte) {
+	t := rs.thing
+
+	t.log.printf("Rule \"%s\" fired on %.80s", r.Name, raw)
+
+	if r.Send != nil {
+		data, _ := json.Marshal(r.Send)
+		pkt := &Packet{bus: t.bus, src: newApiSocket(0), msg: data}
+		t.bus.receive(pkt)
+	}
+
+	if r.Set != nil {
+		if err := t.UpdateState(r.Set); err != nil {
+			t.log.printf("Rule \"%s\": %s", r.Name, err)
+		}
+	}
+
+	if r.notifier != nil {
+		if err := r.notifier.deliver(&notifyMsg{Id: t.id, Model: t.model,
+			Name: t.name, Time: time.Now(), raw: raw}); err != nil {
+			t.raise(newError(ErrWebhook, err))
+		}
+	}
+}
+
+func (rs *rules) start() {
+	rs.done = make(chan bool)
+	for _, r := range rs.rules {
+		if r.notifier != nil {
+			r.notifier.done = rs.done
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-rs.done:
+				return
+			case f := <-rs.fired:
+				f()
+			}
+		}
+	}()
+}
+
+func (rs *rules) stop() {
+	close(rs.done)
+}
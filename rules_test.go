@@ -0,0 +1,127 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRuleConds(t *testing.T) {
+	msg := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"Temp":31.5,"Mode":"heat","On":true,"Pos":{"Lat":45}}`), &msg)
+
+	tests := []struct {
+		cond  string
+		holds bool
+	}{
+		{"Temp > 30", true},
+		{"Temp <= 30", false},
+		{"Temp == 31.5", true},
+		{"Mode == heat", true},
+		{`Mode != "heat"`, false},
+		{"On == true", true},
+		{"On < true", false},
+		{"Pos.Lat >= 45", true},
+		{"Missing == 1", false},
+		{"Temp == hot", false},
+	}
+
+	for _, test := range tests {
+		cond, err := parseCond(test.cond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cond.holds(msg) != test.holds {
+			t.Errorf("%s: %v, want %v", test.cond, !test.holds, test.holds)
+		}
+	}
+
+	for _, bad := range []string{"Temp > ", "Temp ~ 3"} {
+		if _, err := parseCond(bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+type fan struct {
+	sets chan bool
+}
+
+func (f *fan) Subscribers() Subscribers {
+	return Subscribers{
+		"Set": func(p *Packet) {
+			var msg struct{ On bool }
+			p.Unmarshal(&msg)
+			f.sets <- msg.On
+		},
+	}
+}
+
+func (f *fan) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestRules(t *testing.T) {
+	f := &fan{sets: make(chan bool, 10)}
+	thing := NewThing(f)
+	thing.Cfg.Id = testId
+	thing.Cfg.Rules = []Rule{{
+		Name: "cool-off",
+		When: "Update",
+		If:   []string{"Temp > 30"},
+		Edge: true,
+		Send: map[string]interface{}{"Msg": "Set", "On": true},
+	}}
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	thing.rules.start()
+	defer thing.rules.stop()
+
+	type update struct {
+		Msg  string
+		Temp int
+	}
+	for _, temp := range []int{31, 32, 20, 33} {
+		thing.rules.tap(newPacket(thing.bus, nil, &update{"Update", temp}))
+	}
+	thing.rules.tap(newPacket(thing.bus, nil, &Msg{Msg: "Other"}))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case on := <-f.sets:
+			if !on {
+				t.Errorf("Set %v", on)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Rule fired %d times, want 2", i)
+		}
+	}
+	select {
+	case <-f.sets:
+		t.Errorf("Rule fired too often")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRulesBadConfig(t *testing.T) {
+	for _, rule := range []Rule{
+		{Name: "no when"},
+		{When: "Update", If: []string{"Temp"}},
+		{When: "Update", Send: map[string]interface{}{"On": true}},
+	} {
+		thing := NewThing(&sparse{})
+		thing.Cfg.Id = testId
+		thing.Cfg.Rules = []Rule{rule}
+		if err := thing.build(true); !errors.Is(err, ErrBadConfig) {
+			t.Errorf("%+v: error %v, want %v", rule, err, ErrBadConfig)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How often runtime counters sample Thing's state and are saved
+const runtimeTick = time.Minute
+
+// RuntimeCounter counts how long, and how many times, an output is on, for
+// maintenance.  Output is a bool member in Thing's state, named as in
+// PowerOnRule.  Counters are saved in Cfg.RuntimeFile, so they survive Thing
+// restarts.
+//
+// Switches made with UpdateState are counted as they happen.  Other changes
+// to Thing's state are picked up when Thing samples its state, once a
+// minute.
+//
+// If ServiceHours or ServiceCycles is non-zero, EventServiceDue is sent to
+// Thing's Subscribers() once Output has been on for ServiceHours hours, or
+// has switched on ServiceCycles times, since Output was last serviced.
+// Subscribe to EventServiceDue to notify someone.  Send ResetRuntime once
+// Output is serviced.  For example:
+//
+//	thing.Cfg.RuntimeCounters = []merle.RuntimeCounter{
+//		{Output: "Pump", ServiceHours: 500},
+//	}
+//	thing.Cfg.RuntimeFile = "/var/lib/pump/runtime.json"
+type RuntimeCounter struct {
+	Output        string
+	ServiceHours  uint
+	ServiceCycles uint
+}
+
+type runtimeCounters struct {
+	sync.Mutex
+	thing    *Thing
+	counters []RuntimeCounter
+	store    Store
+	status   []RuntimeStatus
+	// Time each output's on-time was last counted, or zero if off
+	onSince []time.Time
+	ticker  *time.Ticker
+	done    chan bool
+}
+
+func newRuntimeCounters(thing *Thing, counters []RuntimeCounter,
+	file string) (*runtimeCounters, error) {
+
+	r := &runtimeCounters{
+		thing:    thing,
+		counters: counters,
+		status:   make([]RuntimeStatus, len(counters)),
+		onSince:  make([]time.Time, len(counters)),
+	}
+
+	for i, counter := range counters {
+		if counter.Output == "" {
+			return nil, fmt.Errorf("Runtime counter missing Output")
+		}
+		r.status[i].Output = counter.Output
+	}
+
+	if file != "" {
+		r.store = NewFileStore(file)
+	}
+
+	return r, r.load()
+}
+
+// Load counters saved from a previous run.  Saved counters for outputs no
+// longer counted are dropped.
+func (r *runtimeCounters) load() error {
+	if r.store == nil {
+		return nil
+	}
+
+	var saved []RuntimeStatus
+	if err := r.store.Load(&saved); err != nil {
+		return err
+	}
+
+	for _, s := range saved {
+		for i := range r.status {
+			if r.status[i].Output == s.Output {
+				r.status[i] = s
+			}
+		}
+	}
+
+	return nil
+}
+
+// Call with lock held
+func (r *runtimeCounters) save() {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.Save(r.status); err != nil {
+		r.thing.log.println("Saving runtime counters failed:", err)
+	}
+}
+
+// Count on-time up to now.  Call with lock held.
+func (r *runtimeCounters) count(i int, now time.Time) {
+	if r.onSince[i].IsZero() {
+		return
+	}
+	secs := uint(now.Sub(r.onSince[i]) / time.Second)
+	r.status[i].OnTime += secs
+	r.status[i].ServiceOnTime += secs
+	r.onSince[i] = r.onSince[i].Add(time.Duration(secs) * time.Second)
+}
+
+// Outputs newly due for service.  Call with lock held.
+func (r *runtimeCounters) due() []MsgServiceDue {
+	var due []MsgServiceDue
+
+	for i, counter := range r.counters {
+		s := &r.status[i]
+		if s.Due {
+			continue
+		}
+		hours := s.ServiceOnTime / 3600
+		if (counter.ServiceHours > 0 && hours >= counter.ServiceHours) ||
+			(counter.ServiceCycles > 0 &&
+				s.ServiceCycles >= counter.ServiceCycles) {
+			s.Due = true
+			due = append(due, MsgServiceDue{Msg: EventServiceDue,
+				Output: s.Output, Hours: hours,
+				Cycles: s.ServiceCycles})
+		}
+	}
+
+	return due
+}
+
+func (r *runtimeCounters) notify(due []MsgServiceDue) {
+	t := r.thing
+	for i := range due {
+		t.log.printf("Service due: %s on %d hours, %d cycles",
+			due[i].Output, due[i].Hours, due[i].Cycles)
+		t.bus.receive(newPacket(t.bus, nil, &due[i]))
+	}
+}
+
+// Count outputs switched on or off in state, a decoded JSON state.  Returns
+// outputs newly due for service.
+func (r *runtimeCounters) sample(state interface{}) []MsgServiceDue {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+
+	for i, counter := range r.counters {
+		on := boolAt(state, strings.Split(counter.Output, "."))
+		switch {
+		case on && r.onSince[i].IsZero():
+			r.onSince[i] = now
+			r.status[i].Cycles++
+			r.status[i].ServiceCycles++
+		case !on && !r.onSince[i].IsZero():
+			r.count(i, now)
+			r.onSince[i] = time.Time{}
+		default:
+			r.count(i, now)
+		}
+	}
+
+	due := r.due()
+	r.save()
+
+	return due
+}
+
+// Record a change to Thing's state, once committed.  The Thinger may be
+// locked, so notify later.
+func (r *runtimeCounters) update(after interface{}) {
+	if due := r.sample(after); len(due) > 0 {
+		go r.notify(due)
+	}
+}
+
+func (r *runtimeCounters) tick() {
+	state, err := r.thing.currentState()
+	if err != nil {
+		r.thing.log.println("Sampling runtime counters failed:", err)
+		return
+	}
+	r.notify(r.sample(state))
+}
+
+func (r *runtimeCounters) start() error {
+	state, err := r.thing.currentState()
+	if err != nil {
+		return err
+	}
+
+	// Outputs on at startup are counted from now, but aren't a new cycle
+	r.Lock()
+	now := time.Now()
+	for i, counter := range r.counters {
+		if boolAt(state, strings.Split(counter.Output, ".")) {
+			r.onSince[i] = now
+		}
+	}
+	due := r.due()
+	r.Unlock()
+
+	r.notify(due)
+
+	r.ticker = time.NewTicker(runtimeTick)
+	r.done = make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-r.ticker.C:
+				r.tick()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *runtimeCounters) stop() {
+	r.ticker.Stop()
+	close(r.done)
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for i := range r.counters {
+		r.count(i, now)
+	}
+	r.save()
+}
+
+func (r *runtimeCounters) getStatus() []RuntimeStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	for i := range r.counters {
+		r.count(i, now)
+	}
+
+	status := make([]RuntimeStatus, len(r.status))
+	copy(status, r.status)
+	return status
+}
+
+// Mark output serviced, clearing its service counters
+func (r *runtimeCounters) reset(output string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+
+	for i := range r.status {
+		s := &r.status[i]
+		if s.Output != output {
+			continue
+		}
+		r.count(i, now)
+		s.ServiceOnTime = 0
+		s.ServiceCycles = 0
+		s.Serviced = now
+		s.Due = false
+		r.save()
+		return nil
+	}
+
+	return fmt.Errorf("No runtime counter for %s", output)
+}
+
+// Subscriber handler for GetRuntime
+func (t *Thing) getRuntime(p *Packet) {
+	resp := MsgRuntime{Msg: ReplyRuntime, Counters: t.runtime.getStatus()}
+	p.Marshal(&resp).Reply()
+}
+
+// Subscriber handler for ResetRuntime
+func (t *Thing) resetRuntime(p *Packet) {
+	var msg MsgResetRuntime
+	p.Unmarshal(&msg)
+
+	if err := t.runtime.reset(msg.Output); err != nil {
+		t.log.println("Resetting runtime counter:", err)
+	} else {
+		t.log.printf("%s serviced", msg.Output)
+	}
+
+	t.getRuntime(p)
+}
+
+// Dump Thing's runtime counters as JSON
+func (t *Thing) runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// If this Thing is a Bridge, and the ID matches a child ID, then dump
+	// the child's counters
+	child := t.getChild(id)
+	if child != nil {
+		child.runtimeHandler(w, r)
+		return
+	}
+
+	if id != "" && id != t.id {
+		http.Error(w, "Mismatch on Ids", http.StatusNotFound)
+		return
+	}
+
+	if t.runtime == nil {
+		http.Error(w, "No runtime counters", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.runtime.getStatus())
+}
@@ -0,0 +1,229 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Minimal client for S3-compatible object storage, signing requests with AWS
+// Signature Version 4.  Path-style addressing is used (endpoint/bucket/key)
+// so the client works with non-AWS stores such as MinIO.
+type s3Client struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Client(endpoint, region, bucket, accessKey, secretKey string) *s3Client {
+	return &s3Client{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: time.Minute},
+	}
+}
+
+func s3Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign the request using AWS Signature Version 4
+func (c *s3Client) sign(r *http.Request, payload []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := s3Hash(payload)
+
+	r.Header.Set("Host", r.URL.Host)
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var names []string
+	for name := range r.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" +
+			strings.TrimSpace(r.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		s3Hash([]byte(canonRequest)),
+	}, "\n")
+
+	key := s3Hmac([]byte("AWS4"+c.secretKey), date)
+	key = s3Hmac(key, c.region)
+	key = s3Hmac(key, "s3")
+	key = s3Hmac(key, "aws4_request")
+	signature := hex.EncodeToString(s3Hmac(key, toSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// S3 request failed with HTTP status
+type s3Error struct {
+	status int
+	msg    string
+}
+
+func (e *s3Error) Error() string {
+	return e.msg
+}
+
+// Do the request, returning the response body
+func (c *s3Client) do(method, key string, query url.Values,
+	header http.Header, payload []byte) ([]byte, error) {
+
+	u, err := url.Parse(c.endpoint + "/" + c.bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+
+	r, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for name := range header {
+		r.Header.Set(name, header.Get(name))
+	}
+
+	c.sign(r, payload)
+
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, &s3Error{status: resp.StatusCode,
+			msg: fmt.Sprintf("S3 %s %s: %s: %s", method, key,
+				resp.Status, strings.TrimSpace(string(body)))}
+	}
+
+	return body, nil
+}
+
+// Put an object into the bucket
+func (c *s3Client) putObject(key, contentType string, data []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	_, err := c.do("PUT", key, url.Values{}, header, data)
+	return err
+}
+
+// Bucket lifecycle rule, as put or got.  Rule holds the rule's elements,
+// so rules other than Merle's are put back as they were.
+type s3Rule struct {
+	ID   string `xml:"ID"`
+	Rule string `xml:",innerxml"`
+}
+
+type s3Lifecycle struct {
+	XMLName xml.Name `xml:"LifecycleConfiguration"`
+	Rules   []s3Rule `xml:"Rule"`
+}
+
+// ID of Merle's lifecycle rule
+const s3RuleID = "merle-archive"
+
+// Put a bucket lifecycle rule expiring objects under prefix after days.  A
+// bucket has one lifecycle configuration, so the bucket's other rules are
+// kept, and Merle's rule, if already there, is replaced.
+func (c *s3Client) putLifecycle(prefix string, days uint) error {
+	query := url.Values{}
+	query.Set("lifecycle", "")
+
+	var current s3Lifecycle
+	body, err := c.do("GET", "", query, http.Header{}, nil)
+	if err == nil {
+		if err := xml.Unmarshal(body, &current); err != nil {
+			return fmt.Errorf("S3 lifecycle: %s", err)
+		}
+	} else if e, ok := err.(*s3Error); !ok || e.status != http.StatusNotFound {
+		// Not found is no lifecycle configuration yet
+		return err
+	}
+
+	var esc strings.Builder
+	xml.EscapeText(&esc, []byte(prefix))
+
+	var buf strings.Builder
+	buf.WriteString(`<LifecycleConfiguration>`)
+	for _, rule := range current.Rules {
+		if strings.TrimSpace(rule.ID) != s3RuleID {
+			buf.WriteString(`<Rule>` + rule.Rule + `</Rule>`)
+		}
+	}
+	fmt.Fprintf(&buf, `<Rule><ID>%s</ID><Filter><Prefix>%s</Prefix></Filter>`+
+		`<Status>Enabled</Status><Expiration><Days>%d</Days></Expiration></Rule>`,
+		s3RuleID, esc.String(), days)
+	buf.WriteString(`</LifecycleConfiguration>`)
+	rules := buf.String()
+
+	sum := md5.Sum([]byte(rules))
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	_, err = c.do("PUT", "", query, header, []byte(rules))
+	return err
+}
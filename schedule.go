@@ -0,0 +1,505 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule sends Thing a message on a timetable: a cron expression, an
+// interval, or sunrise or sunset.  Schedules are configured in
+// Cfg.Schedules, and edited at runtime with SetSchedule and DeleteSchedule
+// messages.  If Cfg.ScheduleFile is set, the schedules are saved there when
+// edited, and replace Cfg.Schedules when Thing restarts.  For example, for
+// the Christmas lights:
+//
+//	thing.Cfg.Schedules = []merle.Schedule{
+//		{Name: "on", Cron: "0 17 * * *",
+//			Send: map[string]interface{}{"Msg": "Lights", "On": true}},
+//		{Name: "off", Cron: "0 23 * * *",
+//			Send: map[string]interface{}{"Msg": "Lights", "On": false}},
+//	}
+//
+// Times are in Thing's local time zone.  Set one of Cron, Every, or Sun.
+type Schedule struct {
+	Name string
+
+	// Cron expression: minute, hour, day of month, month, and day of
+	// week (0-7, Sunday is 0 or 7).  Fields are *, numbers, ranges (1-5),
+	// steps (*/15, 8-18/2), or lists of these (1,15).
+	Cron string `json:",omitempty"`
+
+	// Interval, in seconds
+	Every uint `json:",omitempty"`
+
+	// "sunrise" or "sunset", with an optional offset, a duration, e.g.
+	// "sunset-30m".  Sun needs Cfg.Latitude and Cfg.Longitude.
+	Sun string `json:",omitempty"`
+
+	// Message to send Thing, as if from a client
+	Send map[string]interface{}
+}
+
+type cronField map[int]bool
+
+type cronSpec struct {
+	min, hour, dom, month, dow cronField
+	// Day of month or day of week restricted; either matches if both are
+	domAny, dowAny bool
+}
+
+type schedule struct {
+	Schedule
+	cron   *cronSpec
+	sun    string
+	offset time.Duration
+	next   time.Time
+}
+
+type schedules struct {
+	sync.Mutex
+	thing     *Thing
+	lat, long float64
+	scheds    []*schedule
+	store     Store
+	kick      chan bool
+	done      chan bool
+}
+
+// Parse a cron field of values in [min, max]
+func parseCronField(s string, min, max int) (cronField, error) {
+	f := cronField{}
+
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad step in \"%s\"", s)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("bad value in \"%s\"", s)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad range in \"%s\"", s)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("\"%s\" out of range %d-%d", s, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			f[v] = true
+		}
+	}
+
+	return f, nil
+}
+
+func parseCron(s string) (*cronSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron \"%s\" needs five fields", s)
+	}
+
+	var spec cronSpec
+	var err error
+	for i, f := range []struct {
+		field    *cronField
+		min, max int
+	}{
+		{&spec.min, 0, 59},
+		{&spec.hour, 0, 23},
+		{&spec.dom, 1, 31},
+		{&spec.month, 1, 12},
+		{&spec.dow, 0, 7},
+	} {
+		if *f.field, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("Cron \"%s\": %s", s, err)
+		}
+	}
+	if spec.dow[7] {
+		spec.dow[0] = true
+	}
+	spec.domAny = fields[2] == "*"
+	spec.dowAny = fields[4] == "*"
+
+	return &spec, nil
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next time, after t, matching the cron spec; zero if none within five years
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !c.min[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// Sunrise and sunset, on the day of t, at lat, long (degrees, north and east
+// positive), by the sunrise equation.  ok is false if the sun doesn't rise
+// or set that day.
+func sunTimes(t time.Time, lat, long float64) (rise, set time.Time, ok bool) {
+	rad := math.Pi / 180
+
+	// Julian day at noon UTC
+	noon := time.Date(t.Year(), t.Month(), t.Day(), 12, 0, 0, 0, time.UTC)
+	jd := float64(noon.Unix())/86400 + 2440587.5
+	n := math.Round(jd - 2451545.0)
+
+	mean := n - long/360
+	m := math.Mod(357.5291+0.98560028*mean, 360)
+	c := 1.9148*math.Sin(m*rad) + 0.02*math.Sin(2*m*rad) +
+		0.0003*math.Sin(3*m*rad)
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	transit := 2451545.0 + mean + 0.0053*math.Sin(m*rad) -
+		0.0069*math.Sin(2*lambda*rad)
+
+	sinDecl := math.Sin(lambda*rad) * math.Sin(23.4397*rad)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHour := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*sinDecl) /
+		(math.Cos(lat*rad) * cosDecl)
+	if cosHour < -1 || cosHour > 1 {
+		return
+	}
+	hour := math.Acos(cosHour) / rad
+
+	julian := func(j float64) time.Time {
+		secs := (j - 2440587.5) * 86400
+		return time.Unix(int64(secs), 0).In(t.Location())
+	}
+	return julian(transit - hour/360), julian(transit + hour/360), true
+}
+
+// Next time, after t, of s's sun event; zero if none within a year
+func (s *schedules) nextSun(sched *schedule, t time.Time) time.Time {
+	for day := 0; day <= 366; day++ {
+		d := t.AddDate(0, 0, day)
+		rise, set, ok := sunTimes(d, s.lat, s.long)
+		if !ok {
+			continue
+		}
+		when := rise
+		if sched.sun == "sunset" {
+			when = set
+		}
+		when = when.Add(sched.offset)
+		if when.After(t) {
+			return when
+		}
+	}
+	return time.Time{}
+}
+
+func (s *schedules) parse(cfg Schedule) (*schedule, error) {
+	sched := &schedule{Schedule: cfg}
+
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("Schedule missing Name")
+	}
+	if msg, _ := cfg.Send["Msg"].(string); msg == "" {
+		return nil, fmt.Errorf("Schedule %s: Send missing Msg", cfg.Name)
+	}
+
+	set := 0
+	if cfg.Cron != "" {
+		set++
+		var err error
+		if sched.cron, err = parseCron(cfg.Cron); err != nil {
+			return nil, fmt.Errorf("Schedule %s: %s", cfg.Name, err)
+		}
+	}
+	if cfg.Every != 0 {
+		set++
+	}
+	if cfg.Sun != "" {
+		set++
+		for _, event := range []string{"sunrise", "sunset"} {
+			if strings.HasPrefix(cfg.Sun, event) {
+				sched.sun = event
+			}
+		}
+		if sched.sun == "" {
+			return nil, fmt.Errorf("Schedule %s: Sun must be sunrise or sunset",
+				cfg.Name)
+		}
+		if offset := cfg.Sun[len(sched.sun):]; offset != "" {
+			var err error
+			if sched.offset, err = time.ParseDuration(offset); err != nil {
+				return nil, fmt.Errorf("Schedule %s: Sun offset: %s",
+					cfg.Name, err)
+			}
+		}
+		if s.lat == 0 && s.long == 0 {
+			return nil, fmt.Errorf("Schedule %s: Sun needs Latitude and Longitude",
+				cfg.Name)
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("Schedule %s: set one of Cron, Every, or Sun",
+			cfg.Name)
+	}
+
+	return sched, nil
+}
+
+// Next time, after t, sched fires
+func (s *schedules) nextTime(sched *schedule, t time.Time) time.Time {
+	switch {
+	case sched.cron != nil:
+		return sched.cron.next(t)
+	case sched.Every != 0:
+		return t.Add(time.Duration(sched.Every) * time.Second)
+	}
+	return s.nextSun(sched, t)
+}
+
+func newSchedules(thing *Thing, cfgs []Schedule, file string) (*schedules, error) {
+	s := &schedules{
+		thing: thing,
+		lat:   thing.Cfg.Latitude,
+		long:  thing.Cfg.Longitude,
+		kick:  make(chan bool, 1),
+		done:  make(chan bool),
+	}
+
+	if file != "" {
+		s.store = NewFileStore(file)
+		var saved []Schedule
+		if err := s.store.Load(&saved); err != nil {
+			return nil, err
+		}
+		if saved != nil {
+			cfgs = saved
+		}
+	}
+
+	now := time.Now()
+	for _, cfg := range cfgs {
+		if err := s.set(cfg, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *schedules) find(name string) int {
+	for i, sched := range s.scheds {
+		if sched.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add or replace a schedule.  Call with lock held.
+func (s *schedules) set(cfg Schedule, now time.Time) error {
+	sched, err := s.parse(cfg)
+	if err != nil {
+		return err
+	}
+	sched.next = s.nextTime(sched, now)
+
+	if i := s.find(cfg.Name); i >= 0 {
+		s.scheds[i] = sched
+	} else {
+		s.scheds = append(s.scheds, sched)
+	}
+	return nil
+}
+
+// Call with lock held
+func (s *schedules) save() {
+	if s.store == nil {
+		return
+	}
+	saved := make([]Schedule, len(s.scheds))
+	for i, sched := range s.scheds {
+		saved[i] = sched.Schedule
+	}
+	if err := s.store.Save(saved); err != nil {
+		s.thing.log.println("Saving schedules failed:", err)
+	}
+}
+
+// Fire schedules due at now, and return the time the next is due
+func (s *schedules) run(now time.Time) time.Time {
+	var due []*schedule
+	var next time.Time
+
+	s.Lock()
+	for _, sched := range s.scheds {
+		if sched.next.IsZero() {
+			continue
+		}
+		if !sched.next.After(now) {
+			due = append(due, sched)
+			sched.next = s.nextTime(sched, now)
+		}
+		if !sched.next.IsZero() && (next.IsZero() || sched.next.Before(next)) {
+			next = sched.next
+		}
+	}
+	s.Unlock()
+
+	for _, sched := range due {
+		data, _ := json.Marshal(sched.Send)
+		s.thing.log.printf("Schedule %s: %.80s", sched.Name, data)
+		pkt := &Packet{bus: s.thing.bus, src: newApiSocket(0), msg: data}
+		s.thing.bus.receive(pkt)
+	}
+
+	return next
+}
+
+func (s *schedules) start() {
+	go func() {
+		for {
+			// Nil timer, with no schedules due, waits for an edit
+			var timer *time.Timer
+			var due <-chan time.Time
+			if next := s.run(time.Now()); !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				due = timer.C
+			}
+			select {
+			case <-s.done:
+			case <-s.kick:
+			case <-due:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+		}
+	}()
+}
+
+func (s *schedules) stop() {
+	close(s.done)
+}
+
+// Wake the scheduler to pick up edits
+func (s *schedules) edited() {
+	select {
+	case s.kick <- true:
+	default:
+	}
+}
+
+// Subscriber handler for GetSchedules
+func (t *Thing) getSchedules(p *Packet) {
+	s := t.scheds
+	resp := MsgSchedules{Msg: ReplySchedules, Schedules: []ScheduleStatus{}}
+
+	s.Lock()
+	for _, sched := range s.scheds {
+		resp.Schedules = append(resp.Schedules, ScheduleStatus{
+			Schedule: sched.Schedule,
+			Next:     sched.next,
+		})
+	}
+	s.Unlock()
+
+	p.Marshal(&resp).Reply()
+}
+
+// Subscriber handler for SetSchedule and DeleteSchedule.  Edits are only
+// accepted on the private server.
+func (t *Thing) editSchedule(p *Packet) {
+	var msg MsgSchedule
+
+	if p.src == nil || p.src.Flags()&sock_flag_private == 0 {
+		t.log.println("Ignoring schedule edit; not on private server")
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	s := t.scheds
+	var err error
+	s.Lock()
+	if msg.Msg == DeleteSchedule {
+		if i := s.find(msg.Schedule.Name); i >= 0 {
+			s.scheds = append(s.scheds[:i], s.scheds[i+1:]...)
+		} else {
+			err = fmt.Errorf("No schedule %s", msg.Schedule.Name)
+		}
+	} else {
+		err = s.set(msg.Schedule, time.Now())
+	}
+	if err == nil {
+		s.save()
+	}
+	s.Unlock()
+
+	if err != nil {
+		t.log.println("Editing schedule failed:", err)
+	} else {
+		t.log.printf("Schedule %s edited", msg.Schedule.Name)
+		s.edited()
+	}
+
+	t.getSchedules(p)
+}
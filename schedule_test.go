@@ -0,0 +1,161 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2022, 7, 27, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		cron string
+		next string
+	}{
+		{"* * * * *", "2022-07-27T10:31:00Z"},
+		{"0 17 * * *", "2022-07-27T17:00:00Z"},
+		{"*/15 * * * *", "2022-07-27T10:45:00Z"},
+		{"0 8-18/2 * * *", "2022-07-27T12:00:00Z"},
+		{"0 9 * * 0,6", "2022-07-30T09:00:00Z"},
+		{"0 0 1 * *", "2022-08-01T00:00:00Z"},
+		{"0 0 1 1 *", "2023-01-01T00:00:00Z"},
+		{"0 0 29 2 *", "2024-02-29T00:00:00Z"},
+		{"0 0 1 * 5", "2022-07-29T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		spec, err := parseCron(test.cron)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := spec.next(from).Format(time.RFC3339)
+		if next != test.next {
+			t.Errorf("%s: next %s, want %s", test.cron, next, test.next)
+		}
+	}
+
+	for _, bad := range []string{"* * * *", "60 * * * *", "*/0 * * * *",
+		"5-1 * * * *", "x * * * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestSunTimes(t *testing.T) {
+	// London, midsummer: sunrise 03:43 UTC, sunset 20:21 UTC
+	day := time.Date(2022, 6, 21, 0, 0, 0, 0, time.UTC)
+	rise, set, ok := sunTimes(day, 51.5, -0.13)
+	if !ok {
+		t.Fatal("No sunrise")
+	}
+	near := func(got time.Time, hour, min int) bool {
+		want := time.Date(2022, 6, 21, hour, min, 0, 0, time.UTC)
+		d := got.Sub(want)
+		return d > -5*time.Minute && d < 5*time.Minute
+	}
+	if !near(rise, 3, 43) || !near(set, 20, 21) {
+		t.Errorf("Sunrise %s, sunset %s", rise, set)
+	}
+
+	// Midnight sun at the pole
+	if _, _, ok := sunTimes(day, 89, 0); ok {
+		t.Errorf("Sun set at the pole in June")
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &fan{sets: make(chan bool, 10)}
+	thing := NewThing(f)
+	thing.Cfg.Id = testId
+	thing.Cfg.Schedules = []Schedule{
+		{Name: "on", Every: 60,
+			Send: map[string]interface{}{"Msg": "Set", "On": true}},
+	}
+	thing.Cfg.ScheduleFile = filepath.Join(dir, "schedules.json")
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	s := thing.scheds
+	due := s.scheds[0].next
+	if next := s.run(due.Add(-time.Second)); !next.Equal(due) {
+		t.Errorf("Next %s, want %s", next, due)
+	}
+	if next := s.run(due); !next.Equal(due.Add(time.Minute)) {
+		t.Errorf("Next %s, want %s", next, due.Add(time.Minute))
+	}
+	select {
+	case on := <-f.sets:
+		if !on {
+			t.Errorf("Set %v", on)
+		}
+	default:
+		t.Errorf("Schedule didn't fire")
+	}
+
+	// Edits are only accepted on the private server, and are saved
+	edit := MsgSchedule{Msg: SetSchedule, Schedule: Schedule{Name: "off",
+		Cron: "0 23 * * *", Send: map[string]interface{}{"Msg": "Set"}}}
+	public := &recordSocket{}
+	thing.bus.receive(newPacket(thing.bus, public, &edit))
+	private := &recordSocket{flags: sock_flag_private}
+	thing.bus.receive(newPacket(thing.bus, private, &edit))
+	del := MsgSchedule{Msg: DeleteSchedule, Schedule: Schedule{Name: "on"}}
+	thing.bus.receive(newPacket(thing.bus, private, &del))
+
+	if len(public.sent) != 0 || len(private.sent) != 2 ||
+		!strings.Contains(private.sent[1], `"Name":"off"`) ||
+		strings.Contains(private.sent[1], `"Name":"on"`) {
+		t.Errorf("Public %q, private %q", public.sent, private.sent)
+	}
+
+	// Saved schedules replace those configured
+	thing = NewThing(f)
+	thing.Cfg.Id = testId
+	thing.Cfg.Schedules = []Schedule{{Name: "on", Every: 60,
+		Send: map[string]interface{}{"Msg": "Set"}}}
+	thing.Cfg.ScheduleFile = filepath.Join(dir, "schedules.json")
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	if scheds := thing.scheds.scheds; len(scheds) != 1 || scheds[0].Name != "off" {
+		t.Errorf("Loaded %+v", scheds)
+	}
+}
+
+func TestScheduleBadConfig(t *testing.T) {
+	send := map[string]interface{}{"Msg": "Set"}
+	for _, sched := range []Schedule{
+		{Name: "none", Send: send},
+		{Name: "two", Every: 5, Cron: "* * * * *", Send: send},
+		{Name: "nomsg", Every: 5},
+		{Name: "moon", Sun: "moonrise", Send: send},
+		{Name: "nowhere", Sun: "sunset", Send: send},
+	} {
+		thing := NewThing(&sparse{})
+		thing.Cfg.Id = testId
+		thing.Cfg.Schedules = []Schedule{sched}
+		if err := thing.build(false); err == nil {
+			t.Errorf("%s: no error", sched.Name)
+		}
+	}
+}
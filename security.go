@@ -0,0 +1,104 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Security headers (see Cfg.SecurityHeaders) on the public servers'
+// responses.  Thing's pages are only framed by, and only load from, Thing's
+// own server, unless ThingAssets.ContentSources says otherwise.
+
+// HSTS max-age, in seconds: one year
+const hstsMaxAge = "31536000"
+
+// Content-Security-Policy directives, and their sources, before the
+// Thinger's ContentSources.  Thing's templates use inline scripts and
+// styles.
+var contentDirectives = []struct {
+	name    string
+	sources []string
+}{
+	{"default-src", []string{"'self'"}},
+	{"script-src", []string{"'self'", "'unsafe-inline'"}},
+	{"style-src", []string{"'self'", "'unsafe-inline'"}},
+	{"img-src", []string{"'self'", "data:"}},
+	{"connect-src", []string{"'self'"}},
+	{"frame-ancestors", []string{"'self'"}},
+	{"base-uri", []string{"'self'"}},
+	{"form-action", []string{"'self'"}},
+}
+
+// Content-Security-Policy for Thing's pages, for request r
+func (t *Thing) contentPolicy(r *http.Request) string {
+	var extra map[string][]string
+	if a := t.getAssets(); a != nil {
+		extra = a.ContentSources
+	}
+
+	// Older browsers don't take 'self' to cover Thing's WebSocket
+	scheme, host, _ := t.forwarded(r)
+	ws := "wss://" + host
+	if scheme == "http" {
+		ws = "ws://" + host
+	}
+
+	var policy []string
+	seen := map[string]bool{}
+	for _, d := range contentDirectives {
+		sources := append([]string{}, d.sources...)
+		if d.name == "connect-src" {
+			sources = append(sources, ws)
+		}
+		sources = append(sources, extra[d.name]...)
+		policy = append(policy, d.name+" "+strings.Join(sources, " "))
+		seen[d.name] = true
+	}
+
+	var names []string
+	for name := range extra {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		policy = append(policy, name+" "+strings.Join(extra[name], " "))
+	}
+
+	return strings.Join(policy, "; ")
+}
+
+// Set Thing's Content-Security-Policy on a page.  A bridge's child may
+// have its own sources.
+func (t *Thing) setContentPolicy(w http.ResponseWriter, r *http.Request) {
+	if t.Cfg.SecurityHeaders {
+		w.Header().Set("Content-Security-Policy", t.contentPolicy(r))
+	}
+}
+
+// Security headers on each response from next
+func (w *webPublic) secure(next http.Handler) http.Handler {
+	t := w.thing
+	if !t.Cfg.SecurityHeaders {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		h := writer.Header()
+		if scheme, _, _ := t.forwarded(r); scheme == "https" {
+			h.Set("Strict-Transport-Security", "max-age="+hstsMaxAge)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		h.Set("Content-Security-Policy", t.contentPolicy(r))
+		next.ServeHTTP(writer, r)
+	})
+}
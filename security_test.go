@@ -0,0 +1,90 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type gauge struct {
+	dashboard
+}
+
+func (g *gauge) Assets() *ThingAssets {
+	return &ThingAssets{
+		HtmlTemplateText: "gauge",
+		ContentSources: map[string][]string{
+			"script-src": {"https://cdn.example.com"},
+			"worker-src": {"'self'"},
+			"media-src":  {"https://media.example.com"},
+		},
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	thing := NewThing(&gauge{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(https bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/"+testId, nil)
+		req.Host = "example.com"
+		if https {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		thing.web.public.handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(false)
+	h := w.Header()
+	if h.Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS over HTTP")
+	}
+	if h.Get("X-Content-Type-Options") != "nosniff" ||
+		h.Get("Referrer-Policy") != "same-origin" {
+		t.Errorf("Headers %v", h)
+	}
+	csp := h.Get("Content-Security-Policy")
+	for _, want := range []string{
+		"script-src 'self' 'unsafe-inline' https://cdn.example.com;",
+		"connect-src 'self' ws://example.com;",
+		"frame-ancestors 'self';",
+		"form-action 'self'; media-src https://media.example.com; worker-src 'self'",
+	} {
+		if !strings.Contains(csp, want) {
+			t.Errorf("CSP %q missing %q", csp, want)
+		}
+	}
+	if w.Body.String() != "gauge" {
+		t.Errorf("Body %q", w.Body.String())
+	}
+
+	h = get(true).Header()
+	if h.Get("Strict-Transport-Security") != "max-age="+hstsMaxAge {
+		t.Errorf("HSTS %q", h.Get("Strict-Transport-Security"))
+	}
+	if !strings.Contains(h.Get("Content-Security-Policy"), "wss://example.com") {
+		t.Errorf("CSP %q", h.Get("Content-Security-Policy"))
+	}
+
+	// Opted out
+	thing.Cfg.SecurityHeaders = false
+	h = get(true).Header()
+	if len(h.Values("Content-Security-Policy")) != 0 ||
+		h.Get("Strict-Transport-Security") != "" {
+		t.Errorf("Headers %v", h)
+	}
+}
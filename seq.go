@@ -0,0 +1,183 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+)
+
+// Sequence numbers on the link between Thing and Thing Prime (see
+// Cfg.LinkSeq).  Each side stamps the messages it sends on the link with a
+// LinkSeq member, counting up from 1, and strips the stamp from messages
+// received, so the rest of Thing never sees it.  The counts carry on across
+// WebSocket reconnects, so messages lost in a tunnel flap, written to a
+// dead connection, show up as a gap in the numbers on the far side.
+//
+// A gap means mother's view of Thing may be stale, so either side starts
+// the resync protocol (see resync.go): Thing Prime sends GetState, and Thing
+// replies to a GetState of its own making, as if from mother.  A count
+// starting again from 1 is the peer restarting, not a gap.
+
+type seqLink struct {
+	thing *Thing
+	sync.Mutex
+	// Last sent, and last received
+	tx uint64
+	rx uint64
+	// Thing Prime is waiting on a resync
+	pending bool
+}
+
+func newSeqLink(thing *Thing) *seqLink {
+	return &seqLink{thing: thing}
+}
+
+var seqMember = []byte(`"LinkSeq":`)
+
+// Stamp msg, a JSON object, with seq
+func stampSeq(msg []byte, seq uint64) []byte {
+	end := bytes.LastIndexByte(msg, '}')
+	if end < 0 {
+		return msg
+	}
+
+	stamped := make([]byte, 0, len(msg)+32)
+	stamped = append(stamped, msg[:end]...)
+	if body := bytes.TrimSpace(msg[:end]); len(body) > 0 &&
+		body[len(body)-1] != '{' {
+		stamped = append(stamped, ',')
+	}
+	stamped = append(stamped, seqMember...)
+	stamped = strconv.AppendUint(stamped, seq, 10)
+	return append(stamped, '}')
+}
+
+// Strip the stamp from msg.  Returns msg unstamped, and the seq, or false if
+// msg isn't stamped.
+func unstampSeq(msg []byte) ([]byte, uint64, bool) {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[len(trimmed)-1] != '}' {
+		return msg, 0, false
+	}
+
+	at := bytes.LastIndex(trimmed, seqMember)
+	if at < 0 {
+		return msg, 0, false
+	}
+
+	digits := trimmed[at+len(seqMember) : len(trimmed)-1]
+	seq, err := strconv.ParseUint(string(digits), 10, 64)
+	if err != nil {
+		return msg, 0, false
+	}
+
+	start := at
+	if body := bytes.TrimSpace(trimmed[:at]); len(body) > 0 &&
+		body[len(body)-1] == ',' {
+		start = len(body) - 1
+	}
+
+	unstamped := make([]byte, 0, start+1)
+	unstamped = append(unstamped, trimmed[:start]...)
+	return append(unstamped, '}'), seq, true
+}
+
+// Stamp and send msg on the WebSocket.  The lock is held over the write so
+// the numbers go out in order.
+func (l *seqLink) send(ws *webSocket, msg []byte) error {
+	l.Lock()
+	defer l.Unlock()
+	l.tx++
+	return ws.write(stampSeq(msg, l.tx))
+}
+
+// Check the stamp on msg received on the WebSocket, starting a resync on a
+// gap.  Returns msg unstamped.
+func (l *seqLink) receive(ws *webSocket, msg []byte) []byte {
+	msg, seq, ok := unstampSeq(msg)
+	if !ok {
+		return msg
+	}
+
+	l.Lock()
+	expect := l.rx + 1
+	switch {
+	case l.rx == 0 || seq == 1:
+		// First heard, or peer restarted
+		l.rx = seq
+		l.Unlock()
+		return msg
+	case seq < expect:
+		l.Unlock()
+		l.thing.log.printf("Link [%s] seq %d out of order; want %d",
+			ws.name, seq, expect)
+		return msg
+	case seq == expect:
+		l.rx = seq
+		l.Unlock()
+		return msg
+	}
+	l.rx = seq
+	l.Unlock()
+
+	l.thing.log.printf("Link [%s] gap: %d message(s) lost before seq %d",
+		ws.name, seq-expect, seq)
+
+	if ws.flags&sock_flag_mother != 0 {
+		l.thingResync(ws, msg)
+	} else {
+		l.primeResync(ws)
+	}
+
+	return msg
+}
+
+// On Thing, reply to a GetState of Thing's making, as if from mother, which
+// resyncs mother.  If msg is mother's own GetState, mother has already asked.
+func (l *seqLink) thingResync(ws *webSocket, msg []byte) {
+	var m Msg
+	pkt := newPacket(l.thing.bus, ws, nil)
+
+	pkt.msg = msg
+	pkt.Unmarshal(&m)
+	if m.Msg == GetState {
+		return
+	}
+
+	l.thing.bus.receive(pkt.Marshal(&Msg{Msg: GetState}))
+}
+
+// On Thing Prime, ask Thing for a resync, unless one is already on the way
+func (l *seqLink) primeResync(ws *webSocket) {
+	l.Lock()
+	pending := l.pending
+	l.pending = true
+	l.Unlock()
+
+	if pending {
+		return
+	}
+
+	ws.Send(newPacket(l.thing.bus, ws, &Msg{Msg: GetState}))
+}
+
+// Thing Prime asked Thing for a resync
+func (l *seqLink) asked() {
+	l.Lock()
+	l.pending = true
+	l.Unlock()
+}
+
+// Thing Prime's resync is done
+func (l *seqLink) resynced() {
+	l.Lock()
+	l.pending = false
+	l.Unlock()
+}
@@ -0,0 +1,148 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkSeqStamp(t *testing.T) {
+	tests := []struct {
+		msg, stamped string
+	}{
+		{`{"Msg":"A"}`, `{"Msg":"A","LinkSeq":7}`},
+		{`{}`, `{"LinkSeq":7}`},
+		{`{"Msg":"A","B":{"C":1}}`, `{"Msg":"A","B":{"C":1},"LinkSeq":7}`},
+	}
+
+	for _, test := range tests {
+		stamped := string(stampSeq([]byte(test.msg), 7))
+		if stamped != test.stamped {
+			t.Errorf("Stamped %s, want %s", stamped, test.stamped)
+		}
+		msg, seq, ok := unstampSeq([]byte(stamped))
+		if !ok || seq != 7 || string(msg) != test.msg {
+			t.Errorf("Unstamped %s: %s %d %t", stamped, msg, seq, ok)
+		}
+	}
+
+	for _, msg := range []string{`{"Msg":"A"}`, `{"B":{"LinkSeq":1}}`,
+		`{"LinkSeq":"x"}`, `not json`} {
+		if _, _, ok := unstampSeq([]byte(msg)); ok {
+			t.Errorf("Unstamped %s", msg)
+		}
+	}
+}
+
+// Next message read off the link, or "" if none
+func linkNext(got chan string) string {
+	select {
+	case msg := <-got:
+		return msg
+	case <-time.After(200 * time.Millisecond):
+		return ""
+	}
+}
+
+func TestLinkSeqPrime(t *testing.T) {
+	thing := NewThing(&lamp{})
+	thing.Cfg.Id = testId
+	thing.Cfg.IsPrime = true
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 10)
+	conn, done := chaosLinkTo(t, got)
+	defer done()
+
+	ws := newWebSocket(thing, "link", conn)
+	ws.link = thing.link
+
+	ws.Send(newPacket(thing.bus, nil, &Msg{Msg: "A"}))
+	ws.Send(newPacket(thing.bus, nil, &Msg{Msg: "B"}))
+	for _, want := range []string{`{"Msg":"A","LinkSeq":1}`,
+		`{"Msg":"B","LinkSeq":2}`} {
+		if msg := linkNext(got); msg != want {
+			t.Errorf("Sent %s, want %s", msg, want)
+		}
+	}
+
+	recv := func(msg string) string {
+		return string(ws.link.receive(ws, []byte(msg)))
+	}
+
+	// In order, or a restart, is quiet
+	for _, msg := range []string{`{"Msg":"A","LinkSeq":5}`,
+		`{"Msg":"A","LinkSeq":6}`, `{"Msg":"A","LinkSeq":1}`} {
+		if m := recv(msg); m != `{"Msg":"A"}` {
+			t.Errorf("Received %s", m)
+		}
+	}
+	if msg := linkNext(got); msg != "" {
+		t.Errorf("Sent %s, want nothing", msg)
+	}
+
+	// A gap asks Thing for a resync, once
+	recv(`{"Msg":"A","LinkSeq":3}`)
+	recv(`{"Msg":"A","LinkSeq":5}`)
+	if msg := linkNext(got); msg != `{"Msg":"_GetState","LinkSeq":3}` {
+		t.Errorf("Sent %s, want GetState", msg)
+	}
+	if msg := linkNext(got); msg != "" {
+		t.Errorf("Sent %s, want nothing", msg)
+	}
+
+	// Until the resync is done
+	thing.resynced(newPacket(thing.bus, &recordSocket{},
+		&MsgEventResync{Msg: EventResync}))
+	recv(`{"Msg":"A","LinkSeq":9}`)
+	if msg := linkNext(got); msg != `{"Msg":"_GetState","LinkSeq":4}` {
+		t.Errorf("Sent %s, want GetState", msg)
+	}
+}
+
+func TestLinkSeqThing(t *testing.T) {
+	thing := NewThing(&lamp{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 10)
+	conn, done := chaosLinkTo(t, got)
+	defer done()
+
+	ws := newWebSocket(thing, "link", conn)
+	ws.SetFlags(sock_flag_mother)
+	ws.link = thing.link
+
+	recv := func(msg string) {
+		ws.link.receive(ws, []byte(msg))
+	}
+
+	// Mother's own GetState after a gap is left to mother
+	recv(`{"Msg":"A","LinkSeq":1}`)
+	recv(`{"Msg":"_GetState","LinkSeq":3}`)
+	if msg := linkNext(got); msg != "" {
+		t.Errorf("Sent %s, want nothing", msg)
+	}
+
+	// Otherwise, Thing resyncs mother
+	recv(`{"Msg":"A","LinkSeq":5}`)
+	want := []string{
+		`{"Msg":"_ReplyState","On":false,"LinkSeq":1}`,
+		`{"Msg":"_EventResync","Seq":1,"Events":0,"Version":0,"LinkSeq":2}`,
+	}
+	for _, w := range want {
+		if msg := linkNext(got); msg != w {
+			t.Errorf("Sent %s, want %s", msg, w)
+		}
+	}
+}
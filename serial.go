@@ -0,0 +1,170 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Serial link to Thing's bus, one JSON message per line.  On TinyGo, a
+// serial link is how a microcontroller Thing talks to the world; on a host,
+// a serial link talks to a microcontroller Thing, e.g. on /dev/ttyACM0.
+type serialSocket struct {
+	sync.Mutex
+	thing  *Thing
+	name   string
+	flags  uint32
+	port   io.ReadWriter
+	closed bool
+	once   sync.Once
+}
+
+// Port read buffer size.  Small, for microcontrollers; longer lines are
+// read in pieces.
+const serialReadSize = 256
+
+// AddSerial adds a serial link, on port, to Thing.  Call before Run().  The
+// peer on the other end of the link is a client of Thing, as if on a
+// WebSocket to Thing's private server: the peer can send Thing any message,
+// and, once the peer has Thing's state (see GetState), gets Thing's
+// broadcasts.  Messages are JSON, one per line; other lines, such as
+// console output, are logged and dropped.
+//
+// On a host, port is the serial device, e.g. /dev/ttyACM0, opened with
+// os.OpenFile, and set to the peer's baud rate.  On TinyGo, port is a UART
+// wrapped by merle.UART:
+//
+//	thing := merle.NewThing(&blinky{})
+//	thing.AddSerial("usb", merle.UART(machine.Serial))
+//	thing.Run()
+func (t *Thing) AddSerial(name string, port io.ReadWriter) {
+	t.serials = append(t.serials, &serialSocket{thing: t, name: name,
+		flags: sock_flag_private, port: port})
+}
+
+func (s *serialSocket) start() error {
+	s.thing.bus.plugin(s)
+	go s.read()
+	return nil
+}
+
+func (s *serialSocket) stop() {
+	s.Close()
+	s.unplug()
+}
+
+func (s *serialSocket) unplug() {
+	s.once.Do(func() { s.thing.bus.unplug(s) })
+}
+
+func (s *serialSocket) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
+}
+
+// Read lines from the port, putting messages on the bus, until the port
+// closes.  Lines longer than Cfg.MaxMsgSize are dropped.
+func (s *serialSocket) read() {
+	t := s.thing
+	max := int(t.Cfg.MaxMsgSize)
+	r := bufio.NewReaderSize(s.port, serialReadSize)
+
+	var line []byte
+	skip := false
+
+	for {
+		frag, err := r.ReadSlice('\n')
+		if !skip {
+			line = append(line, frag...)
+			if max > 0 && len(line) > max {
+				t.log.printf("Serial [%s] dropping a line over %d bytes",
+					s.name, max)
+				line, skip = nil, true
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			t.log.printf("Serial [%s] closed: %s", s.name, err)
+			break
+		}
+		if s.isClosed() {
+			break
+		}
+
+		msg := bytes.TrimSpace(line)
+		switch {
+		case skip, len(msg) == 0:
+		case msg[0] != '{':
+			// Not a message.  On TinyGo, println output shares the
+			// port with the link.
+			t.log.printf("Serial [%s]: %s", s.name, msg)
+		default:
+			t.bus.receive(&Packet{bus: t.bus, src: s, msg: msg})
+		}
+		line, skip = nil, false
+	}
+
+	s.unplug()
+}
+
+func (s *serialSocket) Send(p *Packet) error {
+	msg := p.msg
+
+	// One message per line
+	if bytes.IndexByte(msg, '\n') >= 0 {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, msg); err != nil {
+			return err
+		}
+		msg = buf.Bytes()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	_, err := s.port.Write(append(append([]byte(nil), msg...), '\n'))
+	return err
+}
+
+// Close is called by the bus, maybe holding the bus's socket lock.  The
+// reader unplugs the socket once the port closes.
+func (s *serialSocket) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if c, ok := s.port.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (s *serialSocket) Name() string {
+	return s.name
+}
+
+func (s *serialSocket) Flags() uint32 {
+	return s.flags
+}
+
+func (s *serialSocket) SetFlags(flags uint32) {
+	s.flags = flags
+}
+
+func (s *serialSocket) Src() string {
+	return s.name
+}
@@ -0,0 +1,86 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serial port, as a pair of pipes
+type pipePort struct {
+	io.Reader
+	io.Writer
+	r *io.PipeReader
+}
+
+func (p *pipePort) Close() error {
+	return p.r.Close()
+}
+
+func TestSerial(t *testing.T) {
+	thing := NewThing(&echo{})
+	thing.Cfg.Id = testId
+	thing.Cfg.MaxMsgSize = 100
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peer writes to in, and reads from out
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	thing.AddSerial("usb", &pipePort{Reader: inR, Writer: outW, r: inR})
+	s := thing.serials[0]
+	s.start()
+
+	lines := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(outR)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	expect := func(want string) {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("Got %s, want %s", line, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No line, want %s", want)
+		}
+	}
+
+	// Console output and overlong lines are dropped
+	io.WriteString(inW, "booting...\r\n")
+	io.WriteString(inW, `{"Msg":"Echo","Pad":"`+strings.Repeat("x", 500)+"\"}\n")
+	io.WriteString(inW, "{\"Msg\":\"Echo\"}\r\n")
+	expect(`{"Msg":"Echo"}`)
+
+	// Broadcasts follow ReplyState
+	thing.bus.broadcast(newPacket(thing.bus, nil, &Msg{Msg: "Update"}))
+	io.WriteString(inW, "{\"Msg\":\"_GetState\"}\n")
+	expect(`{"Msg":"_ReplyState","Count":0}`)
+	// Sync with the reader, done with _GetState
+	io.WriteString(inW, "{\"Msg\":\"Echo\"}\n")
+	expect(`{"Msg":"Echo"}`)
+	thing.bus.broadcast(newPacket(thing.bus, nil, &Msg{Msg: "Update"}))
+	expect(`{"Msg":"Update"}`)
+
+	s.stop()
+	thing.bus.sockLock.RLock()
+	plugged := thing.bus.sockets[s]
+	thing.bus.sockLock.RUnlock()
+	if plugged {
+		t.Errorf("Serial still plugged in")
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWS IoT device shadow configuration.  Thing's state, as Thing replies to
+// GetState, is mirrored into the shadow's reported state, and desired-state
+// deltas are sent back to Thing as DeltaMsg messages, e.g., with DeltaMsg
+// "Click", desired {"Relay":1,"State":true} is received by Thing as:
+//
+//	{"Msg":"Click","Relay":1,"State":true}
+//
+// Thing broadcasting the new state updates the reported state, which clears
+// the delta.  The connector uses AWS IoT's HTTPS shadow API, authenticated
+// with the device's X.509 certificate.
+type ShadowConfig struct {
+
+	// AWS IoT data endpoint, e.g. "abc123-ats.iot.us-west-2.amazonaws.com".
+	// The shadow is disabled if Endpoint is empty.  The default is "".
+	Endpoint string
+
+	// [Optional] AWS IoT thing name.  The default is "" (Thing's Id).
+	ThingName string
+
+	// [Optional] Named shadow.  The default is "" (the classic shadow).
+	ShadowName string
+
+	// Device certificate and private key files (PEM)
+	CertFile string
+	KeyFile  string
+
+	// [Optional] Root CA file (PEM), e.g. AmazonRootCA1.pem.  The default
+	// is "" (the system's roots).
+	CAFile string
+
+	// [Optional] Msg of the messages Thing receives desired-state deltas
+	// in.  The default is "ShadowDelta".
+	DeltaMsg string
+
+	// [Optional] Seconds between shadow updates and delta polls.  The
+	// default is 10.
+	Interval uint
+}
+
+type shadowDoc struct {
+	State struct {
+		Delta map[string]json.RawMessage `json:"delta,omitempty"`
+	} `json:"state"`
+	Version uint64 `json:"version"`
+}
+
+type shadow struct {
+	thing *Thing
+	cfg   ShadowConfig
+	url   string
+	http  *http.Client
+	sync.Mutex
+	dirty   bool
+	delta   []byte
+	failing bool
+	ticker  *time.Ticker
+	done    chan bool
+}
+
+func newShadow(thing *Thing, cfg ShadowConfig) (*shadow, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Shadow certificate: %s", err)
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Shadow CA: %s", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Shadow CA: no certificates in %s",
+				cfg.CAFile)
+		}
+	}
+
+	name := cfg.ThingName
+	if name == "" {
+		name = thing.id
+	}
+
+	base := cfg.Endpoint
+	if !strings.Contains(base, "://") {
+		base = "https://" + base + ":8443"
+	}
+	u := base + "/things/" + url.PathEscape(name) + "/shadow"
+	if cfg.ShadowName != "" {
+		u += "?name=" + url.QueryEscape(cfg.ShadowName)
+	}
+
+	return &shadow{
+		thing: thing,
+		cfg:   cfg,
+		url:   u,
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		},
+		dirty: true,
+		done:  make(chan bool),
+	}, nil
+}
+
+// Bus tap to mark the reported state stale on Thing's broadcasts
+func (s *shadow) tap(p *Packet) {
+	s.Lock()
+	s.dirty = true
+	s.Unlock()
+}
+
+func (s *shadow) do(method string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == "GET" {
+		// No shadow yet; the first update makes one
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s: %s", method, s.url, resp.Status)
+	}
+	return data, nil
+}
+
+// Thing's state, without Msg, as Thing replies to GetState
+func (s *shadow) state() (map[string]json.RawMessage, error) {
+	sock := newApiSocket(0)
+	msg := Msg{Msg: GetState}
+	s.thing.bus.receive(newPacket(s.thing.bus, sock, &msg))
+
+	var reply []byte
+	select {
+	case reply = <-sock.reply:
+	default:
+		return nil, fmt.Errorf("No reply to %s", GetState)
+	}
+
+	state := map[string]json.RawMessage{}
+	if err := json.Unmarshal(s.thing.redactMsg(reply), &state); err != nil {
+		return nil, err
+	}
+	delete(state, "Msg")
+	return state, nil
+}
+
+// Report Thing's state, if it's changed
+func (s *shadow) report() error {
+	s.Lock()
+	dirty := s.dirty
+	s.dirty = false
+	s.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	state, err := s.state()
+	if err == nil {
+		var doc []byte
+		doc, err = json.Marshal(map[string]interface{}{
+			"state": map[string]interface{}{"reported": state},
+		})
+		if err == nil {
+			_, err = s.do("POST", doc)
+		}
+	}
+
+	if err != nil {
+		// Try again next time
+		s.Lock()
+		s.dirty = true
+		s.Unlock()
+	}
+	return err
+}
+
+// Poll the shadow for a delta, and send Thing any delta not sent already
+func (s *shadow) poll() error {
+	data, err := s.do("GET", nil)
+	if err != nil || data == nil {
+		return err
+	}
+
+	var doc shadowDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	if len(doc.State.Delta) == 0 {
+		s.delta = nil
+		return nil
+	}
+
+	delta, _ := json.Marshal(doc.State.Delta)
+	if bytes.Equal(delta, s.delta) {
+		return nil
+	}
+	s.delta = delta
+
+	msg := doc.State.Delta
+	msg["Msg"], _ = json.Marshal(s.cfg.DeltaMsg)
+	data, _ = json.Marshal(msg)
+
+	pkt := &Packet{bus: s.thing.bus, src: newApiSocket(0), msg: data}
+	s.thing.log.printf("Shadow delta (version %d): %.80s", doc.Version,
+		pkt.String())
+	s.thing.bus.receive(pkt)
+	return nil
+}
+
+// Sync with the shadow: report, then poll.  Errors are raised once, until
+// the shadow is reachable again.
+func (s *shadow) sync() {
+	err := s.report()
+	if err == nil {
+		err = s.poll()
+	}
+
+	switch {
+	case err != nil && !s.failing:
+		s.failing = true
+		s.thing.raise(newError(ErrShadow, err))
+	case err == nil && s.failing:
+		s.failing = false
+		s.thing.log.println("Shadow reachable again")
+	}
+}
+
+func (s *shadow) start() {
+	interval := time.Duration(s.cfg.Interval) * time.Second
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	s.ticker = time.NewTicker(interval)
+
+	go func() {
+		s.sync()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-s.ticker.C:
+				s.sync()
+			}
+		}
+	}()
+}
+
+func (s *shadow) stop() {
+	s.ticker.Stop()
+	s.done <- true
+}
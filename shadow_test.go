@@ -0,0 +1,185 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type relay struct {
+	sync.Mutex
+	Msg   string
+	State bool
+}
+
+func (r *relay) getState(p *Packet) {
+	r.Lock()
+	r.Msg = ReplyState
+	p.Marshal(r)
+	r.Unlock()
+	p.Reply()
+}
+
+func (r *relay) set(p *Packet) {
+	r.Lock()
+	p.Unmarshal(r)
+	r.Unlock()
+}
+
+func (r *relay) Subscribers() Subscribers {
+	return Subscribers{
+		GetState: r.getState,
+		"Set":    r.set,
+	}
+}
+
+func (r *relay) Assets() *ThingAssets { return &ThingAssets{} }
+
+// Write a self-signed device certificate and key to dir
+func writeDeviceCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "device.pem")
+	keyFile = filepath.Join(dir, "device.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func TestShadow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var lock sync.Mutex
+	var reported []byte
+	delta := `,"delta":{"State":true}`
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			t.Error("No device certificate")
+		}
+		if r.URL.Path != "/things/"+testId+"/shadow" {
+			t.Errorf("Path %s", r.URL.Path)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case "POST":
+			reported, _ = ioutil.ReadAll(r.Body)
+		case "GET":
+			w.Write([]byte(`{"state":{"desired":{"State":true}` + delta +
+				`},"version":7}`))
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: srv.Certificate().Raw}), 0600)
+
+	r := &relay{}
+	thing := NewThing(r)
+	thing.Cfg.Id = testId
+	thing.Cfg.Shadow.Endpoint = srv.URL
+	thing.Cfg.Shadow.CertFile, thing.Cfg.Shadow.KeyFile = writeDeviceCert(t, dir)
+	thing.Cfg.Shadow.CAFile = caFile
+	thing.Cfg.Shadow.DeltaMsg = "Set"
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	s := thing.shadow
+
+	checkReported := func(want string) {
+		lock.Lock()
+		defer lock.Unlock()
+		if string(reported) != want {
+			t.Errorf("Reported %s, want %s", reported, want)
+		}
+	}
+
+	// Report state, then the delta is sent to Thing as Set
+	if err := s.report(); err != nil {
+		t.Fatal(err)
+	}
+	checkReported(`{"state":{"reported":{"State":false}}}`)
+	if err := s.poll(); err != nil {
+		t.Fatal(err)
+	}
+	r.Lock()
+	if !r.State {
+		t.Errorf("Delta not received")
+	}
+	// The same delta isn't sent again
+	r.State = false
+	r.Unlock()
+	if err := s.poll(); err != nil {
+		t.Fatal(err)
+	}
+	r.Lock()
+	if r.State {
+		t.Errorf("Delta received twice")
+	}
+	r.State = true
+	r.Unlock()
+
+	// Nothing to report until Thing broadcasts
+	lock.Lock()
+	reported = nil
+	delta = ""
+	lock.Unlock()
+	if err := s.report(); err != nil {
+		t.Fatal(err)
+	}
+	checkReported("")
+	s.tap(nil)
+	if err := s.report(); err != nil {
+		t.Fatal(err)
+	}
+	checkReported(`{"state":{"reported":{"State":true}}}`)
+	if err := s.poll(); err != nil || s.delta != nil {
+		t.Errorf("Delta %s, err %v", s.delta, err)
+	}
+}
@@ -7,6 +7,12 @@ package merle
 // Socket flags
 const (
 	sock_flag_bcast uint32 = 1 << iota
+	// Socket connects to mother (Thing Prime or bridge)
+	sock_flag_mother
+	// Socket opened on the private HTTP server
+	sock_flag_private
+	// Socket can only send requests (see RoleViewer)
+	sock_flag_readonly
 )
 
 // socketer is an interface to a socket.  A socket plugs into a bus.
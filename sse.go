@@ -0,0 +1,148 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Server-Sent Events stream of Thing's broadcasts, at /{id}/events on the
+// public server.  The stream starts with Thing's state, as _ReplyState, then
+// each message Thing broadcasts follows, one event per message:
+//
+//	data: {"Msg":"Click","Relay":1,"State":true}
+//
+// The stream is read-only; send messages on a WebSocket, or with the REST
+// API.  A comment is sent every Cfg.PingInterval seconds so proxies don't
+// time out a quiet stream.
+type sseSocket struct {
+	thing *Thing
+	name  string
+	flags uint32
+	sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	closed  chan bool
+	once    sync.Once
+}
+
+func (s *sseSocket) write(format string, a ...interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := fmt.Fprintf(s.w, format, a...); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseSocket) Send(p *Packet) error {
+	return s.write("data: %s\n\n", p.msg)
+}
+
+func (s *sseSocket) Close() {
+	s.once.Do(func() { close(s.closed) })
+}
+
+func (s *sseSocket) Name() string {
+	return s.name
+}
+
+// Flags are set from the stream's goroutine while broadcasts read them
+func (s *sseSocket) Flags() uint32 {
+	return atomic.LoadUint32(&s.flags)
+}
+
+func (s *sseSocket) SetFlags(flags uint32) {
+	atomic.StoreUint32(&s.flags, flags)
+}
+
+func (s *sseSocket) Src() string {
+	return s.thing.id
+}
+
+// Stream Thing's broadcasts as Server-Sent Events
+func (t *Thing) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if child := t.getChild(id); child != nil {
+		child.events(w, r)
+		return
+	}
+	if id != t.id {
+		http.Error(w, "Mismatch on Ids", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if !t.bus.reserve() {
+		t.log.printf("Event stream rejected [%s]; %d connections max",
+			r.RemoteAddr, t.Cfg.MaxConnections)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sock := &sseSocket{
+		thing:   t,
+		name:    "sse:" + r.RemoteAddr + r.RequestURI,
+		w:       w,
+		flusher: flusher,
+		closed:  make(chan bool),
+	}
+
+	t.log.printf("Event stream opened [%s]", sock.name)
+	t.bus.attach(sock)
+
+	// Broadcasts follow ReplyState
+	msg := Msg{Msg: GetState}
+	t.bus.receive(newPacket(t.bus, sock, &msg))
+
+	var ping <-chan time.Time
+	if t.Cfg.PingInterval > 0 {
+		ticker := time.NewTicker(time.Duration(t.Cfg.PingInterval) * time.Second)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+loop:
+	for {
+		select {
+		case <-r.Context().Done():
+			break loop
+		case <-sock.closed:
+			break loop
+		case <-ping:
+			if sock.write(": ping\n\n") != nil {
+				break loop
+			}
+		}
+	}
+
+	t.log.printf("Event stream closed [%s]", sock.name)
+	t.bus.unplug(sock)
+}
@@ -0,0 +1,108 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type clicker struct {
+	echo
+}
+
+func (c *clicker) Subscribers() Subscribers {
+	return Subscribers{
+		GetState: c.getState,
+		"Click":  Broadcast,
+	}
+}
+
+func TestEvents(t *testing.T) {
+	thing := NewThing(&clicker{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(thing.web.public.mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/" + testId + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %s", ct)
+	}
+
+	events := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+				events <- strings.TrimPrefix(line, "data: ")
+			}
+		}
+		close(events)
+	}()
+
+	next := func() string {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("No event")
+			return ""
+		}
+	}
+
+	if event := next(); event != `{"Msg":"_ReplyState","Count":0}` {
+		t.Errorf("First event %s", event)
+	}
+
+	// Broadcasts follow once ReplyState is sent
+	ready := func() bool {
+		thing.bus.sockLock.RLock()
+		defer thing.bus.sockLock.RUnlock()
+		for s := range thing.bus.sockets {
+			if s.Flags()&sock_flag_bcast == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for deadline := time.Now().Add(time.Second); !ready(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Stream not ready for broadcasts")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A broadcast from someone else is streamed
+	sock := &recordSocket{}
+	thing.bus.plugin(sock)
+	click := `{"Msg":"Click","Relay":1}`
+	thing.bus.receive(&Packet{bus: thing.bus, src: sock, msg: []byte(click)})
+
+	if event := next(); event != click {
+		t.Errorf("Event %s, want %s", event, click)
+	}
+
+	// Closing the bus ends the stream
+	thing.bus.close()
+	for range events {
+	}
+}
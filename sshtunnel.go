@@ -0,0 +1,246 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Container mode (see Cfg.Container) has no ssh binary, so the tunnel to
+// mother is made in-process: the port is asked for over the SSH connection,
+// and mother's port is forwarded back to Thing's private port, as
+// "ssh -R" would.
+
+var errNoPAM = errors.New("No PAM in container mode, or built with -tags nopam")
+
+// Private keys tried, in ~/.ssh, if Cfg.MotherKeyFile isn't given
+var sshDefaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+func (t *tunnel) sshAuth() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	var signers []ssh.Signer
+
+	files := []string{t.thing.Cfg.MotherKeyFile}
+	if files[0] == "" {
+		home, _ := os.UserHomeDir()
+		files = files[:0]
+		for _, key := range sshDefaultKeys {
+			files = append(files, filepath.Join(home, ".ssh", key))
+		}
+	}
+
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			if t.thing.Cfg.MotherKeyFile != "" {
+				return nil, err
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("Key %s: %s", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			client := agent.NewClient(conn)
+			methods = append(methods, ssh.PublicKeysCallback(client.Signers))
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("No SSH keys for mother")
+	}
+
+	return methods, nil
+}
+
+// SSH connection to mother at ep
+func (t *tunnel) sshDial(ep MotherHint) (*ssh.Client, error) {
+	knownHosts := t.thing.Cfg.MotherKnownHosts
+	if knownHosts == "" {
+		home, _ := os.UserHomeDir()
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKey, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, newError(ErrTunnel, err)
+	}
+
+	auth, err := t.sshAuth()
+	if err != nil {
+		return nil, newError(ErrTunnelAuth, err)
+	}
+
+	addr := ep.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            ep.User,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		t.thing.log.printf("Tunnel SSH to %s failed: %s", addr, err)
+		// ssh reports refused credentials as "unable to authenticate"
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, newError(ErrTunnelAuth, err)
+		}
+		return nil, newError(ErrTunnel, err)
+	}
+
+	return client, nil
+}
+
+// Get a port on mother over SSH, from mother's private HTTP server
+func (t *tunnel) sshGetPort(ep MotherHint) (string, error) {
+	client, err := t.sshDial(ep)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	privatePort := strconv.FormatUint(uint64(ep.PortPrivate), 10)
+	url := "http://localhost:" + privatePort + "/port/" + t.thing.id
+
+	t.thing.log.printf("Tunnel getting port [%s@%s %s]", ep.User, ep.Host, url)
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+				return client.Dial(network, addr)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		t.thing.log.printf("Tunnel get port failed: %s", err)
+		return "", newError(ErrTunnel, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", newError(ErrTunnel, err)
+	}
+
+	return string(body), nil
+}
+
+// Forward port on mother to Thing's private port, until the SSH connection
+// drops
+func (t *tunnel) sshTunnel(ep MotherHint, port string) error {
+	client, err := t.sshDial(ep)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	t.thing.log.printf("Creating tunnel [%s@%s -R %s:localhost:%d]",
+		ep.User, ep.Host, port, t.portPrivate)
+
+	ln, err := client.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.thing.log.printf("Create tunnel failed: %s", err)
+		return newError(ErrTunnel, err)
+	}
+
+	done := make(chan bool)
+	defer close(done)
+
+	// Keep the connection alive, and notice when it isn't
+	if interval := t.thing.Cfg.PingInterval; interval > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(interval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+					if err != nil {
+						client.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		client.Wait()
+		ln.Close()
+	}()
+
+	private := "127.0.0.1:" + strconv.FormatUint(uint64(t.portPrivate), 10)
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	for {
+		remote, err := ln.Accept()
+		if err != nil {
+			return newError(ErrTunnel, err)
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			sshForward(remote, private)
+		}()
+	}
+}
+
+// Pipe remote to Thing's private server at addr
+func sshForward(remote net.Conn, addr string) {
+	defer remote.Close()
+
+	local, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer local.Close()
+
+	copied := make(chan bool, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		copied <- true
+	}
+	go pipe(local, remote)
+	go pipe(remote, local)
+
+	// Either side hanging up ends both
+	<-copied
+}
@@ -0,0 +1,122 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+func (b *bus) socketStatus() []SocketStatus {
+	b.sockLock.RLock()
+	defer b.sockLock.RUnlock()
+
+	var status []SocketStatus
+	for sock := range b.sockets {
+		status = append(status, SocketStatus{
+			Name:   sock.Name(),
+			Mother: sock.Flags()&sock_flag_mother != 0,
+			Ready:  sock.Flags()&sock_flag_bcast != 0,
+			Standby: b.thing.election != nil &&
+				sock.Flags()&sock_flag_mother != 0 &&
+				!b.thing.election.isActive(sock),
+		})
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+
+	return status
+}
+
+// Kind of socket s on the bus, for MsgSock
+func (b *bus) sockKind(s socketer) string {
+	if s.Flags()&sock_flag_mother != 0 {
+		return SockMother
+	}
+	if b.thing.primeSock != nil && s == b.thing.primeSock {
+		return SockThing
+	}
+	switch s.(type) {
+	case *webSocket, *sseSocket, *grpcSocket:
+		return SockClient
+	case *wireSocket:
+		return SockBridge
+	}
+	return SockLink
+}
+
+func (b *bridge) childStatus() []ChildStatus {
+	var status []ChildStatus
+
+	b.childrenLock.RLock()
+	defer b.childrenLock.RUnlock()
+
+	for _, child := range b.children {
+		status = append(status, ChildStatus{
+			Id:     child.id,
+			Model:  child.model,
+			Name:   child.name,
+			Online: child.online,
+			Groups: b.groupsOf(child, child.name),
+		})
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Id < status[j].Id
+	})
+
+	return status
+}
+
+// Subscriber handler for GetStatus.  Status is only given on the private HTTP
+// server, as socket names show the addresses of everyone connected.
+func (t *Thing) getStatus(p *Packet) {
+	if p.src == nil || p.src.Flags()&sock_flag_private == 0 {
+		t.log.println("Ignoring GetStatus; not on private server")
+		return
+	}
+
+	resp := MsgStatus{
+		Msg:        ReplyStatus,
+		Sockets:    t.bus.socketStatus(),
+		Tunnel:     t.tunnel.getStatus(),
+		Components: t.Components(),
+	}
+
+	if t.standby != nil {
+		standby := t.standby.getStatus()
+		resp.TunnelStandby = &standby
+	}
+
+	if t.isBridge {
+		resp.Children = t.bridge.childStatus()
+	}
+
+	if t.duty != nil {
+		resp.Duty = t.duty.status()
+	}
+
+	resp.Errors = t.Errors()
+
+	p.Marshal(&resp).Reply()
+}
+
+// Latest framework error of each Code, as JSON, for the private server's
+// /errors endpoint
+func (t *Thing) errorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Errors())
+}
@@ -0,0 +1,103 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGetStatus(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := &recordSocket{}
+	thing.bus.plugin(sock)
+
+	// Not on private server
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: GetStatus}))
+	if len(sock.sent) != 0 {
+		t.Fatalf("Got status on public socket")
+	}
+
+	sock.SetFlags(sock_flag_private | sock_flag_mother)
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: GetStatus}))
+	if len(sock.sent) != 1 {
+		t.Fatalf("Got %d replies, want 1", len(sock.sent))
+	}
+
+	var status MsgStatus
+	json.Unmarshal([]byte(sock.sent[0]), &status)
+
+	if len(status.Sockets) != 1 || !status.Sockets[0].Mother {
+		t.Errorf("Got sockets %+v", status.Sockets)
+	}
+	if status.Tunnel.State != TunnelDisabled {
+		t.Errorf("Got tunnel %+v", status.Tunnel)
+	}
+	if len(status.Components) == 0 {
+		t.Errorf("Missing components")
+	}
+}
+
+func TestPrimeElection(t *testing.T) {
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	thing.Cfg.MotherHostStandby = "standby.example.com"
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	role := func(sock *recordSocket) MsgPrimeRole {
+		var msg MsgPrimeRole
+		json.Unmarshal([]byte(sock.sent[len(sock.sent)-1]), &msg)
+		return msg
+	}
+
+	first := &recordSocket{flags: sock_flag_private | sock_flag_mother}
+	second := &recordSocket{flags: sock_flag_private | sock_flag_mother}
+	thing.bus.plugin(first)
+	thing.bus.plugin(second)
+	thing.election.join(first)
+	thing.election.join(second)
+
+	if r := role(first); !r.Active || r.Term != 1 {
+		t.Errorf("First Prime got %+v, want active", r)
+	}
+	if r := role(second); r.Active {
+		t.Errorf("Second Prime got %+v, want standby", r)
+	}
+
+	sock := &recordSocket{flags: sock_flag_private}
+	thing.bus.plugin(sock)
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: GetStatus}))
+
+	var status MsgStatus
+	json.Unmarshal([]byte(sock.sent[0]), &status)
+	standbys := 0
+	for _, s := range status.Sockets {
+		if s.Standby {
+			standbys++
+		}
+	}
+	if standbys != 1 || status.TunnelStandby == nil {
+		t.Errorf("Got status %+v", status)
+	}
+
+	// Failover
+	thing.election.leave(first)
+	if r := role(second); !r.Active || r.Term != 2 {
+		t.Errorf("Second Prime got %+v after failover, want active", r)
+	}
+	if !thing.election.isActive(second) {
+		t.Errorf("Second Prime isn't active")
+	}
+}
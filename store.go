@@ -0,0 +1,320 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// Store persists Thing's state across Thing restarts.  Thing's state is the
+// Thinger, the same struct marshaled in response to GetState.  Only exported
+// members of the Thinger are stored.
+//
+// Thing's state is loaded from the Store after CmdInit and before CmdRun,
+// and saved to the Store when CmdRun exits.  Save Thing's state on demand
+// with Packet.SaveState().
+//
+// NewFileStore returns the default Store, backed by a JSON file.  Set
+// Cfg.StoreFile to use the default Store, or use Thing.SetStore() for other
+// backends.
+type Store interface {
+	// Load state into v.  Loading from an empty Store is not an error;
+	// v is left unchanged.
+	Load(v interface{}) error
+	// Save state from v
+	Save(v interface{}) error
+}
+
+type fileStore struct {
+	sync.Mutex
+	file string
+}
+
+// NewFileStore returns a Store backed by a JSON file
+func NewFileStore(file string) Store {
+	return &fileStore{file: file}
+}
+
+func (s *fileStore) Load(v interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Write to a temp file first and then rename so a crash mid-write doesn't
+// lose the last good state.
+func (s *fileStore) Save(v interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.file)
+}
+
+// SetStore sets the Store used to persist Thing's state.  SetStore overrides
+// Cfg.StoreFile.  Call SetStore before thing.Run().
+func (t *Thing) SetStore(s Store) {
+	t.store = s
+}
+
+type rlocker interface {
+	RLock()
+	RUnlock()
+}
+
+// Load Thing's state from the Store.  If the Thinger is a sync.Locker, it's
+// locked while loading.
+func (t *Thing) loadState() error {
+	if t.store == nil {
+		return nil
+	}
+
+	if l, ok := t.thinger.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	return t.store.Load(t.thinger)
+}
+
+// SaveState saves Thing's state to the Store.  If the Thinger has RLock()
+// or is a sync.Locker, it's locked while saving, so don't call SaveState
+// with the Thinger's locks held.  SaveState is a no-op if there is no Store.
+func (t *Thing) SaveState() error {
+	if t.store == nil {
+		return nil
+	}
+
+	thinger := t.getThinger()
+
+	switch l := thinger.(type) {
+	case rlocker:
+		l.RLock()
+		defer l.RUnlock()
+	case sync.Locker:
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	return t.store.Save(thinger)
+}
+
+// SaveState saves Thing's state to the Store.  Call SaveState from a
+// subscriber handler after changing Thing's state.  Do not call with locks
+// held.
+//
+//	func (t *thing) setPoint(p *merle.Packet) {
+//		t.Lock()
+//		p.Unmarshal(t)
+//		t.Unlock()
+//		p.SaveState()
+//		p.Broadcast()
+//	}
+func (p *Packet) SaveState() error {
+	t := p.bus.thing
+	err := t.SaveState()
+	if err != nil {
+		t.log.println("Saving state failed:", err)
+	}
+	return err
+}
+
+// StateValidator is implemented by a Thinger to validate changes made with
+// UpdateState.  ValidateState is called on a copy of the Thinger with the
+// changes applied, before the changes are committed.  Return a non-nil error
+// to reject the changes.  Only exported members of the copy are valid.
+//
+//	func (t *thermo) ValidateState() error {
+//		if t.Mode == "heat" && t.SetPoint > 85 {
+//			return &merle.StateRejection{Field: "SetPoint",
+//				Reason: "too hot for heat mode"}
+//		}
+//		return nil
+//	}
+type StateValidator interface {
+	ValidateState() error
+}
+
+// StateRejection is the error returned by UpdateState when changes are
+// rejected by validation.  Field is the offending state member, if known.
+type StateRejection struct {
+	Field  string
+	Reason string
+}
+
+func (r *StateRejection) Error() string {
+	if r.Field == "" {
+		return "State change rejected: " + r.Reason
+	}
+	return "State change rejected: " + r.Field + ": " + r.Reason
+}
+
+// UpdateState applies changes to Thing's state atomically.  Changes is
+// marshaled to JSON and the JSON members, except Msg, are applied to the
+// Thinger.  Either all changes are applied or none are.
+//
+// The changes are first applied to a copy of the Thinger, and the copy is
+// validated by the Thinger's ValidateState (see StateValidator), then by
+// each validator, in order, and then against Cfg.Interlocks and
+// Cfg.DutyLimits.  Validators are passed a pointer to the copy.  If
+// validation fails, the Thinger is unchanged and the validation error is
+// returned, as a *StateRejection.  Otherwise, the changes are applied to the
+// Thinger and Thing's state is saved to the Store, if any.
+//
+// If the Thinger is a sync.Locker, it's locked for the whole update, so
+// concurrent updates can't interleave.  Don't call UpdateState with the
+// Thinger's lock held, and don't lock the Thinger from validators.
+func (t *Thing) UpdateState(changes interface{},
+	validators ...func(proposed interface{}) error) error {
+
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	fields, err := stateMap(data)
+	if err != nil {
+		return err
+	}
+	data, _ = json.Marshal(fields)
+
+	thinger := t.getThinger()
+
+	if l, ok := thinger.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	// Apply the changes to a copy of the state and validate the copy
+
+	typ := reflect.TypeOf(thinger)
+	if typ.Kind() != reflect.Ptr {
+		return fmt.Errorf("Thinger must be a pointer to update state")
+	}
+
+	state, err := json.Marshal(thinger)
+	if err != nil {
+		return err
+	}
+	if t.faults != nil {
+		data = t.faults.stick(data, state)
+	}
+	proposed := reflect.New(typ.Elem()).Interface()
+	if err := json.Unmarshal(state, proposed); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, proposed); err != nil {
+		return &StateRejection{Reason: err.Error()}
+	}
+
+	if v, ok := proposed.(StateValidator); ok {
+		if err := v.ValidateState(); err != nil {
+			return rejection(err)
+		}
+	}
+	for _, validate := range validators {
+		if err := validate(proposed); err != nil {
+			return rejection(err)
+		}
+	}
+
+	// Outputs switched by the change, for interlocks, duty limits, and
+	// runtime counters
+	var before, after interface{}
+
+	if t.watchesOutputs() {
+		data, err := json.Marshal(proposed)
+		if err != nil {
+			return err
+		}
+		if before, after, err = decodeChange(state, data); err != nil {
+			return err
+		}
+	}
+	if t.interlocks != nil {
+		if err := t.interlocks.check(before, after); err != nil {
+			return rejection(err)
+		}
+	}
+	if t.duty != nil {
+		if err := t.duty.check(before, after); err != nil {
+			return rejection(err)
+		}
+	}
+
+	// Commit.  The Thinger is locked, so it's still in the state the
+	// changes were validated against.
+
+	if err := json.Unmarshal(data, thinger); err != nil {
+		return err
+	}
+
+	if before != nil {
+		t.outputsChanged(before, after)
+	}
+
+	if t.store != nil {
+		return t.store.Save(thinger)
+	}
+
+	return nil
+}
+
+func rejection(err error) *StateRejection {
+	if r, ok := err.(*StateRejection); ok {
+		return r
+	}
+	return &StateRejection{Reason: err.Error()}
+}
+
+// UpdateState applies the Packet's message to Thing's state atomically.  See
+// Thing.UpdateState.
+//
+//	type msgSetMode struct {
+//		Msg      string
+//		Mode     string
+//		SetPoint int
+//	}
+//
+//	func (t *thermo) setMode(p *merle.Packet) {
+//		if err := p.UpdateState(); err != nil {
+//			// reply with rejection, or drop
+//			return
+//		}
+//		p.Broadcast()
+//	}
+func (p *Packet) UpdateState(validators ...func(proposed interface{}) error) error {
+	t := p.bus.thing
+	err := t.UpdateState(json.RawMessage(p.msg), validators...)
+	if err != nil {
+		t.log.println("Updating state failed:", err)
+	}
+	return err
+}
@@ -0,0 +1,298 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type thermostat struct {
+	sync.Mutex
+	Msg      string
+	Mode     string
+	SetPoint int
+}
+
+func (t *thermostat) Subscribers() Subscribers { return Subscribers{} }
+func (t *thermostat) Assets() *ThingAssets     { return &ThingAssets{} }
+
+func (t *thermostat) ValidateState() error {
+	if t.Mode == "heat" && t.SetPoint > 85 {
+		return &StateRejection{Field: "SetPoint", Reason: "too hot"}
+	}
+	return nil
+}
+
+func TestUpdateState(t *testing.T) {
+	state := &thermostat{Msg: ReplyState, Mode: "cool", SetPoint: 90}
+	thing := NewThing(state)
+
+	change := struct {
+		Msg      string
+		Mode     string
+		SetPoint int
+	}{Msg: "SetMode", Mode: "heat", SetPoint: 70}
+
+	if err := thing.UpdateState(&change); err != nil {
+		t.Fatal(err)
+	}
+	if state.Mode != "heat" || state.SetPoint != 70 || state.Msg != ReplyState {
+		t.Errorf("Bad state after update: %+v", state)
+	}
+
+	// Setpoint alone would be rejected in heat mode
+	change.SetPoint = 90
+	err := thing.UpdateState(&change)
+	if r, ok := err.(*StateRejection); !ok || r.Field != "SetPoint" {
+		t.Errorf("Got %v, want SetPoint rejection", err)
+	}
+	if state.SetPoint != 70 {
+		t.Errorf("Rejected update was applied: %+v", state)
+	}
+
+	// Extra validator
+	change.Mode, change.SetPoint = "cool", 60
+	err = thing.UpdateState(&change, func(proposed interface{}) error {
+		if proposed.(*thermostat).SetPoint < 65 {
+			return &StateRejection{Field: "SetPoint", Reason: "too cold"}
+		}
+		return nil
+	})
+	if err == nil || state.Mode != "heat" {
+		t.Errorf("Validator didn't reject: %v, %+v", err, state)
+	}
+}
+
+type outputs struct {
+	sync.Mutex
+	States [3]bool
+	Fan    struct{ On bool }
+}
+
+func (o *outputs) Subscribers() Subscribers { return Subscribers{} }
+func (o *outputs) Assets() *ThingAssets     { return &ThingAssets{} }
+
+func TestPowerOn(t *testing.T) {
+	state := &outputs{States: [3]bool{true, true, false}}
+	state.Fan.On = true
+
+	thing := NewThing(state)
+	thing.Cfg.Id = testId
+	thing.Cfg.PowerOn = []PowerOnRule{
+		{Field: "States.0", Action: PowerOnOff},
+		{Field: "States.1", Action: PowerOnRestore},
+		{Field: "States.2", Action: PowerOnOn},
+		{Field: "Fan.On", Action: PowerOnOff},
+	}
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := thing.applyPowerOn(); err != nil {
+		t.Fatal(err)
+	}
+	if state.States != [3]bool{false, true, true} || state.Fan.On {
+		t.Errorf("Bad power-on state: %+v", state)
+	}
+
+	thing.Cfg.PowerOn = []PowerOnRule{{Field: "States.3", Action: PowerOnOn}}
+	if err := thing.applyPowerOn(); err == nil {
+		t.Errorf("Power-on of missing output didn't fail")
+	}
+
+	thing.Cfg.PowerOn = []PowerOnRule{{Field: "Fan.On", Action: "flip"}}
+	if err := thing.build(false); err == nil {
+		t.Errorf("Bad power-on action accepted")
+	}
+}
+
+type motor struct {
+	Forward bool
+	Reverse bool
+}
+
+func (m *motor) Subscribers() Subscribers { return Subscribers{} }
+func (m *motor) Assets() *ThingAssets     { return &ThingAssets{} }
+
+func TestInterlocks(t *testing.T) {
+	state := &motor{}
+	thing := NewThing(state)
+	thing.Cfg.Id = testId
+	thing.Cfg.Interlocks = []Interlock{
+		{Outputs: []string{"Forward", "Reverse"}, MinOffTime: 60},
+	}
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := thing.UpdateState(&motor{Forward: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both on
+	err := thing.UpdateState(&struct{ Reverse bool }{true})
+	if r, ok := err.(*StateRejection); !ok || r.Field != "Reverse" {
+		t.Errorf("Got %v, want Reverse rejection", err)
+	}
+
+	// Straight from forward to reverse, inside the off-time
+	err = thing.UpdateState(&motor{Reverse: true})
+	if r, ok := err.(*StateRejection); !ok || r.Field != "Reverse" {
+		t.Errorf("Got %v, want Reverse off-time rejection", err)
+	}
+	if !state.Forward || state.Reverse {
+		t.Errorf("Rejected update was applied: %+v", state)
+	}
+
+	if err := thing.UpdateState(&motor{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := thing.UpdateState(&motor{Reverse: true}); err == nil {
+		t.Errorf("Reverse on inside off-time")
+	}
+
+	// Off-time passed
+	thing.interlocks.lastOff[0] = time.Now().Add(-time.Minute)
+	if err := thing.UpdateState(&motor{Reverse: true}); err != nil {
+		t.Errorf("Reverse on after off-time: %v", err)
+	}
+
+	thing.Cfg.Interlocks = []Interlock{{Outputs: []string{"Forward"}}}
+	if err := thing.build(false); err == nil {
+		t.Errorf("Interlock of one output accepted")
+	}
+}
+
+type pump struct {
+	sync.Mutex
+	Pump    bool
+	cutoffs chan MsgDutyCutoff
+}
+
+func (p *pump) cutoff(pkt *Packet) {
+	var msg MsgDutyCutoff
+	pkt.Unmarshal(&msg)
+	p.cutoffs <- msg
+}
+
+func (p *pump) Subscribers() Subscribers {
+	return Subscribers{EventDutyCutoff: p.cutoff}
+}
+
+func (p *pump) Assets() *ThingAssets { return &ThingAssets{} }
+
+func TestDutyLimits(t *testing.T) {
+	state := &pump{cutoffs: make(chan MsgDutyCutoff, 1)}
+	thing := NewThing(state)
+	thing.Cfg.Id = testId
+	thing.Cfg.DutyLimits = []DutyLimit{
+		{Output: "Pump", MaxOnTime: 3600, MaxCycles: 2},
+	}
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+	defer thing.duty.stop()
+
+	on := &struct{ Pump bool }{true}
+	off := &struct{ Pump bool }{false}
+
+	if err := thing.UpdateState(on); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut off, as if on for MaxOnTime
+	thing.duty.cutoff(0, thing.duty.onSince[0])
+	select {
+	case msg := <-state.cutoffs:
+		if msg.Output != "Pump" {
+			t.Errorf("Got cutoff %+v", msg)
+		}
+	default:
+		t.Fatalf("No EventDutyCutoff")
+	}
+	if state.Pump {
+		t.Errorf("Pump still on after cutoff")
+	}
+
+	if err := thing.UpdateState(on); err != nil {
+		t.Fatal(err)
+	}
+	if err := thing.UpdateState(off); err != nil {
+		t.Fatal(err)
+	}
+
+	// Third cycle in the hour
+	err := thing.UpdateState(on)
+	if r, ok := err.(*StateRejection); !ok || r.Field != "Pump" {
+		t.Errorf("Got %v, want Pump rejection", err)
+	}
+
+	status := thing.duty.status()
+	if len(status) != 1 || status[0].On || status[0].Cycles != 2 {
+		t.Errorf("Got duty status %+v", status)
+	}
+}
+
+func TestRuntimeCounters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := &pump{cutoffs: make(chan MsgDutyCutoff, 1)}
+	thing := NewThing(state)
+	thing.Cfg.Id = testId
+	thing.Cfg.RuntimeCounters = []RuntimeCounter{
+		{Output: "Pump", ServiceCycles: 2},
+	}
+	thing.Cfg.RuntimeFile = filepath.Join(dir, "runtime")
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, on := range []bool{true, false, true} {
+		if err := thing.UpdateState(&struct{ Pump bool }{on}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Counters are restored on restart
+	cfg := thing.Cfg
+	thing = NewThing(&pump{})
+	thing.Cfg = cfg
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := &recordSocket{}
+	thing.bus.plugin(sock)
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: GetRuntime}))
+
+	var resp MsgRuntime
+	json.Unmarshal([]byte(sock.sent[0]), &resp)
+	if len(resp.Counters) != 1 {
+		t.Fatalf("Got %+v", resp)
+	}
+	if c := resp.Counters[0]; c.Cycles != 2 || c.ServiceCycles != 2 || !c.Due {
+		t.Errorf("Got counter %+v", c)
+	}
+
+	reset := MsgResetRuntime{Msg: ResetRuntime, Output: "Pump"}
+	thing.bus.receive(newPacket(thing.bus, sock, &reset))
+	json.Unmarshal([]byte(sock.sent[1]), &resp)
+	if c := resp.Counters[0]; c.Cycles != 2 || c.ServiceCycles != 0 || c.Due {
+		t.Errorf("Got counter %+v after reset", c)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long SwapThinger waits for CmdRun to return after CmdStop
+const swapTimeout = 10 * time.Second
+
+// Handoff between SwapThinger and the CmdRun loop (see runThinger).  The
+// CmdRun loop signals stopped once CmdRun returns, and then waits for resume
+// to run the new Thinger's CmdRun.
+type swap struct {
+	stopped chan bool
+	resume  chan bool
+}
+
+// Socket to catch the Thinger's ReplyState
+type stateSocket struct {
+	flags uint32
+	state []byte
+}
+
+func (s *stateSocket) Send(p *Packet) error {
+	s.state = p.msg
+	return nil
+}
+
+func (s *stateSocket) Close()                {}
+func (s *stateSocket) Name() string          { return "swap" }
+func (s *stateSocket) Flags() uint32         { return s.flags }
+func (s *stateSocket) SetFlags(flags uint32) { s.flags = flags }
+func (s *stateSocket) Src() string           { return "SYSTEM" }
+
+// SwapThinger swaps Thing's Thinger for a new Thinger while Thing runs, for
+// example to upgrade a model on a hub without restarting the hub.  Websockets
+// and the tunnel to mother stay up.
+//
+// The old Thinger is sent CmdStop, and SwapThinger waits for the old
+// Thinger's CmdRun to return.  The new Thinger gets CmdInit, and then the old
+// Thinger's state, its reply to GetState, is unmarshaled into the new
+// Thinger, overriding any defaults CmdInit set.  The new Thinger's
+// subscribers and assets replace the old, and the new Thinger gets CmdRun.
+// The old Thinger is torn down (see Teardowner), and the new Thinger set up
+// (see Setupper), before the swap.  If the new Thinger's Setup fails, the old
+// Thinger is set up again and stays, and gets CmdRun again.
+// Finally, each websocket ready for broadcasts gets a ReplyState from the new
+// Thinger, so browsers show the new Thinger without reconnecting.
+//
+// On Thing Prime, or a bridge's child, there is no CmdInit or CmdRun; the old
+// Thinger's state is handed to the new Thinger as a ReplyState message.
+//
+// If the old Thinger's CmdRun doesn't return within 10 seconds of CmdStop,
+// SwapThinger returns an error and the old Thinger stays.  The old Thinger's
+// CmdRun should not return after that; if it does, Run returns an error.
+func (t *Thing) SwapThinger(thinger Thinger) error {
+	t.swapLock.Lock()
+	defer t.swapLock.Unlock()
+
+	if t.bus == nil || (!t.isPrime && !t.online) {
+		return fmt.Errorf("Thing isn't running")
+	}
+
+	var s *swap
+	if !t.isPrime {
+		s = &swap{stopped: make(chan bool, 1), resume: make(chan bool)}
+		if err := t.stopThinger(s); err != nil {
+			return err
+		}
+	}
+
+	// Ready the new Thinger before it's on the bus
+
+	subs := thinger.Subscribers()
+
+	if !t.isPrime {
+		if f := subs[CmdInit]; f != nil {
+			f(newPacket(t.bus, nil, &Msg{Msg: CmdInit}))
+		}
+	}
+
+	sock := &stateSocket{}
+	t.bus.receive(newPacket(t.bus, sock, &Msg{Msg: GetState}))
+
+	if sock.state != nil {
+		if t.isPrime {
+			if f := subs[ReplyState]; f != nil {
+				f(&Packet{bus: t.bus, msg: sock.state})
+			}
+		} else if err := restoreState(thinger, sock.state); err != nil {
+			t.log.println("Restoring state to new Thinger failed:", err)
+		}
+	}
+
+	// Hand the hardware over from the old Thinger to the new
+
+	if !t.isPrime {
+		old := t.getThinger()
+		teardown(old)
+		if err := setup(thinger); err != nil {
+			if err := setup(old); err != nil {
+				t.log.println("Setting up old Thinger again failed:", err)
+			}
+			t.bus.resetStop()
+			close(s.resume)
+			return fmt.Errorf("Swapping Thinger: setup failed: %s", err)
+		}
+	}
+
+	t.runLock.Lock()
+	t.thinger = thinger
+	t.assets = thinger.Assets()
+	t.runLock.Unlock()
+	t.bus.setSubscribers(subs)
+	if t.web != nil {
+		t.setHtmlTemplate()
+	}
+
+	if !t.isPrime {
+		if err := t.SaveState(); err != nil {
+			t.log.println("Saving state failed:", err)
+		}
+		t.bus.resetStop()
+		close(s.resume)
+	}
+
+	t.log.println("Thinger swapped")
+
+	t.refreshSockets()
+
+	return nil
+}
+
+// Stop the Thinger's CmdRun.  On success, the CmdRun loop is left waiting on
+// s.resume.
+func (t *Thing) stopThinger(s *swap) error {
+	t.runLock.Lock()
+	t.runSwap = s
+	t.runLock.Unlock()
+
+	t.bus.stopRun()
+
+	select {
+	case <-s.stopped:
+		return nil
+	case <-time.After(swapTimeout):
+	}
+
+	t.runLock.Lock()
+	claimed := t.runSwap == nil
+	t.runSwap = nil
+	t.runLock.Unlock()
+
+	if claimed {
+		// CmdRun returned just now
+		<-s.stopped
+		return nil
+	}
+
+	t.bus.resetStop()
+	return fmt.Errorf("Swapping Thinger: CmdRun didn't stop")
+}
+
+// CmdRun returned.  If CmdRun was stopped by SwapThinger, wait for the swap
+// to finish and return true.
+func (t *Thing) swapped() bool {
+	t.runLock.Lock()
+	s := t.runSwap
+	t.runSwap = nil
+	t.runLock.Unlock()
+
+	if s == nil {
+		return false
+	}
+
+	s.stopped <- true
+	<-s.resume
+
+	return true
+}
+
+// Unmarshal state into the Thinger.  If the Thinger is a sync.Locker, it's
+// locked while unmarshaling.
+func restoreState(thinger Thinger, state []byte) error {
+	if l, ok := thinger.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	return json.Unmarshal(state, thinger)
+}
+
+// Send a ReplyState to each socket ready for broadcasts, except to the
+// sockets to Thing (on Thing Prime) or to the bridge (on a bridge's child)
+func (t *Thing) refreshSockets() {
+	var socks []socketer
+
+	t.bus.sockLock.RLock()
+	for sock := range t.bus.sockets {
+		if sock.Flags()&sock_flag_bcast == 0 {
+			continue
+		}
+		if t.primeSock != nil && sock == socketer(t.primeSock) {
+			continue
+		}
+		if t.bridgeSock != nil && sock == socketer(t.bridgeSock) {
+			continue
+		}
+		socks = append(socks, sock)
+	}
+	t.bus.sockLock.RUnlock()
+
+	for _, sock := range socks {
+		msg := Msg{Msg: GetState}
+		t.bus.receive(newPacket(t.bus, sock, &msg))
+	}
+}
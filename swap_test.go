@@ -0,0 +1,191 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type counter struct {
+	sync.Mutex
+	Msg     string
+	Count   int
+	inited  bool
+	forever bool
+	done    chan bool
+}
+
+func newCounter(forever bool) *counter {
+	return &counter{forever: forever, done: make(chan bool)}
+}
+
+func (c *counter) init(p *Packet) {
+	c.inited = true
+}
+
+func (c *counter) run(p *Packet) {
+	<-c.done
+}
+
+func (c *counter) stop(p *Packet) {
+	close(c.done)
+}
+
+func (c *counter) getState(p *Packet) {
+	c.Lock()
+	c.Msg = ReplyState
+	p.Marshal(c)
+	c.Unlock()
+	p.Reply()
+}
+
+func (c *counter) Subscribers() Subscribers {
+	if c.forever {
+		return Subscribers{
+			CmdInit:  c.init,
+			CmdRun:   RunForever,
+			GetState: c.getState,
+		}
+	}
+	return Subscribers{
+		CmdInit:  c.init,
+		CmdRun:   c.run,
+		CmdStop:  c.stop,
+		GetState: c.getState,
+	}
+}
+
+func (c *counter) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func TestSwapThinger(t *testing.T) {
+	v1 := newCounter(false)
+	v1.Count = 42
+
+	thing := NewThing(v1)
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := thing.SwapThinger(newCounter(false)); err == nil {
+		t.Errorf("Swap before running should fail")
+	}
+
+	thing.online = true
+	errc := make(chan error, 1)
+	go func() { errc <- thing.runThinger() }()
+
+	sock := &recordSocket{flags: sock_flag_bcast}
+	thing.bus.plugin(sock)
+
+	// Swap to a Thinger with RunForever, and then back to one handling
+	// CmdStop
+
+	v2 := newCounter(true)
+	if err := thing.SwapThinger(v2); err != nil {
+		t.Fatal(err)
+	}
+	if !v2.inited || v2.Count != 42 {
+		t.Errorf("New Thinger didn't get CmdInit and old state: %+v", v2)
+	}
+	if len(sock.sent) != 1 || !strings.Contains(sock.sent[0], `"Count":42`) {
+		t.Errorf("Socket didn't get new state: %v", sock.sent)
+	}
+
+	v3 := newCounter(false)
+	if err := thing.SwapThinger(v3); err != nil {
+		t.Fatal(err)
+	}
+	if !v3.inited || v3.Count != 42 || len(sock.sent) != 2 {
+		t.Errorf("Second swap: %+v, %v", v3, sock.sent)
+	}
+
+	select {
+	case err := <-errc:
+		t.Errorf("CmdRun loop exited: %s", err)
+	default:
+	}
+
+	// CmdStop from a socket is dropped
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: CmdStop}))
+	select {
+	case <-v3.done:
+		t.Errorf("CmdStop from socket stopped CmdRun")
+	default:
+	}
+}
+
+type hooked struct {
+	*counter
+	fail     error
+	setups   int
+	downs    int
+	conns    []Connection
+	disconns []Connection
+}
+
+func (h *hooked) Setup() error {
+	h.setups++
+	return h.fail
+}
+
+func (h *hooked) Teardown() {
+	h.downs++
+}
+
+func (h *hooked) Connected(c Connection) {
+	h.conns = append(h.conns, c)
+}
+
+func (h *hooked) Disconnected(c Connection) {
+	h.disconns = append(h.disconns, c)
+}
+
+func TestHooks(t *testing.T) {
+	v1 := &hooked{counter: newCounter(true)}
+
+	thing := NewThing(v1)
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	thing.online = true
+	go thing.runThinger()
+
+	sock := &recordSocket{flags: sock_flag_private}
+	thing.bus.plugin(sock)
+	thing.bus.unplug(sock)
+	want := Connection{Name: "record", Private: true}
+	if len(v1.conns) != 1 || v1.conns[0] != want ||
+		len(v1.disconns) != 1 || v1.disconns[0] != want {
+		t.Errorf("Got connections %+v, %+v", v1.conns, v1.disconns)
+	}
+
+	// Failed setup puts the old Thinger back
+	bad := &hooked{counter: newCounter(true), fail: fmt.Errorf("no GPIO")}
+	if err := thing.SwapThinger(bad); err == nil {
+		t.Fatal("Swap with failed setup should fail")
+	}
+	if thing.thinger != v1 || v1.downs != 1 || v1.setups != 1 {
+		t.Errorf("Old Thinger not restored: %+v", v1)
+	}
+
+	v2 := &hooked{counter: newCounter(true)}
+	if err := thing.SwapThinger(v2); err != nil {
+		t.Fatal(err)
+	}
+	if v1.downs != 2 || v2.setups != 1 || v2.downs != 0 {
+		t.Errorf("Old %+v, new %+v", v1, v2)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Config items a template can set, by path; a struct's items are listed
+// one by one.  Other items mother sends are dropped: identity items and
+// Tags (which select the templates) are Thing's own, and so are users,
+// auth, keys, files, and the other items guarding Thing.
+var templateItems = []string{
+	"PortPublic", "PortPublicTLS", "PublicFailure", "PrivateFailure",
+	"RetryInterval", "Advertise", "Alerts", "Schedules", "Latitude",
+	"Longitude", "JournalMax", "AuditMax", "PatchSnapshot",
+	"MaxConnections", "RejectWhenFull", "PingInterval", "PongTimeout",
+	"MaxMsgSize", "MaxMsgRate", "DedupWindow", "Heartbeat",
+	"History.Msgs", "History.Retention", "OutboxMax", "LoggingEnabled",
+}
+
+// Drop the items of config, at path, a template can't set
+func templateFilter(config map[string]interface{}, path string) {
+	for k, v := range config {
+		item := path + k
+		if contains(templateItems, item) {
+			continue
+		}
+		if m, ok := v.(map[string]interface{}); ok && templateParent(item) {
+			templateFilter(m, item+".")
+			continue
+		}
+		delete(config, k)
+	}
+}
+
+// Some of item's items can be set by a template
+func templateParent(item string) bool {
+	for _, t := range templateItems {
+		if strings.HasPrefix(t, item+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Config template state.  On Thing, the template received from mother.  On
+// mother, the drift last reported by Thing.
+type configTemplate struct {
+	sync.Mutex
+	msg   *MsgConfigTemplate
+	drift *MsgConfigDrift
+}
+
+// Merge mother's templates matching model and tags, in Cfg order, so later
+// templates override earlier ones
+func (t *Thing) matchTemplates(model string, tags []string) MsgConfigTemplate {
+	msg := MsgConfigTemplate{Msg: SetConfigTemplate,
+		Config: make(map[string]interface{})}
+
+	for _, tmpl := range t.Cfg.ConfigTemplates {
+		if tmpl.Model != "" && tmpl.Model != model {
+			continue
+		}
+		if tmpl.Tag != "" && !contains(tags, tmpl.Tag) {
+			continue
+		}
+		// Round-trip through JSON so the merge doesn't modify tmpl
+		var config interface{}
+		data, _ := json.Marshal(tmpl.Config)
+		json.Unmarshal(data, &config)
+		msg.Config = mergeApply(msg.Config, config).(map[string]interface{})
+		msg.Templates = append(msg.Templates, tmpl.Name)
+	}
+
+	return msg
+}
+
+// Send the config template matching the child, if mother has templates, to
+// the child on the socket.  A child matching no templates gets an empty
+// template, clearing any template the child had.
+func (t *Thing) sendConfigTemplate(sock socketer, model string, tags []string) {
+	if len(t.Cfg.ConfigTemplates) == 0 {
+		return
+	}
+	msg := t.matchTemplates(model, tags)
+	sock.Send(newPacket(t.bus, nil, &msg))
+}
+
+// Subscriber handler for SetConfigTemplate.  The template is only accepted
+// from mother.
+func (t *Thing) setConfigTemplate(p *Packet) {
+	var msg MsgConfigTemplate
+
+	if p.src == nil || p.src.Flags()&sock_flag_mother == 0 {
+		t.log.println("Ignoring config template; not from mother")
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	templateFilter(msg.Config, "")
+
+	t.template.Lock()
+	t.template.msg = &msg
+	t.template.Unlock()
+
+	t.log.printf("Config templates: %v", msg.Templates)
+
+	if err := t.template.save(t.Cfg.TemplateFile); err != nil {
+		t.log.println("Saving config template failed:", err)
+	}
+
+	t.Reload()
+}
+
+// Load the config template saved in file.  A missing file is no template.
+func (ct *configTemplate) load(file string) error {
+	var msg MsgConfigTemplate
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	templateFilter(msg.Config, "")
+
+	ct.Lock()
+	ct.msg = &msg
+	ct.Unlock()
+
+	return nil
+}
+
+func (ct *configTemplate) save(file string) error {
+	if file == "" {
+		return nil
+	}
+
+	ct.Lock()
+	data, err := json.Marshal(ct.msg)
+	ct.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func (ct *configTemplate) get() *MsgConfigTemplate {
+	ct.Lock()
+	defer ct.Unlock()
+	return ct.msg
+}
+
+// Apply template config items to cfg
+func applyTemplate(cfg *ThingConfig, config map[string]interface{}) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, cfg)
+}
+
+// Collect template items which differ from the actual config, keyed by item
+// path, e.g. "History.File"
+func driftItems(drift map[string]ConfigDriftItem, path string,
+	template, actual map[string]interface{}) {
+
+	for k, tv := range template {
+		av := actual[k]
+		tm, tIsMap := tv.(map[string]interface{})
+		am, aIsMap := av.(map[string]interface{})
+		if tIsMap && aIsMap {
+			driftItems(drift, path+k+".", tm, am)
+			continue
+		}
+		if !reflect.DeepEqual(tv, av) {
+			drift[path+k] = ConfigDriftItem{Template: tv, Actual: av}
+		}
+	}
+}
+
+// Compare Thing's config against Thing's template
+func (t *Thing) configDrift(msg *MsgConfigTemplate) MsgConfigDrift {
+	var actual map[string]interface{}
+
+	cfg := t.config()
+	data, _ := json.Marshal(&cfg)
+	json.Unmarshal(data, &actual)
+
+	drift := MsgConfigDrift{
+		Msg:       EventConfigDrift,
+		Id:        t.id,
+		Templates: msg.Templates,
+		Drift:     make(map[string]ConfigDriftItem),
+	}
+	driftItems(drift.Drift, "", msg.Config, actual)
+
+	return drift
+}
+
+// Broadcast Thing's config drift, if Thing has a template
+func (t *Thing) sendConfigDrift() {
+	msg := t.template.get()
+	if msg == nil {
+		return
+	}
+	drift := t.configDrift(msg)
+	if len(drift.Drift) > 0 {
+		t.log.printf("Config drifts from template: %v", drift.Drift)
+	}
+	newPacket(t.bus, nil, &drift).Broadcast()
+}
+
+// Mother subscriber handler for EventConfigDrift.  Save the drift and pass
+// it on to mother's listeners.
+func (t *Thing) saveConfigDrift(p *Packet) {
+	var msg MsgConfigDrift
+
+	p.Unmarshal(&msg)
+
+	t.template.Lock()
+	t.template.drift = &msg
+	t.template.Unlock()
+
+	p.Broadcast()
+}
+
+func (t *Thing) lastConfigDrift() *MsgConfigDrift {
+	t.template.Lock()
+	defer t.template.Unlock()
+	return t.template.drift
+}
+
+// ConfigDrift returns the config drift last reported by each of mother's
+// children: Thing Prime's Thing, or a bridge's children.  Children with no
+// template are not listed.  A child with an empty Drift matches its
+// template.
+func (t *Thing) ConfigDrift() []MsgConfigDrift {
+	var drifts []MsgConfigDrift
+
+	if drift := t.lastConfigDrift(); drift != nil {
+		drifts = append(drifts, *drift)
+	}
+
+	if t.isBridge {
+		for _, child := range t.bridge.childThings() {
+			if drift := child.lastConfigDrift(); drift != nil {
+				drifts = append(drifts, *drift)
+			}
+		}
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].Id < drifts[j].Id
+	})
+
+	return drifts
+}
+
+// Serve ConfigDrift on GET /drift
+func (t *Thing) driftHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.ConfigDrift())
+}
@@ -0,0 +1,128 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mother := NewThing(&sparse{})
+	mother.Cfg.IsPrime = true
+	mother.Cfg.ConfigTemplates = []ConfigTemplate{
+		{Name: "relays", Model: "relays", Config: map[string]interface{}{
+			"PortPublic":     80,
+			"LoggingEnabled": true,
+			"History": map[string]interface{}{"Retention": 3600,
+				"File": "/etc/passwd"},
+		}},
+		{Name: "garage", Tag: "garage", Config: map[string]interface{}{
+			"LoggingEnabled": false,
+			"User":           "bob",
+			"user":           "eve",
+			"AuthFile":       "/tmp/auth",
+			"Id":             "hijack",
+		}},
+		{Name: "other", Model: "bmp180", Config: map[string]interface{}{
+			"User": "carol",
+		}},
+	}
+	if err := mother.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := mother.matchTemplates("relays", []string{"garage"})
+	if want := []string{"relays", "garage"}; !reflect.DeepEqual(msg.Templates, want) {
+		t.Errorf("Got templates %v, want %v", msg.Templates, want)
+	}
+	if msg.Config["User"] != "bob" {
+		t.Errorf("Got User %v, want bob", msg.Config["User"])
+	}
+
+	file := filepath.Join(dir, "template.json")
+
+	// Child sets PortPublic in code, overriding the template
+
+	child := NewThing(&sparse{})
+	child.Cfg.Id = testId
+	child.Cfg.Model = "relays"
+	child.Cfg.PortPublic = 8081
+	child.Cfg.TemplateFile = file
+	if err := child.configure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := &recordSocket{flags: sock_flag_bcast}
+	child.bus.plugin(sock)
+
+	// Not from mother
+	child.bus.receive(newPacket(child.bus, sock, &msg))
+	if child.template.get() != nil {
+		t.Errorf("Template accepted from non-mother")
+	}
+
+	sock.SetFlags(sock_flag_bcast | sock_flag_mother)
+	child.bus.receive(newPacket(child.bus, sock, &msg))
+
+	if child.Cfg.LoggingEnabled || child.id != testId {
+		t.Errorf("Got LoggingEnabled %t, Id %s after template",
+			child.Cfg.LoggingEnabled, child.id)
+	}
+
+	// Only items a fleet shares can be templated
+	if child.Cfg.User != "" || child.Cfg.AuthFile != "" {
+		t.Errorf("Template set User %q, AuthFile %q", child.Cfg.User,
+			child.Cfg.AuthFile)
+	}
+
+	var drift MsgConfigDrift
+	if len(sock.sent) != 1 {
+		t.Fatalf("Got %d messages, want drift", len(sock.sent))
+	}
+	json.Unmarshal([]byte(sock.sent[0]), &drift)
+
+	// PortPublic is overridden and History isn't reloadable
+	if len(drift.Drift) != 2 ||
+		drift.Drift["PortPublic"].Actual != float64(8081) ||
+		drift.Drift["History.Retention"].Template != float64(3600) {
+		t.Errorf("Got drift %v", drift.Drift)
+	}
+
+	// Mother saves drift
+	mother.bus.receive(newPacket(mother.bus, nil, &drift))
+	if drifts := mother.ConfigDrift(); len(drifts) != 1 || drifts[0].Id != testId {
+		t.Errorf("Got mother drift %v", drifts)
+	}
+
+	// On restart, the saved template is layered under Cfg
+
+	child = NewThing(&sparse{})
+	child.Cfg.TemplateFile = file
+	if err := child.configure(); err != nil {
+		t.Fatal(err)
+	}
+	if child.Cfg.PortPublic != 80 || child.Cfg.History.Retention != 3600 ||
+		child.Cfg.History.File != "" || child.Cfg.User != "" {
+		t.Errorf("Got PortPublic %d, History %+v, User %q after restart",
+			child.Cfg.PortPublic, child.Cfg.History, child.Cfg.User)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Support for testing Thingers without servers or hardware.  Most tests
+// should use package merletest, which is built on these.
+
+// TestPort is an in-process connection to Thing's bus, standing in for a
+// browser or other client.  Messages sent to the port, replies and
+// broadcasts, are handed to the port's receive function.  Unlike a
+// WebSocket client, a TestPort gets broadcasts from the start, without
+// first getting ReplyState.
+type TestPort struct {
+	thing *Thing
+	name  string
+	flags uint32
+	recv  func(msg []byte, reply bool)
+	once  sync.Once
+}
+
+// StartTest readies Thing for testing.  Thing is built from Cfg, without
+// Configurators, servers, or stored state, and receives CmdInit, sets its
+// outputs to their power-on state, and sets up the Thinger (see Setupper),
+// as in Run.  CmdRun isn't received; see TestRun.  Call StopTest when done.
+func (t *Thing) StartTest() error {
+	if err := t.build(false); err != nil {
+		return err
+	}
+
+	t.online = true
+
+	msg := Msg{Msg: CmdInit}
+	t.bus.receive(newPacket(t.bus, nil, &msg))
+
+	if err := t.applyPowerOn(); err != nil {
+		return err
+	}
+
+	return setup(t.thinger)
+}
+
+// TestRun receives CmdRun, returning when CmdRun returns.  Call TestRun in
+// a goroutine; StopTest stops CmdRun.
+func (t *Thing) TestRun() error {
+	msg := Msg{Msg: CmdRun}
+	t.bus.receive(newPacket(t.bus, nil, &msg))
+	return fmt.Errorf("CmdRun didn't run forever")
+}
+
+// StopTest stops CmdRun, if running, tears down the Thinger (see
+// Teardowner), and unplugs Thing's TestPorts.  Call StopTest once.
+func (t *Thing) StopTest() {
+	t.bus.stopRun()
+	teardown(t.thinger)
+
+	var ports []*TestPort
+	t.bus.sockLock.RLock()
+	for sock := range t.bus.sockets {
+		if p, ok := sock.(*TestPort); ok {
+			ports = append(ports, p)
+		}
+	}
+	t.bus.sockLock.RUnlock()
+
+	for _, p := range ports {
+		p.Unplug()
+	}
+}
+
+// TestPort plugs a TestPort named name into Thing's bus.  If private, the
+// port is as if opened on Thing's private server.  Call after StartTest.
+func (t *Thing) TestPort(name string, private bool,
+	recv func(msg []byte, reply bool)) *TestPort {
+
+	p := &TestPort{thing: t, name: name, flags: sock_flag_bcast, recv: recv}
+	if private {
+		p.flags |= sock_flag_private
+	}
+	t.bus.plugin(p)
+	return p
+}
+
+// Receive msg, JSON-encoded, on Thing's bus from the port, as if sent by
+// the port's client.  Receive returns after Thing's subscriber for the
+// message returns.
+func (p *TestPort) Receive(msg []byte) {
+	p.thing.bus.receive(&Packet{bus: p.thing.bus, src: p, msg: msg})
+}
+
+// Unplug the port from Thing's bus
+func (p *TestPort) Unplug() {
+	p.once.Do(func() { p.thing.bus.unplug(p) })
+}
+
+// SetClock sets the clock for Thing.Now, for tests.  Clock faults (see
+// FaultClock) still apply.
+func (t *Thing) SetClock(now func() time.Time) {
+	t.clock = now
+}
+
+func (p *TestPort) Send(pkt *Packet) error {
+	msg := append([]byte(nil), pkt.msg...)
+	p.recv(msg, pkt.src == socketer(p))
+	return nil
+}
+
+// Close is called by the bus, maybe holding the bus's socket lock, so
+// unplug later, as a WebSocket's reader would
+func (p *TestPort) Close() {
+	go p.Unplug()
+}
+
+func (p *TestPort) Name() string {
+	return p.name
+}
+
+func (p *TestPort) Flags() uint32 {
+	return p.flags
+}
+
+func (p *TestPort) SetFlags(flags uint32) {
+	p.flags = flags
+}
+
+func (p *TestPort) Src() string {
+	return p.name
+}
@@ -6,6 +6,9 @@ package merle
 
 import (
 	"fmt"
+	"io/fs"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -16,6 +19,22 @@ type ThingAssets struct {
 	// relative to the Thing's binary path.
 	AssetsDir string
 
+	// [Optional] File system holding AssetsDir, in lieu of the OS's, e.g.
+	// an embed.FS built into Thing's binary, so a container image needs
+	// nothing but the binary:
+	//
+	//	//go:embed assets
+	//	var assets embed.FS
+	//
+	//	func (t *thing) Assets() *merle.ThingAssets {
+	//		return &merle.ThingAssets{
+	//			FS:           assets,
+	//			AssetsDir:    "assets",
+	//			HtmlTemplate: "templates/thing.html",
+	//		}
+	//	}
+	FS fs.FS
+
 	// Path to Thing's HTML template file, relative to AssetsDir.
 	HtmlTemplate string
 
@@ -23,6 +42,29 @@ type ThingAssets struct {
 	// HtmlTemplateText takes priority over HtmlTemplate, if both are
 	// present.
 	HtmlTemplateText string
+
+	// [Optional] Sources Thing's pages load from, other than Thing's own
+	// server, for the Content-Security-Policy (see Cfg.SecurityHeaders),
+	// keyed by CSP directive, e.g. for a script from a CDN:
+	//
+	//	ContentSources: map[string][]string{
+	//		"script-src": {"https://unpkg.com"},
+	//	}
+	ContentSources map[string][]string
+
+	// Pages, other than the home page, keyed by page name.  Page name is
+	// served at /{id}/{name}, e.g. /{id}/settings, and gets the same
+	// template params as the home page.  Names of Thing's own routes,
+	// e.g. "state" and "history", can't be used.
+	Pages map[string]ThingPage
+}
+
+// ThingPage is a page of Thing's UI.  See ThingAssets.Pages.
+type ThingPage struct {
+	// Path to the page's HTML template file, relative to AssetsDir
+	Template string
+	// Template text, in lieu of a template file
+	TemplateText string
 }
 
 // All Things implement the Thinger interface.
@@ -67,19 +109,82 @@ type Thing struct {
 	id          string
 	model       string
 	name        string
+	tags        []string
 	online      bool
 	startupTime time.Time
 	bus         *bus
 	tunnel      *tunnel
+	standby     *tunnel
+	election    *election
+	link        *seqLink
+	heartbeat   *heartbeat
 	web         *web
 	isBridge    bool
 	bridge      *bridge
 	isPrime     bool
 	primePort   *port
-	primeSock   *webSocket
+	primeSock   socketer
 	primeId     string
+	fromThing   func(*Thing, *Packet)
+	isStandby   bool
 	bridgeSock  *wireSocket
 	childSock   *wireSocket
+	serials     []*serialSocket
+	bles        []*bleLink
+	store       Store
+	authStore   AuthStore
+	accessLog   AccessLogger
+	netFilter   *netFilter
+	proxies     *netFilter
+	audit       *audit
+	e2e         *e2e
+	provision   *provision
+	registry    *registry
+	regStore    Store
+	auth        *auth
+	bundles     *bundles
+	mdns        *mdns
+	configs     []Configurator
+	codeCfg     ThingConfig
+	cfgLock     sync.RWMutex
+	template    configTemplate
+	reload      chan os.Signal
+	lifecycle   *lifecycle
+	archive     *archive
+	influx      *influx
+	notifiers   notifiers
+	rules       *rules
+	notifs      *notifications
+	alerts      *alerts
+	shadow      *shadow
+	lora        *lora
+	can         *canSocket
+	nats        *natsLink
+	lan         *lan
+	graphql     *graphql
+	history     *history
+	redactor    *redactor
+	journaling  bool
+	journalSeq  uint64
+	swapLock    sync.Mutex
+	runLock     sync.Mutex
+	runSwap     *swap
+	power       *power
+	powerOnce   sync.Once
+	powerLost   bool
+	interlocks  *interlocks
+	duty        *duty
+	runtime     *runtimeCounters
+	inputs      *inputs
+	cals        *calibrations
+	scheds      *schedules
+	updater     *updater
+	faults      *faults
+	recorder    *recorder
+	replayer    *replayer
+	clock       func() time.Time
+	errsLock    sync.Mutex
+	errs        map[string]MsgError
 	log         *logger
 }
 
@@ -101,16 +206,39 @@ func NewThing(thinger Thinger) *Thing {
 	}
 }
 
-func (t *Thing) getIdentity(p *Packet) {
-	resp := MsgIdentity{
+// AddConfig adds a Configurator as a source of Thing's configuration.
+// Configurators are parsed in Run(), in the order added, with later
+// Configurators overriding earlier ones.  Any Cfg item set in code overrides
+// all Configurators.
+//
+//	func main() {
+//		thing := merle.NewThing(&thing{})
+//		thing.AddConfig(merle.NewEnvConfig("MERLE_"))
+//		thing.Cfg.PortPublic = 80  // wins over MERLE_PORT_PUBLIC
+//		log.Fatalln(thing.Run())
+//	}
+func (t *Thing) AddConfig(c Configurator) {
+	t.configs = append(t.configs, c)
+}
+
+// Thing's identity, as sent in ReplyIdentity
+func (t *Thing) identity() *MsgIdentity {
+	return &MsgIdentity{
 		Msg:         ReplyIdentity,
 		Id:          t.id,
 		Model:       t.model,
 		Name:        t.name,
 		Online:      t.online,
 		StartupTime: t.startupTime,
+		Journal:     t.bus.journal != nil,
+		Tags:        t.tags,
+		Protocol:    ProtocolVersion,
+		Version:     t.Cfg.Version,
 	}
-	p.Marshal(&resp).Reply()
+}
+
+func (t *Thing) getIdentity(p *Packet) {
+	p.Marshal(t.identity()).Reply()
 }
 
 func (t *Thing) run() error {
@@ -121,53 +249,326 @@ func (t *Thing) run() error {
 	msg := Msg{Msg: CmdInit}
 	t.bus.receive(newPacket(t.bus, nil, &msg))
 
+	// Restore Thing's state saved from a previous run, overriding
+	// any defaults CmdInit set.
+
+	if err := t.loadState(); err != nil {
+		t.log.println("Loading state failed:", err)
+	}
+
+	// Set outputs to their power-on state, before CmdRun drives the
+	// hardware
+
+	if err := t.applyPowerOn(); err != nil {
+		t.log.println("Applying power-on state failed:", err)
+	}
+
+	// Set up the Thinger's hardware before anything can drive it
+
+	if err := setup(t.thinger); err != nil {
+		return fmt.Errorf("Thinger setup failed: %s", err)
+	}
+
 	// After CmdInit, It's safe now to handle html and ws requests.
 	// (CmdInit initializes Thing's state, so it's safe to receive
 	// GetState, even if that happens before CmdRun).
 
-	t.web.public.start()
-	t.web.private.start()
+	if err := t.lifecycle.start(); err != nil {
+		teardown(t.thinger)
+		return err
+	}
 
-	t.tunnel.start()
+	t.logConfigReport()
 
-	if t.isBridge {
-		t.bridge.start()
+	// Force receipt of CmdRun msg.  Thing should wait forever in CmdRun
+	// handler, but just in case CmdRun handler exits, or a required
+	// component fails, tear stuff down...
+
+	err := t.lifecycle.run(t.runThinger)
+
+	if err := t.SaveState(); err != nil {
+		t.log.println("Saving state failed:", err)
 	}
 
-	// Force receipt of CmdRun msg
-	msg = Msg{Msg: CmdRun}
-	t.bus.receive(newPacket(t.bus, nil, &msg))
+	t.lifecycle.stop()
 
-	// Thing should wait forever in CmdRun handler, but just
-	// in case CmdRun handler exits, tear stuff down...
+	teardown(t.thinger)
 
-	if t.isBridge {
-		t.bridge.stop()
+	return err
+}
+
+// Thing's Thinger, which SwapThinger may change
+func (t *Thing) getThinger() Thinger {
+	t.runLock.Lock()
+	defer t.runLock.Unlock()
+	return t.thinger
+}
+
+// Run the Thinger's CmdRun, and the CmdRun of any Thinger swapped in
+func (t *Thing) runThinger() error {
+	for {
+		msg := Msg{Msg: CmdRun}
+		t.bus.receive(newPacket(t.bus, nil, &msg))
+		if !t.swapped() {
+			return fmt.Errorf("CmdRun didn't run forever")
+		}
+	}
+}
+
+// Add Thing's framework components to the lifecycle manager, in start order
+func (t *Thing) addComponents() {
+	l := t.lifecycle
+
+	l.add("reload", FailureDisable, t.startReload, t.stopReload)
+
+	if t.archive != nil {
+		l.add("archive", FailureDisable,
+			func() error { t.archive.start(); return nil },
+			t.archive.stop)
+	}
+
+	if t.influx != nil {
+		l.add("influx", FailureDisable,
+			func() error { t.influx.start(); return nil },
+			t.influx.stop)
+	}
+
+	if t.notifiers != nil {
+		l.add("webhooks", FailureDisable,
+			func() error { t.notifiers.start(); return nil },
+			t.notifiers.stop)
+	}
+
+	if t.scheds != nil {
+		l.add("schedules", FailureDisable,
+			func() error { t.scheds.start(); return nil },
+			t.scheds.stop)
+	}
+
+	if t.notifs != nil {
+		l.add("notifications", FailureDisable,
+			func() error { t.notifs.start(); return nil },
+			t.notifs.stop)
+	}
+
+	if t.rules != nil {
+		l.add("rules", FailureDisable,
+			func() error { t.rules.start(); return nil },
+			t.rules.stop)
+	}
+
+	if t.shadow != nil {
+		l.add("shadow", FailureDisable,
+			func() error { t.shadow.start(); return nil },
+			t.shadow.stop)
 	}
 
-	t.tunnel.stop()
+	if t.lora != nil {
+		l.add("lora", FailureDisable, t.lora.start, t.lora.stop)
+	}
+
+	if t.can != nil {
+		l.add("can", FailureDisable, t.can.start, t.can.stop)
+	}
 
-	t.web.private.stop()
-	t.web.public.stop()
+	// On Thing Prime, NATS runs in place of the Prime port; see primeRun
+	if t.nats != nil && !t.isPrime {
+		l.add("nats", FailureDisable, t.nats.start, t.nats.stop)
+	}
 
-	return fmt.Errorf("CmdRun didn't run forever")
+	if t.lan != nil {
+		l.add("lan", FailureDisable, t.lan.start, t.lan.stop)
+	}
+
+	if t.history != nil {
+		l.add("history", FailureDisable,
+			func() error { t.history.start(); return nil },
+			t.history.stop)
+	}
+
+	if t.Cfg.RunAs != "" {
+		l.add("run as", FailureFatal, t.dropPrivileges, func() {})
+	}
+
+	if t.isPrime {
+		l.add("web public", t.Cfg.PublicFailure,
+			t.primeStartPublic, t.web.public.stop)
+		l.add("web private", t.Cfg.PrivateFailure,
+			t.web.private.start, t.web.private.stop)
+		return
+	}
+
+	l.add("web public", t.Cfg.PublicFailure,
+		t.web.public.start, t.web.public.stop)
+	l.add("web private", t.Cfg.PrivateFailure,
+		t.web.private.start, t.web.private.stop)
+	l.add("tunnel", FailureDisable,
+		func() error { t.tunnel.start(); return nil },
+		t.tunnel.stop)
+	for _, s := range t.serials {
+		l.add("serial "+s.name, FailureDisable, s.start, s.stop)
+	}
+	for _, b := range t.bles {
+		l.add("ble "+b.sock.name, FailureDisable, b.start, b.stop)
+	}
+	if t.standby != nil {
+		l.add("tunnel standby", FailureDisable,
+			func() error { t.standby.start(); return nil },
+			t.standby.stop)
+	}
+
+	if t.mdns != nil {
+		l.add("mdns", FailureDisable, t.mdns.start, t.mdns.stop)
+	}
+
+	if t.power != nil {
+		l.add("power", FailureFatal, t.power.start, t.power.stop)
+	}
+
+	if t.duty != nil {
+		l.add("duty", FailureFatal, t.duty.start, t.duty.stop)
+	}
+
+	if t.heartbeat != nil && !t.isPrime {
+		l.add("heartbeat", FailureDisable, t.heartbeat.start,
+			t.heartbeat.stop)
+	}
+
+	if t.runtime != nil {
+		l.add("runtime", FailureDisable, t.runtime.start,
+			t.runtime.stop)
+	}
+
+	if t.inputs != nil {
+		l.add("inputs", FailureFatal, t.inputs.start, t.inputs.stop)
+	}
+
+	if t.alerts != nil {
+		l.add("alerts", FailureDisable,
+			func() error { t.alerts.start(); return nil },
+			t.alerts.stop)
+	}
+
+	if t.recorder != nil {
+		l.add("record", FailureFatal, t.recorder.start, t.recorder.stop)
+	}
+
+	if t.replayer != nil {
+		l.add("replay", FailureFatal, t.replayer.start, t.replayer.stop)
+	}
+
+	if t.isBridge {
+		l.add("bridge", FailureDisable, t.bridge.start, t.bridge.stop)
+	}
 }
 
 func (t *Thing) build(full bool) error {
 
 	if !validId(t.Cfg.Id) {
-		return fmt.Errorf("Id must contain only alphanumeric or underscore characters")
+		return newError(ErrBadConfig, fmt.Errorf("Id must contain only alphanumeric or underscore characters"))
 	}
 	if !validModel(t.Cfg.Model) {
-		return fmt.Errorf("Model must contain only alphanumeric or underscore characters")
+		return newError(ErrBadConfig, fmt.Errorf("Model must contain only alphanumeric or underscore characters"))
 	}
 	if !validName(t.Cfg.Name) {
-		return fmt.Errorf("Name must contain only alphanumeric or underscore characters")
+		return newError(ErrBadConfig, fmt.Errorf("Name must contain only alphanumeric or underscore characters"))
+	}
+	if !validFailure(t.Cfg.PublicFailure) || !validFailure(t.Cfg.PrivateFailure) {
+		return newError(ErrBadConfig, fmt.Errorf("Failure policy must be one of \"%s\", \"%s\", or \"%s\"",
+			FailureFatal, FailureRetry, FailureDisable))
+	}
+	if !validBasePath(t.Cfg.BasePath) {
+		return newError(ErrBadConfig, fmt.Errorf("BasePath must be an absolute path, without a trailing slash, e.g. \"/things/garage\""))
+	}
+	if len(t.Cfg.TrustedProxies) > 0 {
+		var err error
+		t.proxies, err = newNetFilter(t.Cfg.TrustedProxies, nil)
+		if err != nil {
+			return newError(ErrBadConfig, err)
+		}
+	}
+	if t.Cfg.Container && t.Cfg.User != "" && t.Cfg.AuthFile == "" {
+		return newError(ErrBadConfig, fmt.Errorf("Container mode has no PAM to log User in; give users in AuthFile"))
+	}
+	if t.Cfg.RunAs != "" && t.Cfg.User != "" && t.Cfg.User != t.Cfg.RunAs &&
+		t.Cfg.AuthFile == "" {
+		return newError(ErrBadConfig, fmt.Errorf("PAM can't check User's password once running as RunAs; give users in AuthFile"))
+	}
+	if t.Cfg.RunAs != "" && len(t.Cfg.Update.Keys) > 0 {
+		return newError(ErrBadConfig, fmt.Errorf("Updates can't re-exec Thing once running as RunAs; use RunAs or Update, not both"))
+	}
+	if err := validPowerOn(t.Cfg.PowerOn); err != nil {
+		return newError(ErrBadConfig, err)
+	}
+	if len(t.Cfg.Interlocks) > 0 {
+		var err error
+		t.interlocks, err = newInterlocks(t.Cfg.Interlocks)
+		if err != nil {
+			return err
+		}
+	}
+	if len(t.Cfg.DutyLimits) > 0 && !t.Cfg.IsPrime {
+		var err error
+		t.duty, err = newDuty(t, t.Cfg.DutyLimits)
+		if err != nil {
+			return err
+		}
+	}
+	if len(t.Cfg.RuntimeCounters) > 0 && !t.Cfg.IsPrime {
+		var err error
+		t.runtime, err = newRuntimeCounters(t, t.Cfg.RuntimeCounters,
+			t.Cfg.RuntimeFile)
+		if err != nil {
+			return fmt.Errorf("Loading runtime counters: %s", err)
+		}
+	}
+	if len(t.Cfg.Inputs) > 0 && !t.Cfg.IsPrime {
+		var err error
+		t.inputs, err = newInputs(t, t.Cfg.Inputs, t.Cfg.InputsFile)
+		if err != nil {
+			return fmt.Errorf("Loading inputs: %s", err)
+		}
+	}
+	if len(t.Cfg.Alerts) > 0 && !t.Cfg.IsPrime {
+		var err error
+		t.alerts, err = newAlerts(t, t.Cfg.Alerts)
+		if err != nil {
+			return newError(ErrBadConfig, err)
+		}
+	}
+	if !t.Cfg.IsPrime {
+		var err error
+		t.cals, err = newCalibrations(t, t.Cfg.Calibrations,
+			t.Cfg.CalibrationFile)
+		if err != nil {
+			return fmt.Errorf("Loading calibrations: %s", err)
+		}
+		t.scheds, err = newSchedules(t, t.Cfg.Schedules,
+			t.Cfg.ScheduleFile)
+		if err != nil {
+			return newError(ErrBadConfig, fmt.Errorf("Loading schedules: %s", err))
+		}
+		t.updater, err = newUpdater(t, t.Cfg.Update)
+		if err != nil {
+			return err
+		}
+	}
+	if t.Cfg.FaultInjection && !t.Cfg.IsPrime {
+		t.faults = newFaults(t)
+	}
+	if t.Cfg.RecordFile != "" && !t.Cfg.IsPrime {
+		t.recorder = newRecorder(t, t.Cfg.RecordFile)
+	}
+	if t.Cfg.ReplayFile != "" && !t.Cfg.IsPrime {
+		t.replayer = newReplayer(t, t.Cfg.ReplayFile)
 	}
 
 	id := t.Cfg.Id
 	if !t.Cfg.IsPrime && id == "" {
-		id = defaultId()
+		var err error
+		if id, err = defaultId(); err != nil {
+			return err
+		}
 	}
 
 	prefix := "[" + id + "] "
@@ -176,33 +577,335 @@ func (t *Thing) build(full bool) error {
 	t.id = id
 	t.model = t.Cfg.Model
 	t.name = t.Cfg.Name
+	t.tags = t.Cfg.Tags
 	t.startupTime = time.Now()
 	t.isPrime = t.Cfg.IsPrime
 
 	t.bus = newBus(t, t.Cfg.MaxConnections, t.thinger.Subscribers())
+	if t.Cfg.DedupWindow > 0 {
+		t.bus.dedup = newDedup(t, t.Cfg.DedupWindow)
+	}
+	if t.Cfg.LinkSeq {
+		t.link = newSeqLink(t)
+	}
 
 	t.bus.subscribe(GetIdentity, t.getIdentity)
 
+	if t.isPrime {
+		t.bus.subscribe(ReplyJournal, t.replayJournal)
+		t.bus.subscribe(EventAudit, t.auditHeard)
+		t.bus.subscribe(StatePatch, t.applyStatePatch)
+		t.bus.subscribe(EventConfigDrift, t.saveConfigDrift)
+		t.bus.subscribe(EventPowerLost, t.savePowerLost)
+		t.bus.subscribe(SetPrimeRole, t.setPrimeRole)
+		t.bus.subscribe(EventResync, t.resynced)
+		t.heartbeat = newHeartbeat(t, 0)
+		t.bus.subscribe(Heartbeat, t.heartbeatHeard)
+	} else {
+		t.bus.subscribe(ResyncAck, t.resyncAck)
+	}
+
+	if t.runtime != nil {
+		t.bus.subscribe(GetRuntime, t.getRuntime)
+		t.bus.subscribe(ResetRuntime, t.resetRuntime)
+	}
+
+	if t.inputs != nil {
+		t.bus.subscribe(GetInputs, t.getInputs)
+	}
+
+	if t.alerts != nil {
+		t.bus.subscribe(GetAlerts, t.getAlerts)
+		t.bus.tap(t.alerts.tap)
+	}
+
+	if t.cals != nil {
+		t.bus.subscribe(GetCalibration, t.getCalibration)
+		t.bus.subscribe(SetCalibration, t.setCalibration)
+	}
+
+	if t.scheds != nil {
+		t.bus.subscribe(GetSchedules, t.getSchedules)
+		t.bus.subscribe(SetSchedule, t.editSchedule)
+		t.bus.subscribe(DeleteSchedule, t.editSchedule)
+	}
+
+	if t.updater != nil {
+		t.bus.subscribe(Update, t.updateBinary)
+	}
+
+	if t.recorder != nil {
+		t.bus.tap(t.recorder.tap)
+	}
+
+	if t.faults != nil {
+		t.bus.subscribe(InjectFault, t.injectFault)
+		t.bus.subscribe(ClearFaults, t.clearFaults)
+		t.bus.subscribe(GetFaults, t.getFaults)
+	}
+
 	if full {
+		if t.Cfg.Archive.Endpoint != "" {
+			t.archive = newArchive(t, t.Cfg.Archive)
+			t.bus.tapEgress(t.archive.tap)
+		}
+
+		if t.Cfg.Influx.URL != "" {
+			t.influx = newInflux(t, t.Cfg.Influx)
+			t.bus.tapEgress(t.influx.tap)
+		}
+
+		if len(t.Cfg.Webhooks) > 0 {
+			var err error
+			t.notifiers, err = newNotifiers(t, t.Cfg.Webhooks)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+			t.bus.tapEgress(t.notifiers.tap)
+		}
+
+		if len(t.Cfg.Rules) > 0 {
+			var err error
+			t.rules, err = newRules(t, t.Cfg.Rules)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+			t.bus.tap(t.rules.tap)
+		}
+
+		if n := t.Cfg.Notifications; n.SMTP.Host != "" ||
+			n.Twilio.AccountSID != "" || n.WebPush.PrivateKey != "" {
+			var err error
+			t.notifs, err = newNotifications(t, n)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+			t.bus.tap(t.notifs.tap)
+			t.bus.subscribe(SubscribePush, t.subscribePush)
+		}
+
+		if t.Cfg.Shadow.Endpoint != "" {
+			var err error
+			t.shadow, err = newShadow(t, t.Cfg.Shadow)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+			t.bus.tapEgress(t.shadow.tap)
+		}
+
+		if t.Cfg.LoRa.Device != "" {
+			var err error
+			t.lora, err = newLoRa(t, t.Cfg.LoRa)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+			t.bus.tapEgress(t.lora.tap)
+		}
+
+		if t.Cfg.CAN.Iface != "" {
+			var err error
+			t.can, err = newCANSocket(t, t.Cfg.CAN)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+		}
+
+		if t.Cfg.NATS.URL != "" {
+			var err error
+			t.nats, err = newNATS(t, t.Cfg.NATS)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+		}
+
+		if t.Cfg.LAN.Group != "" {
+			var err error
+			t.lan, err = newLAN(t, t.Cfg.LAN)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+		}
+
+		if t.Cfg.History.File != "" {
+			var err error
+			t.history, err = newHistory(t, t.Cfg.History)
+			if err != nil {
+				return fmt.Errorf("Opening history: %s", err)
+			}
+			t.bus.tap(t.history.tap)
+			t.bus.subscribe(GetHistory, t.history.getHistory)
+		}
+
+		if t.accessLog == nil && t.Cfg.AccessLog.File != "" {
+			var err error
+			t.accessLog, err = newFileAccessLogger(t.Cfg.AccessLog)
+			if err != nil {
+				return newError(ErrBadConfig, fmt.Errorf("Opening access log: %s", err))
+			}
+		}
+
 		t.tunnel = newTunnel(t, t.Cfg.MotherHost,
 			t.Cfg.MotherUser, t.Cfg.PortPrivate,
-			t.Cfg.MotherPortPrivate)
+			t.Cfg.MotherPortPrivate, t.Cfg.MotherHintsFile)
+		if err := t.tunnel.loadHints(); err != nil {
+			return fmt.Errorf("Loading mother hints: %s", err)
+		}
+		t.bus.subscribe(SetMotherHints, t.tunnel.setHints)
+		if !t.isPrime && t.Cfg.MotherHostStandby != "" {
+			t.standby = newTunnel(t, t.Cfg.MotherHostStandby,
+				t.Cfg.MotherUser, t.Cfg.PortPrivate,
+				t.Cfg.MotherPortPrivate, "")
+			t.election = newElection(t)
+		}
+		t.bus.subscribe(SetConfigTemplate, t.setConfigTemplate)
+		t.bus.subscribe(GetStatus, t.getStatus)
+
+		if !t.isPrime && t.store == nil && t.Cfg.StoreFile != "" {
+			t.store = NewFileStore(t.Cfg.StoreFile)
+		}
+
+		if !t.isPrime && len(t.Cfg.Redact) > 0 {
+			var err error
+			t.redactor, err = newRedactor(t.Cfg.Redact, t.Cfg.RedactKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !t.isPrime && t.Cfg.JournalFile != "" {
+			t.bus.journal = newJournal(t, t.Cfg.JournalFile,
+				t.Cfg.JournalMax)
+			if err := t.bus.journal.load(); err != nil {
+				return fmt.Errorf("Loading journal: %s", err)
+			}
+			t.bus.subscribe(GetJournalSince, t.bus.journal.getJournalSince)
+		}
+
+		if t.Cfg.AuditFile != "" {
+			t.audit = newAudit(t, t.Cfg.AuditFile, t.Cfg.AuditMax,
+				t.Cfg.AuditForward)
+			if err := t.audit.load(); err != nil {
+				return fmt.Errorf("Loading audit trail: %s", err)
+			}
+			t.bus.subscribe(GetAudit, t.getAudit)
+		}
+
+		if !t.isPrime && t.Cfg.PowerFailInput != "" {
+			t.power = newPower(t, t.Cfg.PowerFailInput,
+				t.Cfg.PowerFailValue)
+		}
+
+		if !t.isPrime && t.Cfg.Heartbeat > 0 {
+			t.heartbeat = newHeartbeat(t, t.Cfg.Heartbeat)
+		}
+
+		if !t.isPrime && t.Cfg.OutboxFile != "" {
+			t.bus.outbox = newOutbox(t, t.Cfg.OutboxFile,
+				t.Cfg.OutboxMax)
+			if err := t.bus.outbox.load(); err != nil {
+				return fmt.Errorf("Loading outbox: %s", err)
+			}
+		}
+
+		if t.authStore == nil && t.Cfg.AuthFile != "" {
+			t.authStore = NewFileAuthStore(t.Cfg.AuthFile)
+		}
+		if t.authStore != nil {
+			t.auth = newAuth(t, t.authStore)
+			if err := t.auth.load(); err != nil {
+				return fmt.Errorf("Loading auth: %s", err)
+			}
+		}
+
+		if t.Cfg.Provision.File != "" {
+			if t.auth == nil {
+				return newError(ErrBadConfig, fmt.Errorf("Provisioning needs AuthFile, for admins to claim Things"))
+			}
+			t.provision = newProvision(t, t.Cfg.Provision)
+			if err := t.provision.load(); err != nil {
+				return fmt.Errorf("Loading claims: %s", err)
+			}
+		}
+
+		if t.Cfg.Bundles.URL != "" && len(t.Cfg.Bundles.Keys) == 0 {
+			return fmt.Errorf("Bundle URL needs bundle Keys")
+		}
+		var err error
+		t.bundles, err = newBundles(t, t.Cfg.Bundles)
+		if err != nil {
+			return err
+		}
+
+		if !t.isPrime && t.Cfg.Advertise {
+			t.mdns = newMdns(t)
+		}
+
+		t.netFilter, err = newNetFilter(t.Cfg.AllowPublicNets,
+			t.Cfg.DenyPublicNets)
+		if err != nil {
+			return newError(ErrBadConfig, err)
+		}
+
+		if !t.isPrime && t.Cfg.E2E.Key != "" {
+			t.e2e, err = newE2E(t, t.Cfg.E2E)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+		}
 
 		t.web = newWeb(t, t.Cfg.PortPublic, t.Cfg.PortPublicTLS,
-			t.Cfg.PortPrivate, t.Cfg.User)
+			t.Cfg.PortPrivate, t.Cfg.User, t.Cfg.TLSCertFile,
+			t.Cfg.TLSKeyFile)
 		t.setAssetsDir(t)
 		t.setHtmlTemplate()
 
+		if t.Cfg.GRPC {
+			t.web.handleGRPC(t)
+		}
+
 		_, t.isBridge = t.thinger.(Bridger)
 		if t.isBridge {
-			t.bridge = newBridge(t, t.Cfg.BridgePortBegin,
+			t.bridge, err = newBridge(t, t.Cfg.BridgePortBegin,
 				t.Cfg.BridgePortEnd)
+			if err != nil {
+				return newError(ErrBadConfig, err)
+			}
+		}
+
+		if t.provision != nil && t.Cfg.Provision.AuthorizedKeys != "" &&
+			!t.isBridge && !t.isPrime {
+			return newError(ErrBadConfig, fmt.Errorf("Provision.AuthorizedKeys "+
+				"needs Thing to be mother, Thing Prime or a bridge"))
 		}
 
 		if t.isPrime {
 			t.web.handlePrimePortId()
 			t.primePort = newPort(t, t.Cfg.PortPrime, t.primeAttach)
 		}
+
+		if t.regStore == nil && t.Cfg.RegistryFile != "" {
+			t.regStore = NewFileStore(t.Cfg.RegistryFile)
+		}
+		if (t.isBridge || t.isPrime) && t.regStore != nil {
+			t.registry = newRegistry(t, t.regStore)
+			if err := t.registry.load(); err != nil {
+				return fmt.Errorf("Loading registry: %s", err)
+			}
+			t.web.handleRegistry(t.registry)
+			for _, msg := range []string{GetRegistry,
+				SetRegistryNotes, DeleteRegistry} {
+				t.bus.subscribe(msg, t.registry.manage)
+			}
+		}
+
+		if t.isBridge || t.isPrime {
+			t.graphql = newGraphQL(t)
+			t.web.handleGraphQL(t.graphql)
+		}
+
+		t.lifecycle = newLifecycle(t,
+			time.Duration(t.Cfg.RetryInterval)*time.Second)
+		t.addComponents()
 	}
 
 	prime := ""
@@ -215,8 +918,8 @@ func (t *Thing) build(full bool) error {
 	return nil
 }
 
-// Run Thing.  An error is returned if Run() fails.  Configure Thing before
-// running.
+// Run Thing.  An error is returned if Run() fails; framework failures are
+// Errors, e.g. ErrListen (see Error).  Configure Thing before running.
 //
 //	func main() {
 //		thing := merle.NewThing(&thing{})
@@ -225,6 +928,15 @@ func (t *Thing) build(full bool) error {
 //	}
 //
 func (t *Thing) Run() error {
+	if err := t.configure(); err != nil {
+		return newError(ErrBadConfig, err)
+	}
+
+	// A factory-fresh Thing waits here to be claimed
+	if err := t.claimed(); err != nil {
+		return newError(ErrBadConfig, err)
+	}
+
 	err := t.build(true)
 	if err != nil {
 		return err
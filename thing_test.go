@@ -32,6 +32,20 @@ func (s *sparse) Assets() *ThingAssets {
 	return &ThingAssets{}
 }
 
+func TestDefaultId(t *testing.T) {
+	id, err := defaultId()
+	if err != nil {
+		t.Skip(err)
+	}
+	if id == "" || !validId(id) {
+		t.Errorf("Bad default Id %q", id)
+	}
+	// Same hardware, same Id
+	if again, _ := defaultId(); again != id {
+		t.Errorf("Default Id changed: %q then %q", id, again)
+	}
+}
+
 func TestBogusRun(t *testing.T) {
 	var thinger sparse
 
@@ -53,8 +67,6 @@ type simple struct {
 }
 
 func (s *simple) run(p *Packet) {
-	s.done = make(chan bool)
-
 	for {
 		select {
 		case <-s.done:
@@ -90,7 +102,7 @@ func checkIdentityResp(r *MsgIdentity) error {
 }
 
 func testIdentify(t *testing.T, thing *Thing) {
-	httpPort := thing.Cfg.PortPrivate
+	httpPort := thing.config().PortPrivate
 
 	var p = newPort(thing, httpPort, nil)
 
@@ -118,7 +130,7 @@ func testIdentify(t *testing.T, thing *Thing) {
 }
 
 func testDone(t *testing.T, thing *Thing) {
-	httpPort := thing.Cfg.PortPrivate
+	httpPort := thing.config().PortPrivate
 
 	var p = newPort(thing, httpPort, nil)
 
@@ -139,7 +151,7 @@ func testDone(t *testing.T, thing *Thing) {
 }
 
 func testHomePage(t *testing.T, thing *Thing) {
-	httpPort := thing.Cfg.PortPublic
+	httpPort := thing.config().PortPublic
 
 	url := fmt.Sprintf("http://localhost:%d", httpPort)
 
@@ -171,7 +183,7 @@ func testSimple(t *testing.T, thing *Thing) {
 }
 
 func TestRun(t *testing.T) {
-	var thinger simple
+	thinger := simple{done: make(chan bool)}
 
 	thing := NewThing(&thinger)
 	if thing == nil {
@@ -8,10 +8,13 @@
 package merle
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"machine"
+	"reflect"
+	"sync"
 	"time"
-	"unicode"
 
 	"tinygo.org/x/drivers/wifinina"
 )
@@ -20,26 +23,661 @@ type tunnel struct {
 }
 
 func newTunnel(t *Thing, host, user string,
-	portPrivate, portRemote uint) *tunnel {
+	portPrivate, portRemote uint, hintsFile string) *tunnel {
 	return &tunnel{}
 }
 
+func (t *tunnel) loadHints() error {
+	return nil
+}
+
+func (t *tunnel) setHints(p *Packet) {
+}
+
 func (t *tunnel) start() {
 }
 
-func (t *tunnel) stop() {
+func (t *tunnel) stop() {
+}
+
+type port struct {
+}
+
+type ArchiveConfig struct {
+	Endpoint  string
+	Region    string
+	Prefix    string
+	BatchSize uint
+	MaxAge    uint
+}
+
+type archive struct {
+}
+
+func newArchive(thing *Thing, cfg ArchiveConfig) *archive {
+	return &archive{}
+}
+
+func (a *archive) tap(p *Packet) {
+}
+
+func (a *archive) start() {
+}
+
+func (a *archive) stop() {
+}
+
+type InfluxConfig struct {
+	URL       string
+	BatchSize uint
+	MaxAge    uint
+}
+
+type influx struct {
+}
+
+func newInflux(thing *Thing, cfg InfluxConfig) *influx {
+	return &influx{}
+}
+
+func (x *influx) tap(p *Packet) {
+}
+
+func (x *influx) start() {
+}
+
+func (x *influx) stop() {
+}
+
+type WebhookConfig struct {
+	URL string
+}
+
+type notifiers []*struct{}
+
+func newNotifiers(thing *Thing, cfgs []WebhookConfig) (notifiers, error) {
+	return nil, nil
+}
+
+func (ns notifiers) tap(p *Packet) {
+}
+
+func (ns notifiers) start() {
+}
+
+func (ns notifiers) stop() {
+}
+
+type NotificationsConfig struct {
+	MinSeverity string
+	RateLimit   uint
+	SMTP        struct{ Host string }
+	Twilio      struct{ AccountSID string }
+	WebPush     struct{ PrivateKey string }
+}
+
+type PushSubscription struct {
+	Endpoint string
+}
+
+type notifications struct {
+}
+
+func newNotifications(thing *Thing, cfg NotificationsConfig) (*notifications, error) {
+	return &notifications{}, nil
+}
+
+func (n *notifications) tap(p *Packet) {
+}
+
+func (n *notifications) start() {
+}
+
+func (n *notifications) stop() {
+}
+
+func (t *Thing) subscribePush(p *Packet) {
+}
+
+type Rule struct {
+	Name string
+	When string
+}
+
+type rules struct {
+}
+
+func newRules(thing *Thing, cfgs []Rule) (*rules, error) {
+	return &rules{}, nil
+}
+
+func (rs *rules) tap(p *Packet) {
+}
+
+func (rs *rules) start() {
+}
+
+func (rs *rules) stop() {
+}
+
+type ShadowConfig struct {
+	Endpoint string
+	DeltaMsg string
+	Interval uint
+}
+
+type shadow struct {
+}
+
+func newShadow(thing *Thing, cfg ShadowConfig) (*shadow, error) {
+	return &shadow{}, nil
+}
+
+func (s *shadow) tap(p *Packet) {
+}
+
+func (s *shadow) start() {
+}
+
+func (s *shadow) stop() {
+}
+
+type LoRaConfig struct {
+	Device   string
+	Baud     uint
+	FPort    uint
+	MaxSize  uint
+	Interval uint
+}
+
+type lora struct {
+}
+
+func newLoRa(thing *Thing, cfg LoRaConfig) (*lora, error) {
+	return &lora{}, nil
+}
+
+func (l *lora) tap(p *Packet) {
+}
+
+func (l *lora) start() error {
+	return nil
+}
+
+func (l *lora) stop() {
+}
+
+type CANConfig struct {
+	Iface string
+}
+
+type canSocket struct {
+}
+
+func newCANSocket(thing *Thing, cfg CANConfig) (*canSocket, error) {
+	return &canSocket{}, nil
+}
+
+func (s *canSocket) start() error {
+	return nil
+}
+
+func (s *canSocket) stop() {
+}
+
+type NATSConfig struct {
+	URL      string
+	User     string
+	Password string
+	Token    string
+	Prefix   string
+}
+
+type natsLink struct {
+}
+
+func newNATS(thing *Thing, cfg NATSConfig) (*natsLink, error) {
+	return &natsLink{}, nil
+}
+
+func (l *natsLink) start() error {
+	return nil
+}
+
+func (l *natsLink) stop() {
+}
+
+type LANConfig struct {
+	Group  string
+	Iface  string
+	Msgs   []string
+	Beacon uint
+	Key    string
+}
+
+type lan struct {
+}
+
+func newLAN(thing *Thing, cfg LANConfig) (*lan, error) {
+	return &lan{}, nil
+}
+
+func (l *lan) start() error {
+	return nil
+}
+
+func (l *lan) stop() {
+}
+
+type HistoryConfig struct {
+	File      string
+	Retention uint
+}
+
+type history struct {
+}
+
+func newHistory(thing *Thing, cfg HistoryConfig) (*history, error) {
+	return &history{}, nil
+}
+
+func (h *history) tap(p *Packet) {
+}
+
+func (h *history) getHistory(p *Packet) {
+}
+
+func (h *history) start() {
+}
+
+func (h *history) stop() {
+}
+
+type RedactRule struct {
+}
+
+type redactor struct {
+}
+
+func newRedactor(rules []RedactRule, key string) (*redactor, error) {
+	return &redactor{}, nil
+}
+
+func (t *Thing) redactMsg(msg []byte) []byte {
+	return msg
+}
+
+func (t *Thing) redact(p *Packet) *Packet {
+	return p
+}
+
+type journal struct {
+}
+
+func newJournal(thing *Thing, file string, max uint) *journal {
+	return &journal{}
+}
+
+func (j *journal) load() error {
+	return nil
+}
+
+func (j *journal) append(p *Packet) {
+}
+
+func (j *journal) getJournalSince(p *Packet) {
+}
+
+func (t *Thing) replayJournal(p *Packet) {
+}
+
+type audit struct {
+}
+
+func newAudit(thing *Thing, file string, max uint, forward bool) *audit {
+	return &audit{}
+}
+
+func (a *audit) load() error {
+	return nil
+}
+
+func (t *Thing) getAudit(p *Packet) {
+}
+
+func (t *Thing) auditHeard(p *Packet) {
+}
+
+type registry struct {
+}
+
+func newRegistry(thing *Thing, store Store) *registry {
+	return &registry{}
+}
+
+func (r *registry) load() error {
+	return nil
+}
+
+func (r *registry) manage(p *Packet) {
+}
+
+type StateValidator interface {
+	ValidateState() error
+}
+
+type StateRejection struct {
+	Field  string
+	Reason string
+}
+
+func (r *StateRejection) Error() string {
+	if r.Field == "" {
+		return "State change rejected: " + r.Reason
+	}
+	return "State change rejected: " + r.Field + ": " + r.Reason
+}
+
+func rejection(err error) *StateRejection {
+	if r, ok := err.(*StateRejection); ok {
+		return r
+	}
+	return &StateRejection{Reason: err.Error()}
+}
+
+// UpdateState, as on Linux, but without Cfg.Interlocks, Cfg.DutyLimits, or a
+// Store
+func (t *Thing) UpdateState(changes interface{},
+	validators ...func(proposed interface{}) error) error {
+
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	delete(fields, "Msg")
+	data, _ = json.Marshal(fields)
+
+	if l, ok := t.thinger.(sync.Locker); ok {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	typ := reflect.TypeOf(t.thinger)
+	if typ.Kind() != reflect.Ptr {
+		return fmt.Errorf("Thinger must be a pointer to update state")
+	}
+
+	state, err := json.Marshal(t.thinger)
+	if err != nil {
+		return err
+	}
+	proposed := reflect.New(typ.Elem()).Interface()
+	if err := json.Unmarshal(state, proposed); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, proposed); err != nil {
+		return &StateRejection{Reason: err.Error()}
+	}
+
+	if v, ok := proposed.(StateValidator); ok {
+		if err := v.ValidateState(); err != nil {
+			return rejection(err)
+		}
+	}
+	for _, validate := range validators {
+		if err := validate(proposed); err != nil {
+			return rejection(err)
+		}
+	}
+
+	return json.Unmarshal(data, t.thinger)
+}
+
+func (p *Packet) UpdateState(validators ...func(proposed interface{}) error) error {
+	t := p.bus.thing
+	err := t.UpdateState(json.RawMessage(p.msg), validators...)
+	if err != nil {
+		t.log.println("Updating state failed:", err)
+	}
+	return err
+}
+
+func (t *Thing) configure() error {
+	return nil
+}
+
+func (t *Thing) Reload() error {
+	return nil
+}
+
+func (t *Thing) startReload() error {
+	return nil
+}
+
+func (t *Thing) stopReload() {
+}
+
+type configTemplate struct {
+}
+
+type AuthStore interface {
+}
+
+func NewFileAuthStore(file string) AuthStore {
+	return nil
+}
+
+func (t *Thing) SetAuthStore(s AuthStore) {
+}
+
+type AccessLogConfig struct {
+	File   string
+	Format string
+}
+
+const AccessLogCommon = "common"
+
+type AccessLogger interface {
+}
+
+func newFileAccessLogger(cfg AccessLogConfig) (AccessLogger, error) {
+	return nil, nil
+}
+
+type E2EConfig struct {
+	Key    string
+	Msgs   []string
+	Window uint
+}
+
+type e2e struct {
+}
+
+func newE2E(thing *Thing, cfg E2EConfig) (*e2e, error) {
+	return nil, nil
+}
+
+func (t *Thing) e2eReceive(p *Packet) bool {
+	return true
+}
+
+func (t *Thing) e2eSeal(p *Packet) *Packet {
+	return p
+}
+
+type ClaimConfig struct {
+	Code string
+	URL  string
+	File string
+}
+
+type ProvisionConfig struct {
+	File              string
+	MotherHost        string
+	MotherUser        string
+	MotherPortPrivate uint
+	KnownHosts        string
+	AuthorizedKeys    string
+}
+
+type provision struct {
+}
+
+func newProvision(thing *Thing, cfg ProvisionConfig) *provision {
+	return &provision{}
+}
+
+func (p *provision) load() error {
+	return nil
+}
+
+func (t *Thing) claimed() error {
+	return nil
+}
+
+type netFilter struct {
+}
+
+func newNetFilter(allow, deny []string) (*netFilter, error) {
+	return nil, nil
+}
+
+type BundleConfig struct {
+	URL  string
+	Keys []string
+	Dir  string
+}
+
+type mdns struct {
+}
+
+func newMdns(thing *Thing) *mdns {
+	return &mdns{}
+}
+
+func (m *mdns) start() error {
+	return nil
+}
+
+func (m *mdns) stop() {
+}
+
+type bundles struct {
+}
+
+func newBundles(thing *Thing, cfg BundleConfig) (*bundles, error) {
+	return &bundles{}, nil
+}
+
+type auth struct {
+}
+
+func newAuth(thing *Thing, store AuthStore) *auth {
+	return &auth{}
+}
+
+func (a *auth) load() error {
+	return nil
+}
+
+func (t *Thing) getStatus(p *Packet) {
+}
+
+func (t *Thing) setConfigTemplate(p *Packet) {
+}
+
+func (t *Thing) saveConfigDrift(p *Packet) {
+}
+
+func (t *Thing) ConfigDrift() []MsgConfigDrift {
+	return nil
+}
+
+type patchState struct {
+}
+
+func (ps *patchState) reset(msg []byte) {
+}
+
+// No patches; the full state is broadcast
+func (p *Packet) BroadcastPatch() {
+	p.Broadcast()
+}
+
+func (t *Thing) applyStatePatch(p *Packet) {
+}
+
+type outbox struct {
+}
+
+func newOutbox(thing *Thing, file string, max uint) *outbox {
+	return &outbox{}
+}
+
+func (o *outbox) load() error {
+	return nil
+}
+
+func (o *outbox) enqueue(p *Packet) {
+}
+
+func (b *bus) resync(p *Packet) {
+	p.src.Send(p)
+	p.src.SetFlags(p.src.Flags() | sock_flag_bcast)
+}
+
+func (t *Thing) resyncAck(p *Packet) {
+}
+
+func (t *Thing) resynced(p *Packet) {
+}
+
+type portAttachCb func(*port, *MsgIdentity) error
+
+func newPort(thing *Thing, p uint, attachCb portAttachCb) *port {
+	return &port{}
+}
+
+func (t *Thing) setAssetsDir(child *Thing) {
+}
+
+func (t *Thing) logConfigReport() {
+}
+
+type Store interface {
+}
+
+func NewFileStore(file string) Store {
+	return nil
 }
 
-type port struct {
+func (t *Thing) loadState() error {
+	return nil
 }
 
-type portAttachCb func(*port, *MsgIdentity) error
+func (t *Thing) SaveState() error {
+	return nil
+}
 
-func newPort(thing *Thing, p uint, attachCb portAttachCb) *port {
-	return &port{}
+type swap struct {
 }
 
-func (t *Thing) setAssetsDir(child *Thing) {
+func (t *Thing) swapped() bool {
+	return false
+}
+
+func (t *Thing) sendGroup(p *Packet, group string) {
+}
+
+func (t *Thing) fanOut(p *Packet, group string, timeout time.Duration) []FanOutResult {
+	return nil
+}
+
+func (t *Thing) fanOutMsg(p *Packet) {
 }
 
 func (t *Thing) setHtmlTemplate() {
@@ -49,6 +687,10 @@ func (t *Thing) primeAttach(p *port, msg *MsgIdentity) error {
 	return nil
 }
 
+func (t *Thing) primeStartPublic() error {
+	return nil
+}
+
 func (t *Thing) primeRun() error {
 	return nil
 }
@@ -63,14 +705,15 @@ func (b *bridge) getChild(id string) *Thing {
 	return nil
 }
 
-func (b *bridge) start() {
+func (b *bridge) start() error {
+	return nil
 }
 
 func (b *bridge) stop() {
 }
 
-func newBridge(thing *Thing, portBegin, portEnd uint) *bridge {
-	return &bridge{}
+func newBridge(thing *Thing, portBegin, portEnd uint) (*bridge, error) {
+	return &bridge{}, nil
 }
 
 type web struct {
@@ -78,7 +721,8 @@ type web struct {
 	private *webPrivate
 }
 
-func newWeb(t *Thing, portPublic, portPublicTLS, portPrivate uint, user string) *web {
+func newWeb(t *Thing, portPublic, portPublicTLS, portPrivate uint,
+	user, certFile, keyFile string) *web {
 	return &web{}
 }
 
@@ -88,92 +732,58 @@ func (w *web) handlePrimePortId() {
 func (w *web) handleBridgePortId() {
 }
 
-func (w *web) staticFiles(t *Thing) {
-}
-
-type webPrivate struct {
-}
-
-func newWebPrivate(t *Thing, port uint) *webPrivate {
-	return &webPrivate{}
-}
-
-func (w *webPrivate) start() {
+func (w *web) handleGRPC(t *Thing) {
 }
 
-func (w *webPrivate) stop() {
+type graphql struct {
 }
 
-type webPublic struct {
+func newGraphQL(t *Thing) *graphql {
+	return &graphql{}
 }
 
-func newWebPublic(t *Thing, port, portTLS uint, user string) *webPublic {
-	return &webPublic{}
+func (w *web) handleGraphQL(g *graphql) {
 }
 
-func (w *webPublic) start() {
+func (w *web) handleRegistry(r *registry) {
 }
 
-func (w *webPublic) stop() {
+func (w *web) staticFiles(t *Thing) {
 }
 
-type webSocket struct {
+type webPrivate struct {
 }
 
-type wireSocket struct {
+func newWebPrivate(t *Thing, port uint) *webPrivate {
+	return &webPrivate{}
 }
 
-type logger struct {
+func (w *webPrivate) start() error {
+	return nil
 }
 
-func NewLogger(prefix string, enabled bool) *logger {
-	return &logger{}
+func (w *webPrivate) stop() {
 }
 
-func (l *logger) printf(format string, v ...interface{}) {
+type webPublic struct {
 }
 
-func (l *logger) println(v ...interface{}) {
+func newWebPublic(t *Thing, port, portTLS uint,
+	user, certFile, keyFile string) *webPublic {
+	return &webPublic{}
 }
 
-func (l *logger) fatalln(v ...interface{}) {
+func (w *webPublic) start() error {
+	return nil
 }
 
-// TODO encoding/json isn't working with tinygo yet, so
-// TODO these stubs for Marshal and Unmarshal need to be
-// TODO open-coded to work on basic Merle message types
-// TODO like CmdInit and CmdRun and whatever else we
-// TODO might run into on a  tinygo deployment.
-
-func jsonMarshal(v interface{}) ([]byte, error) {
-	msg := v.(*Msg)
-	return []byte(fmt.Sprintf("{\"Msg\":\"%s\"}", msg.Msg)), nil
+func (w *webPublic) stop() {
 }
 
-func jsonUnmarshal(data []byte, v interface{}) error {
-	msg := v.(*Msg)
-	msg.Msg = ""
-	s := 0
-	for _, ch := range string(data) {
-		switch {
-		case ch == ':':
-			s = 1
-		case ch == '"':
-			switch s {
-			case 1:
-				s = 2
-			}
-		case unicode.IsLetter(ch), ch == '_':
-			if s == 2 {
-				msg.Msg += string(ch)
-			}
-		}
-	}
-	return nil
+type webSocket struct {
 }
 
-func jsonPrettyPrint(msg []byte) string {
-	return ""
+type wireSocket struct {
 }
 
 func Nano33ConnectAP(ssid, pass string) {
@@ -217,3 +827,385 @@ func Nano33ConnectAP(ssid, pass string) {
 	}
 	println(ip.String())
 }
+
+type uart struct {
+	machine.Serialer
+}
+
+// UART adapts a TinyGo serial port, such as machine.Serial or machine.UART0,
+// for Thing.AddSerial.  Reads wait for data.
+func UART(port machine.Serialer) io.ReadWriter {
+	return uart{port}
+}
+
+func (u uart) Read(p []byte) (int, error) {
+	for u.Buffered() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	n := 0
+	for n < len(p) && u.Buffered() > 0 {
+		b, err := u.ReadByte()
+		if err != nil {
+			break
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
+
+type power struct {
+}
+
+func newPower(thing *Thing, input, value string) *power {
+	return &power{}
+}
+
+func (p *power) start() error {
+	return nil
+}
+
+func (p *power) stop() {
+}
+
+func (t *Thing) PowerLost() {
+}
+
+func (t *Thing) savePowerLost(p *Packet) {
+}
+
+type BridgeLimit struct {
+	Match string
+	Max   uint
+}
+
+type BridgeGroup struct {
+	Name  string
+	Match string
+}
+
+type PowerOnRule struct {
+	Field  string
+	Action string
+}
+
+func validPowerOn(rules []PowerOnRule) error {
+	return nil
+}
+
+func (t *Thing) applyPowerOn() error {
+	return nil
+}
+
+type Interlock struct {
+	Outputs    []string
+	MinOffTime uint
+}
+
+type interlocks struct {
+}
+
+func newInterlocks(groups []Interlock) (*interlocks, error) {
+	return &interlocks{}, nil
+}
+
+type election struct {
+}
+
+type seqLink struct {
+}
+
+type heartbeat struct {
+}
+
+func (t *Thing) dropPrivileges() error {
+	return nil
+}
+
+func (b *bus) sockKind(s socketer) string {
+	return SockLink
+}
+
+func newHeartbeat(thing *Thing, interval uint) *heartbeat {
+	return &heartbeat{}
+}
+
+func (h *heartbeat) start() error {
+	return nil
+}
+
+func (h *heartbeat) stop() {
+}
+
+func (t *Thing) heartbeatHeard(p *Packet) {
+}
+
+func newSeqLink(thing *Thing) *seqLink {
+	return &seqLink{}
+}
+
+func newElection(t *Thing) *election {
+	return &election{}
+}
+
+func (t *Thing) setPrimeRole(p *Packet) {
+}
+
+type DutyLimit struct {
+	Output    string
+	MaxOnTime uint
+	MaxCycles uint
+}
+
+type duty struct {
+}
+
+func newDuty(thing *Thing, limits []DutyLimit) (*duty, error) {
+	return &duty{}, nil
+}
+
+func (d *duty) start() error {
+	return nil
+}
+
+func (d *duty) stop() {
+}
+
+type RuntimeCounter struct {
+	Output        string
+	ServiceHours  uint
+	ServiceCycles uint
+}
+
+type runtimeCounters struct {
+}
+
+func newRuntimeCounters(thing *Thing, counters []RuntimeCounter,
+	file string) (*runtimeCounters, error) {
+	return &runtimeCounters{}, nil
+}
+
+func (r *runtimeCounters) start() error {
+	return nil
+}
+
+func (r *runtimeCounters) stop() {
+}
+
+func (t *Thing) getRuntime(p *Packet) {
+}
+
+func (t *Thing) resetRuntime(p *Packet) {
+}
+
+type InputConfig struct {
+	Name        string
+	Kind        string
+	File        string
+	ActiveValue string
+	Debounce    uint
+	Scale       float64
+	RateWindow  uint
+	Wrap        uint64
+}
+
+type inputs struct {
+}
+
+func newInputs(thing *Thing, cfgs []InputConfig, file string) (*inputs, error) {
+	return &inputs{}, nil
+}
+
+func (ins *inputs) start() error {
+	return nil
+}
+
+func (ins *inputs) stop() {
+}
+
+func (t *Thing) getInputs(p *Packet) {
+}
+
+func (t *Thing) SetInput(name string, active bool) error {
+	return nil
+}
+
+func (t *Thing) Pulse(name string) error {
+	return nil
+}
+
+func (t *Thing) SetInputCount(name string, raw uint64) error {
+	return nil
+}
+
+func (t *Thing) Input(name string) (InputStatus, error) {
+	return InputStatus{}, nil
+}
+
+type AlertConfig struct {
+	Name       string
+	Msg        string
+	Field      string
+	Op         string
+	Threshold  float64
+	Hysteresis float64
+	Debounce   uint
+	Severity   string
+}
+
+type alerts struct {
+}
+
+func newAlerts(thing *Thing, cfgs []AlertConfig) (*alerts, error) {
+	return &alerts{}, nil
+}
+
+func (as *alerts) tap(p *Packet) {
+}
+
+func (as *alerts) start() {
+}
+
+func (as *alerts) stop() {
+}
+
+func (t *Thing) getAlerts(p *Packet) {
+}
+
+type CalPoint struct {
+	Raw   float64
+	Value float64
+}
+
+type Calibration struct {
+	Name   string
+	Window uint
+	Table  []CalPoint
+	Gain   float64
+	Offset float64
+}
+
+type calibrations struct {
+}
+
+func newCalibrations(thing *Thing, cfgs []Calibration,
+	file string) (*calibrations, error) {
+	return &calibrations{}, nil
+}
+
+func (t *Thing) Calibrate(name string, raw float64) float64 {
+	return raw
+}
+
+func (t *Thing) getCalibration(p *Packet) {
+}
+
+func (t *Thing) setCalibration(p *Packet) {
+}
+
+type Schedule struct {
+	Name  string
+	Cron  string
+	Every uint
+	Sun   string
+	Send  map[string]interface{}
+}
+
+type schedules struct {
+}
+
+func newSchedules(thing *Thing, cfgs []Schedule, file string) (*schedules, error) {
+	return &schedules{}, nil
+}
+
+func (s *schedules) start() {
+}
+
+func (s *schedules) stop() {
+}
+
+func (t *Thing) getSchedules(p *Packet) {
+}
+
+func (t *Thing) editSchedule(p *Packet) {
+}
+
+type UpdateConfig struct {
+	Keys   []string
+	Binary string
+}
+
+type updater struct {
+}
+
+func newUpdater(thing *Thing, cfg UpdateConfig) (*updater, error) {
+	return &updater{}, nil
+}
+
+func (t *Thing) updateBinary(p *Packet) {
+}
+
+type recorder struct {
+}
+
+func newRecorder(thing *Thing, file string) *recorder {
+	return &recorder{}
+}
+
+func (r *recorder) start() error {
+	return nil
+}
+
+func (r *recorder) stop() {
+}
+
+func (r *recorder) tap(p *Packet) {
+}
+
+type replayer struct {
+}
+
+func newReplayer(thing *Thing, file string) *replayer {
+	return &replayer{}
+}
+
+func (r *replayer) start() error {
+	return nil
+}
+
+func (r *replayer) stop() {
+}
+
+type ChaosConfig struct {
+	Latency    uint
+	Jitter     uint
+	Drop       uint
+	Disconnect uint
+}
+
+type Fault struct {
+	Kind     string
+	Target   string
+	Value    float64
+	Duration uint
+}
+
+type faults struct {
+}
+
+func newFaults(thing *Thing) *faults {
+	return &faults{}
+}
+
+func (t *Thing) Now() time.Time {
+	return time.Now()
+}
+
+func (t *Thing) injectFault(p *Packet) {
+}
+
+func (t *Thing) clearFaults(p *Packet) {
+}
+
+func (t *Thing) getFaults(p *Packet) {
+}
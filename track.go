@@ -0,0 +1,209 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Track export of Thing's history.  For Things broadcasting position updates,
+// the positions recorded in history are exported as a track, in GPX or
+// GeoJSON, with an HTTP GET on the public web server:
+//
+//	/{id}/track?msg=Update&since=24h&format=gpx
+//
+// "msg" is the position message type.  "since" and "until" select the time
+// range, as for /{id}/history.  "format" is "gpx" (the default) or "geojson".
+//
+// A position is read from the message's latitude member, one of Lat or
+// Latitude, and longitude member, one of Long, Lon, Lng, or Longitude.
+// Records without both are skipped.  Points are in time order, oldest first.
+
+var trackLatKeys = []string{"Lat", "Latitude"}
+var trackLongKeys = []string{"Long", "Lon", "Lng", "Longitude"}
+
+type trackPoint struct {
+	Time time.Time
+	Lat  float64
+	Long float64
+}
+
+func trackValue(m map[string]interface{}, keys []string) (float64, bool) {
+	for _, key := range keys {
+		if f, ok := m[key].(float64); ok {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// Positions from msg records in time range [since, until], oldest first
+func (h *history) track(msg string, since, until time.Time) ([]trackPoint, error) {
+	records, err := h.query(msg, since, until, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	points := []trackPoint{}
+
+	// Records are most recent first
+	for i := len(records) - 1; i >= 0; i-- {
+		var m map[string]interface{}
+		if err := json.Unmarshal(records[i].Msg, &m); err != nil {
+			continue
+		}
+		lat, ok := trackValue(m, trackLatKeys)
+		if !ok {
+			continue
+		}
+		long, ok := trackValue(m, trackLongKeys)
+		if !ok {
+			continue
+		}
+		points = append(points, trackPoint{records[i].Time, lat, long})
+	}
+
+	return points, nil
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time"`
+}
+
+type gpx struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Name    string     `xml:"trk>name"`
+	Points  []gpxPoint `xml:"trk>trkseg>trkpt"`
+}
+
+func writeGpx(w http.ResponseWriter, name string, points []trackPoint) {
+	doc := gpx{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Version: "1.1",
+		Creator: "merle",
+		Name:    name,
+		Points:  []gpxPoint{},
+	}
+	for _, pt := range points {
+		doc.Points = append(doc.Points, gpxPoint{
+			Lat:  pt.Lat,
+			Lon:  pt.Long,
+			Time: pt.Time.UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s.gpx\"", name))
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(&doc)
+}
+
+type geoJsonGeometry struct {
+	Type string `json:"type"`
+	// [longitude, latitude]
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+type geoJsonProperties struct {
+	Name  string      `json:"name"`
+	Times []time.Time `json:"times"`
+}
+
+type geoJsonFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJsonGeometry   `json:"geometry"`
+	Properties geoJsonProperties `json:"properties"`
+}
+
+func writeGeoJson(w http.ResponseWriter, name string, points []trackPoint) {
+	feature := geoJsonFeature{
+		Type: "Feature",
+		Geometry: geoJsonGeometry{
+			Type:        "LineString",
+			Coordinates: [][2]float64{},
+		},
+		Properties: geoJsonProperties{
+			Name:  name,
+			Times: []time.Time{},
+		},
+	}
+	for _, pt := range points {
+		feature.Geometry.Coordinates = append(feature.Geometry.Coordinates,
+			[2]float64{pt.Long, pt.Lat})
+		feature.Properties.Times = append(feature.Properties.Times, pt.Time)
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(&feature)
+}
+
+// Export Thing's track
+func (t *Thing) trackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t = t.grafanaThing(w, r)
+	if t == nil {
+		return
+	}
+
+	q := r.URL.Query()
+
+	msg := q.Get("msg")
+	if msg == "" {
+		http.Error(w, "Missing msg", http.StatusBadRequest)
+		return
+	}
+
+	since, err := parseSince(q.Get("since"))
+	if err != nil {
+		http.Error(w, "Bad since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var until time.Time
+	if s := q.Get("until"); s != "" {
+		until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Bad until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := q.Get("format")
+	if format != "" && format != "gpx" && format != "geojson" {
+		http.Error(w, "Bad format: want gpx or geojson", http.StatusBadRequest)
+		return
+	}
+
+	points, err := t.history.track(msg, since, until)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "geojson" {
+		writeGeoJson(w, t.name, points)
+	} else {
+		writeGpx(w, t.name, points)
+	}
+}
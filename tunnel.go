@@ -8,10 +8,16 @@
 package merle
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -23,32 +29,190 @@ type tunnel struct {
 	user        string
 	portPrivate uint
 	portRemote  uint
+	sync.Mutex
+	hints     []MotherHint
+	hintsFile string
+	status    TunnelStatus
 }
 
 func newTunnel(t *Thing, host, user string,
-	portPrivate, portRemote uint) *tunnel {
+	portPrivate, portRemote uint, hintsFile string) *tunnel {
 	return &tunnel{
 		thing:       t,
 		host:        host,
 		user:        user,
 		portPrivate: portPrivate,
 		portRemote:  portRemote,
+		hintsFile:   hintsFile,
+		status:      TunnelStatus{State: TunnelDisabled},
 	}
 }
 
-// TODO Need to use golang.org/x/crypto/ssh instead of
-// TODO os/exec'ing these ssh calls.  Also, look into
-// TODO using golang.org/x/crypto/ssh on hub-side of
-// TODO merle for bespoke ssh server.
+// Thing has a mother to tunnel to
+func (t *tunnel) hasMother() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.host != "" || len(t.hints) > 0
+}
+
+func (t *tunnel) setStatus(state, host string) {
+	t.Lock()
+	t.status = TunnelStatus{State: state, Host: host}
+	t.Unlock()
+}
+
+func (t *tunnel) getStatus() TunnelStatus {
+	t.Lock()
+	defer t.Unlock()
+	return t.status
+}
+
+// Set the private port, if picked when the private HTTP server started.  The
+// private server is started before the tunnel.
+func (t *tunnel) setPortPrivate(port uint) {
+	t.portPrivate = port
+}
+
+// Mother endpoints to try, in order.  First is mother from Thing's
+// configuration, followed by any mother hints.
+func (t *tunnel) endpoints() []MotherHint {
+	var eps []MotherHint
+
+	if t.host != "" {
+		eps = append(eps, MotherHint{Host: t.host})
+	}
+
+	t.Lock()
+	eps = append(eps, t.hints...)
+	t.Unlock()
+
+	for i := range eps {
+		if eps[i].User == "" {
+			eps[i].User = t.user
+		}
+		if eps[i].PortPrivate == 0 {
+			eps[i].PortPrivate = t.portRemote
+		}
+	}
+
+	return eps
+}
+
+// Load mother hints saved from a previous run
+func (t *tunnel) loadHints() error {
+	if t.hintsFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(t.hintsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	return json.Unmarshal(data, &t.hints)
+}
+
+func (t *tunnel) saveHints() error {
+	if t.hintsFile == "" {
+		return nil
+	}
+
+	t.Lock()
+	data, err := json.Marshal(t.hints)
+	t.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := t.hintsFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, t.hintsFile)
+}
+
+// Subscriber handler for SetMotherHints.  Hints are only accepted from
+// mother.
+func (t *tunnel) setHints(p *Packet) {
+	var msg MsgMotherHints
+
+	if p.src == nil || p.src.Flags()&sock_flag_mother == 0 {
+		t.thing.log.println("Ignoring mother hints; not from mother")
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	t.Lock()
+	t.hints = msg.Hints
+	t.Unlock()
+
+	t.thing.log.printf("Mother hints: %v", msg.Hints)
 
-func (t *tunnel) getPort() string {
+	if err := t.saveHints(); err != nil {
+		t.thing.log.println("Saving mother hints failed:", err)
+	}
+}
+
+// TODO Look into using golang.org/x/crypto/ssh on hub-side
+// TODO of merle for bespoke ssh server.
+
+// Get a port on mother for the tunnel.  Mother's refusals are returned as
+// the matching Errors.
+func (t *tunnel) getPort(ep MotherHint) (string, error) {
+	var port string
+	var err error
+
+	if t.thing.Cfg.Container {
+		port, err = t.sshGetPort(ep)
+	} else {
+		port, err = t.execGetPort(ep)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch port {
+	case "404 page not found\n":
+		t.thing.log.println("Tunnel weirdness; Thing trying to be its own Mother?; trying again")
+		return "", newError(ErrTunnel, fmt.Errorf("Thing trying to be its own Mother?"))
+	case ErrNoPortsAvailable.Code:
+		t.thing.log.println("Tunnel no ports available; trying again")
+		return "", ErrNoPortsAvailable
+	case ErrPortBusy.Code:
+		t.thing.log.println("Tunnel port is busy; trying again")
+		return "", ErrPortBusy
+	case ErrBlocked.Code:
+		t.thing.log.println("Tunnel blocked by mother; trying again")
+		return "", ErrBlocked
+	case ErrBridgeFull.Code:
+		t.thing.log.println("Tunnel rejected; mother's bridge is full; trying again")
+		return "", ErrBridgeFull
+	case ErrDuplicateId.Code:
+		t.thing.log.printf("Tunnel rejected; a Thing with Id %s is already "+
+			"attached to mother's bridge (set Cfg.Id?); trying again", t.thing.id)
+		return "", ErrDuplicateId
+	}
+
+	return port, nil
+}
+
+// Get a port on mother with the ssh binary, and mother's curl
+func (t *tunnel) execGetPort(ep MotherHint) (string, error) {
 
 	// ssh <user>@<host> curl -s localhost:<privatePort>/port/<id>
 
-	privatePort := strconv.FormatUint(uint64(t.portRemote), 10)
+	privatePort := strconv.FormatUint(uint64(ep.PortPrivate), 10)
 
 	args := []string{
-		t.user + "@" + t.host,
+		ep.User + "@" + ep.Host,
 		"curl", "-s",
 		"localhost:" + privatePort + "/port/" + t.thing.id,
 	}
@@ -65,27 +229,30 @@ func (t *tunnel) getPort() string {
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
 		t.thing.log.printf("Tunnel get port failed: %s, err %v", stdoutStderr, err)
-		return ""
+		return "", sshError(stdoutStderr, err)
 	}
 
-	port := string(stdoutStderr)
+	return string(stdoutStderr), nil
+}
 
-	switch port {
-	case "404 page not found\n":
-		t.thing.log.println("Tunnel weirdness; Thing trying to be its own Mother?; trying again")
-		return ""
-	case "no ports available":
-		t.thing.log.println("Tunnel no ports available; trying again")
-		return ""
-	case "port busy":
-		t.thing.log.println("Tunnel port is busy; trying again")
-		return ""
+// Error for a failed ssh, with output out.  ssh reports refused
+// credentials as "Permission denied".
+func sshError(out []byte, err error) error {
+	msg := strings.TrimSpace(string(out))
+	if msg == "" {
+		msg = err.Error()
 	}
-
-	return port
+	if strings.Contains(msg, "Permission denied") {
+		return newError(ErrTunnelAuth, errors.New(msg))
+	}
+	return newError(ErrTunnel, errors.New(msg))
 }
 
-func (t *tunnel) tunnel(port string) error {
+func (t *tunnel) tunnel(ep MotherHint, port string) error {
+
+	if t.thing.Cfg.Container {
+		return t.sshTunnel(ep, port)
+	}
 
 	// ssh -o ExitOnForwardFailure=yes -CNT -R 8081:localhost:8080 <hub>
 	//
@@ -97,7 +264,7 @@ func (t *tunnel) tunnel(port string) error {
 	args := []string{
 		"-CNT",
 		"-o", "ExitOnForwardFailure=yes",
-		"-R", remote, t.user + "@" + t.host,
+		"-R", remote, ep.User + "@" + ep.Host,
 	}
 
 	t.thing.log.printf("Creating tunnel [ssh %s]", args)
@@ -112,32 +279,72 @@ func (t *tunnel) tunnel(port string) error {
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
 		t.thing.log.printf("Create tunnel failed: %s, err %v", stdoutStderr, err)
+		return sshError(stdoutStderr, err)
 	}
 
-	return err
+	return nil
+}
+
+// Raise err, unless the last try failed the same way, so retries don't
+// repeat the event
+func (t *tunnel) failed(err, last error) {
+	if ErrorCode(err) != ErrorCode(last) {
+		t.thing.raise(err)
+	}
 }
 
 func (t *tunnel) create() {
-	var err error
+	var err, last error
 	var port string
+	var next int
 
 	rand.Seed(time.Now().UnixNano())
 
 	for {
+		var ep MotherHint
+		var conn Connection
+
+		// Try mother endpoints in order, moving to the next endpoint
+		// on failure.  After a tunnel disconnects, start again from
+		// the first endpoint.
+
+		eps := t.endpoints()
+		if len(eps) == 0 {
+			goto again
+		}
+		if next >= len(eps) {
+			next = 0
+		}
+		ep = eps[next]
+		next++
+
+		t.setStatus(TunnelConnecting, ep.Host)
 
-		port = t.getPort()
-		if port == "" {
+		port, err = t.getPort(ep)
+		if err != nil {
+			t.failed(err, last)
+			last = err
 			goto again
 		}
 
-		t.thing.log.println("Tunnel got port", port)
+		t.thing.log.println("Tunnel got port", port, "on", ep.Host)
 
-		err = t.tunnel(port)
+		// Tunnel is up until t.tunnel returns
+		t.setStatus(TunnelConnected, ep.Host)
+		conn = Connection{Name: "tunnel:" + ep.Host, Mother: true}
+		t.thing.connected(conn)
+		err = t.tunnel(ep, port)
+		t.setStatus(TunnelConnecting, ep.Host)
+		t.thing.disconnected(conn)
 		if err != nil {
+			t.failed(err, last)
+			last = err
 			goto again
 		}
 
 		t.thing.log.println("Tunnel disconnected")
+		next = 0
+		last = nil
 
 	again:
 		// TODO maybe try some exponential back-off aglo ala TCP
@@ -155,7 +362,11 @@ func (t *tunnel) create() {
 }
 
 func (t *tunnel) start() {
-	if t.host == "" {
+	t.Lock()
+	hints := len(t.hints)
+	t.Unlock()
+
+	if t.host == "" && hints == 0 {
 		t.thing.log.println("Skipping tunnel to mother; missing host")
 		return
 	}
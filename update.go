@@ -0,0 +1,248 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Update configuration, for over-the-air updates of Thing's binary.  Mother
+// sends Thing an Update message with the new binary's URL, Version, and
+// Signature.  Thing downloads the binary, verifies the signature against
+// Keys, swaps the binary in for the running one, and re-execs.  The new
+// binary reports its version in ReplyIdentity (see Cfg.Version).  The
+// replaced binary is kept, with suffix ".old", for rollback by hand.
+//
+// The signature is an ed25519 signature, base64-encoded, over Thing's
+// Model, a newline, the Version, a newline, and the binary, so a signed
+// binary can't be replayed as another version, or on another model.  Use
+// "merle release" to sign a binary.
+//
+// Updates are refused if Keys is empty.  An update to a Version not newer
+// than Cfg.Version is refused, so an old signed binary can't be replayed to
+// roll Thing back.  Keys need Cfg.Version set.
+//
+// Thing re-execs in place, as the user it runs as, so Update can't be used
+// with Cfg.RunAs.  The new binary doesn't have the old binary's file
+// capabilities, so a binary given CAP_NET_BIND_SERVICE with setcap loses
+// it on update; bind ports below 1024 with systemd socket activation
+// instead.
+type UpdateConfig struct {
+
+	// Public keys, base64-encoded, trusted to sign Thing's binaries.  An
+	// update signed by none of the Keys is rejected.  The default is nil
+	// (no updates).
+	Keys []string
+
+	// [Optional] Path of Thing's binary to replace.  The default is ""
+	// (the running binary).
+	Binary string
+}
+
+// Largest binary downloaded for an update
+const updateMax = 256 << 20
+
+type updater struct {
+	sync.Mutex
+	thing    *Thing
+	keys     []ed25519.PublicKey
+	binary   string
+	updating bool
+	// Re-exec the binary; replaced in tests
+	exec func(binary string) error
+}
+
+func newUpdater(thing *Thing, cfg UpdateConfig) (*updater, error) {
+	u := &updater{thing: thing, binary: cfg.Binary, exec: reexec}
+
+	// Without a Version, any older signed binary could roll Thing back
+	if len(cfg.Keys) > 0 && thing.Cfg.Version == "" {
+		return nil, fmt.Errorf("Update Keys need Version set")
+	}
+
+	for _, key := range cfg.Keys {
+		pub, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Bad update key %q", key)
+		}
+		u.keys = append(u.keys, ed25519.PublicKey(pub))
+	}
+
+	return u, nil
+}
+
+func reexec(binary string) error {
+	return syscall.Exec(binary, os.Args, os.Environ())
+}
+
+// UpdateSigned returns the data signed for an update: model, a newline,
+// version, a newline, and the binary
+func UpdateSigned(model, version string, binary []byte) []byte {
+	return append([]byte(model+"\n"+version+"\n"), binary...)
+}
+
+func (u *updater) verify(version string, binary []byte, sig string) error {
+	s, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("Bad update signature: %s", err)
+	}
+	signed := UpdateSigned(u.thing.Cfg.Model, version, binary)
+	for _, key := range u.keys {
+		if ed25519.Verify(key, signed, s) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Update signature not trusted")
+}
+
+// Swap data in for the binary.  The old binary is kept as binary.old.
+func swapBinary(binary string, data []byte) error {
+	info, err := os.Stat(binary)
+	if err != nil {
+		return err
+	}
+
+	// Write alongside, so the rename is atomic
+	tmp, err := ioutil.TempFile(filepath.Dir(binary), ".update")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	old := binary + ".old"
+	if err := os.Rename(binary, old); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), binary); err != nil {
+		os.Rename(old, binary)
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Fetch, verify, and swap in the binary, and then re-exec
+func (u *updater) update(msg *MsgUpdate) error {
+	t := u.thing
+
+	if len(u.keys) == 0 {
+		return fmt.Errorf("No update keys")
+	}
+	if msg.Version == "" || msg.URL == "" {
+		return fmt.Errorf("Update needs URL and Version")
+	}
+	if compareVersions(msg.Version, t.Cfg.Version) <= 0 {
+		return fmt.Errorf("Version %s is not newer than running version %s",
+			msg.Version, t.Cfg.Version)
+	}
+
+	binary := u.binary
+	if binary == "" {
+		var err error
+		if binary, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+
+	t.log.printf("Updating to version %s from %s", msg.Version, msg.URL)
+
+	data, err := httpGet(msg.URL, updateMax)
+	if err != nil {
+		return err
+	}
+	if err := u.verify(msg.Version, data, msg.Signature); err != nil {
+		return err
+	}
+	if err := swapBinary(binary, data); err != nil {
+		return err
+	}
+
+	// Leave things tidy for the new binary
+
+	if err := t.SaveState(); err != nil {
+		t.log.println("Saving state failed:", err)
+	}
+	thinger := t.getThinger()
+	teardown(thinger)
+
+	t.log.printf("Updated to version %s; restarting", msg.Version)
+
+	err = u.exec(binary)
+
+	// Still here, so the re-exec failed.  The new binary is in place for
+	// the next restart; carry on with this one.
+	if err := setup(thinger); err != nil {
+		t.log.println("Thinger setup failed:", err)
+	}
+
+	return err
+}
+
+// Subscriber handler for Update.  Updates are only accepted from mother.
+// Thing replies with ReplyUpdate if the update fails; on success, Thing
+// re-execs and mother sees Thing reconnect with the new version.
+func (t *Thing) updateBinary(p *Packet) {
+	var msg MsgUpdate
+
+	if p.src == nil || p.src.Flags()&sock_flag_mother == 0 {
+		t.log.println("Ignoring update; not from mother")
+		return
+	}
+
+	p.Unmarshal(&msg)
+
+	u := t.updater
+	u.Lock()
+	busy := u.updating
+	u.updating = true
+	u.Unlock()
+
+	if busy {
+		resp := MsgUpdateResult{Msg: ReplyUpdate, Version: msg.Version,
+			Err: "Update in progress"}
+		p.Marshal(&resp).Reply()
+		return
+	}
+
+	// Downloading takes a while; don't hold up the bus
+	go func() {
+		err := u.update(&msg)
+
+		u.Lock()
+		u.updating = false
+		u.Unlock()
+
+		if err == nil {
+			return
+		}
+
+		t.log.printf("Update to version %s failed: %s", msg.Version, err)
+		resp := MsgUpdateResult{Msg: ReplyUpdate, Version: msg.Version,
+			Err: err.Error()}
+		p.Marshal(&resp).Reply()
+	}()
+}
@@ -0,0 +1,124 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	newBinary := []byte("v2 binary")
+	sign := func(model, version string) string {
+		return base64.StdEncoding.EncodeToString(
+			ed25519.Sign(priv, UpdateSigned(model, version, newBinary)))
+	}
+	sig := sign("pump", "2.0")
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { w.Write(newBinary) }))
+	defer srv.Close()
+
+	binary := filepath.Join(dir, "thing")
+	if err := ioutil.WriteFile(binary, []byte("v1 binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	thing := NewThing(&pump{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Model = "pump"
+	thing.Cfg.Version = "1.0"
+	thing.Cfg.Update.Keys = []string{base64.StdEncoding.EncodeToString(pub)}
+	thing.Cfg.Update.Binary = binary
+	if err := thing.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// No rollback guard without a Version
+	unversioned := NewThing(&pump{})
+	unversioned.Cfg.Id = testId
+	unversioned.Cfg.Update.Keys = thing.Cfg.Update.Keys
+	if err := unversioned.build(false); err == nil {
+		t.Error("Update Keys without Version")
+	}
+
+	var execd string
+	thing.updater.exec = func(binary string) error {
+		execd = binary
+		return fmt.Errorf("exec'd")
+	}
+
+	// Signature must cover the version
+	msg := MsgUpdate{Msg: Update, URL: srv.URL, Version: "3.0", Signature: sig}
+	if err := thing.updater.update(&msg); err == nil {
+		t.Error("Update with signature for another version")
+	}
+	if data, _ := ioutil.ReadFile(binary); string(data) != "v1 binary" {
+		t.Errorf("Binary replaced by bad update: %q", data)
+	}
+
+	// Signature must cover the model
+	msg = MsgUpdate{Msg: Update, URL: srv.URL, Version: "2.0",
+		Signature: sign("fan", "2.0")}
+	if err := thing.updater.update(&msg); err == nil {
+		t.Error("Update with signature for another model")
+	}
+
+	// No going back, even if signed
+	msg = MsgUpdate{Msg: Update, URL: srv.URL, Version: "0.9",
+		Signature: sign("pump", "0.9")}
+	if err := thing.updater.update(&msg); err == nil {
+		t.Error("Update to older version")
+	}
+	msg.Version, msg.Signature = "1.0", sign("pump", "1.0")
+	if err := thing.updater.update(&msg); err == nil {
+		t.Error("Update to same version")
+	}
+
+	msg.Version, msg.Signature = "2.0", sig
+	if err := thing.updater.update(&msg); err == nil || err.Error() != "exec'd" {
+		t.Errorf("Update: %v", err)
+	}
+	if execd != binary {
+		t.Errorf("Exec'd %q", execd)
+	}
+	if data, _ := ioutil.ReadFile(binary); string(data) != "v2 binary" {
+		t.Errorf("Binary not replaced: %q", data)
+	}
+	if data, _ := ioutil.ReadFile(binary + ".old"); string(data) != "v1 binary" {
+		t.Errorf("Old binary not kept: %q", data)
+	}
+	if info, _ := os.Stat(binary); info.Mode().Perm() != 0755 {
+		t.Errorf("Binary mode %v", info.Mode())
+	}
+
+	// Only accepted from mother
+	execd = ""
+	thing.bus.receive(newPacket(thing.bus, &recordSocket{}, &msg))
+	thing.updater.Lock()
+	updating := thing.updater.updating
+	thing.updater.Unlock()
+	if updating || execd != "" {
+		t.Error("Update accepted from non-mother socket")
+	}
+}
@@ -5,22 +5,78 @@
 package merle
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 )
 
-// Make up an id using the MAC address of the first non-lo interface
-func defaultId() string {
+// Make up an id from the hardware: the MAC address of the primary network
+// interface or, failing that, the machine-id.  The id stays the same across
+// restarts, so mother's history and port maps still match.  The MAC address
+// also survives OS reinstalls; the machine-id doesn't.
+func defaultId() (string, error) {
+	if mac := primaryMac(); mac != nil {
+		return strings.Replace(mac.String(), ":", "_", -1), nil
+	}
+	if id := machineId(); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("Can't make up an Id from hardware; set Cfg.Id")
+}
+
+// MAC address of the primary network interface.  Physical interfaces are
+// preferred over virtual ones (bridges, VPNs, containers), and globally
+// unique addresses over locally administered ones, such as randomized WiFi
+// addresses.  Ties go to the lowest interface name, so the pick doesn't
+// depend on the order interfaces came up.
+func primaryMac() net.HardwareAddr {
+	var best net.Interface
+	var bestRank = -1
+
 	ifaces, err := net.Interfaces()
-	if err == nil {
-		for _, iface := range ifaces {
-			if iface.Name != "lo" {
-				addr := iface.HardwareAddr.String()
-				return strings.Replace(addr, ":", "_", -1)
-			}
+	if err != nil {
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		rank := 0
+		if _, err := os.Stat("/sys/class/net/" + iface.Name + "/device"); err == nil {
+			rank += 2
 		}
+		if iface.HardwareAddr[0]&0x02 == 0 {
+			rank++
+		}
+		if rank > bestRank || (rank == bestRank && iface.Name < best.Name) {
+			best, bestRank = iface, rank
+		}
+	}
+
+	if bestRank < 0 {
+		return nil
 	}
-	return "unknown"
+	return best.HardwareAddr
+}
+
+// The OS's machine-id, or "" if none
+func machineId() string {
+	for _, file := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSpace(string(data))
+		if id != "" && validId(id) {
+			return id
+		}
+	}
+	return ""
 }
 
 // A valid ID is a string with only [a-z], [A-Z], [0-9], or underscore
@@ -39,3 +95,54 @@ func validId(s string) bool {
 
 func validModel(s string) bool { return validId(s) }
 func validName(s string) bool  { return validId(s) }
+
+// Base path is "", or an absolute, clean path without a trailing slash,
+// e.g. "/things/garage"
+func validBasePath(s string) bool {
+	if s == "" {
+		return true
+	}
+	return path.IsAbs(s) && path.Clean(s) == s && s != "/"
+}
+
+// Compare versions a and b, e.g. "1.10.0" and "v1.9.2", part by part:
+// numerically if both parts are numbers, otherwise as strings.  Missing parts
+// are "0".  Returns -1 if a is older than b, 0 if they're the same, and 1 if
+// a is newer.
+func compareVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		x, y := "0", "0"
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil && nx < ny:
+			return -1
+		case errx == nil && erry == nil && nx > ny:
+			return 1
+		case (errx != nil || erry != nil) && x < y:
+			return -1
+		case (errx != nil || erry != nil) && x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// List contains s
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -12,17 +12,19 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
-	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"net"
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/msteinert/pam"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -31,12 +33,20 @@ type web struct {
 	private  *webPrivate
 	templ    *template.Template
 	templErr error
+	pages    map[string]*page
+}
+
+// A page of Thing's UI, other than the home page
+type page struct {
+	templ *template.Template
+	err   error
 }
 
 func newWeb(t *Thing, portPublic, portPublicTLS, portPrivate uint,
-	user string) *web {
+	user, certFile, keyFile string) *web {
 	return &web{
-		public:  newWebPublic(t, portPublic, portPublicTLS, user),
+		public: newWebPublic(t, portPublic, portPublicTLS, user,
+			certFile, keyFile),
 		private: newWebPrivate(t, portPrivate),
 	}
 }
@@ -49,16 +59,70 @@ func (w *web) handleBridgePortId() {
 	w.private.mux.HandleFunc("/port/{id}", w.private.getBridgePort)
 }
 
+func (w *web) handleBridgeChildren(b *bridge) {
+	w.private.mux.HandleFunc("/children", b.childrenHandler)
+	w.private.mux.HandleFunc("/children/{id}/{op}", b.childHandler)
+}
+
+func (w *web) handleRegistry(r *registry) {
+	w.private.mux.HandleFunc("/registry", r.registryHandler)
+	w.private.mux.HandleFunc("/registry/{id}", r.entryHandler)
+}
+
+func (w *web) handleGraphQL(g *graphql) {
+	w.private.mux.HandleFunc("/graphql", g.handler)
+}
+
 func (w *web) staticFiles(t *Thing) {
-	fs := http.FileServer(http.Dir(t.assets.AssetsDir))
+	// Assets dir is looked up on each request, as SwapThinger may change
+	// Thing's assets
+	files := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.getAssets().fileServer().ServeHTTP(w, r)
+	})
 	path := "/" + t.id + "/assets/"
-	w.public.mux.PathPrefix(path).Handler(http.StripPrefix(path, fs))
+	w.public.mux.PathPrefix(path).Handler(http.StripPrefix(path, files))
 }
 
-var upgrader = websocket.Upgrader{}
+// Thing's assets, which SwapThinger may change
+func (t *Thing) getAssets() *ThingAssets {
+	t.runLock.Lock()
+	defer t.runLock.Unlock()
+	return t.assets
+}
+
+// File server for the assets dir, in FS if given
+func (a *ThingAssets) fileServer() http.Handler {
+	if a.FS == nil {
+		return http.FileServer(http.Dir(a.AssetsDir))
+	}
+	dir := a.AssetsDir
+	if dir == "" {
+		dir = "."
+	}
+	sub, err := fs.Sub(a.FS, dir)
+	if err != nil {
+		return http.NotFoundHandler()
+	}
+	return http.FileServer(http.FS(sub))
+}
 
 // Open a WebSocket on Thing
 func (t *Thing) ws(w http.ResponseWriter, r *http.Request) {
+	t.wsOpen(w, r, 0)
+}
+
+// Open a WebSocket on Thing from mother.  Mother connects on the private
+// HTTP server.  A WebSocket opened on /ws?monitor is a monitor, such as the
+// merle status command, rather than mother.
+func (t *Thing) wsMother(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["monitor"]; ok {
+		t.wsOpen(w, r, sock_flag_private)
+		return
+	}
+	t.wsOpen(w, r, sock_flag_private|sock_flag_mother)
+}
+
+func (t *Thing) wsOpen(w http.ResponseWriter, r *http.Request, flags uint32) {
 	var err error
 
 	vars := mux.Vars(r)
@@ -77,77 +141,236 @@ func (t *Thing) ws(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !t.bus.reserve() {
+		t.log.printf("Websocket rejected [%s]; %d connections max",
+			r.RemoteAddr, t.Cfg.MaxConnections)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: t.checkOrigin}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		t.bus.release()
 		t.log.println("Websocket upgrader error:", err)
 		return
 	}
 	defer ws.Close()
 
-	name := "ws:" + r.RemoteAddr + r.RequestURI
+	// Viewers can only send requests
+	user, _, _ := r.BasicAuth()
+	u := authUser(r)
+	if u != nil {
+		user = u.Name
+		if u.Role == RoleViewer {
+			flags |= sock_flag_readonly
+		}
+	}
+
+	name := "ws:" + t.clientAddr(r) + r.RequestURI
 	var sock = newWebSocket(t, name, ws)
+	sock.SetFlags(flags)
+	sock.user = user
+	sock.auth = u
+	if user != "" {
+		t.auditAuth(r, user, true)
+	}
+	if flags&sock_flag_mother != 0 {
+		t.chaosLink(sock)
+	}
+	t.keepalive(sock)
+	t.limit(sock, flags&sock_flag_mother == 0)
 
 	t.log.printf("Websocket opened [%s]", name)
 
-	// Plug the websocket into Thing's bus
-	t.bus.plugin(sock)
+	// Plug the websocket into Thing's bus, in the place reserved
+	t.bus.attach(sock)
+
+	elected := t.election != nil && flags&sock_flag_mother != 0
+	if elected {
+		t.election.join(sock)
+	}
+
+	// Active and standby Thing Primes each see only part of the stream
+	if flags&sock_flag_mother != 0 && !elected {
+		sock.link = t.link
+	}
 
 	for {
 		// New pkt for each rcv
 		var pkt = newPacket(t.bus, sock, nil)
 
-		_, pkt.msg, err = ws.ReadMessage()
+		pkt.msg, err = sock.read()
 		if err != nil {
 			t.log.printf("Websocket closed [%s]", name)
 			break
 		}
 
+		if flags&sock_flag_readonly != 0 && !isRequest(pkt) {
+			t.log.printf("Dropping message from read-only [%s]: %.80s",
+				name, pkt.String())
+			t.auditCommand(pkt, user, name, AuditRejected, "read only")
+			continue
+		}
+
+		if elected && !isRequest(pkt) && !t.election.isActive(sock) {
+			t.log.printf("Dropping message from standby Prime [%s]: %.80s",
+				name, pkt.String())
+			continue
+		}
+
+		if flags&sock_flag_mother == 0 && !isRequest(pkt) {
+			t.auditCommand(pkt, user, name, AuditReceived, "")
+		}
+
 		// Put the packet on the bus
 		t.bus.receive(pkt)
 	}
 
+	if elected {
+		t.election.leave(sock)
+	}
+
 	// Unplug the websocket from Thing's bus
 	t.bus.unplug(sock)
+	sock.stop()
 }
 
+// Serve child's assets, and child's WebHandler routes, on Thing's servers.
+// Child may be Thing itself.
 func (t *Thing) setAssetsDir(child *Thing) {
 	t.web.staticFiles(child)
+	t.web.thingHandlers(child)
 }
 
-func (t *Thing) setHtmlTemplate() {
-	a := t.assets
-	if a.HtmlTemplateText != "" {
-		t.web.templ, t.web.templErr = template.New("").Parse(a.HtmlTemplateText)
-		if t.web.templErr != nil {
-			t.log.println("Error parsing HtmlTemplateText:", t.web.templErr)
+// Templater is implemented by a Thinger to extend Thing's HTML template.
+// TemplateFuncs are added to the template before it's parsed, for use in
+// the template:
+//
+//	func (t *thing) TemplateFuncs() template.FuncMap {
+//		return template.FuncMap{
+//			"celsius": func(f float64) string {
+//				return fmt.Sprintf("%.1f°C", (f-32)*5/9)
+//			},
+//		}
+//	}
+//
+// Thinger's TemplateFuncs override Thing's own, such as sparkline (see
+// chart.go).
+//
+// TemplateParams are added to the template's params for request r, along
+// with Thing's own: Host, Id, Model, Name, BasePath, AssetsDir, and
+// WebSocket.
+// Thing's own params take priority.  TemplateParams is called for each
+// request, from the request's goroutine.
+type Templater interface {
+	TemplateFuncs() template.FuncMap
+	TemplateParams(r *http.Request) map[string]interface{}
+}
+
+// Thing's template funcs, and the Thinger's, if it's a Templater
+func (t *Thing) templateFuncs() template.FuncMap {
+	funcs := template.FuncMap{
+		"sparkline": t.sparkline,
+	}
+	if templater, ok := t.getThinger().(Templater); ok {
+		for name, f := range templater.TemplateFuncs() {
+			funcs[name] = f
 		}
-	} else if a.HtmlTemplate != "" {
-		file := path.Join(a.AssetsDir, a.HtmlTemplate)
-		t.web.templ, t.web.templErr = template.ParseFiles(file)
-		if t.web.templErr != nil {
-			t.log.println("Error parsing HtmlTemplate:", t.web.templErr)
+	}
+	return funcs
+}
+
+// Parse a template from text, or else from file in the assets dir, with the
+// Thinger's template funcs.  what names the template in errors.
+func (t *Thing) parseTemplate(what, text, file string) (*template.Template, error) {
+	var templ *template.Template
+	var err error
+
+	funcs := t.templateFuncs()
+	if text != "" {
+		templ, err = template.New("").Funcs(funcs).Parse(text)
+	} else if file != "" {
+		a := t.getAssets()
+		file = path.Join(a.AssetsDir, file)
+		templ = template.New(path.Base(file)).Funcs(funcs)
+		if a.FS != nil {
+			templ, err = templ.ParseFS(a.FS, file)
+		} else {
+			templ, err = templ.ParseFiles(file)
 		}
 	}
+
+	if err != nil {
+		err = newError(ErrTemplateParse, fmt.Errorf("%s: %w", what, err))
+		t.log.println("Error parsing template:", err)
+		t.keepError(err)
+	}
+
+	return templ, err
+}
+
+// Pages' names can't take the public server's own /{id}/ routes
+var reservedPages = map[string]bool{
+	"state": true, "history": true, "track": true, "runtime": true,
+	"grafana": true, "assets": true, "api": true, "events": true,
+	"webhook": true, "lora": true,
+}
+
+func (t *Thing) setHtmlTemplate() {
+	a := t.getAssets()
+	t.web.templ, t.web.templErr = t.parseTemplate("HtmlTemplate",
+		a.HtmlTemplateText, a.HtmlTemplate)
+
+	pages := make(map[string]*page)
+	for name, p := range a.Pages {
+		var pg page
+		if reservedPages[name] {
+			pg.err = newError(ErrTemplateParse,
+				fmt.Errorf("Page %s: name is reserved", name))
+			t.log.println("Error parsing template:", pg.err)
+			t.keepError(pg.err)
+		} else {
+			pg.templ, pg.err = t.parseTemplate("Page "+name,
+				p.TemplateText, p.Template)
+		}
+		pages[name] = &pg
+	}
+	t.web.pages = pages
 }
 
 // Some things to pass into the Thing's HTML template
 func (t *Thing) templateParams(r *http.Request) map[string]interface{} {
-	scheme := "wss://"
-	if r.TLS == nil {
-		scheme = "ws://"
+	scheme, host, _ := t.forwarded(r)
+	base := t.basePath(r)
+	wsScheme := "wss://"
+	if scheme == "http" {
+		wsScheme = "ws://"
+	}
+
+	params := map[string]interface{}{}
+	if templater, ok := t.getThinger().(Templater); ok {
+		for k, v := range templater.TemplateParams(r) {
+			params[k] = v
+		}
 	}
 
-	return map[string]interface{}{
-		"Host":  r.Host,
+	for k, v := range map[string]interface{}{
+		"Host":  host,
 		"Id":    t.id,
 		"Model": t.model,
 		"Name":  t.name,
 		// TODO The forward slashes are getting escaped in the output
 		// TODO within <script></script> tags.  So "/" turns into "\/".
 		// TODO Need to figure out why it's doing that or decide if it matters.
-		"AssetsDir": template.JSStr(t.id + "/assets"),
-		"WebSocket": template.JSStr(scheme + r.Host + "/ws/" + t.id),
+		"BasePath":  base,
+		"AssetsDir": template.JSStr(strings.TrimPrefix(base+"/"+t.id+"/assets", "/")),
+		"WebSocket": template.JSStr(wsScheme + host + base + "/ws/" + t.id),
+	} {
+		params[k] = v
 	}
+
+	return params
 }
 
 // Open the Thing's home page (UI)
@@ -176,10 +399,68 @@ func (t *Thing) home(w http.ResponseWriter, r *http.Request) {
 	if t.web.templErr != nil {
 		http.Error(w, t.web.templErr.Error(), http.StatusNotFound)
 	} else if t.web.templ != nil {
+		t.setContentPolicy(w, r)
 		t.web.templ.Execute(w, t.templateParams(r))
 	}
 }
 
+// Is the request for one of Thing's, or a child's, pages?  Other requests
+// fall through to routes registered later, such as WebHandlers'.
+func (t *Thing) isPage(r *http.Request, rm *mux.RouteMatch) bool {
+	// Route vars aren't set yet, while matching
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		return false
+	}
+	id, name := parts[0], parts[1]
+
+	thing := t
+	if child := t.getChild(id); child != nil {
+		thing = child
+	} else if id != t.id {
+		return false
+	}
+
+	if thing.web == nil {
+		return false
+	}
+	_, ok := thing.web.pages[name]
+	return ok
+}
+
+// Open one of Thing's pages (see ThingAssets.Pages)
+func (t *Thing) page(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	child := t.getChild(id)
+	if child != nil {
+		child.page(w, r)
+		return
+	}
+
+	if id != t.id {
+		http.Error(w, "Mismatch on Ids", http.StatusNotFound)
+		return
+	}
+
+	pg, ok := t.web.pages[vars["page"]]
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case pg.err != nil:
+		http.Error(w, pg.err.Error(), http.StatusNotFound)
+	default:
+		t.setContentPolicy(w, r)
+		pg.templ.Execute(w, t.templateParams(r))
+	}
+}
+
 // Dump Thing's state
 func (t *Thing) state(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -209,35 +490,16 @@ func (t *Thing) state(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, jsonPrettyPrint(p.msg))
 }
 
-func (w *webPublic) pamValidate(user, passwd string) (bool, error) {
-	trans, err := pam.StartFunc("", user,
-		func(s pam.Style, msg string) (string, error) {
-			switch s {
-			case pam.PromptEchoOff:
-				return passwd, nil
-			}
-			return "", errors.New("Unrecognized message style")
-		})
-	if err != nil {
-		w.thing.log.println("PAM Start:", err)
-		return false, err
-	}
-	err = trans.Authenticate(0)
-	if err != nil {
-		w.thing.log.printf("Authenticate [%s,%s]: %s", user, passwd, err)
-		return false, err
-	}
-	err = trans.AcctMgmt(0)
-	if err != nil {
-		w.thing.log.printf("Authenticate [%s,%s]: %s", user, passwd, err)
-		return false, err
-	}
+func (w *webPublic) basicAuth(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
 
-	return true, nil
-}
+		// User can change on config reload
+		authUser := w.getUser()
 
-func (w *webPublic) basicAuth(authUser string, next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		if a := w.thing.auth; a != nil {
+			w.authStore(a, authUser, next, writer, r)
+			return
+		}
 
 		// skip basic authentication if no user
 		if authUser == "" {
@@ -262,6 +524,8 @@ func (w *webPublic) basicAuth(authUser string, next http.HandlerFunc) http.Handl
 				next.ServeHTTP(writer, r)
 				return
 			}
+
+			w.thing.auditAuth(r, user, false)
 		}
 
 		writer.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -269,13 +533,49 @@ func (w *webPublic) basicAuth(authUser string, next http.HandlerFunc) http.Handl
 	})
 }
 
+// Authenticate against the auth store, and check the user can access the
+// Thing, or bridge child, with the request's id
+func (w *webPublic) authStore(a *auth, bootUser string, next http.HandlerFunc,
+	writer http.ResponseWriter, r *http.Request) {
+
+	u := a.authenticate(r, bootUser, w.pamValidate)
+	if u == nil {
+		if r.Header.Get("Authorization") != "" {
+			user, _, _ := r.BasicAuth()
+			w.thing.auditAuth(r, user, false)
+		}
+		writer.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		id = w.thing.id
+	}
+	if !a.canAccess(u, id) {
+		http.Error(writer, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(),
+		authUserKey{}, u)))
+}
+
 // The Thing's public HTTP server
 type webPublic struct {
 	thing *Thing
 	sync.WaitGroup
+	// cfgLock protects config reloadable while running
+	cfgLock     sync.RWMutex
 	user        string
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
 	port        uint
 	portTLS     uint
+	bind        []string
+	bindTLS     []string
 	addr        string
 	addrTLS     string
 	running     bool
@@ -283,9 +583,13 @@ type webPublic struct {
 	server      *http.Server
 	serverTLS   *http.Server
 	certManager autocert.Manager
+	// Ports bound ahead of start, by bindPorts
+	lns    []net.Listener
+	lnsTLS []net.Listener
 }
 
-func newWebPublic(t *Thing, port, portTLS uint, user string) *webPublic {
+func newWebPublic(t *Thing, port, portTLS uint,
+	user, certFile, keyFile string) *webPublic {
 	addr := ":" + strconv.FormatUint(uint64(port), 10)
 	addrTLS := ":" + strconv.FormatUint(uint64(portTLS), 10)
 
@@ -297,8 +601,12 @@ func newWebPublic(t *Thing, port, portTLS uint, user string) *webPublic {
 	w := &webPublic{
 		thing:       t,
 		user:        user,
+		certFile:    certFile,
+		keyFile:     keyFile,
 		port:        port,
 		portTLS:     portTLS,
+		bind:        t.Cfg.BindPublic,
+		bindTLS:     t.Cfg.BindPublicTLS,
 		addr:        addr,
 		addrTLS:     addrTLS,
 		certManager: certManager,
@@ -312,91 +620,259 @@ func newWebPublic(t *Thing, port, portTLS uint, user string) *webPublic {
 func (w *webPublic) newServer() {
 	w.mux = mux.NewRouter()
 
-	w.mux.HandleFunc("/ws/{id}", w.basicAuth(w.user, w.thing.ws))
-	w.mux.HandleFunc("/state", w.basicAuth(w.user, w.thing.state))
-	w.mux.HandleFunc("/{id}/state", w.basicAuth(w.user, w.thing.state))
-	w.mux.HandleFunc("/{id}", w.basicAuth(w.user, w.thing.home))
-	w.mux.HandleFunc("/", w.basicAuth(w.user, w.thing.home))
+	w.mux.HandleFunc("/ws/{id}", w.basicAuth(w.thing.ws))
+	w.mux.HandleFunc("/state", w.basicAuth(w.thing.state))
+	w.mux.HandleFunc("/{id}/state", w.basicAuth(w.thing.state))
+	w.mux.HandleFunc("/{id}/history", w.basicAuth(w.thing.historyHandler))
+	w.mux.HandleFunc("/{id}/track", w.basicAuth(w.thing.trackHandler))
+	w.mux.HandleFunc("/{id}/runtime", w.basicAuth(w.thing.runtimeHandler))
+	w.mux.HandleFunc("/{id}/api/state", w.basicAuth(w.thing.apiState))
+	w.mux.HandleFunc("/{id}/api/msg", w.basicAuth(w.thing.apiMsg))
+	w.mux.HandleFunc("/{id}/api/history", w.basicAuth(w.thing.apiHistory))
+	// Webhooks are signed, not Basic authed (see Cfg.WebhookSecret)
+	w.mux.HandleFunc("/{id}/webhook/{msg}", w.thing.webhook)
+	w.mux.HandleFunc("/{id}/lora", w.basicAuth(w.thing.loraHandler))
+	w.mux.HandleFunc("/{id}/events", w.basicAuth(w.thing.events))
+	w.mux.HandleFunc("/{id}/grafana/", w.basicAuth(w.thing.grafanaTest))
+	w.mux.HandleFunc("/{id}/grafana/search", w.basicAuth(w.thing.grafanaSearch))
+	w.mux.HandleFunc("/{id}/grafana/metrics", w.basicAuth(w.thing.grafanaSearch))
+	w.mux.HandleFunc("/{id}/grafana/query", w.basicAuth(w.thing.grafanaQuery))
+	w.mux.PathPrefix("/bundles/").Handler(w.basicAuth(w.thing.bundles.handler().ServeHTTP))
+	w.mux.HandleFunc("/merle.js", merleJSHandler)
+	if t := w.thing; t.auth != nil {
+		w.mux.HandleFunc("/admin", w.basicAuth(t.adminOnly(t.adminHome)))
+		w.mux.HandleFunc("/admin/user", w.basicAuth(t.adminOnly(t.adminUser)))
+		w.mux.HandleFunc("/admin/token", w.basicAuth(t.adminOnly(t.adminToken)))
+		w.mux.HandleFunc("/admin/tenant", w.basicAuth(t.adminOnly(t.adminTenant)))
+		if t.provision != nil {
+			w.mux.HandleFunc("/admin/claim", w.basicAuth(t.adminOnly(t.adminClaim)))
+			w.mux.HandleFunc("/admin/claims", w.basicAuth(t.claimsAPI))
+		}
+	}
+	if t := w.thing; t.provision != nil {
+		w.mux.HandleFunc("/claim", t.claimHandler)
+	}
+	w.mux.HandleFunc("/{id}/{page}", w.basicAuth(w.thing.page)).
+		MatcherFunc(w.thing.isPage)
+	w.mux.HandleFunc("/{id}", w.basicAuth(w.thing.home))
+	w.mux.HandleFunc("/", w.basicAuth(w.thing.home))
 
 	w.server = &http.Server{
 		Addr:    w.addr,
-		Handler: w.mux,
+		Handler: w.handler(),
 		// TODO add timeouts
 	}
 
 	if w.portTLS != 0 {
-		w.server.Handler = w.certManager.HTTPHandler(nil)
+		w.server.Handler = w.thing.logAccess("public",
+			w.certManager.HTTPHandler(nil))
 	}
 
 	w.serverTLS = &http.Server{
 		Addr:    w.addrTLS,
-		Handler: w.mux,
+		Handler: w.handler(),
 		// TODO add timeouts
 		TLSConfig: &tls.Config{
-			GetCertificate: w.certManager.GetCertificate,
+			GetCertificate: w.getCertificate,
 		},
 	}
 }
 
+// Handler for the public servers: Thing's routes, under Cfg.BasePath, with
+// security headers, network filtering, and access logging
+func (w *webPublic) handler() http.Handler {
+	return w.thing.logAccess("public", w.secure(w.filter(w.routes())))
+}
+
+// Thing's routes, under Cfg.BasePath
+func (w *webPublic) routes() http.Handler {
+	base := w.thing.Cfg.BasePath
+	if base == "" {
+		return w.mux
+	}
+	return http.StripPrefix(base, http.HandlerFunc(
+		func(writer http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "":
+				// BasePath itself is Thing's home page
+				r.URL.Path = "/"
+			case !strings.HasPrefix(r.URL.Path, "/"):
+				// Not under BasePath; just sharing its prefix
+				http.NotFound(writer, r)
+				return
+			}
+			w.mux.ServeHTTP(writer, r)
+		}))
+}
+
 func (w *webPublic) httpShutdown() {
 	// Close all WebSocket connections on bus
 	w.thing.bus.close()
 	w.Done()
 }
 
-func (w *webPublic) start() {
+// Start the public HTTP and HTTPS servers.  The servers' ports are bound
+// before returning, so an error is returned if a port is in use.
+func (w *webPublic) start() error {
 	if w.running {
-		return
+		return nil
 	}
-	w.running = true
 
 	if w.port == 0 {
 		w.thing.log.println("Skipping public HTTP server; port is zero")
-		return
+		w.running = true
+		return nil
+	}
+
+	if err := w.bindPorts(); err != nil {
+		return err
 	}
 
-	if w.user != "" {
+	lns, lnsTLS := w.lns, w.lnsTLS
+	w.lns, w.lnsTLS = nil, nil
+
+	w.running = true
+
+	if user := w.getUser(); user != "" {
 		w.thing.log.printf("Basic HTTP Authentication enabled for user \"%s\"",
-			w.user)
+			user)
 	}
 
-	w.Add(2)
+	w.Add(1 + len(lns))
 	w.server.RegisterOnShutdown(w.httpShutdown)
 
-	w.thing.log.println("Public HTTP server listening on port", w.server.Addr)
+	w.thing.log.println("Public HTTP server listening on", listenAddrs(lns))
 
-	go func() {
-		if err := w.server.ListenAndServe(); err != http.ErrServerClosed {
-			w.thing.log.fatalln("Public HTTP server failed:", err)
-		}
-		w.Done()
-	}()
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			if err := w.server.Serve(ln); err != http.ErrServerClosed {
+				w.thing.lifecycle.fail("web public", err)
+			}
+			w.Done()
+		}(ln)
+	}
 
-	if w.portTLS == 0 {
+	if lnsTLS == nil {
 		w.thing.log.println("Skipping public HTTPS server; port is zero")
-		return
+		return nil
 	}
 
-	w.Add(2)
+	w.Add(1 + len(lnsTLS))
 	w.serverTLS.RegisterOnShutdown(w.Done)
 
-	w.thing.log.println("Public HTTPS server listening on port", w.serverTLS.Addr)
-
-	go func() {
-		// TODO Consider passing in optional certificate and key to
-		// TODO ListenAndServeTLS to self-sign server.  See
-		// TODO https://www.vultr.com/ja/docs/secure-a-golang-web-server-with-a-selfsigned-or-lets-encrypt-ssl-certificate/#2__Secure_the_Server_with_a_Self_Signed_Certificate
-		// TODO Note: self-signing is needed if server is accessed with IP rather
-		// TODO than DNS because Let's Encrypt wants a server name (DNS name),
-		// TODO and not an IP addr.
-		if err := w.serverTLS.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
-			w.thing.log.fatalln("Public HTTPS server failed:", err)
+	w.thing.log.println("Public HTTPS server listening on", listenAddrs(lnsTLS))
+
+	for _, ln := range lnsTLS {
+		go func(ln net.Listener) {
+			// TODO Consider passing in optional certificate and key to
+			// TODO ListenAndServeTLS to self-sign server.  See
+			// TODO https://www.vultr.com/ja/docs/secure-a-golang-web-server-with-a-selfsigned-or-lets-encrypt-ssl-certificate/#2__Secure_the_Server_with_a_Self_Signed_Certificate
+			// TODO Note: self-signing is needed if server is accessed with IP rather
+			// TODO than DNS because Let's Encrypt wants a server name (DNS name),
+			// TODO and not an IP addr.
+			if err := w.serverTLS.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+				w.thing.lifecycle.fail("web public", err)
+			}
+			w.Done()
+		}(ln)
+	}
+
+	return nil
+}
+
+func (w *webPublic) getUser() string {
+	w.cfgLock.RLock()
+	defer w.cfgLock.RUnlock()
+	return w.user
+}
+
+func (w *webPublic) setUser(user string) {
+	w.cfgLock.Lock()
+	defer w.cfgLock.Unlock()
+	w.user = user
+}
+
+// Load TLS certificate from cert files, if given.  On error, the previously
+// loaded certificate, if any, is kept.
+func (w *webPublic) loadCert() error {
+	w.cfgLock.Lock()
+	defer w.cfgLock.Unlock()
+
+	if w.certFile == "" {
+		w.cert = nil
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	w.cert = &cert
+
+	return nil
+}
+
+func (w *webPublic) setCertFiles(certFile, keyFile string) error {
+	w.cfgLock.Lock()
+	w.certFile, w.keyFile = certFile, keyFile
+	w.cfgLock.Unlock()
+
+	return w.loadCert()
+}
+
+// Use certificate from cert files, if given, otherwise get a certificate
+// from Let's Encrypt
+func (w *webPublic) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.cfgLock.RLock()
+	cert := w.cert
+	w.cfgLock.RUnlock()
+
+	if cert != nil {
+		return cert, nil
+	}
+
+	return w.certManager.GetCertificate(hello)
+}
+
+// Bind the public ports, if not already bound, ahead of start, so the
+// ports can be bound while Thing still has the privileges to (see
+// Cfg.RunAs)
+func (w *webPublic) bindPorts() error {
+	if w.running || w.port == 0 || w.lns != nil {
+		return nil
+	}
+
+	lns, err := listen(w.bind, w.port)
+	if err != nil {
+		return err
+	}
+
+	var lnsTLS []net.Listener
+	if w.portTLS != 0 {
+		err := w.loadCert()
+		if err == nil {
+			lnsTLS, err = listen(w.bindTLS, w.portTLS)
 		}
-		w.Done()
-	}()
+		if err != nil {
+			closeListeners(lns)
+			return err
+		}
+	}
+
+	w.lns, w.lnsTLS = lns, lnsTLS
+	return nil
 }
 
 func (w *webPublic) stop() {
+	if !w.running {
+		// Ports bound, but never served
+		closeListeners(w.lns)
+		closeListeners(w.lnsTLS)
+		w.lns, w.lnsTLS = nil, nil
+		return
+	}
+	w.running = false
+
 	if w.portTLS != 0 {
 		w.serverTLS.Shutdown(context.Background())
 	}
@@ -415,54 +891,117 @@ type webPrivate struct {
 	thing *Thing
 	sync.WaitGroup
 	port   uint
+	bind   []string
 	mux    *mux.Router
 	server *http.Server
+	// Ports bound ahead of start, by bindPorts
+	lns []net.Listener
 }
 
 func newWebPrivate(t *Thing, port uint) *webPrivate {
 	addr := ":" + strconv.FormatUint(uint64(port), 10)
 
 	mux := mux.NewRouter()
-	mux.HandleFunc("/ws", t.ws)
+	mux.HandleFunc("/ws", t.wsMother)
+	mux.HandleFunc("/reload", t.reloadHandler)
+	mux.HandleFunc("/drift", t.driftHandler)
+	mux.HandleFunc("/errors", t.errorsHandler)
+	mux.HandleFunc("/config", t.configHandler)
 
 	server := &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: t.logAccess("private", mux),
 		// TODO add timeouts
 	}
 
 	return &webPrivate{
 		thing:  t,
 		port:   port,
+		bind:   t.Cfg.BindPrivate,
 		mux:    mux,
 		server: server,
 	}
 }
 
-func (w *webPrivate) start() {
-	if w.port == 0 {
+// Start the private HTTP server.  The server's port is bound before
+// returning, so an error is returned if the port is in use.
+func (w *webPrivate) start() error {
+	// With port zero, any free port is picked, but only if there's a
+	// mother to tunnel to the private server
+	if w.port == 0 && !w.thing.tunnel.hasMother() {
 		w.thing.log.println("Skipping private HTTP server; port is zero")
-		return
+		return nil
+	}
+
+	if err := w.bindPorts(); err != nil {
+		return err
 	}
 
-	w.Add(2)
+	lns := w.lns
+	w.lns = nil
+
+	w.Add(1 + len(lns))
 	w.server.RegisterOnShutdown(w.Done)
 
-	w.thing.log.println("Private HTTP server listening on port", w.server.Addr)
+	w.thing.log.println("Private HTTP server listening on", listenAddrs(lns))
+
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			if err := w.server.Serve(ln); err != http.ErrServerClosed {
+				w.thing.lifecycle.fail("web private", err)
+			}
+			w.Done()
+		}(ln)
+	}
+
+	return nil
+}
+
+// Bind the private port, if not already bound, ahead of start (see
+// webPublic.bindPorts)
+func (w *webPrivate) bindPorts() error {
+	if w.lns != nil {
+		return nil
+	}
+	if w.port == 0 && !w.thing.tunnel.hasMother() {
+		return nil
+	}
 
-	go func() {
-		if err := w.server.ListenAndServe(); err != http.ErrServerClosed {
-			w.thing.log.fatalln("Private HTTP server failed:", err)
+	lns, err := listen(w.bind, w.port)
+	if err != nil {
+		return err
+	}
+
+	if w.port == 0 {
+		// Keep the picked port across restarts
+		w.port = uint(lns[0].Addr().(*net.TCPAddr).Port)
+		w.server.Addr = ":" + strconv.FormatUint(uint64(w.port), 10)
+		w.thing.tunnel.setPortPrivate(w.port)
+		if w.thing.standby != nil {
+			w.thing.standby.setPortPrivate(w.port)
 		}
-		w.Done()
-	}()
+		w.thing.log.println("Private HTTP server picked port", w.port)
+	}
+
+	w.lns = lns
+	return nil
 }
 
 func (w *webPrivate) stop() {
+	// Port bound, but never served
+	closeListeners(w.lns)
+	w.lns = nil
+
 	if w.port != 0 {
 		w.server.Shutdown(context.Background())
 	}
 	w.Wait()
+
+	// A server can't restart once it's shutdown
+	w.server = &http.Server{
+		Addr:    w.server.Addr,
+		Handler: w.server.Handler,
+	}
 }
 
 func (w *webPrivate) getPrimePort(writer http.ResponseWriter, r *http.Request) {
@@ -476,23 +1015,53 @@ func (w *webPrivate) getBridgePort(writer http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	if w.thing.bridge.isBlocked(id) {
+		fmt.Fprintf(writer, ErrBlocked.Code)
+		return
+	}
+
+	if w.thing.bridge.full(id) {
+		w.thing.log.printf("Bridge full: MaxChildren %d attached; turning away [%s]",
+			w.thing.Cfg.MaxChildren, id)
+		fmt.Fprintf(writer, ErrBridgeFull.Code)
+		return
+	}
+
 	port := w.thing.bridge.ports.getPort(id)
 
 	switch port {
 	case -1:
-		fmt.Fprintf(writer, "no ports available")
+		fmt.Fprintf(writer, ErrNoPortsAvailable.Code)
 	case -2:
-		fmt.Fprintf(writer, "port busy")
+		// Busy port and child online: likely another Thing with the
+		// same Id
+		if child := w.thing.getChild(id); child != nil &&
+			w.thing.bridge.childOnline(child) {
+			w.thing.log.printf("Child [%s] already attached; duplicate Id?", id)
+			fmt.Fprintf(writer, ErrDuplicateId.Code)
+			return
+		}
+		fmt.Fprintf(writer, ErrPortBusy.Code)
 	default:
 		fmt.Fprintf(writer, "%d", port)
 	}
 }
 
 type webSocket struct {
-	thing *Thing
-	name  string
-	flags uint32
-	conn  *websocket.Conn
+	thing  *Thing
+	name   string
+	flags  uint32
+	conn   *websocket.Conn
+	chaos  *chaos
+	quiet  time.Duration
+	pinger *time.Ticker
+	done   chan bool
+	rate   float64
+	tokens float64
+	last   time.Time
+	link   *seqLink
+	user   string
+	auth   *AuthUser
 }
 
 func newWebSocket(thing *Thing, name string, conn *websocket.Conn) *webSocket {
@@ -500,7 +1069,38 @@ func newWebSocket(thing *Thing, name string, conn *websocket.Conn) *webSocket {
 }
 
 func (ws *webSocket) Send(p *Packet) error {
-	return ws.conn.WriteMessage(websocket.TextMessage, p.msg)
+	msg := p.msg
+
+	// Redact messages leaving for mother
+	if ws.flags&sock_flag_mother != 0 {
+		msg = ws.thing.redactMsg(msg)
+	}
+
+	if ws.link != nil {
+		return ws.link.send(ws, msg)
+	}
+
+	return ws.write(msg)
+}
+
+func (ws *webSocket) write(msg []byte) error {
+	if ws.chaos != nil {
+		return ws.chaos.send(msg)
+	}
+
+	return ws.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (ws *webSocket) stopChaos() {
+	if ws.chaos != nil {
+		ws.chaos.stop()
+	}
+}
+
+// Stop the WebSocket's chaos and keepalive, once unplugged
+func (ws *webSocket) stop() {
+	ws.stopChaos()
+	ws.stopKeepalive()
 }
 
 func (ws *webSocket) Close() {
@@ -0,0 +1,237 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type dashboard struct {
+	html string
+}
+
+func (d *dashboard) Subscribers() Subscribers {
+	return Subscribers{}
+}
+
+func (d *dashboard) Assets() *ThingAssets {
+	return &ThingAssets{HtmlTemplateText: d.html}
+}
+
+func (d *dashboard) TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"celsius": func(f float64) string {
+			return fmt.Sprintf("%.1fC", (f-32)*5/9)
+		},
+	}
+}
+
+func (d *dashboard) TemplateParams(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"Temp":  212.0,
+		"Beta":  r.URL.Query().Get("beta") != "",
+		"Model": "not mine",
+	}
+}
+
+func TestTemplater(t *testing.T) {
+	thing := NewThing(&dashboard{
+		html: `{{celsius .Temp}} {{.Beta}} {{.Model}}`,
+	})
+	thing.Cfg.Id = testId
+	thing.Cfg.Model = "dashboard"
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/?beta=1", nil)
+	w := httptest.NewRecorder()
+	thing.web.public.mux.ServeHTTP(w, req)
+
+	if got, want := w.Body.String(), "100.0C true dashboard"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+type settings struct {
+	dashboard
+}
+
+func (s *settings) Assets() *ThingAssets {
+	return &ThingAssets{
+		HtmlTemplateText: "home",
+		Pages: map[string]ThingPage{
+			"settings": {TemplateText: `settings {{.Id}} {{celsius .Temp}}`},
+			"broken":   {TemplateText: `{{.Id`},
+			"state":    {TemplateText: `mine`},
+		},
+	}
+}
+
+func TestPages(t *testing.T) {
+	thing := NewThing(&settings{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		thing.web.public.mux.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/" + testId, http.StatusOK, "home"},
+		{"/" + testId + "/settings", http.StatusOK, "settings " + testId + " 100.0C"},
+		{"/" + testId + "/missing", http.StatusNotFound, ""},
+		{"/" + testId + "/broken", http.StatusNotFound, ""},
+		{"/other/settings", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		code, body := get(test.path)
+		if code != test.code || (test.body != "" && body != test.body) {
+			t.Errorf("GET %s: %d %q, want %d %q", test.path, code, body,
+				test.code, test.body)
+		}
+	}
+
+	// Reserved name doesn't take the route
+	if code, body := get("/" + testId + "/state"); code != http.StatusOK ||
+		body == "mine" {
+		t.Errorf("GET state: %d %q", code, body)
+	}
+
+	codes := 0
+	for _, e := range thing.Errors() {
+		if e.Code == ErrTemplateParse.Code {
+			codes++
+		}
+	}
+	if codes != 1 {
+		t.Errorf("Errors %+v", thing.Errors())
+	}
+}
+
+type camera struct {
+	dashboard
+}
+
+func (c *camera) PublicHandlers() WebHandlers {
+	return WebHandlers{
+		"snapshot.jpg": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("jpeg"))
+		},
+	}
+}
+
+func (c *camera) PrivateHandlers() WebHandlers {
+	return WebHandlers{
+		"/export.csv": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("a,b"))
+		},
+	}
+}
+
+func TestWebHandler(t *testing.T) {
+	thing := NewThing(&camera{})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	thing.Cfg.User = "merle"
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(h http.Handler, path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	// Public routes need auth, like the UI
+	if code, _ := get(thing.web.public.mux, "/"+testId+"/snapshot.jpg"); code !=
+		http.StatusUnauthorized {
+		t.Errorf("Snapshot without auth: %d", code)
+	}
+
+	thing.web.public.setUser("")
+	if code, body := get(thing.web.public.mux, "/"+testId+"/snapshot.jpg"); code !=
+		http.StatusOK || body != "jpeg" {
+		t.Errorf("Snapshot: %d %q", code, body)
+	}
+
+	if code, body := get(thing.web.private.mux, "/export.csv"); code !=
+		http.StatusOK || body != "a,b" {
+		t.Errorf("Export: %d %q", code, body)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	thing := NewThing(&dashboard{
+		html: `{{.BasePath}} {{.AssetsDir}} {{.WebSocket}}`,
+	})
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPublic = 8080
+	thing.Cfg.BasePath = "/things/garage"
+	if err := thing.build(true); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "example.com"
+		w := httptest.NewRecorder()
+		thing.web.public.handler().ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	home := "/things/garage things/garage/" + testId + "/assets " +
+		"ws://example.com/things/garage/ws/" + testId
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/things/garage", http.StatusOK, home},
+		{"/things/garage/" + testId, http.StatusOK, home},
+		{"/things/garage/state", http.StatusOK, ""},
+		{"/things/garagedoor", http.StatusNotFound, ""},
+		{"/" + testId, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		code, body := get(test.path)
+		if code != test.code || (test.body != "" && body != test.body) {
+			t.Errorf("GET %s: %d %q, want %d %q", test.path, code, body,
+				test.code, test.body)
+		}
+	}
+
+	for _, bad := range []string{"things", "/things/", "/things/../x", "/"} {
+		thing := NewThing(&dashboard{})
+		thing.Cfg.Id = testId
+		thing.Cfg.BasePath = bad
+		if err := thing.build(false); ErrorCode(err) != ErrBadConfig.Code {
+			t.Errorf("BasePath %q: %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+	"strings"
+)
+
+// WebHandlers is a map of HTTP handlers, keyed by path.  A path may have
+// gorilla/mux variables, e.g. "export/{day}.csv", read in the handler with
+// mux.Vars.
+type WebHandlers map[string]http.HandlerFunc
+
+// WebHandler is implemented by a Thinger to serve its own HTTP routes, e.g.
+// a camera snapshot or a CSV export.
+//
+//	func (t *thing) PublicHandlers() merle.WebHandlers {
+//		return merle.WebHandlers{
+//			"snapshot.jpg": t.snapshot,
+//		}
+//	}
+//
+// PublicHandlers are served on the public HTTP(S) server under /{id}/, e.g.
+// /{id}/snapshot.jpg, with the same authentication as Thing's UI.  A
+// bridge's children's PublicHandlers are served too.  PrivateHandlers are
+// served on the private HTTP server, for local tools, under /, e.g.
+// /export.csv.  Thing's own routes, e.g. /{id}/state, and Thing's pages
+// (see ThingAssets.Pages) take priority.  Routes are registered when Thing
+// is built (or a child attaches); a Thinger swapped in later (see
+// SwapThinger) handles the routes its predecessor registered.
+type WebHandler interface {
+	PublicHandlers() WebHandlers
+	PrivateHandlers() WebHandlers
+}
+
+// Register thing's WebHandler routes.  Thing may be a bridge's child, whose
+// private routes aren't served.
+func (w *web) thingHandlers(thing *Thing) {
+	handler, ok := thing.thinger.(WebHandler)
+	if !ok {
+		return
+	}
+
+	for path := range handler.PublicHandlers() {
+		route := "/" + thing.id + "/" + strings.TrimPrefix(path, "/")
+		w.public.mux.HandleFunc(route,
+			w.public.basicAuth(thing.webHandler(path, true)))
+	}
+
+	if thing != w.private.thing {
+		return
+	}
+
+	for path := range handler.PrivateHandlers() {
+		route := "/" + strings.TrimPrefix(path, "/")
+		w.private.mux.HandleFunc(route, thing.webHandler(path, false))
+	}
+}
+
+// Handler for path, looked up on each request, as SwapThinger may change
+// Thing's Thinger
+func (t *Thing) webHandler(path string, public bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var f http.HandlerFunc
+		if handler, ok := t.getThinger().(WebHandler); ok {
+			if public {
+				f = handler.PublicHandlers()[path]
+			} else {
+				f = handler.PrivateHandlers()[path]
+			}
+		}
+		if f == nil {
+			http.NotFound(w, r)
+			return
+		}
+		f(w, r)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// PushSubscription is a browser's Web Push subscription, as from the
+// browser's PushSubscription.toJSON()
+type PushSubscription struct {
+	Endpoint string
+	Keys     struct {
+		// Browser's P-256 public key and auth secret, base64url
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	}
+}
+
+var b64 = base64.RawURLEncoding
+
+// Decode base64url, padded or not
+func b64Decode(s string) ([]byte, error) {
+	return b64.DecodeString(string(bytes.TrimRight([]byte(s), "=")))
+}
+
+// VAPID key from the base64url private key, d
+func vapidKey(private string) (*ecdsa.PrivateKey, error) {
+	d, err := b64Decode(private)
+	if err != nil || len(d) != 32 {
+		return nil, fmt.Errorf("VAPID private key must be 32 bytes, base64url")
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d)
+	return key, nil
+}
+
+// Encrypt payload for sub, as aes128gcm content (RFC 8291)
+func pushEncrypt(sub *PushSubscription, payload []byte) ([]byte, error) {
+	curve := elliptic.P256()
+
+	uaPublic, err := b64Decode(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := b64Decode(sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, fmt.Errorf("Bad subscription key")
+	}
+
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sx, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	secret := make([]byte, 32)
+	sx.FillBytes(secret)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	expand := func(r io.Reader, n int) []byte {
+		out := make([]byte, n)
+		io.ReadFull(r, out)
+		return out
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := expand(hkdf.New(sha256.New, secret, authSecret, keyInfo), 32)
+
+	cek := expand(hkdf.New(sha256.New, ikm, salt,
+		[]byte("Content-Encoding: aes128gcm\x00")), 16)
+	nonce := expand(hkdf.New(sha256.New, ikm, salt,
+		[]byte("Content-Encoding: nonce\x00")), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// One record, so pad with just the last record delimiter
+	plain := append(append([]byte(nil), payload...), 2)
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(4096))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(gcm.Seal(nil, nonce, plain, nil))
+
+	return body.Bytes(), nil
+}
+
+// VAPID Authorization header (RFC 8292) for endpoint
+func vapidAuth(key *ecdsa.PrivateKey, subject, endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	claims, _ := jsonMarshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	unsigned := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) +
+		"." + b64.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	public := elliptic.Marshal(key.Curve, key.X, key.Y)
+	return "vapid t=" + unsigned + "." + b64.EncodeToString(sig) +
+		", k=" + b64.EncodeToString(public), nil
+}
+
+// Push payload to sub.  gone is true if the subscription has expired.
+func webPush(client *http.Client, key *ecdsa.PrivateKey, subject string,
+	sub *PushSubscription, payload []byte) (gone bool, err error) {
+
+	body, err := pushEncrypt(sub, payload)
+	if err != nil {
+		return false, err
+	}
+	auth, err := vapidAuth(key, subject, sub.Endpoint)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Authorization", auth)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound,
+		resp.StatusCode == http.StatusGone:
+		return true, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	return false, nil
+}